@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"zrb/internal/config"
+
+	"github.com/urfave/cli/v3"
+)
+
+// completionFlag is what the completion scripts append to the command line to ask for candidates.
+const completionFlag = "--generate-shell-completion"
+
+// fishValueCompletion completes the values of --task, --level and --source in fish, whose script
+// urfave/cli generates statically from the flags.
+const fishValueCompletion = `
+function __fish_zrb_complete_value
+    set -l args (commandline -opc)
+    $args %s 2>/dev/null
+end
+complete -c zrb -n 'contains -- (commandline -opc)[-1] --task --level --source' -f -a '(__fish_zrb_complete_value)'
+`
+
+// completing reports whether zrb runs to print completion candidates rather than a command.
+func completing() bool {
+	return len(os.Args) > 1 && os.Args[len(os.Args)-1] == completionFlag
+}
+
+// setShellComplete makes cmd and its subcommands complete flag values with completeValues.
+func setShellComplete(cmd *cli.Command) {
+	cmd.ShellComplete = shellComplete
+	for _, sub := range cmd.Commands {
+		setShellComplete(sub)
+	}
+}
+
+func shellComplete(ctx context.Context, cmd *cli.Command) {
+	args := os.Args[1:]
+	if len(args) > 0 && args[len(args)-1] == completionFlag {
+		args = args[:len(args)-1]
+	}
+	if completeValues(cmd.Root().Writer, args) {
+		return
+	}
+	cli.DefaultCompleteWithFlags(ctx, cmd)
+}
+
+// completeValues writes the candidates for the value of the flag args end with, and reports
+// whether that flag takes one it knows. Task names and levels come from the config file of
+// --config, or zrb_config.yaml; a config that cannot be read yields no candidates, never an error,
+// as anything written ends up in the completion list.
+func completeValues(w io.Writer, args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	switch strings.TrimLeft(args[len(args)-1], "-") {
+	case "task":
+		cfg, err := config.Peek(configArg(args))
+		if err != nil {
+			return true
+		}
+		for _, t := range cfg.Tasks {
+			fmt.Fprintln(w, t.Name)
+		}
+	case "level":
+		cfg, err := config.Peek(configArg(args))
+		if err != nil {
+			return true
+		}
+		for level := int16(0); ; level++ {
+			if _, err := cfg.DataStorageClass(level); err != nil {
+				break
+			}
+			fmt.Fprintln(w, level)
+		}
+	case "source":
+		fmt.Fprintln(w, "local")
+		fmt.Fprintln(w, "s3")
+	default:
+		return false
+	}
+	return true
+}
+
+// configArg returns the value of --config in args, or the default of the flag.
+func configArg(args []string) string {
+	path := "zrb_config.yaml"
+	for i, arg := range args {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "config" {
+			continue
+		}
+		if hasValue {
+			path = value
+		} else if i+1 < len(args) {
+			path = args[i+1]
+		}
+	}
+	return path
+}
+
+// configureCompletionCommand lists the completion command in the help and adds the value
+// completion to the fish script.
+func configureCompletionCommand(cmd *cli.Command) {
+	cmd.Hidden = false
+	cmd.Usage = "Print the shell completion script for bash, zsh or fish"
+	action := cmd.Action
+	cmd.Action = func(ctx context.Context, cmd *cli.Command) error {
+		if err := action(ctx, cmd); err != nil || cmd.Args().First() != "fish" {
+			return err
+		}
+		_, err := fmt.Fprintf(cmd.Writer, fishValueCompletion, completionFlag)
+		return err
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompleteValues(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(`base_dir: /var/lib/zrb
+age_public_key: age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+s3:
+  enabled: true
+  bucket: b
+  region: us-east-1
+  storage_class:
+    manifest: STANDARD
+    backup_data: [STANDARD, STANDARD_IA, GLACIER]
+tasks:
+  - name: home
+    pool: tank
+    dataset: home
+  - name: media
+    pool: tank
+    dataset: media
+`), 0o644))
+
+	complete := func(args ...string) (string, bool) {
+		var out bytes.Buffer
+		ok := completeValues(&out, args)
+		return out.String(), ok
+	}
+
+	out, ok := complete("backup", "--config", configPath, "--task")
+	assert.True(t, ok)
+	assert.Equal(t, "home\nmedia\n", out)
+	out, _ = complete("restore", "--config="+configPath, "--level", "1", "--task")
+	assert.Equal(t, "home\nmedia\n", out, "--config=path")
+	out, _ = complete("list", "--config", configPath, "--level")
+	assert.Equal(t, "0\n1\n2\n", out, "a level per storage class")
+	out, _ = complete("list", "--source")
+	assert.Equal(t, "local\ns3\n", out)
+
+	out, ok = complete("backup", "--config", filepath.Join(dir, "missing.yaml"), "--task")
+	assert.True(t, ok)
+	assert.Empty(t, out, "a missing config completes nothing rather than an error")
+
+	t.Chdir(dir)
+	require.NoError(t, os.Rename(configPath, filepath.Join(dir, "zrb_config.yaml")))
+	out, _ = complete("verify", "--task")
+	assert.Equal(t, "home\nmedia\n", out, "the default config path")
+
+	_, ok = complete("backup", "--config")
+	assert.False(t, ok, "other flags fall back to the default completion")
+	_, ok = complete()
+	assert.False(t, ok)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"time"
+	"zrb/internal/units"
+
+	"github.com/urfave/cli/v3"
+)
+
+// durationFlag is a cli.DurationFlag that parses with units.ParseDuration, so flags accept 7d
+// and 2w like the config file does. cmd.Duration reads it.
+type durationFlag = cli.FlagBase[time.Duration, cli.NoConfig, durationValue]
+
+type durationValue time.Duration
+
+func (d durationValue) Create(val time.Duration, p *time.Duration, _ cli.NoConfig) cli.Value {
+	*p = val
+	return (*durationValue)(p)
+}
+
+func (d durationValue) ToString(val time.Duration) string {
+	return val.String()
+}
+
+func (d *durationValue) Set(s string) error {
+	v, err := units.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = durationValue(v)
+	return nil
+}
+
+func (d *durationValue) Get() any { return time.Duration(*d) }
+
+func (d *durationValue) String() string { return time.Duration(*d).String() }
@@ -2,26 +2,119 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 	"zrb/internal/backup"
+	"zrb/internal/browse"
 	"zrb/internal/check"
+	"zrb/internal/cleanup"
+	"zrb/internal/config"
+	"zrb/internal/gc"
+	"zrb/internal/inspect"
 	"zrb/internal/keys"
+	"zrb/internal/legacy"
 	"zrb/internal/list"
+	"zrb/internal/prune"
+	"zrb/internal/repair"
 	"zrb/internal/restore"
+	"zrb/internal/shutdown"
+	"zrb/internal/stats"
+	"zrb/internal/status"
+	"zrb/internal/tracing"
+	"zrb/internal/verify"
+	"zrb/internal/version"
+	"zrb/internal/wizard"
 	"zrb/internal/zfs"
 
 	"github.com/urfave/cli/v3"
 )
 
+// standaloneFlags let list and restore run without a config file on a bare machine.
+func standaloneFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "bucket",
+			Usage: "S3 bucket; when set, no config file is used",
+		},
+		&cli.StringFlag{
+			Name:  "region",
+			Usage: "S3 region (required with --bucket)",
+		},
+		&cli.StringFlag{
+			Name:  "prefix",
+			Usage: "S3 prefix (with --bucket)",
+		},
+		&cli.StringFlag{
+			Name:  "task-prefix",
+			Usage: "Per-task s3_prefix the backups were written with (with --bucket)",
+		},
+		&cli.StringFlag{
+			Name:  "endpoint",
+			Usage: "Custom S3 endpoint (with --bucket)",
+		},
+		&cli.StringFlag{
+			Name:  "pool",
+			Usage: "Original ZFS pool name (required with --bucket)",
+		},
+		&cli.StringFlag{
+			Name:  "dataset",
+			Usage: "Original ZFS dataset name (required with --bucket)",
+		},
+	}
+}
+
+func standaloneFromFlags(cmd *cli.Command) config.Standalone {
+	return config.Standalone{
+		Bucket:     cmd.String("bucket"),
+		Region:     cmd.String("region"),
+		Prefix:     cmd.String("prefix"),
+		TaskPrefix: cmd.String("task-prefix"),
+		Endpoint:   cmd.String("endpoint"),
+		Pool:       cmd.String("pool"),
+		Dataset:    cmd.String("dataset"),
+	}
+}
+
+// startTracing exports spans to the collector set in otel.endpoint of the config, if any. The
+// returned func flushes pending spans before the command exits.
+func startTracing(ctx context.Context, configPath string) func() {
+	otelCfg := config.ReadOtel(configPath)
+	if otelCfg.Endpoint == "" {
+		return func() {}
+	}
+	shutdown, err := tracing.Setup(ctx, otelCfg.Endpoint, otelCfg.Insecure)
+	if err != nil {
+		slog.Warn("Tracing disabled", "error", err)
+		return func() {}
+	}
+	return func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+		defer cancel()
+		if err := shutdown(ctx); err != nil {
+			slog.Warn("Failed to flush traces", "error", err)
+		}
+	}
+}
+
 func main() {
 	cmd := &cli.Command{
 		Name:    "zrb",
 		Usage:   "ZFS Remote Backup",
-		Version: "0.1.0",
+		Version: version.String(),
+		// Shell completion: zrb completion bash|zsh|fish prints the script.
+		EnableShellCompletion:           true,
+		ConfigureShellCompletionCommand: configureCompletionCommand,
+		Before: func(ctx context.Context, cmd *cli.Command) (context.Context, error) {
+			if !completing() {
+				slog.Info("zrb starting", append([]any{"args", os.Args[1:]}, version.LogAttrs()...)...)
+			}
+			return ctx, nil
+		},
 		Commands: []*cli.Command{
 			{
 				Name:  "check",
@@ -37,11 +130,69 @@ func main() {
 					return check.Run(ctx, cmd.String("config"))
 				},
 			},
+			{
+				Name:  "config",
+				Usage: "Inspect or create configuration files",
+				Commands: []*cli.Command{
+					{
+						Name:  "schema",
+						Usage: "Print the JSON Schema of the config file",
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+							schema, err := config.Schema()
+							if err != nil {
+								return err
+							}
+							_, err = os.Stdout.Write(schema)
+							return err
+						},
+					},
+					{
+						Name:  "init",
+						Usage: "Write a starter config and a new key pair, prompting for values not given as flags",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "output",
+								Usage: "path of the config file to write",
+								Value: "zrb_config.yaml",
+							},
+							&cli.StringFlag{Name: "base-dir", Usage: "base directory for backups"},
+							&cli.StringFlag{Name: "bucket", Usage: "S3 bucket name"},
+							&cli.StringFlag{Name: "region", Usage: "S3 region"},
+							&cli.StringFlag{Name: "prefix", Usage: "S3 key prefix"},
+							&cli.StringFlag{Name: "endpoint", Usage: "custom S3 endpoint (empty for AWS)"},
+							&cli.StringFlag{Name: "task", Usage: "task name (default pool_dataset)"},
+							&cli.StringFlag{Name: "pool", Usage: "ZFS pool name"},
+							&cli.StringFlag{Name: "dataset", Usage: "ZFS dataset name"},
+							&cli.BoolFlag{Name: "non-interactive", Usage: "fail on missing values instead of prompting"},
+						},
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+							return wizard.Init(ctx, wizard.Options{
+								Output:         cmd.String("output"),
+								BaseDir:        cmd.String("base-dir"),
+								Bucket:         cmd.String("bucket"),
+								Region:         cmd.String("region"),
+								Prefix:         cmd.String("prefix"),
+								Endpoint:       cmd.String("endpoint"),
+								TaskName:       cmd.String("task"),
+								Pool:           cmd.String("pool"),
+								Dataset:        cmd.String("dataset"),
+								NonInteractive: cmd.Bool("non-interactive"),
+							})
+						},
+					},
+				},
+			},
 			{
 				Name:  "genkey",
 				Usage: "Generate public and private key pair",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "passphrase",
+						Usage: "Encrypt the private key with a passphrase, prompted twice or read from ZRB_KEY_PASSPHRASE",
+					},
+				},
 				Action: func(ctx context.Context, cmd *cli.Command) error {
-					return keys.Generate(ctx)
+					return keys.Generate(ctx, cmd.Bool("passphrase"))
 				},
 			},
 			{
@@ -72,9 +223,9 @@ func main() {
 						Usage: "path to configuration yaml file",
 						Value: "zrb_config.yaml",
 					},
-					&cli.StringFlag{
+					&cli.StringSliceFlag{
 						Name:     "task",
-						Usage:    "Name of the backup task to run.",
+						Usage:    "Name of the backup task to run, or a glob such as 'prod-*'; repeat to run several tasks one after the other.",
 						Required: true,
 					},
 					&cli.Int16Flag{
@@ -82,9 +233,83 @@ func main() {
 						Usage:    "Backup level to perform.",
 						Required: true,
 					},
+					&cli.BoolFlag{
+						Name:  "reset-history",
+						Usage: "Start a new backup history with this level 0 backup, required after changing incremental_mode.",
+					},
+					&cli.StringFlag{
+						Name:  "resume-remote-key",
+						Usage: "Private key to decrypt the remote state of a backup interrupted on another host, and finish that backup (requires s3.remote_state).",
+					},
+					&cli.BoolFlag{
+						Name:  "accept-key-change",
+						Usage: "Continue the incremental chain although the age recipients changed since its parent backup; restoring then needs every key.",
+					},
+					&cli.BoolFlag{
+						Name:  "ignore-clock-skew",
+						Usage: "Back up even though the system clock is behind the newest snapshot or the last backup.",
+					},
+					&cli.BoolFlag{
+						Name:  "no-fsync",
+						Usage: "Do not flush parts to disk before recording them as done; only safe with a battery-backed write cache.",
+					},
+					&cli.BoolFlag{
+						Name:    "snapshot",
+						Aliases: []string{"create-snapshot"},
+						Usage:   "Take a fresh zrb_level<N> snapshot to back up, running the task's pre_snapshot and post_snapshot hooks around it; a resumed backup keeps its snapshot.",
+					},
+					&cli.BoolFlag{
+						Name:  "acknowledge-cost",
+						Usage: "Upload past s3.max_upload_bytes_per_backup, e.g. to resume a backup that stopped at the budget.",
+					},
+					&cli.BoolFlag{
+						Name:  "ignore-remote-state",
+						Usage: "Start over even though the remote state of an interrupted backup exists.",
+					},
+					&cli.BoolFlag{
+						Name:  "discard-state",
+						Usage: "Start fresh even though the local backup state cannot be read or was written by a newer zrb.",
+					},
+					&cli.BoolFlag{
+						Name:  "ignore-health-check",
+						Usage: "Back up even if the dataset is unmounted, below min_used_mb or on a degraded pool.",
+					},
+					&cli.BoolFlag{
+						Name:  "ignore-window",
+						Usage: "Upload right away, even outside the task's upload_window.",
+					},
+					&cli.BoolFlag{
+						Name:  "quiet",
+						Usage: "Do not show the progress line or log the progress periodically; the totals are still logged at the end.",
+					},
+					&cli.BoolFlag{
+						Name:  "anchor",
+						Usage: "Also upload an anchor, a summary of the part hashes encrypted to the recipients, which zrb verify checks the manifest against.",
+					},
 				},
 				Action: func(ctx context.Context, cmd *cli.Command) error {
-					return backup.Run(ctx, cmd.String("config"), cmd.Int16("level"), cmd.String("task"))
+					defer startTracing(ctx, cmd.String("config"))()
+					pause := make(chan os.Signal, 1)
+					signal.Notify(pause, syscall.SIGUSR1)
+					defer signal.Stop(pause)
+					return backup.RunTasks(ctx, backup.Options{
+						ConfigPath:        cmd.String("config"),
+						Level:             cmd.Int16("level"),
+						ResetHistory:      cmd.Bool("reset-history"),
+						IgnoreHealthCheck: cmd.Bool("ignore-health-check"),
+						ResumeRemoteKey:   cmd.String("resume-remote-key"),
+						IgnoreRemoteState: cmd.Bool("ignore-remote-state"),
+						DiscardState:      cmd.Bool("discard-state"),
+						AcceptKeyChange:   cmd.Bool("accept-key-change"),
+						IgnoreClockSkew:   cmd.Bool("ignore-clock-skew"),
+						NoFsync:           cmd.Bool("no-fsync"),
+						Snapshot:          cmd.Bool("snapshot"),
+						AcknowledgeCost:   cmd.Bool("acknowledge-cost"),
+						Anchor:            cmd.Bool("anchor"),
+						IgnoreWindow:      cmd.Bool("ignore-window"),
+						Quiet:             cmd.Bool("quiet"),
+						Pause:             pause,
+					}, cmd.StringSlice("task"))
 				},
 			},
 			{
@@ -108,22 +333,26 @@ func main() {
 					},
 				},
 				Action: func(ctx context.Context, cmd *cli.Command) error {
+					if err := zfs.CheckPermissions(cmd.String("pool")+"/"+cmd.String("dataset"), zfs.SnapshotPermissions); err != nil {
+						return err
+					}
 					return zfs.CreateSnapshot(cmd.String("pool"), cmd.String("dataset"), cmd.String("prefix"))
 				},
 			},
 			{
 				Name:  "list",
 				Usage: "List available backups",
-				Flags: []cli.Flag{
+				Description: "Without a config file (disaster recovery):\n" +
+					"  zrb list --source s3 --bucket my-bucket --region us-east-1 --prefix zfs-backups/ --pool pool --dataset data",
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:  "config",
 						Usage: "path to configuration yaml file",
 						Value: "zrb_config.yaml",
 					},
-					&cli.StringFlag{
-						Name:     "task",
-						Usage:    "Name of the backup task",
-						Required: true,
+					&cli.StringSliceFlag{
+						Name:  "task",
+						Usage: "Name of the backup task or a glob such as 'prod-*', repeatable (required with --config); several tasks print a JSON array",
 					},
 					&cli.Int16Flag{
 						Name:  "level",
@@ -132,27 +361,68 @@ func main() {
 					},
 					&cli.StringFlag{
 						Name:  "source",
-						Usage: "Data source: local or s3",
+						Usage: "Data source: local, s3, which reads from GCS when gcs is enabled, or both, which merges the two and marks where they differ",
 						Value: "local",
 					},
+					&cli.BoolFlag{
+						Name:  "strict",
+						Usage: "Exit non-zero when a backup's manifest cannot be read locally or from S3",
+					},
+					&cli.BoolFlag{
+						Name:  "scan",
+						Usage: "List the task manifests in the bucket instead of reading the last backup manifest (with --source s3)",
+					},
+				}, standaloneFlags()...),
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					return list.Run(ctx, list.Options{
+						ConfigPath:  cmd.String("config"),
+						Standalone:  standaloneFromFlags(cmd),
+						Tasks:       cmd.StringSlice("task"),
+						FilterLevel: cmd.Int16("level"),
+						Source:      cmd.String("source"),
+						Strict:      cmd.Bool("strict"),
+						Scan:        cmd.Bool("scan"),
+					})
+				},
+			},
+			{
+				Name:  "status",
+				Usage: "Show locks, unfinished backups and the last backup of each level",
+				Description: "Reads only the local run directories, so it is safe while a backup runs.\n" +
+					"  zrb status --config config.yaml",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "path to configuration yaml file",
+						Value: "zrb_config.yaml",
+					},
+					&cli.StringSliceFlag{
+						Name:  "task",
+						Usage: "Name of the backup task or a glob such as 'prod-*', repeatable; all tasks when omitted",
+					},
 				},
 				Action: func(ctx context.Context, cmd *cli.Command) error {
-					return list.Run(ctx, cmd.String("config"), cmd.String("task"), cmd.Int16("level"), cmd.String("source"))
+					return status.Run(status.Options{
+						ConfigPath: cmd.String("config"),
+						Tasks:      cmd.StringSlice("task"),
+					})
 				},
 			},
 			{
 				Name:  "restore",
 				Usage: "Restore backup from S3 or local",
-				Flags: []cli.Flag{
+				Description: "Without a config file (disaster recovery):\n" +
+					"  zrb restore --bucket my-bucket --region us-east-1 --prefix zfs-backups/ --pool pool --dataset data \\\n" +
+					"    --level 0 --target newpool/restored --private-key ./zrb_private.key",
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:  "config",
 						Usage: "path to configuration yaml file",
 						Value: "zrb_config.yaml",
 					},
 					&cli.StringFlag{
-						Name:     "task",
-						Usage:    "Name of the backup task",
-						Required: true,
+						Name:  "task",
+						Usage: "Name of the backup task (required with --config)",
 					},
 					&cli.Int16Flag{
 						Name:     "level",
@@ -171,9 +441,13 @@ func main() {
 					},
 					&cli.StringFlag{
 						Name:  "source",
-						Usage: "Data source: local or s3",
+						Usage: "Data source: local or s3, which reads from GCS when gcs is enabled",
 						Value: "s3",
 					},
+					&cli.StringFlag{
+						Name:  "manifest",
+						Usage: "Path to a local task_manifest.yaml to restore from, bypassing the last backup lookup",
+					},
 					&cli.BoolFlag{
 						Name:  "dry-run",
 						Usage: "Show what would be restored without actually restoring",
@@ -184,21 +458,579 @@ func main() {
 						Usage: "Pass -F to zfs receive, discarding uncommitted changes in the target dataset",
 						Value: false,
 					},
+					&cli.BoolFlag{
+						Name:  "allow-cross-host",
+						Usage: "Allow restoring over the original dataset from a different host than the backup was taken on",
+						Value: false,
+					},
+					&cli.BoolFlag{
+						Name:  "from-scratch",
+						Usage: "Destroy the target dataset (after confirmation) and receive again instead of skipping already received snapshots",
+						Value: false,
+					},
+					&cli.BoolFlag{
+						Name:  "chain",
+						Usage: "Receive the backups the level builds on first, from level 0 up, skipping those already received",
+					},
+					&cli.BoolFlag{
+						Name:  "skip-key-check",
+						Usage: "Do not check the private key against the public key recorded in the manifest",
+						Value: false,
+					},
+					&cli.StringFlag{
+						Name:  "work-dir",
+						Usage: "Directory for the restore scratch space (overrides restore.work_dir; default: system temp if it has room, else base_dir/tmp)",
+					},
+					&cli.BoolFlag{
+						Name:  "verify-checksums",
+						Usage: "Cross-check CHECKSUMS.blake3 against the manifest before restoring",
+					},
+					&cli.BoolFlag{
+						Name:  "acknowledge-cost",
+						Usage: "Download past s3.max_download_bytes_per_restore, e.g. to resume a restore that stopped at the budget",
+					},
+					&cli.StringFlag{
+						Name:  "receive-via-ssh",
+						Usage: "Pipe the verified stream into zfs receive on user@host over ssh instead of receiving locally",
+					},
+					&cli.StringSliceFlag{
+						Name:  "ssh-option",
+						Usage: "ssh_config option passed to ssh with -o, e.g. Port=2222 or IdentityFile=~/.ssh/restore (repeatable)",
+					},
+					&cli.BoolFlag{
+						Name:  "progress",
+						Usage: "Show the download, decrypt and receive rates on a line of stderr while it is a terminal",
+					},
+					&cli.BoolFlag{
+						Name:  "safe",
+						Usage: "Merge the parts into a file and verify the stream hash before zfs receive reads it, instead of streaming them into zfs receive; needs scratch space for the whole stream",
+					},
+				}, standaloneFlags()...),
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					defer startTracing(ctx, cmd.String("config"))()
+					return restore.Run(ctx, restore.Options{
+						ConfigPath:      cmd.String("config"),
+						Standalone:      standaloneFromFlags(cmd),
+						TaskName:        cmd.String("task"),
+						Level:           cmd.Int16("level"),
+						Target:          cmd.String("target"),
+						PrivateKeyPath:  cmd.String("private-key"),
+						Source:          cmd.String("source"),
+						ManifestPath:    cmd.String("manifest"),
+						DryRun:          cmd.Bool("dry-run"),
+						Force:           cmd.Bool("force"),
+						AllowCrossHost:  cmd.Bool("allow-cross-host"),
+						FromScratch:     cmd.Bool("from-scratch"),
+						Chain:           cmd.Bool("chain"),
+						SkipKeyCheck:    cmd.Bool("skip-key-check"),
+						VerifyChecksums: cmd.Bool("verify-checksums"),
+						WorkDir:         cmd.String("work-dir"),
+						AcknowledgeCost: cmd.Bool("acknowledge-cost"),
+						ReceiveViaSSH:   cmd.String("receive-via-ssh"),
+						SSHOptions:      cmd.StringSlice("ssh-option"),
+						Progress:        cmd.Bool("progress"),
+						Safe:            cmd.Bool("safe"),
+					})
+				},
+			},
+			{
+				Name:  "browse",
+				Usage: "Restore a backup into a temporary dataset and mount it read-only for browsing",
+				Description: "The target must not exist; it is destroyed on Ctrl-C or after --timeout.\n" +
+					"  zrb browse --task example_task --level 2 --target tank/zrb_browse_tmp --private-key ./zrb_private.key",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "path to configuration yaml file",
+						Value: "zrb_config.yaml",
+					},
+					&cli.StringFlag{
+						Name:  "task",
+						Usage: "Name of the backup task (required with --config)",
+					},
+					&cli.Int16Flag{
+						Name:     "level",
+						Usage:    "Backup level to browse; the levels it is based on are restored too",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "target",
+						Usage:    "Temporary pool/dataset to restore into (must not exist)",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "private-key",
+						Usage:    "Path to age private key file",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "source",
+						Usage: "Data source: local or s3, which reads from GCS when gcs is enabled",
+						Value: "s3",
+					},
+					&cli.StringFlag{
+						Name:  "mountpoint",
+						Usage: "Where to mount the dataset (default base_dir/browse/<task>)",
+					},
+					&durationFlag{
+						Name:  "timeout",
+						Usage: "Destroy the dataset after this long (e.g. 30m or 1d) instead of waiting for Ctrl-C",
+					},
+				}, standaloneFlags()...),
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					return browse.Run(ctx, browse.Options{
+						ConfigPath:     cmd.String("config"),
+						Standalone:     standaloneFromFlags(cmd),
+						TaskName:       cmd.String("task"),
+						Level:          cmd.Int16("level"),
+						Target:         cmd.String("target"),
+						PrivateKeyPath: cmd.String("private-key"),
+						Source:         cmd.String("source"),
+						Mountpoint:     cmd.String("mountpoint"),
+						Timeout:        cmd.Duration("timeout"),
+					})
+				},
+			},
+			{
+				Name:  "verify",
+				Usage: "Check the backup objects in the bucket, or the local parts, against their manifests and anchors",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "path to configuration yaml file",
+						Value: "zrb_config.yaml",
+					},
+					&cli.StringFlag{
+						Name:     "task",
+						Usage:    "Name of the backup task",
+						Required: true,
+					},
+					&cli.Int16Flag{
+						Name:  "level",
+						Usage: "Backup level to verify (default: every level)",
+						Value: -1,
+					},
+					&cli.StringFlag{
+						Name:  "source",
+						Usage: "Where to check the parts: s3, which checks GCS when gcs is enabled, or local, the task directories under base_dir or staging_dir",
+						Value: "s3",
+					},
+					&cli.BoolFlag{
+						Name:  "deep",
+						Usage: "Download, or read, every part and check its hash instead of trusting the object metadata",
+					},
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "Print the report as JSON, with the status of every part",
+					},
+					&cli.StringFlag{
+						Name:  "private-key",
+						Usage: "Path to age private key file, needed to check the anchors",
+					},
+					&cli.StringFlag{
+						Name:  "work-dir",
+						Usage: "Directory for the downloaded manifests and parts (overrides restore.work_dir; default: system temp if it has room, else base_dir/tmp)",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					return verify.Run(ctx, verify.Options{
+						ConfigPath:     cmd.String("config"),
+						TaskName:       cmd.String("task"),
+						Level:          cmd.Int16("level"),
+						Source:         cmd.String("source"),
+						Deep:           cmd.Bool("deep"),
+						JSON:           cmd.Bool("json"),
+						PrivateKeyPath: cmd.String("private-key"),
+						WorkDir:        cmd.String("work-dir"),
+					})
+				},
+			},
+			{
+				Name:  "import-legacy",
+				Usage: "Register a backup made by simple_backup so it can be listed and restored",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "path to configuration yaml file",
+						Value: "zrb_config.yaml",
+					},
+					&cli.StringFlag{
+						Name:     "task",
+						Usage:    "Task name the legacy backup belongs to",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "path",
+						Usage:    "Directory containing backup_manifest.yaml, or s3://<prefix> relative to the configured S3 prefix",
+						Required: true,
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					return legacy.Import(ctx, cmd.String("config"), cmd.String("task"), cmd.String("path"))
+				},
+			},
+			{
+				Name:  "cleanup",
+				Usage: "Remove old logs and leftover local task directories, or everything local of a removed task",
+				Description: "Lists what would be removed; nothing is removed without --delete.\n" +
+					"Without --purge-task, removes logs past the retention and task directories no backup references.\n" +
+					"  zrb cleanup --log-retention-days 30 --delete\n" +
+					"  zrb cleanup --purge-task old_task --pool tank --dataset old --delete",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "path to configuration yaml file",
+						Value: "zrb_config.yaml",
+					},
+					&cli.StringFlag{
+						Name:  "purge-task",
+						Usage: "Remove the run state, logs and task directories of a task no longer in the config",
+					},
+					&cli.StringFlag{
+						Name:  "pool",
+						Usage: "ZFS pool of the purged task",
+					},
+					&cli.StringFlag{
+						Name:  "dataset",
+						Usage: "ZFS dataset of the purged task",
+					},
+					&cli.IntFlag{
+						Name:  "log-retention-days",
+						Usage: "Keep the daily logs of this many days; 0 keeps all",
+						Value: 90,
+					},
+					&cli.BoolFlag{
+						Name:  "delete",
+						Usage: "Remove what is listed instead of only listing it",
+					},
+					&cli.BoolFlag{
+						Name:  "yes",
+						Usage: "Do not ask for confirmation before removing",
+					},
 				},
 				Action: func(ctx context.Context, cmd *cli.Command) error {
-					return restore.Run(ctx, cmd.String("config"), cmd.String("task"),
-						cmd.Int16("level"), cmd.String("target"), cmd.String("private-key"),
-						cmd.String("source"), cmd.Bool("dry-run"), cmd.Bool("force"))
+					return cleanup.Run(cleanup.Options{
+						ConfigPath:       cmd.String("config"),
+						PurgeTask:        cmd.String("purge-task"),
+						Pool:             cmd.String("pool"),
+						Dataset:          cmd.String("dataset"),
+						LogRetentionDays: cmd.Int("log-retention-days"),
+						Delete:           cmd.Bool("delete"),
+						Yes:              cmd.Bool("yes"),
+					})
+				},
+			},
+			{
+				Name:  "gc",
+				Usage: "Remove leftovers in the bucket that cost money without holding backups",
+				Description: "Aborts incomplete multipart uploads that interrupted uploads left below the data prefix\n" +
+					"of each task. Backups do the same for their own task, for uploads older than a day.\n" +
+					"  zrb gc --abort-multipart --older-than 24h",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "path to configuration yaml file",
+						Value: "zrb_config.yaml",
+					},
+					&cli.StringFlag{
+						Name:  "task",
+						Usage: "Only collect for this task",
+					},
+					&cli.BoolFlag{
+						Name:  "abort-multipart",
+						Usage: "Abort incomplete multipart uploads",
+					},
+					&durationFlag{
+						Name:  "older-than",
+						Usage: "Only abort multipart uploads started longer ago than this (e.g. 36h or 7d)",
+						Value: 24 * time.Hour,
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					return gc.Run(ctx, gc.Options{
+						ConfigPath:     cmd.String("config"),
+						TaskName:       cmd.String("task"),
+						AbortMultipart: cmd.Bool("abort-multipart"),
+						OlderThan:      cmd.Duration("older-than"),
+					})
+				},
+			},
+			{
+				Name:  "prune",
+				Usage: "Remove the backups in the bucket that the retention of their task no longer keeps",
+				Description: "Keeps the backups in the last backup manifest, those the task's retention keeps and every\n" +
+					"parent a kept incremental depends on, and removes the data and manifests of the others.\n" +
+					"  zrb prune --task data --dry-run",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "path to configuration yaml file",
+						Value: "zrb_config.yaml",
+					},
+					&cli.StringFlag{
+						Name:  "task",
+						Usage: "Only prune this task",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Print what would be removed without removing it",
+					},
+					&cli.BoolFlag{
+						Name:  "yes",
+						Usage: "Do not ask for confirmation before removing",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					return prune.Run(ctx, prune.Options{
+						ConfigPath: cmd.String("config"),
+						TaskName:   cmd.String("task"),
+						DryRun:     cmd.Bool("dry-run"),
+						Yes:        cmd.Bool("yes"),
+					})
+				},
+			},
+			{
+				Name:  "repair-index",
+				Usage: "Rebuild a missing last backup manifest in the bucket from the task manifests there",
+				Description: "Lists the task manifests of the task in the bucket, prints the last backup manifest they\n" +
+					"make up and uploads it. An existing last backup manifest is only replaced with --force.\n" +
+					"  zrb repair-index --task data --dry-run",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "path to configuration yaml file",
+						Value: "zrb_config.yaml",
+					},
+					&cli.StringFlag{
+						Name:     "task",
+						Usage:    "Name of the backup task",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Print the rebuilt last backup manifest without uploading it",
+					},
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "Replace a last backup manifest that exists in the bucket",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					return repair.Run(ctx, repair.Options{
+						ConfigPath: cmd.String("config"),
+						TaskName:   cmd.String("task"),
+						DryRun:     cmd.Bool("dry-run"),
+						Force:      cmd.Bool("force"),
+					})
+				},
+			},
+			{
+				Name:  "manifest",
+				Usage: "Inspect task manifests",
+				Commands: []*cli.Command{
+					{
+						Name:  "show",
+						Usage: "Print and validate a task manifest",
+						Description: "Pick the manifest with --path, or with --task and --level (plus --date for an older one):\n" +
+							"  zrb manifest show --path /mnt/backup/task/pool/data/level0/20260101/task_manifest.yaml\n" +
+							"  zrb manifest show --path s3://manifests/pool/data/level0/20260101/task_manifest.yaml\n" +
+							"  zrb manifest show --task example_task --level 1 --source s3",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "config",
+								Usage: "path to configuration yaml file (needed for s3:// paths and --task)",
+								Value: "zrb_config.yaml",
+							},
+							&cli.StringFlag{
+								Name:  "path",
+								Usage: "Local manifest file, or s3://<key> relative to the configured S3 prefix",
+							},
+							&cli.StringFlag{
+								Name:  "task",
+								Usage: "Name of the backup task",
+							},
+							&cli.Int16Flag{
+								Name:  "level",
+								Usage: "Backup level of the task",
+								Value: -1,
+							},
+							&cli.StringFlag{
+								Name:  "date",
+								Usage: "Date directory (YYYYMMDD) of the backup; default is the latest backup of the level",
+							},
+							&cli.StringFlag{
+								Name:  "source",
+								Usage: "Where --task looks for the manifest: local or s3, which reads from GCS when gcs is enabled",
+								Value: "local",
+							},
+							&cli.BoolFlag{
+								Name:  "json",
+								Usage: "Print the manifest as JSON instead of a summary",
+							},
+							&cli.BoolFlag{
+								Name:  "detail",
+								Usage: "List the parts after the summary, with when each was encrypted and uploaded",
+							},
+						},
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+							return inspect.Show(ctx, cmd.String("config"), inspect.Location{
+								Path:     cmd.String("path"),
+								TaskName: cmd.String("task"),
+								Level:    cmd.Int16("level"),
+								Date:     cmd.String("date"),
+								Source:   cmd.String("source"),
+							}, cmd.Bool("json"), cmd.Bool("detail"))
+						},
+					},
+					{
+						Name:      "diff",
+						Usage:     "Compare two task manifests",
+						ArgsUsage: "<A> <B>",
+						Description: "A and B are local manifest files or s3://<key> relative to the configured S3 prefix.\n" +
+							"Shows how they relate in the backup chain and which fields and parts differ.",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "config",
+								Usage: "path to configuration yaml file (needed for s3:// paths)",
+								Value: "zrb_config.yaml",
+							},
+						},
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+							if cmd.Args().Len() != 2 {
+								return fmt.Errorf("expected two manifests, got %d arguments", cmd.Args().Len())
+							}
+							return inspect.Diff(ctx, cmd.String("config"), cmd.Args().Get(0), cmd.Args().Get(1))
+						},
+					},
+				},
+			},
+			{
+				Name:  "diff",
+				Usage: "Print the files a backup changed, as zfs diff recorded them when it was taken",
+				Description: "Needs record_changes on the task; level 0 backups have no change list.\n" +
+					"Lines are those of zfs diff -H: the change type (+ added, - removed, M modified, R renamed) and the path.\n" +
+					"  zrb diff --task example_task --level 1 --private-key ./zrb_private.key\n" +
+					"  zrb diff --task example_task --level 2 --date 20260101 --path /tank/data/home --type M,R --private-key ./zrb_private.key",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "path to configuration yaml file",
+						Value: "zrb_config.yaml",
+					},
+					&cli.StringFlag{
+						Name:     "task",
+						Usage:    "Name of the backup task",
+						Required: true,
+					},
+					&cli.Int16Flag{
+						Name:     "level",
+						Usage:    "Backup level of the task",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "date",
+						Usage: "Date directory (YYYYMMDD) of the backup; default is the latest backup of the level",
+					},
+					&cli.StringFlag{
+						Name:  "source",
+						Usage: "Where to look for the manifest: local or s3, which reads from GCS when gcs is enabled",
+						Value: "local",
+					},
+					&cli.StringFlag{
+						Name:     "private-key",
+						Usage:    "Path to age private key file",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "path",
+						Usage: "Only print changes of paths starting with this prefix",
+					},
+					&cli.StringSliceFlag{
+						Name:  "type",
+						Usage: "Only print changes of these types: +, -, M, R, or added, removed, modified, renamed",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					return inspect.Changes(ctx, cmd.String("config"), inspect.Location{
+						TaskName: cmd.String("task"),
+						Level:    cmd.Int16("level"),
+						Date:     cmd.String("date"),
+						Source:   cmd.String("source"),
+					}, cmd.String("private-key"), inspect.ChangeFilter{
+						PathPrefix: cmd.String("path"),
+						Types:      cmd.StringSlice("type"),
+					})
+				},
+			},
+			{
+				Name:  "restore-history",
+				Usage: "Show recorded restore operations",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "path to configuration yaml file",
+						Value: "zrb_config.yaml",
+					},
+					&cli.StringFlag{
+						Name:     "task",
+						Usage:    "Name of the backup task",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "Output format: json or table",
+						Value: "json",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					return restore.History(ctx, cmd.String("config"), cmd.String("task"), cmd.String("format"))
+				},
+			},
+			{
+				Name:  "stats",
+				Usage: "Show backup size and duration trends",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "path to configuration yaml file",
+						Value: "zrb_config.yaml",
+					},
+					&cli.StringFlag{
+						Name:     "task",
+						Usage:    "Name of the backup task",
+						Required: true,
+					},
+					&cli.Int16Flag{
+						Name:  "level",
+						Usage: "Filter by backup level (-1 for all levels)",
+						Value: -1,
+					},
+					&cli.IntFlag{
+						Name:  "last",
+						Usage: "Only include the last N runs (0 for all)",
+						Value: 0,
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "Output format: json or table",
+						Value: "json",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					return stats.Run(ctx, cmd.String("config"), cmd.String("task"), cmd.Int16("level"), cmd.Int("last"), cmd.String("format"))
 				},
 			},
 		},
 	}
 
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	setShellComplete(cmd)
+
+	// A backup uploading parts lets them finish after the first signal; the second stops at once
+	ctx, stop := shutdown.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
 	if err := cmd.Run(ctx, os.Args); err != nil {
-		if ctx.Err() == context.Canceled {
+		if ctx.Err() == context.Canceled || errors.Is(err, shutdown.ErrStopped) {
 			fmt.Fprintln(os.Stderr, "\n⚠ Backup interrupted by user")
 			os.Exit(130)
 		}
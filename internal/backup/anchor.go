@@ -0,0 +1,61 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"zrb/internal/config"
+	"zrb/internal/crypto"
+	"zrb/internal/manifest"
+	"zrb/internal/remote"
+
+	"filippo.io/age"
+)
+
+// uploadAnchor stores the anchor of the backup m in taskDirName, with its parts as backend reports
+// them now, encrypted to recipients through manifestBackend.
+func uploadAnchor(ctx context.Context, backend, manifestBackend remote.Backend, m *manifest.Backup, manifestPath string, recipients []age.Recipient, task *config.Task, taskDirName string) error {
+	manifestBlake3, err := crypto.BLAKE3File(manifestPath)
+	if err != nil {
+		return fmt.Errorf("failed to calculate manifest BLAKE3: %w", err)
+	}
+	anchor := manifest.Anchor{
+		Task:           task.Name,
+		Pool:           m.Pool,
+		Dataset:        m.Dataset,
+		BackupLevel:    m.BackupLevel,
+		Datetime:       m.Datetime,
+		TargetSnapshot: m.TargetSnapshot,
+		Blake3Hash:     m.Blake3Hash,
+		ManifestBlake3: manifestBlake3,
+	}
+	for _, pi := range m.Parts {
+		remotePath := remote.DataPath(task.S3Prefix, task.Pool, task.Dataset, taskDirName, manifest.PartFileName(pi.Index))
+		obj, err := backend.Head(ctx, remotePath)
+		if err != nil {
+			return fmt.Errorf("failed to read part %s for the anchor: %w", pi.Index, err)
+		}
+		anchor.Parts = append(anchor.Parts, manifest.AnchorPart{Index: pi.Index, Blake3Hash: pi.Blake3Hash, Size: obj.Size, ETag: obj.ETag})
+	}
+
+	plain := filepath.Join(filepath.Dir(manifestPath), "anchor.yaml")
+	encrypted := filepath.Join(filepath.Dir(manifestPath), manifest.AnchorFile)
+	defer os.Remove(plain)
+	defer os.Remove(encrypted)
+	if err := manifest.WriteAnchor(plain, &anchor); err != nil {
+		return fmt.Errorf("failed to write anchor: %w", err)
+	}
+	if err := crypto.Encrypt(plain, encrypted, recipients...); err != nil {
+		return fmt.Errorf("failed to encrypt anchor: %w", err)
+	}
+	hash, err := crypto.BLAKE3File(encrypted)
+	if err != nil {
+		return fmt.Errorf("failed to calculate anchor BLAKE3: %w", err)
+	}
+	tags := remote.ObjectTags{Level: -1, Task: task.Name, Generation: remote.GenerationFromTaskDir(taskDirName)}
+	if err := manifestBackend.Upload(ctx, encrypted, remote.AnchorPath(task.S3Prefix, task.Pool, task.Dataset, taskDirName, manifest.AnchorFile), hash, tags); err != nil {
+		return fmt.Errorf("failed to upload anchor: %w", err)
+	}
+	return nil
+}
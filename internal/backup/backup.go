@@ -4,35 +4,90 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 	"zrb/internal/config"
 	"zrb/internal/crypto"
+	"zrb/internal/events"
+	"zrb/internal/fsync"
+	"zrb/internal/hooks"
 	"zrb/internal/lock"
 	"zrb/internal/manifest"
 	"zrb/internal/remote"
+	"zrb/internal/sdnotify"
+	"zrb/internal/shutdown"
+	"zrb/internal/stats"
+	"zrb/internal/tracing"
 	"zrb/internal/util"
+	"zrb/internal/version"
 	"zrb/internal/zfs"
 
 	"filippo.io/age"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func Run(ctx context.Context, configPath string, backupLevel int16, taskName string) error {
+type Options struct {
+	ConfigPath string
+	TaskName   string
+	Level      int16
+	// ResetHistory starts a new backup history at level 0, e.g. after changing the task's incremental mode.
+	ResetHistory bool
+	// IgnoreHealthCheck backs up a dataset even when it is unmounted, too small or on an unhealthy pool.
+	IgnoreHealthCheck bool
+	// ResumeRemoteKey is the private key that decrypts a remote state left by an interrupted run.
+	ResumeRemoteKey string
+	// IgnoreRemoteState starts over even though a remote state of an interrupted run exists.
+	IgnoreRemoteState bool
+	// AcceptKeyChange continues an incremental chain although the age recipients changed since its parent.
+	AcceptKeyChange bool
+	// IgnoreClockSkew backs up although the system clock is behind the newest snapshot or last backup.
+	IgnoreClockSkew bool
+	// NoFsync skips flushing parts to disk before recording them in the state, for battery-backed storage.
+	NoFsync bool
+	// Snapshot takes a fresh zrb_level<N> snapshot to back up, between the task's snapshot hooks,
+	// as the task's auto_snapshot does.
+	Snapshot bool
+	// DiscardState starts fresh although the backup state cannot be read or was written by a newer
+	// zrb, which removes what the interrupted run left in today's output directory.
+	DiscardState bool
+	// AcknowledgeCost lets the backup upload more than s3.max_upload_bytes_per_backup.
+	AcknowledgeCost bool
+	// Anchor uploads an encrypted summary of the part hashes apart from the manifest, which zrb
+	// verify checks the manifest and parts against.
+	Anchor bool
+	// IgnoreWindow uploads right away although the task's upload_window is closed.
+	IgnoreWindow bool
+	// Quiet hides the progress line and the periodic progress logs; the totals are logged at the end.
+	Quiet bool
+	// Pause toggles pausing the part workers on every value received; the CLI feeds it SIGUSR1.
+	Pause <-chan os.Signal
+}
+
+func Run(ctx context.Context, opts Options) (retErr error) {
+	configPath, backupLevel, taskName := opts.ConfigPath, opts.Level, opts.TaskName
+
 	if backupLevel < 0 {
 		return fmt.Errorf("backup level must be non-negative")
 	}
 	if taskName == "" {
 		return fmt.Errorf("task name must be specified")
 	}
+	if opts.ResetHistory && backupLevel != 0 {
+		return fmt.Errorf("--reset-history requires a level 0 backup")
+	}
 	if ctx.Err() != nil {
 		return fmt.Errorf("backup cancelled before start: %w", ctx.Err())
 	}
 
+	start := time.Now()
+
 	// Load configuration
 	cfg, err := config.Load(configPath)
 	if err != nil {
@@ -48,13 +103,88 @@ func Run(ctx context.Context, configPath string, backupLevel int16, taskName str
 		return fmt.Errorf("backup task is disabled: %s", taskName)
 	}
 
+	// The storage class of the level is checked before anything is sent or written
+	upload := cfg.Uploads(task)
+	var dataStorageClass string
+	if upload {
+		if dataStorageClass, err = cfg.DataStorageClass(backupLevel); err != nil {
+			return err
+		}
+	}
+
+	ctx, span := tracing.Start(ctx, "backup", attribute.String("task", taskName),
+		attribute.String("zfs.dataset", task.Pool+"/"+task.Dataset), attribute.Int("backup.level", int(backupLevel)))
+	defer func() { tracing.End(span, retErr) }()
+
+	// Holds and releases retry while the pool is busy; the ones that never get released are reported
+	holds := zfs.NewHolds(cfg.HoldRetry())
+	ctx = zfs.NewHoldsContext(ctx, holds)
+
+	// Bytes moved to and from S3 are counted for the statistics and bounded by the upload budget
+	transfer := remote.NewTransfer(remote.BudgetFromConfig(cfg, remote.DirectionUpload, opts.AcknowledgeCost))
+	ctx = remote.WithTransfer(ctx, transfer)
+
+	// Parts are fsynced before the state records them, unless the storage makes that pointless
+	if opts.NoFsync {
+		ctx = fsync.NewContext(ctx, fsync.Off)
+	}
+
+	// Audit events, recorded independently of the log level
+	sink, err := events.Open(cfg.Events.File)
+	if err != nil {
+		return err
+	}
+	defer sink.Close()
+	emitter := events.NewEmitter(sink, events.Event{Task: taskName, Pool: task.Pool, Dataset: task.Dataset, Level: backupLevel})
+	ctx = events.NewContext(ctx, emitter)
+	emitter.Emit(events.Event{Stage: events.BackupStarted})
+	defer func() {
+		if retErr != nil {
+			class, _ := remote.Classify(retErr)
+			emitter.Emit(events.Event{Stage: events.BackupFailed, Error: retErr.Error(), ErrorClass: string(class)})
+		}
+	}()
+
 	// Pre-flight: verify ZFS dataset is accessible before doing any work
 	if err := zfs.CheckDatasetExists(task.Pool, task.Dataset); err != nil {
+		return fmt.Errorf("pre-flight check: %w", zfs.ExplainLocal(err, task.Pool+"/"+task.Dataset, zfs.BackupPermissions))
+	}
+	if err := zfs.CheckPermissions(task.Pool+"/"+task.Dataset, zfs.BackupPermissions); err != nil {
+		return fmt.Errorf("pre-flight check: %w", err)
+	}
+
+	// Pre-flight: never ship an unmounted or damaged filesystem as a valid backup
+	if err := zfs.CheckHealth(task.Pool, task.Dataset, int64(task.MinUsedMB)<<20); err != nil {
+		if !opts.IgnoreHealthCheck {
+			return fmt.Errorf("pre-flight check: %w", err)
+		}
+		slog.Warn("Ignoring failed health check", "error", err)
+	}
+
+	// Pre-flight: levels of one history must all be taken in the same incremental mode
+	mode := task.Mode()
+	lastPath := filepath.Join(cfg.BaseDir, "run", task.Pool, task.Dataset, "last_backup_manifest.yaml")
+	previous, err := manifest.ReadLast(lastPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read last backup manifest: %w", err)
+	}
+	if previous != nil && !opts.ResetHistory {
+		if err := previous.CheckMode(mode); err != nil {
+			return fmt.Errorf("pre-flight check: %w", err)
+		}
+	}
+
+	// Pre-flight: a clock that went backwards misdates the output directory and new snapshots
+	latestSnapshot, err := zfs.LatestSnapshotCreation(task.Pool, task.Dataset)
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	if err := checkClock(time.Now(), latestSnapshot, previous, opts.IgnoreClockSkew); err != nil {
 		return fmt.Errorf("pre-flight check: %w", err)
 	}
 
 	// Ensure base directory
-	if err := os.MkdirAll(cfg.BaseDir, 0o755); err != nil {
+	if err := util.MkdirAll(cfg.BaseDir); err != nil {
 		return fmt.Errorf("failed to create base directory: %w", err)
 	}
 
@@ -66,25 +196,29 @@ func Run(ctx context.Context, configPath string, backupLevel int16, taskName str
 	}
 	defer logFile.Close()
 	slog.SetDefault(logger)
-	slog.Info("Backup started", "level", backupLevel, "pool", task.Pool, "dataset", task.Dataset)
+	slog.Info("Backup started", append([]any{"level", backupLevel, "pool", task.Pool, "dataset", task.Dataset}, version.LogAttrs()...)...)
 
 	// Ensure run directory
 	runDir := util.RunDir(cfg.BaseDir, task.Pool, task.Dataset)
-	if err := os.MkdirAll(runDir, 0o755); err != nil {
+	if err := util.MkdirAll(runDir); err != nil {
 		return fmt.Errorf("failed to create run directory: %w", err)
 	}
 
 	// Backup state management
 	statePath := filepath.Join(runDir, "backup_state.yaml")
-	state, err := loadOrCreateState(statePath, taskName, backupLevel)
+	state, fresh, err := loadOrCreateState(statePath, taskName, backupLevel, opts.DiscardState)
 	if err != nil {
 		return fmt.Errorf("failed to load backup state: %w", err)
 	}
 
 	// Acquire lock for the dataset
 	lockPath := filepath.Join(runDir, "zrb.lock")
-	releaseLock, err := lock.Acquire(lockPath)
+	releaseLock, err := lock.Acquire(lockPath, taskName, backupLevel)
 	if err != nil {
+		var held lock.ErrHeld
+		if errors.As(err, &held) {
+			return fmt.Errorf("another backup of %s/%s is already running: %w", task.Pool, task.Dataset, held)
+		}
 		return fmt.Errorf("failed to acquire lock: %w", err)
 	}
 	defer func() {
@@ -93,6 +227,61 @@ func Run(ctx context.Context, configPath string, backupLevel int16, taskName str
 		}
 	}()
 
+	// Load encryption recipients
+	recipients, err := crypto.ParseRecipients(cfg.Recipients())
+	if err != nil {
+		return fmt.Errorf("failed to parse age recipients: %w", err)
+	}
+
+	// Tell systemd a Type=notify unit is up; the watchdog is fed only while bytes move
+	notifier, err := sdnotify.New()
+	if err != nil {
+		slog.Warn("systemd notification disabled", "error", err)
+	}
+	defer notifier.Close()
+	ctx = sdnotify.NewContext(ctx, notifier)
+	notifier.Ready()
+	defer notifier.Watch()()
+	defer notifier.Stopping()
+
+	// The post_backup hook learns the outcome of the run, whatever it is
+	var targetSnapshot string
+	defer func() {
+		hooks.Post(ctx, "post_backup", task.Hooks.PostBackup, task.HookTimeout(),
+			hooks.Env{Task: taskName, Level: backupLevel, Snapshot: targetSnapshot}, retErr)
+	}()
+
+	// A dataset or snapshot destroyed or renamed mid-run leaves nothing to resume against
+	defer func() {
+		if errors.Is(retErr, zfs.ErrNotFound) {
+			retErr = checkVanished(retErr, task, targetSnapshot, state, statePath)
+		}
+	}()
+
+	// Mirror the state to S3, or pick up the state of a run interrupted on another host
+	var stateSync *remoteState
+	resumedRemotely := false
+	if upload && cfg.S3.RemoteState {
+		stateSync, resumedRemotely, err = setupRemoteState(ctx, cfg, task, backupLevel, state, statePath, lastPath, runDir, recipients, opts)
+		if err != nil {
+			return err
+		}
+		if resumedRemotely {
+			fresh = ""
+		}
+	}
+
+	// A resumed run keeps sending the snapshot it started with
+	snapshot := opts.Snapshot || task.AutoSnapshot
+	var created string
+	if snapshot && state.TargetSnapshot == "" {
+		if created, err = takeSnapshot(ctx, task, backupLevel); err != nil {
+			return err
+		}
+	} else if !snapshot && (task.Hooks.PreSnapshot != "" || task.Hooks.PostSnapshot != "") {
+		slog.Warn("Snapshot hooks are configured but only run when zrb backup takes the snapshot with --snapshot or auto_snapshot")
+	}
+
 	// List snapshots and determine target snapshot for backup
 	snapshots, err := zfs.ListSnapshots(task.Pool, task.Dataset, "zrb_level"+fmt.Sprint(backupLevel))
 	if err != nil {
@@ -101,12 +290,28 @@ func Run(ctx context.Context, configPath string, backupLevel int16, taskName str
 	if len(snapshots) == 0 {
 		return fmt.Errorf("no snapshots found for pool=%s dataset=%s", task.Pool, task.Dataset)
 	}
-	targetSnapshot := snapshots[0]
+	targetSnapshot = snapshots[0]
+	if created != "" {
+		targetSnapshot = created
+	}
 	if state.TargetSnapshot != "" {
 		targetSnapshot = state.TargetSnapshot
 	}
 	slog.Info("Target snapshot determined", "targetSnapshot", targetSnapshot, "count", len(snapshots))
 
+	// An interrupted backup whose snapshot is gone cannot be finished, only started over
+	if state.TargetSnapshot != "" && !resumedRemotely {
+		found, err := zfs.SnapshotExists(targetSnapshot)
+		if err != nil {
+			return fmt.Errorf("failed to check the snapshot of the interrupted backup: %w", err)
+		}
+		if !found {
+			reason := fmt.Sprintf("snapshot %s was destroyed or renamed", targetSnapshot)
+			invalidateState(statePath, state, reason)
+			return fmt.Errorf("cannot resume the interrupted backup: %s; pass --discard-state to start over", reason)
+		}
+	}
+
 	// Determine task directory name
 	taskDirName := util.TaskDirName(backupLevel, time.Now())
 	if state.OutputDir != "" {
@@ -116,90 +321,198 @@ func Run(ctx context.Context, configPath string, backupLevel int16, taskName str
 		taskDirName = filepath.Join(levelDir, dateDir)
 	}
 
-	// Ensure output directory
-	outputDir := filepath.Join(cfg.BaseDir, "task", task.Pool, task.Dataset, taskDirName)
-	if state.OutputDir == "" {
-		if _, err := os.Stat(outputDir); err == nil {
-			slog.Info("Cleaning up existing output directory", "path", outputDir)
-
-			if err := os.RemoveAll(outputDir); err != nil {
-				return fmt.Errorf("failed to remove existing output directory: %w", err)
-			}
-		}
-	}
-	if err := os.MkdirAll(outputDir, 0o755); err != nil {
-		return fmt.Errorf("failed to create output directory: %w", err)
-	}
-
 	// Determine parent snapshot
-	lastPath := filepath.Join(cfg.BaseDir, "run", task.Pool, task.Dataset, "last_backup_manifest.yaml")
 	var parentSnapshot string
-	var last *manifest.Last
+	var parent *manifest.Ref
+	var keyHistory []manifest.KeyRecord
+	policy := task.Policy()
 	if backupLevel > 0 {
 		// For level >= 1, we need to find the parent snapshot from the last backup manifest
-		last, err = manifest.ReadLast(lastPath)
+		last, err := manifest.ReadLast(lastPath)
 		if err != nil || last == nil {
 			return fmt.Errorf("failed to determine base for backup: %w", err)
 		}
 
-		if last.BackupLevels != nil && int16(len(last.BackupLevels)) >= backupLevel && last.BackupLevels[backupLevel-1] != nil {
-			// We have a previous backup at the required level
-			parentSnapshot = last.BackupLevels[backupLevel-1].Snapshot
-			slog.Info("Found parent snapshot from last backup manifest", "parentSnapshot", parentSnapshot)
+		if parent = last.ParentFor(mode, policy, backupLevel); parent != nil {
+			// A parent in the same dated directory would be overwritten by this backup
+			if parent.S3Path == filepath.Join(task.Pool, task.Dataset, taskDirName) {
+				return fmt.Errorf("failed to determine base for backup: parent %s was taken today at the same level; "+
+					"with parent_policy %s take at most one level %d backup a day", parent.Snapshot, policy, backupLevel)
+			}
+			parentSnapshot = parent.Snapshot
+			slog.Info("Found parent snapshot from last backup manifest", "parentSnapshot", parentSnapshot, "mode", mode, "policy", policy)
+
+			parentManifest, err := loadParentManifest(ctx, cfg, task, parent, upload)
+			if err != nil {
+				slog.Warn("Cannot check the age recipients against the parent backup", "error", err)
+			} else if keyHistory, err = checkKeyChange(cfg, parentManifest, opts.AcceptKeyChange); err != nil {
+				return err
+			}
 		} else {
-			return fmt.Errorf("failed to determine base for backup, no previous backups found")
+			return fmt.Errorf("failed to determine base for backup, no previous level %d backup found", manifest.ParentLevel(mode, backupLevel))
 		}
 	}
 	// Resume from state if parent snapshot was already determined in a previous run
 	if state.ParentSnapshot != "" {
+		// The manifest records the S3 path of the parent, which is only known for the current one
+		if parent != nil && parent.Snapshot != state.ParentSnapshot {
+			return fmt.Errorf("interrupted backup was based on %s, but parent_policy %s now selects %s; "+
+				"finish it with the previous parent_policy or remove %s to start over", state.ParentSnapshot, policy, parent.Snapshot, statePath)
+		}
 		parentSnapshot = state.ParentSnapshot
 	}
 
+	// Ensure output directory
+	stagingRoot := cfg.StagingRoot(task)
+	if stagingRoot != cfg.BaseDir {
+		if err := checkStagingDir(stagingRoot); err != nil {
+			return err
+		}
+	}
+	outputDir := filepath.Join(cfg.TaskRoot(task), task.Pool, task.Dataset, taskDirName)
+	if state.OutputDir != "" && filepath.Clean(state.OutputDir) != outputDir {
+		// The parts of the interrupted run stay where it put them; a resume elsewhere would miss them
+		return fmt.Errorf("interrupted backup staged its parts in %s, but staging_dir now puts them in %s; "+
+			"set staging_dir back to finish it, or remove %s to start over", state.OutputDir, outputDir, statePath)
+	}
+	if state.OutputDir == "" {
+		if _, err := os.Stat(outputDir); err == nil {
+			slog.Info("Cleaning up existing output directory", "path", outputDir)
+
+			if err := os.RemoveAll(outputDir); err != nil {
+				return fmt.Errorf("failed to remove existing output directory: %w", err)
+			}
+		}
+	}
+	if err := util.MkdirAll(outputDir); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
 	if ctx.Err() != nil {
 		return fmt.Errorf("backup cancelled before ZFS send: %w", ctx.Err())
 	}
 
+	// A dedup_store skips the chunks its index knows to be in S3
+	var store string
+	var index *chunkIndex
+	if task.DedupStore {
+		store = chunkStore(cfg.Recipients())
+		if index, err = loadChunkIndex(chunkIndexPath(runDir, store)); err != nil {
+			return err
+		}
+	}
+
+	// Report what is sent and uploaded until the run ends, and the totals after
+	meters := newBackupMeters(time.Now())
+	ctx = withMeters(ctx, meters)
+	var progress io.Writer
+	stopReport := func() {}
+	if !opts.Quiet {
+		if stderrIsTerminal() {
+			progress = os.Stderr
+		}
+		stopReport = meters.report(progress)
+	}
+	defer func() {
+		stopReport()
+		meters.logSummary(time.Now())
+	}()
+
+	// A snapshot taken for this run is not left behind by a send that failed before streaming anything
+	if created != "" {
+		defer func() {
+			if retErr != nil && meters.send.Bytes() == 0 {
+				discardSnapshot(created)
+			}
+		}()
+	}
+
 	// Check zfs send and split already done
 	var blake3Hash string
+	var streamBytes int64
+	// A resumed backup keeps the part size its parts were split at
+	partSize := cfg.PartSizeBytes(task)
+	if state.Blake3Hash != "" {
+		partSize = statePartSize(state)
+	}
+	if limit := remote.MaxUploadSize(cfg.S3UploadPartSize()); upload && !task.SingleFile && !task.DedupStore && partSize > limit {
+		return fmt.Errorf("part_size exceeds the S3 upload limit of %d bytes (10000 parts of s3.upload_part_size_mb)", limit)
+	}
 	if state.Blake3Hash == "" {
-		// Need to run zfs send and split
-		slog.Info("Running zfs send and split", "targetSnapshot", targetSnapshot, "parentSnapshot", parentSnapshot)
-		blake3Hash, err = zfs.SendAndSplit(ctx, targetSnapshot, parentSnapshot, outputDir)
-		if err != nil {
-			return fmt.Errorf("failed to run zfs send and split: %w", err)
+		if err := checkStagingSpace(ctx, outputDir, targetSnapshot, parentSnapshot); err != nil {
+			return err
+		}
+		limit, estimated := streamLimit(ctx, task, targetSnapshot, parentSnapshot)
+		notifier.Phase("sending "+targetSnapshot, 0)
+		emitter.Emit(events.Event{Stage: events.SendStarted, Snapshot: targetSnapshot})
+		if task.DedupStore {
+			err = meters.send.Time(func() (err error) {
+				blake3Hash, streamBytes, err = sendChunked(ctx, task, targetSnapshot, parentSnapshot, outputDir, recipients, index, limit)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("failed to run chunked send: %w", streamLimitExceeded(ctx, err, task, estimated, targetSnapshot, outputDir))
+			}
+		} else if task.SingleFile {
+			err = meters.send.Time(func() (err error) {
+				blake3Hash, streamBytes, err = sendSingleFile(ctx, cfg, task, targetSnapshot, parentSnapshot, outputDir, recipients, limit)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("failed to run single file send: %w", streamLimitExceeded(ctx, err, task, estimated, targetSnapshot, outputDir))
+			}
+		} else if task.InlineEncryption {
+			err = meters.send.Time(func() (err error) {
+				blake3Hash, streamBytes, err = sendEncrypted(ctx, state, targetSnapshot, parentSnapshot, outputDir, recipients, partSize, limit)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("failed to run zfs send with inline encryption: %w", streamLimitExceeded(ctx, err, task, estimated, targetSnapshot, outputDir))
+			}
+		} else {
+			// Need to run zfs send and split
+			slog.Info("Running zfs send and split", "targetSnapshot", targetSnapshot, "parentSnapshot", parentSnapshot)
+			err = meters.send.Time(func() (err error) {
+				blake3Hash, streamBytes, err = zfs.SendAndSplit(ctx, targetSnapshot, parentSnapshot, outputDir, partSize, limit)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("failed to run zfs send and split: %w", streamLimitExceeded(ctx, err, task, estimated, targetSnapshot, outputDir))
+			}
 		}
 		slog.Info("Snapshot BLAKE3", "hash", blake3Hash)
+		emitter.Emit(events.Event{Stage: events.SendCompleted, Snapshot: targetSnapshot, Blake3: blake3Hash})
 	} else {
 		// Skip zfs send and split, resume from existing state
 		blake3Hash = state.Blake3Hash
+		streamBytes = state.StreamBytes
 		slog.Info("Using stored BLAKE3 hash", "hash", blake3Hash)
 	}
 
-	// Find snapshot part files (both raw and encrypted) and build unique index list
-	allParts, err := filepath.Glob(filepath.Join(outputDir, "snapshot.part-*"))
-	if err != nil {
-		return fmt.Errorf("failed to find snapshot parts: %w", err)
-	}
-	partIndexSet := make(map[string]bool)
-	for _, part := range allParts {
-		baseName := filepath.Base(part)
-		baseName = strings.TrimSuffix(baseName, ".age")
-		index := strings.TrimPrefix(baseName, "snapshot.part-")
-		partIndexSet[index] = true
-	}
 	var partIndices []string
-	for idx := range partIndexSet {
-		partIndices = append(partIndices, idx)
-	}
-	sort.Strings(partIndices)
-	if len(partIndices) == 0 {
-		return fmt.Errorf("no snapshot parts found in %s", outputDir)
+	var chunks []manifest.ChunkInfo
+	switch {
+	case task.DedupStore:
+		if chunks, err = readChunkList(filepath.Join(outputDir, chunkListName)); err != nil {
+			return err
+		}
+	case resumedRemotely:
+		// Every part is already uploaded; only the manifests are left to do.
+		partIndices = completedIndices(state)
+	default:
+		var unexpected []string
+		partIndices, unexpected, err = findPartIndices(outputDir)
+		for _, name := range unexpected {
+			slog.Warn("Ignoring unexpected entry in output directory", "path", filepath.Join(outputDir, name))
+		}
+		if err != nil {
+			return err
+		}
 	}
-
-	// Load encryption public key
-	recipient, err := age.ParseX25519Recipient(cfg.AgePublicKey)
-	if err != nil {
-		return fmt.Errorf("failed to parse age public key: %w", err)
+	if !task.DedupStore {
+		if err := checkPartCount(partIndices, streamBytes, partSize); err != nil {
+			return err
+		}
 	}
 
 	// Update state
@@ -210,6 +523,10 @@ func Run(ctx context.Context, configPath string, backupLevel int16, taskName str
 		state.ParentSnapshot = parentSnapshot
 		state.OutputDir = outputDir
 		state.Blake3Hash = blake3Hash
+		state.StreamBytes = streamBytes
+		if !task.SingleFile && !task.DedupStore {
+			state.PartSizeBytes = partSize
+		}
 		state.PartsCompleted = make(map[string]string)
 		state.LastUpdated = time.Now().Unix()
 
@@ -217,41 +534,95 @@ func Run(ctx context.Context, configPath string, backupLevel int16, taskName str
 		if err := manifest.WriteState(statePath, state); err != nil {
 			return fmt.Errorf("failed to persist initial backup state: %w", err)
 		}
+		stateSync.push(ctx, state, true)
 	}
 
 	// Initialize remote backend
 	var backend remote.Backend
 	var manifestBackend remote.Backend
-	if cfg.S3.Enabled {
-		maxRetryAttempts := cfg.S3RetryAttempts()
-		if int(backupLevel) >= len(cfg.S3.StorageClass.BackupData) {
-			return fmt.Errorf("backup level %d exceeds configured storage classes (only %d defined)", backupLevel, len(cfg.S3.StorageClass.BackupData))
-		}
-		storageClass := cfg.S3.StorageClass.BackupData[backupLevel]
-		s3Backend, err := remote.NewS3(ctx, cfg.S3.Bucket, cfg.S3.Region, cfg.S3.Prefix, cfg.S3.Endpoint, storageClass, maxRetryAttempts)
+	if upload {
+		dataOpts := remote.OptionsFromConfig(cfg, dataStorageClass)
+		dataBackend, err := remote.DefaultCache.Get(ctx, dataOpts)
 		if err != nil {
-			return fmt.Errorf("failed to initialize S3 backend: %w", err)
+			return fmt.Errorf("failed to initialize %s backend: %w", dataOpts.Backend, err)
 		}
 
-		backend = s3Backend
-		slog.Info("S3 backend initialized", "bucket", cfg.S3.Bucket, "region", cfg.S3.Region, "prefix", cfg.S3.Prefix)
-		if err := backend.VerifyCredentials(ctx); err != nil {
-			return fmt.Errorf("AWS credentials verification failed: %w", err)
-		}
+		backend = dataBackend
+		slog.Info("Remote backend initialized", "backend", dataOpts.Backend, "bucket", dataOpts.Bucket, "region", dataOpts.Region, "prefix", dataOpts.Prefix)
 
-		mBackend, err := remote.NewS3(ctx, cfg.S3.Bucket, cfg.S3.Region, cfg.S3.Prefix, cfg.S3.Endpoint, cfg.S3.StorageClass.Manifest, maxRetryAttempts)
+		mBackend, err := remote.DefaultCache.Get(ctx, remote.OptionsFromConfig(cfg, cfg.ManifestStorageClass()))
 		if err != nil {
-			return fmt.Errorf("failed to initialize S3 backend for manifests: %w", err)
+			return fmt.Errorf("failed to initialize %s backend for manifests: %w", dataOpts.Backend, err)
 		}
 
 		manifestBackend = mBackend
-		slog.Info("S3 backend for manifests initialized")
+		slog.Info("Remote backend for manifests initialized")
+
+		switch cfg.S3Preflight() {
+		case config.PreflightStrict:
+			if err := backend.VerifyCredentials(ctx); err != nil {
+				return fmt.Errorf("credentials verification failed: %w", err)
+			}
+		case config.PreflightDeferred:
+			// Parts are encrypted while S3 is unreachable; the check waits for the first upload.
+			check := &deferredCheck{backend: backend}
+			backend = &checkedBackend{Backend: backend, check: check}
+			manifestBackend = &checkedBackend{Backend: manifestBackend, check: check}
+			slog.Info("Credentials verification deferred to the first upload")
+		case config.PreflightSkip:
+			slog.Info("Credentials verification skipped")
+		}
+
+		abortStaleUploads(ctx, dataBackend, remote.DataPath(task.S3Prefix, task.Pool, task.Dataset)+"/")
 	}
 
 	// Process parts
-	partInfos, err := processPartsWithWorkerPool(ctx, partIndices, outputDir, state, statePath, recipient, backend, task, taskDirName, backupLevel)
-	if err != nil {
-		return err
+	gate := newPauseGate(filepath.Join(runDir, pauseFileName), notifier)
+	if backend != nil && !opts.IgnoreWindow {
+		if gate.window, err = newUploadWindow(task.UploadWindow); err != nil {
+			return fmt.Errorf("invalid upload_window: %w", err)
+		}
+	}
+	// Each part is checked with a HEAD request after its upload and uploaded again on a mismatch
+	var verifyAttempts int
+	if cfg.VerifiesUploads() {
+		verifyAttempts = cfg.S3RetryAttempts()
+	}
+	stopPause := gate.watch(ctx, opts.Pause)
+	var partInfos []manifest.PartInfo
+	if task.DedupStore {
+		tags := remote.ObjectTags{Level: backupLevel, Task: task.Name, Generation: remote.GenerationFromTaskDir(taskDirName)}
+		var checked map[string]bool
+		err = meters.upload.Time(func() (err error) {
+			checked, err = storeChunks(ctx, backend, outputDir, store, task, tags, index, gate)
+			return err
+		})
+		stopPause()
+		if err != nil {
+			return err
+		}
+		if err := verifyChunks(ctx, backend, chunks, checked, store, index.path, task); err != nil {
+			return err
+		}
+	} else {
+		notifier.Phase("processing parts", len(partIndices))
+		if backend != nil {
+			meters.expect(streamBytes, state.UploadedBytes)
+			resuming(progress, state.UploadedBytes, streamBytes)
+		}
+		// A stop requested while parts upload lets the ones in flight finish
+		release := shutdown.Grace(ctx, cfg.ShutdownGracePeriod())
+		err = meters.upload.Time(func() (err error) {
+			partInfos, err = processPartsWithWorkerPool(ctx, partIndices, outputDir, state, statePath, stateSync, recipients, backend, task, taskDirName, backupLevel, gate, cfg.WorkerCount(), verifyAttempts)
+			return err
+		})
+		release()
+		stopPause()
+		// Record uploaded parts remotely even when interrupted, so another host can pick up from here.
+		stateSync.push(context.WithoutCancel(ctx), state, true)
+		if err != nil {
+			return err
+		}
 	}
 
 	// Sort part infos by index to ensure correct order in manifest
@@ -260,8 +631,9 @@ func Run(ctx context.Context, configPath string, backupLevel int16, taskName str
 	})
 	slog.Info("All part files processed", "count", len(partInfos))
 
-	// Verify uploads via HeadObject (only level 0)
-	if backupLevel == 0 && backend != nil {
+	// Verify uploads via HeadObject (only level 0), unless each part was already checked right
+	// after its upload.
+	if backupLevel == 0 && backend != nil && !cfg.VerifiesUploads() {
 		if err := verifyLevel0Parts(ctx, backend, partInfos, outputDir, task, taskDirName); err != nil {
 			return fmt.Errorf("level 0 verification failed: %w", err)
 		}
@@ -269,9 +641,19 @@ func Run(ctx context.Context, configPath string, backupLevel int16, taskName str
 
 	// Manifest management
 	var manifestPath string
+	var generationID string
 	if state.ManifestCreated {
 		manifestPath = filepath.Join(outputDir, "task_manifest.yaml")
+		if written, err := manifest.Read(manifestPath); err == nil {
+			generationID = written.GenerationID
+		} else {
+			slog.Warn("Failed to read the generation of the written manifest", "path", manifestPath, "error", err)
+		}
 	} else {
+		if !upload {
+			slog.Info("Upload disabled for this task, keeping the backup local-only", "path", outputDir)
+		}
+
 		// Create and write manifest
 		systemInfo, err := manifest.GetSystemInfo()
 		if err != nil {
@@ -284,21 +666,56 @@ func Run(ctx context.Context, configPath string, backupLevel int16, taskName str
 		}
 
 		m := manifest.Backup{
-			Datetime:       time.Now().Unix(),
-			System:         systemInfo,
-			Pool:           task.Pool,
-			Dataset:        task.Dataset,
-			BackupLevel:    backupLevel,
-			TargetSnapshot: targetSnapshot,
-			ParentSnapshot: parentSnapshot,
-			AgePublicKey:   cfg.AgePublicKey,
-			Blake3Hash:     blake3Hash,
-			Parts:          partInfos,
-			TargetS3Path:   filepath.Join(task.Pool, task.Dataset, taskDirName),
-			ParentS3Path:   "",
+			Datetime:        time.Now().Unix(),
+			DateTimezone:    "UTC",
+			ZrbVersion:      version.Get(),
+			System:          systemInfo,
+			Pool:            task.Pool,
+			Dataset:         task.Dataset,
+			BackupLevel:     backupLevel,
+			IncrementalMode: mode,
+			TargetSnapshot:  targetSnapshot,
+			ParentSnapshot:  parentSnapshot,
+			AgePublicKey:    cfg.AgePublicKey,
+			AgeRecipients:   cfg.AgeRecipients,
+			KeyHistory:      keyHistory,
+			StagingDir:      stagingRoot,
+			S3Prefix:        task.S3Prefix,
+			Blake3Hash:      blake3Hash,
+			StreamBytes:     streamBytes,
+			SendArgs:        zfs.SendCommand(targetSnapshot, parentSnapshot),
+			RecipientCount:  len(recipients),
+			Parts:           partInfos,
+			ChecksumsBlake3: manifest.PartChecksumsDigest(partInfos),
+			LocalOnly:       !upload,
+			TargetS3Path:    filepath.Join(task.Pool, task.Dataset, taskDirName),
+			ParentS3Path:    "",
 		}
+		// Every level carries the generation of the level 0 it grows from
 		if backupLevel > 0 {
-			m.ParentS3Path = last.BackupLevels[backupLevel-1].S3Path
+			m.ParentPolicy = policy
+			m.ParentS3Path = parent.S3Path
+			m.GenerationID = parent.GenerationID
+		} else {
+			m.GenerationID = manifest.NewGenerationID(time.Unix(m.Datetime, 0))
+		}
+		generationID = m.GenerationID
+		switch {
+		case task.DedupStore:
+			m.FormatVersion = manifest.ChunkedFormat
+			m.ChunkStore = store
+			m.ChunkSizeBytes = int64(task.DedupChunkSize())
+			m.Chunks = chunks
+		case !task.SingleFile:
+			m.PartSizeBytes = partSize
+		}
+		if task.RecordChanges && parentSnapshot != "" {
+			if m.Changes, err = recordChanges(ctx, outputDir, targetSnapshot, parentSnapshot, recipients, task); err != nil {
+				return err
+			}
+		}
+		if m.TargetSnapshotGUID, err = zfs.SnapshotGUID(targetSnapshot); err != nil {
+			slog.Warn("Failed to read snapshot guid, restores of this backup can only verify the snapshot name", "snapshot", targetSnapshot, "error", err)
 		}
 
 		manifestPath = filepath.Join(outputDir, "task_manifest.yaml")
@@ -306,6 +723,7 @@ func Run(ctx context.Context, configPath string, backupLevel int16, taskName str
 			return fmt.Errorf("failed to write manifest: %w", err)
 		}
 		slog.Info("Manifest written", "path", manifestPath)
+		removePartialManifest(outputDir)
 
 		state.ManifestCreated = true
 		state.LastUpdated = time.Now().Unix()
@@ -315,18 +733,33 @@ func Run(ctx context.Context, configPath string, backupLevel int16, taskName str
 		}
 	}
 
-	// Upload manifest
-	if manifestBackend != nil && !state.ManifestUploaded {
-		manifestBlake3, err := crypto.BLAKE3File(manifestPath)
+	// Checksum files for verifying the parts and manifest without reading YAML
+	var checksumPaths []string
+	if !state.ManifestUploaded {
+		withSHA256 := task.ChecksumsSHA256
+		if withSHA256 && resumedRemotely {
+			slog.Warn("Skipping " + manifest.ChecksumsSHA256File + ", the parts of a backup resumed from remote state are not on this host")
+			withSHA256 = false
+		}
+		checksumPaths, err = writeChecksums(outputDir, partInfos, manifestPath, withSHA256)
 		if err != nil {
-			return fmt.Errorf("failed to calculate manifest BLAKE3: %w", err)
+			return err
+		}
+		// The change list uploads with them, next to the parts
+		if _, err := os.Stat(filepath.Join(outputDir, manifest.ChangesFile)); err == nil {
+			checksumPaths = append(checksumPaths, filepath.Join(outputDir, manifest.ChangesFile))
 		}
+	}
 
-		remotePath := filepath.Join("manifests", task.Pool, task.Dataset, taskDirName, "task_manifest.yaml")
-		if err := manifestBackend.Upload(ctx, manifestPath, remotePath, manifestBlake3, -1); err != nil {
-			return fmt.Errorf("failed to upload manifest: %w", err)
+	// Upload manifest
+	if manifestBackend != nil && !state.ManifestUploaded {
+		notifier.Phase("uploading manifest", 0)
+		remotePath, err := uploadManifest(ctx, manifestBackend, manifestPath, checksumPaths, task, taskDirName)
+		if err != nil {
+			return err
 		}
 		slog.Info("Manifest upload completed")
+		emitter.Emit(events.Event{Stage: events.ManifestUploaded, Object: remotePath})
 
 		state.ManifestUploaded = true
 		state.LastUpdated = time.Now().Unix()
@@ -336,19 +769,52 @@ func Run(ctx context.Context, configPath string, backupLevel int16, taskName str
 		}
 	}
 
+	// The anchor vouches for the manifest as uploaded, so it comes after it
+	if opts.Anchor && manifestBackend != nil {
+		written, err := manifest.Read(manifestPath)
+		if err != nil {
+			return fmt.Errorf("failed to read manifest for the anchor: %w", err)
+		}
+		if err := uploadAnchor(ctx, backend, manifestBackend, written, manifestPath, recipients, task, taskDirName); err != nil {
+			return err
+		}
+		slog.Info("Anchor uploaded")
+	}
+
 	// Update last successful backup manifest
 	var currentLast manifest.Last
 	if existing, err := manifest.ReadLast(lastPath); err == nil && existing != nil {
 		currentLast = *existing
 	}
+	if backupLevel == 0 && len(currentLast.BackupLevels) > 1 {
+		// Levels above 0 belong to the previous generation and no longer chain to this level 0; keep
+		// the level 0 slot so its hold is released below. A failed level 0 never gets here.
+		if opts.ResetHistory {
+			slog.Info("Resetting backup history", "previousMode", currentLast.Mode(), "mode", mode)
+		} else {
+			slog.Info("New level 0 starts a new generation, dropping the levels of the previous one",
+				"levels", len(currentLast.BackupLevels)-1, "generation", generationID)
+		}
+		for _, ref := range currentLast.BackupLevels[1:] {
+			if ref != nil && ref.Snapshot != targetSnapshot {
+				if err := zfs.Release(ctx, "zrb:last", ref.Snapshot); err != nil {
+					slog.Error("Failed to release hold on previous snapshot", "snapshot", ref.Snapshot, "error", err)
+				}
+			}
+		}
+		currentLast.BackupLevels = currentLast.BackupLevels[:1]
+	}
 	currentLast.Pool = task.Pool
 	currentLast.Dataset = task.Dataset
+	currentLast.IncrementalMode = mode
 	ref := &manifest.Ref{
-		Datetime:   time.Now().Unix(),
-		Snapshot:   targetSnapshot,
-		Manifest:   manifestPath,
-		Blake3Hash: blake3Hash,
-		S3Path:     filepath.Join(task.Pool, task.Dataset, taskDirName),
+		Datetime:     time.Now().Unix(),
+		Snapshot:     targetSnapshot,
+		Manifest:     manifestPath,
+		Blake3Hash:   blake3Hash,
+		S3Path:       filepath.Join(task.Pool, task.Dataset, taskDirName),
+		LocalOnly:    !upload,
+		GenerationID: generationID,
 	}
 
 	var oldSnapshot string
@@ -367,8 +833,10 @@ func Run(ctx context.Context, configPath string, backupLevel int16, taskName str
 	currentLast.BackupLevels[backupLevel] = ref
 
 	// Hold the snapshot to prevent deletion while it's still referenced by last backup manifest
-	if err := zfs.Hold("zrb:last", targetSnapshot); err != nil {
+	if err := zfs.Hold(ctx, "zrb:last", targetSnapshot); err != nil {
 		slog.Warn("Failed to hold snapshot", "snapshot", targetSnapshot, "error", err)
+	} else {
+		emitter.Emit(events.Event{Stage: events.SnapshotHeld, Snapshot: targetSnapshot})
 	}
 
 	if err := manifest.WriteLast(lastPath, &currentLast); err != nil {
@@ -378,8 +846,8 @@ func Run(ctx context.Context, configPath string, backupLevel int16, taskName str
 
 	// Release hold on old snapshot if different from current target snapshot
 	if oldSnapshot != "" && oldSnapshot != targetSnapshot {
-		if err := zfs.Release("zrb:last", oldSnapshot); err != nil {
-			slog.Warn("Failed to release hold on previous snapshot", "snapshot", oldSnapshot, "error", err)
+		if err := zfs.Release(ctx, "zrb:last", oldSnapshot); err != nil {
+			slog.Error("Failed to release hold on previous snapshot", "snapshot", oldSnapshot, "error", err)
 		}
 	}
 
@@ -390,11 +858,17 @@ func Run(ctx context.Context, configPath string, backupLevel int16, taskName str
 			return fmt.Errorf("failed to calculate BLAKE3 for last backup manifest: %w", err)
 		}
 
-		remoteLastPath := filepath.Join("manifests", task.Pool, task.Dataset, "last_backup_manifest.yaml")
-		if err := manifestBackend.Upload(ctx, lastPath, remoteLastPath, lastBlake3, -1); err != nil {
+		remoteLastPath := remote.ManifestPath(task.S3Prefix, task.Pool, task.Dataset, "last_backup_manifest.yaml")
+		if err := manifestBackend.Upload(ctx, lastPath, remoteLastPath, lastBlake3, remote.ObjectTags{Level: -1, Task: taskName}); err != nil {
 			return fmt.Errorf("failed to upload last backup manifest: %w", err)
 		}
 		slog.Info("Uploaded last backup manifest to remote", "remote", remoteLastPath)
+		emitter.Emit(events.Event{Stage: events.ManifestUploaded, Object: remoteLastPath})
+	}
+
+	encryptedBytes, err := encryptedPartsSize(outputDir, partInfos)
+	if err != nil {
+		slog.Warn("Failed to measure encrypted parts", "error", err)
 	}
 
 	if backend != nil {
@@ -409,23 +883,172 @@ func Run(ctx context.Context, configPath string, backupLevel int16, taskName str
 	if err := os.Remove(statePath); err != nil {
 		slog.Warn("Failed to remove backup state file", "error", err)
 	}
+	stateSync.remove(ctx)
+
+	rec := &stats.Record{
+		ZrbVersion:        version.Version,
+		Level:             backupLevel,
+		Datetime:          time.Now().Unix(),
+		StreamBytes:       streamBytes,
+		EncryptedBytes:    encryptedBytes,
+		DurationSeconds:   time.Since(start).Seconds(),
+		Parts:             len(partInfos),
+		TargetSnapshot:    targetSnapshot,
+		ParentSnapshot:    parentSnapshot,
+		UploadedBytes:     transfer.Uploaded(),
+		DownloadedBytes:   transfer.Downloaded(),
+		StaleHolds:        holds.Stale(),
+		FreshStart:        string(fresh),
+		PartUploadSeconds: stats.PartUploadSeconds(partInfos),
+	}
+	if len(rec.StaleHolds) > 0 {
+		slog.Error("Some snapshot holds could not be released; release them with zfs release <tag> <snapshot>", "holds", rec.StaleHolds)
+	}
+	if err := stats.Append(stats.Path(cfg.BaseDir, task.Pool, task.Dataset), rec); err != nil {
+		slog.Warn("Failed to record backup statistics", "error", err)
+	}
 
-	slog.Info("Backup completed successfully!")
+	emitter.Emit(events.Event{Stage: events.BackupCompleted, Snapshot: targetSnapshot, Blake3: blake3Hash})
+	slog.Info("Backup completed successfully!", "uploadedBytes", rec.UploadedBytes, "downloadedBytes", rec.DownloadedBytes)
 	return nil
 }
 
-func loadOrCreateState(statePath, taskName string, backupLevel int16) (*manifest.State, error) {
-	if existingState, err := manifest.ReadState(statePath); err == nil && existingState != nil {
-		if existingState.TaskName == taskName && existingState.BackupLevel == backupLevel {
-			slog.Info("Found existing backup state, resuming", "state", existingState)
+func encryptedPartsSize(outputDir string, partInfos []manifest.PartInfo) (int64, error) {
+	var total int64
+	for _, pi := range partInfos {
+		info, err := os.Stat(filepath.Join(outputDir, manifest.PartFileName(pi.Index)))
+		if err != nil {
+			return 0, err
+		}
+		total += info.Size()
+	}
+	return total, nil
+}
+
+// partFilePattern matches split output (six-letter suffix) and its encrypted counterpart.
+var partFilePattern = regexp.MustCompile(fmt.Sprintf(`^snapshot\.part-([a-z]{%d})(\.age)?$`, zfs.PartSuffixLength))
+
+// interruptedPattern matches an encryption a crash interrupted; processPart redoes it from the raw part.
+var interruptedPattern = regexp.MustCompile(fmt.Sprintf(`^snapshot\.part-[a-z]{%d}\.age\.tmp$`, zfs.PartSuffixLength))
+
+// findPartIndices finds snapshot part files (both raw and encrypted) and builds a sorted unique index list.
+// Any other entries in the output directory are returned so they can be reported.
+func findPartIndices(outputDir string) ([]string, []string, error) {
+	singleFile := filepath.Join(outputDir, manifest.PartFileName(manifest.SingleFileIndex))
+	if _, err := os.Stat(singleFile); err == nil {
+		return []string{manifest.SingleFileIndex}, nil, nil
+	}
+
+	entries, err := os.ReadDir(outputDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to find snapshot parts: %w", err)
+	}
 
-			return existingState, nil
+	partIndexSet := make(map[string]bool)
+	var unexpected []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			if m := partFilePattern.FindStringSubmatch(entry.Name()); m != nil {
+				partIndexSet[m[1]] = true
+				continue
+			}
+			if interruptedPattern.MatchString(entry.Name()) {
+				continue
+			}
+			switch entry.Name() {
+			case "task_manifest.yaml", partialManifestName, manifest.ChecksumsBlake3File, manifest.ChecksumsSHA256File, manifest.ChangesFile:
+				continue
+			}
 		}
+		unexpected = append(unexpected, entry.Name())
+	}
+
+	var partIndices []string
+	for idx := range partIndexSet {
+		partIndices = append(partIndices, idx)
+	}
+	sort.Strings(partIndices)
+	if len(partIndices) == 0 {
+		return nil, unexpected, fmt.Errorf("no snapshot parts found in %s", outputDir)
+	}
+	return partIndices, unexpected, nil
+}
+
+// checkPartCount verifies discovery found as many parts as split must have produced for the stream
+// size at partSize.
+func checkPartCount(partIndices []string, streamBytes, partSize int64) error {
+	if streamBytes <= 0 || (len(partIndices) == 1 && partIndices[0] == manifest.SingleFileIndex) {
+		return nil
+	}
+	expected := int((streamBytes + partSize - 1) / partSize)
+	if len(partIndices) != expected {
+		return fmt.Errorf("found %d part(s) but a %d byte stream splits into %d", len(partIndices), streamBytes, expected)
+	}
+	return nil
+}
+
+// statePartSize is the part size the stream of state was split at. States written before
+// part_size was configurable split at zfs.PartSize.
+func statePartSize(state *manifest.State) int64 {
+	if state.PartSizeBytes > 0 {
+		return state.PartSizeBytes
+	}
+	return zfs.PartSize
+}
+
+// sendSingleFile streams zfs send through age into one encrypted file instead of splitting.
+func sendSingleFile(ctx context.Context, cfg *config.Config, task *config.Task, targetSnapshot, parentSnapshot, outputDir string, recipients []age.Recipient, limit int64) (string, int64, error) {
+	maxSize := task.SingleFileMaxSize()
+	if limit := remote.MaxUploadSize(cfg.S3UploadPartSize()); cfg.Uploads(task) && maxSize > limit {
+		return "", 0, fmt.Errorf("single_file_max_size_gb exceeds the S3 upload limit of %d bytes (10000 parts of s3.upload_part_size_mb)", limit)
+	}
+
+	estimated, err := zfs.EstimateSendSize(ctx, targetSnapshot, parentSnapshot)
+	if err != nil {
+		return "", 0, err
+	}
+	if estimated > maxSize {
+		return "", 0, fmt.Errorf("estimated stream size %d bytes exceeds single file limit of %d bytes", estimated, maxSize)
+	}
+	slog.Info("Running zfs send to single file", "targetSnapshot", targetSnapshot, "parentSnapshot", parentSnapshot, "estimatedBytes", estimated)
+
+	ageFile := filepath.Join(outputDir, manifest.PartFileName(manifest.SingleFileIndex))
+	tmpFile := ageFile + ".tmp"
+	defer os.Remove(tmpFile)
+
+	f, err := util.CreatePart(tmpFile)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
 
-		slog.Info("Existing backup state is for different task/level, starting fresh")
+	w, err := age.Encrypt(f, recipients...)
+	if err != nil {
+		return "", 0, err
 	}
 
-	return &manifest.State{}, nil
+	blake3Hash, streamBytes, err := zfs.Send(ctx, targetSnapshot, parentSnapshot, w, limit)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := w.Close(); err != nil {
+		return "", 0, err
+	}
+	syncer := fsync.FromContext(ctx)
+	if err := syncer.File(tmpFile); err != nil {
+		return "", 0, err
+	}
+	if err := f.Close(); err != nil {
+		return "", 0, err
+	}
+
+	if err := os.Rename(tmpFile, ageFile); err != nil {
+		return "", 0, err
+	}
+	if err := syncer.Dir(outputDir); err != nil {
+		return "", 0, err
+	}
+	return blake3Hash, streamBytes, nil
 }
 
 func processPartsWithWorkerPool(
@@ -434,18 +1057,40 @@ func processPartsWithWorkerPool(
 	outputDir string,
 	state *manifest.State,
 	statePath string,
-	recipient age.Recipient,
+	stateSync *remoteState,
+	recipients []age.Recipient,
 	backend remote.Backend,
 	task *config.Task,
 	taskDirName string,
 	backupLevel int16,
-) ([]manifest.PartInfo, error) {
-	numWorkers := 4 // TODO: make workers configurable
-	var partInfos []manifest.PartInfo
+	gate *pauseGate,
+	numWorkers int,
+	// verifyAttempts bounds the uploads of a part that fail the check after upload, 0 to not check.
+	verifyAttempts int,
+) (_ []manifest.PartInfo, retErr error) {
 	var wg sync.WaitGroup
-	var stateMu sync.Mutex
+	tracker := newPartTracker(state, statePath, outputDir, task, len(partIndices))
+	if stateSync != nil {
+		tracker.onFlush = func(s *manifest.State) { stateSync.push(ctx, s, false) }
+	}
+	if gate != nil {
+		gate.onPause = func() {
+			if err := tracker.flush(); err != nil {
+				slog.Warn("Failed to save backup state on pause", "error", err)
+			}
+		}
+	}
+	tags := remote.ObjectTags{Level: backupLevel, Task: task.Name, Generation: remote.GenerationFromTaskDir(taskDirName)}
 
-	partInfoChan := make(chan manifest.PartInfo, len(partIndices))
+	ctx, span := tracing.Start(ctx, "backup.parts", attribute.Int("parts", len(partIndices)))
+	defer func() { tracing.End(span, retErr) }()
+
+	// A permanent failure stops the other workers, as every part would fail the same way
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	notifier := sdnotify.FromContext(ctx)
+	stopping := shutdown.Stopping(ctx)
 	errChan := make(chan error, len(partIndices))
 	taskChan := make(chan string, len(partIndices))
 
@@ -456,88 +1101,53 @@ func processPartsWithWorkerPool(
 			defer wg.Done()
 
 			for index := range taskChan {
-				if ctx.Err() != nil {
+				// Once asked to stop, no part is started; the ones in flight finish.
+				select {
+				case <-stopping:
+					return
+				default:
+				}
+
+				// Paused workers wait here, between parts.
+				if err := gate.wait(ctx); err != nil || ctx.Err() != nil {
 					slog.Warn("Worker stopping due to context cancellation")
 					errChan <- ctx.Err()
 
 					return
 				}
 
-				stateMu.Lock()
-				completedHash := state.PartsCompleted[index]
-				stateMu.Unlock()
-
-				if completedHash != "" {
+				if stage, completedHash := tracker.stage(index); stage == partUploaded {
 					slog.Info("Skipping already completed part", "index", index)
-					partInfoChan <- manifest.PartInfo{Index: index, Blake3Hash: completedHash}
-
-					continue
-				}
-
-				rawFile := filepath.Join(outputDir, "snapshot.part-"+index)
-				ageFile := rawFile + ".age"
-
-				var blake3Hash string
-
-				if _, err := os.Stat(ageFile); err == nil {
-					slog.Info("Found existing encrypted file, skipping encryption", "ageFile", ageFile)
-
-					var err error
-					blake3Hash, err = crypto.BLAKE3File(ageFile)
-					if err != nil {
-						slog.Error("Failed to hash encrypted file", "ageFile", ageFile, "error", err)
+					if err := tracker.complete(index, completedHash, true); err != nil {
 						errChan <- err
 
-						continue
+						return
 					}
+					notifier.Step()
 
-					os.Remove(rawFile)
-				} else {
-					slog.Info("Encrypting part file", "rawFile", rawFile)
-
-					var err error
-					blake3Hash, _, err = crypto.ProcessPart(rawFile, recipient)
-					if err != nil {
-						slog.Error("Failed to process part file", "rawFile", rawFile, "error", err)
-						errChan <- err
-
-						continue
-					}
+					continue
 				}
 
-				if backend != nil {
+				blake3Hash, err := processPart(ctx, index, outputDir, recipients, backend, task, taskDirName, tags, gate, tracker, verifyAttempts)
+				if err != nil {
+					if remote.IsPermanent(err) {
+						cancel(fmt.Errorf("part %s: %w", index, err))
+					}
+					errChan <- &partError{index: index, err: err}
 					if ctx.Err() != nil {
-						slog.Warn("Worker stopping before upload due to context cancellation")
-						errChan <- ctx.Err()
-
 						return
 					}
 
-					slog.Info("Uploading part file to remote backend", "ageFile", ageFile)
-
-					remotePath := filepath.Join("data", task.Pool, task.Dataset, taskDirName, filepath.Base(ageFile))
-					if err := backend.Upload(ctx, ageFile, remotePath, blake3Hash, backupLevel); err != nil {
-						slog.Error("Failed to upload part file", "ageFile", ageFile, "error", err)
-						errChan <- err
-
-						continue
-					}
+					continue
 				}
 
-				stateMu.Lock()
-				state.PartsCompleted[index] = blake3Hash
-				state.LastUpdated = time.Now().Unix()
-				writeErr := manifest.WriteState(statePath, state)
-				stateMu.Unlock()
-
-				if writeErr != nil {
-					slog.Error("Failed to save backup state", "error", writeErr)
-					errChan <- fmt.Errorf("failed to save state for part %s: %w", index, writeErr)
+				if err := tracker.complete(index, blake3Hash, false); err != nil {
+					slog.Error("Failed to save backup state", "error", err)
+					errChan <- err
 
 					return
 				}
-
-				partInfoChan <- manifest.PartInfo{Index: index, Blake3Hash: blake3Hash}
+				notifier.Step()
 			}
 		}()
 	}
@@ -549,42 +1159,281 @@ func processPartsWithWorkerPool(
 	close(taskChan)
 
 	wg.Wait()
-	close(partInfoChan)
 	close(errChan)
 
+	// Persist whatever finished, even on failure, so a resumed run can skip it.
+	if err := tracker.flush(); err != nil {
+		return nil, fmt.Errorf("failed to save backup state: %w", err)
+	}
+
+	if cause := context.Cause(ctx); remote.IsPermanent(cause) {
+		_, hint := remote.Classify(cause)
+		return nil, fmt.Errorf("upload failed with a permanent error, likely because %s; the remaining parts were stopped: %w", hint, cause)
+	}
 	var errs []error
+	var failed []string
 	for err := range errChan {
 		errs = append(errs, err)
+		if partErr, ok := err.(*partError); ok {
+			failed = append(failed, partErr.index)
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		slog.Error("Parts failed, a resumed run retries them", "failed", failed, "done", len(tracker.infos), "parts", len(partIndices))
+		return nil, fmt.Errorf("failed to process part(s) %s, %d of %d part(s) done; run the backup again to resume with the failed parts: %w",
+			strings.Join(failed, ", "), len(tracker.infos), len(partIndices), errors.Join(errs...))
 	}
 	if len(errs) > 0 {
 		return nil, fmt.Errorf("failed to process %d part(s): %w", len(errs), errors.Join(errs...))
 	}
+	if done := len(tracker.infos); done < len(partIndices) {
+		slog.Warn("Stopped with parts left, a resumed run uploads them", "done", done, "parts", len(partIndices))
+		return nil, fmt.Errorf("%d of %d part(s) done: %w", done, len(partIndices), shutdown.ErrStopped)
+	}
+
+	return tracker.infos, nil
+}
+
+// partError is the failure of the part at index. Its encrypted file is kept, so a resumed run
+// only uploads it again.
+type partError struct {
+	index string
+	err   error
+}
+
+func (e *partError) Error() string {
+	return fmt.Sprintf("part %s: %v", e.index, e.err)
+}
+
+func (e *partError) Unwrap() error {
+	return e.err
+}
+
+// uploadManifest uploads the checksum files next to the parts, then the task manifest, and returns
+// the manifest's remote path.
+func uploadManifest(ctx context.Context, backend remote.Backend, manifestPath string, checksumPaths []string, task *config.Task, taskDirName string) (_ string, err error) {
+	ctx, span := tracing.Start(ctx, "backup.manifest_upload")
+	defer func() { tracing.End(span, err) }()
+
+	tags := remote.ObjectTags{Level: -1, Task: task.Name, Generation: remote.GenerationFromTaskDir(taskDirName)}
+
+	// Checksum files and the change list sit next to the parts but use the manifest storage class,
+	// so they stay readable.
+	for _, path := range checksumPaths {
+		checksumBlake3, err := crypto.BLAKE3File(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to calculate BLAKE3 of %s: %w", filepath.Base(path), err)
+		}
+		remotePath := remote.DataPath(task.S3Prefix, task.Pool, task.Dataset, taskDirName, filepath.Base(path))
+		if err := backend.Upload(ctx, path, remotePath, checksumBlake3, tags); err != nil {
+			return "", fmt.Errorf("failed to upload %s: %w", filepath.Base(path), err)
+		}
+	}
+
+	manifestBlake3, err := crypto.BLAKE3File(manifestPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to calculate manifest BLAKE3: %w", err)
+	}
+
+	remotePath := remote.ManifestPath(task.S3Prefix, task.Pool, task.Dataset, taskDirName, "task_manifest.yaml")
+	if err := backend.Upload(ctx, manifestPath, remotePath, manifestBlake3, tags); err != nil {
+		return "", fmt.Errorf("failed to upload manifest: %w", err)
+	}
+	return remotePath, nil
+}
+
+// processPart encrypts the raw part at index, or reuses an encrypted file left by an earlier run or,
+// with inline_encryption, by the send, and uploads it when a backend is set. It records the encrypted stage in tracker before the upload
+// and returns the BLAKE3 of the encrypted part.
+func processPart(ctx context.Context, index, outputDir string, recipients []age.Recipient, backend remote.Backend, task *config.Task, taskDirName string, tags remote.ObjectTags, gate *pauseGate, tracker *partTracker, verifyAttempts int) (blake3Hash string, err error) {
+	ctx, span := tracing.Start(ctx, "backup.part", attribute.String("part.index", index))
+	defer func() { tracing.End(span, err) }()
+
+	ageFile := filepath.Join(outputDir, manifest.PartFileName(index))
+	rawFile := strings.TrimSuffix(ageFile, ".age")
+
+	// A .age.tmp is an encryption a crash interrupted; the raw part is still there to redo it.
+	if err := os.Remove(ageFile + ".tmp"); err == nil {
+		slog.Info("Removed interrupted encryption, re-encrypting", "ageFile", ageFile+".tmp")
+	}
+
+	if _, err := os.Stat(ageFile); err == nil {
+		if err := crypto.QuickCheck(ageFile); err != nil {
+			if _, rawErr := os.Stat(rawFile); rawErr != nil {
+				slog.Error("Existing encrypted file is invalid and raw part is gone", "ageFile", ageFile, "error", err)
+				if task.InlineEncryption {
+					return "", inlinePartError(ageFile, err)
+				}
+				return "", err
+			}
+
+			slog.Warn("Existing encrypted file failed quick check, re-encrypting", "ageFile", ageFile, "error", err)
+			if err := os.Remove(ageFile); err != nil {
+				return "", fmt.Errorf("failed to remove invalid encrypted file %s: %w", ageFile, err)
+			}
+		}
+	}
+
+	stage, recordedHash := tracker.stage(index)
+	ageInfo, statErr := os.Stat(ageFile)
+	encryptedAt := time.Now()
+	switch {
+	case statErr == nil && stage == partEncrypted:
+		slog.Info("Resuming part at upload, encrypted earlier", "ageFile", ageFile)
+		blake3Hash = recordedHash
+		os.Remove(rawFile)
+	case statErr == nil:
+		slog.Info("Found existing encrypted file, skipping encryption", "ageFile", ageFile)
+		encryptedAt = ageInfo.ModTime()
+
+		blake3Hash, err = crypto.BLAKE3File(ageFile)
+		if err != nil {
+			slog.Error("Failed to hash encrypted file", "ageFile", ageFile, "error", err)
+			return "", err
+		}
+
+		os.Remove(rawFile)
+	case task.InlineEncryption:
+		// The send encrypted the parts; there never was a raw one.
+		slog.Error("Encrypted part is missing", "ageFile", ageFile, "error", statErr)
+		return "", inlinePartError(ageFile, statErr)
+	default:
+		slog.Info("Encrypting part file", "rawFile", rawFile)
+
+		_, encryptSpan := tracing.Start(ctx, "backup.part.encrypt")
+		// ProcessPart syncs the encrypted part before removing the raw one, so it survives a power
+		// failure before the state says it is done.
+		blake3Hash, _, err = crypto.ProcessPart(ctx, rawFile, recipients...)
+		tracing.End(encryptSpan, err)
+		if err != nil {
+			slog.Error("Failed to process part file", "rawFile", rawFile, "error", err)
+			return "", err
+		}
+		encryptedAt = time.Now()
+		events.Emit(ctx, events.Event{Stage: events.PartEncrypted, Part: index, Blake3: blake3Hash})
+	}
+	if stage != partEncrypted || blake3Hash != recordedHash {
+		if err := tracker.encrypted(index, blake3Hash, encryptedAt); err != nil {
+			return "", err
+		}
+	}
+
+	info, err := os.Stat(ageFile)
+	var size int64
+	if err == nil {
+		size = info.Size()
+		span.SetAttributes(attribute.Int64("part.size", size))
+		tracker.sized(index, size)
+	}
+
+	if backend != nil {
+		// A pause requested while encrypting holds the upload, the part that uses the uplink, and so
+		// does the upload window.
+		if err := gate.waitUpload(ctx); err != nil || ctx.Err() != nil {
+			slog.Warn("Worker stopping before upload due to context cancellation")
+			return "", ctx.Err()
+		}
+
+		remotePath := remote.DataPath(task.S3Prefix, task.Pool, task.Dataset, taskDirName, filepath.Base(ageFile))
+		// A crash between the upload and the state write leaves the part encrypted in the state but
+		// already in the bucket.
+		if stage == partEncrypted && info != nil {
+			if obj := uploaded(ctx, backend, remotePath, blake3Hash, info.Size()); obj != nil {
+				slog.Info("Part already uploaded by an earlier run, skipping upload", "ageFile", ageFile, "remote", remotePath)
+				tracker.uploaded(index, obj.LastModified, obj.Size)
+				return blake3Hash, nil
+			}
+		}
+
+		slog.Info("Uploading part file to remote backend", "ageFile", ageFile)
+
+		uploadCtx, retries := remote.WithRetryCounter(ctx)
+		err := uploadPart(uploadCtx, backend, ageFile, remotePath, blake3Hash, size, tags, verifyAttempts)
+		span.SetAttributes(attribute.Int64("part.retries", retries.Load()))
+		if err != nil {
+			slog.Error("Failed to upload part file", "ageFile", ageFile, "error", err)
+			return "", err
+		}
+		tracker.uploaded(index, time.Now(), size)
+		events.Emit(ctx, events.Event{Stage: events.PartUploaded, Part: index, Object: remotePath, Blake3: blake3Hash})
+	}
+
+	return blake3Hash, nil
+}
+
+// uploadPart uploads the encrypted part and, if verifyAttempts is above 0, checks the size and
+// BLAKE3 hash of the object with a HEAD request, uploading it again on a mismatch until
+// verifyAttempts uploads failed the check.
+func uploadPart(ctx context.Context, backend remote.Backend, ageFile, remotePath, blake3Hash string, size int64, tags remote.ObjectTags, verifyAttempts int) error {
+	for attempt := 1; ; attempt++ {
+		if err := backend.Upload(ctx, ageFile, remotePath, blake3Hash, tags); err != nil {
+			return err
+		}
+		if verifyAttempts <= 0 {
+			return nil
+		}
+		err := verifyUpload(ctx, backend, remotePath, blake3Hash, size)
+		if err == nil {
+			return nil
+		}
+		if attempt >= verifyAttempts || ctx.Err() != nil {
+			return fmt.Errorf("uploaded part failed verification after %d attempt(s): %w", attempt, err)
+		}
+		slog.Warn("Uploaded part failed verification, uploading again", "remote", remotePath, "attempt", attempt, "error", err)
+	}
+}
 
-	for pi := range partInfoChan {
-		partInfos = append(partInfos, pi)
+// verifyUpload checks that the object at remotePath has the size and BLAKE3 hash of the part.
+func verifyUpload(ctx context.Context, backend remote.Backend, remotePath, blake3Hash string, size int64) error {
+	obj, err := backend.Head(ctx, remotePath)
+	if err != nil {
+		return fmt.Errorf("failed to check uploaded object %s: %w", remotePath, err)
+	}
+	if obj.Size != size {
+		return fmt.Errorf("size mismatch for %s: local=%d remote=%d", remotePath, size, obj.Size)
 	}
+	if obj.Blake3 != blake3Hash {
+		return fmt.Errorf("BLAKE3 mismatch for %s: expected=%s remote=%s", remotePath, blake3Hash, obj.Blake3)
+	}
+	return nil
+}
 
-	return partInfos, nil
+// uploaded returns the object at remotePath if it is the encrypted part with blake3Hash and size,
+// nil otherwise. Any failure to tell counts as not uploaded.
+func uploaded(ctx context.Context, backend remote.Backend, remotePath, blake3Hash string, size int64) *remote.ObjectInfo {
+	obj, err := backend.Head(ctx, remotePath)
+	if err != nil {
+		if !remote.IsNotFound(err) {
+			slog.Debug("Failed to check for an uploaded part, uploading it", "remote", remotePath, "error", err)
+		}
+		return nil
+	}
+	if obj.Blake3 != blake3Hash || obj.Size != size {
+		return nil
+	}
+	return obj
 }
 
 func verifyLevel0Parts(ctx context.Context, backend remote.Backend, partInfos []manifest.PartInfo, outputDir string, task *config.Task, taskDirName string) error {
 	slog.Info("Verifying level 0 uploaded parts", "count", len(partInfos))
 
 	for _, pi := range partInfos {
-		ageFile := filepath.Join(outputDir, "snapshot.part-"+pi.Index+".age")
+		ageFile := filepath.Join(outputDir, manifest.PartFileName(pi.Index))
 
+		// A backup resumed from the remote state has no local copy; the BLAKE3 check still applies.
 		localInfo, err := os.Stat(ageFile)
-		if err != nil {
+		if err != nil && !os.IsNotExist(err) {
 			return fmt.Errorf("failed to stat local file %s: %w", ageFile, err)
 		}
 
-		remotePath := filepath.Join("data", task.Pool, task.Dataset, taskDirName, filepath.Base(ageFile))
+		remotePath := remote.DataPath(task.S3Prefix, task.Pool, task.Dataset, taskDirName, filepath.Base(ageFile))
 		obj, err := backend.Head(ctx, remotePath)
 		if err != nil {
 			return fmt.Errorf("verification failed for part %s: %w", pi.Index, err)
 		}
 
-		if obj.Size != localInfo.Size() {
+		if localInfo != nil && obj.Size != localInfo.Size() {
 			return fmt.Errorf("size mismatch for part %s: local=%d remote=%d", pi.Index, localInfo.Size(), obj.Size)
 		}
 		if obj.Blake3 != pi.Blake3Hash {
@@ -0,0 +1,2755 @@
+package backup
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"zrb/internal/config"
+	"zrb/internal/crypto"
+	"zrb/internal/events"
+	"zrb/internal/fsync"
+	"zrb/internal/manifest"
+	"zrb/internal/remote"
+	"zrb/internal/shutdown"
+	"zrb/internal/stats"
+	"zrb/internal/util"
+	"zrb/internal/verify"
+	"zrb/internal/zfs"
+
+	"filippo.io/age"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func touch(t *testing.T, path string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, nil, 0o644))
+}
+
+func TestFindPartIndices(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, name := range []string{
+		"snapshot.part-aaaaaa",
+		"snapshot.part-aaaaab.age",
+		"snapshot.part-aaaaac",
+		"snapshot.part-aaaaac.age",
+		"snapshot.part-aaaaaa.age.tmp",
+		"task_manifest.yaml",
+	} {
+		touch(t, filepath.Join(dir, name))
+	}
+
+	junk := []string{
+		"snapshot.part-.tmp",
+		"snapshot.part-aaaaad.tmp",
+		"snapshot.part-aaaaaa~",
+		"snapshot.part-AAAAAA",
+		"snapshot.part-aaa",
+		".snapshot.part-aaaaaa.swp",
+	}
+	for _, name := range junk {
+		touch(t, filepath.Join(dir, name))
+	}
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "snapshot.part-aaaaae"), 0o755))
+
+	indices, unexpected, err := findPartIndices(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"aaaaaa", "aaaaab", "aaaaac"}, indices)
+	assert.ElementsMatch(t, append(junk, "snapshot.part-aaaaae"), unexpected)
+}
+
+func TestFindPartIndicesOnlyJunk(t *testing.T) {
+	dir := t.TempDir()
+	touch(t, filepath.Join(dir, "snapshot.part-aaaaaa.tmp"))
+
+	_, unexpected, err := findPartIndices(dir)
+	assert.ErrorContains(t, err, "no snapshot parts found")
+	assert.Equal(t, []string{"snapshot.part-aaaaaa.tmp"}, unexpected)
+}
+
+func TestFindPartIndicesSingleFile(t *testing.T) {
+	dir := t.TempDir()
+	touch(t, filepath.Join(dir, "snapshot.age"))
+
+	indices, _, err := findPartIndices(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"single"}, indices)
+}
+
+func TestProcessPartRedoesInterruptedEncryption(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	raw := filepath.Join(dir, "snapshot.part-aaaaaa")
+	content := make([]byte, 200<<10)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	require.NoError(t, os.WriteFile(raw, content, 0o644))
+
+	// A crash in the middle of the encryption leaves a truncated .age.tmp next to the raw part.
+	require.NoError(t, crypto.Encrypt(raw, raw+".age.tmp", identity.Recipient()))
+	require.NoError(t, os.Truncate(raw+".age.tmp", 100<<10))
+
+	indices, unexpected, err := findPartIndices(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"aaaaaa"}, indices)
+	assert.Empty(t, unexpected)
+
+	task := &config.Task{Name: "t", Pool: "p", Dataset: "d"}
+	hash, err := processPart(context.Background(), "aaaaaa", dir, []age.Recipient{identity.Recipient()}, nil, task, "20240101", remote.ObjectTags{}, nil, nil, 0)
+	require.NoError(t, err)
+
+	assert.NoFileExists(t, raw+".age.tmp")
+	assert.NoFileExists(t, raw)
+	require.NoError(t, crypto.QuickCheck(raw+".age"))
+	want, err := crypto.BLAKE3File(raw + ".age")
+	require.NoError(t, err)
+	assert.Equal(t, want, hash)
+
+	require.NoError(t, crypto.Decrypt(raw+".age", raw+".out", identity))
+	got, err := os.ReadFile(raw + ".out")
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+}
+
+// failingUploadBackend is a fileBackend whose uploads fail while fail is set, after writing half of
+// the object when partial is set, as a connection lost mid-upload would.
+type failingUploadBackend struct {
+	*fileBackend
+	fail, partial bool
+}
+
+func (b *failingUploadBackend) Upload(ctx context.Context, localPath, remotePath, checksumHash string, tags remote.ObjectTags) error {
+	if !b.fail {
+		return b.fileBackend.Upload(ctx, localPath, remotePath, checksumHash, tags)
+	}
+	if b.partial {
+		data, err := os.ReadFile(localPath)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(b.dir, remotePath)
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(dst, data[:len(data)/2], 0o644); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("connection reset by peer")
+}
+
+func TestProcessPartResumesStage(t *testing.T) {
+	oldInterval := stateFlushInterval
+	stateFlushInterval = 0
+	defer func() { stateFlushInterval = oldInterval }()
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	recipients := []age.Recipient{identity.Recipient()}
+	task := &config.Task{Name: "t", Pool: "p", Dataset: "d"}
+	const index = "aaaaaa"
+
+	type setup struct {
+		dir, statePath string
+		backend        *failingUploadBackend
+	}
+	newSetup := func(t *testing.T) setup {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "snapshot.part-"+index), []byte(strings.Repeat("x", 64<<10)), 0o644))
+		statePath := filepath.Join(t.TempDir(), "backup_state.yaml")
+		require.NoError(t, manifest.WriteState(statePath, &manifest.State{TaskName: "t", PartsCompleted: map[string]string{}}))
+		return setup{dir: dir, statePath: statePath, backend: &failingUploadBackend{fileBackend: &fileBackend{dir: t.TempDir()}}}
+	}
+	// run processes the part like a worker reading the saved state, and crashes before the part
+	// is completed when crash is set.
+	run := func(t *testing.T, s setup, crash bool) (string, error) {
+		state, err := manifest.ReadState(s.statePath)
+		require.NoError(t, err)
+		tracker := newPartTracker(state, s.statePath, s.dir, task, 1)
+		hash, err := processPart(context.Background(), index, s.dir, recipients, s.backend, task, "20240101", remote.ObjectTags{}, nil, tracker, 1)
+		if err == nil && !crash {
+			require.NoError(t, tracker.complete(index, hash, false))
+		}
+		require.NoError(t, tracker.flush())
+		return hash, err
+	}
+	readState := func(t *testing.T, s setup) *manifest.State {
+		state, err := manifest.ReadState(s.statePath)
+		require.NoError(t, err)
+		return state
+	}
+	ageFile := func(s setup) string { return filepath.Join(s.dir, "snapshot.part-"+index+".age") }
+
+	for _, tt := range []struct {
+		name    string
+		partial bool
+	}{
+		{name: "upload fails after encrypting"},
+		{name: "crash mid-upload", partial: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSetup(t)
+			s.backend.fail, s.backend.partial = true, tt.partial
+			_, err := run(t, s, false)
+			require.ErrorContains(t, err, "connection reset")
+
+			state := readState(t, s)
+			assert.Empty(t, state.PartsCompleted, "a failed upload is not completed")
+			require.Contains(t, state.PartsEncrypted, index)
+			encrypted, err := os.ReadFile(ageFile(s))
+			require.NoError(t, err)
+			want, err := crypto.BLAKE3File(ageFile(s))
+			require.NoError(t, err)
+			assert.Equal(t, want, state.PartsEncrypted[index], "the hash is recorded at the encrypted stage")
+			encryptedAt := state.PartTimes[index].EncryptedAt
+			assert.NotZero(t, encryptedAt)
+			assert.Zero(t, state.PartTimes[index].UploadedAt)
+
+			s.backend.fail = false
+			hash, err := run(t, s, false)
+			require.NoError(t, err)
+			assert.Equal(t, want, hash)
+			again, err := os.ReadFile(ageFile(s))
+			require.NoError(t, err)
+			assert.Equal(t, encrypted, again, "the part is not encrypted again")
+			assert.Equal(t, 1, s.backend.uploads, "the part is uploaded in full")
+			uploadedData, err := os.ReadFile(filepath.Join(s.backend.dir, remote.DataPath("", "p", "d", "20240101", "snapshot.part-"+index+".age")))
+			require.NoError(t, err)
+			assert.Equal(t, encrypted, uploadedData)
+
+			state = readState(t, s)
+			assert.Equal(t, map[string]string{index: want}, state.PartsCompleted)
+			assert.Empty(t, state.PartsEncrypted)
+			assert.Equal(t, encryptedAt, state.PartTimes[index].EncryptedAt, "the encryption time survives the resume")
+			assert.GreaterOrEqual(t, state.PartTimes[index].UploadedAt, encryptedAt)
+		})
+	}
+
+	t.Run("crash after upload before the state write", func(t *testing.T) {
+		s := newSetup(t)
+		hash, err := run(t, s, true)
+		require.NoError(t, err)
+		assert.Equal(t, 1, s.backend.uploads)
+		assert.Equal(t, map[string]string{index: hash}, readState(t, s).PartsEncrypted)
+		object := filepath.Join(s.backend.dir, remote.DataPath("", "p", "d", "20240101", "snapshot.part-"+index+".age"))
+		uploadedAt := time.Unix(1700000000, 0)
+		require.NoError(t, os.Chtimes(object, uploadedAt, uploadedAt))
+
+		resumed, err := run(t, s, false)
+		require.NoError(t, err)
+		assert.Equal(t, hash, resumed)
+		assert.Equal(t, 1, s.backend.uploads, "the uploaded part is found in the bucket and not uploaded again")
+		state := readState(t, s)
+		assert.Equal(t, map[string]string{index: hash}, state.PartsCompleted)
+		assert.Equal(t, uploadedAt.Unix(), state.PartTimes[index].UploadedAt, "the upload time is the object's")
+	})
+
+	t.Run("crash after encrypting before the state write", func(t *testing.T) {
+		s := newSetup(t)
+		hash, err := run(t, s, true)
+		require.NoError(t, err)
+		// The state written before the crash did not have the part yet.
+		require.NoError(t, manifest.WriteState(s.statePath, &manifest.State{TaskName: "t", PartsCompleted: map[string]string{}}))
+		require.NoError(t, os.RemoveAll(s.backend.dir))
+
+		resumed, err := run(t, s, false)
+		require.NoError(t, err)
+		assert.Equal(t, hash, resumed, "the encrypted file is hashed again rather than encrypted again")
+		assert.Equal(t, 2, s.backend.uploads)
+	})
+}
+
+// mangledBackend is a fileBackend whose HEAD requests report a mangled object for the first bad
+// uploads, as a proxy truncating them would.
+type mangledBackend struct {
+	*fileBackend
+	bad    int
+	mangle func(obj *remote.ObjectInfo)
+	heads  int
+}
+
+func (b *mangledBackend) Head(ctx context.Context, remotePath string) (*remote.ObjectInfo, error) {
+	obj, err := b.fileBackend.Head(ctx, remotePath)
+	if err != nil {
+		return nil, err
+	}
+	b.heads++
+	if b.heads <= b.bad {
+		b.mangle(obj)
+	}
+	return obj, nil
+}
+
+func TestProcessPartVerifiesUpload(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	task := &config.Task{Name: "t", Pool: "p", Dataset: "d"}
+	truncated := func(obj *remote.ObjectInfo) { obj.Size /= 2 }
+
+	tests := []struct {
+		name           string
+		bad            int
+		mangle         func(obj *remote.ObjectInfo)
+		verifyAttempts int
+		uploads        int
+		err            string
+	}{
+		{name: "intact", mangle: truncated, verifyAttempts: 3, uploads: 1},
+		{name: "truncated once", bad: 1, mangle: truncated, verifyAttempts: 3, uploads: 2},
+		{name: "always truncated", bad: 10, mangle: truncated, verifyAttempts: 3, uploads: 3, err: "failed verification after 3 attempt(s): size mismatch"},
+		{name: "hash differs", bad: 10, mangle: func(obj *remote.ObjectInfo) { obj.Blake3 = "0123" }, verifyAttempts: 2, uploads: 2, err: "BLAKE3 mismatch"},
+		{name: "not verified", bad: 10, mangle: truncated, uploads: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "snapshot.part-aaaaaa"), []byte(strings.Repeat("x", 64<<10)), 0o644))
+			backend := &mangledBackend{fileBackend: &fileBackend{dir: t.TempDir()}, bad: tt.bad, mangle: tt.mangle}
+
+			_, err := processPart(context.Background(), "aaaaaa", dir, []age.Recipient{identity.Recipient()}, backend, task, "20240101", remote.ObjectTags{}, nil, nil, tt.verifyAttempts)
+			if tt.err != "" {
+				assert.ErrorContains(t, err, tt.err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.uploads, backend.uploads)
+			if tt.verifyAttempts == 0 {
+				assert.Zero(t, backend.heads, "nothing is checked with verification off")
+			}
+		})
+	}
+}
+
+func TestPartTrackerRecordsTimes(t *testing.T) {
+	dir := t.TempDir()
+	state := &manifest.State{TaskName: "t", PartsCompleted: map[string]string{}}
+	tracker := newPartTracker(state, filepath.Join(dir, "backup_state.yaml"), dir, &config.Task{Pool: "p", Dataset: "d"}, 2)
+
+	require.NoError(t, tracker.encrypted("aaaaaa", "h1", time.Unix(100, 0)))
+	tracker.sized("aaaaaa", 100)
+	tracker.uploaded("aaaaaa", time.Unix(160, 0), 100)
+	require.NoError(t, tracker.complete("aaaaaa", "h1", false))
+	require.NoError(t, tracker.encrypted("aaaaab", "h2", time.Unix(110, 0)))
+	tracker.uploaded("aaaaab", time.Time{}, 50)
+	require.NoError(t, tracker.complete("aaaaab", "h2", false))
+
+	assert.Equal(t, []manifest.PartInfo{
+		{Index: "aaaaaa", Blake3Hash: "h1", EncryptedAt: 100, UploadedAt: 160, SizeBytes: 100},
+		{Index: "aaaaab", Blake3Hash: "h2", EncryptedAt: 110},
+	}, tracker.infos, "an unknown upload time or size is not recorded")
+	assert.Equal(t, int64(150), state.UploadedBytes, "the sizes of the uploaded parts are counted")
+
+	require.NoError(t, tracker.writePartialLocked())
+	partial, err := manifest.Read(filepath.Join(dir, partialManifestName))
+	require.NoError(t, err)
+	assert.Equal(t, tracker.infos, partial.Parts)
+}
+
+func TestCheckPartCount(t *testing.T) {
+	three := []string{"aaaaaa", "aaaaab", "aaaaac"}
+
+	assert.NoError(t, checkPartCount(three, 2*zfs.PartSize+1, zfs.PartSize))
+	assert.NoError(t, checkPartCount(three, 3*zfs.PartSize, zfs.PartSize))
+	assert.Error(t, checkPartCount(three, 3*zfs.PartSize+1, zfs.PartSize))
+	assert.Error(t, checkPartCount(three, 2*zfs.PartSize, zfs.PartSize))
+	assert.NoError(t, checkPartCount(three, 0, zfs.PartSize), "unknown stream size is not checked")
+	assert.NoError(t, checkPartCount([]string{"single"}, 10*zfs.PartSize, zfs.PartSize))
+	assert.NoError(t, checkPartCount(three, 3<<30, 1<<30), "a configured part size")
+	assert.Error(t, checkPartCount(three, 3<<30, zfs.PartSize))
+}
+
+type countingBackend struct {
+	remote.Backend
+	uploads atomic.Int64
+}
+
+func (b *countingBackend) Upload(_ context.Context, _, _, _ string, _ remote.ObjectTags) error {
+	b.uploads.Add(1)
+	return nil
+}
+
+func TestProcessPartsManyParts(t *testing.T) {
+	const total = 10000
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	indices := make([]string, total)
+	for i := range indices {
+		indices[i] = fmt.Sprintf("a%05d", i)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "snapshot.part-"+indices[i]), []byte{byte(i)}, 0o644))
+	}
+
+	// Pretend the first 100 parts were finished by an earlier, interrupted run.
+	state := &manifest.State{TaskName: "t", BackupLevel: 1, Blake3Hash: "stream", PartsCompleted: make(map[string]string)}
+	for _, index := range indices[:100] {
+		state.PartsCompleted[index] = "resumed-" + index
+	}
+
+	oldInterval, oldEvery := stateFlushInterval, partialManifestEvery
+	stateFlushInterval, partialManifestEvery = time.Hour, 1000
+	defer func() { stateFlushInterval, partialManifestEvery = oldInterval, oldEvery }()
+
+	statePath := filepath.Join(t.TempDir(), "backup_state.yaml")
+	backend := &countingBackend{}
+	task := &config.Task{Name: "t", Pool: "p", Dataset: "d"}
+
+	infos, err := processPartsWithWorkerPool(context.Background(), indices, dir, state, statePath, nil, []age.Recipient{identity.Recipient()}, backend, task, "20240101", 1, nil, 4, 0)
+	require.NoError(t, err)
+
+	assert.Len(t, infos, total)
+	assert.Equal(t, int64(total-100), backend.uploads.Load())
+
+	saved, err := manifest.ReadState(statePath)
+	require.NoError(t, err)
+	assert.Len(t, saved.PartsCompleted, total)
+	assert.Equal(t, "resumed-"+indices[0], saved.PartsCompleted[indices[0]])
+
+	partial, err := manifest.Read(filepath.Join(dir, partialManifestName))
+	require.NoError(t, err)
+	assert.True(t, partial.Incomplete)
+	assert.Equal(t, "stream", partial.Blake3Hash)
+	assert.GreaterOrEqual(t, len(partial.Parts), total-1000)
+	assert.True(t, sort.SliceIsSorted(partial.Parts, func(i, j int) bool {
+		return partial.Parts[i].Index < partial.Parts[j].Index
+	}))
+}
+
+// deniedBackend rejects every upload the way S3 does when the credentials lack permission.
+type deniedBackend struct {
+	remote.Backend
+	uploads atomic.Int64
+}
+
+func (b *deniedBackend) Upload(_ context.Context, _, _, _ string, _ remote.ObjectTags) error {
+	b.uploads.Add(1)
+	time.Sleep(10 * time.Millisecond)
+	return accessDenied()
+}
+
+func accessDenied() error {
+	return &smithyhttp.ResponseError{Response: &smithyhttp.Response{Response: &http.Response{StatusCode: http.StatusForbidden}},
+		Err: &smithy.GenericAPIError{Code: "AccessDenied", Message: "Access Denied"}}
+}
+
+func TestProcessPartsStopsOnPermanentError(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	indices := make([]string, 50)
+	for i := range indices {
+		indices[i] = fmt.Sprintf("a%05d", i)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "snapshot.part-"+indices[i]), []byte{byte(i)}, 0o644))
+	}
+	state := &manifest.State{TaskName: "t", BackupLevel: 1, Blake3Hash: "stream", PartsCompleted: make(map[string]string)}
+	statePath := filepath.Join(t.TempDir(), "backup_state.yaml")
+	backend := &deniedBackend{}
+	task := &config.Task{Name: "t", Pool: "p", Dataset: "d"}
+
+	_, err = processPartsWithWorkerPool(context.Background(), indices, dir, state, statePath, nil, []age.Recipient{identity.Recipient()}, backend, task, "20240101", 1, nil, 4, 0)
+	require.Error(t, err)
+	assert.True(t, remote.IsPermanent(err))
+	assert.ErrorContains(t, err, "upload failed with a permanent error, likely because the credentials lack permission for s3.bucket and s3.prefix")
+	assert.NotContains(t, err.Error(), "context canceled", "only the permanent error is reported")
+	assert.LessOrEqual(t, backend.uploads.Load(), int64(4), "no worker starts another upload after the first rejection")
+
+	saved, err := manifest.ReadState(statePath)
+	require.NoError(t, err)
+	assert.NotEmpty(t, saved.PartsEncrypted, "the encrypted parts are kept for the next run")
+}
+
+// partFailingBackend is a fileBackend whose uploads of the parts in fail fail with a transient error.
+type partFailingBackend struct {
+	*fileBackend
+	fail map[string]bool
+}
+
+func (b *partFailingBackend) Upload(ctx context.Context, localPath, remotePath, checksumHash string, tags remote.ObjectTags) error {
+	if b.fail[strings.TrimSuffix(strings.TrimPrefix(filepath.Base(localPath), "snapshot.part-"), ".age")] {
+		return fmt.Errorf("connection reset by peer")
+	}
+	return b.fileBackend.Upload(ctx, localPath, remotePath, checksumHash, tags)
+}
+
+func TestProcessPartsKeepsCompletedOnFailure(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	indices := make([]string, 8)
+	for i := range indices {
+		indices[i] = fmt.Sprintf("a%05d", i)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "snapshot.part-"+indices[i]), []byte{byte(i)}, 0o644))
+	}
+	state := &manifest.State{TaskName: "t", BackupLevel: 1, Blake3Hash: "stream", PartsCompleted: make(map[string]string)}
+	statePath := filepath.Join(t.TempDir(), "backup_state.yaml")
+	backend := &partFailingBackend{fileBackend: &fileBackend{dir: t.TempDir()}, fail: map[string]bool{"a00005": true, "a00002": true}}
+	task := &config.Task{Name: "t", Pool: "p", Dataset: "d"}
+	recipients := []age.Recipient{identity.Recipient()}
+
+	_, err = processPartsWithWorkerPool(context.Background(), indices, dir, state, statePath, nil, recipients, backend, task, "20240101", 1, nil, 4, 0)
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "failed to process part(s) a00002, a00005, 6 of 8 part(s) done; run the backup again to resume")
+	assert.ErrorContains(t, err, "connection reset by peer")
+
+	saved, err := manifest.ReadState(statePath)
+	require.NoError(t, err)
+	assert.Len(t, saved.PartsCompleted, 6, "the parts that succeeded stay recorded")
+	require.Len(t, saved.PartsEncrypted, 2)
+	encrypted := make(map[string][]byte)
+	for index := range saved.PartsEncrypted {
+		data, err := os.ReadFile(filepath.Join(dir, "snapshot.part-"+index+".age"))
+		require.NoError(t, err, "the encrypted file of a failed part is kept")
+		encrypted[index] = data
+	}
+
+	backend.fail = nil
+	backend.uploads = 0
+	infos, err := processPartsWithWorkerPool(context.Background(), indices, dir, saved, statePath, nil, recipients, backend, task, "20240101", 1, nil, 4, 0)
+	require.NoError(t, err)
+	assert.Len(t, infos, 8)
+	assert.Equal(t, 2, backend.uploads, "only the failed parts are uploaded again")
+	for index, data := range encrypted {
+		again, err := os.ReadFile(filepath.Join(dir, "snapshot.part-"+index+".age"))
+		require.NoError(t, err)
+		assert.Equal(t, data, again, "part %s is not encrypted again", index)
+	}
+}
+
+// slowBackend takes delay for each upload, or fails with the error of ctx when it is cancelled first.
+type slowBackend struct {
+	remote.Backend
+	delay    time.Duration
+	started  chan struct{}
+	uploaded atomic.Int64
+}
+
+func (b *slowBackend) Upload(ctx context.Context, _, _, _ string, _ remote.ObjectTags) error {
+	select {
+	case b.started <- struct{}{}:
+	default:
+	}
+	select {
+	case <-time.After(b.delay):
+		b.uploaded.Add(1)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestProcessPartsShutdownGrace(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		name    string
+		grace   time.Duration
+		wantErr error
+	}{
+		{"parts in flight finish", time.Minute, shutdown.ErrStopped},
+		{"grace period over", 20 * time.Millisecond, context.Canceled},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			indices := make([]string, 20)
+			for i := range indices {
+				indices[i] = fmt.Sprintf("a%05d", i)
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "snapshot.part-"+indices[i]), []byte{byte(i)}, 0o644))
+			}
+			state := &manifest.State{TaskName: "t", BackupLevel: 1, Blake3Hash: "stream", PartsCompleted: make(map[string]string)}
+			statePath := filepath.Join(t.TempDir(), "backup_state.yaml")
+			backend := &slowBackend{delay: 300 * time.Millisecond, started: make(chan struct{}, 1)}
+			task := &config.Task{Name: "t", Pool: "p", Dataset: "d"}
+
+			ctx, stop := shutdown.NotifyContext(context.Background(), syscall.SIGUSR2)
+			defer stop()
+			release := shutdown.Grace(ctx, tt.grace)
+			go func() {
+				// SIGTERM while the first parts are nearly uploaded
+				<-backend.started
+				time.Sleep(250 * time.Millisecond)
+				assert.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGUSR2))
+			}()
+			_, runErr := processPartsWithWorkerPool(ctx, indices, dir, state, statePath, nil, []age.Recipient{identity.Recipient()}, backend, task, "20240101", 1, nil, 4, 0)
+			release()
+			require.ErrorIs(t, runErr, tt.wantErr)
+
+			saved, err := manifest.ReadState(statePath)
+			require.NoError(t, err)
+			assert.Len(t, saved.PartsCompleted, int(backend.uploaded.Load()), "the state records every part uploaded")
+			if tt.wantErr == shutdown.ErrStopped {
+				assert.Positive(t, backend.uploaded.Load(), "the parts in flight were uploaded")
+				assert.Less(t, backend.uploaded.Load(), int64(len(indices)), "no part was started after the signal")
+				assert.NotContains(t, runErr.Error(), "context canceled")
+			} else {
+				assert.Zero(t, backend.uploaded.Load(), "the uploads in flight were cut off")
+				assert.NotEmpty(t, saved.PartsEncrypted, "the encrypted parts are kept for the next run")
+			}
+		})
+	}
+}
+
+func TestPauseGate(t *testing.T) {
+	oldInterval := pausePollInterval
+	pausePollInterval = 10 * time.Millisecond
+	defer func() { pausePollInterval = oldInterval }()
+
+	file := filepath.Join(t.TempDir(), pauseFileName)
+	gate := newPauseGate(file, nil)
+	var pauses atomic.Int32
+	gate.onPause = func() { pauses.Add(1) }
+
+	// waitAsync returns a channel receiving the result of gate.wait once it returns.
+	waitAsync := func(ctx context.Context) <-chan error {
+		result := make(chan error, 1)
+		go func() { result <- gate.wait(ctx) }()
+		return result
+	}
+	blocked := func(result <-chan error) bool {
+		select {
+		case <-result:
+			return false
+		case <-time.After(50 * time.Millisecond):
+			return true
+		}
+	}
+
+	require.NoError(t, gate.wait(context.Background()), "not paused")
+
+	toggles := make(chan os.Signal, 1)
+	stop := gate.watch(context.Background(), toggles)
+	defer stop()
+
+	toggles <- syscall.SIGUSR1
+	require.Eventually(t, func() bool {
+		gate.mu.Lock()
+		defer gate.mu.Unlock()
+		return gate.signalled
+	}, time.Second, time.Millisecond)
+	result := waitAsync(context.Background())
+	assert.True(t, blocked(result), "paused by the signal")
+	toggles <- syscall.SIGUSR1
+	require.NoError(t, <-result, "resumed by the next signal")
+	assert.Equal(t, int32(1), pauses.Load(), "the state is saved once per pause")
+
+	touch(t, file)
+	result = waitAsync(context.Background())
+	assert.True(t, blocked(result), "paused by the file")
+	require.NoError(t, os.Remove(file))
+	require.NoError(t, <-result, "resumed when the file is removed")
+	assert.Equal(t, int32(2), pauses.Load())
+
+	touch(t, file)
+	ctx, cancel := context.WithCancel(context.Background())
+	result = waitAsync(ctx)
+	assert.True(t, blocked(result))
+	cancel()
+	assert.ErrorIs(t, <-result, context.Canceled, "cancellation ends a pause")
+
+	var none *pauseGate
+	assert.NoError(t, none.wait(context.Background()))
+}
+
+func TestProcessPartsPaused(t *testing.T) {
+	oldInterval := pausePollInterval
+	pausePollInterval = 10 * time.Millisecond
+	defer func() { pausePollInterval = oldInterval }()
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	indices := []string{"aa", "ab", "ac"}
+	for i, index := range indices {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "snapshot.part-"+index), []byte{byte(i)}, 0o644))
+	}
+	state := &manifest.State{TaskName: "t", BackupLevel: 1, Blake3Hash: "stream", PartsCompleted: make(map[string]string)}
+	statePath := filepath.Join(t.TempDir(), "backup_state.yaml")
+	backend := &countingBackend{}
+	task := &config.Task{Name: "t", Pool: "p", Dataset: "d"}
+
+	pauseFile := filepath.Join(t.TempDir(), pauseFileName)
+	touch(t, pauseFile)
+	gate := newPauseGate(pauseFile, nil)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := processPartsWithWorkerPool(context.Background(), indices, dir, state, statePath, nil, []age.Recipient{identity.Recipient()}, backend, task, "20240101", 1, gate, 4, 0)
+		done <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Zero(t, backend.uploads.Load(), "no part starts while paused")
+	assert.FileExists(t, filepath.Join(dir, "snapshot.part-aa"))
+
+	require.NoError(t, os.Remove(pauseFile))
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("workers did not resume")
+	}
+	assert.Equal(t, int64(len(indices)), backend.uploads.Load())
+}
+
+func TestUploadWindowState(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+	at := func(s string) time.Time {
+		tm, err := time.Parse(time.RFC3339, s)
+		require.NoError(t, err)
+		return tm
+	}
+
+	tests := []struct {
+		name       string
+		start, end string
+		now        string
+		wantOpen   bool
+		wantUntil  string
+	}{
+		{name: "inside", start: "01:00", end: "05:00", now: "2024-01-10T03:00:00+01:00", wantOpen: true, wantUntil: "2024-01-10T05:00:00+01:00"},
+		{name: "after the window", start: "01:00", end: "05:00", now: "2024-01-10T06:00:00+01:00", wantUntil: "2024-01-11T01:00:00+01:00"},
+		{name: "before the window", start: "01:00", end: "05:00", now: "2024-01-10T00:59:59+01:00", wantUntil: "2024-01-10T01:00:00+01:00"},
+		{name: "at the start", start: "01:00", end: "05:00", now: "2024-01-10T01:00:00+01:00", wantOpen: true, wantUntil: "2024-01-10T05:00:00+01:00"},
+		{name: "at the end", start: "01:00", end: "05:00", now: "2024-01-10T05:00:00+01:00", wantUntil: "2024-01-11T01:00:00+01:00"},
+		{name: "across midnight before it", start: "22:00", end: "06:00", now: "2024-01-10T23:00:00+01:00", wantOpen: true, wantUntil: "2024-01-11T06:00:00+01:00"},
+		{name: "across midnight after it", start: "22:00", end: "06:00", now: "2024-01-11T02:00:00+01:00", wantOpen: true, wantUntil: "2024-01-11T06:00:00+01:00"},
+		{name: "across midnight outside", start: "22:00", end: "06:00", now: "2024-01-11T12:00:00+01:00", wantUntil: "2024-01-11T22:00:00+01:00"},
+		{name: "other time zone of now", start: "22:00", end: "06:00", now: "2024-01-11T04:00:00Z", wantOpen: true, wantUntil: "2024-01-11T06:00:00+01:00"},
+		// On 2024-03-31 the clocks in Berlin skip from 02:00 to 03:00.
+		{name: "shorter night", start: "00:00", end: "06:00", now: "2024-03-31T01:00:00+01:00", wantOpen: true, wantUntil: "2024-03-31T06:00:00+02:00"},
+		{name: "start skipped", start: "02:30", end: "06:00", now: "2024-03-31T01:45:00+01:00", wantUntil: "2024-03-31T03:00:00+02:00"},
+		{name: "inside after skipped start", start: "02:30", end: "06:00", now: "2024-03-31T03:10:00+02:00", wantOpen: true, wantUntil: "2024-03-31T06:00:00+02:00"},
+		{name: "end skipped", start: "22:00", end: "02:30", now: "2024-03-31T01:00:00+01:00", wantOpen: true, wantUntil: "2024-03-31T03:00:00+02:00"},
+		// On 2024-10-27 they go back from 03:00 to 02:00.
+		{name: "longer night", start: "00:00", end: "06:00", now: "2024-10-27T01:00:00+02:00", wantOpen: true, wantUntil: "2024-10-27T06:00:00+01:00"},
+		{name: "repeated end", start: "00:00", end: "02:30", now: "2024-10-27T02:15:00+01:00", wantUntil: "2024-10-28T00:00:00+01:00"},
+		{name: "repeated start", start: "02:30", end: "06:00", now: "2024-10-27T02:00:00+02:00", wantUntil: "2024-10-27T02:30:00+02:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			window, err := newUploadWindow(&config.UploadWindow{Start: tt.start, End: tt.end, Timezone: "Europe/Berlin"})
+			require.NoError(t, err)
+			open, until := window.state(at(tt.now))
+			assert.Equal(t, tt.wantOpen, open)
+			assert.Equal(t, at(tt.wantUntil).In(berlin).String(), until.In(berlin).String())
+		})
+	}
+
+	window, err := newUploadWindow(nil)
+	require.NoError(t, err)
+	assert.Nil(t, window, "no window")
+}
+
+func TestProcessPartsUploadWindow(t *testing.T) {
+	oldInterval := pausePollInterval
+	pausePollInterval = 10 * time.Millisecond
+	defer func() { pausePollInterval = oldInterval }()
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	indices := []string{"aa", "ab", "ac"}
+	for i, index := range indices {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "snapshot.part-"+index), []byte{byte(i)}, 0o644))
+	}
+	state := &manifest.State{TaskName: "t", BackupLevel: 1, Blake3Hash: "stream", PartsCompleted: make(map[string]string)}
+	statePath := filepath.Join(t.TempDir(), "backup_state.yaml")
+	backend := &countingBackend{}
+	task := &config.Task{Name: "t", Pool: "p", Dataset: "d"}
+
+	gate := newPauseGate(filepath.Join(t.TempDir(), pauseFileName), nil)
+	gate.window, err = newUploadWindow(&config.UploadWindow{Start: "00:00", End: "06:00", Timezone: "UTC"})
+	require.NoError(t, err)
+	var night atomic.Bool
+	gate.now = func() time.Time {
+		if night.Load() {
+			return time.Date(2024, 1, 11, 1, 0, 0, 0, time.UTC)
+		}
+		return time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := processPartsWithWorkerPool(context.Background(), indices, dir, state, statePath, nil, []age.Recipient{identity.Recipient()}, backend, task, "20240101", 1, gate, 4, 0)
+		done <- err
+	}()
+
+	require.Eventually(t, func() bool {
+		saved, err := manifest.ReadState(statePath)
+		return err == nil && len(saved.PartsEncrypted) == len(indices)
+	}, 5*time.Second, 10*time.Millisecond, "parts are encrypted outside the window and the state saved")
+	assert.Zero(t, backend.uploads.Load(), "no part is uploaded outside the window")
+
+	night.Store(true)
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("uploads did not start when the window opened")
+	}
+	assert.Equal(t, int64(len(indices)), backend.uploads.Load())
+}
+
+// fileBackend stores objects as files in a directory.
+type fileBackend struct {
+	remote.Backend
+	dir string
+
+	mu      sync.Mutex
+	uploads int
+	hashes  map[string]string
+	// downloads records the local paths of the downloads.
+	downloads []string
+	// credentialsErr fails VerifyCredentials.
+	credentialsErr error
+	// heads records the remote paths of the HEAD requests.
+	heads []string
+}
+
+func (b *fileBackend) Upload(_ context.Context, localPath, remotePath, checksumHash string, _ remote.ObjectTags) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.uploads++
+	if b.hashes == nil {
+		b.hashes = make(map[string]string)
+	}
+	b.hashes[remotePath] = checksumHash
+
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(b.dir, remotePath)
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, 0o644)
+}
+
+func (b *fileBackend) Download(_ context.Context, remotePath, localPath string) error {
+	b.mu.Lock()
+	b.downloads = append(b.downloads, localPath)
+	b.mu.Unlock()
+	data, err := os.ReadFile(filepath.Join(b.dir, remotePath))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(localPath, data, 0o644)
+}
+
+func (b *fileBackend) Head(_ context.Context, remotePath string) (*remote.ObjectInfo, error) {
+	info, err := os.Stat(filepath.Join(b.dir, remotePath))
+	if os.IsNotExist(err) {
+		return nil, &smithyhttp.ResponseError{Response: &smithyhttp.Response{Response: &http.Response{StatusCode: http.StatusNotFound}}, Err: err}
+	}
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.heads = append(b.heads, remotePath)
+	return &remote.ObjectInfo{Key: remotePath, Size: info.Size(), Blake3: b.hashes[remotePath], LastModified: info.ModTime()}, nil
+}
+
+func (b *fileBackend) VerifyCredentials(context.Context) error {
+	return b.credentialsErr
+}
+
+func TestPlanResume(t *testing.T) {
+	complete := func(parts int) map[string]string {
+		m := make(map[string]string)
+		for i := range parts {
+			m[fmt.Sprintf("a%05d", i)] = "hash"
+		}
+		return m
+	}
+	threeParts := int64(2*zfs.PartSize + 1)
+
+	tests := []struct {
+		name        string
+		local       *manifest.State
+		remote      *manifest.State
+		want        resumeSource
+		errContains string
+	}{
+		{
+			name: "nothing to resume",
+			want: resumeNone,
+		},
+		{
+			name:   "local state wins over remote",
+			local:  &manifest.State{TaskName: "t", BackupLevel: 0},
+			remote: &manifest.State{TaskName: "t", BackupLevel: 0, Blake3Hash: "h", StreamBytes: threeParts, PartsCompleted: complete(3)},
+			want:   resumeLocal,
+		},
+		{
+			name:   "local state of another level is ignored",
+			local:  &manifest.State{TaskName: "t", BackupLevel: 1},
+			remote: &manifest.State{TaskName: "t", BackupLevel: 0, Blake3Hash: "h", StreamBytes: threeParts, PartsCompleted: complete(3)},
+			want:   resumeRemote,
+		},
+		{
+			name:   "all parts uploaded",
+			local:  &manifest.State{},
+			remote: &manifest.State{TaskName: "t", BackupLevel: 0, Blake3Hash: "h", StreamBytes: threeParts, PartsCompleted: complete(3)},
+			want:   resumeRemote,
+		},
+		{
+			name:   "single file uploaded",
+			remote: &manifest.State{TaskName: "t", BackupLevel: 0, Blake3Hash: "h", StreamBytes: threeParts, PartsCompleted: map[string]string{"single": "h"}},
+			want:   resumeRemote,
+		},
+		{
+			name:        "parts missing remotely",
+			remote:      &manifest.State{TaskName: "t", BackupLevel: 0, Blake3Hash: "h", StreamBytes: threeParts, PartsCompleted: complete(2)},
+			want:        resumeNone,
+			errContains: "only 2 of 3 parts were uploaded",
+		},
+		{
+			name:        "parts missing at the recorded part size",
+			remote:      &manifest.State{TaskName: "t", BackupLevel: 0, Blake3Hash: "h", StreamBytes: threeParts, PartSizeBytes: 1 << 30, PartsCompleted: complete(3)},
+			want:        resumeNone,
+			errContains: "only 3 of 7 parts were uploaded",
+		},
+		{
+			name:        "send not finished",
+			remote:      &manifest.State{TaskName: "t", BackupLevel: 0, PartsCompleted: map[string]string{}},
+			want:        resumeNone,
+			errContains: "had not finished zfs send",
+		},
+		{
+			name:   "remote state of another task",
+			remote: &manifest.State{TaskName: "other", BackupLevel: 0, Blake3Hash: "h", StreamBytes: threeParts, PartsCompleted: complete(3)},
+			want:   resumeNone,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := planResume(tt.local, tt.remote, "t", 0)
+			if tt.errContains != "" {
+				assert.ErrorContains(t, err, tt.errContains)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestLoadOrCreateState(t *testing.T) {
+	recent := time.Now().Add(-time.Hour).Unix()
+	tests := []struct {
+		name    string
+		content string
+		reason  freshReason
+		wantErr string
+	}{
+		{name: "no state", reason: freshNoState},
+		{name: "matching state", content: fmt.Sprintf("version: 1\ntask_name: t\nbackup_level: 1\nlast_updated: %d\n", recent)},
+		{name: "state without version", content: "task_name: t\nbackup_level: 1\n"},
+		{name: "other task", content: "task_name: other\nbackup_level: 1\n", reason: freshTaskMismatch},
+		{name: "other level", content: "task_name: t\nbackup_level: 0\n", reason: freshLevelMismatch},
+		{name: "expired", content: fmt.Sprintf("task_name: t\nbackup_level: 1\nlast_updated: %d\n", time.Now().Add(-31*24*time.Hour).Unix()),
+			reason: freshExpired},
+		{name: "unparsable", content: "task_name: [t\n", reason: freshParseError, wantErr: "(parse-error)"},
+		{name: "newer version", content: "version: 99\ntask_name: t\nbackup_level: 1\n", reason: freshVersionMismatch,
+			wantErr: "(version-mismatch): state version 99 is newer than version 1 of this zrb"},
+		{name: "invalid", content: "task_name: t\nbackup_level: 1\ninvalid: snapshot tank/data@a was destroyed or renamed\n",
+			reason: freshInvalid, wantErr: "(invalid): snapshot tank/data@a was destroyed or renamed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statePath := filepath.Join(t.TempDir(), "backup_state.yaml")
+			if tt.content != "" {
+				require.NoError(t, os.WriteFile(statePath, []byte(tt.content), 0o644))
+			}
+
+			state, reason, err := loadOrCreateState(statePath, "t", 1, false)
+			assert.Equal(t, tt.reason, reason)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				assert.ErrorContains(t, err, "pass --discard-state")
+
+				state, reason, err = loadOrCreateState(statePath, "t", 1, true)
+				assert.Equal(t, tt.reason, reason)
+			}
+			require.NoError(t, err)
+			if tt.reason != "" {
+				assert.Equal(t, &manifest.State{Version: manifest.StateVersion}, state, "a fresh state")
+			} else {
+				assert.Equal(t, "t", state.TaskName)
+				assert.Equal(t, int16(1), state.BackupLevel)
+			}
+		})
+	}
+}
+
+func TestAdoptRemoteState(t *testing.T) {
+	state := &manifest.State{
+		OutputDir:        "/old/base/task/tank/data/level0/20240115",
+		PartsCompleted:   map[string]string{"aaaaab": "h2", "aaaaaa": "h1"},
+		PartsEncrypted:   map[string]string{"aaaaac": "h3"},
+		ManifestCreated:  true,
+		ManifestUploaded: true,
+	}
+	adoptRemoteState(state, "/new/base", &config.Task{Pool: "tank", Dataset: "data"})
+
+	assert.Equal(t, "/new/base/task/tank/data/level0/20240115", state.OutputDir)
+	assert.False(t, state.ManifestCreated)
+	assert.False(t, state.ManifestUploaded)
+	assert.Nil(t, state.PartsEncrypted, "encrypted parts that were not uploaded stayed on the old host")
+	assert.Equal(t, []string{"aaaaaa", "aaaaab"}, completedIndices(state))
+}
+
+func TestRemoteStateRoundTrip(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(keyPath, []byte(identity.String()+"\n"), 0o600))
+
+	backend := &fileBackend{dir: t.TempDir()}
+	task := &config.Task{Name: "t", Pool: "tank", Dataset: "data", S3Prefix: "host-a"}
+	r := &remoteState{
+		backend:    backend,
+		recipients: []age.Recipient{identity.Recipient()},
+		remotePath: remoteStatePath(task, 0),
+		workDir:    t.TempDir(),
+	}
+	assert.Equal(t, "host-a/manifests/tank/data/state/t-level0.yaml.age", r.remotePath)
+
+	state := &manifest.State{TaskName: "t", Blake3Hash: "h", PartsCompleted: map[string]string{"aaaaaa": "h1"}}
+	r.push(context.Background(), state, true)
+
+	// Within the interval only forced pushes go out.
+	state.PartsCompleted["aaaaab"] = "h2"
+	r.push(context.Background(), state, false)
+	assert.Equal(t, 1, backend.uploads)
+
+	stored, err := os.ReadFile(filepath.Join(backend.dir, r.remotePath))
+	require.NoError(t, err)
+	assert.NotContains(t, string(stored), "aaaaaa", "remote state must be encrypted")
+
+	r.push(context.Background(), state, true)
+	assert.Equal(t, 2, backend.uploads)
+
+	got, err := r.fetch(context.Background(), keyPath)
+	require.NoError(t, err)
+	assert.Equal(t, state.PartsCompleted, got.PartsCompleted)
+
+	// The remote copy can only be read with the private key.
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(keyPath, []byte(other.String()+"\n"), 0o600))
+	_, err = r.fetch(context.Background(), keyPath)
+	assert.ErrorContains(t, err, "failed to decrypt remote backup state")
+}
+
+// fakeZFS puts zfs and zpool scripts first in PATH that answer the commands a backup runs.
+func fakeZFS(t *testing.T) {
+	t.Helper()
+	bin := t.TempDir()
+	scripts := map[string]string{
+		"zfs": `#!/bin/sh
+case "$1" in
+list)
+	case "$*" in
+	*snapshot*) printf 'tank/data@zrb_level0_2024-01-15_00-00\t1705276800\n' ;;
+	*) echo "tank/data" ;;
+	esac ;;
+get)
+	case "$*" in
+	*guid*) echo 1234567890 ;;
+	*) printf 'type\tfilesystem\nmounted\tyes\ncanmount\ton\nmountpoint\t/tank/data\nused\t1048576\n' ;;
+	esac ;;
+send) printf 'zfs send stream' ;;
+version) echo '{"zfs_version":{"userland":"zfs-2.2.0-1","kernel":"zfs-kmod-2.2.0-1"}}' ;;
+allow) printf -- '---- Permissions on tank/data ----\nLocal+Descendent permissions:\n\teveryone send,snapshot,hold\n' ;;
+esac
+`,
+		"zpool": "#!/bin/sh\necho 'all pools are healthy'\n",
+	}
+	for name, script := range scripts {
+		require.NoError(t, os.WriteFile(filepath.Join(bin, name), []byte(script), 0o755))
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestRunEmitsEvents(t *testing.T) {
+	fakeZFS(t)
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	backend := &fileBackend{dir: t.TempDir()}
+	oldCache := remote.DefaultCache
+	remote.DefaultCache = remote.NewCache(func(context.Context, remote.Options) (remote.Backend, error) {
+		return backend, nil
+	})
+	defer func() { remote.DefaultCache = oldCache }()
+	defer slog.SetDefault(slog.Default())
+
+	dir := t.TempDir()
+	eventsPath := filepath.Join(dir, "audit", "events.jsonl")
+	configPath := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: %s
+s3:
+  enabled: true
+  bucket: b
+  region: us-east-1
+  prefix: p
+  storage_class:
+    manifest: STANDARD
+    backup_data: [STANDARD, STANDARD]
+events:
+  file: %s
+tasks:
+  - name: t
+    pool: tank
+    dataset: data
+    enabled: true
+`, filepath.Join(dir, "base"), identity.Recipient(), eventsPath)), 0o644))
+
+	require.NoError(t, Run(context.Background(), Options{ConfigPath: configPath, TaskName: "t", Level: 0}))
+
+	data, err := os.ReadFile(eventsPath)
+	require.NoError(t, err)
+
+	var stages []events.Stage
+	var runIDs []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e events.Event
+		require.NoError(t, json.Unmarshal([]byte(line), &e))
+		assert.Equal(t, "t", e.Task)
+		assert.Equal(t, "tank", e.Pool)
+		assert.Equal(t, "data", e.Dataset)
+		assert.False(t, e.Time.IsZero())
+		stages = append(stages, e.Stage)
+		runIDs = append(runIDs, e.RunID)
+	}
+
+	assert.Equal(t, []events.Stage{
+		events.BackupStarted,
+		events.SendStarted,
+		events.SendCompleted,
+		events.PartEncrypted,
+		events.PartUploaded,
+		events.ManifestUploaded,
+		events.SnapshotHeld,
+		events.ManifestUploaded,
+		events.BackupCompleted,
+	}, stages)
+	for _, id := range runIDs {
+		assert.Equal(t, runIDs[0], id, "events of one run share its run ID")
+	}
+
+	// There is no level 1 snapshot, so this run fails after it started.
+	require.Error(t, Run(context.Background(), Options{ConfigPath: configPath, TaskName: "t", Level: 1}))
+
+	data, err = os.ReadFile(eventsPath)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var failed events.Event
+	require.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &failed))
+	assert.Equal(t, events.BackupFailed, failed.Stage)
+	assert.Equal(t, int16(1), failed.Level)
+	assert.Contains(t, failed.Error, "no snapshots found")
+	assert.Empty(t, failed.ErrorClass, "only errors of S3 or GCS are classified")
+	assert.NotEqual(t, runIDs[0], failed.RunID)
+
+	// An upload S3 rejects for good is reported as permanent.
+	remote.DefaultCache = remote.NewCache(func(context.Context, remote.Options) (remote.Backend, error) {
+		return &deniedBackend{Backend: backend}, nil
+	})
+	require.Error(t, Run(context.Background(), Options{ConfigPath: configPath, TaskName: "t", Level: 0}))
+	data, err = os.ReadFile(eventsPath)
+	require.NoError(t, err)
+	lines = strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &failed))
+	assert.Equal(t, events.BackupFailed, failed.Stage)
+	assert.Equal(t, string(remote.Permanent), failed.ErrorClass)
+}
+
+func TestRunRejectsLevelWithoutStorageClass(t *testing.T) {
+	fakeZFS(t)
+
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base")
+	configPath := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+s3:
+  enabled: true
+  bucket: b
+  region: us-east-1
+  prefix: p
+  storage_class:
+    manifest: STANDARD
+    backup_data: [STANDARD]
+tasks:
+  - name: t
+    pool: tank
+    dataset: data
+    enabled: true
+`, base)), 0o644))
+
+	err := Run(context.Background(), Options{ConfigPath: configPath, TaskName: "t", Level: 1})
+	require.EqualError(t, err, "s3.storage_class.backup_data defines storage classes for levels 0 to 0, not for backup level 1")
+	assert.NoDirExists(t, base, "nothing is written before the level is checked")
+
+	require.Error(t, Run(context.Background(), Options{ConfigPath: configPath, TaskName: "t", Level: -1}))
+}
+
+func TestRunLocalOnly(t *testing.T) {
+	fakeZFS(t)
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	oldCache := remote.DefaultCache
+	remote.DefaultCache = remote.NewCache(func(context.Context, remote.Options) (remote.Backend, error) {
+		t.Error("a task with upload: false must not initialize the backend")
+		return nil, fmt.Errorf("unexpected backend")
+	})
+	defer func() { remote.DefaultCache = oldCache }()
+	defer slog.SetDefault(slog.Default())
+
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base")
+	configPath := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: %s
+s3:
+  enabled: true
+  bucket: b
+  region: us-east-1
+  prefix: p
+  storage_class:
+    manifest: STANDARD
+    backup_data: [STANDARD]
+tasks:
+  - name: t
+    pool: tank
+    dataset: data
+    enabled: true
+    upload: false
+`, base, identity.Recipient())), 0o644))
+
+	require.NoError(t, Run(context.Background(), Options{ConfigPath: configPath, TaskName: "t", Level: 0}))
+
+	last, err := manifest.ReadLast(filepath.Join(base, "run", "tank", "data", "last_backup_manifest.yaml"))
+	require.NoError(t, err)
+	ref := last.BackupLevels[0]
+	assert.True(t, ref.LocalOnly)
+
+	m, err := manifest.Read(ref.Manifest)
+	require.NoError(t, err)
+	assert.True(t, m.LocalOnly)
+	assert.Empty(t, m.Validate())
+	assert.Equal(t, []string{"zfs", "send", "-L", m.TargetSnapshot}, m.SendArgs)
+	assert.Equal(t, int64(zfs.PartSize), m.PartSizeBytes)
+	assert.Equal(t, 1, m.RecipientCount)
+	assert.Equal(t, "1234567890", m.TargetSnapshotGUID)
+	for _, p := range m.Parts {
+		assert.FileExists(t, filepath.Join(filepath.Dir(ref.Manifest), manifest.PartFileName(p.Index)), "local parts are kept")
+	}
+
+	records, err := stats.Read(stats.Path(base, "tank", "data"))
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "no-state", records[0].FreshStart)
+}
+
+func TestRunDedupStore(t *testing.T) {
+	fakeZFS(t)
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	backend := &fileBackend{dir: t.TempDir()}
+	oldCache := remote.DefaultCache
+	remote.DefaultCache = remote.NewCache(func(context.Context, remote.Options) (remote.Backend, error) {
+		return backend, nil
+	})
+	defer func() { remote.DefaultCache = oldCache }()
+	defer slog.SetDefault(slog.Default())
+
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base")
+	configPath := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: %s
+s3:
+  enabled: true
+  bucket: b
+  region: us-east-1
+  prefix: p
+  storage_class:
+    manifest: STANDARD
+    backup_data: [STANDARD]
+tasks:
+  - name: t
+    pool: tank
+    dataset: data
+    enabled: true
+    dedup_store: true
+`, base, identity.Recipient())), 0o644))
+
+	require.NoError(t, Run(context.Background(), Options{ConfigPath: configPath, TaskName: "t", Level: 0}))
+
+	last, err := manifest.ReadLast(filepath.Join(base, "run", "tank", "data", "last_backup_manifest.yaml"))
+	require.NoError(t, err)
+	ref := last.BackupLevels[0]
+	m, err := manifest.Read(filepath.Join(backend.dir, remote.ManifestPath("", ref.S3Path, "task_manifest.yaml")))
+	require.NoError(t, err)
+	assert.Empty(t, m.Validate())
+	assert.True(t, m.Chunked())
+	assert.Empty(t, m.Parts)
+	store := chunkStore([]string{identity.Recipient().String()})
+	assert.Equal(t, store, m.ChunkStore)
+	require.Len(t, m.Chunks, 1, "the stream is smaller than one chunk")
+	assert.Equal(t, int64(len("zfs send stream")), m.Chunks[0].Size)
+
+	chunkPath := remote.ChunkPath("", store, m.Chunks[0].Blake3Hash)
+	assert.FileExists(t, filepath.Join(backend.dir, chunkPath))
+
+	indexPath := chunkIndexPath(filepath.Join(base, "run", "tank", "data"), store)
+	index, err := loadChunkIndex(indexPath)
+	require.NoError(t, err)
+	assert.True(t, index.has(m.Chunks[0].Blake3Hash))
+
+	// A chunk the index lists is not uploaded again, but must still be in S3.
+	require.NoError(t, verifyChunks(context.Background(), backend, m.Chunks, map[string]bool{}, store, indexPath, &config.Task{}))
+	require.NoError(t, os.Remove(filepath.Join(backend.dir, chunkPath)))
+	err = verifyChunks(context.Background(), backend, m.Chunks, map[string]bool{}, store, indexPath, &config.Task{})
+	assert.ErrorContains(t, err, "is in the local chunk index but missing from S3")
+}
+
+func TestRunStagingDir(t *testing.T) {
+	fakeZFS(t)
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	defer slog.SetDefault(slog.Default())
+
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base")
+	staging := filepath.Join(dir, "scratch")
+	configPath := filepath.Join(dir, "config.yaml")
+	writeConfig := func(stagingDir string) {
+		require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+staging_dir: %s
+age_public_key: %s
+s3:
+  enabled: false
+tasks:
+  - name: t
+    pool: tank
+    dataset: data
+    enabled: true
+`, base, stagingDir, identity.Recipient())), 0o644))
+	}
+	opts := Options{ConfigPath: configPath, TaskName: "t", Level: 0}
+
+	t.Run("missing staging_dir", func(t *testing.T) {
+		writeConfig(staging)
+		assert.ErrorContains(t, Run(context.Background(), opts), "staging_dir "+staging+" is not usable")
+		assert.NoDirExists(t, staging, "staging_dir is never created")
+	})
+
+	t.Run("parts staged below staging_dir", func(t *testing.T) {
+		require.NoError(t, os.Mkdir(staging, 0o755))
+		writeConfig(staging)
+		require.NoError(t, Run(context.Background(), opts))
+
+		last, err := manifest.ReadLast(filepath.Join(base, "run", "tank", "data", "last_backup_manifest.yaml"))
+		require.NoError(t, err)
+		ref := last.BackupLevels[0]
+		assert.Equal(t, filepath.Join(staging, "task", ref.S3Path, "task_manifest.yaml"), ref.Manifest)
+		m, err := manifest.Read(ref.Manifest)
+		require.NoError(t, err)
+		assert.Equal(t, staging, m.StagingDir)
+		assert.NoDirExists(t, filepath.Join(base, "task"))
+		assert.DirExists(t, filepath.Join(base, "logs"), "logs stay under base_dir")
+	})
+
+	t.Run("resume after staging_dir changed", func(t *testing.T) {
+		moved := filepath.Join(dir, "other")
+		require.NoError(t, os.Mkdir(moved, 0o755))
+		writeConfig(moved)
+		interrupted := filepath.Join(staging, "task", "tank", "data", "level0", "20240115")
+		statePath := filepath.Join(base, "run", "tank", "data", "backup_state.yaml")
+		require.NoError(t, manifest.WriteState(statePath, &manifest.State{TaskName: "t", BackupLevel: 0, OutputDir: interrupted}))
+
+		err := Run(context.Background(), opts)
+		assert.ErrorContains(t, err, "interrupted backup staged its parts in "+interrupted+
+			", but staging_dir now puts them in "+filepath.Join(moved, "task", "tank", "data", "level0", "20240115"))
+		assert.ErrorContains(t, err, "remove "+statePath+" to start over")
+		assert.FileExists(t, statePath, "the interrupted backup is left to resume")
+	})
+}
+
+func TestCheckStagingSpace(t *testing.T) {
+	bin := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "zfs"), []byte("#!/bin/sh\nprintf 'size\\t1000\\n'\n"), 0o755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	old := diskFree
+	defer func() { diskFree = old }()
+
+	diskFree = func(string) (uint64, error) { return 2000, nil }
+	assert.NoError(t, checkStagingSpace(context.Background(), "/scratch/task", "tank/data@s", ""))
+
+	diskFree = func(string) (uint64, error) { return 1050, nil }
+	assert.ErrorContains(t, checkStagingSpace(context.Background(), "/scratch/task", "tank/data@s", ""),
+		"/scratch/task has 1050 bytes free, but the estimated 1000 byte stream of tank/data@s needs about 1100")
+}
+
+// flakyBackend fails its first credential checks, as during a brief S3 outage, or with err.
+type flakyBackend struct {
+	*fileBackend
+	failures int32
+	checks   atomic.Int32
+	err      error
+}
+
+func (b *flakyBackend) VerifyCredentials(context.Context) error {
+	if b.checks.Add(1) <= b.failures {
+		if b.err != nil {
+			return b.err
+		}
+		return fmt.Errorf("HeadBucket: connection refused")
+	}
+	return nil
+}
+
+func TestRunPreflight(t *testing.T) {
+	fakeZFS(t)
+	defer slog.SetDefault(slog.Default())
+
+	oldBackoff := preflightBackoff
+	preflightBackoff = time.Millisecond
+	defer func() { preflightBackoff = oldBackoff }()
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		preflight string
+		failures  int32
+		checks    int32
+		wantErr   string
+		err       error
+	}{
+		{"strict fails at once", config.PreflightStrict, 1, 1, "credentials verification failed: HeadBucket: connection refused", nil},
+		{"deferred rides out the outage", config.PreflightDeferred, 2, 3, "", nil},
+		{"deferred gives up", config.PreflightDeferred, 100, 6, "credentials verification failed after 6 attempt(s)", nil},
+		{"deferred stops at a permanent error", config.PreflightDeferred, 100, 1, "credentials verification failed after 1 attempt(s)", accessDenied()},
+		{"skip", config.PreflightSkip, 100, 0, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &flakyBackend{fileBackend: &fileBackend{dir: t.TempDir()}, failures: tt.failures, err: tt.err}
+			oldCache := remote.DefaultCache
+			remote.DefaultCache = remote.NewCache(func(context.Context, remote.Options) (remote.Backend, error) {
+				return backend, nil
+			})
+			defer func() { remote.DefaultCache = oldCache }()
+
+			dir := t.TempDir()
+			base := filepath.Join(dir, "base")
+			configPath := filepath.Join(dir, "config.yaml")
+			require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: %s
+s3:
+  enabled: true
+  bucket: b
+  region: us-east-1
+  preflight: %s
+  storage_class:
+    manifest: STANDARD
+    backup_data: [STANDARD]
+tasks:
+  - name: t
+    pool: tank
+    dataset: data
+    enabled: true
+`, base, identity.Recipient(), tt.preflight)), 0o644))
+
+			err := Run(context.Background(), Options{ConfigPath: configPath, TaskName: "t", Level: 0})
+			assert.Equal(t, tt.checks, backend.checks.Load())
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+				assert.Positive(t, backend.uploads)
+				return
+			}
+			assert.ErrorContains(t, err, tt.wantErr)
+			assert.Zero(t, backend.uploads)
+
+			if tt.preflight == config.PreflightDeferred {
+				parts, err := filepath.Glob(filepath.Join(base, "task", "tank", "data", "*", "*", "*.age"))
+				require.NoError(t, err)
+				assert.NotEmpty(t, parts, "parts are encrypted before the check, for the next run to upload")
+			}
+		})
+	}
+}
+
+func TestWriteChecksums(t *testing.T) {
+	dir := t.TempDir()
+	var infos []manifest.PartInfo
+	for i, index := range []string{"aaaaab", "aaaaaa"} {
+		path := filepath.Join(dir, manifest.PartFileName(index))
+		require.NoError(t, os.WriteFile(path, []byte{byte(i)}, 0o644))
+		hash, err := crypto.BLAKE3File(path)
+		require.NoError(t, err)
+		infos = append(infos, manifest.PartInfo{Index: index, Blake3Hash: hash})
+	}
+	manifestPath := filepath.Join(dir, "task_manifest.yaml")
+	require.NoError(t, manifest.Write(manifestPath, &manifest.Backup{Parts: infos, ChecksumsBlake3: manifest.PartChecksumsDigest(infos)}))
+
+	paths, err := writeChecksums(dir, infos, manifestPath, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, manifest.ChecksumsBlake3File), filepath.Join(dir, manifest.ChecksumsSHA256File)}, paths)
+
+	data, err := os.ReadFile(paths[0])
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 3)
+	assert.Equal(t, infos[1].Blake3Hash+"  snapshot.part-aaaaaa.age", lines[0])
+	assert.Equal(t, infos[0].Blake3Hash+"  snapshot.part-aaaaab.age", lines[1])
+	assert.True(t, strings.HasSuffix(lines[2], "  task_manifest.yaml"))
+
+	if _, err := exec.LookPath("sha256sum"); err == nil {
+		cmd := exec.Command("sha256sum", "--check", "--strict", manifest.ChecksumsSHA256File)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(out))
+	}
+
+	// The checksum files are not mistaken for parts on resume.
+	_, unexpected, err := findPartIndices(dir)
+	require.NoError(t, err)
+	assert.Empty(t, unexpected)
+}
+
+func TestCheckClock(t *testing.T) {
+	now := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	last := &manifest.Last{BackupLevels: []*manifest.Ref{
+		{Snapshot: "tank/data@zrb_level0_a", Datetime: now.Add(-48 * time.Hour).Unix()},
+		{Snapshot: "tank/data@zrb_level1_b", Datetime: now.Add(time.Hour).Unix()},
+	}}
+
+	t.Run("no history", func(t *testing.T) {
+		assert.NoError(t, checkClock(now, time.Time{}, nil, false))
+	})
+
+	t.Run("clock ahead", func(t *testing.T) {
+		assert.NoError(t, checkClock(now, now.Add(-time.Hour), nil, false))
+	})
+
+	t.Run("within tolerance", func(t *testing.T) {
+		assert.NoError(t, checkClock(now, now.Add(5*time.Minute), nil, false))
+	})
+
+	t.Run("behind newest snapshot", func(t *testing.T) {
+		err := checkClock(now, now.Add(24*time.Hour), nil, false)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "24h0m0s behind the newest snapshot")
+		assert.Contains(t, err.Error(), "--ignore-clock-skew")
+	})
+
+	t.Run("behind last backup", func(t *testing.T) {
+		err := checkClock(now, now.Add(-time.Hour), last, false)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "1h0m0s behind the last backup of tank/data@zrb_level1_b")
+	})
+
+	t.Run("ignored", func(t *testing.T) {
+		assert.NoError(t, checkClock(now, now.Add(24*time.Hour), last, true))
+	})
+}
+
+func TestCheckKeyChange(t *testing.T) {
+	const oldKey = "age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p"
+	const newKey = "age1lggyhqrw2nlhcxprm67z43rta597azn8gknawjehu9d9dl0jq3yqqvfafg"
+	const sshKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"
+
+	parent := &manifest.Backup{BackupLevel: 0, TargetSnapshot: "tank/data@zrb_level0_a", AgePublicKey: oldKey}
+
+	t.Run("same key", func(t *testing.T) {
+		history, err := checkKeyChange(&config.Config{AgePublicKey: oldKey}, parent, false)
+		require.NoError(t, err)
+		assert.Empty(t, history)
+	})
+
+	t.Run("order and ssh comments do not matter", func(t *testing.T) {
+		p := &manifest.Backup{AgePublicKey: oldKey, AgeRecipients: []string{sshKey + " admin@old"}}
+		cfg := &config.Config{AgeRecipients: []string{sshKey + " admin@new", oldKey}}
+		_, err := checkKeyChange(cfg, p, false)
+		assert.NoError(t, err)
+	})
+
+	t.Run("changed key is refused", func(t *testing.T) {
+		_, err := checkKeyChange(&config.Config{AgePublicKey: newKey}, parent, false)
+		assert.ErrorContains(t, err, "changed since the level 0 backup")
+		assert.ErrorContains(t, err, "--accept-key-change")
+		assert.ErrorContains(t, err, oldKey)
+	})
+
+	t.Run("added recipient is a change", func(t *testing.T) {
+		_, err := checkKeyChange(&config.Config{AgePublicKey: oldKey, AgeRecipients: []string{sshKey}}, parent, false)
+		assert.Error(t, err)
+	})
+
+	t.Run("accepted change records the parent key", func(t *testing.T) {
+		history, err := checkKeyChange(&config.Config{AgePublicKey: newKey}, parent, true)
+		require.NoError(t, err)
+		assert.Equal(t, []manifest.KeyRecord{{BackupLevel: 0, TargetSnapshot: "tank/data@zrb_level0_a", AgePublicKey: oldKey}}, history)
+	})
+
+	t.Run("history is carried along the chain", func(t *testing.T) {
+		level1 := &manifest.Backup{BackupLevel: 1, AgePublicKey: newKey, KeyHistory: []manifest.KeyRecord{{BackupLevel: 0, AgePublicKey: oldKey}}}
+		history, err := checkKeyChange(&config.Config{AgePublicKey: newKey}, level1, false)
+		require.NoError(t, err)
+		assert.Equal(t, level1.KeyHistory, history)
+	})
+
+	t.Run("parent without recorded key", func(t *testing.T) {
+		_, err := checkKeyChange(&config.Config{AgePublicKey: newKey}, &manifest.Backup{}, false)
+		assert.NoError(t, err)
+	})
+}
+
+func TestLoadParentManifest(t *testing.T) {
+	dir := t.TempDir()
+	local := filepath.Join(dir, "task_manifest.yaml")
+	require.NoError(t, manifest.Write(local, &manifest.Backup{BackupLevel: 0, AgePublicKey: "age1local"}))
+
+	backend := &fileBackend{dir: t.TempDir()}
+	oldCache := remote.DefaultCache
+	remote.DefaultCache = remote.NewCache(func(context.Context, remote.Options) (remote.Backend, error) {
+		return backend, nil
+	})
+	defer func() { remote.DefaultCache = oldCache }()
+
+	cfg := &config.Config{S3: config.S3Config{Enabled: true}}
+	task := &config.Task{Pool: "tank", Dataset: "data"}
+
+	m, err := loadParentManifest(context.Background(), cfg, task, &manifest.Ref{Manifest: local}, true)
+	require.NoError(t, err)
+	assert.Equal(t, "age1local", m.AgePublicKey)
+
+	// The local copy is gone after upload; the manifest comes from S3.
+	s3Path := "tank/data/level0/20240101"
+	require.NoError(t, manifest.Write(local, &manifest.Backup{BackupLevel: 0, AgePublicKey: "age1remote"}))
+	require.NoError(t, backend.Upload(context.Background(), local, remote.ManifestPath("", s3Path, "task_manifest.yaml"), "", remote.ObjectTags{}))
+	require.NoError(t, os.Remove(local))
+
+	m, err = loadParentManifest(context.Background(), cfg, task, &manifest.Ref{Manifest: local, S3Path: s3Path}, true)
+	require.NoError(t, err)
+	assert.Equal(t, "age1remote", m.AgePublicKey)
+
+	_, err = loadParentManifest(context.Background(), cfg, task, &manifest.Ref{Manifest: local, S3Path: s3Path}, false)
+	assert.ErrorContains(t, err, "does not upload")
+}
+
+func TestRunTraceSpans(t *testing.T) {
+	fakeZFS(t)
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	oldProvider := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(oldProvider)
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	backend := &fileBackend{dir: t.TempDir()}
+	oldCache := remote.DefaultCache
+	remote.DefaultCache = remote.NewCache(func(context.Context, remote.Options) (remote.Backend, error) {
+		return backend, nil
+	})
+	defer func() { remote.DefaultCache = oldCache }()
+	defer slog.SetDefault(slog.Default())
+
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: %s
+s3:
+  enabled: true
+  bucket: b
+  region: us-east-1
+  prefix: p
+  storage_class:
+    manifest: STANDARD
+    backup_data: [STANDARD]
+tasks:
+  - name: t
+    pool: tank
+    dataset: data
+    enabled: true
+`, filepath.Join(dir, "base"), identity.Recipient())), 0o644))
+
+	require.NoError(t, Run(context.Background(), Options{ConfigPath: configPath, TaskName: "t", Level: 0}))
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range recorder.Ended() {
+		spans[s.Name()] = s
+	}
+	parentOf := func(name string) string {
+		t.Helper()
+		span, ok := spans[name]
+		require.True(t, ok, "missing span %s", name)
+		for _, s := range spans {
+			if s.SpanContext().SpanID() == span.Parent().SpanID() {
+				return s.Name()
+			}
+		}
+		return ""
+	}
+
+	assert.Equal(t, "", parentOf("backup"))
+	assert.Equal(t, "backup", parentOf("zfs.send_and_split"))
+	assert.Equal(t, "backup", parentOf("backup.parts"))
+	assert.Equal(t, "backup.parts", parentOf("backup.part"))
+	assert.Equal(t, "backup.part", parentOf("backup.part.encrypt"))
+	assert.Equal(t, "backup", parentOf("backup.manifest_upload"))
+
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range spans["backup.part"].Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	assert.Equal(t, "aaaaaa", attrs["part.index"].AsString())
+	assert.Positive(t, attrs["part.size"].AsInt64())
+	assert.Equal(t, int64(0), attrs["part.retries"].AsInt64())
+	for _, s := range recorder.Ended() {
+		assert.Equal(t, codes.Unset, s.Status().Code, "span %s", s.Name())
+	}
+}
+
+// recordingSyncer records fsync calls and what the backup state said at the time.
+type recordingSyncer struct {
+	statePath string
+	mu        sync.Mutex
+	calls     []string
+	// recorded lists the parts already recorded as complete when their encrypted file was synced.
+	recorded []string
+}
+
+func (s *recordingSyncer) File(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, "file "+filepath.Base(path))
+	if strings.HasSuffix(path, ".age.tmp") {
+		if state, err := manifest.ReadState(s.statePath); err == nil {
+			index := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "snapshot.part-"), ".age.tmp")
+			if _, ok := state.PartsCompleted[index]; ok {
+				s.recorded = append(s.recorded, index)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *recordingSyncer) Dir(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, "dir "+filepath.Base(path))
+	return nil
+}
+
+func TestRunSyncsParts(t *testing.T) {
+	fakeZFS(t)
+	defer slog.SetDefault(slog.Default())
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base")
+	configPath := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: %s
+s3:
+  enabled: true
+  bucket: b
+  region: us-east-1
+  prefix: p
+  storage_class:
+    manifest: STANDARD
+    backup_data: [STANDARD]
+tasks:
+  - name: t
+    pool: tank
+    dataset: data
+    enabled: true
+    upload: false
+`, base, identity.Recipient())), 0o644))
+
+	syncer := &recordingSyncer{statePath: filepath.Join(base, "run", "tank", "data", "backup_state.yaml")}
+	ctx := fsync.NewContext(context.Background(), syncer)
+	require.NoError(t, Run(ctx, Options{ConfigPath: configPath, TaskName: "t", Level: 0}))
+
+	// The output directory is named after the date of the run.
+	require.Len(t, syncer.calls, 4)
+	outputDir := strings.TrimPrefix(syncer.calls[1], "dir ")
+	assert.Equal(t, []string{
+		"file snapshot.part-aaaaaa.tmp", "dir " + outputDir,
+		"file snapshot.part-aaaaaa.age.tmp", "dir " + outputDir,
+	}, syncer.calls)
+	assert.Empty(t, syncer.recorded, "parts are synced before the state records them")
+
+	// --no-fsync replaces the syncer from the context.
+	syncer.calls = nil
+	require.NoError(t, Run(ctx, Options{ConfigPath: configPath, TaskName: "t", Level: 0, NoFsync: true}))
+	assert.Empty(t, syncer.calls)
+}
+
+func TestRunInlineEncryption(t *testing.T) {
+	fakeZFS(t)
+	defer slog.SetDefault(slog.Default())
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	backend := &fileBackend{dir: t.TempDir()}
+	oldCache := remote.DefaultCache
+	remote.DefaultCache = remote.NewCache(func(context.Context, remote.Options) (remote.Backend, error) {
+		return backend, nil
+	})
+	defer func() { remote.DefaultCache = oldCache }()
+
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base")
+	configPath := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: %s
+s3:
+  enabled: true
+  bucket: b
+  region: us-east-1
+  prefix: p
+  storage_class:
+    manifest: STANDARD
+    backup_data: [STANDARD]
+tasks:
+  - name: t
+    pool: tank
+    dataset: data
+    enabled: true
+    inline_encryption: true
+    part_size: 64M
+`, base, identity.Recipient())), 0o644))
+
+	syncer := &recordingSyncer{statePath: filepath.Join(base, "run", "tank", "data", "backup_state.yaml")}
+	ctx := fsync.NewContext(context.Background(), syncer)
+	require.NoError(t, Run(ctx, Options{ConfigPath: configPath, TaskName: "t", Level: 0}))
+
+	// Only the encrypted part is ever written, and it is synced before the state records it.
+	require.Len(t, syncer.calls, 2)
+	assert.Equal(t, "file snapshot.part-aaaaaa.age.tmp", syncer.calls[0])
+	assert.Empty(t, syncer.recorded)
+
+	last, err := manifest.ReadLast(filepath.Join(base, "run", "tank", "data", "last_backup_manifest.yaml"))
+	require.NoError(t, err)
+	ref := last.BackupLevels[0]
+	m, err := manifest.Read(filepath.Join(backend.dir, remote.ManifestPath("", ref.S3Path, "task_manifest.yaml")))
+	require.NoError(t, err)
+	assert.Empty(t, m.Validate())
+	assert.Equal(t, int64(64<<20), m.PartSizeBytes, "the configured part size is recorded")
+	require.Len(t, m.Parts, 1)
+	assert.NotZero(t, m.Parts[0].EncryptedAt)
+	assert.NotZero(t, m.Parts[0].UploadedAt)
+
+	part := filepath.Join(backend.dir, remote.DataPath("", ref.S3Path, manifest.PartFileName("aaaaaa")))
+	hash, err := crypto.BLAKE3File(part)
+	require.NoError(t, err)
+	assert.Equal(t, m.Parts[0].Blake3Hash, hash, "the hash taken while encrypting is the one of the uploaded part")
+	uploadedPart, err := os.Stat(part)
+	require.NoError(t, err)
+	assert.Equal(t, uploadedPart.Size(), m.Parts[0].SizeBytes)
+	plain := filepath.Join(dir, "plain")
+	require.NoError(t, crypto.Decrypt(part, plain, identity))
+	data, err := os.ReadFile(plain)
+	require.NoError(t, err)
+	assert.Equal(t, "zfs send stream", string(data))
+	streamHash, err := crypto.BLAKE3File(plain)
+	require.NoError(t, err)
+	assert.Equal(t, streamHash, m.Blake3Hash, "the manifest hashes the raw stream")
+}
+
+func TestProcessPartInlineEncryptionMissingPart(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	dir := t.TempDir()
+	task := &config.Task{Name: "t", Pool: "p", Dataset: "d", InlineEncryption: true}
+	tracker := newPartTracker(&manifest.State{PartsCompleted: map[string]string{}, PartsEncrypted: map[string]string{"aaaaaa": "h"}},
+		filepath.Join(dir, "state.yaml"), dir, task, 1)
+
+	_, err = processPart(context.Background(), "aaaaaa", dir, []age.Recipient{identity.Recipient()}, nil, task, "20240101", remote.ObjectTags{}, nil, tracker, 0)
+	assert.ErrorContains(t, err, "inline_encryption keeps no unencrypted part")
+
+	// A damaged part cannot be encrypted again either.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "snapshot.part-aaaaaa.age"), []byte("damaged"), 0o644))
+	_, err = processPart(context.Background(), "aaaaaa", dir, []age.Recipient{identity.Recipient()}, nil, task, "20240101", remote.ObjectTags{}, nil, tracker, 0)
+	assert.ErrorContains(t, err, "inline_encryption keeps no unencrypted part")
+}
+
+func TestRunHooks(t *testing.T) {
+	fakeZFS(t)
+	defer slog.SetDefault(slog.Default())
+
+	// Record the zfs commands the backup runs.
+	fake, err := exec.LookPath("zfs")
+	require.NoError(t, err)
+	bin := t.TempDir()
+	zfsLog := filepath.Join(bin, "zfs.log")
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "zfs"), []byte(fmt.Sprintf("#!/bin/sh\necho \"$*\" >> %s\nexec %s \"$@\"\n", zfsLog, fake)), 0o755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	hookLog := filepath.Join(dir, "hooks.log")
+	hook := filepath.Join(dir, "hook.sh")
+	require.NoError(t, os.WriteFile(hook, []byte(fmt.Sprintf("#!/bin/sh\necho \"$1 $ZRB_TASK $ZRB_LEVEL $ZRB_SNAPSHOT $ZRB_RESULT\" >> %s\n[ \"$FAIL\" != \"$1\" ]\n", hookLog)), 0o755))
+
+	base := filepath.Join(dir, "base")
+	configPath := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: %s
+s3:
+  enabled: true
+  bucket: b
+  region: us-east-1
+  prefix: p
+  storage_class:
+    manifest: STANDARD
+    backup_data: [STANDARD]
+tasks:
+  - name: t
+    pool: tank
+    dataset: data
+    enabled: true
+    upload: false
+    hooks:
+      pre_snapshot: %[3]s pre_snapshot
+      post_snapshot: %[3]s post_snapshot
+      post_backup: %[3]s post_backup
+      timeout: 10s
+`, base, identity.Recipient(), hook)), 0o644))
+
+	readLines := func(path string) []string {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.NoError(t, os.Remove(path))
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+	snapshotTaken := func() bool {
+		for _, line := range readLines(zfsLog) {
+			if strings.HasPrefix(line, "snapshot ") {
+				return true
+			}
+		}
+		return false
+	}
+
+	t.Run("success", func(t *testing.T) {
+		require.NoError(t, Run(context.Background(), Options{ConfigPath: configPath, TaskName: "t", Level: 0, Snapshot: true}))
+
+		lines := readLines(hookLog)
+		require.Len(t, lines, 3)
+		assert.Regexp(t, `^pre_snapshot t 0 tank/data@zrb_level0_\d{4}-\d\d-\d\d_\d\d-\d\d $`, lines[0])
+		assert.Equal(t, strings.TrimSpace(strings.Replace(lines[0], "pre_snapshot", "post_snapshot", 1))+" success", lines[1])
+		// The snapshot just taken is backed up, rather than the newest one the fake zfs lists.
+		assert.Equal(t, strings.Replace(strings.TrimSpace(lines[0]), "pre_snapshot", "post_backup", 1)+" success", lines[2])
+		assert.True(t, snapshotTaken())
+	})
+
+	t.Run("failing pre_snapshot aborts before the snapshot", func(t *testing.T) {
+		t.Setenv("FAIL", "pre_snapshot")
+		err := Run(context.Background(), Options{ConfigPath: configPath, TaskName: "t", Level: 0, Snapshot: true})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "pre_snapshot hook failed")
+
+		lines := readLines(hookLog)
+		require.Len(t, lines, 3)
+		assert.True(t, strings.HasPrefix(lines[0], "pre_snapshot "))
+		assert.True(t, strings.HasPrefix(lines[1], "post_snapshot ") && strings.HasSuffix(lines[1], " failure"))
+		assert.Equal(t, "post_backup t 0  failure", lines[2])
+		assert.False(t, snapshotTaken())
+	})
+
+	t.Run("without --snapshot only post_backup runs", func(t *testing.T) {
+		t.Setenv("FAIL", "post_backup")
+		require.NoError(t, Run(context.Background(), Options{ConfigPath: configPath, TaskName: "t", Level: 0}))
+
+		assert.Equal(t, []string{"post_backup t 0 tank/data@zrb_level0_2024-01-15_00-00 success"}, readLines(hookLog))
+		assert.False(t, snapshotTaken())
+	})
+}
+
+func TestRunAutoSnapshot(t *testing.T) {
+	fakeZFS(t)
+	defer slog.SetDefault(slog.Default())
+
+	// Record the zfs commands the backup runs, and fail the send without output when asked to.
+	fake, err := exec.LookPath("zfs")
+	require.NoError(t, err)
+	bin := t.TempDir()
+	zfsLog := filepath.Join(bin, "zfs.log")
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "zfs"), []byte(fmt.Sprintf(
+		"#!/bin/sh\necho \"$*\" >> %s\n[ \"$1\" = send ] && [ -n \"$FAIL_SEND\" ] && exit 1\nexec %s \"$@\"\n", zfsLog, fake)), 0o755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	backend := &failingUploadBackend{fileBackend: &fileBackend{dir: t.TempDir()}}
+	oldCache := remote.DefaultCache
+	remote.DefaultCache = remote.NewCache(func(context.Context, remote.Options) (remote.Backend, error) {
+		return backend, nil
+	})
+	defer func() { remote.DefaultCache = oldCache }()
+
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base")
+	configPath := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: %s
+verify_after_upload: false
+s3:
+  enabled: true
+  bucket: b
+  region: us-east-1
+  prefix: p
+  storage_class:
+    manifest: STANDARD
+    backup_data: [STANDARD]
+tasks:
+  - name: t
+    pool: tank
+    dataset: data
+    enabled: true
+    auto_snapshot: true
+`, base, identity.Recipient())), 0o644))
+
+	// commands returns the zfs commands run since the last call that start with prefix.
+	commands := func(prefix string) []string {
+		data, err := os.ReadFile(zfsLog)
+		require.NoError(t, err)
+		require.NoError(t, os.Remove(zfsLog))
+		var matched []string
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			if strings.HasPrefix(line, prefix) {
+				matched = append(matched, line)
+			}
+		}
+		return matched
+	}
+	opts := Options{ConfigPath: configPath, TaskName: "t", Level: 0}
+
+	t.Run("send fails before streaming", func(t *testing.T) {
+		t.Setenv("FAIL_SEND", "1")
+		require.Error(t, Run(context.Background(), opts))
+
+		lines := commands("")
+		var taken string
+		for _, line := range lines {
+			if name, ok := strings.CutPrefix(line, "snapshot "); ok {
+				taken = name
+			}
+		}
+		require.Regexp(t, `^tank/data@zrb_level0_\d{4}-\d\d-\d\d_\d\d-\d\d$`, taken)
+		assert.Contains(t, lines, "destroy "+taken, "the snapshot nothing was sent from is destroyed")
+	})
+
+	t.Run("resume keeps the snapshot of the interrupted run", func(t *testing.T) {
+		backend.fail = true
+		require.ErrorContains(t, Run(context.Background(), opts), "connection reset")
+		taken := commands("snapshot ")
+		require.Len(t, taken, 1)
+		snapshot := strings.TrimPrefix(taken[0], "snapshot ")
+		state, err := manifest.ReadState(filepath.Join(base, "run", "tank", "data", "backup_state.yaml"))
+		require.NoError(t, err)
+		assert.Equal(t, snapshot, state.TargetSnapshot, "the snapshot just taken is the target")
+
+		backend.fail = false
+		require.NoError(t, Run(context.Background(), opts))
+		assert.Empty(t, commands("snapshot "), "a resumed backup takes no snapshot")
+		last, err := manifest.ReadLast(filepath.Join(base, "run", "tank", "data", "last_backup_manifest.yaml"))
+		require.NoError(t, err)
+		assert.Equal(t, snapshot, last.BackupLevels[0].Snapshot)
+	})
+}
+
+func TestRunTasks(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+s3:
+  enabled: true
+  bucket: b
+  region: us-east-1
+  prefix: p
+  storage_class:
+    manifest: STANDARD
+    backup_data: [STANDARD]
+tasks:
+  - name: prod-db
+    pool: tank
+    dataset: db
+    enabled: true
+  - name: prod-old
+    pool: tank
+    dataset: old
+    enabled: false
+  - name: prod-web
+    pool: tank
+    dataset: web
+    enabled: true
+`, filepath.Join(dir, "base"))), 0o644))
+
+	// Level 1 has no storage class, so every selected task fails before touching zfs
+	err := RunTasks(context.Background(), Options{ConfigPath: configPath, Level: 1}, []string{"prod-*"})
+	require.ErrorContains(t, err, "2 of 2 task backup(s) failed")
+	assert.ErrorContains(t, err, "task prod-db: s3.storage_class.backup_data")
+	assert.ErrorContains(t, err, "task prod-web: s3.storage_class.backup_data")
+	assert.NotContains(t, err.Error(), "prod-old", "disabled tasks are skipped when several are selected")
+
+	err = RunTasks(context.Background(), Options{ConfigPath: configPath, Level: 1}, []string{"prod-old"})
+	assert.EqualError(t, err, "backup task is disabled: prod-old", "a single task behaves like Run")
+
+	err = RunTasks(context.Background(), Options{ConfigPath: configPath, Level: 1}, []string{"dev-*"})
+	assert.EqualError(t, err, `no task matches "dev-*"`)
+}
+
+// vanishingZFS wraps the zfs of fakeZFS in one that logs each command to the returned file and
+// answers the commands for a missing dataset, as zfs does, once gone matches them.
+func vanishingZFS(t *testing.T, gone string) string {
+	t.Helper()
+	fakeZFS(t)
+	realZFS, err := exec.LookPath("zfs")
+	require.NoError(t, err)
+	bin := t.TempDir()
+	logPath := filepath.Join(bin, "zfs.log")
+	script := fmt.Sprintf(`#!/bin/sh
+echo "$*" >> %[1]s
+%[2]s
+exec %[3]s "$@"
+`, logPath, gone, realZFS)
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "zfs"), []byte(script), 0o755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return logPath
+}
+
+func localConfig(t *testing.T, dir string) string {
+	t.Helper()
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	configPath := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: %s
+tasks:
+  - name: t
+    pool: tank
+    dataset: data
+    enabled: true
+`, filepath.Join(dir, "base"), identity.Recipient())), 0o644))
+	return configPath
+}
+
+func TestRunDatasetVanishesDuringSend(t *testing.T) {
+	// The send destroys the dataset, which every later command on it then fails to find
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "gone")
+	logPath := vanishingZFS(t, fmt.Sprintf(`case "$*" in
+"send -L tank/data@"*) touch %[1]s ;;
+esac
+if [ -e %[1]s ]; then
+	case "$*" in
+	*tank/data*) echo "cannot open 'tank/data': dataset does not exist" >&2; exit 1 ;;
+	esac
+fi`, marker))
+	defer slog.SetDefault(slog.Default())
+	configPath := localConfig(t, dir)
+
+	err := Run(context.Background(), Options{ConfigPath: configPath, TaskName: "t", Level: 0})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, zfs.ErrNotFound)
+	assert.ErrorContains(t, err, "dataset tank/data was destroyed or renamed during the backup: failed to run zfs send and split")
+
+	data, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	var sequence []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		// The dry-run send of the size estimate comes first
+		if cmd, _, _ := strings.Cut(line, " "); cmd == "hold" || cmd == "release" || strings.HasPrefix(line, "send -L tank/data@") {
+			sequence = append(sequence, cmd)
+		}
+	}
+	assert.Equal(t, []string{"hold", "send", "release"}, sequence, "the hold is released after the failed send")
+	assert.Regexp(t, `(?m)^list -H -o name tank$`, string(data), "the pool is checked before blaming the dataset")
+
+	_, err = os.Stat(filepath.Join(dir, "base", "run", "tank", "data", "backup_state.yaml"))
+	assert.ErrorIs(t, err, os.ErrNotExist, "a send that never finished leaves no state to resume")
+}
+
+func TestRunRefusesVanishedSnapshot(t *testing.T) {
+	ghost := "tank/data@zrb_level0_2024-01-01_00-00"
+	vanishingZFS(t, fmt.Sprintf(`case "$*" in
+*%[1]s*) echo "cannot open '%[1]s': dataset does not exist" >&2; exit 1 ;;
+esac`, ghost))
+	defer slog.SetDefault(slog.Default())
+	dir := t.TempDir()
+	configPath := localConfig(t, dir)
+
+	statePath := filepath.Join(dir, "base", "run", "tank", "data", "backup_state.yaml")
+	require.NoError(t, os.MkdirAll(filepath.Dir(statePath), 0o755))
+	require.NoError(t, manifest.WriteState(statePath, &manifest.State{Version: manifest.StateVersion, TaskName: "t",
+		TargetSnapshot: ghost, Blake3Hash: "0123456789abcdef", LastUpdated: time.Now().Unix()}))
+
+	err := Run(context.Background(), Options{ConfigPath: configPath, TaskName: "t", Level: 0})
+	assert.EqualError(t, err, "cannot resume the interrupted backup: snapshot "+ghost+" was destroyed or renamed; pass --discard-state to start over")
+	state, err := manifest.ReadState(statePath)
+	require.NoError(t, err)
+	assert.Equal(t, "snapshot "+ghost+" was destroyed or renamed", state.Invalid)
+
+	// The next run reports the invalid state instead of trying again
+	err = Run(context.Background(), Options{ConfigPath: configPath, TaskName: "t", Level: 0})
+	assert.ErrorContains(t, err, "(invalid): snapshot "+ghost+" was destroyed or renamed")
+	assert.ErrorContains(t, err, "pass --discard-state")
+
+	require.NoError(t, Run(context.Background(), Options{ConfigPath: configPath, TaskName: "t", Level: 0, DiscardState: true}))
+	_, err = os.Stat(statePath)
+	assert.ErrorIs(t, err, os.ErrNotExist, "the fresh backup completed")
+}
+
+func TestRunLevel0HeadsPartsOnce(t *testing.T) {
+	fakeZFS(t)
+	defer slog.SetDefault(slog.Default())
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	for _, verify := range []bool{true, false} {
+		t.Run(fmt.Sprintf("verify_after_upload %v", verify), func(t *testing.T) {
+			backend := &fileBackend{dir: t.TempDir()}
+			oldCache := remote.DefaultCache
+			remote.DefaultCache = remote.NewCache(func(context.Context, remote.Options) (remote.Backend, error) {
+				return backend, nil
+			})
+			defer func() { remote.DefaultCache = oldCache }()
+
+			dir := t.TempDir()
+			configPath := filepath.Join(dir, "config.yaml")
+			require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: %s
+verify_after_upload: %v
+s3:
+  enabled: true
+  bucket: b
+  region: us-east-1
+  prefix: p
+  storage_class:
+    manifest: STANDARD
+    backup_data: [STANDARD]
+tasks:
+  - name: t
+    pool: tank
+    dataset: data
+    enabled: true
+`, filepath.Join(dir, "base"), identity.Recipient(), verify)), 0o644))
+
+			require.NoError(t, Run(context.Background(), Options{ConfigPath: configPath, TaskName: "t", Level: 0}))
+
+			var partHeads int
+			for _, path := range backend.heads {
+				if strings.Contains(path, "snapshot.part-") {
+					partHeads++
+				}
+			}
+			assert.Equal(t, 1, partHeads, "the one part is checked once, right after its upload or after all uploads")
+		})
+	}
+}
+
+func TestRunLevel0StartsNewGeneration(t *testing.T) {
+	fakeZFS(t)
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	defer slog.SetDefault(slog.Default())
+
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base")
+	configPath := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: %s
+tasks:
+  - name: t
+    pool: tank
+    dataset: data
+    enabled: true
+`, base, identity.Recipient())), 0o644))
+
+	lastPath := filepath.Join(base, "run", "tank", "data", "last_backup_manifest.yaml")
+	require.NoError(t, os.MkdirAll(filepath.Dir(lastPath), 0o755))
+	previous := &manifest.Last{Pool: "tank", Dataset: "data", IncrementalMode: manifest.ModeChain, BackupLevels: []*manifest.Ref{
+		{Snapshot: "tank/data@zrb_level0_2023-12-01_00-00", S3Path: "tank/data/level0/20231201", GenerationID: "20231201T000000Z"},
+		{Snapshot: "tank/data@zrb_level1_2023-12-02_00-00", S3Path: "tank/data/level1/20231202", GenerationID: "20231201T000000Z"},
+		{Snapshot: "tank/data@zrb_level2_2023-12-03_00-00", S3Path: "tank/data/level2/20231203", GenerationID: "20231201T000000Z"},
+	}}
+	require.NoError(t, manifest.WriteLast(lastPath, previous))
+
+	// A level 0 that fails leaves the previous generation alone
+	bin := t.TempDir()
+	realZFS, err := exec.LookPath("zfs")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "zfs"), []byte("#!/bin/sh\n[ \"$1\" = send ] && exit 1\nexec "+realZFS+" \"$@\"\n"), 0o755))
+	path := os.Getenv("PATH")
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+	require.Error(t, Run(context.Background(), Options{ConfigPath: configPath, TaskName: "t", Level: 0, DiscardState: true}))
+	last, err := manifest.ReadLast(lastPath)
+	require.NoError(t, err)
+	assert.Equal(t, previous.BackupLevels, last.BackupLevels)
+
+	t.Setenv("PATH", path)
+	require.NoError(t, Run(context.Background(), Options{ConfigPath: configPath, TaskName: "t", Level: 0, DiscardState: true}))
+	last, err = manifest.ReadLast(lastPath)
+	require.NoError(t, err)
+	require.Len(t, last.BackupLevels, 1, "the levels of the previous generation are dropped")
+	ref := last.BackupLevels[0]
+	assert.Equal(t, "tank/data@zrb_level0_2024-01-15_00-00", ref.Snapshot)
+	assert.Regexp(t, `^\d{8}T\d{6}Z$`, ref.GenerationID)
+	assert.NotEqual(t, "20231201T000000Z", ref.GenerationID)
+
+	m, err := manifest.Read(ref.Manifest)
+	require.NoError(t, err)
+	assert.Equal(t, ref.GenerationID, m.GenerationID)
+}
+
+func TestRunAnchor(t *testing.T) {
+	fakeZFS(t)
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	backend := &fileBackend{dir: t.TempDir()}
+	oldCache := remote.DefaultCache
+	remote.DefaultCache = remote.NewCache(func(context.Context, remote.Options) (remote.Backend, error) {
+		return backend, nil
+	})
+	defer func() { remote.DefaultCache = oldCache }()
+	defer slog.SetDefault(slog.Default())
+
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "key.txt")
+	require.NoError(t, os.WriteFile(keyPath, []byte(identity.String()+"\n"), 0o600))
+	configPath := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: %s
+s3:
+  enabled: true
+  bucket: b
+  region: us-east-1
+  prefix: p
+  storage_class:
+    manifest: STANDARD
+    backup_data: [STANDARD]
+tasks:
+  - name: t
+    pool: tank
+    dataset: data
+    enabled: true
+`, filepath.Join(dir, "base"), identity.Recipient())), 0o644))
+
+	require.NoError(t, Run(context.Background(), Options{ConfigPath: configPath, TaskName: "t", Level: 0, Anchor: true}))
+
+	anchors, err := filepath.Glob(filepath.Join(backend.dir, "anchors", "tank", "data", "level0", "*", manifest.AnchorFile))
+	require.NoError(t, err)
+	require.Len(t, anchors, 1, "the anchor is stored apart from the manifest")
+	plain := filepath.Join(t.TempDir(), "anchor.yaml")
+	require.NoError(t, crypto.Decrypt(anchors[0], plain, identity))
+	anchor, err := manifest.ReadAnchor(plain)
+	require.NoError(t, err)
+	assert.Equal(t, "tank/data@zrb_level0_2024-01-15_00-00", anchor.TargetSnapshot)
+	require.Len(t, anchor.Parts, 1)
+
+	manifests, err := filepath.Glob(filepath.Join(backend.dir, "manifests", "tank", "data", "level0", "*", "task_manifest.yaml"))
+	require.NoError(t, err)
+	require.Len(t, manifests, 1)
+	manifestBlake3, err := crypto.BLAKE3File(manifests[0])
+	require.NoError(t, err)
+	assert.Equal(t, manifestBlake3, anchor.ManifestBlake3)
+	m, err := manifest.Read(manifests[0])
+	require.NoError(t, err)
+	assert.Equal(t, m.Parts[0].Blake3Hash, anchor.Parts[0].Blake3Hash)
+	assert.Positive(t, anchor.Parts[0].Size)
+
+	var report strings.Builder
+	verifyOpts := verify.Options{ConfigPath: configPath, TaskName: "t", Level: -1, PrivateKeyPath: keyPath, Out: &report}
+	require.NoError(t, verify.Run(context.Background(), verifyOpts))
+	assert.Regexp(t, `level 0 tank/data@zrb_level0_2024-01-15_00-00: OK \(1 parts, uploaded \S+ to \S+, anchor checked\)`, report.String())
+
+	// A manifest replaced wholesale, consistent with itself, is caught by the anchor only.
+	require.NoError(t, os.WriteFile(manifests[0], append(mustReadFile(t, manifests[0]), "# replaced\n"...), 0o644))
+	report.Reset()
+	require.EqualError(t, verify.Run(context.Background(), verifyOpts), "1 problem(s) found in 1 level(s)")
+	assert.Contains(t, report.String(), "level 0 manifest: manifest_replaced: task_manifest.yaml has BLAKE3")
+
+	verifyOpts.PrivateKeyPath = ""
+	report.Reset()
+	require.NoError(t, verify.Run(context.Background(), verifyOpts))
+	assert.Contains(t, report.String(), "anchor not checked without --private-key")
+
+	// --deep downloads the parts, which the metadata alone cannot vouch for.
+	parts, err := filepath.Glob(filepath.Join(backend.dir, "data", "tank", "data", "level0", "*", "*.age"))
+	require.NoError(t, err)
+	require.Len(t, parts, 1)
+	// A damaged payload keeps a valid header and framing, so only the hash finds it.
+	data := mustReadFile(t, parts[0])
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(parts[0], data, 0o644))
+	verifyOpts.Deep = true
+	report.Reset()
+	require.EqualError(t, verify.Run(context.Background(), verifyOpts), "1 problem(s) found in 1 level(s)")
+	assert.Contains(t, report.String(), "level 0 part "+m.Parts[0].Index+": corrupt: the data has BLAKE3")
+
+	// The downloads go to the scratch directory restore uses, which is removed afterwards.
+	scratch := t.TempDir()
+	verifyOpts.WorkDir = scratch
+	backend.downloads = nil
+	require.Error(t, verify.Run(context.Background(), verifyOpts))
+	require.NotEmpty(t, backend.downloads)
+	for _, path := range backend.downloads {
+		assert.Equal(t, filepath.Join(scratch, "verify_t"), filepath.Dir(path))
+	}
+	assert.NoDirExists(t, filepath.Join(scratch, "verify_t"))
+
+	// Credentials are checked before anything is downloaded. A new cache forgets the last check.
+	remote.DefaultCache = remote.NewCache(func(context.Context, remote.Options) (remote.Backend, error) {
+		return backend, nil
+	})
+	backend.credentialsErr = errors.New("token expired")
+	backend.downloads = nil
+	assert.ErrorContains(t, verify.Run(context.Background(), verifyOpts), "token expired")
+	assert.Empty(t, backend.downloads)
+}
+
+func TestRunVerifyLocal(t *testing.T) {
+	fakeZFS(t)
+	defer slog.SetDefault(slog.Default())
+	dir := t.TempDir()
+	configPath := localConfig(t, dir)
+	require.NoError(t, Run(context.Background(), Options{ConfigPath: configPath, TaskName: "t", Level: 0}))
+
+	var report strings.Builder
+	verifyOpts := verify.Options{ConfigPath: configPath, TaskName: "t", Level: -1, Source: "local", Deep: true, Out: &report}
+	require.NoError(t, verify.Run(context.Background(), verifyOpts))
+	assert.Regexp(t, `level 0 tank/data@\S+: OK \(\d+ parts in \S+, hashed\)`, report.String())
+
+	last, err := manifest.ReadLast(filepath.Join(dir, "base", "run", "tank", "data", "last_backup_manifest.yaml"))
+	require.NoError(t, err)
+	m, err := manifest.Read(last.BackupLevels[0].Manifest)
+	require.NoError(t, err)
+	part := filepath.Join(filepath.Dir(last.BackupLevels[0].Manifest), manifest.PartFileName(m.Parts[0].Index))
+
+	// A flipped byte keeps the size; only hashing the part finds it.
+	data := mustReadFile(t, part)
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(part, data, 0o600))
+	verifyOpts.JSON = true
+	report.Reset()
+	require.EqualError(t, verify.Run(context.Background(), verifyOpts), "1 problem(s) found in 1 level(s)")
+	var r verify.Report
+	require.NoError(t, json.Unmarshal([]byte(report.String()), &r))
+	assert.Equal(t, "local", r.Source)
+	assert.False(t, r.Summary.Passed)
+	assert.Equal(t, 1, r.Summary.Mismatched)
+	require.Len(t, r.Levels, 1)
+	assert.Equal(t, verify.StatusProblems, r.Levels[0].Status)
+	assert.Equal(t, string(verify.Corrupt), r.Levels[0].Parts[0].Status)
+	assert.Equal(t, int64(len(data)), r.Levels[0].Parts[0].Size)
+
+	verifyOpts.Deep, verifyOpts.JSON = false, false
+	report.Reset()
+	require.NoError(t, verify.Run(context.Background(), verifyOpts), "without --deep only the presence of the parts is checked")
+
+	require.NoError(t, os.Remove(part))
+	report.Reset()
+	require.EqualError(t, verify.Run(context.Background(), verifyOpts), "1 problem(s) found in 1 level(s)")
+	assert.Contains(t, report.String(), "part "+m.Parts[0].Index+": missing: the file is not in")
+
+	verifyOpts.Source = "s3"
+	assert.EqualError(t, verify.Run(context.Background(), verifyOpts), "none of s3, gcs and sftp is enabled in config")
+}
+
+func mustReadFile(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return data
+}
+
+func TestRunStreamLimit(t *testing.T) {
+	fakeZFS(t)
+	defer slog.SetDefault(slog.Default())
+	old := minStreamLimit
+	minStreamLimit = 0
+	defer func() { minStreamLimit = old }()
+
+	// zfs send estimates 1000 bytes but streams without end, like a snapshot with a runaway file.
+	fake, err := exec.LookPath("zfs")
+	require.NoError(t, err)
+	bin := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "zfs"), []byte(fmt.Sprintf(`#!/bin/sh
+case "$*" in
+send*-nP*) printf 'full\ttank/data@zrb_level0_2024-01-15_00-00\t1000\nsize\t1000\n' ;;
+send*) exec yes zfs-send-stream ;;
+*) exec %s "$@" ;;
+esac
+`, fake)), 0o755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	var backend *fileBackend
+	oldCache := remote.DefaultCache
+	remote.DefaultCache = remote.NewCache(func(context.Context, remote.Options) (remote.Backend, error) {
+		return backend, nil
+	})
+	defer func() { remote.DefaultCache = oldCache }()
+
+	tests := []struct {
+		name      string
+		options   string
+		limit     string
+		wantLimit int64
+	}{
+		{name: "split parts", limit: "3x", wantLimit: 3000},
+		{name: "single file", options: "single_file: true", limit: "3x", wantLimit: 3000},
+		{name: "dedup store", options: "dedup_store: true", limit: "3x", wantLimit: 3000},
+		{name: "inline encryption", options: "inline_encryption: true", limit: "3x", wantLimit: 3000},
+		{name: "absolute", limit: "4K", wantLimit: 4096},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend = &fileBackend{dir: t.TempDir()}
+			dir := t.TempDir()
+			base := filepath.Join(dir, "base")
+			eventsPath := filepath.Join(dir, "events.jsonl")
+			hookEnv := filepath.Join(dir, "hook.env")
+			configPath := filepath.Join(dir, "config.yaml")
+			require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: %s
+s3:
+  enabled: true
+  bucket: b
+  region: us-east-1
+  prefix: p
+  storage_class:
+    manifest: STANDARD
+    backup_data: [STANDARD]
+events:
+  file: %s
+tasks:
+  - name: t
+    pool: tank
+    dataset: data
+    enabled: true
+    max_stream_size: %s
+    %s
+    hooks:
+      post_backup: 'echo "$ZRB_RESULT: $ZRB_ERROR" > %s'
+`, base, identity.Recipient(), eventsPath, tt.limit, tt.options, hookEnv)), 0o644))
+
+			done := make(chan error, 1)
+			go func() { done <- Run(context.Background(), Options{ConfigPath: configPath, TaskName: "t", Level: 0}) }()
+			var runErr error
+			select {
+			case runErr = <-done:
+			case <-time.After(30 * time.Second):
+				t.Fatal("the send was not stopped at the limit")
+			}
+
+			var limitErr *zfs.StreamLimitError
+			require.ErrorAs(t, runErr, &limitErr)
+			assert.Equal(t, tt.wantLimit, limitErr.Limit)
+			assert.Greater(t, limitErr.Produced, tt.wantLimit)
+			assert.Contains(t, runErr.Error(), "max_stream_size "+tt.limit)
+			assert.Contains(t, runErr.Error(), "the partial parts were removed")
+
+			// Nothing of the send is left to resume or upload.
+			taskDir := filepath.Join(base, "task", "tank", "data")
+			entries, _ := filepath.Glob(filepath.Join(taskDir, "*", "*"))
+			assert.Empty(t, entries, "partial parts are removed")
+			assert.NoFileExists(t, filepath.Join(base, "run", "tank", "data", "backup_state.yaml"))
+			uploaded, _ := os.ReadDir(backend.dir)
+			assert.Empty(t, uploaded)
+
+			data, err := os.ReadFile(eventsPath)
+			require.NoError(t, err)
+			var exceeded *events.Event
+			for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+				var e events.Event
+				require.NoError(t, json.Unmarshal([]byte(line), &e))
+				if e.Stage == events.StreamLimitExceeded {
+					exceeded = &e
+				}
+			}
+			require.NotNil(t, exceeded)
+			assert.Equal(t, tt.wantLimit, exceeded.Limit)
+			assert.Equal(t, limitErr.Produced, exceeded.Bytes)
+
+			env, err := os.ReadFile(hookEnv)
+			require.NoError(t, err)
+			assert.Contains(t, string(env), "failure: ")
+			assert.Contains(t, string(env), "zfs send produced more than the limit")
+		})
+	}
+}
+
+func TestRecordChanges(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	recipients := []age.Recipient{identity.Recipient()}
+	bin := t.TempDir()
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	writeZFS := func(script string) {
+		require.NoError(t, os.WriteFile(filepath.Join(bin, "zfs"), []byte("#!/bin/sh\n"+script), 0o755))
+	}
+
+	t.Run("recorded", func(t *testing.T) {
+		writeZFS("printf 'M\\t/tank/data\\n+\\t/tank/data/new\\n'\n")
+		outputDir := t.TempDir()
+		changes, err := recordChanges(context.Background(), outputDir, "tank/data@b", "tank/data@a", recipients, &config.Task{})
+		require.NoError(t, err)
+		encrypted := filepath.Join(outputDir, manifest.ChangesFile)
+		hash, err := crypto.BLAKE3File(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, &manifest.Changes{File: manifest.ChangesFile, Blake3Hash: hash, Lines: 2}, changes)
+		assert.NoFileExists(t, filepath.Join(outputDir, "changes.txt.gz"), "only the encrypted list is kept")
+
+		plain := filepath.Join(t.TempDir(), "changes.txt.gz")
+		require.NoError(t, crypto.Decrypt(encrypted, plain, identity))
+		f, err := os.Open(plain)
+		require.NoError(t, err)
+		defer f.Close()
+		gz, err := gzip.NewReader(f)
+		require.NoError(t, err)
+		data, err := io.ReadAll(gz)
+		require.NoError(t, err)
+		assert.Equal(t, "M\t/tank/data\n+\t/tank/data/new\n", string(data))
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		writeZFS("printf 'M\\t/tank/data\\n+\\t/tank/data/new\\n'\n")
+		changes, err := recordChanges(context.Background(), t.TempDir(), "tank/data@b", "tank/data@a", recipients, &config.Task{RecordChangesMaxSize: 20})
+		require.NoError(t, err)
+		assert.True(t, changes.Truncated)
+		assert.Equal(t, int64(1), changes.Lines)
+	})
+
+	t.Run("zfs diff fails", func(t *testing.T) {
+		writeZFS("echo 'permission denied' >&2\nexit 1\n")
+		outputDir := t.TempDir()
+		changes, err := recordChanges(context.Background(), outputDir, "tank/data@b", "tank/data@a", recipients, &config.Task{})
+		require.NoError(t, err, "the backup goes on without the list")
+		assert.Empty(t, changes.File)
+		assert.Contains(t, changes.Unavailable, "permission denied")
+		assert.NoFileExists(t, filepath.Join(outputDir, manifest.ChangesFile))
+	})
+}
+
+func TestRunFileModes(t *testing.T) {
+	fakeZFS(t)
+	defer slog.SetDefault(slog.Default())
+	// A umask of 002 lets file_mode and dir_mode show through
+	defer syscall.Umask(syscall.Umask(0o002))
+
+	for _, tt := range []struct {
+		name      string
+		modes     string
+		file, dir os.FileMode
+	}{
+		{name: "defaults", file: 0o640, dir: 0o750},
+		{name: "shared operators", modes: "file_mode: \"0660\"\ndir_mode: \"0770\"\n", file: 0o660, dir: 0o770},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			defer util.SetModes(0, 0)
+			dir := t.TempDir()
+			configPath := localConfig(t, dir)
+			data, err := os.ReadFile(configPath)
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile(configPath, append([]byte(tt.modes), data...), 0o644))
+
+			require.NoError(t, Run(context.Background(), Options{ConfigPath: configPath, TaskName: "t", Level: 0}))
+
+			modes := make(map[string]os.FileMode)
+			base := filepath.Join(dir, "base")
+			require.NoError(t, filepath.WalkDir(base, func(path string, d os.DirEntry, err error) error {
+				if err != nil || path == base {
+					return err
+				}
+				info, err := d.Info()
+				if err != nil {
+					return err
+				}
+				rel, err := filepath.Rel(base, path)
+				modes[rel] = info.Mode().Perm()
+				return err
+			}))
+			var parts int
+			for rel, mode := range modes {
+				switch info, _ := os.Stat(filepath.Join(base, rel)); {
+				case info.IsDir():
+					assert.Equal(t, tt.dir, mode, rel)
+				case strings.HasSuffix(rel, ".age"):
+					parts++
+					assert.Equal(t, util.PartMode, mode, rel)
+				default:
+					assert.Equal(t, tt.file, mode, rel)
+				}
+			}
+			assert.Equal(t, 1, parts, "the local-only backup keeps its part")
+			assert.Contains(t, modes, filepath.Join("run", "tank", "data", "last_backup_manifest.yaml"))
+		})
+	}
+}
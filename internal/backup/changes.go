@@ -0,0 +1,61 @@
+package backup
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"zrb/internal/config"
+	"zrb/internal/crypto"
+	"zrb/internal/manifest"
+	"zrb/internal/util"
+	"zrb/internal/zfs"
+
+	"filippo.io/age"
+)
+
+// recordChanges stores the zfs diff from parentSnapshot to targetSnapshot in outputDir as
+// manifest.ChangesFile, compressed and encrypted to recipients. The list is a convenience for zrb
+// diff, so a failing zfs diff, such as one lacking the diff permission, only marks it unavailable.
+func recordChanges(ctx context.Context, outputDir, targetSnapshot, parentSnapshot string, recipients []age.Recipient, task *config.Task) (*manifest.Changes, error) {
+	plain := filepath.Join(outputDir, "changes.txt.gz")
+	encrypted := filepath.Join(outputDir, manifest.ChangesFile)
+	defer os.Remove(plain)
+
+	f, err := util.CreatePart(plain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create change list: %w", err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	lines, truncated, err := zfs.Diff(ctx, parentSnapshot, targetSnapshot, gz, task.ChangesMaxSize())
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		slog.Warn("zfs diff failed, the backup has no change list", "snapshot", targetSnapshot, "parentSnapshot", parentSnapshot, "error", err)
+		return &manifest.Changes{Unavailable: err.Error()}, nil
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress change list: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write change list: %w", err)
+	}
+	if truncated {
+		slog.Warn("Change list truncated at record_changes_max_size", "lines", lines, "maxBytes", task.ChangesMaxSize())
+	}
+
+	if err := crypto.Encrypt(plain, encrypted, recipients...); err != nil {
+		os.Remove(encrypted)
+		return nil, fmt.Errorf("failed to encrypt change list: %w", err)
+	}
+	hash, err := crypto.BLAKE3File(encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate change list BLAKE3: %w", err)
+	}
+	slog.Info("Change list recorded", "lines", lines, "truncated", truncated)
+	return &manifest.Changes{File: manifest.ChangesFile, Blake3Hash: hash, Lines: lines, Truncated: truncated}, nil
+}
@@ -0,0 +1,52 @@
+package backup
+
+import (
+	"fmt"
+	"path/filepath"
+	"zrb/internal/crypto"
+	"zrb/internal/manifest"
+	"zrb/internal/util"
+)
+
+// writeChecksums writes CHECKSUMS.blake3, and CHECKSUMS.sha256 when withSHA256 is set, listing every
+// encrypted part and the task manifest. It returns the paths of the written files.
+func writeChecksums(outputDir string, partInfos []manifest.PartInfo, manifestPath string, withSHA256 bool) ([]string, error) {
+	manifestBlake3, err := crypto.BLAKE3File(manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash manifest: %w", err)
+	}
+	entries := append(manifest.PartChecksums(partInfos), manifest.Checksum{Hash: manifestBlake3, Name: filepath.Base(manifestPath)})
+
+	blake3Path := filepath.Join(outputDir, manifest.ChecksumsBlake3File)
+	if err := util.WriteFile(blake3Path, manifest.FormatChecksums(entries)); err != nil {
+		return nil, fmt.Errorf("failed to write %s: %w", manifest.ChecksumsBlake3File, err)
+	}
+	paths := []string{blake3Path}
+
+	if withSHA256 {
+		var sha256Entries []manifest.Checksum
+		for _, name := range append(partFileNames(partInfos), filepath.Base(manifestPath)) {
+			hash, err := crypto.SHA256File(filepath.Join(outputDir, name))
+			if err != nil {
+				return nil, fmt.Errorf("failed to hash %s for %s: %w", name, manifest.ChecksumsSHA256File, err)
+			}
+			sha256Entries = append(sha256Entries, manifest.Checksum{Hash: hash, Name: name})
+		}
+
+		sha256Path := filepath.Join(outputDir, manifest.ChecksumsSHA256File)
+		if err := util.WriteFile(sha256Path, manifest.FormatChecksums(sha256Entries)); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", manifest.ChecksumsSHA256File, err)
+		}
+		paths = append(paths, sha256Path)
+	}
+
+	return paths, nil
+}
+
+func partFileNames(partInfos []manifest.PartInfo) []string {
+	names := make([]string, 0, len(partInfos))
+	for _, pi := range partInfos {
+		names = append(names, manifest.PartFileName(pi.Index))
+	}
+	return names
+}
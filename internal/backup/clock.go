@@ -0,0 +1,38 @@
+package backup
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+	"zrb/internal/manifest"
+)
+
+// clockSkewTolerance is how far the system clock may lag the newest snapshot or backup before a
+// backup is refused, leaving room for small NTP corrections.
+const clockSkewTolerance = 10 * time.Minute
+
+// checkClock refuses to back up when the system clock is behind the newest snapshot of the dataset
+// or the last backup, i.e. time appears to have gone backwards. Such a clock misdates the output
+// directory and the names of new snapshots; ignore turns the refusal into a warning.
+func checkClock(now, latestSnapshot time.Time, last *manifest.Last, ignore bool) error {
+	reference, source := latestSnapshot, "the newest snapshot"
+	if last != nil {
+		for _, ref := range last.BackupLevels {
+			if ref != nil && time.Unix(ref.Datetime, 0).After(reference) {
+				reference, source = time.Unix(ref.Datetime, 0), fmt.Sprintf("the last backup of %s", ref.Snapshot)
+			}
+		}
+	}
+	if reference.IsZero() || now.After(reference.Add(-clockSkewTolerance)) {
+		return nil
+	}
+
+	skew := reference.Sub(now).Round(time.Second)
+	if ignore {
+		slog.Warn("SYSTEM CLOCK IS BEHIND, continuing because of --ignore-clock-skew",
+			"now", now.UTC(), "reference", reference.UTC(), "source", source, "skew", skew)
+		return nil
+	}
+	return fmt.Errorf("the system clock (%s) is %s behind %s (%s); fix the clock or pass --ignore-clock-skew",
+		now.UTC().Format(time.RFC3339), skew, source, reference.UTC().Format(time.RFC3339))
+}
@@ -0,0 +1,326 @@
+package backup
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"zrb/internal/chunker"
+	"zrb/internal/config"
+	"zrb/internal/crypto"
+	"zrb/internal/events"
+	"zrb/internal/fsync"
+	"zrb/internal/manifest"
+	"zrb/internal/remote"
+	"zrb/internal/sdnotify"
+	"zrb/internal/util"
+	"zrb/internal/zfs"
+
+	"filippo.io/age"
+	"github.com/zeebo/blake3"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// chunkDirName holds the encrypted chunks of a dedup_store send until they are stored.
+	chunkDirName = "chunks"
+	// chunkListName is the ordered chunk list a dedup_store send leaves in the output directory.
+	chunkListName = "chunks.yaml"
+	// chunkUploadWorkers is the number of chunks stored at once; chunks are small, so more run
+	// in parallel than parts.
+	chunkUploadWorkers = 8
+)
+
+// chunkStore names the chunk area of the recipients. A chunk is encrypted once and reused by
+// every later backup, so backups to other recipients must not find it.
+func chunkStore(recipients []string) string {
+	normalized := make([]string, len(recipients))
+	for i, r := range recipients {
+		normalized[i] = crypto.NormalizeRecipient(r)
+	}
+	sort.Strings(normalized)
+	sum := blake3.Sum256([]byte(strings.Join(normalized, "\n")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// chunkIndexPath is the local index of the chunks stored in store.
+func chunkIndexPath(runDir, store string) string {
+	return filepath.Join(runDir, "chunk_index_"+store)
+}
+
+// chunkIndex records the chunks known to be in S3, so a send skips them without asking S3.
+type chunkIndex struct {
+	mu    sync.Mutex
+	path  string
+	known map[string]bool
+}
+
+func loadChunkIndex(path string) (*chunkIndex, error) {
+	index := &chunkIndex{path: path, known: make(map[string]bool)}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read chunk index: %w", err)
+	}
+	for _, hash := range strings.Fields(string(data)) {
+		index.known[hash] = true
+	}
+	return index, nil
+}
+
+func (x *chunkIndex) has(hash string) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.known[hash]
+}
+
+// add records a chunk as stored. A line lost in a crash only costs a Head request next time.
+func (x *chunkIndex) add(hash string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.known[hash] {
+		return nil
+	}
+	f, err := util.AppendFile(x.path)
+	if err != nil {
+		return fmt.Errorf("failed to update chunk index: %w", err)
+	}
+	if _, err := f.WriteString(hash + "\n"); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to update chunk index: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to update chunk index: %w", err)
+	}
+	x.known[hash] = true
+	return nil
+}
+
+// sendChunked runs zfs send through the chunker. Chunks that neither the index nor an earlier
+// chunk of the stream holds are encrypted one by one into outputDir/chunks, and the ordered
+// chunk list is written to chunks.yaml. It returns the BLAKE3 hash and size of the stream.
+func sendChunked(ctx context.Context, task *config.Task, targetSnapshot, parentSnapshot, outputDir string, recipients []age.Recipient, index *chunkIndex, limit int64) (string, int64, error) {
+	chunkDir := filepath.Join(outputDir, chunkDirName)
+	if err := util.MkdirAll(chunkDir); err != nil {
+		return "", 0, fmt.Errorf("failed to create chunk directory: %w", err)
+	}
+	syncer := fsync.FromContext(ctx)
+
+	var chunks []manifest.ChunkInfo
+	written := make(map[string]bool)
+	cutter, err := chunker.New(task.DedupChunkSize(), func(chunk []byte) error {
+		sum := blake3.Sum256(chunk)
+		hash := hex.EncodeToString(sum[:])
+		chunks = append(chunks, manifest.ChunkInfo{Blake3Hash: hash, Size: int64(len(chunk))})
+		if written[hash] || index.has(hash) {
+			return nil
+		}
+		written[hash] = true
+		return writeChunk(syncer, filepath.Join(chunkDir, hash+".age"), chunk, recipients)
+	})
+	if err != nil {
+		return "", 0, err
+	}
+
+	slog.Info("Running zfs send into chunks", "targetSnapshot", targetSnapshot, "parentSnapshot", parentSnapshot, "avgChunkBytes", cutter.AvgSize)
+	blake3Hash, streamBytes, err := zfs.Send(ctx, targetSnapshot, parentSnapshot, cutter, limit)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := cutter.Close(); err != nil {
+		return "", 0, err
+	}
+	if err := syncer.Dir(chunkDir); err != nil {
+		return "", 0, err
+	}
+	if err := writeChunkList(syncer, filepath.Join(outputDir, chunkListName), chunks); err != nil {
+		return "", 0, err
+	}
+	slog.Info("Stream cut into chunks", "chunks", len(chunks), "new", len(written), "reused", len(chunks)-len(written))
+	return blake3Hash, streamBytes, nil
+}
+
+// writeChunk encrypts chunk to path through a temporary file, so a crash never leaves a
+// truncated chunk behind.
+func writeChunk(syncer fsync.Syncer, path string, chunk []byte, recipients []age.Recipient) error {
+	tmp := path + ".tmp"
+	f, err := util.CreatePart(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create chunk: %w", err)
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	w, err := age.Encrypt(f, recipients...)
+	if err != nil {
+		return fmt.Errorf("age encryption failed: %w", err)
+	}
+	if _, err := w.Write(chunk); err != nil {
+		return fmt.Errorf("age encryption failed: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("age encryption failed: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write chunk: %w", err)
+	}
+	if err := syncer.File(tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func writeChunkList(syncer fsync.Syncer, path string, chunks []manifest.ChunkInfo) error {
+	data, err := yaml.Marshal(chunks)
+	if err != nil {
+		return fmt.Errorf("failed to marshal chunk list: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := util.WriteFile(tmp, data); err != nil {
+		return fmt.Errorf("failed to write chunk list: %w", err)
+	}
+	if err := syncer.File(tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write chunk list: %w", err)
+	}
+	return nil
+}
+
+func readChunkList(path string) ([]manifest.ChunkInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk list: %w", err)
+	}
+	var chunks []manifest.ChunkInfo
+	if err := yaml.Unmarshal(data, &chunks); err != nil {
+		return nil, fmt.Errorf("failed to read chunk list: %w", err)
+	}
+	return chunks, nil
+}
+
+// storeChunks uploads the chunks a send left in outputDir unless S3 already has them, e.g. from
+// another dataset, records each in the index and removes it. It returns the hashes it stored or
+// found in S3.
+func storeChunks(ctx context.Context, backend remote.Backend, outputDir, store string, task *config.Task, tags remote.ObjectTags, index *chunkIndex, gate *pauseGate) (map[string]bool, error) {
+	chunkDir := filepath.Join(outputDir, chunkDirName)
+	entries, err := os.ReadDir(chunkDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to list chunks: %w", err)
+	}
+	var files []string
+	for _, e := range entries {
+		switch name := e.Name(); {
+		case strings.HasSuffix(name, ".age.tmp"):
+			os.Remove(filepath.Join(chunkDir, name))
+		case strings.HasSuffix(name, ".age"):
+			files = append(files, filepath.Join(chunkDir, name))
+		}
+	}
+
+	notifier := sdnotify.FromContext(ctx)
+	notifier.Phase("storing chunks", len(files))
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var errs []error
+	stored := make(map[string]bool, len(files))
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for range chunkUploadWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range work {
+				if err := gate.waitUpload(ctx); err != nil {
+					return
+				}
+				hash := strings.TrimSuffix(filepath.Base(path), ".age")
+				err := storeChunk(ctx, backend, path, remote.ChunkPath(task.S3Prefix, store, hash), tags)
+				if err == nil {
+					err = index.add(hash)
+				}
+				mu.Lock()
+				if err != nil {
+					errs = append(errs, fmt.Errorf("chunk %s: %w", hash, err))
+					cancel()
+				} else {
+					stored[hash] = true
+				}
+				mu.Unlock()
+				if err != nil {
+					return
+				}
+				if err := os.Remove(path); err != nil {
+					slog.Warn("Failed to remove stored chunk", "path", path, "error", err)
+				}
+				notifier.Step()
+			}
+		}()
+	}
+	for _, path := range files {
+		select {
+		case work <- path:
+		case <-ctx.Done():
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("failed to store %d chunk(s): %w", len(errs), errors.Join(errs...))
+	}
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("storing chunks cancelled: %w", ctx.Err())
+	}
+	slog.Info("Chunks stored", "count", len(stored))
+	return stored, nil
+}
+
+// storeChunk uploads one encrypted chunk unless an object with its hash exists already.
+func storeChunk(ctx context.Context, backend remote.Backend, path, remotePath string, tags remote.ObjectTags) error {
+	if _, err := backend.Head(ctx, remotePath); err == nil {
+		slog.Debug("Chunk already stored", "remote", remotePath)
+		return nil
+	} else if !remote.IsNotFound(err) {
+		return fmt.Errorf("failed to check %s: %w", remotePath, err)
+	}
+
+	blake3Hash, err := crypto.BLAKE3File(path)
+	if err != nil {
+		return fmt.Errorf("BLAKE3 hash failed: %w", err)
+	}
+	if err := backend.Upload(ctx, path, remotePath, blake3Hash, tags); err != nil {
+		return err
+	}
+	events.Emit(ctx, events.Event{Stage: events.PartUploaded, Object: remotePath, Blake3: blake3Hash})
+	return nil
+}
+
+// verifyChunks checks that every chunk of the backup this run did not store or find itself is in
+// S3. Those were skipped because the local index listed them, which cannot tell when an object
+// was deleted since.
+func verifyChunks(ctx context.Context, backend remote.Backend, chunks []manifest.ChunkInfo, checked map[string]bool, store, indexPath string, task *config.Task) error {
+	for _, c := range chunks {
+		if checked[c.Blake3Hash] {
+			continue
+		}
+		remotePath := remote.ChunkPath(task.S3Prefix, store, c.Blake3Hash)
+		if _, err := backend.Head(ctx, remotePath); err != nil {
+			if remote.IsNotFound(err) {
+				return fmt.Errorf("chunk %s is in the local chunk index but missing from S3; remove %s and run the backup again",
+					c.Blake3Hash, indexPath)
+			}
+			return fmt.Errorf("failed to check %s: %w", remotePath, err)
+		}
+		checked[c.Blake3Hash] = true
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+	"zrb/internal/events"
+	"zrb/internal/fsync"
+	"zrb/internal/manifest"
+	"zrb/internal/util"
+	"zrb/internal/zfs"
+
+	"filippo.io/age"
+	"github.com/zeebo/blake3"
+)
+
+// sendEncrypted runs zfs send through a zfs.PartWriter that encrypts every part of partSize bytes
+// as it is written, for inline_encryption, so only encrypted parts reach the disk. They are written
+// to <part>.age.tmp and renamed once the send succeeded, as split's parts are; a failed send
+// removes them. The BLAKE3 and encryption time of each part are recorded in state, so the parts are
+// uploaded without being read again. It returns the BLAKE3 hash and size of the stream.
+func sendEncrypted(ctx context.Context, state *manifest.State, targetSnapshot, parentSnapshot, outputDir string, recipients []age.Recipient, partSize, limit int64) (string, int64, error) {
+	syncer := fsync.FromContext(ctx)
+	var parts []*encryptedPart
+	success := false
+	defer func() {
+		if !success {
+			for _, p := range parts {
+				p.discard()
+			}
+		}
+	}()
+
+	w := zfs.NewPartWriter(partSize, func(index string) (io.WriteCloser, error) {
+		p, err := newEncryptedPart(ctx, syncer, filepath.Join(outputDir, manifest.PartFileName(index)), index, recipients)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create part %s: %w", index, err)
+		}
+		parts = append(parts, p)
+		return p, nil
+	})
+
+	slog.Info("Running zfs send with inline encryption", "targetSnapshot", targetSnapshot, "parentSnapshot", parentSnapshot)
+	blake3Hash, streamBytes, err := zfs.Send(ctx, targetSnapshot, parentSnapshot, w, limit)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := w.Close(); err != nil {
+		return "", 0, err
+	}
+
+	// The parts must be on disk before the state records them as encrypted.
+	encrypted := make(map[string]string, len(parts))
+	times := make(map[string]manifest.PartTimes, len(parts))
+	for _, p := range parts {
+		if err := os.Rename(p.path+".tmp", p.path); err != nil {
+			return "", 0, fmt.Errorf("failed to rename tmp file: %w", err)
+		}
+		encrypted[p.index] = p.blake3Hash
+		times[p.index] = manifest.PartTimes{EncryptedAt: p.encryptedAt.Unix()}
+	}
+	if err := syncer.Dir(outputDir); err != nil {
+		return "", 0, err
+	}
+
+	success = true
+	state.PartsEncrypted = encrypted
+	state.PartTimes = times
+	slog.Info("ZFS send with inline encryption completed successfully", "parts", len(parts), "blake3", blake3Hash, "bytes", streamBytes)
+	return blake3Hash, streamBytes, nil
+}
+
+// encryptedPart is a part age encrypts into path+".tmp" while it is written, hashing the
+// ciphertext.
+type encryptedPart struct {
+	ctx         context.Context
+	syncer      fsync.Syncer
+	path, index string
+	file        *os.File
+	encrypt     io.WriteCloser
+	hasher      *blake3.Hasher
+	blake3Hash  string
+	encryptedAt time.Time
+}
+
+func newEncryptedPart(ctx context.Context, syncer fsync.Syncer, path, index string, recipients []age.Recipient) (*encryptedPart, error) {
+	f, err := util.CreatePart(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	hasher := blake3.New()
+	w, err := age.Encrypt(io.MultiWriter(f, hasher), recipients...)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &encryptedPart{ctx: ctx, syncer: syncer, path: path, index: index, file: f, encrypt: w, hasher: hasher}, nil
+}
+
+func (p *encryptedPart) Write(b []byte) (int, error) {
+	return p.encrypt.Write(b)
+}
+
+// Close finishes the encryption and syncs the part.
+func (p *encryptedPart) Close() error {
+	if err := p.encrypt.Close(); err != nil {
+		return fmt.Errorf("age encryption of part %s failed: %w", p.index, err)
+	}
+	if err := p.syncer.File(p.file.Name()); err != nil {
+		return err
+	}
+	// A failed close can mean buffered data never reached the file.
+	if err := p.file.Close(); err != nil {
+		return err
+	}
+	p.blake3Hash = fmt.Sprintf("%x", p.hasher.Sum(nil))
+	p.encryptedAt = time.Now()
+	slog.Info("Encrypted part", "index", p.index, "blake3", p.blake3Hash)
+	events.Emit(p.ctx, events.Event{Stage: events.PartEncrypted, Part: p.index, Blake3: p.blake3Hash})
+	return nil
+}
+
+// discard removes the part of a failed send, finished or not.
+func (p *encryptedPart) discard() {
+	p.file.Close()
+	for _, path := range []string{p.path + ".tmp", p.path} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			slog.Warn("Failed to clean up", "file", path, "error", err)
+		}
+	}
+}
+
+// inlinePartError is the failure of an encrypted part of an inline_encryption backup that is gone
+// or damaged, which cannot be encrypted again as no unencrypted part was kept.
+func inlinePartError(ageFile string, err error) error {
+	return fmt.Errorf("%s: %w; inline_encryption keeps no unencrypted part to encrypt it again, remove the backup state to send the snapshot again",
+		filepath.Base(ageFile), err)
+}
@@ -0,0 +1,83 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"zrb/internal/config"
+	"zrb/internal/crypto"
+	"zrb/internal/manifest"
+	"zrb/internal/remote"
+)
+
+// loadParentManifest reads the task manifest of the parent level, from its local path or, once the
+// local copy was cleaned up after upload, from S3.
+func loadParentManifest(ctx context.Context, cfg *config.Config, task *config.Task, ref *manifest.Ref, upload bool) (*manifest.Backup, error) {
+	if ref.Manifest != "" {
+		if m, err := manifest.Read(ref.Manifest); err == nil {
+			return m, nil
+		}
+	}
+	if !upload {
+		return nil, fmt.Errorf("parent manifest %s is not readable and the task does not upload to S3", ref.Manifest)
+	}
+
+	backend, err := remote.DefaultCache.Get(ctx, remote.OptionsFromConfig(cfg, cfg.ManifestStorageClass()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize S3 backend: %w", err)
+	}
+
+	tmp, err := os.CreateTemp("", "backup_parent_manifest_*.yaml")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	remotePath := remote.ManifestPath(task.S3Prefix, ref.S3Path, "task_manifest.yaml")
+	if err := backend.Download(ctx, remotePath, tmp.Name()); err != nil {
+		return nil, fmt.Errorf("failed to download parent manifest %s: %w", remotePath, err)
+	}
+	return manifest.Read(tmp.Name())
+}
+
+// checkKeyChange compares the configured recipients with those the parent level was encrypted to.
+// A chain encrypted to different keys needs all of them to restore, so a change is refused unless
+// accepted; the returned key history then records the parent's recipients for the new manifest.
+func checkKeyChange(cfg *config.Config, parent *manifest.Backup, accept bool) ([]manifest.KeyRecord, error) {
+	configured := normalizedRecipients(cfg.Recipients())
+	recorded := normalizedRecipients(parent.Recipients())
+	if len(recorded) == 0 || slices.Equal(configured, recorded) {
+		return parent.KeyHistory, nil
+	}
+
+	if !accept {
+		return nil, fmt.Errorf("the configured age recipients changed since the level %d backup this one builds on\n"+
+			"  configured: %s\n"+
+			"  level %d:   %s\n"+
+			"Restoring the chain would need the private keys of both. Run a new level 0 backup, or pass\n"+
+			"--accept-key-change to continue the chain and record both keys in the manifest's key_history",
+			parent.BackupLevel, strings.Join(configured, ", "), parent.BackupLevel, strings.Join(recorded, ", "))
+	}
+
+	slog.Warn("Continuing the backup chain with changed age recipients, restoring it needs the keys of every level",
+		"parentLevel", parent.BackupLevel, "configured", configured, "recorded", recorded)
+	return append(slices.Clone(parent.KeyHistory), manifest.KeyRecord{
+		BackupLevel:    parent.BackupLevel,
+		TargetSnapshot: parent.TargetSnapshot,
+		AgePublicKey:   parent.AgePublicKey,
+		AgeRecipients:  parent.AgeRecipients,
+	}), nil
+}
+
+func normalizedRecipients(recipients []string) []string {
+	normalized := make([]string, 0, len(recipients))
+	for _, r := range recipients {
+		normalized = append(normalized, crypto.NormalizeRecipient(r))
+	}
+	slices.Sort(normalized)
+	return slices.Compact(normalized)
+}
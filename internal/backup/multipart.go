@@ -0,0 +1,37 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+	"zrb/internal/remote"
+)
+
+// staleUploadAge is how long ago a multipart upload must have started before a backup aborts it;
+// younger ones may belong to a backup of a nested dataset running right now.
+const staleUploadAge = 24 * time.Hour
+
+// abortUploadsTimeout bounds the look for incomplete multipart uploads at the start of a backup.
+var abortUploadsTimeout = 30 * time.Second
+
+// abortStaleUploads aborts the multipart uploads interrupted runs left below prefix, which are
+// billed without showing up as objects. It only logs failures, as the backup does not depend on it.
+func abortStaleUploads(ctx context.Context, backend remote.Backend, prefix string) {
+	aborter, ok := backend.(remote.MultipartAborter)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, abortUploadsTimeout)
+	defer cancel()
+
+	aborted, err := aborter.AbortIncompleteUploads(ctx, prefix, staleUploadAge)
+	switch {
+	case errors.Is(err, remote.ErrMultipartNotSupported):
+		slog.Warn("Cannot look for incomplete multipart uploads; use a bucket lifecycle rule to abort them", "prefix", prefix, "error", err)
+	case err != nil:
+		slog.Warn("Failed to abort incomplete multipart uploads", "prefix", prefix, "aborted", aborted, "error", err)
+	case aborted > 0:
+		slog.Info("Aborted incomplete multipart uploads of earlier runs", "prefix", prefix, "count", aborted)
+	}
+}
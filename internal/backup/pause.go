@@ -0,0 +1,178 @@
+package backup
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+	"zrb/internal/sdnotify"
+)
+
+// pauseFileName is the file in the run directory that pauses the part workers while it exists.
+const pauseFileName = "pause"
+
+// pausePollInterval is how often a paused or pausing gate looks for the pause file.
+var pausePollInterval = 5 * time.Second
+
+// pauseGate holds the part workers between parts and before uploads while the backup is paused,
+// so the uplink can be freed without killing the process and sending the snapshot again. A
+// signal toggles the pause, and so does creating or removing the pause file. Outside the upload
+// window of the task, it holds uploads only. A nil gate never pauses.
+type pauseGate struct {
+	file     string
+	notifier *sdnotify.Notifier
+	// window is the upload window of the task, nil for none or with --ignore-window.
+	window *uploadWindow
+	now    func() time.Time
+	// onPause runs when the backup becomes paused and when a part starts waiting for the upload
+	// window, to save the state of the parts done so far.
+	onPause func()
+
+	mu        sync.Mutex
+	signalled bool
+	paused    bool
+	// waiting is set while uploads wait for the window to open.
+	waiting bool
+	// changed is closed and replaced whenever a signal toggles the pause.
+	changed chan struct{}
+}
+
+func newPauseGate(file string, notifier *sdnotify.Notifier) *pauseGate {
+	return &pauseGate{file: file, notifier: notifier, now: time.Now, changed: make(chan struct{})}
+}
+
+// watch toggles the pause on every value received from toggles until ctx is done or the returned
+// stop is called.
+func (g *pauseGate) watch(ctx context.Context, toggles <-chan os.Signal) (stop func()) {
+	if g == nil || toggles == nil {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-toggles:
+				g.toggle()
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func (g *pauseGate) toggle() {
+	g.mu.Lock()
+	g.signalled = !g.signalled
+	close(g.changed)
+	g.changed = make(chan struct{})
+	g.mu.Unlock()
+	g.update()
+}
+
+// update reports a change between paused and running and returns whether the backup is paused.
+func (g *pauseGate) update() bool {
+	_, err := os.Stat(g.file)
+	fileExists := err == nil
+
+	g.mu.Lock()
+	paused := g.signalled || fileExists
+	changed := paused != g.paused
+	g.paused = paused
+	g.mu.Unlock()
+
+	if changed {
+		g.notifier.Paused(paused)
+		if paused {
+			slog.Info("Backup paused, workers stop after their current part; send SIGUSR1 again or remove the pause file to resume", "pauseFile", g.file)
+			if g.onPause != nil {
+				g.onPause()
+			}
+		} else {
+			slog.Info("Backup resumed")
+		}
+	}
+	return paused
+}
+
+// outsideWindow reports a change between inside and outside the upload window and returns whether
+// uploads wait for it to open.
+func (g *pauseGate) outsideWindow() bool {
+	if g.window == nil {
+		return false
+	}
+	open, until := g.window.state(g.now())
+
+	g.mu.Lock()
+	changed := g.waiting == open
+	g.waiting = !open
+	g.mu.Unlock()
+
+	if changed {
+		if open {
+			g.notifier.Waiting("")
+			slog.Info("Upload window open, uploads continue", "closes", until)
+		} else {
+			g.notifier.Waiting("waiting for upload window until " + until.In(g.window.loc).Format("15:04"))
+			slog.Info("Outside the upload window, uploads wait for it to open; pass --ignore-window to upload now", "opens", until)
+		}
+	}
+	return !open
+}
+
+// wait returns once the backup is not paused, or with the error of ctx when it ends first.
+func (g *pauseGate) wait(ctx context.Context) error {
+	if g == nil {
+		return nil
+	}
+	return g.hold(ctx, g.update)
+}
+
+// waitUpload returns once the backup is neither paused nor outside the upload window, or with the
+// error of ctx when it ends first.
+func (g *pauseGate) waitUpload(ctx context.Context) error {
+	if g == nil {
+		return nil
+	}
+	saved := false
+	return g.hold(ctx, func() bool {
+		if g.update() {
+			return true
+		}
+		if !g.outsideWindow() {
+			return false
+		}
+		// The window may stay closed for hours; record the part waiting for it as encrypted.
+		if !saved && g.onPause != nil {
+			g.onPause()
+		}
+		saved = true
+		return true
+	})
+}
+
+// hold returns once held reports false, checking again whenever a signal toggles the pause and
+// every pausePollInterval.
+func (g *pauseGate) hold(ctx context.Context, held func() bool) error {
+	for {
+		g.mu.Lock()
+		changed := g.changed
+		g.mu.Unlock()
+		if !held() {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		case <-time.After(pausePollInterval):
+		}
+	}
+}
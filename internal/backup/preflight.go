@@ -0,0 +1,74 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+	"zrb/internal/remote"
+)
+
+// preflightAttempts and preflightBackoff ride out an S3 outage of a few minutes before the first
+// upload of a run with s3.preflight: deferred. The backoff doubles for each further attempt.
+var (
+	preflightAttempts = 6
+	preflightBackoff  = 5 * time.Second
+)
+
+// deferredCheck verifies the S3 credentials once, when the first upload is about to start, so
+// sending and encrypting are not held up by a slow or briefly unreachable S3. Concurrent uploads
+// wait for the first check and share its outcome; a failed check fails every upload of the run,
+// which resumes with the encrypted parts on the next run.
+type deferredCheck struct {
+	backend remote.Backend
+
+	mu   sync.Mutex
+	done bool
+	err  error
+}
+
+func (c *deferredCheck) verify(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done {
+		return c.err
+	}
+
+	backoff := preflightBackoff
+	for attempt := 1; ; attempt++ {
+		err := c.backend.VerifyCredentials(ctx)
+		if err == nil {
+			slog.Info("S3 credentials verified before the first upload", "attempt", attempt)
+			c.done = true
+			return nil
+		}
+		// Waiting does not create a bucket or grant a permission.
+		if attempt >= preflightAttempts || ctx.Err() != nil || remote.IsPermanent(err) {
+			c.done = true
+			c.err = fmt.Errorf("credentials verification failed after %d attempt(s): %w", attempt, err)
+			return c.err
+		}
+
+		slog.Warn("Credentials verification failed, retrying", "attempt", attempt, "retryIn", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("credentials verification interrupted: %w", ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// checkedBackend runs a deferredCheck before each upload.
+type checkedBackend struct {
+	remote.Backend
+	check *deferredCheck
+}
+
+func (b *checkedBackend) Upload(ctx context.Context, localPath, remotePath, checksumHash string, tags remote.ObjectTags) error {
+	if err := b.check.verify(ctx); err != nil {
+		return err
+	}
+	return b.Backend.Upload(ctx, localPath, remotePath, checksumHash, tags)
+}
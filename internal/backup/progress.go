@@ -0,0 +1,251 @@
+package backup
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+	"zrb/internal/config"
+	"zrb/internal/manifest"
+	"zrb/internal/version"
+)
+
+const partialManifestName = "task_manifest.partial.yaml"
+
+var (
+	// stateFlushInterval bounds how often completed parts are persisted to the state file.
+	// Parts finished in between are re-verified on resume, which is cheap compared to rewriting
+	// a state with tens of thousands of entries after every part.
+	stateFlushInterval = 5 * time.Second
+
+	// partialManifestEvery is the number of completed parts between partial manifest writes.
+	partialManifestEvery = 500
+)
+
+// partTracker collects part results from the workers, persists them to the state file in batches
+// and periodically writes an incomplete manifest so per-part hashes survive losing the state file.
+type partTracker struct {
+	mu          sync.Mutex
+	state       *manifest.State
+	statePath   string
+	partialPath string
+	task        *config.Task
+	total       int
+	infos       []manifest.PartInfo
+	unflushed   int
+	lastFlush   time.Time
+	// uploadedSizes holds the size of each part uploaded but not yet completed.
+	uploadedSizes map[string]int64
+	// onFlush, if set, runs with the lock held after each state write.
+	onFlush func(*manifest.State)
+}
+
+func newPartTracker(state *manifest.State, statePath, outputDir string, task *config.Task, total int) *partTracker {
+	return &partTracker{
+		state:       state,
+		statePath:   statePath,
+		partialPath: filepath.Join(outputDir, partialManifestName),
+		task:        task,
+		total:       total,
+		infos:       make([]manifest.PartInfo, 0, total),
+		lastFlush:   time.Now(),
+	}
+}
+
+// partStage is how far a part got in earlier runs, as the backup state records it.
+type partStage int
+
+const (
+	// partPending parts have no encrypted file the state knows of. An encrypted file a crash left
+	// before the state was saved is checked and hashed again.
+	partPending partStage = iota
+	// partEncrypted parts have an encrypted file with a recorded hash and still need uploading.
+	partEncrypted
+	// partUploaded parts are done and skipped.
+	partUploaded
+)
+
+// stage returns how far the part at index got and its recorded hash. A nil tracker knows of no
+// earlier run.
+func (t *partTracker) stage(index string) (partStage, string) {
+	if t == nil {
+		return partPending, ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if hash, ok := t.state.PartsCompleted[index]; ok && hash != "" {
+		return partUploaded, hash
+	}
+	if hash, ok := t.state.PartsEncrypted[index]; ok && hash != "" {
+		return partEncrypted, hash
+	}
+	return partPending, ""
+}
+
+// encrypted records the hash of a part whose encrypted file was written at at, so a resumed run
+// uploads it without hashing it again.
+func (t *partTracker) encrypted(index, blake3Hash string, at time.Time) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.state.PartsEncrypted == nil {
+		t.state.PartsEncrypted = make(map[string]string)
+	}
+	t.state.PartsEncrypted[index] = blake3Hash
+	times := t.timesLocked(index)
+	times.EncryptedAt = at.Unix()
+	t.state.PartTimes[index] = times
+	return t.changedLocked(index)
+}
+
+// uploaded records that the part at index, of size bytes, reached the bucket at at, unless at is
+// unknown. The state is saved with the completed part, which adds size to its UploadedBytes.
+func (t *partTracker) uploaded(index string, at time.Time, size int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.uploadedSizes == nil {
+		t.uploadedSizes = make(map[string]int64)
+	}
+	t.uploadedSizes[index] = size
+	if at.IsZero() {
+		return
+	}
+	times := t.timesLocked(index)
+	times.UploadedAt = at.Unix()
+	t.state.PartTimes[index] = times
+}
+
+// sized records the size of the encrypted file of the part at index for its manifest entry.
+func (t *partTracker) sized(index string, size int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.state.PartSizes == nil {
+		t.state.PartSizes = make(map[string]int64)
+	}
+	t.state.PartSizes[index] = size
+}
+
+func (t *partTracker) timesLocked(index string) manifest.PartTimes {
+	if t.state.PartTimes == nil {
+		t.state.PartTimes = make(map[string]manifest.PartTimes)
+	}
+	return t.state.PartTimes[index]
+}
+
+// partInfoLocked is the manifest entry of the part at index with its recorded times and size.
+func (t *partTracker) partInfoLocked(index, blake3Hash string) manifest.PartInfo {
+	times := t.state.PartTimes[index]
+	return manifest.PartInfo{Index: index, Blake3Hash: blake3Hash, EncryptedAt: times.EncryptedAt, UploadedAt: times.UploadedAt,
+		SizeBytes: t.state.PartSizes[index]}
+}
+
+// complete records a finished part. Parts already in the state (resumed) are only counted.
+func (t *partTracker) complete(index, blake3Hash string, resumed bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.infos = append(t.infos, t.partInfoLocked(index, blake3Hash))
+	slog.Info("Part completed", "index", index, "completed", len(t.infos), "total", t.total)
+
+	if resumed {
+		return nil
+	}
+
+	t.state.PartsCompleted[index] = blake3Hash
+	delete(t.state.PartsEncrypted, index)
+	t.state.UploadedBytes += t.uploadedSizes[index]
+	delete(t.uploadedSizes, index)
+	if err := t.changedLocked(index); err != nil {
+		return err
+	}
+
+	if len(t.infos)%partialManifestEvery == 0 {
+		if err := t.writePartialLocked(); err != nil {
+			slog.Warn("Failed to write partial manifest", "path", t.partialPath, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// changedLocked counts a change to the part at index and saves the state once stateFlushInterval
+// has passed since the last write.
+func (t *partTracker) changedLocked(index string) error {
+	t.unflushed++
+	if time.Since(t.lastFlush) >= stateFlushInterval {
+		if err := t.flushLocked(); err != nil {
+			return fmt.Errorf("failed to save state for part %s: %w", index, err)
+		}
+	}
+	return nil
+}
+
+// flush persists any parts completed since the last state write.
+func (t *partTracker) flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.flushLocked()
+}
+
+func (t *partTracker) flushLocked() error {
+	if t.unflushed == 0 {
+		return nil
+	}
+
+	t.state.LastUpdated = time.Now().Unix()
+	if err := manifest.WriteState(t.statePath, t.state); err != nil {
+		return err
+	}
+
+	t.unflushed = 0
+	t.lastFlush = time.Now()
+	if t.onFlush != nil {
+		t.onFlush(t.state)
+	}
+	return nil
+}
+
+func (t *partTracker) writePartialLocked() error {
+	parts := make([]manifest.PartInfo, 0, len(t.state.PartsCompleted))
+	for index, hash := range t.state.PartsCompleted {
+		parts = append(parts, t.partInfoLocked(index, hash))
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].Index < parts[j].Index
+	})
+
+	return manifest.Write(t.partialPath, &manifest.Backup{
+		Incomplete:     true,
+		Datetime:       time.Now().Unix(),
+		ZrbVersion:     version.Get(),
+		Pool:           t.task.Pool,
+		Dataset:        t.task.Dataset,
+		BackupLevel:    t.state.BackupLevel,
+		TargetSnapshot: t.state.TargetSnapshot,
+		ParentSnapshot: t.state.ParentSnapshot,
+		Blake3Hash:     t.state.Blake3Hash,
+		Parts:          parts,
+	})
+}
+
+// removePartialManifest deletes the partial manifest once the complete one has been written.
+func removePartialManifest(outputDir string) {
+	path := filepath.Join(outputDir, partialManifestName)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		slog.Warn("Failed to remove partial manifest", "path", path, "error", err)
+	}
+}
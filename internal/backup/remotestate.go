@@ -0,0 +1,258 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"zrb/internal/config"
+	"zrb/internal/crypto"
+	"zrb/internal/manifest"
+	"zrb/internal/remote"
+
+	"filippo.io/age"
+)
+
+// remoteStateInterval bounds how often state updates are mirrored to S3; milestones are always pushed.
+var remoteStateInterval = time.Minute
+
+// remoteState mirrors the backup state, encrypted to the configured recipients, next to the manifests
+// so another host can finish a backup whose parts were already uploaded.
+type remoteState struct {
+	backend    remote.Backend
+	recipients []age.Recipient
+	remotePath string
+	tags       remote.ObjectTags
+	workDir    string
+
+	mu       sync.Mutex
+	lastPush time.Time
+}
+
+func remoteStatePath(task *config.Task, level int16) string {
+	return remote.ManifestPath(task.S3Prefix, task.Pool, task.Dataset, "state", fmt.Sprintf("%s-level%d.yaml.age", task.Name, level))
+}
+
+// push uploads state unless one was uploaded within remoteStateInterval and force is not set.
+// Failures are logged only: the remote copy is a convenience and must not fail the backup.
+// A nil remoteState does nothing, so callers need not check whether the feature is enabled.
+func (r *remoteState) push(ctx context.Context, state *manifest.State, force bool) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !force && time.Since(r.lastPush) < remoteStateInterval {
+		return
+	}
+
+	plain := filepath.Join(r.workDir, "backup_state.remote.yaml")
+	encrypted := plain + ".age"
+	defer os.Remove(plain)
+	defer os.Remove(encrypted)
+
+	if err := manifest.WriteState(plain, state); err != nil {
+		slog.Warn("Failed to write backup state for upload", "error", err)
+		return
+	}
+	if err := crypto.Encrypt(plain, encrypted, r.recipients...); err != nil {
+		slog.Warn("Failed to encrypt backup state for upload", "error", err)
+		return
+	}
+	hash, err := crypto.BLAKE3File(encrypted)
+	if err != nil {
+		slog.Warn("Failed to hash backup state for upload", "error", err)
+		return
+	}
+	if err := r.backend.Upload(ctx, encrypted, r.remotePath, hash, r.tags); err != nil {
+		slog.Warn("Failed to upload backup state", "remote", r.remotePath, "error", err)
+		return
+	}
+	r.lastPush = time.Now()
+}
+
+// remove deletes the remote copy once the backup has completed.
+func (r *remoteState) remove(ctx context.Context) {
+	if r == nil {
+		return
+	}
+	if err := r.backend.Delete(ctx, r.remotePath); err != nil && !remote.IsNotFound(err) {
+		slog.Warn("Failed to delete remote backup state", "remote", r.remotePath, "error", err)
+	}
+}
+
+// exists reports whether a remote state is stored for this task and level.
+func (r *remoteState) exists(ctx context.Context) (bool, error) {
+	if _, err := r.backend.Head(ctx, r.remotePath); err != nil {
+		if remote.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// fetch downloads and decrypts the remote state with the private key at privateKeyPath.
+func (r *remoteState) fetch(ctx context.Context, privateKeyPath string) (*manifest.State, error) {
+	identities, err := crypto.LoadIdentities(privateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted := filepath.Join(r.workDir, "backup_state.remote.yaml.age")
+	plain := strings.TrimSuffix(encrypted, ".age")
+	defer os.Remove(encrypted)
+	defer os.Remove(plain)
+
+	if err := r.backend.Download(ctx, r.remotePath, encrypted); err != nil {
+		return nil, fmt.Errorf("failed to download remote backup state: %w", err)
+	}
+	if err := crypto.Decrypt(encrypted, plain, identities...); err != nil {
+		return nil, fmt.Errorf("failed to decrypt remote backup state: %w", err)
+	}
+	return manifest.ReadState(plain)
+}
+
+// setupRemoteState prepares mirroring the state to S3. Without a local state it looks for the state of
+// an interrupted run and, given the private key to decrypt it, resumes from it when planResume allows.
+// It reports whether state was replaced by the remote copy.
+func setupRemoteState(
+	ctx context.Context,
+	cfg *config.Config,
+	task *config.Task,
+	level int16,
+	state *manifest.State,
+	statePath string,
+	lastPath string,
+	workDir string,
+	recipients []age.Recipient,
+	opts Options,
+) (*remoteState, bool, error) {
+	backend, err := remote.DefaultCache.Get(ctx, remote.OptionsFromConfig(cfg, cfg.ManifestStorageClass()))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to initialize S3 backend for remote state: %w", err)
+	}
+
+	r := &remoteState{
+		backend:    backend,
+		recipients: recipients,
+		remotePath: remoteStatePath(task, level),
+		tags:       remote.ObjectTags{Level: -1, Task: task.Name},
+		workDir:    workDir,
+	}
+
+	if source, _ := planResume(state, nil, task.Name, level); source == resumeLocal {
+		return r, false, nil
+	}
+
+	found, err := r.exists(ctx)
+	if err != nil {
+		slog.Warn("Failed to look for remote backup state", "remote", r.remotePath, "error", err)
+		return r, false, nil
+	}
+	if !found {
+		return r, false, nil
+	}
+	if opts.IgnoreRemoteState {
+		slog.Warn("Ignoring remote backup state of an interrupted run, starting over", "remote", r.remotePath)
+		return r, false, nil
+	}
+	if opts.ResumeRemoteKey == "" {
+		return nil, false, fmt.Errorf("found the state of an interrupted level %d backup of task %s at %s\n"+
+			"Rerun with --resume-remote-key <private key> to finish it, or with --ignore-remote-state to start over",
+			level, task.Name, r.remotePath)
+	}
+
+	remoteCopy, err := r.fetch(ctx, opts.ResumeRemoteKey)
+	if err != nil {
+		return nil, false, err
+	}
+	source, err := planResume(state, remoteCopy, task.Name, level)
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot resume from remote backup state: %w\nRerun with --ignore-remote-state to start over", err)
+	}
+	if source != resumeRemote {
+		return r, false, nil
+	}
+
+	adoptRemoteState(remoteCopy, cfg.StagingRoot(task), task)
+	*state = *remoteCopy
+	if err := manifest.WriteState(statePath, state); err != nil {
+		return nil, false, fmt.Errorf("failed to save resumed backup state: %w", err)
+	}
+	slog.Info("Resuming backup from remote state", "remote", r.remotePath, "parts", len(state.PartsCompleted))
+
+	// A replacement host has no last backup manifest, which level > 0 needs for its parent.
+	if _, err := os.Stat(lastPath); os.IsNotExist(err) {
+		remoteLast := remote.ManifestPath(task.S3Prefix, task.Pool, task.Dataset, "last_backup_manifest.yaml")
+		if err := backend.Download(ctx, remoteLast, lastPath); err != nil {
+			slog.Warn("Failed to download last backup manifest", "remote", remoteLast, "error", err)
+		}
+	}
+
+	return r, true, nil
+}
+
+type resumeSource int
+
+const (
+	resumeNone resumeSource = iota
+	resumeLocal
+	resumeRemote
+)
+
+// planResume decides where a backup resumes from. A matching local state always wins, since the local
+// part files let it redo anything. A remote state is only usable when the zfs send finished and every part
+// was uploaded: parts that were split or encrypted but not uploaded existed only on the old host's disk.
+func planResume(local, remoteCopy *manifest.State, taskName string, level int16) (resumeSource, error) {
+	if local != nil && local.TaskName == taskName && local.BackupLevel == level {
+		return resumeLocal, nil
+	}
+	if remoteCopy == nil || remoteCopy.TaskName != taskName || remoteCopy.BackupLevel != level {
+		return resumeNone, nil
+	}
+
+	if remoteCopy.Blake3Hash == "" {
+		return resumeNone, fmt.Errorf("the interrupted backup had not finished zfs send, so no part was uploaded")
+	}
+	if _, ok := remoteCopy.PartsCompleted[manifest.SingleFileIndex]; ok {
+		return resumeRemote, nil
+	}
+
+	partSize := statePartSize(remoteCopy)
+	expected := int((remoteCopy.StreamBytes + partSize - 1) / partSize)
+	if remoteCopy.StreamBytes <= 0 || len(remoteCopy.PartsCompleted) < expected {
+		return resumeNone, fmt.Errorf("only %d of %d parts were uploaded; the rest existed only on the host that ran the backup",
+			len(remoteCopy.PartsCompleted), expected)
+	}
+	return resumeRemote, nil
+}
+
+// adoptRemoteState turns a remote state into a local one: the output directory moves below this host's
+// staging root and the manifest is rebuilt, since the old host's manifest file is gone.
+func adoptRemoteState(state *manifest.State, stagingRoot string, task *config.Task) {
+	levelDir := filepath.Base(filepath.Dir(state.OutputDir))
+	dateDir := filepath.Base(state.OutputDir)
+	state.OutputDir = filepath.Join(stagingRoot, "task", task.Pool, task.Dataset, levelDir, dateDir)
+	state.ManifestCreated = false
+	state.ManifestUploaded = false
+	// The encrypted files of parts not yet uploaded stayed on the old host.
+	state.PartsEncrypted = nil
+}
+
+// completedIndices lists the parts recorded in the state, for a resume without local part files.
+func completedIndices(state *manifest.State) []string {
+	indices := make([]string, 0, len(state.PartsCompleted))
+	for index := range state.PartsCompleted {
+		indices = append(indices, index)
+	}
+	sort.Strings(indices)
+	return indices
+}
@@ -0,0 +1,42 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+	"zrb/internal/config"
+	"zrb/internal/hooks"
+	"zrb/internal/zfs"
+)
+
+// takeSnapshot creates the zrb_level<N> snapshot the backup then sends, between the task's
+// pre_snapshot and post_snapshot hooks, and returns its name. A failing pre_snapshot hook aborts
+// before the snapshot is taken; post_snapshot runs whenever pre_snapshot did, so it can undo
+// whatever that started.
+func takeSnapshot(ctx context.Context, task *config.Task, level int16) (_ string, retErr error) {
+	name := zfs.TimestampedSnapshot(task.Pool, task.Dataset, fmt.Sprintf("zrb_level%d", level), time.Now()).String()
+	env := hooks.Env{Task: task.Name, Level: level, Snapshot: name}
+	defer func() {
+		hooks.Post(ctx, "post_snapshot", task.Hooks.PostSnapshot, task.HookTimeout(), env, retErr)
+	}()
+
+	if err := hooks.Run(ctx, "pre_snapshot", task.Hooks.PreSnapshot, task.HookTimeout(), env); err != nil {
+		return "", fmt.Errorf("aborting backup before the snapshot: %w", err)
+	}
+	slog.Info("Taking snapshot", "snapshot", name)
+	if err := zfs.TakeSnapshot(name); err != nil {
+		return "", fmt.Errorf("failed to create snapshot %s: %w", name, err)
+	}
+	return name, nil
+}
+
+// discardSnapshot destroys the snapshot a backup took when its send failed before streaming
+// anything, so a later backup does not pick it up as the newest one.
+func discardSnapshot(snapshot string) {
+	if err := zfs.DestroySnapshot(snapshot); err != nil {
+		slog.Warn("Failed to destroy the snapshot of the failed backup", "snapshot", snapshot, "error", err)
+		return
+	}
+	slog.Info("Destroyed the snapshot of the failed backup, nothing was sent from it", "snapshot", snapshot)
+}
@@ -0,0 +1,59 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"zrb/internal/util"
+	"zrb/internal/zfs"
+)
+
+// stagingSafetyFactor pads the estimated stream size for the encrypted parts in flight next to
+// the split ones.
+const stagingSafetyFactor = 1.1
+
+// diskFree is util.DiskFree; replaced in tests.
+var diskFree = util.DiskFree
+
+// checkStagingDir fails unless a configured staging_dir exists and is writable. It is not created,
+// so parts never fill the filesystem below the mount point of a scratch disk that is not mounted.
+func checkStagingDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("staging_dir %s is not usable: %w", dir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("staging_dir %s is not a directory", dir)
+	}
+	f, err := os.CreateTemp(dir, ".zrb_write_check_*")
+	if err != nil {
+		return fmt.Errorf("staging_dir %s is not writable: %w", dir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
+
+// checkStagingSpace fails when the filesystem of outputDir cannot hold the estimated send stream.
+// Without an estimate or the free space it only warns, as the send itself would still fail cleanly.
+func checkStagingSpace(ctx context.Context, outputDir, targetSnapshot, parentSnapshot string) error {
+	estimated, err := zfs.EstimateSendSize(ctx, targetSnapshot, parentSnapshot)
+	if err != nil {
+		slog.Warn("Cannot estimate the stream size, skipping the staging space check", "error", err)
+		return nil
+	}
+	free, err := diskFree(outputDir)
+	if err != nil {
+		slog.Warn("Cannot check the free staging space", "error", err)
+		return nil
+	}
+
+	required := uint64(float64(estimated) * stagingSafetyFactor)
+	if free < required {
+		return fmt.Errorf("%s has %d bytes free, but the estimated %d byte stream of %s needs about %d; "+
+			"free up space or set staging_dir to a larger filesystem", outputDir, free, estimated, targetSnapshot, required)
+	}
+	slog.Info("Staging space checked", "path", outputDir, "freeBytes", free, "estimatedBytes", estimated)
+	return nil
+}
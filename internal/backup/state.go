@@ -0,0 +1,107 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+	"zrb/internal/config"
+	"zrb/internal/manifest"
+	"zrb/internal/zfs"
+)
+
+// freshReason is why a backup starts fresh instead of resuming the backup state.
+type freshReason string
+
+const (
+	freshNoState         freshReason = "no-state"
+	freshTaskMismatch    freshReason = "task-mismatch"
+	freshLevelMismatch   freshReason = "level-mismatch"
+	freshParseError      freshReason = "parse-error"
+	freshVersionMismatch freshReason = "version-mismatch"
+	freshExpired         freshReason = "expired"
+	freshInvalid         freshReason = "invalid"
+)
+
+// stateMaxAge is how long after its last update a backup state is resumed. An older one belongs to
+// a run abandoned long ago, whose snapshot later backups have superseded.
+const stateMaxAge = 30 * 24 * time.Hour
+
+// loadOrCreateState returns the backup state to resume, or a new one and the reason the existing
+// state was not resumed. A state that cannot be read, was written by a newer zrb or was marked
+// invalid is only discarded with discard, since starting fresh removes what its run left in the
+// output directory.
+func loadOrCreateState(statePath, taskName string, backupLevel int16, discard bool) (*manifest.State, freshReason, error) {
+	reason, detail := freshNoState, ""
+	existing, err := manifest.ReadState(statePath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		slog.Info("No backup state, starting fresh", "reason", reason)
+		return &manifest.State{Version: manifest.StateVersion}, reason, nil
+	case err != nil:
+		reason, detail = freshParseError, err.Error()
+	case existing.Version > manifest.StateVersion:
+		reason, detail = freshVersionMismatch, fmt.Sprintf("state version %d is newer than version %d of this zrb", existing.Version, manifest.StateVersion)
+	case existing.Invalid != "":
+		reason, detail = freshInvalid, existing.Invalid
+	case existing.TaskName != taskName:
+		reason, detail = freshTaskMismatch, fmt.Sprintf("state is for task %s, not %s", existing.TaskName, taskName)
+	case existing.BackupLevel != backupLevel:
+		reason, detail = freshLevelMismatch, fmt.Sprintf("state is for level %d, not %d", existing.BackupLevel, backupLevel)
+	case existing.LastUpdated != 0 && time.Since(time.Unix(existing.LastUpdated, 0)) > stateMaxAge:
+		reason, detail = freshExpired, fmt.Sprintf("state was last updated %s, more than %d days ago",
+			time.Unix(existing.LastUpdated, 0).Format(time.RFC3339), int(stateMaxAge.Hours()/24))
+	default:
+		slog.Info("Found existing backup state, resuming", "state", existing)
+		return existing, "", nil
+	}
+
+	if (reason == freshParseError || reason == freshVersionMismatch || reason == freshInvalid) && !discard {
+		return nil, reason, fmt.Errorf("cannot resume from %s (%s): %s; starting fresh removes what the interrupted backup left behind, "+
+			"pass --discard-state to do so", statePath, reason, detail)
+	}
+	slog.Warn("Not resuming the existing backup state, starting fresh", "reason", reason, "detail", detail, "state", statePath)
+	return &manifest.State{Version: manifest.StateVersion}, reason, nil
+}
+
+// invalidateState marks the backup state at statePath as not resumable for reason, so that the
+// next run reports it rather than resuming against a snapshot that is gone.
+func invalidateState(statePath string, state *manifest.State, reason string) {
+	state.Invalid = reason
+	state.LastUpdated = time.Now().Unix()
+	if err := manifest.WriteState(statePath, state); err != nil {
+		slog.Warn("Failed to mark the backup state invalid", "state", statePath, "error", err)
+		return
+	}
+	slog.Warn("Marked the backup state invalid", "state", statePath, "reason", reason)
+}
+
+// checkVanished tells a dataset or target snapshot destroyed or renamed during the run from other
+// failures that match zfs.ErrNotFound, and then marks the backup state invalid. A pool that is gone
+// as a whole was more likely exported than destroyed, so the state is kept to resume once it is
+// imported again.
+func checkVanished(err error, task *config.Task, snapshot string, state *manifest.State, statePath string) error {
+	if zfs.CheckPoolExists(task.Pool) != nil {
+		return err
+	}
+	var gone string
+	dataset := zfs.DatasetPath(task.Pool, task.Dataset)
+	if found, checkErr := zfs.DatasetExists(dataset); checkErr == nil && !found {
+		gone = "dataset " + dataset
+	} else if snapshot != "" {
+		if found, checkErr := zfs.SnapshotExists(snapshot); checkErr == nil && !found {
+			gone = "snapshot " + snapshot
+		}
+	}
+	if gone == "" {
+		return err
+	}
+
+	reason := gone + " was destroyed or renamed during the backup"
+	// A state only exists on disk once the send has finished
+	if state.TaskName != "" {
+		invalidateState(statePath, state, reason)
+	}
+	return fmt.Errorf("%s: %w", reason, err)
+}
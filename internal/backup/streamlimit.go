@@ -0,0 +1,63 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"zrb/internal/config"
+	"zrb/internal/events"
+	"zrb/internal/zfs"
+)
+
+// minStreamLimit is the lowest limit a max_stream_size multiple sets, since a multiple of the
+// tiny estimate of a quiet incremental would stop sends that only carry a few more headers.
+// Replaced in tests.
+var minStreamLimit int64 = 64 << 20
+
+// streamLimit returns how many bytes the send of targetSnapshot may produce under the task's
+// max_stream_size, 0 for no limit, and the estimate a multiple was applied to. Without an
+// estimate a multiple only warns, like the staging space check.
+func streamLimit(ctx context.Context, task *config.Task, targetSnapshot, parentSnapshot string) (limit, estimated int64) {
+	switch {
+	case task.MaxStreamSize.IsZero():
+		return 0, 0
+	case task.MaxStreamSize.Factor == 0:
+		return task.MaxStreamSize.Bytes, 0
+	}
+
+	estimated, err := zfs.EstimateSendSize(ctx, targetSnapshot, parentSnapshot)
+	if err != nil {
+		slog.Warn("Cannot estimate the stream size, sending without max_stream_size", "maxStreamSize", task.MaxStreamSize, "error", err)
+		return 0, 0
+	}
+	limit = max(task.MaxStreamSize.Of(estimated), minStreamLimit)
+	slog.Info("Stream size limited", "maxStreamSize", task.MaxStreamSize, "estimatedBytes", estimated, "limitBytes", limit)
+	return limit, estimated
+}
+
+// streamLimitExceeded reports a send that err tells was stopped at the stream limit and removes
+// what it left in outputDir, which no state refers to yet. Other errors are returned as they are.
+func streamLimitExceeded(ctx context.Context, err error, task *config.Task, estimated int64, targetSnapshot, outputDir string) error {
+	var limitErr *zfs.StreamLimitError
+	if !errors.As(err, &limitErr) {
+		return err
+	}
+
+	if rmErr := os.RemoveAll(outputDir); rmErr != nil {
+		slog.Warn("Failed to remove the partial parts", "path", outputDir, "error", rmErr)
+	} else {
+		slog.Info("Removed the partial parts", "path", outputDir)
+	}
+
+	reason := fmt.Sprintf("max_stream_size %s", task.MaxStreamSize)
+	if estimated > 0 {
+		reason += fmt.Sprintf(" of the %d byte estimate", estimated)
+	}
+	events.Emit(ctx, events.Event{Stage: events.StreamLimitExceeded, Snapshot: targetSnapshot,
+		Bytes: limitErr.Produced, Limit: limitErr.Limit, Error: reason})
+	slog.Error("Backup stopped, the send stream outgrew max_stream_size", "snapshot", targetSnapshot,
+		"limitBytes", limitErr.Limit, "producedBytes", limitErr.Produced, "estimatedBytes", estimated, "maxStreamSize", task.MaxStreamSize)
+	return fmt.Errorf("%w (%s); the snapshot may hold unexpected data, the partial parts were removed", err, reason)
+}
@@ -0,0 +1,56 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"zrb/internal/config"
+)
+
+// RunTasks backs up the tasks the --task selectors pick, one after the other, with opts.TaskName
+// set to each. A selector naming exactly one task behaves like Run. When several tasks are
+// selected, disabled ones are skipped and a failed task does not stop the ones after it; the
+// failures are returned together. An interrupt stops before the next task.
+func RunTasks(ctx context.Context, opts Options, selectors []string) error {
+	cfg, err := config.Load(opts.ConfigPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	names, err := cfg.SelectTasks(selectors)
+	if err != nil {
+		return err
+	}
+	if len(names) == 1 {
+		opts.TaskName = names[0]
+		return Run(ctx, opts)
+	}
+
+	var errs []error
+	attempted := 0
+	for i, name := range names {
+		task, err := cfg.FindTask(name)
+		if err != nil {
+			return err
+		}
+		if !task.Enabled {
+			slog.Warn("Skipping disabled task", "task", name)
+			continue
+		}
+		if ctx.Err() != nil {
+			return errors.Join(append(errs, fmt.Errorf("backup cancelled before task %s: %w", name, ctx.Err()))...)
+		}
+
+		slog.Info("Backing up selected task", "task", name, "index", i+1, "selected", len(names))
+		opts.TaskName = name
+		attempted++
+		if err := Run(ctx, opts); err != nil {
+			slog.Error("Task backup failed", "task", name, "error", err)
+			errs = append(errs, fmt.Errorf("task %s: %w", name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d of %d task backup(s) failed: %w", len(errs), attempted, errors.Join(errs...))
+	}
+	return nil
+}
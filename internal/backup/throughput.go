@@ -0,0 +1,150 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+	"zrb/internal/remote"
+	"zrb/internal/throughput"
+	"zrb/internal/zfs"
+)
+
+// Replaced by tests.
+var (
+	// progressLogInterval is how often a backup whose stderr is not a terminal logs its progress.
+	progressLogInterval = 30 * time.Second
+	// progressInterval is how often the progress line on a terminal is redrawn.
+	progressInterval = time.Second
+	stderrIsTerminal = func() bool {
+		info, err := os.Stderr.Stat()
+		return err == nil && info.Mode()&os.ModeCharDevice != 0
+	}
+)
+
+// progressBarWidth is the number of cells of the progress bar.
+const progressBarWidth = 20
+
+// backupMeters count the bytes zfs send streams and the bytes uploaded, from the start of the run.
+type backupMeters struct {
+	send, upload *throughput.Meter
+	start        time.Time
+	// total is the size of the stream, once known and if parts are uploaded, and resumed what
+	// earlier runs uploaded of it.
+	total, resumed atomic.Int64
+}
+
+func newBackupMeters(start time.Time) *backupMeters {
+	return &backupMeters{send: &throughput.Meter{}, upload: &throughput.Meter{}, start: start}
+}
+
+// withMeters returns a context whose zfs sends and uploads are counted by m.
+func withMeters(ctx context.Context, m *backupMeters) context.Context {
+	return remote.WithMeter(zfs.WithSendMeter(ctx, m.send), m.upload)
+}
+
+// expect sets the bytes to upload, which the progress then shows a percentage of, and how many of
+// them earlier runs uploaded.
+func (m *backupMeters) expect(total, resumed int64) {
+	m.total.Store(total)
+	m.resumed.Store(resumed)
+}
+
+// uploaded returns the bytes uploaded by this run and the earlier ones, and their percentage of
+// the total, -1 when it is unknown.
+func (m *backupMeters) uploaded() (int64, int) {
+	done, total := m.resumed.Load()+m.upload.Bytes(), m.total.Load()
+	if total <= 0 {
+		return done, -1
+	}
+	// The encrypted parts are a little larger than the stream.
+	return done, int(min(100, done*100/total))
+}
+
+// line describes the progress at at: the send until parts upload, then the upload.
+func (m *backupMeters) line(at time.Time) string {
+	elapsed := at.Sub(m.start).Round(time.Second)
+	done, percent := m.uploaded()
+	switch {
+	case percent >= 0:
+		return fmt.Sprintf("%d%% uploaded, %s of %s at %s, elapsed %s", percent, throughput.FormatBytes(done),
+			throughput.FormatBytes(m.total.Load()), throughput.FormatRate(m.upload.Rolling(at)), elapsed)
+	case done > 0:
+		return fmt.Sprintf("uploaded %s at %s, elapsed %s", throughput.FormatBytes(done), throughput.FormatRate(m.upload.Rolling(at)), elapsed)
+	}
+	return fmt.Sprintf("sent %s at %s, elapsed %s", throughput.FormatBytes(m.send.Bytes()), throughput.FormatRate(m.send.Rolling(at)), elapsed)
+}
+
+// bar draws percent, or nothing while it is unknown.
+func bar(percent int) string {
+	if percent < 0 {
+		return ""
+	}
+	filled := percent * progressBarWidth / 100
+	return "[" + strings.Repeat("#", filled) + strings.Repeat("-", progressBarWidth-filled) + "] "
+}
+
+// report redraws a line of progress with a bar on progress every progressInterval, or without
+// progress logs it every progressLogInterval, until stop is called.
+func (m *backupMeters) report(progress io.Writer) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	interval := progressLogInterval
+	if progress != nil {
+		interval = progressInterval
+	}
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				if progress != nil {
+					fmt.Fprint(progress, "\r\033[K")
+				}
+				return
+			case at := <-ticker.C:
+				uploaded, percent := m.uploaded()
+				if progress != nil {
+					fmt.Fprintf(progress, "\r\033[K%s%s", bar(percent), m.line(at))
+					continue
+				}
+				slog.Info("Backup progress",
+					"sent", m.send.Bytes(), "send", throughput.FormatRate(m.send.Rolling(at)),
+					"uploaded", uploaded, "upload", throughput.FormatRate(m.upload.Rolling(at)),
+					"uploadedPercent", percent, "elapsed", at.Sub(m.start).Round(time.Second).String())
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// resuming tells how much of the stream earlier runs uploaded, on progress unless it is nil.
+func resuming(progress io.Writer, uploaded, streamBytes int64) {
+	if uploaded <= 0 || streamBytes <= 0 {
+		return
+	}
+	percent := min(100, uploaded*100/streamBytes)
+	slog.Info("Resuming backup", "uploadedBytes", uploaded, "streamBytes", streamBytes, "uploadedPercent", percent)
+	if progress != nil {
+		fmt.Fprintf(progress, "Resuming at %d%% uploaded (%s of %s)\n", percent, throughput.FormatBytes(uploaded), throughput.FormatBytes(streamBytes))
+	}
+}
+
+// logSummary logs the bytes sent and uploaded, their rates over the time spent sending and
+// processing parts, and the time the whole run took.
+func (m *backupMeters) logSummary(at time.Time) {
+	send, upload := m.send.Summary(), m.upload.Summary()
+	slog.Info("Backup throughput summary",
+		"sent", send.Bytes, "send", throughput.FormatRate(send.BytesPerSecond), "sendSeconds", send.Seconds,
+		"uploaded", upload.Bytes, "upload", throughput.FormatRate(upload.BytesPerSecond), "uploadSeconds", upload.Seconds,
+		"elapsed", at.Sub(m.start).Round(time.Second).String())
+}
@@ -0,0 +1,79 @@
+package backup
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// syncBuffer is a bytes.Buffer safe for the reporting goroutine and the test.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestMetersLine(t *testing.T) {
+	start := time.Unix(1000, 0)
+	m := newBackupMeters(start)
+	m.send.Add(3 << 20)
+	assert.Equal(t, "sent 3.0 MiB at 0 B/s, elapsed 1m0s", m.line(start.Add(time.Minute)), "the send until parts upload")
+
+	m.upload.Add(1 << 20)
+	assert.Contains(t, m.line(start.Add(time.Minute)), "uploaded 1.0 MiB", "the upload without a known total")
+
+	m.expect(10<<20, 3<<20)
+	assert.Contains(t, m.line(start.Add(time.Minute)), "40% uploaded, 4.0 MiB of 10.0 MiB", "the earlier runs count towards the percentage")
+
+	m.upload.Add(7 << 20)
+	_, percent := m.uploaded()
+	assert.Equal(t, 100, percent, "the encrypted parts larger than the stream do not go past 100%")
+}
+
+func TestBar(t *testing.T) {
+	assert.Equal(t, "", bar(-1))
+	assert.Equal(t, "[##########----------] ", bar(50))
+	assert.Equal(t, "[####################] ", bar(100))
+}
+
+func TestReportProgress(t *testing.T) {
+	defer func(d time.Duration) { progressInterval = d }(progressInterval)
+	progressInterval = 5 * time.Millisecond
+
+	m := newBackupMeters(time.Now())
+	m.expect(4<<20, 0)
+	m.upload.Add(1 << 20)
+	var out syncBuffer
+	stop := m.report(&out)
+	assert.Eventually(t, func() bool { return strings.Contains(out.String(), "uploaded") }, time.Second, time.Millisecond)
+	stop()
+
+	line := out.String()
+	assert.Contains(t, line, "[#####---------------] 25% uploaded, 1.0 MiB of 4.0 MiB")
+	assert.True(t, strings.HasSuffix(line, "\r\033[K"), "stop clears the line")
+}
+
+func TestResuming(t *testing.T) {
+	var out bytes.Buffer
+	resuming(&out, 42<<20, 100<<20)
+	assert.Equal(t, "Resuming at 42% uploaded (42.0 MiB of 100.0 MiB)\n", out.String())
+
+	out.Reset()
+	resuming(&out, 0, 100<<20)
+	assert.Empty(t, out.String(), "nothing to say for a fresh backup")
+}
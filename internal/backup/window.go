@@ -0,0 +1,82 @@
+package backup
+
+import (
+	"time"
+	"zrb/internal/config"
+)
+
+// uploadWindow is the parsed upload_window of a task. start and end are wall-clock times of day in
+// loc, so the window keeps its hours across DST changes.
+type uploadWindow struct {
+	start, end time.Duration
+	loc        *time.Location
+}
+
+// newUploadWindow parses w, returning nil when the task has no window.
+func newUploadWindow(w *config.UploadWindow) (*uploadWindow, error) {
+	if w == nil {
+		return nil, nil
+	}
+	start, end, loc, err := w.Bounds()
+	if err != nil {
+		return nil, err
+	}
+	return &uploadWindow{start: start, end: end, loc: loc}, nil
+}
+
+// state reports whether now lies in the window, and until when that holds: the end of the window
+// while it is open and the next start otherwise. A window whose end is before its start spans
+// midnight. A start or end skipped by a DST change passes at the first instant after the gap, and
+// one repeated by a DST change at its first occurrence, so a window across the change is an hour
+// shorter or longer.
+func (w *uploadWindow) state(now time.Time) (open bool, until time.Time) {
+	y, mo, d := now.In(w.loc).Date()
+	// The window open at now, if any, started today or, spanning midnight, yesterday.
+	for day := d - 1; day <= d; day++ {
+		start, end := w.bounds(y, mo, day)
+		if !now.Before(start) && now.Before(end) {
+			return true, end
+		}
+	}
+	for day := d; ; day++ {
+		if start, _ := w.bounds(y, mo, day); start.After(now) {
+			return false, start
+		}
+	}
+}
+
+// bounds returns the start and end of the window opening on the given day.
+func (w *uploadWindow) bounds(y int, mo time.Month, d int) (start, end time.Time) {
+	start = w.at(y, mo, d, w.start)
+	if w.end < w.start {
+		d++
+	}
+	return start, w.at(y, mo, d, w.end)
+}
+
+// at returns when the wall clock of loc first reads clock on the given day, or the end of the DST
+// gap that skips it.
+func (w *uploadWindow) at(y int, mo time.Month, d int, clock time.Duration) time.Time {
+	hour, minute := int(clock/time.Hour), int(clock%time.Hour/time.Minute)
+	t := time.Date(y, mo, d, hour, minute, 0, 0, w.loc)
+	zoneStart, zoneEnd := t.ZoneBounds()
+	_, offset := t.Zone()
+	if t.Hour() != hour || t.Minute() != minute {
+		// time.Date resolves a skipped time with the offset of either side of the gap, landing
+		// after the gap or before it.
+		wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+		if wall.After(time.Date(y, mo, d, hour, minute, 0, 0, time.UTC)) {
+			return zoneStart
+		}
+		return zoneEnd
+	}
+	// A repeated time may resolve to its second occurrence, right after the clocks went back.
+	if !zoneStart.IsZero() {
+		if _, before := zoneStart.Add(-time.Nanosecond).Zone(); before > offset {
+			if first := t.Add(-time.Duration(before-offset) * time.Second); first.Before(zoneStart) {
+				return first
+			}
+		}
+	}
+	return t
+}
@@ -0,0 +1,131 @@
+// Package browse implements zrb browse: restoring a backup into a temporary dataset and mounting
+// it read-only until the user is done looking through it.
+package browse
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+	"zrb/internal/config"
+	"zrb/internal/manifest"
+	"zrb/internal/restore"
+	"zrb/internal/zfs"
+)
+
+type Options struct {
+	ConfigPath string
+	// Standalone replaces the config file when browsing on a bare machine.
+	Standalone     config.Standalone
+	TaskName       string
+	Level          int16
+	Target         string
+	PrivateKeyPath string
+	Source         string
+	// Mountpoint overrides base_dir/browse/<task>.
+	Mountpoint string
+	// Timeout destroys the dataset after this long; zero waits for Ctrl-C.
+	Timeout time.Duration
+}
+
+// restoreLevel receives one level into the target; tests replace it.
+var restoreLevel = restore.Run
+
+// Run restores the levels level needs into opts.Target, which must not exist, mounts it read-only
+// and waits for ctx to end or the timeout to pass. The target is destroyed on the way out, also
+// when the restore fails or is interrupted.
+func Run(ctx context.Context, opts Options) (err error) {
+	cfg, task, err := config.Resolve(opts.ConfigPath, opts.TaskName, opts.Standalone)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(opts.Target, "/") {
+		return fmt.Errorf("target must be in format pool/dataset, got: %s", opts.Target)
+	}
+	exists, err := zfs.DatasetExists(opts.Target)
+	if err != nil {
+		return fmt.Errorf("failed to check target dataset: %w", err)
+	}
+	if exists {
+		return fmt.Errorf("target %s already exists; browse restores into a new dataset and destroys it afterwards, pick another --target", opts.Target)
+	}
+
+	mountpoint := opts.Mountpoint
+	if mountpoint == "" {
+		mountpoint = filepath.Join(cfg.BaseDir, "browse", task.Name)
+	}
+
+	defer func() {
+		if cleanupErr := destroy(opts.Target); cleanupErr != nil {
+			slog.Error("Failed to destroy browse dataset", "target", opts.Target, "error", cleanupErr)
+			if err == nil {
+				err = cleanupErr
+			}
+		}
+	}()
+
+	levels := manifest.RestoreChain(task.Mode(), opts.Level)
+	slog.Info("Restoring backup for browsing", "task", task.Name, "levels", levels, "target", opts.Target)
+	for _, level := range levels {
+		if err := restoreLevel(ctx, restore.Options{
+			ConfigPath:     opts.ConfigPath,
+			Standalone:     opts.Standalone,
+			TaskName:       opts.TaskName,
+			Level:          level,
+			Target:         opts.Target,
+			PrivateKeyPath: opts.PrivateKeyPath,
+			Source:         opts.Source,
+		}); err != nil {
+			return fmt.Errorf("failed to restore level %d: %w", level, err)
+		}
+	}
+
+	if err := zfs.SetProperty(opts.Target, "readonly", "on"); err != nil {
+		return err
+	}
+	if err := zfs.SetProperty(opts.Target, "mountpoint", mountpoint); err != nil {
+		return err
+	}
+	if err := zfs.Mount(opts.Target); err != nil {
+		return err
+	}
+
+	fmt.Printf("Level %d of %s is mounted read-only at %s\n", opts.Level, task.Name, mountpoint)
+	if opts.Timeout > 0 {
+		fmt.Printf("It is destroyed in %s, or on Ctrl-C\n", opts.Timeout)
+	} else {
+		fmt.Println("Press Ctrl-C to unmount and destroy it")
+	}
+
+	var expired <-chan time.Time
+	if opts.Timeout > 0 {
+		timer := time.NewTimer(opts.Timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-ctx.Done():
+		slog.Info("Browse interrupted, destroying dataset", "target", opts.Target)
+	case <-expired:
+		slog.Info("Browse timeout reached, destroying dataset", "target", opts.Target)
+	}
+	return nil
+}
+
+// destroy removes what the browse left of target, if anything.
+func destroy(target string) error {
+	exists, err := zfs.DatasetExists(target)
+	if err != nil {
+		return fmt.Errorf("failed to check browse dataset: %w", err)
+	}
+	if !exists {
+		return nil
+	}
+	if err := zfs.DestroyRecursive(target); err != nil {
+		return fmt.Errorf("%w; leave the mountpoint and run zfs destroy -r %s", err, target)
+	}
+	slog.Info("Browse dataset destroyed", "target", target)
+	return nil
+}
@@ -0,0 +1,125 @@
+package browse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"zrb/internal/restore"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeZFS puts a zfs script first in PATH that logs its arguments to the returned file. The
+// dataset exists while the file named by the returned marker exists.
+func fakeZFS(t *testing.T) (log, marker string) {
+	t.Helper()
+	bin := t.TempDir()
+	log = filepath.Join(bin, "log")
+	marker = filepath.Join(bin, "exists")
+	script := fmt.Sprintf(`#!/bin/sh
+echo "$*" >> %[1]q
+case "$1" in
+list) [ -f %[2]q ] || { echo "dataset does not exist" >&2; exit 1; } ;;
+get) echo no ;;
+destroy) rm %[2]q ;;
+esac
+`, log, marker)
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "zfs"), []byte(script), 0o755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return log, marker
+}
+
+func writeConfig(t *testing.T, mode string) (configPath, base string) {
+	t.Helper()
+	dir := t.TempDir()
+	base = filepath.Join(dir, "base")
+	configPath = filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+tasks:
+  - name: t
+    pool: tank
+    dataset: data
+    enabled: true
+    incremental_mode: %s
+`, base, mode)), 0o644))
+	return configPath, base
+}
+
+func stubRestore(t *testing.T, marker string, fail int16) *[]int16 {
+	t.Helper()
+	var levels []int16
+	orig := restoreLevel
+	restoreLevel = func(ctx context.Context, opts restore.Options) error {
+		levels = append(levels, opts.Level)
+		if opts.Level == fail {
+			return errors.New("receive failed")
+		}
+		return os.WriteFile(marker, nil, 0o644)
+	}
+	t.Cleanup(func() { restoreLevel = orig })
+	return &levels
+}
+
+func TestRun(t *testing.T) {
+	log, marker := fakeZFS(t)
+	configPath, base := writeConfig(t, "chain")
+	levels := stubRestore(t, marker, -1)
+
+	err := Run(context.Background(), Options{ConfigPath: configPath, TaskName: "t", Level: 2, Target: "tank/browse", Timeout: 10 * time.Millisecond})
+	require.NoError(t, err)
+	assert.Equal(t, []int16{0, 1, 2}, *levels)
+	assert.NoFileExists(t, marker, "the dataset is destroyed after the timeout")
+
+	calls, err := os.ReadFile(log)
+	require.NoError(t, err)
+	assert.Contains(t, string(calls), "set readonly=on tank/browse\n")
+	assert.Contains(t, string(calls), "set mountpoint="+filepath.Join(base, "browse", "t")+" tank/browse\n")
+	assert.Contains(t, string(calls), "mount tank/browse\n")
+	assert.True(t, strings.HasSuffix(string(calls), "destroy -r tank/browse\n"))
+}
+
+func TestRunInterrupted(t *testing.T) {
+	_, marker := fakeZFS(t)
+	configPath, _ := writeConfig(t, "differential")
+	levels := stubRestore(t, marker, -1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	err := Run(ctx, Options{ConfigPath: configPath, TaskName: "t", Level: 2, Target: "tank/browse", Mountpoint: "/mnt/look"})
+	require.NoError(t, err)
+	assert.Equal(t, []int16{0, 2}, *levels)
+	assert.NoFileExists(t, marker)
+}
+
+func TestRunDestroysAfterFailedRestore(t *testing.T) {
+	_, marker := fakeZFS(t)
+	configPath, _ := writeConfig(t, "chain")
+	stubRestore(t, marker, 1)
+
+	err := Run(context.Background(), Options{ConfigPath: configPath, TaskName: "t", Level: 2, Target: "tank/browse"})
+	require.EqualError(t, err, "failed to restore level 1: receive failed")
+	assert.NoFileExists(t, marker, "level 0 was received and must not be left behind")
+}
+
+func TestRunRefusesExistingTarget(t *testing.T) {
+	log, marker := fakeZFS(t)
+	configPath, _ := writeConfig(t, "chain")
+	levels := stubRestore(t, marker, -1)
+	require.NoError(t, os.WriteFile(marker, nil, 0o644))
+
+	err := Run(context.Background(), Options{ConfigPath: configPath, TaskName: "t", Level: 0, Target: "tank/data"})
+	require.ErrorContains(t, err, "target tank/data already exists")
+	assert.Empty(t, *levels)
+	assert.FileExists(t, marker, "an existing dataset is never destroyed")
+
+	calls, err := os.ReadFile(log)
+	require.NoError(t, err)
+	assert.NotContains(t, string(calls), "destroy")
+}
@@ -3,8 +3,13 @@ package check
 import (
 	"context"
 	"fmt"
+	"os"
+	"path/filepath"
 	"zrb/internal/config"
+	"zrb/internal/crypto"
+	"zrb/internal/manifest"
 	"zrb/internal/remote"
+	"zrb/internal/util"
 	"zrb/internal/zfs"
 )
 
@@ -15,28 +20,42 @@ func Run(ctx context.Context, configPath string) error {
 	}
 	fmt.Println("config: OK")
 
+	if _, err := crypto.ParseRecipients(cfg.Recipients()); err != nil {
+		return fmt.Errorf("age recipients: %w", err)
+	}
+	fmt.Printf("age recipients (%d): OK\n", len(cfg.Recipients()))
+
 	for _, task := range cfg.Tasks {
 		if !task.Enabled {
 			fmt.Printf("task %s: skipped (disabled)\n", task.Name)
 			continue
 		}
 		if err := zfs.CheckDatasetExists(task.Pool, task.Dataset); err != nil {
-			return fmt.Errorf("task %s: %w", task.Name, err)
+			return fmt.Errorf("task %s: %w", task.Name, zfs.ExplainLocal(err, task.Pool+"/"+task.Dataset, zfs.BackupPermissions))
 		}
 		fmt.Printf("task %s dataset %s/%s: OK\n", task.Name, task.Pool, task.Dataset)
+
+		lastPath := filepath.Join(util.RunDir(cfg.BaseDir, task.Pool, task.Dataset), "last_backup_manifest.yaml")
+		if last, err := manifest.ReadLast(lastPath); err == nil {
+			if err := last.CheckMode(task.Mode()); err != nil {
+				return fmt.Errorf("task %s: %w", task.Name, err)
+			}
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("task %s: failed to read last backup manifest: %w", task.Name, err)
+		}
+		fmt.Printf("task %s incremental mode %s: OK\n", task.Name, task.Mode())
 	}
 
-	if cfg.S3.Enabled {
-		backend, err := remote.NewS3(ctx, cfg.S3.Bucket, cfg.S3.Region,
-			cfg.S3.Prefix, cfg.S3.Endpoint,
-			cfg.S3.StorageClass.Manifest, cfg.S3RetryAttempts())
+	if cfg.RemoteEnabled() {
+		opts := remote.OptionsFromConfig(cfg, cfg.ManifestStorageClass())
+		backend, err := remote.DefaultCache.Get(ctx, opts)
 		if err != nil {
-			return fmt.Errorf("S3 init: %w", err)
+			return fmt.Errorf("%s init: %w", opts.Backend, err)
 		}
 		if err := backend.VerifyCredentials(ctx); err != nil {
-			return fmt.Errorf("S3 credentials: %w", err)
+			return fmt.Errorf("%s credentials: %w", opts.Backend, err)
 		}
-		fmt.Printf("S3 bucket %s: OK\n", cfg.S3.Bucket)
+		fmt.Printf("%s bucket %s: OK\n", opts.Backend, opts.Bucket)
 	}
 
 	fmt.Println("all checks passed")
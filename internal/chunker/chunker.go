@@ -0,0 +1,120 @@
+// Package chunker splits a stream into content-defined chunks with FastCDC, so that data shifted
+// by an insertion upstream still yields mostly the same chunks.
+package chunker
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// gear holds the random values the rolling hash adds per byte. It is derived from a fixed seed:
+// changing it moves every chunk boundary, which breaks deduplication against earlier backups
+// (though not their restores).
+var gear = func() (table [256]uint64) {
+	state := uint64(0x7a72622d63646321) // "zrb-cdc!"
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// Chunker cuts what is written to it into chunks of MinSize to MaxSize bytes, averaging about
+// AvgSize, and passes them in order to the emit function given to New.
+type Chunker struct {
+	MinSize, AvgSize, MaxSize int
+
+	// Boundaries are harder to hit below AvgSize and easier above it, FastCDC's normalized
+	// chunking, which narrows the spread of chunk sizes.
+	maskSmall, maskLarge uint64
+	emit                 func(chunk []byte) error
+	buf                  []byte
+}
+
+// New returns a Chunker for chunks averaging avgSize bytes, a power of two of at least 64 bytes.
+// The slice passed to emit is only valid until it returns.
+func New(avgSize int, emit func(chunk []byte) error) (*Chunker, error) {
+	if avgSize < 64 || avgSize&(avgSize-1) != 0 {
+		return nil, fmt.Errorf("average chunk size %d is not a power of two of at least 64", avgSize)
+	}
+	n := bits.TrailingZeros(uint(avgSize))
+	return &Chunker{
+		MinSize:   avgSize / 4,
+		AvgSize:   avgSize,
+		MaxSize:   avgSize * 8,
+		maskSmall: topBits(n + 2),
+		maskLarge: topBits(n - 2),
+		emit:      emit,
+		buf:       make([]byte, 0, avgSize*16),
+	}, nil
+}
+
+// topBits returns a mask of the n most significant bits, the ones that depend on the most input
+// bytes of the gear hash.
+func topBits(n int) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+// Write buffers p and emits every chunk whose end no longer depends on data still to come.
+func (c *Chunker) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		room := cap(c.buf) - len(c.buf)
+		take := min(room, len(p))
+		c.buf = append(c.buf, p[:take]...)
+		p = p[take:]
+		if err := c.flush(c.MaxSize); err != nil {
+			return written - len(p), err
+		}
+	}
+	return written, nil
+}
+
+// Close emits the remaining data as the last chunks.
+func (c *Chunker) Close() error {
+	return c.flush(1)
+}
+
+// flush emits chunks while at least keep bytes are buffered.
+func (c *Chunker) flush(keep int) error {
+	start := 0
+	for len(c.buf)-start >= keep && start < len(c.buf) {
+		n := c.cut(c.buf[start:])
+		if err := c.emit(c.buf[start : start+n]); err != nil {
+			return err
+		}
+		start += n
+	}
+	c.buf = c.buf[:copy(c.buf, c.buf[start:])]
+	return nil
+}
+
+// cut returns the length of the chunk at the start of data.
+func (c *Chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.MinSize {
+		return n
+	}
+	n = min(n, c.MaxSize)
+	normal := min(n, c.AvgSize)
+
+	var hash uint64
+	i := c.MinSize
+	for ; i < normal; i++ {
+		hash = hash<<1 + gear[data[i]]
+		if hash&c.maskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		hash = hash<<1 + gear[data[i]]
+		if hash&c.maskLarge == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
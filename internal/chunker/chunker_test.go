@@ -0,0 +1,89 @@
+package chunker
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// chunks writes data to a Chunker in writes of writeSize bytes and returns the chunks.
+func chunks(t *testing.T, data []byte, writeSize int) [][]byte {
+	t.Helper()
+	var out [][]byte
+	c, err := New(1024, func(chunk []byte) error {
+		out = append(out, bytes.Clone(chunk))
+		return nil
+	})
+	require.NoError(t, err)
+	for len(data) > 0 {
+		n := min(writeSize, len(data))
+		_, err := c.Write(data[:n])
+		require.NoError(t, err)
+		data = data[n:]
+	}
+	require.NoError(t, c.Close())
+	return out
+}
+
+func random(seed uint64, n int) []byte {
+	r := rand.New(rand.NewPCG(seed, seed))
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(r.Uint32())
+	}
+	return data
+}
+
+func TestNew(t *testing.T) {
+	for _, size := range []int{0, 32, 1000} {
+		_, err := New(size, nil)
+		assert.Error(t, err, "size %d", size)
+	}
+	c, err := New(4<<20, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1<<20, c.MinSize)
+	assert.Equal(t, 32<<20, c.MaxSize)
+}
+
+func TestChunks(t *testing.T) {
+	data := random(1, 1<<20)
+	got := chunks(t, data, 4096)
+
+	assert.Equal(t, data, bytes.Join(got, nil), "the chunks reassemble the stream")
+	for i, chunk := range got {
+		assert.LessOrEqual(t, len(chunk), 8192)
+		if i < len(got)-1 {
+			assert.Greater(t, len(chunk), 256)
+		}
+	}
+	avg := len(data) / len(got)
+	assert.InDelta(t, 1024, avg, 512, "chunks average about the configured size")
+
+	assert.Equal(t, got, chunks(t, data, 1), "boundaries do not depend on how the stream is written")
+	assert.Equal(t, got, chunks(t, data, 1<<20))
+}
+
+func TestChunksSurviveInsertion(t *testing.T) {
+	data := random(2, 512<<10)
+	shifted := append(append(bytes.Clone(data[:1000]), []byte("inserted")...), data[1000:]...)
+
+	before := map[string]bool{}
+	for _, chunk := range chunks(t, data, 4096) {
+		before[string(chunk)] = true
+	}
+	after := chunks(t, shifted, 4096)
+	shared := 0
+	for _, chunk := range after {
+		if before[string(chunk)] {
+			shared++
+		}
+	}
+	assert.GreaterOrEqual(t, shared, len(after)-8, "only the chunks around the insertion change")
+}
+
+func TestEmptyStream(t *testing.T) {
+	assert.Empty(t, chunks(t, nil, 1))
+}
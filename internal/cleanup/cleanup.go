@@ -0,0 +1,408 @@
+package cleanup
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"zrb/internal/config"
+	"zrb/internal/lock"
+	"zrb/internal/manifest"
+	"zrb/internal/util"
+)
+
+// Options of zrb cleanup. Without PurgeTask it cleans up after every task of the config.
+type Options struct {
+	ConfigPath string
+	// PurgeTask removes the local state of a task that is no longer in the config. Its dataset is
+	// given by Pool and Dataset, as the config cannot tell any more.
+	PurgeTask string
+	Pool      string
+	Dataset   string
+	// LogRetentionDays keeps the daily logs of that many days; 0 keeps all of them.
+	LogRetentionDays int
+	// Delete removes what is listed, after confirmation unless Yes is set; otherwise nothing is
+	// changed.
+	Delete bool
+	Yes    bool
+}
+
+// Item is a file or directory cleanup removes.
+type Item struct {
+	Path   string
+	Reason string
+}
+
+// target is the dataset of one task whose local files are cleaned up.
+type target struct {
+	task          string
+	pool, dataset string
+	// taskRoot is where the dated task directories are staged, below base_dir or staging_dir.
+	taskRoot string
+	// purge removes the run state and every dated task directory, not just the orphaned ones.
+	purge bool
+}
+
+var (
+	logFilePattern = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}\.log$`)
+	levelPattern   = regexp.MustCompile(`^level\d+$`)
+	datePattern    = regexp.MustCompile(`^\d{8}$`)
+)
+
+// Replaced by tests.
+var (
+	promptInput     io.Reader = os.Stdin
+	output          io.Writer = os.Stdout
+	stdinIsTerminal           = func() bool {
+		info, err := os.Stdin.Stat()
+		return err == nil && info.Mode()&os.ModeCharDevice != 0
+	}
+)
+
+func Run(opts Options) error {
+	cfg, err := config.Load(opts.ConfigPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	targets, err := selectTargets(cfg, opts)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var items []Item
+	var ready []target
+	for _, t := range targets {
+		if err := checkLock(cfg.BaseDir, t); err != nil {
+			if t.purge {
+				return err
+			}
+			slog.Warn("Skipping task while its backup is running", "task", t.task, "error", err)
+			continue
+		}
+		planned, err := plan(cfg, t, opts.LogRetentionDays, now)
+		if err != nil {
+			return err
+		}
+		items = append(items, planned...)
+		ready = append(ready, t)
+	}
+
+	if len(items) == 0 {
+		fmt.Fprintln(output, "Nothing to clean up.")
+		return nil
+	}
+	fmt.Fprintln(output, "Local files to remove:")
+	for _, item := range items {
+		fmt.Fprintf(output, "  %s (%s)\n", item.Path, item.Reason)
+	}
+	if !opts.Delete {
+		fmt.Fprintln(output, "Dry run, nothing was removed; run again with --delete to remove them.")
+		return nil
+	}
+	if !opts.Yes {
+		if err := confirm(len(items)); err != nil {
+			return err
+		}
+	}
+
+	removed := 0
+	for _, t := range ready {
+		n, err := clean(cfg, t, opts.LogRetentionDays, now)
+		removed += n
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(output, "Removed %d item(s).\n", removed)
+	return nil
+}
+
+// selectTargets returns the task to purge, or every configured task.
+func selectTargets(cfg *config.Config, opts Options) ([]target, error) {
+	if opts.PurgeTask == "" {
+		if opts.Pool != "" || opts.Dataset != "" {
+			return nil, fmt.Errorf("--pool and --dataset are only used with --purge-task")
+		}
+		targets := make([]target, 0, len(cfg.Tasks))
+		for _, task := range cfg.Tasks {
+			targets = append(targets, target{task: task.Name, pool: task.Pool, dataset: task.Dataset, taskRoot: cfg.TaskRoot(&task)})
+		}
+		return targets, nil
+	}
+
+	if _, err := cfg.FindTask(opts.PurgeTask); err == nil {
+		return nil, fmt.Errorf("task %s is still in the config; remove it from the config before purging it", opts.PurgeTask)
+	}
+	if opts.Pool == "" || opts.Dataset == "" {
+		return nil, fmt.Errorf("--purge-task needs --pool and --dataset of the removed task")
+	}
+	if !filepath.IsLocal(opts.Pool) || !filepath.IsLocal(opts.Dataset) {
+		return nil, fmt.Errorf("invalid pool or dataset name: %s/%s", opts.Pool, opts.Dataset)
+	}
+	for _, task := range cfg.Tasks {
+		if task.Pool == opts.Pool && task.Dataset == opts.Dataset {
+			return nil, fmt.Errorf("%s/%s is still backed up by task %s", opts.Pool, opts.Dataset, task.Name)
+		}
+	}
+	// The removed task's own staging_dir override is gone with it; its directories are below the global root.
+	return []target{{task: opts.PurgeTask, pool: opts.Pool, dataset: opts.Dataset, taskRoot: cfg.TaskRoot(nil), purge: true}}, nil
+}
+
+// checkLock fails while a backup of the dataset is running.
+func checkLock(baseDir string, t target) error {
+	entries, err := lock.Query(filepath.Join(util.RunDir(baseDir, t.pool, t.dataset), "zrb.lock"))
+	if err != nil {
+		return fmt.Errorf("failed to read lock of %s/%s: %w", t.pool, t.dataset, err)
+	}
+	for _, e := range entries {
+		if e.Alive {
+			return fmt.Errorf("refusing to clean up %s/%s while it is locked: %w", t.pool, t.dataset, lock.ErrHeld{Entry: e})
+		}
+	}
+	return nil
+}
+
+// plan lists the local files of t to remove.
+func plan(cfg *config.Config, t target, retentionDays int, now time.Time) ([]Item, error) {
+	var items []Item
+
+	if t.purge {
+		runItems, err := runStateItems(cfg, t)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, runItems...)
+	}
+
+	logItems, err := logItems(util.LogDir(cfg.BaseDir, t.pool, t.dataset), retentionDays, now)
+	if err != nil {
+		return nil, err
+	}
+	items = append(items, logItems...)
+
+	taskItems, err := taskDirItems(cfg, t)
+	if err != nil {
+		return nil, err
+	}
+	return append(items, taskItems...), nil
+}
+
+// runStateItems lists the run directory of a purged task: its files and imported legacy
+// manifests. Other directories belong to nested datasets and are left alone, and so is the lock,
+// which cleanup holds while removing.
+func runStateItems(cfg *config.Config, t target) ([]Item, error) {
+	runDir := util.RunDir(cfg.BaseDir, t.pool, t.dataset)
+	entries, err := readDir(runDir)
+	if err != nil {
+		return nil, err
+	}
+	var items []Item
+	for _, e := range entries {
+		if e.Name() == "zrb.lock" {
+			continue
+		}
+		if e.IsDir() && (e.Name() != "legacy" || foreign(cfg, t, e.Name())) {
+			continue
+		}
+		items = append(items, Item{Path: filepath.Join(runDir, e.Name()), Reason: "run state of removed task " + t.task})
+	}
+	return items, nil
+}
+
+// logItems lists the daily logs older than retentionDays.
+func logItems(logDir string, retentionDays int, now time.Time) ([]Item, error) {
+	if retentionDays <= 0 {
+		return nil, nil
+	}
+	entries, err := readDir(logDir)
+	if err != nil {
+		return nil, err
+	}
+	cutoff := now.AddDate(0, 0, -retentionDays).Format("2006-01-02")
+	var items []Item
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !logFilePattern.MatchString(e.Name()) {
+			continue
+		}
+		if strings.TrimSuffix(e.Name(), ".log") < cutoff {
+			items = append(items, Item{Path: filepath.Join(logDir, e.Name()), Reason: fmt.Sprintf("log older than %d days", retentionDays)})
+		}
+	}
+	return items, nil
+}
+
+// taskDirItems lists the dated task directories (levelN/YYYYMMDD) that hold no retained backup
+// generation. All of them go when purging, local-only backups included.
+func taskDirItems(cfg *config.Config, t target) ([]Item, error) {
+	reason := "local-only backups of removed task " + t.task
+	retained := map[string]bool{}
+	if !t.purge {
+		reason = "not a retained backup generation"
+		var found bool
+		var err error
+		if retained, found, err = retainedDirs(cfg, t); err != nil {
+			return nil, err
+		}
+		if !found {
+			slog.Warn("No last backup manifest, leaving task directories alone", "task", t.task)
+			return nil, nil
+		}
+	}
+
+	taskRoot := filepath.Join(t.taskRoot, t.pool, t.dataset)
+	levels, err := readDir(taskRoot)
+	if err != nil {
+		return nil, err
+	}
+	var items []Item
+	for _, level := range levels {
+		if !level.IsDir() || !levelPattern.MatchString(level.Name()) || foreign(cfg, t, level.Name()) {
+			continue
+		}
+		dates, err := readDir(filepath.Join(taskRoot, level.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, date := range dates {
+			dir := filepath.Join(taskRoot, level.Name(), date.Name())
+			if date.IsDir() && datePattern.MatchString(date.Name()) && !retained[dir] {
+				items = append(items, Item{Path: dir, Reason: reason})
+			}
+		}
+	}
+	return items, nil
+}
+
+// retainedDirs returns the task directories of the backups the last backup manifest references
+// and of an interrupted backup, and whether there is a last backup manifest at all.
+func retainedDirs(cfg *config.Config, t target) (map[string]bool, bool, error) {
+	runDir := util.RunDir(cfg.BaseDir, t.pool, t.dataset)
+	last, err := manifest.ReadLast(filepath.Join(runDir, "last_backup_manifest.yaml"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("failed to read last backup manifest of task %s: %w", t.task, err)
+	}
+
+	retained := map[string]bool{}
+	for _, ref := range append(append([]*manifest.Ref{}, last.BackupLevels...), last.Legacy...) {
+		if ref == nil {
+			continue
+		}
+		if ref.Manifest != "" {
+			retained[filepath.Dir(filepath.Clean(ref.Manifest))] = true
+		}
+		if ref.S3Path != "" {
+			retained[filepath.Join(t.taskRoot, ref.S3Path)] = true
+		}
+	}
+
+	state, err := manifest.ReadState(filepath.Join(runDir, "backup_state.yaml"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, false, fmt.Errorf("failed to read backup state of task %s: %w", t.task, err)
+	}
+	if state != nil && state.OutputDir != "" {
+		retained[filepath.Clean(state.OutputDir)] = true
+	}
+	return retained, true, nil
+}
+
+// foreign reports whether name, a directory below the dataset directories of t, belongs to the
+// nested dataset of another configured task.
+func foreign(cfg *config.Config, t target, name string) bool {
+	nested := t.dataset + "/" + name
+	for _, task := range cfg.Tasks {
+		if task.Name == t.task || task.Pool != t.pool {
+			continue
+		}
+		if task.Dataset == nested || strings.HasPrefix(task.Dataset, nested+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// clean removes the files plan lists for t while holding the lock of its dataset, so no backup
+// starts meanwhile, and returns how many it removed.
+func clean(cfg *config.Config, t target, retentionDays int, now time.Time) (int, error) {
+	runDir := util.RunDir(cfg.BaseDir, t.pool, t.dataset)
+	release := func() error { return nil }
+	if _, err := os.Stat(runDir); err == nil {
+		if release, err = lock.Acquire(filepath.Join(runDir, "zrb.lock"), t.task, -1); err != nil {
+			var held lock.ErrHeld
+			if errors.As(err, &held) {
+				return 0, fmt.Errorf("refusing to clean up %s/%s while it is locked: %w", t.pool, t.dataset, held)
+			}
+			return 0, fmt.Errorf("failed to acquire lock: %w", err)
+		}
+	}
+
+	// Planned again under the lock, as a backup may have finished since the listing.
+	removed := 0
+	items, err := plan(cfg, t, retentionDays, now)
+	if err == nil {
+		removed, err = remove(items)
+	}
+
+	if releaseErr := release(); releaseErr != nil {
+		slog.Warn("Failed to release lock", "error", releaseErr)
+	}
+	if err != nil {
+		return removed, err
+	}
+
+	// Directories left empty go too; one still holding something fails to be removed and stays.
+	taskRoot := filepath.Join(t.taskRoot, t.pool, t.dataset)
+	levels, _ := readDir(taskRoot)
+	for _, level := range levels {
+		if levelPattern.MatchString(level.Name()) {
+			os.Remove(filepath.Join(taskRoot, level.Name()))
+		}
+	}
+	if t.purge {
+		for _, dir := range []string{runDir, util.LogDir(cfg.BaseDir, t.pool, t.dataset), taskRoot} {
+			os.Remove(dir)
+		}
+	}
+	return removed, nil
+}
+
+func remove(items []Item) (int, error) {
+	for i, item := range items {
+		if err := os.RemoveAll(item.Path); err != nil {
+			return i, fmt.Errorf("failed to remove %s: %w", item.Path, err)
+		}
+		slog.Info("Removed local file", "path", item.Path, "reason", item.Reason)
+	}
+	return len(items), nil
+}
+
+func confirm(count int) error {
+	if !stdinIsTerminal() {
+		return fmt.Errorf("refusing to remove %d item(s) without a terminal to confirm; pass --yes", count)
+	}
+	fmt.Fprintf(output, "Remove these %d item(s)? [y/N]: ", count)
+	answer, _ := bufio.NewReader(promptInput).ReadString('\n')
+	if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+		return fmt.Errorf("cleanup cancelled")
+	}
+	return nil
+}
+
+// readDir returns the entries of dir, none when it does not exist.
+func readDir(dir string) ([]os.DirEntry, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read %s: %w", dir, err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,193 @@
+package cleanup
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"zrb/internal/lock"
+	"zrb/internal/manifest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setup writes a config with the tasks data (tank/data) and sub (tank/data/sub) and returns it
+// with its base_dir. The output of Run is captured in the returned buffer.
+func setup(t *testing.T) (string, string, *bytes.Buffer) {
+	t.Helper()
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base")
+	configPath := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+tasks:
+  - name: data
+    pool: tank
+    dataset: data
+    enabled: true
+  - name: sub
+    pool: tank
+    dataset: data/sub
+    enabled: true
+`, base)), 0o644))
+
+	var out bytes.Buffer
+	oldOutput, oldTerminal := output, stdinIsTerminal
+	output = &out
+	stdinIsTerminal = func() bool { return false }
+	t.Cleanup(func() { output, stdinIsTerminal = oldOutput, oldTerminal })
+	return configPath, base, &out
+}
+
+func mkdir(t *testing.T, parts ...string) string {
+	t.Helper()
+	dir := filepath.Join(parts...)
+	require.NoError(t, os.MkdirAll(dir, 0o755))
+	return dir
+}
+
+func write(t *testing.T, path string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(t, os.WriteFile(path, []byte("x"), 0o644))
+}
+
+func TestRunOrphans(t *testing.T) {
+	configPath, base, out := setup(t)
+	today := time.Now()
+
+	taskRoot := filepath.Join(base, "task", "tank", "data")
+	retained := mkdir(t, taskRoot, "level0", "20240101")
+	inProgress := mkdir(t, taskRoot, "level1", "20240105")
+	orphan := mkdir(t, taskRoot, "level0", "20230101")
+	nested := mkdir(t, taskRoot, "sub", "level0", "20230101")
+
+	runDir := mkdir(t, base, "run", "tank", "data")
+	require.NoError(t, manifest.WriteLast(filepath.Join(runDir, "last_backup_manifest.yaml"), &manifest.Last{
+		Pool: "tank", Dataset: "data",
+		BackupLevels: []*manifest.Ref{{Snapshot: "tank/data@zrb_level0", Manifest: filepath.Join(retained, "task_manifest.yaml"), S3Path: "tank/data/level0/20240101", Blake3Hash: "0123456789abcdef"}},
+	}))
+	require.NoError(t, manifest.WriteState(filepath.Join(runDir, "backup_state.yaml"), &manifest.State{TaskName: "data", BackupLevel: 1, OutputDir: inProgress}))
+
+	logDir := filepath.Join(base, "logs", "tank", "data")
+	oldLog := filepath.Join(logDir, today.AddDate(0, 0, -40).Format("2006-01-02")+".log")
+	recentLog := filepath.Join(logDir, today.Format("2006-01-02")+".log")
+	for _, path := range []string{oldLog, recentLog} {
+		write(t, path)
+	}
+
+	opts := Options{ConfigPath: configPath, LogRetentionDays: 30}
+	require.NoError(t, Run(opts))
+	assert.Contains(t, out.String(), orphan+" (not a retained backup generation)")
+	assert.Contains(t, out.String(), oldLog+" (log older than 30 days)")
+	assert.Contains(t, out.String(), "Dry run")
+	assert.DirExists(t, orphan, "a dry run removes nothing")
+	assert.FileExists(t, oldLog)
+
+	opts.Delete = true
+	require.ErrorContains(t, Run(opts), "without a terminal to confirm; pass --yes")
+	assert.DirExists(t, orphan)
+
+	opts.Yes = true
+	require.NoError(t, Run(opts))
+	assert.NoDirExists(t, orphan)
+	assert.NoFileExists(t, oldLog)
+	for _, kept := range []string{retained, inProgress, nested} {
+		assert.DirExists(t, kept)
+	}
+	assert.FileExists(t, recentLog)
+	assert.NoFileExists(t, filepath.Join(runDir, "zrb.lock"), "the lock is released")
+}
+
+func TestRunPurge(t *testing.T) {
+	configPath, base, out := setup(t)
+
+	// Task old backed up tank/other and was removed from the config.
+	runDir := mkdir(t, base, "run", "tank", "other")
+	write(t, filepath.Join(runDir, "last_backup_manifest.yaml"))
+	write(t, filepath.Join(runDir, "legacy", "20200101000000", "task_manifest.yaml"))
+	localOnly := mkdir(t, base, "task", "tank", "other", "level0", "20240101")
+	otherTask := mkdir(t, base, "run", "tank", "data")
+	write(t, filepath.Join(otherTask, "last_backup_manifest.yaml"))
+
+	opts := Options{ConfigPath: configPath, PurgeTask: "old", Pool: "tank", Dataset: "other", Delete: true, Yes: true}
+
+	assert.EqualError(t, Run(Options{ConfigPath: configPath, PurgeTask: "data", Pool: "tank", Dataset: "data"}),
+		"task data is still in the config; remove it from the config before purging it")
+	assert.EqualError(t, Run(Options{ConfigPath: configPath, PurgeTask: "old", Pool: "tank", Dataset: "data"}),
+		"tank/data is still backed up by task data")
+	assert.EqualError(t, Run(Options{ConfigPath: configPath, PurgeTask: "old"}),
+		"--purge-task needs --pool and --dataset of the removed task")
+	assert.EqualError(t, Run(Options{ConfigPath: configPath, PurgeTask: "old", Pool: "tank", Dataset: "../../etc"}),
+		"invalid pool or dataset name: tank/../../etc")
+
+	release, err := lock.Acquire(filepath.Join(runDir, "zrb.lock"), "old", 0)
+	require.NoError(t, err)
+	assert.ErrorContains(t, Run(opts), "refusing to clean up tank/other while it is locked")
+	assert.FileExists(t, filepath.Join(runDir, "last_backup_manifest.yaml"))
+	require.NoError(t, release())
+
+	require.NoError(t, Run(opts))
+	assert.Contains(t, out.String(), "local-only backups of removed task old")
+	assert.NoDirExists(t, runDir)
+	assert.NoDirExists(t, filepath.Join(base, "task", "tank", "other"))
+	assert.NoDirExists(t, localOnly)
+	assert.FileExists(t, filepath.Join(otherTask, "last_backup_manifest.yaml"), "other tasks of the pool are untouched")
+
+	out.Reset()
+	require.NoError(t, Run(opts))
+	assert.Equal(t, "Nothing to clean up.\n", out.String())
+}
+
+func TestRunPurgeKeepsNestedDataset(t *testing.T) {
+	configPath, base, _ := setup(t)
+
+	// Task sub (tank/data/sub) stays while tank/data is purged under another name.
+	configData, err := os.ReadFile(configPath)
+	require.NoError(t, err)
+	trimmed := strings.Replace(string(configData), "  - name: data\n    pool: tank\n    dataset: data\n    enabled: true\n", "", 1)
+	require.NoError(t, os.WriteFile(configPath, []byte(trimmed), 0o644))
+
+	runDir := mkdir(t, base, "run", "tank", "data")
+	write(t, filepath.Join(runDir, "stats.yaml"))
+	nestedRun := filepath.Join(runDir, "sub", "last_backup_manifest.yaml")
+	write(t, nestedRun)
+	nestedTask := mkdir(t, base, "task", "tank", "data", "sub", "level0", "20240101")
+	mkdir(t, base, "task", "tank", "data", "level0", "20240101")
+
+	require.NoError(t, Run(Options{ConfigPath: configPath, PurgeTask: "data", Pool: "tank", Dataset: "data", Delete: true, Yes: true}))
+	assert.NoFileExists(t, filepath.Join(runDir, "stats.yaml"))
+	assert.NoDirExists(t, filepath.Join(base, "task", "tank", "data", "level0"))
+	assert.FileExists(t, nestedRun)
+	assert.DirExists(t, nestedTask)
+}
+
+func TestRunOrphansStagingDir(t *testing.T) {
+	configPath, base, out := setup(t)
+	staging := filepath.Join(filepath.Dir(base), "scratch")
+	configData, err := os.ReadFile(configPath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(configPath, []byte("staging_dir: "+staging+"\n"+string(configData)), 0o644))
+
+	taskRoot := filepath.Join(staging, "task", "tank", "data")
+	retained := mkdir(t, taskRoot, "level0", "20240101")
+	orphan := mkdir(t, taskRoot, "level0", "20230101")
+	// Left below base_dir from before staging_dir was set; cleanup no longer looks there.
+	unstaged := mkdir(t, base, "task", "tank", "data", "level0", "20220101")
+
+	runDir := mkdir(t, base, "run", "tank", "data")
+	require.NoError(t, manifest.WriteLast(filepath.Join(runDir, "last_backup_manifest.yaml"), &manifest.Last{
+		Pool: "tank", Dataset: "data",
+		BackupLevels: []*manifest.Ref{{Snapshot: "tank/data@zrb_level0", S3Path: "tank/data/level0/20240101", Blake3Hash: "0123456789abcdef"}},
+	}))
+
+	require.NoError(t, Run(Options{ConfigPath: configPath, Delete: true, Yes: true}))
+	assert.Contains(t, out.String(), orphan+" (not a retained backup generation)")
+	assert.NoDirExists(t, orphan)
+	assert.DirExists(t, retained)
+	assert.DirExists(t, unstaged)
+}
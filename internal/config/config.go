@@ -1,44 +1,274 @@
 package config
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+	"zrb/internal/manifest"
+	"zrb/internal/units"
+	"zrb/internal/util"
+	"zrb/internal/zfs"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"gopkg.in/yaml.v3"
 )
 
 type Task struct {
-	Name        string `yaml:"name"`
-	Description string `yaml:"description,omitempty"`
-	Pool        string `yaml:"pool"`
-	Dataset     string `yaml:"dataset"`
-	Enabled     bool   `yaml:"enabled"`
+	Name        string `yaml:"name" required:"true" desc:"Task name"`
+	Description string `yaml:"description,omitempty" desc:"Task description"`
+	Pool        string `yaml:"pool" required:"true" desc:"ZFS pool name"`
+	Dataset     string `yaml:"dataset" required:"true" desc:"ZFS dataset name"`
+	Enabled     bool   `yaml:"enabled" required:"true" desc:"Enable this task"`
+	SingleFile  bool   `yaml:"single_file,omitempty" desc:"Write one encrypted file per backup instead of split parts"`
+	// SingleFileMaxSizeGB is the largest estimated stream size allowed for single_file tasks.
+	SingleFileMaxSizeGB units.GiB `yaml:"single_file_max_size_gb,omitempty" minimum:"0" desc:"Largest estimated stream size allowed for single_file, in GiB or with a unit (e.g. 3 or 512M, default 3G)"`
+	// InlineEncryption encrypts the split parts as zfs send streams them, so no unencrypted part is
+	// ever written to disk.
+	InlineEncryption bool `yaml:"inline_encryption,omitempty" desc:"Encrypt each part while zfs send streams it instead of splitting the stream into unencrypted parts first, so no plaintext of the snapshot is written to disk; an encrypted part lost before its upload means sending the snapshot again"`
+	// DedupStore stores the stream as chunks shared between backups; see manifest.ChunkedFormat.
+	DedupStore       bool        `yaml:"dedup_store,omitempty" desc:"Experimental: cut the stream into content-defined chunks and upload only those no earlier backup stored below chunks/, instead of split parts"`
+	DedupChunkSizeMB units.MiB   `yaml:"dedup_chunk_size_mb,omitempty" minimum:"0" desc:"Average chunk size of dedup_store, in MiB or with a unit, a power of two MiB (e.g. 8 or 8M, default 4M)"`
+	IncrementalMode  string      `yaml:"incremental_mode,omitempty" enum:"chain,differential" desc:"chain: level N is relative to level N-1; differential: every level is relative to level 0 (default chain)"`
+	ParentPolicy     string      `yaml:"parent_policy,omitempty" enum:"previous_level,latest_any,same_level" desc:"previous_level: level N is relative to the level incremental_mode names; latest_any: to the most recent backup of levels 0 to N; same_level: to the previous level N backup, the first one as previous_level (default previous_level)"`
+	S3Prefix         string      `yaml:"s3_prefix,omitempty" desc:"Per-task S3 prefix inserted after s3.prefix and before data/ and manifests/, e.g. the host name, so tasks of different hosts with the same pool/dataset do not collide"`
+	StagingDir       string      `yaml:"staging_dir,omitempty" desc:"Overrides the global staging_dir for this task"`
+	PartSize         units.Bytes `yaml:"part_size,omitempty" desc:"Overrides the global part_size for this task"`
+	// MaxStreamSize stops a send that grows far past its estimate, e.g. because of a runaway log file,
+	// before it fills the staging disk.
+	MaxStreamSize   units.Limit `yaml:"max_stream_size,omitempty" desc:"Stop the backup when zfs send produces more than this, either a size (e.g. 500G) or a multiple of the zfs send -nP estimate (e.g. 3x); the partial parts are removed (default off)"`
+	MinUsedMB       units.MiB   `yaml:"min_used_mb,omitempty" minimum:"0" desc:"Refuse to back up the dataset when it uses less than this, in MiB or with a unit (e.g. 100 or 1G), e.g. because it failed to mount (default off)"`
+	ChecksumsSHA256 bool        `yaml:"checksums_sha256,omitempty" desc:"Also write CHECKSUMS.sha256 next to CHECKSUMS.blake3, which costs one more read of every encrypted part"`
+	// RecordChanges keeps the zfs diff of each incremental backup for zrb diff.
+	RecordChanges        bool        `yaml:"record_changes,omitempty" desc:"Run zfs diff from the parent snapshot for every backup above level 0 and store its output, compressed and encrypted, as changes.txt.age next to the parts, for zrb diff; a failing zfs diff only records that the list is unavailable"`
+	RecordChangesMaxSize units.Bytes `yaml:"record_changes_max_size,omitempty" minimum:"0" desc:"Largest zfs diff output record_changes stores, in bytes or with a unit; longer lists keep their first lines and are marked truncated (e.g. 100M, default 16M)"`
+	// AutoSnapshot makes every backup of the task take its own snapshot, as zrb backup --snapshot.
+	AutoSnapshot bool `yaml:"auto_snapshot,omitempty" desc:"Take a fresh zrb_level<N> snapshot at the start of every backup of this task, as zrb backup --snapshot does; a resumed backup keeps its snapshot"`
+	// Upload overrides whether a remote backend is enabled for this task; see Config.Uploads.
+	Upload *bool       `yaml:"upload,omitempty" desc:"Upload this task's backups to S3, GCS or SFTP; false keeps them local-only in the task/ directory of staging_dir or base_dir (default: whether one of them is enabled)"`
+	Hooks  HooksConfig `yaml:"hooks,omitempty"`
+	// UploadWindow limits the hours parts are uploaded in; see UploadWindow.Bounds.
+	UploadWindow *UploadWindow `yaml:"upload_window,omitempty"`
+	Retention    *Retention    `yaml:"retention,omitempty"`
+
+	// source is the file the task was read from when the config has an include_dir, and
+	// sourceIndex its position in that file's tasks.
+	source      string
+	sourceIndex int
+}
+
+// HooksConfig holds shell commands run around a task's backup, e.g. to quiesce a database while
+// the snapshot is taken. They see ZRB_TASK, ZRB_LEVEL and ZRB_SNAPSHOT, post hooks also ZRB_RESULT.
+type HooksConfig struct {
+	PreSnapshot  string         `yaml:"pre_snapshot,omitempty" desc:"Command run before zrb backup --snapshot takes the snapshot; failing aborts the backup"`
+	PostSnapshot string         `yaml:"post_snapshot,omitempty" desc:"Command run after the snapshot was taken or failed, whenever pre_snapshot ran"`
+	PostBackup   string         `yaml:"post_backup,omitempty" desc:"Command run after every backup of the task, successful or not"`
+	Timeout      units.Duration `yaml:"timeout,omitempty" desc:"How long each hook may run before it is killed (e.g. 30s, default 5m)"`
+}
+
+// Retention is which backups of a task zrb prune keeps in the bucket, besides those the last
+// backup manifest references and the parents kept backups depend on.
+type Retention struct {
+	KeepLast int `yaml:"keep_last,omitempty" minimum:"0" desc:"Keep the N most recent backups, of any level"`
+	KeepDays int `yaml:"keep_days,omitempty" minimum:"0" desc:"Keep the backups taken in the last N days"`
 }
 
+// UploadWindow is the daily time range a task uploads in, e.g. the night hours of a metered or
+// shared uplink. Sending, splitting and encrypting run at any time.
+type UploadWindow struct {
+	Start    string `yaml:"start" required:"true" desc:"Time of day, HH:MM, the window opens"`
+	End      string `yaml:"end" required:"true" desc:"Time of day, HH:MM, the window closes; before start for a window spanning midnight"`
+	Timezone string `yaml:"timezone,omitempty" desc:"IANA time zone of start and end, e.g. Europe/Berlin (default: the local time zone)"`
+}
+
+// Struct tags other than yaml feed the JSON Schema generated by Schema.
 type Config struct {
-	BaseDir      string   `yaml:"base_dir"`
-	AgePublicKey string   `yaml:"age_public_key"`
-	S3           S3Config `yaml:"s3"`
-	Tasks        []Task   `yaml:"tasks"`
+	BaseDir       string        `yaml:"base_dir" required:"true" desc:"Base directory for backups"`
+	StagingDir    string        `yaml:"staging_dir,omitempty" desc:"Existing directory, e.g. on a scratch disk, holding the task/ hierarchy of split and encrypted parts and local-only backups instead of base_dir; logs and run state stay under base_dir"`
+	PartSize      units.Bytes   `yaml:"part_size,omitempty" desc:"Size the send stream is split into parts at, in bytes or with a unit, from 64M to 64G (e.g. 1G, default 3G)"`
+	Workers       int           `yaml:"workers,omitempty" minimum:"0" desc:"Parts a backup encrypts and uploads, and a restore downloads and decrypts, in parallel (default 4); a restore keeps up to this many decrypted parts in its work_dir"`
+	AgePublicKey  string        `yaml:"age_public_key,omitempty" desc:"Age X25519 public key for encryption (age1...)"`
+	AgeRecipients []string      `yaml:"age_recipients,omitempty" desc:"Additional age recipients in any format age supports: age1..., plugin recipients (age1<plugin>1...), ssh-ed25519 or ssh-rsa public keys"`
+	S3            S3Config      `yaml:"s3,omitempty"`
+	GCS           GCSConfig     `yaml:"gcs,omitempty"`
+	SFTP          SFTPConfig    `yaml:"sftp,omitempty"`
+	Events        EventsConfig  `yaml:"events,omitempty"`
+	Restore       RestoreConfig `yaml:"restore,omitempty"`
+	Otel          OtelConfig    `yaml:"otel,omitempty"`
+	ZFS           ZFSConfig     `yaml:"zfs,omitempty"`
+	// VerifyAfterUpload catches parts truncated or mangled on their way to the bucket, e.g. by a proxy.
+	VerifyAfterUpload *bool           `yaml:"verify_after_upload,omitempty" desc:"Check the size and BLAKE3 hash of every part with a HEAD request right after its upload, and upload it again on a mismatch, up to s3.retry.max_attempts times (default true)"`
+	ShutdownGrace     *units.Duration `yaml:"shutdown_grace,omitempty" desc:"How long a backup stopped by SIGTERM or SIGINT while uploading parts lets the parts in flight finish before it exits; a second signal exits at once, 0s always does (e.g. 2m, default 60s)"`
+	FileMode          string          `yaml:"file_mode,omitempty" desc:"Mode, in octal, of the run state, manifests, logs and other metadata files zrb creates, e.g. 0660 for operators sharing a group (default 0640); parts and decrypted data stay 0600, and the umask applies on top"`
+	DirMode           string          `yaml:"dir_mode,omitempty" desc:"Mode, in octal, of the directories zrb creates below base_dir and staging_dir, e.g. 0770 (default 0750); the umask applies on top"`
+	IncludeDir        string          `yaml:"include_dir,omitempty" desc:"Directory whose *.yaml files each hold a tasks: list, merged in file name order after the tasks of this file; relative to this file"`
+	Tasks             []Task          `yaml:"tasks,omitempty" desc:"Backup tasks; at least one here or in include_dir"`
+}
+
+// RestoreConfig holds defaults for the restore command.
+type RestoreConfig struct {
+	WorkDir string `yaml:"work_dir,omitempty" desc:"Scratch directory for downloaded and decrypted parts, also used by verify (default: the system temp directory if it has room, else base_dir/tmp)"`
+}
+
+// OtelConfig enables OpenTelemetry tracing of backup and restore phases.
+type OtelConfig struct {
+	Endpoint string `yaml:"endpoint,omitempty" desc:"OTLP/gRPC collector address (host:port) to export traces to (default off)"`
+	Insecure bool   `yaml:"insecure,omitempty" desc:"Connect to the collector without TLS"`
+}
+
+// ZFSConfig tunes the zfs commands zrb runs.
+type ZFSConfig struct {
+	// Hold is the retry policy of zfs hold and release, which fail while a pool is briefly busy.
+	Hold struct {
+		MaxAttempts int            `yaml:"max_attempts,omitempty" minimum:"0" desc:"Attempts of each zfs hold or release before giving up (default 4)"`
+		Backoff     units.Duration `yaml:"backoff,omitempty" desc:"Wait before the first retry, doubled for each further one (e.g. 10s, default 5s)"`
+		Timeout     units.Duration `yaml:"timeout,omitempty" desc:"How long one zfs hold or release may take (default 30s)"`
+	} `yaml:"hold,omitempty"`
+}
+
+// EventsConfig configures the audit trail of backup and restore stages, independent of logging.
+type EventsConfig struct {
+	File string `yaml:"file,omitempty" desc:"Append audit events of backups and restores as JSON lines to this file (default off)"`
 }
 
 type S3Config struct {
-	Enabled      bool   `yaml:"enabled"`
-	Bucket       string `yaml:"bucket"`
-	Prefix       string `yaml:"prefix"`
-	Region       string `yaml:"region"`
-	Endpoint     string `yaml:"endpoint"`
+	Enabled      bool   `yaml:"enabled" required:"true" desc:"Enable S3 storage"`
+	Bucket       string `yaml:"bucket" required:"true" desc:"S3 bucket name"`
+	Region       string `yaml:"region" required:"true" desc:"AWS region"`
+	Prefix       string `yaml:"prefix" required:"true" desc:"S3 prefix for backups"`
+	Endpoint     string `yaml:"endpoint" desc:"Custom S3 endpoint (leave empty for AWS)"`
 	StorageClass struct {
-		BackupData []types.StorageClass `yaml:"backup_data"`
-		Manifest   types.StorageClass   `yaml:"manifest"`
-	} `yaml:"storage_class"`
+		Manifest   string   `yaml:"manifest" required:"true" enum:"STANDARD,REDUCED_REDUNDANCY,STANDARD_IA,ONEZONE_IA,INTELLIGENT_TIERING,GLACIER,DEEP_ARCHIVE,OUTPOSTS,GLACIER_IR,SNOW,EXPRESS_ONEZONE,FSX_OPENZFS,FSX_ONTAP" desc:"Storage class for manifest files"`
+		BackupData []string `yaml:"backup_data" required:"true" enum:"STANDARD,REDUCED_REDUNDANCY,STANDARD_IA,ONEZONE_IA,INTELLIGENT_TIERING,GLACIER,DEEP_ARCHIVE,OUTPOSTS,GLACIER_IR,SNOW,EXPRESS_ONEZONE,FSX_OPENZFS,FSX_ONTAP" desc:"Storage classes for backup data by level"`
+	} `yaml:"storage_class" required:"true"`
 	Retry struct {
-		MaxAttempts int `yaml:"max_attempts"`
+		MaxAttempts int `yaml:"max_attempts" desc:"Maximum retry attempts"`
+		// Mode adaptive adds client-side rate limiting to the standard retries, which helps against
+		// endpoints that throttle or drop connections under load.
+		Mode           string         `yaml:"mode,omitempty" enum:"standard,adaptive" desc:"standard: retry with exponential backoff; adaptive: also slow down requests while the endpoint throttles (default standard)"`
+		InitialBackoff units.Duration `yaml:"initial_backoff,omitempty" desc:"Longest wait before the first retry, doubled for each further one up to max_backoff (e.g. 500ms, default the AWS SDK backoff of up to 2s)"`
+		MaxBackoff     units.Duration `yaml:"max_backoff,omitempty" desc:"Longest wait between two attempts (e.g. 30s, default 20s)"`
 	} `yaml:"retry,omitempty"`
+	// Preflight deferred lets a backup send and encrypt through a brief S3 outage and check the
+	// credentials only when it is about to upload.
+	Preflight string         `yaml:"preflight,omitempty" enum:"strict,deferred,skip" desc:"strict: check the S3 credentials before processing parts and fail at once; deferred: check them before the first upload, retrying with backoff; skip: never check (default strict)"`
+	VerifyTTL units.Duration `yaml:"verify_ttl,omitempty" desc:"How long a successful credentials check is reused within one process (e.g. 5m, default 5m)"`
+	// UploadPartSizeMB and UploadConcurrency bound the multipart uploader's buffers per uploading file.
+	UploadPartSizeMB  units.MiB `yaml:"upload_part_size_mb,omitempty" minimum:"0" desc:"Size of each multipart upload part, in MiB or with a unit (e.g. 64 or 1G), 5M to 5G (default 64M); with upload_concurrency this bounds the memory of each uploading file"`
+	UploadConcurrency int       `yaml:"upload_concurrency,omitempty" minimum:"0" desc:"Parts of one file uploaded in parallel (default 5)"`
+	// RemoteState mirrors the backup state to S3 so another host can finish an interrupted backup.
+	RemoteState bool `yaml:"remote_state,omitempty" desc:"Upload the encrypted backup state next to the manifests so another host can finish an interrupted backup"`
+	// MaxUploadBytesPerBackup and MaxDownloadBytesPerRestore guard against unexpected transfer costs,
+	// such as Glacier retrievals or cross-region egress.
+	MaxUploadBytesPerBackup    units.Bytes `yaml:"max_upload_bytes_per_backup,omitempty" minimum:"0" desc:"How much one backup may upload before it needs --acknowledge-cost, in bytes or with a unit (e.g. 500G, default 0, no limit)"`
+	MaxDownloadBytesPerRestore units.Bytes `yaml:"max_download_bytes_per_restore,omitempty" minimum:"0" desc:"How much one restore may download before it needs --acknowledge-cost, in bytes or with a unit (e.g. 100G, default 0, no limit)"`
+	OnBudgetExceeded           string      `yaml:"on_budget_exceeded,omitempty" enum:"pause,fail" desc:"pause: ask on the terminal whether to go on, and fail without one; fail: stop the run, to be resumed with --acknowledge-cost (default pause)"`
+	// SSE requests server-side encryption on every upload, for buckets whose policy rejects
+	// uploads without it.
+	SSE struct {
+		Mode     string `yaml:"mode,omitempty" enum:"none,AES256,aws:kms" desc:"none: send no encryption header, the bucket default applies; AES256: SSE-S3; aws:kms: SSE-KMS with kms_key_id (default none)"`
+		KMSKeyID string `yaml:"kms_key_id,omitempty" desc:"KMS key ID, alias or ARN; required with mode aws:kms"`
+	} `yaml:"sse,omitempty"`
+	ObjectACL string `yaml:"object_acl,omitempty" enum:"private,public-read,public-read-write,authenticated-read,aws-exec-read,bucket-owner-read,bucket-owner-full-control" desc:"Canned ACL set on every upload, for the rare bucket whose policy requires one, e.g. bucket-owner-full-control (default none)"`
+}
+
+// Modes of s3.sse.mode.
+const (
+	SSENone   = "none"
+	SSEAES256 = "AES256"
+	SSEKMS    = "aws:kms"
+)
+
+// objectACLs are the canned ACLs s3.object_acl accepts.
+var objectACLs = []string{"private", "public-read", "public-read-write", "authenticated-read", "aws-exec-read", "bucket-owner-read", "bucket-owner-full-control"}
+
+// ObjectACLs returns the canned ACLs s3.object_acl accepts.
+func ObjectACLs() []string {
+	return slices.Clone(objectACLs)
+}
+
+// GCSConfig stores backups in Google Cloud Storage instead of S3. Credentials come from
+// GOOGLE_APPLICATION_CREDENTIALS or the application default credentials.
+type GCSConfig struct {
+	Enabled      bool   `yaml:"enabled" required:"true" desc:"Enable Google Cloud Storage; cannot be combined with s3.enabled"`
+	Bucket       string `yaml:"bucket" required:"true" desc:"GCS bucket name"`
+	Prefix       string `yaml:"prefix" required:"true" desc:"GCS prefix for backups"`
+	StorageClass struct {
+		Manifest   string   `yaml:"manifest" required:"true" enum:"STANDARD,NEARLINE,COLDLINE,ARCHIVE" desc:"Storage class for manifest files"`
+		BackupData []string `yaml:"backup_data" required:"true" enum:"STANDARD,NEARLINE,COLDLINE,ARCHIVE" desc:"Storage classes for backup data by level"`
+	} `yaml:"storage_class" required:"true"`
+}
+
+// SFTPConfig stores backups in a directory of an SSH server over SFTP instead of object storage.
+// The host key must be in known_hosts_file; there is no trust on first use.
+type SFTPConfig struct {
+	Enabled        bool   `yaml:"enabled" required:"true" desc:"Enable the SFTP backend; cannot be combined with s3.enabled or gcs.enabled"`
+	Host           string `yaml:"host" required:"true" desc:"SSH server host name or address"`
+	Port           int    `yaml:"port,omitempty" minimum:"1" maximum:"65535" desc:"SSH port (default: 22)"`
+	User           string `yaml:"user" required:"true" desc:"SSH user"`
+	KeyFile        string `yaml:"key_file" required:"true" desc:"Unencrypted private key file of the user"`
+	KnownHostsFile string `yaml:"known_hosts_file,omitempty" desc:"known_hosts file holding the host key of the server (default: ~/.ssh/known_hosts)"`
+	BasePath       string `yaml:"base_path" required:"true" desc:"Absolute path of the directory on the server that backups are stored below, like an S3 prefix"`
 }
 
+// Backends of Config.Backend.
+const (
+	BackendS3   = "s3"
+	BackendGCS  = "gcs"
+	BackendSFTP = "sftp"
+)
+
+// ErrNoRemote is returned by commands that need a remote backend when none is enabled.
+var ErrNoRemote = errors.New("none of s3, gcs and sftp is enabled in config")
+
+// Storage class names are plain strings, checked against the classes of the enabled backend when
+// the config is loaded; internal/remote converts them to the SDK's types. The lists match the
+// enum tags of the storage_class fields.
+var (
+	s3StorageClasses = []string{
+		"STANDARD", "REDUCED_REDUNDANCY", "STANDARD_IA", "ONEZONE_IA", "INTELLIGENT_TIERING", "GLACIER",
+		"DEEP_ARCHIVE", "OUTPOSTS", "GLACIER_IR", "SNOW", "EXPRESS_ONEZONE", "FSX_OPENZFS", "FSX_ONTAP",
+	}
+	gcsStorageClasses = []string{"STANDARD", "NEARLINE", "COLDLINE", "ARCHIVE"}
+)
+
+// StorageClasses returns the storage classes backend accepts.
+func StorageClasses(backend string) []string {
+	if backend == BackendGCS {
+		return slices.Clone(gcsStorageClasses)
+	}
+	return slices.Clone(s3StorageClasses)
+}
+
+// Modes of s3.retry.mode.
+const (
+	RetryStandard = "standard"
+	RetryAdaptive = "adaptive"
+)
+
+// Policies of s3.preflight.
+const (
+	PreflightStrict   = "strict"
+	PreflightDeferred = "deferred"
+	PreflightSkip     = "skip"
+)
+
+// DefaultS3RetryMaxBackoff is the default of s3.retry.max_backoff, that of the AWS SDK.
+const DefaultS3RetryMaxBackoff = 20 * time.Second
+
+// Actions of s3.on_budget_exceeded.
+const (
+	BudgetPause = "pause"
+	BudgetFail  = "fail"
+)
+
 func Load(filename string) (*Config, error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
@@ -46,39 +276,314 @@ func Load(filename string) (*Config, error) {
 	}
 
 	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return nil, err
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	// Misspelled keys would otherwise silently decode to zero values.
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("config file %s is empty", filename)
+		}
+		return nil, fmt.Errorf("failed to parse config: %w", fieldError(data, err))
+	}
+	if cfg.IncludeDir != "" {
+		if err := cfg.include(filename); err != nil {
+			return nil, err
+		}
 	}
 
 	if err := cfg.Validate(); err != nil {
 		return nil, fmt.Errorf("config validation failed: %w", err)
 	}
+	for _, w := range cfg.Warnings() {
+		slog.Warn("Config warning", "warning", w)
+	}
+	// Everything created from here on gets the configured modes
+	util.SetModes(cfg.Modes())
 
 	return &cfg, nil
 }
 
+// Peek decodes a config file and its include_dir without validating them or logging warnings, for
+// shell completion, which has to stay quiet. Unknown keys are ignored.
+func Peek(filename string) (*Config, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	if cfg.IncludeDir != "" {
+		if err := cfg.include(filename); err != nil {
+			return nil, err
+		}
+	}
+	return &cfg, nil
+}
+
+// include merges the tasks of the *.yaml files in include_dir after the tasks of the main config
+// file, in file name order, and records where each task came from for validation errors.
+func (c *Config) include(mainFile string) error {
+	dir := c.IncludeDir
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(mainFile), dir)
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("failed to read include_dir: %w", err)
+	} else if !info.IsDir() {
+		return fmt.Errorf("include_dir %s is not a directory", dir)
+	}
+
+	for i := range c.Tasks {
+		c.Tasks[i].source, c.Tasks[i].sourceIndex = mainFile, i
+	}
+	// Glob sorts the files, so the task order does not depend on the directory.
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return fmt.Errorf("failed to list include_dir %s: %w", dir, err)
+	}
+	for _, file := range files {
+		tasks, err := readTaskFile(file)
+		if err != nil {
+			return err
+		}
+		for i := range tasks {
+			tasks[i].source, tasks[i].sourceIndex = file, i
+		}
+		c.Tasks = append(c.Tasks, tasks...)
+	}
+	return nil
+}
+
+// readTaskFile reads the tasks of an include_dir file. It holds nothing but a tasks: list, so the
+// global settings of the main config file apply to every task.
+func readTaskFile(filename string) ([]Task, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read task file: %w", err)
+	}
+	var file struct {
+		Tasks []Task `yaml:"tasks"`
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse task file %s: %w", filename, fieldError(data, err))
+	}
+	return file.Tasks, nil
+}
+
+// fieldError names the field of a size or duration in data that did not parse, which the error
+// of err only locates by line.
+func fieldError(data []byte, err error) error {
+	var unitErr *units.YAMLError
+	if !errors.As(err, &unitErr) {
+		return err
+	}
+	var root yaml.Node
+	if yaml.Unmarshal(data, &root) != nil {
+		return err
+	}
+	if field := fieldAt(&root, unitErr.Line, unitErr.Column, ""); field != "" {
+		return fmt.Errorf("line %d: %s: %w", unitErr.Line, field, unitErr.Err)
+	}
+	return err
+}
+
+// fieldAt returns the path below node, such as s3.upload_part_size_mb or tasks[1].min_used_mb,
+// of the mapping value at line and column.
+func fieldAt(node *yaml.Node, line, column int, path string) string {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			if field := fieldAt(child, line, column, path); field != "" {
+				return field
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			name := key.Value
+			if path != "" {
+				name = path + "." + name
+			}
+			if value.Line == line && value.Column == column {
+				return name
+			}
+			if field := fieldAt(value, line, column, name); field != "" {
+				return field
+			}
+		}
+	case yaml.SequenceNode:
+		for i, child := range node.Content {
+			if field := fieldAt(child, line, column, fmt.Sprintf("%s[%d]", path, i)); field != "" {
+				return field
+			}
+		}
+	}
+	return ""
+}
+
+// ref names the task at index i in validation errors, with the file it came from when the config
+// has an include_dir.
+func (t *Task) ref(i int) string {
+	if t.source == "" {
+		return fmt.Sprintf("tasks[%d]", i)
+	}
+	return fmt.Sprintf("%s: tasks[%d]", t.source, t.sourceIndex)
+}
+
+// ReadOtel returns the otel section of a config file without validating the rest, so tracing can
+// start before the command loads its config. A missing or broken file yields tracing off.
+func ReadOtel(filename string) OtelConfig {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return OtelConfig{}
+	}
+	var cfg struct {
+		Otel OtelConfig `yaml:"otel"`
+	}
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return OtelConfig{}
+	}
+	return cfg.Otel
+}
+
 func (c *Config) Validate() error {
 	if c.BaseDir == "" {
 		return fmt.Errorf("base_dir is required")
 	}
-	if c.AgePublicKey == "" {
-		return fmt.Errorf("age_public_key is required")
+	if c.AgePublicKey == "" && len(c.AgeRecipients) == 0 {
+		return fmt.Errorf("age_public_key is required unless age_recipients is set")
 	}
-	if !strings.HasPrefix(c.AgePublicKey, "age1") {
+	if c.AgePublicKey != "" && !strings.HasPrefix(c.AgePublicKey, "age1") {
 		return fmt.Errorf("age_public_key must start with 'age1'")
 	}
+	for i, r := range c.AgeRecipients {
+		if strings.TrimSpace(r) == "" {
+			return fmt.Errorf("age_recipients[%d] is empty", i)
+		}
+	}
+	if c.StagingDir != "" && !filepath.IsAbs(c.StagingDir) {
+		return fmt.Errorf("staging_dir must be an absolute path")
+	}
+	if err := validatePartSize(c.PartSize); err != nil {
+		return fmt.Errorf("part_size %w", err)
+	}
+	if c.Workers < 0 {
+		return fmt.Errorf("workers must be non-negative")
+	}
 	if len(c.Tasks) == 0 {
 		return fmt.Errorf("at least one task is required")
 	}
+	if c.ZFS.Hold.MaxAttempts < 0 || c.ZFS.Hold.Backoff < 0 || c.ZFS.Hold.Timeout < 0 {
+		return fmt.Errorf("zfs.hold settings must be non-negative")
+	}
+	if c.ShutdownGrace != nil && *c.ShutdownGrace < 0 {
+		return fmt.Errorf("shutdown_grace must be non-negative")
+	}
+	if _, err := parseMode(c.FileMode); err != nil {
+		return fmt.Errorf("file_mode %w", err)
+	}
+	if _, err := parseMode(c.DirMode); err != nil {
+		return fmt.Errorf("dir_mode %w", err)
+	}
+	names := make(map[string]int, len(c.Tasks))
 	for i, t := range c.Tasks {
+		ref := t.ref(i)
 		if t.Name == "" {
-			return fmt.Errorf("tasks[%d].name is required", i)
+			return fmt.Errorf("%s.name is required", ref)
 		}
 		if t.Pool == "" {
-			return fmt.Errorf("tasks[%d].pool is required", i)
+			return fmt.Errorf("%s.pool is required", ref)
 		}
 		if t.Dataset == "" {
-			return fmt.Errorf("tasks[%d].dataset is required", i)
+			return fmt.Errorf("%s.dataset is required", ref)
+		}
+		if first, ok := names[t.Name]; ok {
+			return fmt.Errorf("%s.name %s is already used by %s", ref, t.Name, c.Tasks[first].ref(first))
+		}
+		names[t.Name] = i
+		if t.SingleFileMaxSizeGB < 0 {
+			return fmt.Errorf("%s.single_file_max_size_gb must be non-negative", ref)
+		}
+		if t.StagingDir != "" && !filepath.IsAbs(t.StagingDir) {
+			return fmt.Errorf("%s.staging_dir must be an absolute path", ref)
+		}
+		if err := validatePartSize(t.PartSize); err != nil {
+			return fmt.Errorf("%s.part_size %w", ref, err)
+		}
+		if t.DedupChunkSizeMB < 0 || t.DedupChunkSizeMB&(t.DedupChunkSizeMB-1) != 0 {
+			return fmt.Errorf("%s.dedup_chunk_size_mb must be a power of two, got %d", ref, t.DedupChunkSizeMB)
+		}
+		if t.DedupStore && t.SingleFile {
+			return fmt.Errorf("%s.dedup_store cannot be combined with single_file", ref)
+		}
+		if t.InlineEncryption && (t.SingleFile || t.DedupStore) {
+			return fmt.Errorf("%s.inline_encryption applies to split parts; single_file and dedup_store already encrypt while sending", ref)
+		}
+		if t.DedupStore && !c.Uploads(&t) {
+			return fmt.Errorf("%s.dedup_store requires uploads, its chunks are not kept locally", ref)
+		}
+		if err := validateS3Prefix(t.S3Prefix); err != nil {
+			return fmt.Errorf("%s.s3_prefix %w", ref, err)
+		}
+		if t.MinUsedMB < 0 {
+			return fmt.Errorf("%s.min_used_mb must be non-negative", ref)
+		}
+		if t.RecordChangesMaxSize < 0 {
+			return fmt.Errorf("%s.record_changes_max_size must be non-negative", ref)
+		}
+		if t.MaxStreamSize.Bytes < 0 || (t.MaxStreamSize.Factor != 0 && t.MaxStreamSize.Factor < 1) {
+			return fmt.Errorf("%s.max_stream_size must be a size or a multiple of at least 1x, got %s", ref, t.MaxStreamSize)
+		}
+		if t.Upload != nil && *t.Upload && !c.RemoteEnabled() {
+			return fmt.Errorf("%s.upload requires s3.enabled, gcs.enabled or sftp.enabled", ref)
+		}
+		if t.Hooks.Timeout < 0 {
+			return fmt.Errorf("%s.hooks.timeout must be non-negative", ref)
+		}
+		if r := t.Retention; r != nil {
+			if r.KeepLast < 0 || r.KeepDays < 0 {
+				return fmt.Errorf("%s.retention.keep_last and keep_days must be non-negative", ref)
+			}
+			if r.KeepLast == 0 && r.KeepDays == 0 {
+				return fmt.Errorf("%s.retention needs keep_last or keep_days", ref)
+			}
+		}
+		if t.UploadWindow != nil {
+			if _, _, _, err := t.UploadWindow.Bounds(); err != nil {
+				return fmt.Errorf("%s.upload_window: %w", ref, err)
+			}
+		}
+		if t.IncrementalMode != "" && t.IncrementalMode != manifest.ModeChain && t.IncrementalMode != manifest.ModeDifferential {
+			return fmt.Errorf("%s.incremental_mode must be %s or %s, got %q", ref, manifest.ModeChain, manifest.ModeDifferential, t.IncrementalMode)
+		}
+		switch t.ParentPolicy {
+		case "", manifest.PolicyPreviousLevel:
+		case manifest.PolicyLatestAny, manifest.PolicySameLevel:
+			if t.Mode() == manifest.ModeDifferential {
+				return fmt.Errorf("%s.parent_policy %s cannot be combined with incremental_mode %s, which bases every level on level 0", ref, t.ParentPolicy, manifest.ModeDifferential)
+			}
+		default:
+			return fmt.Errorf("%s.parent_policy must be %s, %s or %s, got %q", ref, manifest.PolicyPreviousLevel, manifest.PolicyLatestAny, manifest.PolicySameLevel, t.ParentPolicy)
+		}
+	}
+	if c.S3.Enabled && c.GCS.Enabled {
+		return fmt.Errorf("s3.enabled and gcs.enabled cannot both be set")
+	}
+	if c.SFTP.Enabled && (c.S3.Enabled || c.GCS.Enabled) {
+		return fmt.Errorf("sftp.enabled cannot be combined with s3.enabled or gcs.enabled")
+	}
+	if c.GCS.Enabled {
+		if err := c.validateGCS(); err != nil {
+			return err
+		}
+	}
+	if c.SFTP.Enabled {
+		if err := c.validateSFTP(); err != nil {
+			return err
 		}
 	}
 	if c.S3.Enabled {
@@ -91,10 +596,102 @@ func (c *Config) Validate() error {
 		if len(c.S3.StorageClass.BackupData) == 0 {
 			return fmt.Errorf("s3.storage_class.backup_data must have at least one entry")
 		}
+		if err := validateStorageClasses(BackendS3, c.S3.StorageClass.Manifest, c.S3.StorageClass.BackupData); err != nil {
+			return err
+		}
+		if c.S3.UploadPartSizeMB != 0 && (c.S3.UploadPartSizeMB < 5 || c.S3.UploadPartSizeMB > 5120) {
+			return fmt.Errorf("s3.upload_part_size_mb must be between 5 and 5120 (the S3 part size limits), got %d", c.S3.UploadPartSizeMB)
+		}
+		if c.S3.UploadConcurrency < 0 {
+			return fmt.Errorf("s3.upload_concurrency must be non-negative")
+		}
+		if c.S3.MaxUploadBytesPerBackup < 0 || c.S3.MaxDownloadBytesPerRestore < 0 {
+			return fmt.Errorf("s3.max_upload_bytes_per_backup and s3.max_download_bytes_per_restore must be non-negative")
+		}
+		if err := c.validateS3Retry(); err != nil {
+			return err
+		}
+		switch c.S3.Preflight {
+		case "", PreflightStrict, PreflightDeferred, PreflightSkip:
+		default:
+			return fmt.Errorf("s3.preflight must be %s, %s or %s, got %q", PreflightStrict, PreflightDeferred, PreflightSkip, c.S3.Preflight)
+		}
+		if c.S3.OnBudgetExceeded != "" && c.S3.OnBudgetExceeded != BudgetPause && c.S3.OnBudgetExceeded != BudgetFail {
+			return fmt.Errorf("s3.on_budget_exceeded must be %s or %s, got %q", BudgetPause, BudgetFail, c.S3.OnBudgetExceeded)
+		}
+		if err := c.validateS3SSE(); err != nil {
+			return err
+		}
+		if c.S3.ObjectACL != "" && !slices.Contains(objectACLs, c.S3.ObjectACL) {
+			return fmt.Errorf("s3.object_acl must be one of %s, got %q", strings.Join(objectACLs, ", "), c.S3.ObjectACL)
+		}
 	}
 	return nil
 }
 
+func (c *Config) validateGCS() error {
+	if c.GCS.Bucket == "" {
+		return fmt.Errorf("gcs.bucket is required when gcs is enabled")
+	}
+	if len(c.GCS.StorageClass.BackupData) == 0 {
+		return fmt.Errorf("gcs.storage_class.backup_data must have at least one entry")
+	}
+	return validateStorageClasses(BackendGCS, c.GCS.StorageClass.Manifest, c.GCS.StorageClass.BackupData)
+}
+
+func (c *Config) validateSFTP() error {
+	switch {
+	case c.SFTP.Host == "":
+		return fmt.Errorf("sftp.host is required when sftp is enabled")
+	case c.SFTP.User == "":
+		return fmt.Errorf("sftp.user is required when sftp is enabled")
+	case c.SFTP.KeyFile == "":
+		return fmt.Errorf("sftp.key_file is required when sftp is enabled")
+	case !path.IsAbs(c.SFTP.BasePath):
+		return fmt.Errorf("sftp.base_path must be an absolute path on the server, got %q", c.SFTP.BasePath)
+	case c.SFTP.Port < 0 || c.SFTP.Port > 65535:
+		return fmt.Errorf("sftp.port must be between 1 and 65535, got %d", c.SFTP.Port)
+	}
+	return nil
+}
+
+// validateStorageClasses checks the storage_class section of backend against its known classes.
+func validateStorageClasses(backend, manifest string, backupData []string) error {
+	known := StorageClasses(backend)
+	if !slices.Contains(known, manifest) {
+		return fmt.Errorf("%s.storage_class.manifest must be one of %v, got %q", backend, known, manifest)
+	}
+	for i, class := range backupData {
+		if !slices.Contains(known, class) {
+			return fmt.Errorf("%s.storage_class.backup_data[%d] must be one of %v, got %q", backend, i, known, class)
+		}
+	}
+	return nil
+}
+
+// Warnings reports settings that are valid but almost certainly unintended.
+func (c *Config) Warnings() []string {
+	var warnings []string
+	if c.S3.Enabled {
+		switch c.S3.StorageClass.Manifest {
+		case "GLACIER", "DEEP_ARCHIVE":
+			warnings = append(warnings, fmt.Sprintf("s3.storage_class.manifest is %s; manifests must be thawed before list or restore can read them from S3", c.S3.StorageClass.Manifest))
+		}
+	}
+	if c.GCS.Enabled {
+		switch c.GCS.StorageClass.Manifest {
+		case "COLDLINE", "ARCHIVE":
+			warnings = append(warnings, fmt.Sprintf("gcs.storage_class.manifest is %s; every list and restore pays its retrieval fee to read the manifests", c.GCS.StorageClass.Manifest))
+		}
+	}
+	for _, t := range c.Tasks {
+		if t.Upload != nil && !*t.Upload {
+			warnings = append(warnings, fmt.Sprintf("task %s has upload: false; its backups are kept under %s and never removed, so prune them yourself", t.Name, c.TaskRoot(&t)))
+		}
+	}
+	return warnings
+}
+
 func (c *Config) FindTask(name string) (*Task, error) {
 	for _, t := range c.Tasks {
 		if t.Name == name {
@@ -104,9 +701,408 @@ func (c *Config) FindTask(name string) (*Task, error) {
 	return nil, fmt.Errorf("task not found: %s", name)
 }
 
+// SelectTasks expands --task selectors into task names, in config order and each once. A selector
+// is a task name or a shell-style glob such as prod-*; names are matched case-sensitively, and
+// a name that equals the selector matches even if it contains glob characters. A selector that
+// matches no task is an error.
+func (c *Config) SelectTasks(selectors []string) ([]string, error) {
+	if len(selectors) == 0 {
+		return nil, fmt.Errorf("--task is required when using a config file")
+	}
+	selected := make(map[string]bool)
+	for _, selector := range selectors {
+		matched := false
+		for _, t := range c.Tasks {
+			ok := t.Name == selector
+			if !ok {
+				var err error
+				if ok, err = path.Match(selector, t.Name); err != nil {
+					return nil, fmt.Errorf("invalid --task pattern %q: %w", selector, err)
+				}
+			}
+			if ok {
+				selected[t.Name] = true
+				matched = true
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("no task matches %q", selector)
+		}
+	}
+
+	var names []string
+	for _, t := range c.Tasks {
+		if selected[t.Name] {
+			names = append(names, t.Name)
+			delete(selected, t.Name)
+		}
+	}
+	return names, nil
+}
+
+// VerifiesUploads reports whether parts are checked with a HEAD request after their upload:
+// verify_after_upload, true when unset.
+func (c *Config) VerifiesUploads() bool {
+	return c.VerifyAfterUpload == nil || *c.VerifyAfterUpload
+}
+
 func (c *Config) S3RetryAttempts() int {
 	if c.S3.Retry.MaxAttempts > 0 {
 		return c.S3.Retry.MaxAttempts
 	}
 	return 3
 }
+
+// S3RetryMode is s3.retry.mode, standard when unset.
+func (c *Config) S3RetryMode() string {
+	if c.S3.Retry.Mode != "" {
+		return c.S3.Retry.Mode
+	}
+	return RetryStandard
+}
+
+// S3Preflight is s3.preflight, strict when unset.
+func (c *Config) S3Preflight() string {
+	if c.S3.Preflight != "" {
+		return c.S3.Preflight
+	}
+	return PreflightStrict
+}
+
+// S3RetryMaxBackoff is the longest wait between two attempts of an S3 request.
+func (c *Config) S3RetryMaxBackoff() time.Duration {
+	if c.S3.Retry.MaxBackoff > 0 {
+		return time.Duration(c.S3.Retry.MaxBackoff)
+	}
+	return DefaultS3RetryMaxBackoff
+}
+
+func (c *Config) validateS3Retry() error {
+	r := c.S3.Retry
+	switch {
+	case r.Mode != "" && r.Mode != RetryStandard && r.Mode != RetryAdaptive:
+		return fmt.Errorf("s3.retry.mode must be %s or %s, got %q", RetryStandard, RetryAdaptive, r.Mode)
+	case r.MaxAttempts < 0:
+		return fmt.Errorf("s3.retry.max_attempts must be non-negative")
+	case r.InitialBackoff < 0 || r.MaxBackoff < 0:
+		return fmt.Errorf("s3.retry.initial_backoff and s3.retry.max_backoff must be non-negative")
+	case time.Duration(r.InitialBackoff) > c.S3RetryMaxBackoff():
+		return fmt.Errorf("s3.retry.initial_backoff %s exceeds s3.retry.max_backoff %s", r.InitialBackoff, c.S3RetryMaxBackoff())
+	case r.MaxAttempts == 1 && (r.InitialBackoff > 0 || r.MaxBackoff > 0):
+		return fmt.Errorf("s3.retry.max_attempts 1 never retries, so its backoff settings have no effect")
+	}
+	return nil
+}
+
+func (c *Config) validateS3SSE() error {
+	sse := c.S3.SSE
+	switch sse.Mode {
+	case "", SSENone, SSEAES256:
+		if sse.KMSKeyID != "" {
+			return fmt.Errorf("s3.sse.kms_key_id only applies to s3.sse.mode %s", SSEKMS)
+		}
+	case SSEKMS:
+		if sse.KMSKeyID == "" {
+			return fmt.Errorf("s3.sse.kms_key_id is required with s3.sse.mode %s", SSEKMS)
+		}
+	default:
+		return fmt.Errorf("s3.sse.mode must be %s, %s or %s, got %q", SSENone, SSEAES256, SSEKMS, sse.Mode)
+	}
+	return nil
+}
+
+// S3SSE returns the server-side encryption of uploads, empty for none, and the KMS key it uses.
+func (c *Config) S3SSE() (mode, kmsKeyID string) {
+	if c.S3.SSE.Mode == SSENone {
+		return "", ""
+	}
+	return c.S3.SSE.Mode, c.S3.SSE.KMSKeyID
+}
+
+// SFTPPort is sftp.port, 22 when unset.
+func (c *Config) SFTPPort() int {
+	if c.SFTP.Port > 0 {
+		return c.SFTP.Port
+	}
+	return 22
+}
+
+// SFTPKnownHostsFile is sftp.known_hosts_file, ~/.ssh/known_hosts when unset.
+func (c *Config) SFTPKnownHostsFile() string {
+	if c.SFTP.KnownHostsFile != "" {
+		return c.SFTP.KnownHostsFile
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".ssh", "known_hosts")
+	}
+	return filepath.Join(home, ".ssh", "known_hosts")
+}
+
+// S3UploadPartSize is the multipart upload part size in bytes.
+func (c *Config) S3UploadPartSize() int64 {
+	if c.S3.UploadPartSizeMB > 0 {
+		return int64(c.S3.UploadPartSizeMB) << 20
+	}
+	return 64 << 20
+}
+
+// Backend names the enabled remote backend: gcs when gcs.enabled, sftp when sftp.enabled and s3
+// otherwise.
+func (c *Config) Backend() string {
+	switch {
+	case c.GCS.Enabled:
+		return BackendGCS
+	case c.SFTP.Enabled:
+		return BackendSFTP
+	}
+	return BackendS3
+}
+
+// RemoteEnabled reports whether s3, gcs or sftp is enabled.
+func (c *Config) RemoteEnabled() bool {
+	return c.S3.Enabled || c.GCS.Enabled || c.SFTP.Enabled
+}
+
+// ManifestStorageClass is the storage class of manifests on the enabled backend, empty for sftp,
+// which has none.
+func (c *Config) ManifestStorageClass() string {
+	switch {
+	case c.GCS.Enabled:
+		return c.GCS.StorageClass.Manifest
+	case c.SFTP.Enabled:
+		return ""
+	}
+	return c.S3.StorageClass.Manifest
+}
+
+// DataStorageClass is the storage class of backup data at level, from the storage_class.backup_data
+// of the enabled backend.
+func (c *Config) DataStorageClass(level int16) (string, error) {
+	if c.SFTP.Enabled && level >= 0 {
+		return "", nil
+	}
+	classes := c.S3.StorageClass.BackupData
+	if c.GCS.Enabled {
+		classes = c.GCS.StorageClass.BackupData
+	}
+	key := c.Backend() + ".storage_class.backup_data"
+	switch {
+	case level < 0:
+		return "", fmt.Errorf("invalid backup level %d", level)
+	case len(classes) == 0:
+		return "", fmt.Errorf("%s defines no storage class for backup level %d", key, level)
+	case int(level) >= len(classes):
+		return "", fmt.Errorf("%s defines storage classes for levels 0 to %d, not for backup level %d", key, len(classes)-1, level)
+	}
+	return classes[level], nil
+}
+
+// S3UploadConcurrency is the number of parts of one file uploaded in parallel.
+func (c *Config) S3UploadConcurrency() int {
+	if c.S3.UploadConcurrency > 0 {
+		return c.S3.UploadConcurrency
+	}
+	return 5
+}
+
+// HoldRetry is the retry policy of zfs hold and release, defaults filled in.
+func (c *Config) HoldRetry() zfs.HoldRetry {
+	retry := zfs.DefaultHoldRetry
+	if c.ZFS.Hold.MaxAttempts > 0 {
+		retry.Attempts = c.ZFS.Hold.MaxAttempts
+	}
+	if c.ZFS.Hold.Backoff > 0 {
+		retry.Backoff = time.Duration(c.ZFS.Hold.Backoff)
+	}
+	if c.ZFS.Hold.Timeout > 0 {
+		retry.Timeout = time.Duration(c.ZFS.Hold.Timeout)
+	}
+	return retry
+}
+
+// ShutdownGracePeriod is how long the parts in flight may take to finish once a backup is asked to stop.
+func (c *Config) ShutdownGracePeriod() time.Duration {
+	if c.ShutdownGrace != nil {
+		return time.Duration(*c.ShutdownGrace)
+	}
+	return time.Minute
+}
+
+func (c *Config) S3VerifyTTL() time.Duration {
+	if c.S3.VerifyTTL > 0 {
+		return time.Duration(c.S3.VerifyTTL)
+	}
+	return 5 * time.Minute
+}
+
+// validateS3Prefix keeps a per-task prefix below the global prefix.
+func validateS3Prefix(prefix string) error {
+	if strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("must not start with a slash")
+	}
+	for _, segment := range strings.Split(prefix, "/") {
+		if segment == ".." {
+			return fmt.Errorf("must not contain '..'")
+		}
+	}
+	return nil
+}
+
+// Recipients returns every configured age recipient string, age_public_key first.
+func (c *Config) Recipients() []string {
+	var recipients []string
+	if c.AgePublicKey != "" {
+		recipients = append(recipients, c.AgePublicKey)
+	}
+	return append(recipients, c.AgeRecipients...)
+}
+
+// Mode returns the task's incremental mode, chain unless configured otherwise.
+func (t *Task) Mode() string {
+	if t.IncrementalMode != "" {
+		return t.IncrementalMode
+	}
+	return manifest.ModeChain
+}
+
+// Policy returns the task's parent policy, previous_level unless configured otherwise.
+func (t *Task) Policy() string {
+	if t.ParentPolicy != "" {
+		return t.ParentPolicy
+	}
+	return manifest.PolicyPreviousLevel
+}
+
+// StagingRoot returns the directory holding the task/ hierarchy of t: its staging_dir, else the
+// global staging_dir, else base_dir. A nil t yields the global one.
+func (c *Config) StagingRoot(t *Task) string {
+	if t != nil && t.StagingDir != "" {
+		return t.StagingDir
+	}
+	if c.StagingDir != "" {
+		return c.StagingDir
+	}
+	return c.BaseDir
+}
+
+// validatePartSize checks a part_size, which is unset when 0.
+func validatePartSize(size units.Bytes) error {
+	if size != 0 && (size < zfs.MinPartSize || size > zfs.MaxPartSize) {
+		return fmt.Errorf("must be between %s and %s, got %s", units.FormatSize(zfs.MinPartSize), units.FormatSize(zfs.MaxPartSize), units.FormatSize(int64(size)))
+	}
+	return nil
+}
+
+// PartSizeBytes returns the size the stream of t is split at: its part_size, else the global
+// part_size, else zfs.PartSize.
+func (c *Config) PartSizeBytes(t *Task) int64 {
+	if t != nil && t.PartSize > 0 {
+		return int64(t.PartSize)
+	}
+	if c.PartSize > 0 {
+		return int64(c.PartSize)
+	}
+	return zfs.PartSize
+}
+
+// WorkerCount is the number of parts a backup or restore processes in parallel.
+func (c *Config) WorkerCount() int {
+	if c.Workers > 0 {
+		return c.Workers
+	}
+	return 4
+}
+
+// TaskRoot returns the task/ directory below StagingRoot, which holds pool/dataset/levelN/YYYYMMDD.
+func (c *Config) TaskRoot(t *Task) string {
+	return filepath.Join(c.StagingRoot(t), "task")
+}
+
+// Uploads reports whether backups of t go to the remote backend: the task's upload setting, else
+// whether s3, gcs or sftp is enabled.
+func (c *Config) Uploads(t *Task) bool {
+	if t.Upload != nil {
+		return c.RemoteEnabled() && *t.Upload
+	}
+	return c.RemoteEnabled()
+}
+
+// HookTimeout is how long each hook of the task may run.
+func (t *Task) HookTimeout() time.Duration {
+	if t.Hooks.Timeout > 0 {
+		return time.Duration(t.Hooks.Timeout)
+	}
+	return 5 * time.Minute
+}
+
+// Bounds returns the start and end of the window as offsets from midnight, and its time zone.
+func (w *UploadWindow) Bounds() (start, end time.Duration, loc *time.Location, err error) {
+	if start, err = parseClock(w.Start); err != nil {
+		return 0, 0, nil, fmt.Errorf("start %w", err)
+	}
+	if end, err = parseClock(w.End); err != nil {
+		return 0, 0, nil, fmt.Errorf("end %w", err)
+	}
+	if start == end {
+		return 0, 0, nil, fmt.Errorf("start and end are both %s, leaving an empty window", w.Start)
+	}
+	loc = time.Local
+	if w.Timezone != "" {
+		if loc, err = time.LoadLocation(w.Timezone); err != nil {
+			return 0, 0, nil, fmt.Errorf("unknown timezone %q: %w", w.Timezone, err)
+		}
+	}
+	return start, end, loc, nil
+}
+
+// parseClock parses a time of day such as 06:30 into its offset from midnight.
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("must be a time of day such as 06:30, got %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Modes returns file_mode and dir_mode, zero when unset.
+func (c *Config) Modes() (file, dir os.FileMode) {
+	file, _ = parseMode(c.FileMode)
+	dir, _ = parseMode(c.DirMode)
+	return file, dir
+}
+
+// parseMode parses a permission mode in octal, such as 0640; empty yields zero.
+func parseMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("must be an octal permission mode such as 0640, got %q", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// DedupChunkSize returns the average dedup_store chunk size in bytes.
+func (t *Task) DedupChunkSize() int {
+	if t.DedupChunkSizeMB > 0 {
+		return int(t.DedupChunkSizeMB) << 20
+	}
+	return 4 << 20
+}
+
+// ChangesMaxSize returns how many bytes of zfs diff output record_changes stores.
+func (t *Task) ChangesMaxSize() int64 {
+	if t.RecordChangesMaxSize > 0 {
+		return int64(t.RecordChangesMaxSize)
+	}
+	return 16 << 20
+}
+
+func (t *Task) SingleFileMaxSize() int64 {
+	if t.SingleFileMaxSizeGB > 0 {
+		return int64(t.SingleFileMaxSizeGB) << 30
+	}
+	return 3 << 30
+}
@@ -1,71 +1,109 @@
 package config
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+	"zrb/internal/units"
+	"zrb/internal/util"
+	"zrb/internal/zfs"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 func TestS3RetryAttempts(t *testing.T) {
-	tests := []struct {
-		name   string
-		config *Config
-		want   int
-	}{
-		{
-			name: "custom retry attempts",
-			config: &Config{
-				S3: S3Config{
-					Retry: struct {
-						MaxAttempts int `yaml:"max_attempts"`
-					}{
-						MaxAttempts: 5,
-					},
-				},
-			},
-			want: 5,
-		},
-		{
-			name: "default retry attempts",
-			config: &Config{
-				S3: S3Config{
-					Retry: struct {
-						MaxAttempts int `yaml:"max_attempts"`
-					}{
-						MaxAttempts: 0,
-					},
-				},
-			},
-			want: 3,
-		},
-		{
-			name: "zero retry config",
-			config: &Config{
-				S3: S3Config{},
-			},
-			want: 3,
-		},
-	}
+	cfg := &Config{}
+	assert.Equal(t, 3, cfg.S3RetryAttempts(), "zero retry config")
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got := tt.config.S3RetryAttempts()
-			assert.Equal(t, tt.want, got)
-		})
-	}
+	cfg.S3.Retry.MaxAttempts = 5
+	assert.Equal(t, 5, cfg.S3RetryAttempts())
+}
+
+func TestS3RetryPolicy(t *testing.T) {
+	cfg := &Config{}
+	assert.Equal(t, RetryStandard, cfg.S3RetryMode())
+	assert.Equal(t, 20*time.Second, cfg.S3RetryMaxBackoff())
+
+	cfg.S3.Retry.Mode = RetryAdaptive
+	cfg.S3.Retry.MaxBackoff = units.Duration(30 * time.Second)
+	assert.Equal(t, RetryAdaptive, cfg.S3RetryMode())
+	assert.Equal(t, 30*time.Second, cfg.S3RetryMaxBackoff())
+}
+
+func TestS3Upload(t *testing.T) {
+	cfg := &Config{}
+	assert.Equal(t, int64(64<<20), cfg.S3UploadPartSize())
+	assert.Equal(t, 5, cfg.S3UploadConcurrency())
+
+	cfg.S3.UploadPartSizeMB = 8
+	cfg.S3.UploadConcurrency = 2
+	assert.Equal(t, int64(8<<20), cfg.S3UploadPartSize())
+	assert.Equal(t, 2, cfg.S3UploadConcurrency())
+}
+
+func TestDataStorageClass(t *testing.T) {
+	cfg := &Config{}
+	_, err := cfg.DataStorageClass(0)
+	assert.EqualError(t, err, "s3.storage_class.backup_data defines no storage class for backup level 0")
+
+	cfg.S3.StorageClass.BackupData = []string{"STANDARD", "STANDARD_IA"}
+	class, err := cfg.DataStorageClass(1)
+	require.NoError(t, err)
+	assert.Equal(t, "STANDARD_IA", class)
+
+	_, err = cfg.DataStorageClass(2)
+	assert.EqualError(t, err, "s3.storage_class.backup_data defines storage classes for levels 0 to 1, not for backup level 2")
+	_, err = cfg.DataStorageClass(-1)
+	assert.EqualError(t, err, "invalid backup level -1")
+
+	cfg.GCS.Enabled = true
+	cfg.GCS.StorageClass.BackupData = []string{"NEARLINE"}
+	class, err = cfg.DataStorageClass(0)
+	require.NoError(t, err)
+	assert.Equal(t, "NEARLINE", class)
+	_, err = cfg.DataStorageClass(1)
+	assert.EqualError(t, err, "gcs.storage_class.backup_data defines storage classes for levels 0 to 0, not for backup level 1")
+}
+
+func TestHoldRetry(t *testing.T) {
+	cfg := &Config{}
+	assert.Equal(t, zfs.DefaultHoldRetry, cfg.HoldRetry())
+
+	cfg.ZFS.Hold.MaxAttempts = 6
+	cfg.ZFS.Hold.Backoff = units.Duration(10 * time.Second)
+	assert.Equal(t, zfs.HoldRetry{Attempts: 6, Backoff: 10 * time.Second, Timeout: 30 * time.Second}, cfg.HoldRetry())
+}
+
+func TestShutdownGracePeriod(t *testing.T) {
+	cfg := &Config{}
+	assert.Equal(t, time.Minute, cfg.ShutdownGracePeriod())
+
+	grace := units.Duration(0)
+	cfg.ShutdownGrace = &grace
+	assert.Zero(t, cfg.ShutdownGracePeriod(), "0s stops at once")
+}
+
+func TestVerifiesUploads(t *testing.T) {
+	off := false
+	assert.True(t, (&Config{}).VerifiesUploads(), "on by default")
+	assert.False(t, (&Config{VerifyAfterUpload: &off}).VerifiesUploads())
 }
 
 func TestValidate(t *testing.T) {
 	validConfig := func() *Config {
-		return &Config{
+		cfg := &Config{
 			BaseDir:      "/tmp/zrb",
 			AgePublicKey: "age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p",
 			Tasks: []Task{
 				{Name: "t1", Pool: "p1", Dataset: "d1", Enabled: true},
 			},
 		}
+		cfg.S3.StorageClass.Manifest = "STANDARD"
+		return cfg
 	}
 
 	t.Run("valid config", func(t *testing.T) {
@@ -84,6 +122,122 @@ func TestValidate(t *testing.T) {
 		assert.ErrorContains(t, cfg.Validate(), "age_public_key is required")
 	})
 
+	t.Run("age_recipients without age_public_key", func(t *testing.T) {
+		cfg := validConfig()
+		cfg.AgePublicKey = ""
+		cfg.AgeRecipients = []string{"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"}
+		require.NoError(t, cfg.Validate())
+		assert.Equal(t, cfg.AgeRecipients, cfg.Recipients())
+	})
+
+	t.Run("upload without s3", func(t *testing.T) {
+		cfg := validConfig()
+		on := true
+		cfg.Tasks[0].Upload = &on
+		assert.ErrorContains(t, cfg.Validate(), "tasks[0].upload requires s3.enabled")
+	})
+
+	t.Run("upload part size out of range", func(t *testing.T) {
+		cfg := validConfig()
+		cfg.S3 = S3Config{Enabled: true, Bucket: "b", Region: "r"}
+		cfg.S3.StorageClass.BackupData = []string{"STANDARD"}
+		cfg.S3.StorageClass.Manifest = "STANDARD"
+		cfg.S3.UploadPartSizeMB = 4
+		assert.ErrorContains(t, cfg.Validate(), "s3.upload_part_size_mb must be between 5 and 5120")
+		cfg.S3.UploadPartSizeMB = 5
+		assert.NoError(t, cfg.Validate())
+		cfg.S3.UploadConcurrency = -1
+		assert.ErrorContains(t, cfg.Validate(), "s3.upload_concurrency must be non-negative")
+	})
+
+	t.Run("transfer budget", func(t *testing.T) {
+		cfg := validConfig()
+		cfg.S3 = S3Config{Enabled: true, Bucket: "b", Region: "r", MaxDownloadBytesPerRestore: 1 << 30, OnBudgetExceeded: BudgetFail}
+		cfg.S3.StorageClass.BackupData = []string{"STANDARD"}
+		cfg.S3.StorageClass.Manifest = "STANDARD"
+		assert.NoError(t, cfg.Validate())
+		cfg.S3.OnBudgetExceeded = "ignore"
+		assert.ErrorContains(t, cfg.Validate(), `s3.on_budget_exceeded must be pause or fail, got "ignore"`)
+		cfg.S3.OnBudgetExceeded = ""
+		cfg.S3.MaxUploadBytesPerBackup = -1
+		assert.ErrorContains(t, cfg.Validate(), "must be non-negative")
+	})
+
+	t.Run("s3 sse and acl", func(t *testing.T) {
+		cfg := validConfig()
+		cfg.S3 = S3Config{Enabled: true, Bucket: "b", Region: "r"}
+		cfg.S3.StorageClass.BackupData = []string{"STANDARD"}
+		cfg.S3.StorageClass.Manifest = "STANDARD"
+		for _, mode := range []string{"", SSENone, SSEAES256} {
+			cfg.S3.SSE.Mode = mode
+			assert.NoError(t, cfg.Validate(), mode)
+		}
+		cfg.S3.SSE.Mode = SSEKMS
+		assert.EqualError(t, cfg.Validate(), "s3.sse.kms_key_id is required with s3.sse.mode aws:kms")
+		cfg.S3.SSE.KMSKeyID = "alias/backups"
+		assert.NoError(t, cfg.Validate())
+		cfg.S3.SSE.Mode = SSEAES256
+		assert.EqualError(t, cfg.Validate(), "s3.sse.kms_key_id only applies to s3.sse.mode aws:kms")
+		cfg.S3.SSE.Mode, cfg.S3.SSE.KMSKeyID = "kms", ""
+		assert.EqualError(t, cfg.Validate(), `s3.sse.mode must be none, AES256 or aws:kms, got "kms"`)
+
+		cfg.S3.SSE.Mode = ""
+		cfg.S3.ObjectACL = "bucket-owner-full-control"
+		assert.NoError(t, cfg.Validate())
+		cfg.S3.ObjectACL = "owner"
+		assert.ErrorContains(t, cfg.Validate(), `s3.object_acl must be one of private, `)
+	})
+
+	t.Run("s3 retry", func(t *testing.T) {
+		cfg := validConfig()
+		cfg.S3 = S3Config{Enabled: true, Bucket: "b", Region: "r"}
+		cfg.S3.StorageClass.BackupData = []string{"STANDARD"}
+		cfg.S3.StorageClass.Manifest = "STANDARD"
+		cfg.S3.Retry.Mode = RetryAdaptive
+		cfg.S3.Retry.MaxBackoff = units.Duration(30 * time.Second)
+		assert.NoError(t, cfg.Validate())
+
+		for _, tt := range []struct {
+			name   string
+			change func(*Config)
+			want   string
+		}{
+			{"unknown mode", func(c *Config) { c.S3.Retry.Mode = "legacy" }, `s3.retry.mode must be standard or adaptive, got "legacy"`},
+			{"negative attempts", func(c *Config) { c.S3.Retry.MaxAttempts = -1 }, "s3.retry.max_attempts must be non-negative"},
+			{"negative backoff", func(c *Config) { c.S3.Retry.InitialBackoff = units.Duration(-time.Second) }, "must be non-negative"},
+			{"initial over max", func(c *Config) { c.S3.Retry.InitialBackoff = units.Duration(time.Minute) }, "s3.retry.initial_backoff 1m0s exceeds s3.retry.max_backoff 30s"},
+			{"initial over default max", func(c *Config) { c.S3.Retry.MaxBackoff, c.S3.Retry.InitialBackoff = 0, units.Duration(25*time.Second) }, "exceeds s3.retry.max_backoff 20s"},
+			{"backoff without retries", func(c *Config) { c.S3.Retry.MaxAttempts = 1 }, "s3.retry.max_attempts 1 never retries"},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				cfg := *cfg
+				tt.change(&cfg)
+				assert.ErrorContains(t, cfg.Validate(), tt.want)
+			})
+		}
+	})
+
+	t.Run("s3 preflight", func(t *testing.T) {
+		cfg := validConfig()
+		cfg.S3 = S3Config{Enabled: true, Bucket: "b", Region: "r"}
+		cfg.S3.StorageClass.BackupData = []string{"STANDARD"}
+		cfg.S3.StorageClass.Manifest = "STANDARD"
+		assert.Equal(t, PreflightStrict, cfg.S3Preflight())
+
+		cfg.S3.Preflight = PreflightDeferred
+		assert.NoError(t, cfg.Validate())
+		assert.Equal(t, PreflightDeferred, cfg.S3Preflight())
+
+		cfg.S3.Preflight = "lazy"
+		assert.EqualError(t, cfg.Validate(), `s3.preflight must be strict, deferred or skip, got "lazy"`)
+	})
+
+	t.Run("empty age_recipients entry", func(t *testing.T) {
+		cfg := validConfig()
+		cfg.AgeRecipients = []string{" "}
+		assert.ErrorContains(t, cfg.Validate(), "age_recipients[0] is empty")
+	})
+
 	t.Run("invalid age_public_key prefix", func(t *testing.T) {
 		cfg := validConfig()
 		cfg.AgePublicKey = "invalid-key"
@@ -114,11 +268,233 @@ func TestValidate(t *testing.T) {
 		assert.ErrorContains(t, cfg.Validate(), "tasks[0].dataset is required")
 	})
 
+	t.Run("valid s3_prefix", func(t *testing.T) {
+		cfg := validConfig()
+		cfg.Tasks[0].S3Prefix = "hosts/nas-1"
+		require.NoError(t, cfg.Validate())
+	})
+
+	t.Run("s3_prefix with leading slash", func(t *testing.T) {
+		cfg := validConfig()
+		cfg.Tasks[0].S3Prefix = "/nas-1"
+		assert.ErrorContains(t, cfg.Validate(), "tasks[0].s3_prefix must not start with a slash")
+	})
+
+	t.Run("s3_prefix escaping the global prefix", func(t *testing.T) {
+		cfg := validConfig()
+		cfg.Tasks[0].S3Prefix = "nas-1/../other"
+		assert.ErrorContains(t, cfg.Validate(), "tasks[0].s3_prefix must not contain '..'")
+	})
+
+	t.Run("unknown incremental_mode", func(t *testing.T) {
+		cfg := validConfig()
+		cfg.Tasks[0].IncrementalMode = "cumulative"
+		assert.ErrorContains(t, cfg.Validate(), "tasks[0].incremental_mode must be chain or differential")
+	})
+
+	t.Run("differential incremental_mode", func(t *testing.T) {
+		cfg := validConfig()
+		cfg.Tasks[0].IncrementalMode = "differential"
+		require.NoError(t, cfg.Validate())
+		assert.Equal(t, "differential", cfg.Tasks[0].Mode())
+	})
+
+	t.Run("parent_policy", func(t *testing.T) {
+		cfg := validConfig()
+		assert.Equal(t, "previous_level", cfg.Tasks[0].Policy())
+
+		cfg.Tasks[0].ParentPolicy = "oldest"
+		assert.ErrorContains(t, cfg.Validate(), "tasks[0].parent_policy must be previous_level, latest_any or same_level")
+
+		cfg.Tasks[0].ParentPolicy = "same_level"
+		require.NoError(t, cfg.Validate())
+		assert.Equal(t, "same_level", cfg.Tasks[0].Policy())
+
+		cfg.Tasks[0].IncrementalMode = "differential"
+		assert.ErrorContains(t, cfg.Validate(), "cannot be combined with incremental_mode differential")
+	})
+
+	t.Run("staging_dir", func(t *testing.T) {
+		cfg := validConfig()
+		assert.Equal(t, filepath.Join(cfg.BaseDir, "task"), cfg.TaskRoot(&cfg.Tasks[0]))
+
+		cfg.StagingDir = "scratch"
+		assert.ErrorContains(t, cfg.Validate(), "staging_dir must be an absolute path")
+
+		cfg.StagingDir = "/scratch"
+		cfg.Tasks[0].StagingDir = "fast"
+		assert.ErrorContains(t, cfg.Validate(), "tasks[0].staging_dir must be an absolute path")
+
+		cfg.Tasks[0].StagingDir = "/fast"
+		require.NoError(t, cfg.Validate())
+		assert.Equal(t, "/fast/task", cfg.TaskRoot(&cfg.Tasks[0]))
+		assert.Equal(t, "/scratch/task", cfg.TaskRoot(nil))
+	})
+
+	t.Run("part_size", func(t *testing.T) {
+		cfg := validConfig()
+		assert.Equal(t, int64(3<<30), cfg.PartSizeBytes(&cfg.Tasks[0]))
+
+		cfg.PartSize = 1 << 30
+		assert.Equal(t, int64(1<<30), cfg.PartSizeBytes(&cfg.Tasks[0]))
+		cfg.Tasks[0].PartSize = 512 << 20
+		require.NoError(t, cfg.Validate())
+		assert.Equal(t, int64(512<<20), cfg.PartSizeBytes(&cfg.Tasks[0]))
+
+		cfg.Tasks[0].PartSize = 1 << 20
+		assert.EqualError(t, cfg.Validate(), "tasks[0].part_size must be between 64M and 64G, got 1M")
+		cfg.Tasks[0].PartSize = 0
+		cfg.PartSize = 100 << 30
+		assert.EqualError(t, cfg.Validate(), "part_size must be between 64M and 64G, got 100G")
+	})
+
+	t.Run("workers", func(t *testing.T) {
+		cfg := validConfig()
+		assert.Equal(t, 4, cfg.WorkerCount())
+
+		cfg.Workers = 8
+		require.NoError(t, cfg.Validate())
+		assert.Equal(t, 8, cfg.WorkerCount())
+
+		cfg.Workers = -1
+		assert.EqualError(t, cfg.Validate(), "workers must be non-negative")
+	})
+
+	t.Run("dedup_store", func(t *testing.T) {
+		cfg := validConfig()
+		cfg.S3.Enabled = true
+		cfg.S3.Bucket = "my-bucket"
+		cfg.S3.Region = "us-east-1"
+		cfg.S3.StorageClass.BackupData = []string{"STANDARD"}
+		cfg.Tasks[0].DedupStore = true
+		require.NoError(t, cfg.Validate())
+		assert.Equal(t, 4<<20, cfg.Tasks[0].DedupChunkSize())
+
+		cfg.Tasks[0].DedupChunkSizeMB = 3
+		assert.ErrorContains(t, cfg.Validate(), "tasks[0].dedup_chunk_size_mb must be a power of two, got 3")
+		cfg.Tasks[0].DedupChunkSizeMB = 8
+		assert.Equal(t, 8<<20, cfg.Tasks[0].DedupChunkSize())
+
+		cfg.Tasks[0].SingleFile = true
+		assert.ErrorContains(t, cfg.Validate(), "tasks[0].dedup_store cannot be combined with single_file")
+
+		cfg.Tasks[0].SingleFile = false
+		upload := false
+		cfg.Tasks[0].Upload = &upload
+		assert.ErrorContains(t, cfg.Validate(), "tasks[0].dedup_store requires uploads")
+	})
+
+	t.Run("inline_encryption", func(t *testing.T) {
+		cfg := validConfig()
+		cfg.Tasks[0].InlineEncryption = true
+		require.NoError(t, cfg.Validate())
+
+		cfg.Tasks[0].SingleFile = true
+		assert.ErrorContains(t, cfg.Validate(), "tasks[0].inline_encryption applies to split parts")
+	})
+
+	t.Run("max_stream_size", func(t *testing.T) {
+		cfg := validConfig()
+		cfg.Tasks[0].MaxStreamSize = units.Limit{Factor: 3}
+		require.NoError(t, cfg.Validate())
+		cfg.Tasks[0].MaxStreamSize = units.Limit{Bytes: 500 << 30}
+		require.NoError(t, cfg.Validate())
+		cfg.Tasks[0].MaxStreamSize = units.Limit{Factor: 0.5}
+		assert.EqualError(t, cfg.Validate(), "tasks[0].max_stream_size must be a size or a multiple of at least 1x, got 0.5x")
+		cfg.Tasks[0].MaxStreamSize = units.Limit{Bytes: -1}
+		assert.ErrorContains(t, cfg.Validate(), "tasks[0].max_stream_size must be")
+	})
+
+	t.Run("file and dir modes", func(t *testing.T) {
+		cfg := validConfig()
+		cfg.FileMode, cfg.DirMode = "0660", "770"
+		require.NoError(t, cfg.Validate())
+		file, dir := cfg.Modes()
+		assert.Equal(t, os.FileMode(0o660), file)
+		assert.Equal(t, os.FileMode(0o770), dir)
+		cfg.FileMode = "rw-rw----"
+		assert.EqualError(t, cfg.Validate(), `file_mode must be an octal permission mode such as 0640, got "rw-rw----"`)
+		cfg.FileMode, cfg.DirMode = "", "4755"
+		assert.ErrorContains(t, cfg.Validate(), "dir_mode must be an octal permission mode")
+	})
+
+	t.Run("retention", func(t *testing.T) {
+		cfg := validConfig()
+		cfg.Tasks[0].Retention = &Retention{KeepLast: 3}
+		require.NoError(t, cfg.Validate())
+		cfg.Tasks[0].Retention = &Retention{}
+		assert.EqualError(t, cfg.Validate(), "tasks[0].retention needs keep_last or keep_days")
+		cfg.Tasks[0].Retention = &Retention{KeepLast: 3, KeepDays: -1}
+		assert.EqualError(t, cfg.Validate(), "tasks[0].retention.keep_last and keep_days must be non-negative")
+	})
+
+	t.Run("upload window", func(t *testing.T) {
+		cfg := validConfig()
+		cfg.Tasks[0].UploadWindow = &UploadWindow{Start: "22:00", End: "6:30", Timezone: "Europe/Berlin"}
+		require.NoError(t, cfg.Validate())
+		start, end, loc, err := cfg.Tasks[0].UploadWindow.Bounds()
+		require.NoError(t, err)
+		assert.Equal(t, 22*time.Hour, start)
+		assert.Equal(t, 6*time.Hour+30*time.Minute, end)
+		assert.Equal(t, "Europe/Berlin", loc.String())
+
+		cfg.Tasks[0].UploadWindow.End = "24:00"
+		assert.EqualError(t, cfg.Validate(), `tasks[0].upload_window: end must be a time of day such as 06:30, got "24:00"`)
+		cfg.Tasks[0].UploadWindow.End = "22:00"
+		assert.EqualError(t, cfg.Validate(), "tasks[0].upload_window: start and end are both 22:00, leaving an empty window")
+		cfg.Tasks[0].UploadWindow.End, cfg.Tasks[0].UploadWindow.Timezone = "06:00", "Mars/Olympus"
+		assert.ErrorContains(t, cfg.Validate(), `tasks[0].upload_window: unknown timezone "Mars/Olympus"`)
+	})
+
+	t.Run("gcs", func(t *testing.T) {
+		cfg := validConfig()
+		cfg.GCS.Enabled = true
+		cfg.GCS.Bucket = "my-bucket"
+		cfg.GCS.StorageClass.Manifest = "STANDARD"
+		cfg.GCS.StorageClass.BackupData = []string{"NEARLINE", "COLDLINE"}
+		require.NoError(t, cfg.Validate())
+		assert.True(t, cfg.Uploads(&cfg.Tasks[0]))
+		assert.Equal(t, BackendGCS, cfg.Backend())
+
+		cfg.GCS.StorageClass.BackupData = []string{"GLACIER"}
+		assert.EqualError(t, cfg.Validate(), `gcs.storage_class.backup_data[0] must be one of [STANDARD NEARLINE COLDLINE ARCHIVE], got "GLACIER"`)
+
+		cfg.GCS.StorageClass.BackupData = []string{"STANDARD"}
+		cfg.GCS.Bucket = ""
+		assert.EqualError(t, cfg.Validate(), "gcs.bucket is required when gcs is enabled")
+
+		cfg.GCS.Bucket = "my-bucket"
+		cfg.S3.Enabled = true
+		assert.EqualError(t, cfg.Validate(), "s3.enabled and gcs.enabled cannot both be set")
+	})
+
+	t.Run("sftp", func(t *testing.T) {
+		cfg := validConfig()
+		cfg.SFTP = SFTPConfig{Enabled: true, Host: "backup.example.com", User: "zrb", KeyFile: "/etc/zrb/id_ed25519", BasePath: "/srv/zrb"}
+		require.NoError(t, cfg.Validate())
+		assert.True(t, cfg.Uploads(&cfg.Tasks[0]))
+		assert.Equal(t, BackendSFTP, cfg.Backend())
+		assert.Equal(t, 22, cfg.SFTPPort())
+		assert.Empty(t, cfg.ManifestStorageClass())
+		class, err := cfg.DataStorageClass(3)
+		require.NoError(t, err)
+		assert.Empty(t, class)
+
+		cfg.SFTP.BasePath = "zrb"
+		assert.EqualError(t, cfg.Validate(), `sftp.base_path must be an absolute path on the server, got "zrb"`)
+		cfg.SFTP.BasePath, cfg.SFTP.KeyFile = "/srv/zrb", ""
+		assert.EqualError(t, cfg.Validate(), "sftp.key_file is required when sftp is enabled")
+
+		cfg.SFTP.KeyFile = "/etc/zrb/id_ed25519"
+		cfg.S3.Enabled = true
+		assert.EqualError(t, cfg.Validate(), "sftp.enabled cannot be combined with s3.enabled or gcs.enabled")
+	})
+
 	t.Run("s3 enabled without bucket", func(t *testing.T) {
 		cfg := validConfig()
 		cfg.S3.Enabled = true
 		cfg.S3.Region = "us-east-1"
-		cfg.S3.StorageClass.BackupData = []types.StorageClass{"STANDARD"}
+		cfg.S3.StorageClass.BackupData = []string{"STANDARD"}
 		assert.ErrorContains(t, cfg.Validate(), "s3.bucket is required")
 	})
 
@@ -126,10 +502,25 @@ func TestValidate(t *testing.T) {
 		cfg := validConfig()
 		cfg.S3.Enabled = true
 		cfg.S3.Bucket = "my-bucket"
-		cfg.S3.StorageClass.BackupData = []types.StorageClass{"STANDARD"}
+		cfg.S3.StorageClass.BackupData = []string{"STANDARD"}
 		assert.ErrorContains(t, cfg.Validate(), "s3.region is required")
 	})
 
+	t.Run("s3 storage classes", func(t *testing.T) {
+		cfg := validConfig()
+		cfg.S3.Enabled = true
+		cfg.S3.Bucket = "my-bucket"
+		cfg.S3.Region = "us-east-1"
+		cfg.S3.StorageClass.BackupData = []string{"DEEP_ARCHIVE", "GLACIER_IR"}
+		require.NoError(t, cfg.Validate())
+
+		cfg.S3.StorageClass.BackupData = []string{"DEEP_ARCHIVE", "glacier"}
+		assert.ErrorContains(t, cfg.Validate(), `s3.storage_class.backup_data[1] must be one of [STANDARD REDUCED_REDUNDANCY`)
+		cfg.S3.StorageClass.BackupData = []string{"STANDARD"}
+		cfg.S3.StorageClass.Manifest = "NEARLINE"
+		assert.ErrorContains(t, cfg.Validate(), `got "NEARLINE"`)
+	})
+
 	t.Run("s3 enabled without storage classes", func(t *testing.T) {
 		cfg := validConfig()
 		cfg.S3.Enabled = true
@@ -143,7 +534,7 @@ func TestValidate(t *testing.T) {
 		cfg.S3.Enabled = true
 		cfg.S3.Bucket = "my-bucket"
 		cfg.S3.Region = "us-east-1"
-		cfg.S3.StorageClass.BackupData = []types.StorageClass{"STANDARD"}
+		cfg.S3.StorageClass.BackupData = []string{"STANDARD"}
 		require.NoError(t, cfg.Validate())
 	})
 }
@@ -201,3 +592,332 @@ func TestFindTask(t *testing.T) {
 		})
 	}
 }
+
+func TestSelectTasks(t *testing.T) {
+	cfg := &Config{Tasks: []Task{
+		{Name: "prod-db"}, {Name: "prod-web"}, {Name: "Prod-mail"}, {Name: "staging-db"}, {Name: "media[old]"}, {Name: "a*b"},
+	}}
+
+	tests := []struct {
+		name      string
+		selectors []string
+		want      []string
+		wantErr   string
+	}{
+		{name: "exact name", selectors: []string{"prod-db"}, want: []string{"prod-db"}},
+		{name: "glob is case sensitive", selectors: []string{"prod-*"}, want: []string{"prod-db", "prod-web"}},
+		{name: "glob across prefixes", selectors: []string{"*-db"}, want: []string{"prod-db", "staging-db"}},
+		{name: "single character", selectors: []string{"?rod-*"}, want: []string{"prod-db", "prod-web", "Prod-mail"}},
+		{name: "character class", selectors: []string{"[pP]rod-[dm]*"}, want: []string{"prod-db", "Prod-mail"}},
+		{name: "config order and no duplicates", selectors: []string{"staging-db", "prod-*", "prod-db"}, want: []string{"prod-db", "prod-web", "staging-db"}},
+		{name: "name with glob characters matches itself", selectors: []string{"media[old]"}, want: []string{"media[old]"}},
+		{name: "star in a name also globs", selectors: []string{"a*b"}, want: []string{"a*b"}},
+		{name: "escaped glob character", selectors: []string{`media\[*`}, want: []string{"media[old]"}},
+		{name: "no match", selectors: []string{"PROD-*"}, wantErr: `no task matches "PROD-*"`},
+		{name: "one of several does not match", selectors: []string{"prod-db", "dev-*"}, wantErr: `no task matches "dev-*"`},
+		{name: "malformed pattern", selectors: []string{"prod-[db"}, wantErr: `invalid --task pattern "prod-[db"`},
+		{name: "no selector", wantErr: "--task is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cfg.SelectTasks(tt.selectors)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	cfg := &Config{S3: S3Config{Enabled: true}}
+	cfg.S3.StorageClass.Manifest = "STANDARD"
+	assert.Empty(t, cfg.Warnings())
+
+	cfg.S3.StorageClass.Manifest = "GLACIER"
+	assert.Len(t, cfg.Warnings(), 1)
+
+	cfg.S3.StorageClass.Manifest = "STANDARD"
+	cfg.Tasks = []Task{{Name: "local", Upload: new(bool)}}
+	require.Len(t, cfg.Warnings(), 1)
+	assert.Contains(t, cfg.Warnings()[0], "task local has upload: false")
+}
+
+func TestUploads(t *testing.T) {
+	on, off := true, false
+	cfg := &Config{S3: S3Config{Enabled: true}}
+	assert.True(t, cfg.Uploads(&Task{}))
+	assert.True(t, cfg.Uploads(&Task{Upload: &on}))
+	assert.False(t, cfg.Uploads(&Task{Upload: &off}))
+
+	cfg.S3.Enabled = false
+	assert.False(t, cfg.Uploads(&Task{}))
+	assert.False(t, cfg.Uploads(&Task{Upload: &on}))
+}
+
+func TestResolveStandalone(t *testing.T) {
+	full := Standalone{Bucket: "b", Region: "r", Prefix: "p/", Pool: "tank", Dataset: "data/sub"}
+
+	t.Run("builds config from flags", func(t *testing.T) {
+		cfg, task, err := Resolve("", "", full)
+		require.NoError(t, err)
+		assert.True(t, cfg.S3.Enabled)
+		assert.Equal(t, "b", cfg.S3.Bucket)
+		assert.Equal(t, "p/", cfg.S3.Prefix)
+		assert.Equal(t, "STANDARD", cfg.S3.StorageClass.Manifest)
+		assert.Equal(t, "tank", task.Pool)
+		assert.Equal(t, "data/sub", task.Dataset)
+		assert.Equal(t, "tank_data_sub", task.Name)
+		assert.Empty(t, task.S3Prefix)
+	})
+
+	t.Run("task prefix", func(t *testing.T) {
+		s := full
+		s.TaskPrefix = "nas-1"
+		_, task, err := Resolve("", "", s)
+		require.NoError(t, err)
+		assert.Equal(t, "nas-1", task.S3Prefix)
+
+		s.TaskPrefix = "../nas-1"
+		_, _, err = Resolve("", "", s)
+		assert.ErrorContains(t, err, "--task-prefix must not contain")
+	})
+
+	missing := map[string]func(s *Standalone){
+		"--region":  func(s *Standalone) { s.Region = "" },
+		"--pool":    func(s *Standalone) { s.Pool = "" },
+		"--dataset": func(s *Standalone) { s.Dataset = "" },
+	}
+	for flag, clear := range missing {
+		t.Run("missing "+flag, func(t *testing.T) {
+			s := full
+			clear(&s)
+			_, _, err := Resolve("", "", s)
+			assert.ErrorContains(t, err, flag+" is required")
+		})
+	}
+
+	t.Run("config mode requires task", func(t *testing.T) {
+		_, _, err := Resolve("zrb_config.yaml", "", Standalone{})
+		assert.ErrorContains(t, err, "--task is required")
+	})
+}
+
+const validConfig = `base_dir: /tmp/zrb
+age_public_key: age1qyqszqgpqyqszqgpqyqszqgpqyqszqgpqyqszqgpqyqszqgpqyqs3290gq
+s3:
+  enabled: true
+  bucket: b
+  region: r
+  prefix: p
+  storage_class:
+    manifest: STANDARD
+    backup_data:
+      - DEEP_ARCHIVE
+tasks:
+  - name: t
+    pool: tank
+    dataset: data
+    enabled: true
+`
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "zrb_config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	return path
+}
+
+func TestLoadStrict(t *testing.T) {
+	_, err := Load(writeConfig(t, validConfig))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		from    string
+		to      string
+		wantErr string
+	}{
+		{name: "misspelled top-level key", from: "age_public_key:", to: "age_publickey:", wantErr: "field age_publickey not found"},
+		{name: "misspelled nested key", from: "backup_data:", to: "backupdata:", wantErr: "field backupdata not found"},
+		{name: "misspelled task key", from: "    dataset:", to: "    datset:", wantErr: "field datset not found"},
+		{name: "list item mis-indented", from: "      - DEEP_ARCHIVE", to: "  - DEEP_ARCHIVE", wantErr: "failed to parse config"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := strings.Replace(validConfig, tt.from, tt.to, 1)
+			require.NotEqual(t, validConfig, content)
+
+			_, err := Load(writeConfig(t, content))
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestLoadUnits(t *testing.T) {
+	load := func(t *testing.T, s3, task string) (*Config, error) {
+		t.Helper()
+		content := strings.Replace(validConfig, "  prefix: p\n", "  prefix: p\n"+s3, 1) + task
+		return Load(writeConfig(t, content))
+	}
+
+	t.Run("plain numbers keep the unit of the field", func(t *testing.T) {
+		cfg, err := load(t, "  upload_part_size_mb: 16\n  max_upload_bytes_per_backup: 1000\n", "    min_used_mb: 100\n    single_file_max_size_gb: 2\n")
+		require.NoError(t, err)
+		assert.Equal(t, units.MiB(16), cfg.S3.UploadPartSizeMB)
+		assert.Equal(t, units.Bytes(1000), cfg.S3.MaxUploadBytesPerBackup)
+		assert.Equal(t, units.MiB(100), cfg.Tasks[0].MinUsedMB)
+		assert.Equal(t, int64(2<<30), cfg.Tasks[0].SingleFileMaxSize())
+	})
+
+	t.Run("sizes and durations with units", func(t *testing.T) {
+		cfg, err := load(t,
+			"  upload_part_size_mb: 1G\n  max_download_bytes_per_restore: 1.5GiB\n  verify_ttl: 1d\n  retry:\n    max_backoff: 1m30s\n",
+			"    dedup_chunk_size_mb: 8M\n    single_file_max_size_gb: 3G\n    hooks:\n      timeout: 2w\n")
+		require.NoError(t, err)
+		assert.Equal(t, units.MiB(1024), cfg.S3.UploadPartSizeMB)
+		assert.Equal(t, units.Bytes(3<<29), cfg.S3.MaxDownloadBytesPerRestore)
+		assert.Equal(t, 24*time.Hour, cfg.S3VerifyTTL())
+		assert.Equal(t, 90*time.Second, cfg.S3RetryMaxBackoff())
+		assert.Equal(t, 8<<20, cfg.Tasks[0].DedupChunkSize())
+		assert.Equal(t, int64(3<<30), cfg.Tasks[0].SingleFileMaxSize())
+		assert.Equal(t, 14*24*time.Hour, cfg.Tasks[0].HookTimeout())
+	})
+
+	t.Run("unquoted file mode", func(t *testing.T) {
+		cfg, err := Load(writeConfig(t, "file_mode: 0660\n"+validConfig))
+		require.NoError(t, err)
+		defer util.SetModes(0, 0)
+		assert.Equal(t, "0660", cfg.FileMode, "an octal-looking number keeps its digits")
+		assert.Equal(t, os.FileMode(0o660), util.FileMode(), "Load applies the modes")
+	})
+
+	tests := []struct {
+		name    string
+		s3      string
+		task    string
+		wantErr string
+	}{
+		{name: "unknown size unit", s3: "  upload_part_size_mb: 64X\n", wantErr: `line 8: s3.upload_part_size_mb: invalid size "64X": unknown unit "X"; want a byte count`},
+		{name: "size below the unit of the field", s3: "  upload_part_size_mb: 512K\n", wantErr: `s3.upload_part_size_mb: invalid size "512K": not a whole number of MiB`},
+		{name: "task field", task: "    min_used_mb: lots\n", wantErr: `tasks[0].min_used_mb: invalid size "lots"`},
+		{name: "duration without unit", s3: "  verify_ttl: 300\n", wantErr: `s3.verify_ttl: invalid duration "300": missing unit after 300; want a number with a unit`},
+		{name: "ambiguous duration", task: "    hooks:\n      timeout: 1M\n", wantErr: `tasks[0].hooks.timeout: invalid duration "1M": M is ambiguous`},
+		{name: "validation still applies", s3: "  upload_part_size_mb: 4M\n", wantErr: "s3.upload_part_size_mb must be between 5 and 5120"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := load(t, tt.s3, tt.task)
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+// includeTree writes a main config with include_dir: tasks.d and the given task files to a temp
+// directory and returns the main config path.
+func includeTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	main := strings.Replace(validConfig, "tasks:\n", "include_dir: tasks.d\ntasks:\n", 1)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "zrb.yaml"), []byte(main), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "tasks.d"), 0o755))
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "tasks.d", name), []byte(content), 0o644))
+	}
+	return filepath.Join(dir, "zrb.yaml")
+}
+
+func TestLoadIncludeDir(t *testing.T) {
+	task := func(name string) string {
+		return fmt.Sprintf("  - name: %s\n    pool: tank\n    dataset: %s\n    enabled: true\n", name, name)
+	}
+
+	t.Run("merges task files in name order", func(t *testing.T) {
+		path := includeTree(t, map[string]string{
+			"b-media.yaml": "tasks:\n" + task("media"),
+			"a-db.yaml":    "tasks:\n" + task("db") + task("logs"),
+			"notes.txt":    "not a task file",
+			"empty.yaml":   "",
+		})
+
+		cfg, err := Load(path)
+		require.NoError(t, err)
+		var names []string
+		for _, task := range cfg.Tasks {
+			names = append(names, task.Name)
+		}
+		assert.Equal(t, []string{"t", "db", "logs", "media"}, names)
+		assert.Equal(t, "b", cfg.S3.Bucket, "the main file's settings apply to every task")
+	})
+
+	t.Run("duplicate name across files", func(t *testing.T) {
+		path := includeTree(t, map[string]string{
+			"a.yaml": "tasks:\n" + task("db"),
+			"b.yaml": "tasks:\n" + task("web") + task("db"),
+		})
+		dir := filepath.Join(filepath.Dir(path), "tasks.d")
+
+		_, err := Load(path)
+		assert.ErrorContains(t, err, filepath.Join(dir, "b.yaml")+": tasks[1].name db is already used by "+filepath.Join(dir, "a.yaml")+": tasks[0]")
+	})
+
+	t.Run("duplicate of a main file task", func(t *testing.T) {
+		path := includeTree(t, map[string]string{"a.yaml": "tasks:\n" + task("t")})
+
+		_, err := Load(path)
+		assert.ErrorContains(t, err, "tasks[0].name t is already used by "+path+": tasks[0]")
+	})
+
+	t.Run("invalid task cites its file", func(t *testing.T) {
+		path := includeTree(t, map[string]string{"team.yaml": "tasks:\n" + task("db") + "  - name: web\n    pool: tank\n    enabled: true\n"})
+
+		_, err := Load(path)
+		assert.ErrorContains(t, err, filepath.Join(filepath.Dir(path), "tasks.d", "team.yaml")+": tasks[1].dataset is required")
+	})
+
+	t.Run("task files hold only tasks", func(t *testing.T) {
+		path := includeTree(t, map[string]string{"team.yaml": "base_dir: /elsewhere\ntasks:\n" + task("db")})
+
+		_, err := Load(path)
+		assert.ErrorContains(t, err, "team.yaml")
+		assert.ErrorContains(t, err, "field base_dir not found")
+	})
+
+	t.Run("missing include_dir", func(t *testing.T) {
+		path := includeTree(t, nil)
+		require.NoError(t, os.Remove(filepath.Join(filepath.Dir(path), "tasks.d")))
+
+		_, err := Load(path)
+		assert.ErrorContains(t, err, "failed to read include_dir")
+	})
+
+	t.Run("tasks only in include_dir", func(t *testing.T) {
+		path := includeTree(t, map[string]string{"a.yaml": "tasks:\n" + task("db")})
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		main, _, _ := strings.Cut(string(data), "tasks:\n")
+		require.NoError(t, os.WriteFile(path, []byte(main), 0o644))
+
+		cfg, err := Load(path)
+		require.NoError(t, err)
+		require.Len(t, cfg.Tasks, 1)
+		assert.Equal(t, "db", cfg.Tasks[0].Name)
+	})
+}
+
+func TestLoadEmpty(t *testing.T) {
+	_, err := Load(writeConfig(t, ""))
+	assert.ErrorContains(t, err, "is empty")
+}
+
+func TestSchemaMatchesDocs(t *testing.T) {
+	schema, err := Schema()
+	require.NoError(t, err)
+
+	docs, err := os.ReadFile("../../docs/config-schema.json")
+	require.NoError(t, err)
+	assert.Equal(t, string(docs), string(schema), "regenerate with: zrb config schema > docs/config-schema.json")
+}
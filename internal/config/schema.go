@@ -0,0 +1,142 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"zrb/internal/units"
+)
+
+// schemaNode is one JSON Schema object; field order matches the emitted key order.
+type schemaNode struct {
+	Schema string `json:"$schema,omitempty"`
+	// Type is a type name or a list of them.
+	Type        any         `json:"type"`
+	Properties  *properties `json:"properties,omitempty"`
+	Items       *schemaNode `json:"items,omitempty"`
+	Enum        []string    `json:"enum,omitempty"`
+	Minimum     *int        `json:"minimum,omitempty"`
+	Description string      `json:"description,omitempty"`
+	Required    []string    `json:"required,omitempty"`
+}
+
+// properties keeps struct field order, which encoding/json maps would sort away.
+type properties struct {
+	names []string
+	nodes []*schemaNode
+}
+
+func (p *properties) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, name := range p.names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := marshalJSON(p.nodes[i])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+var (
+	durationType = reflect.TypeOf(units.Duration(0))
+	sizeTypes    = []reflect.Type{reflect.TypeOf(units.Bytes(0)), reflect.TypeOf(units.MiB(0)), reflect.TypeOf(units.GiB(0)), reflect.TypeOf(units.Limit{})}
+)
+
+func schemaFor(t reflect.Type) *schemaNode {
+	if t == durationType {
+		return &schemaNode{Type: "string"}
+	}
+	// Sizes are plain numbers in the unit of the field or strings with a unit.
+	if slices.Contains(sizeTypes, t) {
+		return &schemaNode{Type: []string{"integer", "string"}}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return &schemaNode{Type: "string"}
+	case reflect.Bool:
+		return &schemaNode{Type: "boolean"}
+	case reflect.Pointer:
+		return schemaFor(t.Elem())
+	case reflect.Int, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &schemaNode{Type: "integer"}
+	case reflect.Slice:
+		return &schemaNode{Type: "array", Items: schemaFor(t.Elem())}
+	case reflect.Struct:
+		node := &schemaNode{Type: "object", Properties: &properties{}}
+		for i := range t.NumField() {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+
+			child := schemaFor(f.Type)
+			child.Description = f.Tag.Get("desc")
+			if enum, ok := f.Tag.Lookup("enum"); ok {
+				// The enum of a list applies to its items.
+				if child.Items != nil {
+					child.Items.Enum = strings.Split(enum, ",")
+				} else {
+					child.Enum = strings.Split(enum, ",")
+				}
+			}
+			if m, ok := f.Tag.Lookup("minimum"); ok {
+				if v, err := strconv.Atoi(m); err == nil {
+					child.Minimum = &v
+				}
+			}
+			if f.Tag.Get("required") == "true" {
+				node.Required = append(node.Required, name)
+			}
+
+			node.Properties.names = append(node.Properties.names, name)
+			node.Properties.nodes = append(node.Properties.nodes, child)
+		}
+		return node
+	}
+	panic("config schema: unsupported type " + t.String())
+}
+
+func marshalJSON(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// Schema returns the JSON Schema of the config file, generated from the Config struct tags.
+func Schema() ([]byte, error) {
+	root := schemaFor(reflect.TypeOf(Config{}))
+	root.Schema = "https://json-schema.org/draft/2020-12/schema"
+
+	data, err := marshalJSON(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, data, "", "  "); err != nil {
+		return nil, err
+	}
+	out.WriteByte('\n')
+	return out.Bytes(), nil
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Standalone describes a single dataset on S3 without a config file, for disaster recovery.
+type Standalone struct {
+	Bucket     string
+	Region     string
+	Prefix     string
+	TaskPrefix string
+	Endpoint   string
+	Pool       string
+	Dataset    string
+}
+
+func (s Standalone) Enabled() bool {
+	return s.Bucket != ""
+}
+
+func (s Standalone) Validate() error {
+	if s.Bucket == "" {
+		return fmt.Errorf("--bucket is required without a config file")
+	}
+	if s.Region == "" {
+		return fmt.Errorf("--region is required without a config file")
+	}
+	if s.Pool == "" {
+		return fmt.Errorf("--pool is required without a config file")
+	}
+	if s.Dataset == "" {
+		return fmt.Errorf("--dataset is required without a config file")
+	}
+	if err := validateS3Prefix(s.TaskPrefix); err != nil {
+		return fmt.Errorf("--task-prefix %w", err)
+	}
+	return nil
+}
+
+// Resolve loads the config file and task, or builds both from s when it is enabled.
+func Resolve(configPath, taskName string, s Standalone) (*Config, *Task, error) {
+	if !s.Enabled() {
+		if taskName == "" {
+			return nil, nil, fmt.Errorf("--task is required when using a config file")
+		}
+
+		cfg, err := Load(configPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load config: %w", err)
+		}
+
+		task, err := cfg.FindTask(taskName)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cfg, task, nil
+	}
+
+	if err := s.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	if taskName == "" {
+		taskName = strings.ReplaceAll(s.Pool+"/"+s.Dataset, "/", "_")
+	}
+
+	cfg := &Config{
+		BaseDir: filepath.Join(os.TempDir(), "zrb"),
+		S3: S3Config{
+			Enabled:  true,
+			Bucket:   s.Bucket,
+			Region:   s.Region,
+			Prefix:   s.Prefix,
+			Endpoint: s.Endpoint,
+		},
+	}
+	// Storage classes are unknown without a config; downloads do not depend on them.
+	cfg.S3.StorageClass.Manifest = "STANDARD"
+
+	task := &Task{Name: taskName, Pool: s.Pool, Dataset: s.Dataset, S3Prefix: s.TaskPrefix, Enabled: true}
+	cfg.Tasks = []Task{*task}
+
+	return cfg, task, nil
+}
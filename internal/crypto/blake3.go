@@ -0,0 +1,113 @@
+package crypto
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"zrb/internal/sdnotify"
+
+	"github.com/zeebo/blake3"
+)
+
+// Files from parallelHashThreshold bytes on are hashed by hashParallel, which reads
+// parallelHashBlock bytes at a time. Replaced by tests.
+var (
+	parallelHashThreshold int64 = 64 << 20
+	parallelHashBlock           = 4 << 20
+)
+
+// parallelHashReaders is how many blocks hashParallel reads ahead of the hasher.
+const parallelHashReaders = 4
+
+// BLAKE3File computes the BLAKE3 hash of a file. Files from parallelHashThreshold on are read
+// ahead in parallel, so that reading overlaps hashing.
+func BLAKE3File(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().IsRegular() && info.Size() >= parallelHashThreshold {
+		return hashParallel(f, info.Size())
+	}
+	return hashSequential(f)
+}
+
+func hashSequential(r io.Reader) (string, error) {
+	hasher := blake3.New()
+	if _, err := io.Copy(hasher, sdnotify.Reader(r)); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+type hashBlock struct {
+	buf []byte
+	err error
+}
+
+// hashParallel hashes the first size bytes of f. Up to parallelHashReaders blocks are read at once
+// with ReadAt while the hasher takes the blocks in order. zeebo/blake3 hashes on one goroutine, but
+// writes of whole blocks let it hash many chunks at a time with SIMD, and the hasher no longer
+// waits for the disk between them.
+func hashParallel(f *os.File, size int64) (string, error) {
+	free := make(chan []byte, parallelHashReaders)
+	for range parallelHashReaders {
+		free <- make([]byte, parallelHashBlock)
+	}
+	// Each block holds a buffer, so the reader never has more blocks out than free buffers.
+	blocks := make(chan chan hashBlock, parallelHashReaders)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(blocks)
+		for offset := int64(0); offset < size; offset += int64(parallelHashBlock) {
+			var buf []byte
+			select {
+			case buf = <-free:
+			case <-done:
+				return
+			}
+			block := make(chan hashBlock, 1)
+			blocks <- block
+			go func() {
+				buf := buf[:min(int64(len(buf)), size-offset)]
+				n, err := f.ReadAt(buf, offset)
+				if n == len(buf) {
+					err = nil
+				} else if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				if err != nil {
+					err = fmt.Errorf("failed to read %s at offset %d: %w", f.Name(), offset, err)
+				}
+				block <- hashBlock{buf: buf[:n], err: err}
+			}()
+		}
+	}()
+
+	hasher := blake3.New()
+	w := io.MultiWriter(hasher, sdnotify.Writer())
+	var err error
+	// The blocks are drained even after an error, so no read is left running on f.
+	for block := range blocks {
+		b := <-block
+		if err == nil {
+			if err = b.err; err != nil {
+				close(done)
+			} else {
+				_, _ = w.Write(b.buf)
+			}
+		}
+		free <- b.buf[:cap(b.buf)]
+	}
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
@@ -0,0 +1,86 @@
+package crypto
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zeebo/blake3"
+)
+
+func writeRandom(t testing.TB, path string, size int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	rng := rand.New(rand.NewPCG(uint64(size), 1))
+	for i := range data {
+		data[i] = byte(rng.Uint32())
+	}
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+	return data
+}
+
+func TestBLAKE3FileParallel(t *testing.T) {
+	defer func(threshold int64, block int) { parallelHashThreshold, parallelHashBlock = threshold, block }(parallelHashThreshold, parallelHashBlock)
+	dir := t.TempDir()
+
+	// Blocks of 3000 bytes end inside BLAKE3 chunks of 1024 bytes and the 8192 byte batches
+	// zeebo/blake3 hashes at once; more blocks than readers make the reader wait for buffers.
+	for _, block := range []int{3000, 8192} {
+		for _, size := range []int{0, 1, 1023, 1024, 1025, 2999, 3000, 3001, 8191, 8192, 8193, 6000, 16384, 3000*parallelHashReaders*3 + 17} {
+			t.Run(fmt.Sprintf("block %d size %d", block, size), func(t *testing.T) {
+				path := filepath.Join(dir, fmt.Sprintf("part-%d", size))
+				data := writeRandom(t, path, size)
+				want := fmt.Sprintf("%x", blake3.Sum256(data))
+
+				parallelHashThreshold, parallelHashBlock = 0, block
+				got, err := BLAKE3File(path)
+				require.NoError(t, err)
+				assert.Equal(t, want, got)
+
+				parallelHashThreshold = int64(size) + 1
+				got, err = BLAKE3File(path)
+				require.NoError(t, err)
+				assert.Equal(t, want, got, "the sequential path")
+			})
+		}
+	}
+}
+
+func TestHashParallelShortFile(t *testing.T) {
+	defer func(block int) { parallelHashBlock = block }(parallelHashBlock)
+	parallelHashBlock = 1000
+	path := filepath.Join(t.TempDir(), "part")
+	writeRandom(t, path, 5500)
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	// A file that shrank since its size was taken fails rather than hashing what is left.
+	_, err = hashParallel(f, 9000)
+	assert.ErrorContains(t, err, "at offset 5000: unexpected EOF")
+}
+
+// BenchmarkBLAKE3File hashes a 256 MiB file with io.Copy and with the parallel reads.
+func BenchmarkBLAKE3File(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "part")
+	writeRandom(b, path, 256<<20)
+	for _, bench := range []struct {
+		name      string
+		threshold int64
+	}{{"sequential", 1 << 62}, {"parallel", 0}} {
+		b.Run(bench.name, func(b *testing.B) {
+			defer func(threshold int64) { parallelHashThreshold = threshold }(parallelHashThreshold)
+			parallelHashThreshold = bench.threshold
+			b.SetBytes(256 << 20)
+			for b.Loop() {
+				if _, err := BLAKE3File(path); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,23 +1,48 @@
 package crypto
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"fmt"
+	"hash"
 	"io"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
+	"zrb/internal/fsync"
+	"zrb/internal/sdnotify"
+	"zrb/internal/throughput"
+	"zrb/internal/util"
 
 	"filippo.io/age"
 	"github.com/zeebo/blake3"
 )
 
-// ProcessPart encrypts a snapshot part, calculates BLAKE3, and removes the original
-func ProcessPart(partFile string, recipient age.Recipient) (string, string, error) {
+// ProcessPart encrypts a snapshot part, calculates BLAKE3, and removes the original.
+// The ciphertext is written to <part>.age.tmp and renamed to <part>.age only once it is complete
+// and synced with the Syncer of ctx, so a crash never leaves a truncated .age file that a resumed
+// run would trust while the raw part is already gone.
+func ProcessPart(ctx context.Context, partFile string, recipients ...age.Recipient) (string, string, error) {
 	slog.Info("Processing part file", "partFile", partFile)
 
 	encryptedFile := partFile + ".age"
-	if err := Encrypt(partFile, encryptedFile, recipient); err != nil {
+	tmpFile := encryptedFile + ".tmp"
+	if err := Encrypt(partFile, tmpFile, recipients...); err != nil {
+		os.Remove(tmpFile)
 		return "", "", fmt.Errorf("age encryption failed: %w", err)
 	}
+	syncer := fsync.FromContext(ctx)
+	if err := syncer.File(tmpFile); err != nil {
+		return "", "", err
+	}
+	if err := os.Rename(tmpFile, encryptedFile); err != nil {
+		return "", "", fmt.Errorf("failed to rename encrypted file: %w", err)
+	}
+	if err := syncer.Dir(filepath.Dir(encryptedFile)); err != nil {
+		return "", "", err
+	}
 	slog.Info("Encrypted to", "encryptedFile", encryptedFile)
 
 	blake3Hash, err := BLAKE3File(encryptedFile)
@@ -34,90 +59,169 @@ func ProcessPart(partFile string, recipient age.Recipient) (string, string, erro
 	return blake3Hash, encryptedFile, nil
 }
 
-func Encrypt(inputFile, outputFile string, recipient age.Recipient) error {
+func Encrypt(inputFile, outputFile string, recipients ...age.Recipient) error {
 	in, err := os.Open(inputFile)
 	if err != nil {
 		return err
 	}
 	defer in.Close()
 
-	out, err := os.Create(outputFile)
+	out, err := util.CreatePart(outputFile)
 	if err != nil {
 		return err
 	}
 	defer out.Close()
 
-	w, err := age.Encrypt(out, recipient)
+	w, err := age.Encrypt(out, recipients...)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(w, sdnotify.Reader(in)); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+	// A failed close can mean buffered data never reached the file.
+	return out.Close()
+}
+
+func Decrypt(inputFile, outputFile string, identities ...age.Identity) error {
+	return decrypt(inputFile, outputFile, nil, identities...)
+}
+
+// decrypt is Decrypt with the time it takes and the decrypted bytes counted in meter.
+func decrypt(inputFile, outputFile string, meter *throughput.Meter, identities ...age.Identity) error {
+	in, err := os.Open(inputFile)
 	if err != nil {
 		return err
 	}
+	defer in.Close()
 
-	if _, err := io.Copy(w, in); err != nil {
+	out, err := util.CreatePart(outputFile)
+	if err != nil {
 		return err
 	}
+	defer out.Close()
 
-	return w.Close()
+	return meter.Time(func() error {
+		r, err := age.Decrypt(sdnotify.Reader(in), identities...)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(meter.Writer(out), r)
+		return err
+	})
 }
 
-// BLAKE3File computes the BLAKE3 hash of a file
-func BLAKE3File(filename string) (string, error) {
+// SHA256File hashes a file with SHA256, used by manifests imported from simple_backup.
+func SHA256File(filename string) (string, error) {
 	f, err := os.Open(filename)
 	if err != nil {
 		return "", err
 	}
 	defer f.Close()
 
-	hasher := blake3.New()
-	if _, err := io.Copy(hasher, f); err != nil {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, sdnotify.Reader(f)); err != nil {
 		return "", err
 	}
 
 	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
 }
 
-func Decrypt(inputFile, outputFile string, identity age.Identity) error {
-	in, err := os.Open(inputFile)
-	if err != nil {
-		return err
+// HashFile hashes a file with the named algorithm ("blake3" or "sha256").
+func HashFile(algorithm, filename string) (string, error) {
+	switch algorithm {
+	case "blake3":
+		return BLAKE3File(filename)
+	case "sha256":
+		return SHA256File(filename)
 	}
-	defer in.Close()
+	return "", fmt.Errorf("unsupported hash algorithm: %s", algorithm)
+}
 
-	out, err := os.Create(outputFile)
-	if err != nil {
-		return err
+// NewHasher returns a hash of the named algorithm ("blake3" or "sha256"), for a stream HashFile
+// cannot read from a file.
+func NewHasher(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "blake3":
+		return blake3.New(), nil
+	case "sha256":
+		return sha256.New(), nil
 	}
-	defer out.Close()
+	return nil, fmt.Errorf("unsupported hash algorithm: %s", algorithm)
+}
 
-	r, err := age.Decrypt(in, identity)
+// DecryptAndVerify decrypts an encrypted part file and verifies its hash with the given algorithm.
+// The decryption, but not the hashing, is counted in meter, which may be nil.
+func DecryptAndVerify(encryptedFile, outputFile, algorithm, expectedHash string, meter *throughput.Meter, identities ...age.Identity) error {
+	slog.Info("Decrypting part file", "encryptedFile", encryptedFile)
+
+	actualHash, err := HashFile(algorithm, encryptedFile)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to calculate %s: %w", strings.ToUpper(algorithm), err)
 	}
 
-	if _, err := io.Copy(out, r); err != nil {
-		return err
+	if actualHash != expectedHash {
+		return fmt.Errorf("%s mismatch: expected %s, got %s", strings.ToUpper(algorithm), expectedHash, actualHash)
+	}
+	slog.Info("Part hash verified", "algorithm", algorithm, "hash", actualHash)
+
+	if err := decrypt(encryptedFile, outputFile, meter, identities...); err != nil {
+		return fmt.Errorf("decryption failed: %w", err)
 	}
+	slog.Info("Decrypted to", "outputFile", outputFile)
 
 	return nil
 }
 
-// DecryptAndVerify decrypts an encrypted part file and verifies its BLAKE3 hash
-func DecryptAndVerify(encryptedFile, outputFile, expectedBlake3 string, identity age.Identity) error {
-	slog.Info("Decrypting part file", "encryptedFile", encryptedFile)
+const (
+	ageNonceSize    = 16
+	ageTagSize      = 16
+	ageChunkSize    = 64 * 1024
+	ageEncChunkSize = ageChunkSize + ageTagSize
+)
 
-	actualBlake3, err := BLAKE3File(encryptedFile)
+// QuickCheck validates the age header and that the payload length matches age's chunk framing, without decrypting.
+func QuickCheck(path string) error {
+	f, err := os.Open(path)
 	if err != nil {
-		return fmt.Errorf("failed to calculate BLAKE3: %w", err)
+		return err
 	}
+	defer f.Close()
 
-	if actualBlake3 != expectedBlake3 {
-		return fmt.Errorf("BLAKE3 mismatch: expected %s, got %s", expectedBlake3, actualBlake3)
+	info, err := f.Stat()
+	if err != nil {
+		return err
 	}
-	slog.Info("BLAKE3 verified", "hash", actualBlake3)
 
-	if err := Decrypt(encryptedFile, outputFile, identity); err != nil {
-		return fmt.Errorf("decryption failed: %w", err)
+	header, err := age.ExtractHeader(f)
+	if err != nil {
+		return fmt.Errorf("invalid age header in %s: %w", path, err)
+	}
+	if !bytes.Contains(header, []byte("\n-> ")) {
+		return fmt.Errorf("invalid age header in %s: no recipient stanzas", path)
+	}
+
+	payloadSize := info.Size() - int64(len(header)) - ageNonceSize
+	if payloadSize < ageTagSize {
+		return fmt.Errorf("truncated age payload in %s: %d bytes", path, payloadSize)
+	}
+
+	fullChunks := payloadSize / ageEncChunkSize
+	rem := payloadSize % ageEncChunkSize
+	switch {
+	case rem == 0:
+		// Last chunk is full-sized.
+	case rem < ageTagSize:
+		return fmt.Errorf("truncated age payload in %s: incomplete final chunk", path)
+	case rem == ageTagSize && fullChunks > 0:
+		// An empty final chunk is only allowed for empty plaintext.
+		return fmt.Errorf("truncated age payload in %s: empty final chunk", path)
 	}
-	slog.Info("Decrypted to", "outputFile", outputFile)
 
 	return nil
 }
@@ -0,0 +1,179 @@
+package crypto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"zrb/internal/throughput"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encryptedFile(t *testing.T, size int) string {
+	t.Helper()
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "part")
+	require.NoError(t, os.WriteFile(plain, make([]byte, size), 0o644))
+
+	enc := plain + ".age"
+	require.NoError(t, Encrypt(plain, enc, identity.Recipient()))
+	return enc
+}
+
+func TestQuickCheckValid(t *testing.T) {
+	sizes := map[string]int{
+		"empty":              0,
+		"small":              1,
+		"exactly one chunk":  ageChunkSize,
+		"one chunk plus one": ageChunkSize + 1,
+		"multiple chunks":    3 * ageChunkSize,
+	}
+
+	for name, size := range sizes {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, QuickCheck(encryptedFile(t, size)))
+		})
+	}
+}
+
+func TestQuickCheckTruncated(t *testing.T) {
+	tests := map[string]struct {
+		size     int
+		truncate int64
+	}{
+		"missing tag":        {size: 0, truncate: 8},
+		"incomplete chunk":   {size: ageChunkSize + 10, truncate: 20},
+		"partial full chunk": {size: 2 * ageChunkSize, truncate: ageEncChunkSize - 8},
+		"empty final chunk":  {size: ageChunkSize + 100, truncate: 100},
+		"header only":        {size: 10, truncate: 10 + ageTagSize + ageNonceSize},
+		"inside nonce":       {size: 0, truncate: ageTagSize + 4},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := encryptedFile(t, tt.size)
+			info, err := os.Stat(path)
+			require.NoError(t, err)
+			require.NoError(t, os.Truncate(path, info.Size()-tt.truncate))
+
+			assert.Error(t, QuickCheck(path))
+		})
+	}
+}
+
+func TestQuickCheckCorruptedHeader(t *testing.T) {
+	path := encryptedFile(t, 1000)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	data[0] = 'x'
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+
+	err = QuickCheck(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid age header")
+}
+
+func TestQuickCheckNotAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plain")
+	require.NoError(t, os.WriteFile(path, []byte("not an age file\n"), 0o644))
+
+	assert.Error(t, QuickCheck(path))
+}
+
+func TestHashFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "f")
+	require.NoError(t, os.WriteFile(path, []byte("test"), 0o644))
+
+	got, err := HashFile("sha256", path)
+	require.NoError(t, err)
+	assert.Equal(t, "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", got)
+
+	b3, err := HashFile("blake3", path)
+	require.NoError(t, err)
+	want, err := BLAKE3File(path)
+	require.NoError(t, err)
+	assert.Equal(t, want, b3)
+
+	_, err = HashFile("md5", path)
+	assert.Error(t, err)
+
+	for _, algorithm := range []string{"sha256", "blake3"} {
+		hasher, err := NewHasher(algorithm)
+		require.NoError(t, err)
+		hasher.Write([]byte("test"))
+		want, err := HashFile(algorithm, path)
+		require.NoError(t, err)
+		assert.Equal(t, want, fmt.Sprintf("%x", hasher.Sum(nil)), algorithm)
+	}
+	_, err = NewHasher("md5")
+	assert.Error(t, err)
+}
+
+// failingRecipient makes age.Encrypt fail before anything is written.
+type failingRecipient struct{}
+
+func (failingRecipient) Wrap([]byte) ([]*age.Stanza, error) {
+	return nil, errors.New("recipient unavailable")
+}
+
+func TestProcessPart(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	t.Run("renames the synced ciphertext, then removes the part", func(t *testing.T) {
+		part := filepath.Join(t.TempDir(), "snapshot.part-aaaaaa")
+		require.NoError(t, os.WriteFile(part, []byte("zfs send stream"), 0o644))
+
+		hash, encrypted, err := ProcessPart(context.Background(), part, identity.Recipient())
+		require.NoError(t, err)
+		assert.Equal(t, part+".age", encrypted)
+		assert.NoFileExists(t, part)
+		assert.NoFileExists(t, part+".age.tmp")
+
+		want, err := BLAKE3File(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, want, hash)
+	})
+
+	t.Run("failed encryption keeps the part", func(t *testing.T) {
+		part := filepath.Join(t.TempDir(), "snapshot.part-aaaaaa")
+		require.NoError(t, os.WriteFile(part, []byte("zfs send stream"), 0o644))
+
+		_, _, err := ProcessPart(context.Background(), part, failingRecipient{})
+		require.ErrorContains(t, err, "age encryption failed")
+		assert.FileExists(t, part)
+		assert.NoFileExists(t, part+".age")
+		assert.NoFileExists(t, part+".age.tmp")
+	})
+}
+
+func TestDecryptAndVerify(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "part")
+	require.NoError(t, os.WriteFile(plain, make([]byte, 3*ageChunkSize), 0o644))
+	require.NoError(t, Encrypt(plain, plain+".age", identity.Recipient()))
+	hash, err := BLAKE3File(plain + ".age")
+	require.NoError(t, err)
+
+	meter := &throughput.Meter{}
+	out := filepath.Join(dir, "out")
+	require.NoError(t, DecryptAndVerify(plain+".age", out, "blake3", hash, meter, identity))
+	assert.Equal(t, int64(3*ageChunkSize), meter.Bytes(), "the meter counts the decrypted bytes")
+	assert.Positive(t, meter.Summary().Seconds)
+
+	err = DecryptAndVerify(plain+".age", out, "blake3", "other", meter, identity)
+	assert.ErrorContains(t, err, "BLAKE3 mismatch")
+	assert.Equal(t, int64(3*ageChunkSize), meter.Bytes(), "a part failing its hash is not decrypted")
+}
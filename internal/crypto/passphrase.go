@@ -0,0 +1,137 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"golang.org/x/term"
+)
+
+// PassphraseEnv holds the passphrase of an encrypted private key, for runs without a terminal.
+const PassphraseEnv = "ZRB_KEY_PASSPHRASE"
+
+// ErrWrongPassphrase is returned when a passphrase-encrypted private key does not open with the
+// passphrase given, as opposed to a key that opens but does not match the backups.
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// scryptWorkFactor is the scrypt cost of new encrypted private keys, the one age -p uses.
+// Lowered by tests.
+var scryptWorkFactor = 18
+
+// promptPassword reads a password from the terminal without echoing it. Replaced by tests.
+var promptPassword = func(prompt string) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("no terminal to ask for the passphrase; set %s", PassphraseEnv)
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, prompt)
+	password, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	return string(password), nil
+}
+
+// NewPassphrase returns the passphrase to encrypt a new private key with: ZRB_KEY_PASSPHRASE when
+// set, otherwise one entered twice on the terminal.
+func NewPassphrase() (string, error) {
+	if passphrase := os.Getenv(PassphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
+	passphrase, err := promptPassword("Enter passphrase for the private key: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase == "" {
+		return "", fmt.Errorf("passphrase must not be empty")
+	}
+	again, err := promptPassword("Confirm passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if again != passphrase {
+		return "", fmt.Errorf("passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+// EncryptKey encrypts a private key file with passphrase, in the format age -p writes.
+func EncryptKey(data []byte, passphrase string) ([]byte, error) {
+	recipient, err := age.NewScryptRecipient(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	recipient.SetWorkFactor(scryptWorkFactor)
+
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, recipient)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// isEncryptedKey reports whether a private key file is an age file, binary or armored, rather than
+// a list of identities.
+func isEncryptedKey(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("age-encryption.org/")) ||
+		bytes.HasPrefix(bytes.TrimSpace(data), []byte(armor.Header))
+}
+
+// decryptKey opens a passphrase-encrypted private key file with ZRB_KEY_PASSPHRASE, or with a
+// passphrase entered on the terminal.
+func decryptKey(path string, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte("age-encryption.org/")) {
+		decoded, err := io.ReadAll(armor.NewReader(bytes.NewReader(bytes.TrimSpace(data))))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read private key %s: %w", path, err)
+		}
+		data = decoded
+	}
+	header, err := age.ExtractHeader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key %s: %w", path, err)
+	}
+	if !bytes.Contains(header, []byte("\n-> scrypt ")) {
+		return nil, fmt.Errorf("private key %s is age-encrypted to a recipient, not with a passphrase", path)
+	}
+
+	passphrase := os.Getenv(PassphraseEnv)
+	if passphrase == "" {
+		if passphrase, err = promptPassword(fmt.Sprintf("Enter passphrase for %s: ", path)); err != nil {
+			return nil, err
+		}
+	}
+	identity, err := age.NewScryptIdentity(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := age.Decrypt(bytes.NewReader(data), identity)
+	if err != nil {
+		var noMatch *age.NoIdentityMatchError
+		if errors.As(err, &noMatch) {
+			return nil, fmt.Errorf("failed to decrypt private key %s: %w", path, ErrWrongPassphrase)
+		}
+		return nil, fmt.Errorf("failed to decrypt private key %s: %w", path, err)
+	}
+	plain, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt private key %s: %w", path, err)
+	}
+	return plain, nil
+}
@@ -0,0 +1,156 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// encryptedKey writes a new identity encrypted with passphrase and returns it with the file path.
+func encryptedKey(t *testing.T, passphrase string) (*age.X25519Identity, string) {
+	t.Helper()
+
+	old := scryptWorkFactor
+	scryptWorkFactor = 10
+	t.Cleanup(func() { scryptWorkFactor = old })
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	data, err := EncryptKey([]byte(identity.String()+"\n"), passphrase)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "zrb_private.key")
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+	return identity, path
+}
+
+// answer makes the terminal prompt return answers in turn.
+func answer(t *testing.T, answers ...string) *[]string {
+	t.Helper()
+	var prompts []string
+	old := promptPassword
+	promptPassword = func(prompt string) (string, error) {
+		prompts = append(prompts, prompt)
+		if len(answers) == 0 {
+			return "", errors.New("no terminal")
+		}
+		next := answers[0]
+		answers = answers[1:]
+		return next, nil
+	}
+	t.Cleanup(func() { promptPassword = old })
+	return &prompts
+}
+
+func TestLoadIdentitiesEncryptedKey(t *testing.T) {
+	identity, path := encryptedKey(t, "correct horse")
+
+	t.Run("passphrase from the environment", func(t *testing.T) {
+		t.Setenv(PassphraseEnv, "correct horse")
+		prompts := answer(t)
+
+		identities, err := LoadIdentities(path)
+		require.NoError(t, err)
+		require.Len(t, identities, 1)
+		roundTrip(t, []age.Recipient{identity.Recipient()}, identities)
+		assert.Empty(t, *prompts)
+	})
+
+	t.Run("passphrase from the terminal", func(t *testing.T) {
+		t.Setenv(PassphraseEnv, "")
+		prompts := answer(t, "correct horse")
+
+		identities, err := LoadIdentities(path)
+		require.NoError(t, err)
+		roundTrip(t, []age.Recipient{identity.Recipient()}, identities)
+		assert.Equal(t, []string{"Enter passphrase for " + path + ": "}, *prompts)
+	})
+
+	t.Run("wrong passphrase", func(t *testing.T) {
+		t.Setenv(PassphraseEnv, "wrong")
+
+		_, err := LoadIdentities(path)
+		assert.ErrorIs(t, err, ErrWrongPassphrase)
+	})
+
+	t.Run("armored", func(t *testing.T) {
+		t.Setenv(PassphraseEnv, "correct horse")
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		w := armor.NewWriter(&buf)
+		_, err = w.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		armored := path + ".asc"
+		require.NoError(t, os.WriteFile(armored, buf.Bytes(), 0o600))
+
+		identities, err := LoadIdentities(armored)
+		require.NoError(t, err)
+		roundTrip(t, []age.Recipient{identity.Recipient()}, identities)
+	})
+}
+
+func TestLoadIdentitiesWrongKeyIsNotWrongPassphrase(t *testing.T) {
+	t.Setenv(PassphraseEnv, "correct horse")
+	_, path := encryptedKey(t, "correct horse")
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	identities, err := LoadIdentities(path)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "plain")
+	require.NoError(t, os.WriteFile(plain, []byte("zrb"), 0o644))
+	require.NoError(t, Encrypt(plain, plain+".age", other.Recipient()))
+	err = Decrypt(plain+".age", plain+".out", identities...)
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrWrongPassphrase)
+}
+
+func TestLoadIdentitiesKeyEncryptedToRecipient(t *testing.T) {
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "zrb_private.key")
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, other.Recipient())
+	require.NoError(t, err)
+	_, err = w.Write([]byte("AGE-SECRET-KEY-1\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0o600))
+
+	_, err = LoadIdentities(path)
+	assert.ErrorContains(t, err, "age-encrypted to a recipient, not with a passphrase")
+}
+
+func TestNewPassphrase(t *testing.T) {
+	t.Setenv(PassphraseEnv, "")
+
+	answer(t, "secret", "secret")
+	passphrase, err := NewPassphrase()
+	require.NoError(t, err)
+	assert.Equal(t, "secret", passphrase)
+
+	answer(t, "secret", "typo")
+	_, err = NewPassphrase()
+	assert.EqualError(t, err, "passphrases do not match")
+
+	answer(t, "")
+	_, err = NewPassphrase()
+	assert.EqualError(t, err, "passphrase must not be empty")
+
+	t.Setenv(PassphraseEnv, "from env")
+	answer(t)
+	passphrase, err = NewPassphrase()
+	require.NoError(t, err)
+	assert.Equal(t, "from env", passphrase)
+}
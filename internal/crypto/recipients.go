@@ -0,0 +1,189 @@
+package crypto
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"filippo.io/age/plugin"
+	"filippo.io/age/tag"
+	"golang.org/x/crypto/ssh"
+)
+
+// pluginUI forwards plugin messages and prompts (e.g. a hardware token PIN) to the terminal.
+var pluginUI = plugin.NewTerminalUI(
+	func(format string, v ...any) { fmt.Fprintf(os.Stderr, format+"\n", v...) },
+	func(format string, v ...any) { fmt.Fprintf(os.Stderr, "warning: "+format+"\n", v...) },
+)
+
+// requirePlugin fails when the binary backing an age plugin is not installed, which age itself
+// would only report on first use, halfway through a backup or restore.
+func requirePlugin(name, key string) error {
+	binary := "age-plugin-" + name
+	if _, err := exec.LookPath(binary); err != nil {
+		return fmt.Errorf("%s needs the age plugin binary %s, which was not found in $PATH", key, binary)
+	}
+	return nil
+}
+
+// ParseRecipient parses a recipient in any format age supports: X25519 (age1...), post-quantum
+// (age1pq1...), tagged (age1tag1...), plugin recipients (age1<plugin>1...) and ssh-ed25519/ssh-rsa public keys.
+func ParseRecipient(s string) (age.Recipient, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case strings.HasPrefix(s, "age1pq1"):
+		return age.ParseHybridRecipient(s)
+	case strings.HasPrefix(s, "age1tag1") || strings.HasPrefix(s, "age1tagpq1"):
+		return tag.ParseRecipient(s)
+	case strings.HasPrefix(s, "age1") && strings.Count(s, "1") > 1:
+		r, err := plugin.NewRecipient(s, pluginUI)
+		if err != nil {
+			return nil, err
+		}
+		if err := requirePlugin(r.Name(), "recipient"); err != nil {
+			return nil, err
+		}
+		return r, nil
+	case strings.HasPrefix(s, "age1"):
+		return age.ParseX25519Recipient(s)
+	case strings.HasPrefix(s, "ssh-"):
+		return agessh.ParseRecipient(s)
+	}
+	return nil, fmt.Errorf("unknown recipient type")
+}
+
+// ParseRecipients parses every recipient string, naming the one that failed.
+func ParseRecipients(list []string) ([]age.Recipient, error) {
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no recipients configured")
+	}
+	recipients := make([]age.Recipient, 0, len(list))
+	for _, s := range list {
+		r, err := ParseRecipient(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient %q: %w", s, err)
+		}
+		recipients = append(recipients, r)
+	}
+	return recipients, nil
+}
+
+// sshIdentity keeps the public key of an SSH identity, which agessh does not expose.
+type sshIdentity struct {
+	age.Identity
+	publicKey string
+}
+
+// ParseIdentities parses a private key file: one or more age identities (AGE-SECRET-KEY-1...,
+// AGE-SECRET-KEY-PQ-1..., AGE-PLUGIN-...) one per line, or an unencrypted OpenSSH private key.
+func ParseIdentities(data []byte) ([]age.Identity, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		return parseSSHIdentity(data)
+	}
+
+	var identities []age.Identity
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var identity age.Identity
+		var err error
+		switch {
+		case strings.HasPrefix(line, "AGE-PLUGIN-"):
+			var p *plugin.Identity
+			if p, err = plugin.NewIdentity(line, pluginUI); err == nil {
+				err = requirePlugin(p.Name(), "identity")
+				identity = p
+			}
+		case strings.HasPrefix(line, "AGE-SECRET-KEY-PQ-1"):
+			identity, err = age.ParseHybridIdentity(line)
+		case strings.HasPrefix(line, "AGE-SECRET-KEY-1"):
+			identity, err = age.ParseX25519Identity(line)
+		case strings.HasPrefix(line, "age1") || strings.HasPrefix(line, "ssh-"):
+			err = fmt.Errorf("found a public key, not a private key")
+		default:
+			err = fmt.Errorf("unknown identity type")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity at line %d: %w", n, err)
+		}
+		identities = append(identities, identity)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("no identities found")
+	}
+	return identities, nil
+}
+
+func parseSSHIdentity(data []byte) ([]age.Identity, error) {
+	identity, err := agessh.ParseIdentity(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH private key: %w", err)
+	}
+
+	key, err := ssh.ParseRawPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH private key: %w", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH private key: %w", err)
+	}
+	publicKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+
+	return []age.Identity{&sshIdentity{Identity: identity, publicKey: publicKey}}, nil
+}
+
+// LoadIdentities reads and parses a private key file, see ParseIdentities. A key file encrypted
+// with a passphrase (age -p) is decrypted in memory first.
+func LoadIdentities(path string) ([]age.Identity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+	if isEncryptedKey(data) {
+		if data, err = decryptKey(path, data); err != nil {
+			return nil, err
+		}
+	}
+	identities, err := ParseIdentities(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key %s: %w", path, err)
+	}
+	return identities, nil
+}
+
+// IdentityRecipient returns the recipient string an identity decrypts, or false when it cannot be derived.
+func IdentityRecipient(identity age.Identity) (string, bool) {
+	switch i := identity.(type) {
+	case *age.X25519Identity:
+		return i.Recipient().String(), true
+	case *age.HybridIdentity:
+		return i.Recipient().String(), true
+	case *sshIdentity:
+		return i.publicKey, true
+	}
+	return "", false
+}
+
+// NormalizeRecipient drops the comment of an SSH public key so recipients compare by key alone.
+func NormalizeRecipient(s string) string {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "ssh-") {
+		if fields := strings.Fields(s); len(fields) > 2 {
+			return fields[0] + " " + fields[1]
+		}
+	}
+	return s
+}
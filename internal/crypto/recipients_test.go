@@ -0,0 +1,106 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/plugin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshKeyPair returns an authorized_keys line and an unencrypted OpenSSH private key.
+func sshKeyPair(t *testing.T) (string, []byte) {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	sshPub, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	require.NoError(t, err)
+
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub))) + " backup@host", pem.EncodeToMemory(block)
+}
+
+func roundTrip(t *testing.T, recipients []age.Recipient, identities []age.Identity) {
+	t.Helper()
+
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "plain")
+	require.NoError(t, os.WriteFile(plain, []byte("zrb"), 0o644))
+
+	require.NoError(t, Encrypt(plain, plain+".age", recipients...))
+	require.NoError(t, Decrypt(plain+".age", plain+".out", identities...))
+
+	got, err := os.ReadFile(plain + ".out")
+	require.NoError(t, err)
+	assert.Equal(t, "zrb", string(got))
+}
+
+func TestParseRecipientsX25519(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	recipients, err := ParseRecipients([]string{identity.Recipient().String()})
+	require.NoError(t, err)
+
+	identities, err := ParseIdentities([]byte("# created: today\n" + identity.String() + "\n"))
+	require.NoError(t, err)
+	roundTrip(t, recipients, identities)
+
+	r, ok := IdentityRecipient(identities[0])
+	assert.True(t, ok)
+	assert.Equal(t, identity.Recipient().String(), r)
+}
+
+func TestParseRecipientsSSH(t *testing.T) {
+	publicKey, privateKey := sshKeyPair(t)
+
+	recipients, err := ParseRecipients([]string{publicKey})
+	require.NoError(t, err)
+
+	identities, err := ParseIdentities(privateKey)
+	require.NoError(t, err)
+	roundTrip(t, recipients, identities)
+
+	r, ok := IdentityRecipient(identities[0])
+	assert.True(t, ok)
+	assert.Equal(t, NormalizeRecipient(publicKey), r)
+}
+
+func TestParseRecipientsErrors(t *testing.T) {
+	_, err := ParseRecipients([]string{"age1notakey"})
+	assert.ErrorContains(t, err, `invalid recipient "age1notakey"`)
+
+	_, err = ParseRecipients([]string{"pgp:0xdeadbeef"})
+	assert.ErrorContains(t, err, "unknown recipient type")
+
+	_, err = ParseRecipients(nil)
+	assert.ErrorContains(t, err, "no recipients")
+
+	t.Setenv("PATH", t.TempDir())
+	_, err = ParseRecipients([]string{plugin.EncodeRecipient("zrbtest", []byte("data"))})
+	assert.ErrorContains(t, err, "age plugin binary age-plugin-zrbtest")
+
+	_, err = ParseIdentities([]byte(plugin.EncodeIdentity("zrbtest", []byte("data")) + "\n"))
+	assert.ErrorContains(t, err, "age plugin binary age-plugin-zrbtest")
+}
+
+func TestParseIdentitiesRejectsPublicKey(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	_, err = ParseIdentities([]byte(identity.Recipient().String()))
+	assert.ErrorContains(t, err, "line 1: found a public key")
+
+	_, err = ParseIdentities([]byte("# only comments\n"))
+	assert.ErrorContains(t, err, "no identities")
+}
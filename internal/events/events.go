@@ -0,0 +1,187 @@
+// Package events records an audit trail of backup and restore stages. It is separate from logging on
+// purpose: events are written regardless of the log level and in a stable format for external pipelines.
+package events
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"zrb/internal/util"
+)
+
+// Stage names one step of a backup or restore.
+type Stage string
+
+const (
+	BackupStarted    Stage = "backup-started"
+	SendStarted      Stage = "send-started"
+	SendCompleted    Stage = "send-completed"
+	PartEncrypted    Stage = "part-encrypted"
+	PartUploaded     Stage = "part-uploaded"
+	ManifestUploaded Stage = "manifest-uploaded"
+	SnapshotHeld     Stage = "snapshot-held"
+	BackupCompleted  Stage = "backup-completed"
+	BackupFailed     Stage = "backup-failed"
+
+	RestoreStarted   Stage = "restore-started"
+	PartDownloaded   Stage = "part-downloaded"
+	PartVerified     Stage = "part-verified"
+	ReceiveStarted   Stage = "receive-started"
+	ReceiveCompleted Stage = "receive-completed"
+	RestoreCompleted Stage = "restore-completed"
+	RestoreFailed    Stage = "restore-failed"
+
+	// HoldReleaseFailed records a hold left in place, its tag in Object, during a backup or restore.
+	HoldReleaseFailed Stage = "hold-release-failed"
+	// StreamLimitExceeded records a backup send stopped at max_stream_size, with the limit in
+	// Limit and the bytes zfs send produced until then in Bytes.
+	StreamLimitExceeded Stage = "stream-limit-exceeded"
+)
+
+// Event is one audit record. RunID ties together the events of one backup or restore run.
+type Event struct {
+	Time     time.Time `json:"time"`
+	Stage    Stage     `json:"stage"`
+	RunID    string    `json:"run_id"`
+	Host     string    `json:"host,omitempty"`
+	Task     string    `json:"task,omitempty"`
+	Pool     string    `json:"pool,omitempty"`
+	Dataset  string    `json:"dataset,omitempty"`
+	Level    int16     `json:"level"`
+	Snapshot string    `json:"snapshot,omitempty"`
+	Part     string    `json:"part,omitempty"`
+	Object   string    `json:"object,omitempty"`
+	Target   string    `json:"target,omitempty"`
+	Blake3   string    `json:"blake3,omitempty"`
+	Bytes    int64     `json:"bytes,omitempty"`
+	Limit    int64     `json:"limit,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	// ErrorClass is remote.Transient or remote.Permanent when Error came from S3 or GCS.
+	ErrorClass string `json:"error_class,omitempty"`
+}
+
+// Sink receives events. Implementations must be safe for concurrent use, since parts are processed in parallel.
+type Sink interface {
+	Emit(Event) error
+	Close() error
+}
+
+type nopSink struct{}
+
+func (nopSink) Emit(Event) error { return nil }
+func (nopSink) Close() error     { return nil }
+
+// Nop returns a sink that discards every event.
+func Nop() Sink {
+	return nopSink{}
+}
+
+// FileSink appends events to a file as JSON lines.
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	if err := util.MkdirAll(filepath.Dir(path)); err != nil {
+		return nil, fmt.Errorf("failed to create events directory: %w", err)
+	}
+	file, err := util.AppendFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open events file: %w", err)
+	}
+	return &FileSink{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+func (s *FileSink) Emit(e Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(e)
+}
+
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
+
+// Open returns a FileSink for path, or a no-op sink when path is empty.
+func Open(path string) (Sink, error) {
+	if path == "" {
+		return Nop(), nil
+	}
+	return NewFileSink(path)
+}
+
+// Emitter stamps events with the identifiers of one run before handing them to a sink.
+type Emitter struct {
+	sink Sink
+	base Event
+}
+
+// NewEmitter returns an emitter that fills RunID, Host, Task, Pool, Dataset and Level from base
+// when an event leaves them empty. A RunID is generated when base has none.
+func NewEmitter(sink Sink, base Event) *Emitter {
+	if base.RunID == "" {
+		base.RunID = newRunID()
+	}
+	if base.Host == "" {
+		base.Host, _ = os.Hostname()
+	}
+	return &Emitter{sink: sink, base: base}
+}
+
+func newRunID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Emit records e. A failing sink is logged but never fails the operation being audited.
+func (em *Emitter) Emit(e Event) {
+	if em == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	e.RunID = em.base.RunID
+	e.Host = em.base.Host
+	if e.Task == "" {
+		e.Task = em.base.Task
+	}
+	if e.Pool == "" {
+		e.Pool = em.base.Pool
+	}
+	if e.Dataset == "" {
+		e.Dataset = em.base.Dataset
+	}
+	if e.Level == 0 {
+		e.Level = em.base.Level
+	}
+	if e.Target == "" {
+		e.Target = em.base.Target
+	}
+	if err := em.sink.Emit(e); err != nil {
+		slog.Warn("Failed to record audit event", "stage", e.Stage, "error", err)
+	}
+}
+
+type emitterKey struct{}
+
+// NewContext attaches em to ctx, so code deep in a run can emit without threading it through every call.
+func NewContext(ctx context.Context, em *Emitter) context.Context {
+	return context.WithValue(ctx, emitterKey{}, em)
+}
+
+// Emit records e with the emitter attached to ctx, if any.
+func Emit(ctx context.Context, e Event) {
+	em, _ := ctx.Value(emitterKey{}).(*Emitter)
+	em.Emit(e)
+}
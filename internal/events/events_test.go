@@ -0,0 +1,82 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memorySink struct {
+	events []Event
+}
+
+func (s *memorySink) Emit(e Event) error {
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *memorySink) Close() error { return nil }
+
+func TestFileSinkAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log", "events.jsonl")
+
+	for _, stage := range []Stage{BackupStarted, BackupCompleted} {
+		sink, err := Open(path)
+		require.NoError(t, err)
+		require.NoError(t, sink.Emit(Event{Stage: stage, Task: "t"}))
+		require.NoError(t, sink.Close())
+	}
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var stages []Stage
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Event
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		stages = append(stages, e.Stage)
+	}
+	assert.Equal(t, []Stage{BackupStarted, BackupCompleted}, stages)
+}
+
+func TestOpenWithoutPathIsNop(t *testing.T) {
+	sink, err := Open("")
+	require.NoError(t, err)
+	assert.Equal(t, Nop(), sink)
+}
+
+func TestEmitterFillsRunFields(t *testing.T) {
+	sink := &memorySink{}
+	em := NewEmitter(sink, Event{Task: "t", Pool: "tank", Dataset: "data", Level: 2})
+	ctx := NewContext(context.Background(), em)
+
+	Emit(ctx, Event{Stage: PartUploaded, Part: "aaaaaa"})
+	Emit(ctx, Event{Stage: BackupFailed, Error: "boom"})
+
+	require.Len(t, sink.events, 2)
+	for _, e := range sink.events {
+		assert.NotEmpty(t, e.RunID)
+		assert.Equal(t, sink.events[0].RunID, e.RunID)
+		assert.Equal(t, "t", e.Task)
+		assert.Equal(t, "tank", e.Pool)
+		assert.Equal(t, "data", e.Dataset)
+		assert.Equal(t, int16(2), e.Level)
+		assert.False(t, e.Time.IsZero())
+	}
+	assert.Equal(t, "aaaaaa", sink.events[0].Part)
+	assert.Equal(t, "boom", sink.events[1].Error)
+}
+
+func TestEmitWithoutEmitter(t *testing.T) {
+	assert.NotPanics(t, func() {
+		Emit(context.Background(), Event{Stage: BackupStarted})
+	})
+}
@@ -0,0 +1,65 @@
+// Package fsync flushes finished files and their directory entries to stable storage, so the backup
+// state never records a part as complete whose data a power failure could still lose.
+package fsync
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// Syncer flushes the data of a file, or the entries of a directory, to disk.
+type Syncer interface {
+	File(path string) error
+	Dir(path string) error
+}
+
+type disk struct{}
+
+// Disk fsyncs through the operating system.
+var Disk Syncer = disk{}
+
+func (disk) File(path string) error {
+	return syncPath(path)
+}
+
+func (disk) Dir(path string) error {
+	return syncPath(path)
+}
+
+// syncPath reopens path and fsyncs it; on Linux a read-only descriptor flushes the data written
+// through any other descriptor too.
+func syncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s for fsync: %w", path, err)
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to fsync %s: %w", path, err)
+	}
+	return nil
+}
+
+type off struct{}
+
+// Off skips syncing, for storage whose write cache survives power loss.
+var Off Syncer = off{}
+
+func (off) File(string) error { return nil }
+func (off) Dir(string) error  { return nil }
+
+type syncerKey struct{}
+
+// NewContext returns a context whose backup steps sync with s.
+func NewContext(ctx context.Context, s Syncer) context.Context {
+	return context.WithValue(ctx, syncerKey{}, s)
+}
+
+// FromContext returns the Syncer carried by ctx, Disk when there is none.
+func FromContext(ctx context.Context) Syncer {
+	if s, ok := ctx.Value(syncerKey{}).(Syncer); ok {
+		return s
+	}
+	return Disk
+}
@@ -0,0 +1,63 @@
+package fsync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDisk(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "part")
+	require.NoError(t, os.WriteFile(path, []byte("data"), 0o644))
+
+	assert.NoError(t, Disk.File(path))
+	assert.NoError(t, Disk.Dir(dir))
+
+	err := Disk.File(filepath.Join(dir, "missing"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to open")
+}
+
+func TestFromContext(t *testing.T) {
+	assert.Equal(t, Disk, FromContext(context.Background()))
+	assert.Equal(t, Off, FromContext(NewContext(context.Background(), Off)))
+
+	// Off never touches the filesystem.
+	assert.NoError(t, Off.File("/nonexistent"))
+	assert.NoError(t, Off.Dir("/nonexistent"))
+}
+
+// BenchmarkWritePart writes a part-sized file the way the splitter does, with and without the
+// fsync of the file and its directory.
+func BenchmarkWritePart(b *testing.B) {
+	data := make([]byte, 64<<20)
+	for _, s := range []struct {
+		name   string
+		syncer Syncer
+	}{{"fsync", Disk}, {"no-fsync", Off}} {
+		b.Run(s.name, func(b *testing.B) {
+			dir := b.TempDir()
+			b.SetBytes(int64(len(data)))
+			for b.Loop() {
+				tmp, path := filepath.Join(dir, "part.tmp"), filepath.Join(dir, "part")
+				if err := os.WriteFile(tmp, data, 0o644); err != nil {
+					b.Fatal(err)
+				}
+				if err := s.syncer.File(tmp); err != nil {
+					b.Fatal(err)
+				}
+				if err := os.Rename(tmp, path); err != nil {
+					b.Fatal(err)
+				}
+				if err := s.syncer.Dir(dir); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
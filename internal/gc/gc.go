@@ -0,0 +1,79 @@
+package gc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+	"zrb/internal/config"
+	"zrb/internal/remote"
+)
+
+// Options of zrb gc. Without TaskName it collects for every task of the config that uploads.
+type Options struct {
+	ConfigPath string
+	TaskName   string
+	// AbortMultipart aborts the incomplete multipart uploads below the data prefix of each task
+	// that were started more than OlderThan ago.
+	AbortMultipart bool
+	OlderThan      time.Duration
+}
+
+// Replaced by tests.
+var output io.Writer = os.Stdout
+
+func Run(ctx context.Context, opts Options) error {
+	if !opts.AbortMultipart {
+		return fmt.Errorf("nothing to collect; pass --abort-multipart")
+	}
+
+	cfg, err := config.Load(opts.ConfigPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	if !cfg.RemoteEnabled() {
+		return config.ErrNoRemote
+	}
+
+	tasks := cfg.Tasks
+	if opts.TaskName != "" {
+		task, err := cfg.FindTask(opts.TaskName)
+		if err != nil {
+			return err
+		}
+		tasks = []config.Task{*task}
+	}
+
+	total := 0
+	for _, task := range tasks {
+		if !cfg.Uploads(&task) {
+			continue
+		}
+		backend, err := remote.DefaultCache.Get(ctx, remote.OptionsFromConfig(cfg, cfg.ManifestStorageClass()))
+		if err != nil {
+			return fmt.Errorf("failed to initialize S3 backend: %w", err)
+		}
+		aborter, ok := backend.(remote.MultipartAborter)
+		if !ok {
+			return remote.ErrMultipartNotSupported
+		}
+
+		prefix := remote.DataPath(task.S3Prefix, task.Pool, task.Dataset) + "/"
+		aborted, err := aborter.AbortIncompleteUploads(ctx, prefix, opts.OlderThan)
+		total += aborted
+		if errors.Is(err, remote.ErrMultipartNotSupported) {
+			slog.Warn("S3 endpoint cannot list multipart uploads; use a bucket lifecycle rule to abort them", "error", err)
+			fmt.Fprintln(output, "The S3 endpoint does not support listing multipart uploads; nothing was aborted.")
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("task %s: %w", task.Name, err)
+		}
+		fmt.Fprintf(output, "Task %s: aborted %d incomplete multipart upload(s) below %s\n", task.Name, aborted, prefix)
+	}
+	fmt.Fprintf(output, "Aborted %d incomplete multipart upload(s) in total.\n", total)
+	return nil
+}
@@ -0,0 +1,95 @@
+package gc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"zrb/internal/remote"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// abortingBackend records the prefixes it was asked to abort uploads below.
+type abortingBackend struct {
+	remote.Backend
+	prefixes  []string
+	olderThan time.Duration
+	err       error
+}
+
+func (b *abortingBackend) AbortIncompleteUploads(_ context.Context, prefix string, olderThan time.Duration) (int, error) {
+	b.prefixes = append(b.prefixes, prefix)
+	b.olderThan = olderThan
+	return 2, b.err
+}
+
+func setup(t *testing.T, backend remote.Backend) (string, *bytes.Buffer) {
+	t.Helper()
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+s3:
+  enabled: true
+  bucket: b
+  region: r
+  storage_class:
+    manifest: STANDARD
+    backup_data: [STANDARD]
+tasks:
+  - name: data
+    pool: tank
+    dataset: data
+    enabled: true
+  - name: media
+    pool: tank
+    dataset: media
+    enabled: true
+    s3_prefix: media
+  - name: local
+    pool: tank
+    dataset: local
+    enabled: true
+    upload: false
+`, dir)), 0o644))
+
+	oldCache := remote.DefaultCache
+	remote.DefaultCache = remote.NewCache(func(context.Context, remote.Options) (remote.Backend, error) {
+		return backend, nil
+	})
+	var out bytes.Buffer
+	oldOutput := output
+	output = &out
+	t.Cleanup(func() { remote.DefaultCache, output = oldCache, oldOutput })
+	return configPath, &out
+}
+
+func TestRunAbortMultipart(t *testing.T) {
+	backend := &abortingBackend{}
+	configPath, out := setup(t, backend)
+
+	assert.EqualError(t, Run(context.Background(), Options{ConfigPath: configPath}), "nothing to collect; pass --abort-multipart")
+
+	require.NoError(t, Run(context.Background(), Options{ConfigPath: configPath, AbortMultipart: true, OlderThan: time.Hour}))
+	assert.Equal(t, []string{"data/tank/data/", "media/data/tank/media/"}, backend.prefixes, "tasks that do not upload are skipped")
+	assert.Equal(t, time.Hour, backend.olderThan)
+	assert.Contains(t, out.String(), "Aborted 4 incomplete multipart upload(s) in total.")
+
+	backend.prefixes = nil
+	require.NoError(t, Run(context.Background(), Options{ConfigPath: configPath, TaskName: "media", AbortMultipart: true}))
+	assert.Equal(t, []string{"media/data/tank/media/"}, backend.prefixes)
+}
+
+func TestRunAbortMultipartNotSupported(t *testing.T) {
+	configPath, out := setup(t, &abortingBackend{err: fmt.Errorf("%w: NotImplemented", remote.ErrMultipartNotSupported)})
+	require.NoError(t, Run(context.Background(), Options{ConfigPath: configPath, AbortMultipart: true}))
+	assert.Contains(t, out.String(), "does not support listing multipart uploads")
+
+	configPath, _ = setup(t, &abortingBackend{err: fmt.Errorf("access denied")})
+	assert.EqualError(t, Run(context.Background(), Options{ConfigPath: configPath, AbortMultipart: true}), "task data: access denied")
+}
@@ -0,0 +1,126 @@
+// Package hooks runs the shell commands a task configures around its backup, logging their
+// output to the task log.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Values of ZRB_RESULT for post hooks.
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+// Env describes the backup a hook runs for, passed to it as ZRB_* environment variables.
+type Env struct {
+	Task     string
+	Level    int16
+	Snapshot string
+	// Result is ResultSuccess or ResultFailure, set for post hooks only.
+	Result string
+	// Error is why the backup failed, set for post hooks of failed backups.
+	Error string
+}
+
+func (e Env) environ() []string {
+	env := append(os.Environ(),
+		"ZRB_TASK="+e.Task,
+		"ZRB_LEVEL="+strconv.Itoa(int(e.Level)),
+		"ZRB_SNAPSHOT="+e.Snapshot,
+	)
+	if e.Result != "" {
+		env = append(env, "ZRB_RESULT="+e.Result)
+	}
+	if e.Error != "" {
+		env = append(env, "ZRB_ERROR="+e.Error)
+	}
+	return env
+}
+
+// Run runs command through sh -c and kills it after timeout. Every line it prints is logged; an
+// empty command does nothing.
+func Run(ctx context.Context, name, command string, timeout time.Duration, env Env) error {
+	if command == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	slog.Info("Running hook", "hook", name, "command", command)
+	start := time.Now()
+	output := &lineLogger{hook: name}
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = env.environ()
+	cmd.Stdout = output
+	cmd.Stderr = output
+	// Kill the whole process group on timeout, not only sh, so no child keeps running or holds
+	// the output open; a process that left the group must still not block the backup.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+	cmd.WaitDelay = 5 * time.Second
+	err := cmd.Run()
+	output.flush()
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s hook timed out after %s", name, timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%s hook failed: %w", name, err)
+	}
+	slog.Info("Hook finished", "hook", name, "duration", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// Post runs a post hook with the outcome of what it follows in ZRB_RESULT. It ignores the
+// cancellation of ctx, so an interrupted backup still undoes what a pre hook started, and only
+// logs a failure: the backup itself is not affected by it.
+func Post(ctx context.Context, name, command string, timeout time.Duration, env Env, outcome error) {
+	env.Result = ResultSuccess
+	if outcome != nil {
+		env.Result, env.Error = ResultFailure, outcome.Error()
+	}
+	if err := Run(context.WithoutCancel(ctx), name, command, timeout, env); err != nil {
+		slog.Error("Post hook failed", "hook", name, "error", err)
+	}
+}
+
+// lineLogger logs the output of a hook line by line. exec.Cmd serializes writes when stdout and
+// stderr share it.
+type lineLogger struct {
+	hook string
+	buf  []byte
+}
+
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		l.log(l.buf[:i])
+		l.buf = l.buf[i+1:]
+	}
+}
+
+// flush logs a last line without a trailing newline.
+func (l *lineLogger) flush() {
+	if len(l.buf) > 0 {
+		l.log(l.buf)
+		l.buf = nil
+	}
+}
+
+func (l *lineLogger) log(line []byte) {
+	slog.Info("Hook output", "hook", l.hook, "line", string(bytes.TrimRight(line, "\r")))
+}
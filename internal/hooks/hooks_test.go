@@ -0,0 +1,99 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// script writes an executable shell script to a temp dir and returns its path.
+func script(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "hook.sh")
+	require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0o755))
+	return path
+}
+
+// captureLog sends the default logger to a buffer for the rest of the test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	return &buf
+}
+
+func TestRunEnvironment(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "env")
+	hook := script(t, `echo "$ZRB_TASK $ZRB_LEVEL $ZRB_SNAPSHOT ${ZRB_RESULT-unset} ${ZRB_ERROR-unset}" > "$1"`)
+
+	env := Env{Task: "db", Level: 1, Snapshot: "tank/db@zrb_level1_2024-01-15_00-00"}
+	require.NoError(t, Run(context.Background(), "pre_snapshot", hook+" "+out, time.Minute, env))
+	got, err := os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "db 1 tank/db@zrb_level1_2024-01-15_00-00 unset unset\n", string(got))
+
+	Post(context.Background(), "post_backup", hook+" "+out, time.Minute, env, errors.New("upload failed"))
+	got, err = os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "db 1 tank/db@zrb_level1_2024-01-15_00-00 failure upload failed\n", string(got))
+
+	Post(context.Background(), "post_backup", hook+" "+out, time.Minute, env, nil)
+	got, err = os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "db 1 tank/db@zrb_level1_2024-01-15_00-00 success unset\n", string(got))
+}
+
+func TestRunLogsOutput(t *testing.T) {
+	log := captureLog(t)
+	hook := script(t, "echo flushed tables\necho warning >&2\nprintf 'no newline'\n")
+
+	require.NoError(t, Run(context.Background(), "pre_snapshot", hook, time.Minute, Env{}))
+	assert.Contains(t, log.String(), `msg="Hook output" hook=pre_snapshot line="flushed tables"`)
+	assert.Contains(t, log.String(), `msg="Hook output" hook=pre_snapshot line=warning`)
+	assert.Contains(t, log.String(), `msg="Hook output" hook=pre_snapshot line="no newline"`)
+}
+
+func TestRunFailure(t *testing.T) {
+	err := Run(context.Background(), "pre_snapshot", script(t, "exit 3"), time.Minute, Env{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "pre_snapshot hook failed: exit status 3")
+}
+
+func TestRunTimeout(t *testing.T) {
+	start := time.Now()
+	err := Run(context.Background(), "pre_snapshot", script(t, "sleep 10"), 100*time.Millisecond, Env{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "pre_snapshot hook timed out after 100ms")
+	assert.Less(t, time.Since(start), 3*time.Second, "the sleep child is killed with its shell")
+}
+
+func TestRunEmptyCommand(t *testing.T) {
+	log := captureLog(t)
+	require.NoError(t, Run(context.Background(), "post_backup", "", time.Minute, Env{}))
+	assert.Empty(t, log.String())
+}
+
+func TestPostIgnoresCancellation(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "ran")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	Post(ctx, "post_snapshot", "touch "+out, time.Minute, Env{}, ctx.Err())
+	assert.FileExists(t, out)
+}
+
+func TestPostLogsFailure(t *testing.T) {
+	log := captureLog(t)
+	Post(context.Background(), "post_backup", "exit 1", time.Minute, Env{}, nil)
+	assert.Contains(t, log.String(), `level=ERROR msg="Post hook failed" hook=post_backup`)
+}
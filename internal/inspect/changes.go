@@ -0,0 +1,158 @@
+package inspect
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"zrb/internal/crypto"
+	"zrb/internal/remote"
+	"zrb/internal/zfs"
+)
+
+// output is where Changes prints the change list. Replaced by tests.
+var output io.Writer = os.Stdout
+
+// changeTypes map the names zrb diff --type accepts to the change types of zfs diff.
+var changeTypes = map[string]string{
+	"added":    zfs.ChangeAdded,
+	"removed":  zfs.ChangeRemoved,
+	"modified": zfs.ChangeModified,
+	"renamed":  zfs.ChangeRenamed,
+}
+
+// ChangeFilter picks the lines zrb diff prints: those with a path, or for renames either path,
+// below PathPrefix, of one of Types (+, -, M, R or their names), all when empty.
+type ChangeFilter struct {
+	PathPrefix string
+	Types      []string
+}
+
+// match returns a function that reports whether a change passes the filter.
+func (f ChangeFilter) match() (func(zfs.Change) bool, error) {
+	types := make(map[string]bool)
+	for _, t := range f.Types {
+		if name, ok := changeTypes[strings.ToLower(t)]; ok {
+			t = name
+		}
+		switch t {
+		case zfs.ChangeAdded, zfs.ChangeRemoved, zfs.ChangeModified, zfs.ChangeRenamed:
+			types[t] = true
+		default:
+			return nil, fmt.Errorf("unknown change type %q, expected +, -, M, R, added, removed, modified or renamed", t)
+		}
+	}
+	return func(c zfs.Change) bool {
+		if len(types) > 0 && !types[c.Type] {
+			return false
+		}
+		return f.PathPrefix == "" || strings.HasPrefix(c.Path, f.PathPrefix) ||
+			(c.NewPath != "" && strings.HasPrefix(c.NewPath, f.PathPrefix))
+	}, nil
+}
+
+// Changes prints the change list of the backup at loc, as zfs diff -H printed it when the backup
+// was taken, limited to the lines filter picks. The list is read next to a local manifest when it
+// is still there, and downloaded from next to the parts otherwise.
+func Changes(ctx context.Context, configPath string, loc Location, privateKeyPath string, filter ChangeFilter) error {
+	match, err := filter.match()
+	if err != nil {
+		return err
+	}
+	l := &loader{configPath: configPath}
+	got, err := l.load(ctx, loc)
+	if err != nil {
+		return err
+	}
+	m := got.manifest
+	switch {
+	case m.Changes == nil && m.BackupLevel == 0:
+		return fmt.Errorf("backup %s is a level 0 backup, which has no change list", m.TargetSnapshot)
+	case m.Changes == nil:
+		return fmt.Errorf("backup %s has no change list; set record_changes on the task to record one", m.TargetSnapshot)
+	case m.Changes.File == "":
+		return fmt.Errorf("the change list of backup %s is unavailable, zfs diff failed during the backup: %s", m.TargetSnapshot, m.Changes.Unavailable)
+	}
+
+	identities, err := crypto.LoadIdentities(privateKeyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load private key: %w", err)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "zrb_changes_*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var encrypted string
+	if !strings.HasPrefix(got.from, "s3://") {
+		local := filepath.Join(filepath.Dir(got.from), m.Changes.File)
+		if _, err := os.Stat(local); err == nil {
+			encrypted = local
+		} else if m.LocalOnly {
+			return fmt.Errorf("change list of local-only backup %s not found at %s", m.TargetSnapshot, local)
+		}
+	}
+	if encrypted == "" {
+		encrypted = filepath.Join(tmpDir, m.Changes.File)
+		key := remote.DataPath(m.S3Prefix, m.TargetS3Path, m.Changes.File)
+		if err := l.download(ctx, "change list", key, encrypted); err != nil {
+			return err
+		}
+	}
+
+	hash, err := crypto.BLAKE3File(encrypted)
+	if err != nil {
+		return fmt.Errorf("failed to calculate change list BLAKE3: %w", err)
+	}
+	if hash != m.Changes.Blake3Hash {
+		return fmt.Errorf("change list BLAKE3 mismatch: manifest records %s, got %s", m.Changes.Blake3Hash, hash)
+	}
+	plain := filepath.Join(tmpDir, "changes.txt.gz")
+	if err := crypto.Decrypt(encrypted, plain, identities...); err != nil {
+		return fmt.Errorf("failed to decrypt change list: %w", err)
+	}
+
+	f, err := os.Open(plain)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := printChanges(output, f, match); err != nil {
+		return err
+	}
+	if m.Changes.Truncated {
+		fmt.Fprintf(os.Stderr, "The change list was truncated at record_changes_max_size after %d lines; later changes are missing\n", m.Changes.Lines)
+	}
+	return nil
+}
+
+// printChanges writes the lines of the compressed change list r that match picks.
+func printChanges(w io.Writer, r io.Reader, match func(zfs.Change) bool) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("failed to read change list: %w", err)
+	}
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		change, err := zfs.ParseChange(scanner.Text())
+		if err != nil {
+			return err
+		}
+		if match(change) {
+			if _, err := fmt.Fprintln(w, scanner.Text()); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read change list: %w", err)
+	}
+	return nil
+}
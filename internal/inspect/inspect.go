@@ -0,0 +1,376 @@
+// Package inspect implements zrb manifest: printing, validating and comparing task manifests
+// stored locally or on S3, and zrb diff, which prints the change list a manifest refers to.
+package inspect
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"zrb/internal/config"
+	"zrb/internal/manifest"
+	"zrb/internal/remote"
+
+	"gopkg.in/yaml.v3"
+)
+
+const manifestName = "task_manifest.yaml"
+
+// Location names a task manifest: Path is a local file or s3://<key> relative to the configured S3
+// prefix; otherwise TaskName and Level pick the manifest of a backup level, the latest one or the
+// one dated Date (YYYYMMDD), from Source (local or s3).
+type Location struct {
+	Path     string
+	TaskName string
+	Level    int16
+	Date     string
+	Source   string
+}
+
+// loaded is a manifest together with its raw YAML and where it was read from.
+type loaded struct {
+	from     string
+	raw      []byte
+	manifest *manifest.Backup
+}
+
+// loader loads the config only when a location needs it, so local paths work without one.
+type loader struct {
+	configPath string
+	cfg        *config.Config
+}
+
+func (l *loader) config() (*config.Config, error) {
+	if l.cfg == nil {
+		cfg, err := config.Load(l.configPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load config: %w", err)
+		}
+		l.cfg = cfg
+	}
+	return l.cfg, nil
+}
+
+func (l *loader) load(ctx context.Context, loc Location) (*loaded, error) {
+	if loc.Path != "" {
+		if key, ok := strings.CutPrefix(loc.Path, "s3://"); ok {
+			return l.fetch(ctx, strings.TrimPrefix(key, "/"))
+		}
+		return readLocal(loc.Path)
+	}
+
+	if loc.TaskName == "" {
+		return nil, fmt.Errorf("either --path or --task is required")
+	}
+	if loc.Level < 0 {
+		return nil, fmt.Errorf("--level is required with --task")
+	}
+	cfg, err := l.config()
+	if err != nil {
+		return nil, err
+	}
+	task, err := cfg.FindTask(loc.TaskName)
+	if err != nil {
+		return nil, err
+	}
+
+	// s3_path of a backup, also its directory below the task root of base_dir or staging_dir
+	var s3Path, localPath string
+	if loc.Date != "" {
+		if _, err := time.Parse("20060102", loc.Date); err != nil {
+			return nil, fmt.Errorf("invalid --date %q, expected YYYYMMDD", loc.Date)
+		}
+		s3Path = filepath.Join(task.Pool, task.Dataset, fmt.Sprintf("level%d", loc.Level), loc.Date)
+		localPath = filepath.Join(cfg.TaskRoot(task), s3Path, manifestName)
+	} else {
+		ref, err := l.latest(ctx, cfg, task, loc)
+		if err != nil {
+			return nil, err
+		}
+		s3Path, localPath = ref.S3Path, ref.Manifest
+	}
+
+	if loc.Source == "s3" {
+		return l.fetch(ctx, remote.ManifestPath(task.S3Prefix, s3Path, manifestName))
+	}
+	return readLocal(localPath)
+}
+
+// latest returns the last backup manifest's entry for loc.Level, read from loc.Source.
+func (l *loader) latest(ctx context.Context, cfg *config.Config, task *config.Task, loc Location) (*manifest.Ref, error) {
+	var data []byte
+	if loc.Source == "s3" {
+		got, err := l.fetch(ctx, remote.ManifestPath(task.S3Prefix, task.Pool, task.Dataset, "last_backup_manifest.yaml"))
+		if err != nil {
+			return nil, err
+		}
+		data = got.raw
+	} else {
+		var err error
+		data, err = os.ReadFile(filepath.Join(cfg.BaseDir, "run", task.Pool, task.Dataset, "last_backup_manifest.yaml"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read last backup manifest: %w", err)
+		}
+	}
+
+	last, err := manifest.ParseLast(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse last backup manifest: %w", err)
+	}
+	if int(loc.Level) >= len(last.BackupLevels) || last.BackupLevels[loc.Level] == nil {
+		return nil, fmt.Errorf("no level %d backup recorded for task %s", loc.Level, task.Name)
+	}
+	return last.BackupLevels[loc.Level], nil
+}
+
+func readLocal(path string) (*loaded, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	return parse(path, raw)
+}
+
+// fetch downloads the manifest key, relative to the configured S3 prefix.
+func (l *loader) fetch(ctx context.Context, key string) (*loaded, error) {
+	tmp, err := os.CreateTemp("", "zrb_manifest_*.yaml")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err := l.download(ctx, "manifest", key, tmp.Name()); err != nil {
+		return nil, err
+	}
+	raw, err := os.ReadFile(tmp.Name())
+	if err != nil {
+		return nil, err
+	}
+	return parse("s3://"+key, raw)
+}
+
+// download fetches the object key, relative to the configured S3 prefix, into localPath with the
+// manifest storage class.
+func (l *loader) download(ctx context.Context, what, key, localPath string) error {
+	cfg, err := l.config()
+	if err != nil {
+		return err
+	}
+	if !cfg.RemoteEnabled() {
+		return config.ErrNoRemote
+	}
+
+	backend, err := remote.DefaultCache.Get(ctx, remote.OptionsFromConfig(cfg, cfg.ManifestStorageClass()))
+	if err != nil {
+		return fmt.Errorf("failed to initialize S3 backend: %w", err)
+	}
+	if err := remote.CheckAccessible(ctx, backend, key); err != nil {
+		return fmt.Errorf("cannot read %s from S3: %w", what, err)
+	}
+
+	slog.Debug("Downloading "+what+" from S3", "remote", key)
+	if err := backend.Download(ctx, key, localPath); err != nil {
+		return fmt.Errorf("failed to download %s %s: %w", what, key, err)
+	}
+	return nil
+}
+
+func parse(from string, raw []byte) (*loaded, error) {
+	m, err := manifest.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %w", from, err)
+	}
+	return &loaded{from: from, raw: raw, manifest: m}, nil
+}
+
+// Show prints a task manifest, as a summary or as its raw content in JSON, and fails when it does not validate.
+// With detail, the summary is followed by the parts with when each was encrypted and uploaded.
+func Show(ctx context.Context, configPath string, loc Location, asJSON, detail bool) error {
+	l := &loader{configPath: configPath}
+	got, err := l.load(ctx, loc)
+	if err != nil {
+		return err
+	}
+
+	problems := got.manifest.Validate()
+	if asJSON {
+		if err := printJSON(os.Stdout, got.raw); err != nil {
+			return err
+		}
+		for _, p := range problems {
+			fmt.Fprintln(os.Stderr, "invalid manifest:", p)
+		}
+	} else {
+		if err := printSummary(os.Stdout, got, problems); err != nil {
+			return err
+		}
+		if detail {
+			if err := printParts(os.Stdout, got.manifest); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("manifest %s has %d problem(s)", got.from, len(problems))
+	}
+	return nil
+}
+
+// printJSON converts the raw YAML, so the output shows exactly what the file holds.
+func printJSON(w io.Writer, raw []byte) error {
+	var doc any
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return fmt.Errorf("failed to encode JSON: %w", err)
+	}
+	return nil
+}
+
+func printSummary(w io.Writer, got *loaded, problems []error) error {
+	m := got.manifest
+	mode := m.IncrementalMode
+	if mode == "" {
+		mode = manifest.ModeChain
+	}
+	algorithm, hash := m.StreamHash()
+
+	var flags []string
+	if m.Incomplete {
+		flags = append(flags, "incomplete")
+	}
+	if m.Legacy {
+		flags = append(flags, "legacy")
+	}
+	if m.LocalOnly {
+		flags = append(flags, "local only")
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Manifest:\t%s\n", got.from)
+	fmt.Fprintf(tw, "Dataset:\t%s/%s\n", m.Pool, m.Dataset)
+	fmt.Fprintf(tw, "Level:\t%d (%s)\n", m.BackupLevel, mode)
+	fmt.Fprintf(tw, "Created:\t%s\n", time.Unix(m.Datetime, 0).Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(tw, "Target snapshot:\t%s\n", orNone(m.TargetSnapshot))
+	if m.TargetSnapshotGUID != "" {
+		fmt.Fprintf(tw, "Snapshot guid:\t%s\n", m.TargetSnapshotGUID)
+	}
+	fmt.Fprintf(tw, "Parent snapshot:\t%s\n", orNone(m.ParentSnapshot))
+	fmt.Fprintf(tw, "S3 path:\t%s\n", orNone(m.TargetS3Path))
+	fmt.Fprintf(tw, "Parent S3 path:\t%s\n", orNone(m.ParentS3Path))
+	if m.ParentPolicy != "" {
+		fmt.Fprintf(tw, "Parent policy:\t%s\n", m.ParentPolicy)
+	}
+	fmt.Fprintf(tw, "Stream:\t%s %s, %d bytes\n", algorithm, orNone(hash), m.StreamBytes)
+	fmt.Fprintf(tw, "Send command:\t%s\n", orNone(strings.Join(m.SendArgs, " ")))
+	if m.Chunked() {
+		fmt.Fprintf(tw, "Chunks:\t%d averaging %d bytes, in chunk store %s\n", len(m.Chunks), m.ChunkSizeBytes, m.ChunkStore)
+	} else if m.PartSizeBytes > 0 {
+		fmt.Fprintf(tw, "Parts:\t%d of up to %d bytes\n", len(m.Parts), m.PartSizeBytes)
+	} else {
+		fmt.Fprintf(tw, "Parts:\t%d\n", len(m.Parts))
+	}
+	if m.RecipientCount > 0 {
+		fmt.Fprintf(tw, "Recipients:\t%d (%s)\n", m.RecipientCount, orNone(strings.Join(m.Recipients(), ", ")))
+	} else {
+		fmt.Fprintf(tw, "Recipients:\t%s\n", orNone(strings.Join(m.Recipients(), ", ")))
+	}
+	switch {
+	case m.Changes == nil:
+	case m.Changes.File == "":
+		fmt.Fprintf(tw, "Change list:\tunavailable (%s)\n", m.Changes.Unavailable)
+	case m.Changes.Truncated:
+		fmt.Fprintf(tw, "Change list:\t%d lines, truncated, see zrb diff\n", m.Changes.Lines)
+	default:
+		fmt.Fprintf(tw, "Change list:\t%d lines, see zrb diff\n", m.Changes.Lines)
+	}
+	for _, k := range m.KeyHistory {
+		fmt.Fprintf(tw, "Earlier key:\tlevel %d %s\n", k.BackupLevel, strings.Join(k.Recipients(), ", "))
+	}
+	fmt.Fprintf(tw, "Written by:\tzrb %s on %s\n", orNone(m.ZrbVersion.Version), orNone(m.System.Hostname))
+	fmt.Fprintf(tw, "Flags:\t%s\n", orNone(strings.Join(flags, ", ")))
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(problems) == 0 {
+		fmt.Fprintln(w, "\nValidation: OK")
+		return nil
+	}
+	fmt.Fprintf(w, "\nValidation: %d problem(s)\n", len(problems))
+	for _, p := range problems {
+		fmt.Fprintf(w, "  - %s\n", p)
+	}
+	return nil
+}
+
+// printParts lists the parts of m, with the times the manifest recorded for them.
+func printParts(w io.Writer, m *manifest.Backup) error {
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PART\tHASH\tENCRYPTED\tUPLOADED")
+	for _, p := range m.Parts {
+		algorithm, hash := p.Hash()
+		fmt.Fprintf(tw, "%s\t%s:%s\t%s\t%s\n", p.Index, algorithm, orNone(hash), formatUnix(p.EncryptedAt), formatUnix(p.UploadedAt))
+	}
+	return tw.Flush()
+}
+
+// formatUnix formats Unix seconds, with - for an unrecorded zero.
+func formatUnix(sec int64) string {
+	if sec == 0 {
+		return "-"
+	}
+	return time.Unix(sec, 0).Format("2006-01-02 15:04:05")
+}
+
+// Diff prints the differences between two task manifests, each a local file or s3://<key>.
+func Diff(ctx context.Context, configPath, pathA, pathB string) error {
+	l := &loader{configPath: configPath}
+	a, err := l.load(ctx, Location{Path: pathA})
+	if err != nil {
+		return err
+	}
+	b, err := l.load(ctx, Location{Path: pathB})
+	if err != nil {
+		return err
+	}
+	return printDiff(os.Stdout, a, b)
+}
+
+func printDiff(w io.Writer, a, b *loaded) error {
+	fmt.Fprintf(w, "A: %s\nB: %s\n", a.from, b.from)
+	fmt.Fprintf(w, "Lineage: %s\n", manifest.Lineage(a.manifest, b.manifest))
+
+	diffs := manifest.Diff(a.manifest, b.manifest)
+	if len(diffs) == 0 {
+		fmt.Fprintln(w, "\nNo differences")
+		return nil
+	}
+
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FIELD\tA\tB")
+	for _, d := range diffs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", d.Field, orNone(d.Old), orNone(d.New))
+	}
+	return tw.Flush()
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
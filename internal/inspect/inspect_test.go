@@ -0,0 +1,254 @@
+package inspect
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"zrb/internal/crypto"
+	"zrb/internal/manifest"
+	"zrb/internal/remote"
+	"zrb/internal/remote/remotetest"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testManifest() *manifest.Backup {
+	parts := []manifest.PartInfo{{Index: "aaaaaa", Blake3Hash: "h0"}}
+	return &manifest.Backup{
+		Datetime:        1704067200,
+		Pool:            "tank",
+		Dataset:         "data",
+		TargetSnapshot:  "tank/data@zrb_level0_a",
+		AgePublicKey:    "age1example",
+		Blake3Hash:      "stream",
+		StreamBytes:     42,
+		Parts:           parts,
+		ChecksumsBlake3: manifest.PartChecksumsDigest(parts),
+		TargetS3Path:    "tank/data/level0/20240101",
+	}
+}
+
+// setup writes a config whose base_dir and fake S3 bucket both hold the level 0 manifest.
+func setup(t *testing.T) (configPath, base, bucket string) {
+	t.Helper()
+	dir := t.TempDir()
+	base, bucket = filepath.Join(dir, "base"), filepath.Join(dir, "bucket")
+
+	oldCache := remote.DefaultCache
+	remote.DefaultCache = remote.NewCache(func(context.Context, remote.Options) (remote.Backend, error) {
+		return &remotetest.DirBackend{Dir: bucket}, nil
+	})
+	t.Cleanup(func() { remote.DefaultCache = oldCache })
+
+	localPath := filepath.Join(base, "task", "tank", "data", "level0", "20240101", "task_manifest.yaml")
+	remotePath := filepath.Join(bucket, "manifests", "tank", "data", "level0", "20240101", "task_manifest.yaml")
+	for _, p := range []string{localPath, remotePath} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+		require.NoError(t, manifest.Write(p, testManifest()))
+	}
+	last := &manifest.Last{Pool: "tank", Dataset: "data", BackupLevels: []*manifest.Ref{
+		{Snapshot: "tank/data@zrb_level0_a", Manifest: localPath, S3Path: "tank/data/level0/20240101"},
+	}}
+	require.NoError(t, os.MkdirAll(filepath.Join(base, "run", "tank", "data"), 0o755))
+	require.NoError(t, manifest.WriteLast(filepath.Join(base, "run", "tank", "data", "last_backup_manifest.yaml"), last))
+	require.NoError(t, manifest.WriteLast(filepath.Join(bucket, "manifests", "tank", "data", "last_backup_manifest.yaml"), last))
+
+	configPath = filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: age1example
+s3:
+  enabled: true
+  bucket: b
+  region: us-east-1
+  prefix: p
+  storage_class:
+    manifest: STANDARD
+    backup_data: [STANDARD]
+tasks:
+  - name: t
+    pool: tank
+    dataset: data
+    enabled: true
+`, base)), 0o644))
+	return configPath, base, bucket
+}
+
+func TestLoad(t *testing.T) {
+	configPath, base, _ := setup(t)
+	localPath := filepath.Join(base, "task", "tank", "data", "level0", "20240101", "task_manifest.yaml")
+
+	tests := []struct {
+		name string
+		loc  Location
+		from string
+	}{
+		{"local path", Location{Path: localPath}, localPath},
+		{"s3 path", Location{Path: "s3://manifests/tank/data/level0/20240101/task_manifest.yaml"}, "s3://manifests/tank/data/level0/20240101/task_manifest.yaml"},
+		{"latest local", Location{TaskName: "t", Level: 0, Source: "local"}, localPath},
+		{"latest s3", Location{TaskName: "t", Level: 0, Source: "s3"}, "s3://manifests/tank/data/level0/20240101/task_manifest.yaml"},
+		{"dated local", Location{TaskName: "t", Level: 0, Date: "20240101", Source: "local"}, localPath},
+		{"dated s3", Location{TaskName: "t", Level: 0, Date: "20240101", Source: "s3"}, "s3://manifests/tank/data/level0/20240101/task_manifest.yaml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &loader{configPath: configPath}
+			got, err := l.load(context.Background(), tt.loc)
+			require.NoError(t, err)
+			assert.Equal(t, tt.from, got.from)
+			assert.Equal(t, testManifest(), got.manifest)
+		})
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		l := &loader{configPath: configPath}
+		for loc, want := range map[Location]string{
+			{}:                         "either --path or --task is required",
+			{TaskName: "t", Level: -1}: "--level is required",
+			{TaskName: "t", Level: 3, Source: "local"}:    "no level 3 backup recorded",
+			{TaskName: "t", Level: 0, Date: "2024-01-01"}: "invalid --date",
+			{Path: "s3://manifests/missing.yaml"}:         "cannot read manifest from S3",
+		} {
+			_, err := l.load(context.Background(), loc)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), want)
+		}
+	})
+}
+
+func TestPrintSummary(t *testing.T) {
+	m := testManifest()
+	m.BackupLevel = 1
+	var out bytes.Buffer
+	require.NoError(t, printSummary(&out, &loaded{from: "m.yaml", manifest: m}, m.Validate()))
+
+	assert.Contains(t, out.String(), "Dataset:          tank/data\n")
+	assert.Contains(t, out.String(), "Level:            1 (chain)\n")
+	assert.Contains(t, out.String(), "Stream:           blake3 stream, 42 bytes\n")
+	assert.Contains(t, out.String(), "Send command:     -\n", "not recorded in older manifests")
+	assert.Contains(t, out.String(), "Validation: 2 problem(s)\n  - level 1 backup has no parent_snapshot\n")
+
+	m.SendArgs = []string{"zfs", "send", "-L", "tank/data@zrb_level0_a"}
+	m.PartSizeBytes, m.RecipientCount = 3<<30, 1
+	out.Reset()
+	require.NoError(t, printSummary(&out, &loaded{from: "m.yaml", manifest: m}, nil))
+	assert.Contains(t, out.String(), "Send command:     zfs send -L tank/data@zrb_level0_a\n")
+	assert.Contains(t, out.String(), "Parts:            1 of up to 3221225472 bytes\n")
+	assert.Contains(t, out.String(), "Recipients:       1 (age1example)\n")
+
+	m.Changes = &manifest.Changes{File: manifest.ChangesFile, Lines: 12}
+	out.Reset()
+	require.NoError(t, printSummary(&out, &loaded{from: "m.yaml", manifest: m}, nil))
+	assert.Contains(t, out.String(), "Change list:      12 lines, see zrb diff\n")
+}
+
+func TestPrintParts(t *testing.T) {
+	m := testManifest()
+	m.Parts = []manifest.PartInfo{
+		{Index: "aaaaaa", Blake3Hash: "h1", EncryptedAt: time.Date(2024, 1, 15, 3, 0, 0, 0, time.Local).Unix(), UploadedAt: time.Date(2024, 1, 15, 3, 12, 0, 0, time.Local).Unix()},
+		{Index: "aaaaab", SHA256Hash: "s2"},
+	}
+	var out bytes.Buffer
+	require.NoError(t, printParts(&out, m))
+	assert.Equal(t, `
+PART    HASH       ENCRYPTED            UPLOADED
+aaaaaa  blake3:h1  2024-01-15 03:00:00  2024-01-15 03:12:00
+aaaaab  sha256:s2  -                    -
+`, out.String())
+}
+
+func TestPrintJSON(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, printJSON(&out, []byte("pool: tank\nparts:\n  - index: aaaaaa\n")))
+	assert.JSONEq(t, `{"pool": "tank", "parts": [{"index": "aaaaaa"}]}`, out.String())
+}
+
+func TestPrintDiff(t *testing.T) {
+	a := testManifest()
+	b := testManifest()
+	b.BackupLevel, b.ParentSnapshot, b.TargetSnapshot = 1, a.TargetSnapshot, "tank/data@zrb_level1_b"
+
+	var out bytes.Buffer
+	require.NoError(t, printDiff(&out, &loaded{from: "a.yaml", manifest: a}, &loaded{from: "b.yaml", manifest: b}))
+	assert.Contains(t, out.String(), "Lineage: B (level 1) builds on A (level 0)\n")
+	assert.Contains(t, out.String(), "parent_snapshot  -                       tank/data@zrb_level0_a\n")
+
+	out.Reset()
+	require.NoError(t, printDiff(&out, &loaded{from: "a.yaml", manifest: a}, &loaded{from: "a.yaml", manifest: a}))
+	assert.Contains(t, out.String(), "No differences")
+}
+
+// writeChanges stores lines as the encrypted change list path and returns its BLAKE3.
+func writeChanges(t *testing.T, path, lines string, identity *age.X25519Identity) string {
+	t.Helper()
+	plain := filepath.Join(t.TempDir(), "changes.txt.gz")
+	f, err := os.Create(plain)
+	require.NoError(t, err)
+	gz := gzip.NewWriter(f)
+	_, err = gz.Write([]byte(lines))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	require.NoError(t, f.Close())
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(t, crypto.Encrypt(plain, path, identity.Recipient()))
+	hash, err := crypto.BLAKE3File(path)
+	require.NoError(t, err)
+	return hash
+}
+
+func TestChanges(t *testing.T) {
+	configPath, base, bucket := setup(t)
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "key.txt")
+	require.NoError(t, os.WriteFile(keyPath, []byte(identity.String()+"\n"), 0o600))
+	var out bytes.Buffer
+	defer func(w io.Writer) { output = w }(output)
+	output = &out
+
+	lines := "M\t/tank/data/home\n+\t/tank/data/home/new.txt\n-\t/tank/data/tmp/old\nR\t/tank/data/a\t/tank/data/home/a\n"
+	hash := writeChanges(t, filepath.Join(bucket, "data", "tank", "data", "level1", "20240102", manifest.ChangesFile), lines, identity)
+	m := testManifest()
+	m.BackupLevel, m.ParentSnapshot, m.TargetS3Path = 1, m.TargetSnapshot, "tank/data/level1/20240102"
+	m.Changes = &manifest.Changes{File: manifest.ChangesFile, Blake3Hash: hash, Lines: 4}
+	manifestPath := filepath.Join(base, "task", "tank", "data", "level1", "20240102", "task_manifest.yaml")
+	require.NoError(t, os.MkdirAll(filepath.Dir(manifestPath), 0o755))
+	require.NoError(t, manifest.Write(manifestPath, m))
+	loc := Location{Path: manifestPath}
+
+	require.NoError(t, Changes(context.Background(), configPath, loc, keyPath, ChangeFilter{}))
+	assert.Equal(t, lines, out.String(), "downloaded from next to the parts")
+
+	out.Reset()
+	require.NoError(t, Changes(context.Background(), configPath, loc, keyPath, ChangeFilter{PathPrefix: "/tank/data/home", Types: []string{"added", "R"}}))
+	assert.Equal(t, "+\t/tank/data/home/new.txt\nR\t/tank/data/a\t/tank/data/home/a\n", out.String(), "renames match by either path")
+
+	err = Changes(context.Background(), configPath, loc, keyPath, ChangeFilter{Types: []string{"X"}})
+	assert.ErrorContains(t, err, `unknown change type "X"`)
+
+	// A local-only backup keeps the list next to its manifest
+	m.LocalOnly = true
+	require.NoError(t, manifest.Write(manifestPath, m))
+	err = Changes(context.Background(), configPath, loc, keyPath, ChangeFilter{})
+	assert.ErrorContains(t, err, "change list of local-only backup tank/data@zrb_level0_a not found")
+	writeChanges(t, filepath.Join(filepath.Dir(manifestPath), manifest.ChangesFile), "-\t/tank/data/x\n", identity)
+	err = Changes(context.Background(), configPath, loc, keyPath, ChangeFilter{})
+	assert.ErrorContains(t, err, "change list BLAKE3 mismatch")
+
+	m.Changes = &manifest.Changes{Unavailable: "zfs diff -H failed: permission denied"}
+	require.NoError(t, manifest.Write(manifestPath, m))
+	err = Changes(context.Background(), configPath, loc, keyPath, ChangeFilter{})
+	assert.ErrorContains(t, err, "unavailable, zfs diff failed during the backup: zfs diff -H failed: permission denied")
+
+	m.Changes = nil
+	require.NoError(t, manifest.Write(manifestPath, m))
+	err = Changes(context.Background(), configPath, loc, keyPath, ChangeFilter{})
+	assert.ErrorContains(t, err, "has no change list; set record_changes")
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 	"zrb/internal/config"
 	"zrb/internal/crypto"
@@ -18,37 +17,68 @@ const (
 	publicKeyFile  = "zrb_public.key"
 )
 
-func Generate(_ context.Context) error {
-	for _, f := range []string{privateKeyFile, publicKeyFile} {
+// Generate writes a new key pair to the working directory. With passphrase set the private key is
+// encrypted with a passphrase from ZRB_KEY_PASSPHRASE or the terminal.
+func Generate(_ context.Context, passphrase bool) error {
+	var secret string
+	if passphrase {
+		var err error
+		if secret, err = crypto.NewPassphrase(); err != nil {
+			return err
+		}
+	}
+
+	publicKey, err := WriteKeyPair(privateKeyFile, publicKeyFile, secret)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Public key:  %s\n", publicKey)
+	fmt.Printf("Public key saved to:  %s\n", publicKeyFile)
+	fmt.Printf("Private key saved to: %s\n", privateKeyFile)
+	if passphrase {
+		fmt.Printf("The private key is encrypted with your passphrase; restores ask for it, or read %s.\n", crypto.PassphraseEnv)
+	}
+	fmt.Printf("\nIMPORTANT: Keep the private key secure and do not share it with anyone.\n")
+	fmt.Printf("If you lose the private key, your backups cannot be restored.\n")
+
+	return nil
+}
+
+// WriteKeyPair generates an age key pair, writes both halves without overwriting existing files, and returns the public key.
+// A non-empty passphrase encrypts the private key file, as age -p does.
+func WriteKeyPair(privatePath, publicPath, passphrase string) (string, error) {
+	for _, f := range []string{privatePath, publicPath} {
 		if _, err := os.Stat(f); err == nil {
-			return fmt.Errorf("%s already exists, remove it first", f)
+			return "", fmt.Errorf("%s already exists, remove it first", f)
 		}
 	}
 
 	identity, err := age.GenerateX25519Identity()
 	if err != nil {
-		return fmt.Errorf("failed to generate key pair: %w", err)
+		return "", fmt.Errorf("failed to generate key pair: %w", err)
 	}
 
 	publicKey := identity.Recipient().String()
 	privateKey := identity.String()
 
-	if err := os.WriteFile(privateKeyFile, []byte(privateKey+"\n"), 0o600); err != nil {
-		return fmt.Errorf("failed to write private key: %w", err)
+	data := []byte(privateKey + "\n")
+	if passphrase != "" {
+		if data, err = crypto.EncryptKey(data, passphrase); err != nil {
+			return "", fmt.Errorf("failed to encrypt private key: %w", err)
+		}
 	}
 
-	if err := os.WriteFile(publicKeyFile, []byte(publicKey+"\n"), 0o644); err != nil {
-		os.Remove(privateKeyFile)
-		return fmt.Errorf("failed to write public key: %w", err)
+	if err := os.WriteFile(privatePath, data, 0o600); err != nil {
+		return "", fmt.Errorf("failed to write private key: %w", err)
 	}
 
-	fmt.Printf("Public key:  %s\n", publicKey)
-	fmt.Printf("Public key saved to:  %s\n", publicKeyFile)
-	fmt.Printf("Private key saved to: %s\n", privateKeyFile)
-	fmt.Printf("\nIMPORTANT: Keep the private key secure and do not share it with anyone.\n")
-	fmt.Printf("If you lose the private key, your backups cannot be restored.\n")
+	if err := os.WriteFile(publicPath, []byte(publicKey+"\n"), 0o644); err != nil {
+		os.Remove(privatePath)
+		return "", fmt.Errorf("failed to write public key: %w", err)
+	}
 
-	return nil
+	return publicKey, nil
 }
 
 func Test(_ context.Context, configPath, privateKeyPath string) error {
@@ -59,21 +89,18 @@ func Test(_ context.Context, configPath, privateKeyPath string) error {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
 
-	recipient, err := age.ParseX25519Recipient(cfg.AgePublicKey)
+	recipients, err := crypto.ParseRecipients(cfg.Recipients())
 	if err != nil {
-		return fmt.Errorf("failed to parse public key from config: %w", err)
+		return fmt.Errorf("failed to parse recipients from config: %w", err)
 	}
 
-	fmt.Printf("Public key from config: %s\n", cfg.AgePublicKey)
-
-	privateKeyData, err := os.ReadFile(privateKeyPath)
-	if err != nil {
-		return fmt.Errorf("failed to read private key: %w", err)
+	for _, r := range cfg.Recipients() {
+		fmt.Printf("Recipient from config: %s\n", r)
 	}
 
-	identity, err := age.ParseX25519Identity(strings.TrimSpace(string(privateKeyData)))
+	identities, err := crypto.LoadIdentities(privateKeyPath)
 	if err != nil {
-		return fmt.Errorf("failed to parse private key: %w", err)
+		return err
 	}
 
 	fmt.Printf("Private key loaded from: %s\n", privateKeyPath)
@@ -93,9 +120,9 @@ func Test(_ context.Context, configPath, privateKeyPath string) error {
 
 	encryptedFile := filepath.Join(tempDir, "test.txt.age")
 
-	fmt.Println("\nEncrypting test data with public key...")
+	fmt.Println("\nEncrypting test data to the configured recipients...")
 
-	if err := crypto.Encrypt(testFile, encryptedFile, recipient); err != nil {
+	if err := crypto.Encrypt(testFile, encryptedFile, recipients...); err != nil {
 		return fmt.Errorf("encryption failed: %w", err)
 	}
 
@@ -105,8 +132,8 @@ func Test(_ context.Context, configPath, privateKeyPath string) error {
 
 	fmt.Println("Decrypting test data with private key...")
 
-	if err := crypto.Decrypt(encryptedFile, decryptedFile, identity); err != nil {
-		return fmt.Errorf("decryption failed: %w\nThis means the private key does not match the public key in config", err)
+	if err := crypto.Decrypt(encryptedFile, decryptedFile, identities...); err != nil {
+		return fmt.Errorf("decryption failed: %w\nThis means the private key does not match any recipient in config", err)
 	}
 
 	fmt.Println("Decryption successful")
@@ -0,0 +1,143 @@
+package legacy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"zrb/internal/config"
+	"zrb/internal/manifest"
+	"zrb/internal/remote"
+	"zrb/internal/util"
+)
+
+// Import converts a simple_backup manifest found at source (a local directory or s3://<prefix>)
+// and registers it in the task's last backup manifest so list shows it and restore --manifest can use it.
+func Import(ctx context.Context, configPath, taskName, source string) error {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	task, err := cfg.FindTask(taskName)
+	if err != nil {
+		return err
+	}
+
+	runDir := util.RunDir(cfg.BaseDir, task.Pool, task.Dataset)
+
+	var m *manifest.Backup
+	var manifestPath string
+
+	if prefix, ok := strings.CutPrefix(source, "s3://"); ok {
+		if !cfg.RemoteEnabled() {
+			return config.ErrNoRemote
+		}
+		prefix = strings.Trim(prefix, "/")
+
+		backend, err := remote.DefaultCache.Get(ctx, remote.OptionsFromConfig(cfg, cfg.ManifestStorageClass()))
+		if err != nil {
+			return fmt.Errorf("failed to initialize S3 backend: %w", err)
+		}
+
+		remotePath := path.Join(prefix, manifest.LegacyManifestName)
+		if err := remote.CheckAccessible(ctx, backend, remotePath); err != nil {
+			return fmt.Errorf("cannot import from S3: %w", err)
+		}
+
+		downloaded := filepath.Join(os.TempDir(), fmt.Sprintf("legacy_manifest_%s.yaml", taskName))
+		defer os.Remove(downloaded)
+
+		slog.Info("Downloading legacy manifest from S3", "remote", remotePath)
+		if err := backend.Download(ctx, remotePath, downloaded); err != nil {
+			return fmt.Errorf("failed to download legacy manifest: %w", err)
+		}
+
+		if m, err = readLegacy(downloaded); err != nil {
+			return err
+		}
+		if m.TargetS3Path == "" {
+			// Parts are expected next to the manifest; restore prepends data/ itself.
+			m.TargetS3Path = strings.TrimPrefix(prefix, "data/")
+		}
+		manifestPath = filepath.Join(runDir, "legacy", time.Unix(m.Datetime, 0).Format("20060102150405"), "task_manifest.yaml")
+	} else {
+		if m, err = readLegacy(filepath.Join(source, manifest.LegacyManifestName)); err != nil {
+			return err
+		}
+		// Next to the legacy parts, where a local restore --manifest looks for them.
+		manifestPath = filepath.Join(source, "task_manifest.yaml")
+	}
+
+	if m.Pool != task.Pool || m.Dataset != task.Dataset {
+		return fmt.Errorf("legacy manifest is for %s/%s, but task %s backs up %s/%s", m.Pool, m.Dataset, taskName, task.Pool, task.Dataset)
+	}
+
+	if err := util.MkdirAll(filepath.Dir(manifestPath)); err != nil {
+		return fmt.Errorf("failed to create manifest directory: %w", err)
+	}
+	if err := manifest.Write(manifestPath, m); err != nil {
+		return fmt.Errorf("failed to write converted manifest: %w", err)
+	}
+
+	lastPath := filepath.Join(runDir, "last_backup_manifest.yaml")
+	if err := Register(lastPath, task, m, manifestPath); err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported legacy backup %s (%d parts) as %s\n", m.TargetSnapshot, len(m.Parts), manifestPath)
+	fmt.Printf("Restore it with: zrb restore --config %s --task %s --level 0 --manifest %s ...\n", configPath, taskName, manifestPath)
+	return nil
+}
+
+func readLegacy(filename string) (*manifest.Backup, error) {
+	m, err := manifest.Read(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read legacy manifest: %w", err)
+	}
+	if !m.Legacy {
+		return nil, fmt.Errorf("%s is not a simple_backup manifest", filename)
+	}
+	return m, nil
+}
+
+// Register adds the converted manifest to the legacy list of the last backup manifest,
+// replacing an earlier import of the same snapshot. The level chain is left untouched.
+func Register(lastPath string, task *config.Task, m *manifest.Backup, manifestPath string) error {
+	last := &manifest.Last{Pool: task.Pool, Dataset: task.Dataset}
+	if existing, err := manifest.ReadLast(lastPath); err == nil {
+		last = existing
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read last backup manifest: %w", err)
+	}
+
+	ref := &manifest.Ref{
+		Datetime: m.Datetime,
+		Snapshot: m.TargetSnapshot,
+		Manifest: manifestPath,
+		S3Path:   m.TargetS3Path,
+	}
+
+	replaced := false
+	for i, r := range last.Legacy {
+		if r.Snapshot == ref.Snapshot {
+			last.Legacy[i] = ref
+			replaced = true
+		}
+	}
+	if !replaced {
+		last.Legacy = append(last.Legacy, ref)
+	}
+
+	if err := util.MkdirAll(filepath.Dir(lastPath)); err != nil {
+		return fmt.Errorf("failed to create run directory: %w", err)
+	}
+	if err := manifest.WriteLast(lastPath, last); err != nil {
+		return fmt.Errorf("failed to write last backup manifest: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package legacy
+
+import (
+	"path/filepath"
+	"testing"
+	"zrb/internal/config"
+	"zrb/internal/manifest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegister(t *testing.T) {
+	lastPath := filepath.Join(t.TempDir(), "last_backup_manifest.yaml")
+	task := &config.Task{Name: "t", Pool: "tank", Dataset: "data"}
+
+	level0 := &manifest.Ref{Snapshot: "tank/data@zrb_level0_x", Blake3Hash: "h"}
+	require.NoError(t, manifest.WriteLast(lastPath, &manifest.Last{Pool: "tank", Dataset: "data", BackupLevels: []*manifest.Ref{level0}}))
+
+	m := &manifest.Backup{Legacy: true, Datetime: 1, TargetSnapshot: "tank/data@simple_1", TargetS3Path: "old/prefix"}
+	require.NoError(t, Register(lastPath, task, m, "/imports/one/task_manifest.yaml"))
+	// Importing the same snapshot again replaces the earlier entry.
+	require.NoError(t, Register(lastPath, task, m, "/imports/two/task_manifest.yaml"))
+	require.NoError(t, Register(lastPath, task, &manifest.Backup{Legacy: true, Datetime: 2, TargetSnapshot: "tank/data@simple_2"}, "/imports/three/task_manifest.yaml"))
+
+	last, err := manifest.ReadLast(lastPath)
+	require.NoError(t, err)
+	assert.Equal(t, []*manifest.Ref{level0}, last.BackupLevels, "level chain is untouched")
+	require.Len(t, last.Legacy, 2)
+	assert.Equal(t, "/imports/two/task_manifest.yaml", last.Legacy[0].Manifest)
+	assert.Equal(t, "old/prefix", last.Legacy[0].S3Path)
+	assert.Equal(t, "tank/data@simple_2", last.Legacy[1].Snapshot)
+}
+
+func TestRegisterWithoutLastManifest(t *testing.T) {
+	lastPath := filepath.Join(t.TempDir(), "run", "last_backup_manifest.yaml")
+	task := &config.Task{Name: "t", Pool: "tank", Dataset: "data"}
+
+	require.NoError(t, Register(lastPath, task, &manifest.Backup{TargetSnapshot: "tank/data@simple_1"}, "m.yaml"))
+
+	last, err := manifest.ReadLast(lastPath)
+	require.NoError(t, err)
+	assert.Equal(t, "tank", last.Pool)
+	assert.Empty(t, last.BackupLevels)
+	assert.Len(t, last.Legacy, 1)
+}
@@ -7,6 +7,8 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 	"zrb/internal/config"
 	"zrb/internal/manifest"
@@ -26,6 +28,20 @@ type Info struct {
 	EstimatedSizeGB int    `json:"estimated_size_gb"`
 	S3Path          string `json:"s3_path"`
 	ManifestPath    string `json:"manifest_path,omitempty"`
+	// LocalOnly marks backups of tasks with upload: false, which exist only under base_dir/task.
+	LocalOnly bool `json:"local_only,omitempty"`
+	// SizeBytes is the size of the encrypted parts, zero when the manifest did not record the size
+	// of every part, as manifests written before part sizes were recorded do not.
+	SizeBytes int64 `json:"size_bytes,omitempty"`
+	// Details explains why parts_count and estimated_size_gb are zero, when they are.
+	Details string `json:"details,omitempty"`
+	// Discovered marks backups found by scanning the bucket for task manifests rather than through
+	// the last backup manifest, see Scan.
+	Discovered bool `json:"discovered_by_scan,omitempty"`
+	// InSync tells, with --source both, whether the local and the S3 last backup manifests record
+	// the same backup at this level; SyncDetails says how they differ when they do not.
+	InSync      *bool  `json:"in_sync,omitempty"`
+	SyncDetails string `json:"sync_details,omitempty"`
 }
 
 type Output struct {
@@ -39,71 +55,329 @@ type Output struct {
 		FullBackups          int `json:"full_backups"`
 		IncrementalBackups   int `json:"incremental_backups"`
 		TotalEstimatedSizeGB int `json:"total_estimated_size_gb"`
+		// TotalSizeBytes sums SizeBytes, leaving out backups without recorded part sizes.
+		TotalSizeBytes int64 `json:"total_size_bytes"`
+		// SyncStatus is, with --source both, one of the Sync constants.
+		SyncStatus string `json:"sync_status,omitempty"`
 	} `json:"summary"`
 }
 
-func Run(ctx context.Context, configPath, taskName string, filterLevel int16, source string) error {
-	cfg, err := config.Load(configPath)
-	if err != nil {
-		return fmt.Errorf("failed to load config: %w", err)
-	}
+// Sync statuses of a listing with --source both.
+const (
+	// SyncInSync is every listed level recording the same backup locally and in S3.
+	SyncInSync = "in_sync"
+	// SyncDiverged is a listed level missing on one side or recording another backup there.
+	SyncDiverged = "diverged"
+	// SyncRemoteUnavailable is a last backup manifest in S3 that could not be read, so only the
+	// local one is listed.
+	SyncRemoteUnavailable = "remote_unavailable"
+	// SyncLocalUnavailable is a local last backup manifest that could not be read, so only the one
+	// in S3 is listed.
+	SyncLocalUnavailable = "local_unavailable"
+)
+
+type Options struct {
+	ConfigPath string
+	// Standalone replaces the config file when listing from a bare machine.
+	Standalone config.Standalone
+	// Tasks are task names or globs, see config.Config.SelectTasks; empty lists the standalone task.
+	Tasks       []string
+	FilterLevel int16
+	// Source is local, s3, or both, which merges the local and S3 last backup manifests and marks
+	// where they differ.
+	Source string
+	// Strict fails the command when a referenced task manifest cannot be read from any source.
+	Strict bool
+	// Scan lists the task manifests in the bucket instead of reading the last backup manifest,
+	// which a listing from S3 falls back to when the last backup manifest is missing.
+	Scan bool
+}
 
-	task, err := cfg.FindTask(taskName)
+func Run(ctx context.Context, opts Options) error {
+	if opts.Scan && opts.Source != "s3" {
+		return fmt.Errorf("--scan lists the bucket and needs --source s3")
+	}
+	cfg, tasks, single, err := resolveTasks(opts)
 	if err != nil {
 		return err
 	}
 
-	var lastBackup *manifest.Last
-	var lastPath string
+	var outputs []*Output
+	unavailable := 0
+	for _, task := range tasks {
+		output, n, err := listTask(ctx, cfg, task, opts)
+		if err != nil {
+			if !single {
+				return fmt.Errorf("task %s: %w", task.Name, err)
+			}
+			return err
+		}
+		outputs = append(outputs, output)
+		unavailable += n
+	}
 
-	if source == "s3" {
-		if !cfg.S3.Enabled {
-			return fmt.Errorf("S3 is not enabled in config")
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	// A single task named exactly keeps the object, anything else lists an array of them
+	var v any = outputs
+	if single {
+		v = outputs[0]
+	}
+	if err := encoder.Encode(v); err != nil {
+		return fmt.Errorf("failed to encode JSON: %w", err)
+	}
+
+	if opts.Strict && unavailable > 0 {
+		return fmt.Errorf("%d backup manifest(s) could not be read from any source", unavailable)
+	}
+	return nil
+}
+
+// resolveTasks returns the tasks opts.Tasks selects, and whether it named exactly one task.
+func resolveTasks(opts Options) (*config.Config, []*config.Task, bool, error) {
+	if opts.Standalone.Enabled() {
+		if len(opts.Tasks) > 1 {
+			return nil, nil, false, fmt.Errorf("--task takes a single name without a config file")
+		}
+		var taskName string
+		if len(opts.Tasks) == 1 {
+			taskName = opts.Tasks[0]
+		}
+		cfg, task, err := config.Resolve(opts.ConfigPath, taskName, opts.Standalone)
+		if err != nil {
+			return nil, nil, false, err
 		}
+		return cfg, []*config.Task{task}, true, nil
+	}
 
-		manifestStorageClass := string(cfg.S3.StorageClass.Manifest)
-		if err := remote.ValidateStorageClass(manifestStorageClass); err != nil {
-			return fmt.Errorf("cannot list from S3: %w", err)
+	if len(opts.Tasks) == 0 {
+		return nil, nil, false, fmt.Errorf("--task is required when using a config file")
+	}
+	cfg, err := config.Load(opts.ConfigPath)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("failed to load config: %w", err)
+	}
+	names, err := cfg.SelectTasks(opts.Tasks)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	tasks := make([]*config.Task, len(names))
+	for i, name := range names {
+		if tasks[i], err = cfg.FindTask(name); err != nil {
+			return nil, nil, false, err
 		}
+	}
+	single := len(opts.Tasks) == 1 && len(names) == 1 && names[0] == opts.Tasks[0]
+	return cfg, tasks, single, nil
+}
 
-		maxRetryAttempts := cfg.S3RetryAttempts()
+// listTask reads the last backup manifest of task from opts.Source and collects its backups, or
+// scans the bucket for them. It also returns how many of their manifests could not be read.
+func listTask(ctx context.Context, cfg *config.Config, task *config.Task, opts Options) (*Output, int, error) {
+	taskName := task.Name
+	source, filterLevel := opts.Source, opts.FilterLevel
+	var lastPath string
+
+	if source == "both" {
+		return listBoth(ctx, cfg, task, filterLevel)
+	}
+	if source == "s3" {
+		if !cfg.RemoteEnabled() {
+			return nil, 0, config.ErrNoRemote
+		}
 
-		backend, err := remote.NewS3(ctx, cfg.S3.Bucket, cfg.S3.Region,
-			cfg.S3.Prefix, cfg.S3.Endpoint,
-			cfg.S3.StorageClass.Manifest, maxRetryAttempts)
+		backend, err := remote.DefaultCache.Get(ctx, remote.OptionsFromConfig(cfg, cfg.ManifestStorageClass()))
 		if err != nil {
-			return fmt.Errorf("failed to initialize S3 backend: %w", err)
+			return nil, 0, fmt.Errorf("failed to initialize S3 backend: %w", err)
 		}
 
 		if err := backend.VerifyCredentials(ctx); err != nil {
-			return fmt.Errorf("AWS credentials verification failed: %w", err)
+			return nil, 0, fmt.Errorf("credentials verification failed: %w", err)
 		}
 
-		remotePath := filepath.Join("manifests", task.Pool, task.Dataset, "last_backup_manifest.yaml")
+		remotePath := remote.ManifestPath(task.S3Prefix, task.Pool, task.Dataset, "last_backup_manifest.yaml")
 		lastPath = filepath.Join(os.TempDir(), fmt.Sprintf("last_backup_manifest_%s.yaml", taskName))
 
+		scan := opts.Scan
+		if !scan {
+			err := remote.CheckAccessible(ctx, backend, remotePath)
+			switch {
+			case remote.IsNotFound(err):
+				slog.Warn("Last backup manifest not found, scanning the bucket for task manifests", "remote", remotePath)
+				scan = true
+			case err != nil:
+				return nil, 0, fmt.Errorf("cannot list from S3: %w\nAlternatively, use --source local or --source both if this host has the local manifests", err)
+			}
+		}
+		if scan {
+			scanned, err := Scan(ctx, backend, task)
+			if err != nil {
+				return nil, 0, fmt.Errorf("failed to scan the bucket: %w", err)
+			}
+			output := collectScanned(task, scanned, filterLevel)
+			return &output, 0, nil
+		}
+
 		slog.Info("Downloading manifest from S3", "remote", remotePath, "local", lastPath)
 
 		if err := backend.Download(ctx, remotePath, lastPath); err != nil {
-			return fmt.Errorf("failed to download manifest from S3: %w", err)
+			return nil, 0, fmt.Errorf("failed to download manifest from S3: %w", err)
 		}
 		defer os.Remove(lastPath)
 	} else {
 		lastPath = filepath.Join(cfg.BaseDir, "run", task.Pool, task.Dataset, "last_backup_manifest.yaml")
 	}
 
-	lastBackup, err = manifest.ReadLast(lastPath)
+	lastBackup, err := manifest.ReadLast(lastPath)
 	if err != nil {
-		return fmt.Errorf("failed to read backup manifest from %s: %w", lastPath, err)
+		return nil, 0, fmt.Errorf("failed to read backup manifest from %s: %w", lastPath, err)
+	}
+
+	output, unavailable := collect(ctx, cfg, task, lastBackup, source, filterLevel)
+	return &output, unavailable, nil
+}
+
+// listBoth lists the backups of the local and the S3 last backup manifests merged per level,
+// marking the levels where they differ. When either cannot be read, the other is listed alone.
+func listBoth(ctx context.Context, cfg *config.Config, task *config.Task, filterLevel int16) (*Output, int, error) {
+	if !cfg.RemoteEnabled() {
+		return nil, 0, config.ErrNoRemote
+	}
+
+	localPath := filepath.Join(cfg.BaseDir, "run", task.Pool, task.Dataset, "last_backup_manifest.yaml")
+	local, localErr := manifest.ReadLast(localPath)
+	remoteLast, remoteErr := readRemoteLast(ctx, cfg, task)
+	if localErr != nil && remoteErr != nil {
+		return nil, 0, fmt.Errorf("failed to read backup manifest from %s: %w; and from S3: %w", localPath, localErr, remoteErr)
 	}
 
+	var status string
+	merged := local
+	switch {
+	case remoteErr != nil:
+		slog.Warn("Cannot read the last backup manifest from S3, listing the local one", "error", remoteErr)
+		status = SyncRemoteUnavailable
+	case localErr != nil:
+		slog.Warn("Cannot read the local last backup manifest, listing the one from S3", "path", localPath, "error", localErr)
+		status, merged = SyncLocalUnavailable, remoteLast
+	default:
+		merged = mergeLast(local, remoteLast)
+	}
+
+	output, unavailable := collect(ctx, cfg, task, merged, "both", filterLevel)
+	if status == "" {
+		status = SyncInSync
+		for i := range output.Backups {
+			info := &output.Backups[i]
+			if info.Type == "legacy" {
+				continue
+			}
+			inSync, details, compared := compareRefs(levelRef(local, info.Level), levelRef(remoteLast, info.Level))
+			if !compared {
+				continue
+			}
+			info.InSync, info.SyncDetails = &inSync, details
+			if !inSync {
+				status = SyncDiverged
+			}
+		}
+	}
+	output.Summary.SyncStatus = status
+	return &output, unavailable, nil
+}
+
+// readRemoteLast downloads and reads the last backup manifest of task from S3. A bucket without one
+// has no backups, which is not an error.
+func readRemoteLast(ctx context.Context, cfg *config.Config, task *config.Task) (*manifest.Last, error) {
+	backend, err := remote.DefaultCache.Get(ctx, remote.OptionsFromConfig(cfg, cfg.ManifestStorageClass()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize S3 backend: %w", err)
+	}
+	if err := backend.VerifyCredentials(ctx); err != nil {
+		return nil, fmt.Errorf("credentials verification failed: %w", err)
+	}
+
+	tmp, err := os.CreateTemp("", "last_backup_manifest_*.yaml")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	remotePath := remote.ManifestPath(task.S3Prefix, task.Pool, task.Dataset, "last_backup_manifest.yaml")
+	if err := backend.Download(ctx, remotePath, tmp.Name()); err != nil {
+		if remote.IsNotFound(err) {
+			return &manifest.Last{Pool: task.Pool, Dataset: task.Dataset}, nil
+		}
+		return nil, fmt.Errorf("failed to download manifest from S3: %w", err)
+	}
+	return manifest.ReadLast(tmp.Name())
+}
+
+// mergeLast returns local with the levels only remote records added.
+func mergeLast(local, remoteLast *manifest.Last) *manifest.Last {
+	merged := *local
+	merged.BackupLevels = slices.Clone(local.BackupLevels)
+	for level, ref := range remoteLast.BackupLevels {
+		if level >= len(merged.BackupLevels) {
+			merged.BackupLevels = append(merged.BackupLevels, make([]*manifest.Ref, level+1-len(merged.BackupLevels))...)
+		}
+		if merged.BackupLevels[level] == nil {
+			merged.BackupLevels[level] = ref
+		}
+	}
+	return &merged
+}
+
+func levelRef(last *manifest.Last, level int16) *manifest.Ref {
+	if int(level) >= len(last.BackupLevels) {
+		return nil
+	}
+	return last.BackupLevels[level]
+}
+
+// compareRefs tells whether the local and the S3 last backup manifests record the same backup at
+// a level, and how they differ if not. Local-only backups are not expected in S3 and not compared.
+func compareRefs(local, remoteRef *manifest.Ref) (inSync bool, details string, compared bool) {
+	switch {
+	case local != nil && local.LocalOnly:
+		return false, "", false
+	case local == nil:
+		return false, "missing locally", true
+	case remoteRef == nil:
+		return false, "missing in S3", true
+	case local.Snapshot != remoteRef.Snapshot:
+		return false, fmt.Sprintf("S3 records %s", remoteRef.Snapshot), true
+	case local.Blake3Hash != remoteRef.Blake3Hash:
+		return false, "BLAKE3 differs from S3", true
+	}
+	return true, "", true
+}
+
+// collect lists the backups the last backup manifest references, with the details of their task
+// manifests, and returns how many of those could not be read.
+func collect(ctx context.Context, cfg *config.Config, task *config.Task, lastBackup *manifest.Last, source string, filterLevel int16) (Output, int) {
 	output := Output{
-		Task:    taskName,
+		Task:    task.Name,
 		Pool:    task.Pool,
 		Dataset: task.Dataset,
 		Source:  source,
 		Backups: []Info{},
 	}
+	unavailable := 0
+
+	// details fills in what only the task manifest knows, or marks the entry when it is unreadable.
+	details := func(info *Info, ref *manifest.Ref) {
+		m, err := loadManifest(ctx, cfg, task, source, ref)
+		if err != nil {
+			slog.Debug("Backup manifest unavailable", "snapshot", ref.Snapshot, "manifest", ref.Manifest, "s3Path", ref.S3Path, "error", err)
+			info.Details = unavailableDetails(cfg, ref)
+			unavailable++
+			return
+		}
+		fill(info, m)
+	}
 
 	for level, ref := range lastBackup.BackupLevels {
 		if ref == nil {
@@ -114,62 +388,158 @@ func Run(ctx context.Context, configPath, taskName string, filterLevel int16, so
 			continue
 		}
 
-		backupType := "full"
-		if level > 0 {
-			backupType = "incremental"
-		}
-
-		estimatedSizeGB := len(ref.Blake3Hash)
-
-		if ref.Manifest != "" {
-			if m, err := manifest.Read(ref.Manifest); err == nil {
-				estimatedSizeGB = len(m.Parts) * 3
-			}
+		info := Info{
+			Level:        int16(level),
+			Type:         backupType(int16(level)),
+			Datetime:     ref.Datetime,
+			DatetimeStr:  time.Unix(ref.Datetime, 0).Format("2006-01-02 15:04:05"),
+			Snapshot:     ref.Snapshot,
+			Blake3Hash:   ref.Blake3Hash,
+			S3Path:       ref.S3Path,
+			ManifestPath: ref.Manifest,
+			LocalOnly:    ref.LocalOnly,
 		}
 
-		info := Info{
-			Level:           int16(level),
-			Type:            backupType,
-			Datetime:        ref.Datetime,
-			DatetimeStr:     time.Unix(ref.Datetime, 0).Format("2006-01-02 15:04:05"),
-			Snapshot:        ref.Snapshot,
-			Blake3Hash:      ref.Blake3Hash,
-			EstimatedSizeGB: estimatedSizeGB,
-			S3Path:          ref.S3Path,
-			ManifestPath:    ref.Manifest,
-		}
-
-		if level > 0 && len(lastBackup.BackupLevels) > level-1 && lastBackup.BackupLevels[level-1] != nil {
-			parentRef := lastBackup.BackupLevels[level-1]
+		if parentRef := lastBackup.Parent(lastBackup.Mode(), int16(level)); parentRef != nil {
 			info.ParentSnapshot = parentRef.Snapshot
 			info.ParentS3Path = parentRef.S3Path
 		}
 
-		if ref.Manifest != "" {
-			if m, err := manifest.Read(ref.Manifest); err == nil {
-				info.PartsCount = len(m.Parts)
+		details(&info, ref)
+		output.Backups = append(output.Backups, info)
+	}
+
+	if filterLevel <= 0 {
+		for _, ref := range lastBackup.Legacy {
+			info := Info{
+				Level:        0,
+				Type:         "legacy",
+				Datetime:     ref.Datetime,
+				DatetimeStr:  time.Unix(ref.Datetime, 0).Format("2006-01-02 15:04:05"),
+				Snapshot:     ref.Snapshot,
+				S3Path:       ref.S3Path,
+				ManifestPath: ref.Manifest,
 			}
+			details(&info, ref)
+			output.Backups = append(output.Backups, info)
 		}
+	}
 
-		output.Backups = append(output.Backups, info)
+	summarize(&output)
+	return output, unavailable
+}
+
+func backupType(level int16) string {
+	if level > 0 {
+		return "incremental"
+	}
+	return "full"
+}
+
+// fill sets what only the task manifest m of a backup knows.
+func fill(info *Info, m *manifest.Backup) {
+	info.PartsCount = len(m.Parts)
+	info.EstimatedSizeGB = len(m.Parts) * 3
+	if size := partsSize(m.Parts); size > 0 {
+		info.SizeBytes = size
+		info.EstimatedSizeGB = int((size + 1<<30 - 1) >> 30)
+	}
+	if m.Chunked() {
+		info.PartsCount = len(m.Chunks)
+		info.EstimatedSizeGB = int((m.StreamBytes + 1<<30 - 1) >> 30)
+	}
+	info.LocalOnly = info.LocalOnly || m.LocalOnly
+	// The recorded parent wins over the one the incremental mode implies, as parent_policy
+	// may have based the backup on another level.
+	if m.ParentSnapshot != "" {
+		info.ParentSnapshot, info.ParentS3Path = m.ParentSnapshot, m.ParentS3Path
 	}
+}
 
+// partsSize sums the recorded sizes of parts, or returns 0 when any is unknown.
+func partsSize(parts []manifest.PartInfo) int64 {
+	var total int64
+	for _, p := range parts {
+		if p.SizeBytes == 0 {
+			return 0
+		}
+		total += p.SizeBytes
+	}
+	return total
+}
+
+func summarize(output *Output) {
 	output.Summary.TotalBackups = len(output.Backups)
 	for _, backup := range output.Backups {
-		if backup.Type == "full" {
-			output.Summary.FullBackups++
-		} else {
+		if backup.Type == "incremental" {
 			output.Summary.IncrementalBackups++
+		} else {
+			output.Summary.FullBackups++
 		}
 		output.Summary.TotalEstimatedSizeGB += backup.EstimatedSizeGB
+		output.Summary.TotalSizeBytes += backup.SizeBytes
 	}
+}
 
-	encoder := json.NewEncoder(os.Stdout)
-	encoder.SetIndent("", "  ")
+// loadManifest reads the task manifest of ref from its local path or, once the local copy was
+// cleaned up after upload, from S3.
+func loadManifest(ctx context.Context, cfg *config.Config, task *config.Task, source string, ref *manifest.Ref) (*manifest.Backup, error) {
+	localErr := fmt.Errorf("no local manifest recorded")
+	if ref.Manifest != "" {
+		m, err := readManifest(source, ref.Manifest, cfg.BaseDir, cfg.StagingRoot(task))
+		if err == nil {
+			return m, nil
+		}
+		localErr = err
+	}
+	if !fromS3(cfg, ref) {
+		return nil, localErr
+	}
 
-	if err := encoder.Encode(output); err != nil {
-		return fmt.Errorf("failed to encode JSON: %w", err)
+	backend, err := remote.DefaultCache.Get(ctx, remote.OptionsFromConfig(cfg, cfg.ManifestStorageClass()))
+	if err != nil {
+		return nil, fmt.Errorf("%w; failed to initialize S3 backend: %w", localErr, err)
 	}
 
-	return nil
+	tmp, err := os.CreateTemp("", "list_manifest_*.yaml")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	remotePath := remote.ManifestPath(task.S3Prefix, ref.S3Path, "task_manifest.yaml")
+	if err := backend.Download(ctx, remotePath, tmp.Name()); err != nil {
+		return nil, fmt.Errorf("%w; failed to download %s: %w", localErr, remotePath, err)
+	}
+	return manifest.Read(tmp.Name())
+}
+
+// fromS3 reports whether the manifest of ref can be fetched from S3.
+func fromS3(cfg *config.Config, ref *manifest.Ref) bool {
+	return cfg.RemoteEnabled() && !ref.LocalOnly && ref.S3Path != ""
+}
+
+func unavailableDetails(cfg *config.Config, ref *manifest.Ref) string {
+	switch {
+	case fromS3(cfg, ref):
+		return "unavailable (manifest not found locally or in S3)"
+	case ref.LocalOnly:
+		return "unavailable (manifest not found locally)"
+	default:
+		return "unavailable (manifest not found locally; use --source s3)"
+	}
+}
+
+// readManifest reads the local manifest an entry of the last backup manifest points to. An entry
+// that may come from S3 names a path on whichever host wrote it, so it is only followed below roots,
+// base_dir and the task's staging_dir.
+func readManifest(source, path string, roots ...string) (*manifest.Backup, error) {
+	if source != "local" && !slices.ContainsFunc(roots, func(root string) bool {
+		rel, err := filepath.Rel(root, path)
+		return err == nil && filepath.IsLocal(rel)
+	}) {
+		return nil, fmt.Errorf("manifest %s is outside %s", path, strings.Join(slices.Compact(roots), " and "))
+	}
+	return manifest.Read(path)
 }
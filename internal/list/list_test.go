@@ -0,0 +1,275 @@
+package list
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"zrb/internal/config"
+	"zrb/internal/manifest"
+	"zrb/internal/remote"
+	"zrb/internal/remote/remotetest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setup returns a config whose base_dir holds the level 0 manifest and whose fake bucket holds
+// bucketLevels, with a last backup manifest referencing levels 0 and 1 locally.
+func setup(t *testing.T, s3Enabled bool, bucketLevels ...int) (*config.Config, *config.Task, *manifest.Last) {
+	t.Helper()
+	dir := t.TempDir()
+	base, bucket := filepath.Join(dir, "base"), filepath.Join(dir, "bucket")
+
+	oldCache := remote.DefaultCache
+	remote.DefaultCache = remote.NewCache(func(context.Context, remote.Options) (remote.Backend, error) {
+		return &remotetest.DirBackend{Dir: bucket}, nil
+	})
+	t.Cleanup(func() { remote.DefaultCache = oldCache })
+
+	cfg := &config.Config{BaseDir: base, Tasks: []config.Task{{Name: "t", Pool: "tank", Dataset: "data", Enabled: true}}}
+	cfg.S3 = config.S3Config{Enabled: s3Enabled, Bucket: "b", Region: "us-east-1"}
+	cfg.S3.StorageClass.Manifest = "STANDARD"
+
+	last := &manifest.Last{Pool: "tank", Dataset: "data"}
+	for level, parts := range []int{2, 1} {
+		s3Path := fmt.Sprintf("tank/data/level%d/20240101", level)
+		localPath := filepath.Join(base, "task", s3Path, "task_manifest.yaml")
+		m := &manifest.Backup{Pool: "tank", Dataset: "data", BackupLevel: int16(level)}
+		for i := range parts {
+			m.Parts = append(m.Parts, manifest.PartInfo{Index: fmt.Sprintf("aaaaa%c", 'a'+i)})
+		}
+		if level == 0 {
+			require.NoError(t, os.MkdirAll(filepath.Dir(localPath), 0o755))
+			require.NoError(t, manifest.Write(localPath, m))
+		}
+		for _, l := range bucketLevels {
+			if l == level {
+				remotePath := filepath.Join(bucket, "manifests", s3Path, "task_manifest.yaml")
+				require.NoError(t, os.MkdirAll(filepath.Dir(remotePath), 0o755))
+				require.NoError(t, manifest.Write(remotePath, m))
+			}
+		}
+		last.BackupLevels = append(last.BackupLevels, &manifest.Ref{
+			Snapshot: fmt.Sprintf("tank/data@zrb_level%d", level), Manifest: localPath, S3Path: s3Path, Blake3Hash: "0123456789abcdef",
+		})
+	}
+	return cfg, &cfg.Tasks[0], last
+}
+
+func TestCollectMissingManifest(t *testing.T) {
+	tests := []struct {
+		name         string
+		s3Enabled    bool
+		bucketLevels []int
+		details      string
+		unavailable  int
+	}{
+		{"s3 disabled", false, nil, "unavailable (manifest not found locally; use --source s3)", 1},
+		{"missing everywhere", true, nil, "unavailable (manifest not found locally or in S3)", 1},
+		{"fetched from s3", true, []int{1}, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, task, last := setup(t, tt.s3Enabled, tt.bucketLevels...)
+			output, unavailable := collect(context.Background(), cfg, task, last, "local", -1)
+			require.Len(t, output.Backups, 2)
+			assert.Equal(t, tt.unavailable, unavailable)
+
+			assert.Equal(t, 2, output.Backups[0].PartsCount, "the local manifest is read")
+			assert.Empty(t, output.Backups[0].Details)
+
+			missing := output.Backups[1]
+			assert.Equal(t, tt.details, missing.Details)
+			if tt.details != "" {
+				assert.Zero(t, missing.PartsCount)
+				assert.Zero(t, missing.EstimatedSizeGB, "no estimate without a manifest")
+			} else {
+				assert.Equal(t, 1, missing.PartsCount)
+				assert.Equal(t, 3, missing.EstimatedSizeGB)
+			}
+		})
+	}
+}
+
+func TestFillSizes(t *testing.T) {
+	var output Output
+	for _, parts := range [][]manifest.PartInfo{
+		{{Index: "aaaaaa", SizeBytes: 3 << 30}, {Index: "aaaaab", SizeBytes: 1 << 20}},
+		{{Index: "aaaaaa", SizeBytes: 1 << 20}, {Index: "aaaaab"}},
+	} {
+		var info Info
+		fill(&info, &manifest.Backup{Parts: parts})
+		output.Backups = append(output.Backups, info)
+	}
+	summarize(&output)
+
+	assert.Equal(t, int64(3<<30+1<<20), output.Backups[0].SizeBytes)
+	assert.Equal(t, 4, output.Backups[0].EstimatedSizeGB, "the estimate follows the recorded sizes")
+	assert.Zero(t, output.Backups[1].SizeBytes, "a part without a recorded size leaves the size unknown")
+	assert.Equal(t, 6, output.Backups[1].EstimatedSizeGB)
+	assert.Equal(t, int64(3<<30+1<<20), output.Summary.TotalSizeBytes)
+	assert.Equal(t, 10, output.Summary.TotalEstimatedSizeGB)
+}
+
+func TestCollectLocalOnlyManifest(t *testing.T) {
+	cfg, task, last := setup(t, true, 1)
+	last.BackupLevels[1].LocalOnly = true
+
+	output, unavailable := collect(context.Background(), cfg, task, last, "local", 1)
+	require.Len(t, output.Backups, 1)
+	assert.Equal(t, 1, unavailable)
+	assert.Equal(t, "unavailable (manifest not found locally)", output.Backups[0].Details, "local-only backups are not looked for in S3")
+}
+
+func TestRunStrict(t *testing.T) {
+	cfg, _, last := setup(t, false)
+	runDir := filepath.Join(cfg.BaseDir, "run", "tank", "data")
+	require.NoError(t, os.MkdirAll(runDir, 0o755))
+	require.NoError(t, manifest.WriteLast(filepath.Join(runDir, "last_backup_manifest.yaml"), last))
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+tasks:
+  - name: t
+    pool: tank
+    dataset: data
+    enabled: true
+`, cfg.BaseDir)), 0o644))
+
+	stdout := os.Stdout
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	require.NoError(t, err)
+	os.Stdout = devNull
+	t.Cleanup(func() { os.Stdout = stdout; devNull.Close() })
+
+	opts := Options{ConfigPath: configPath, Tasks: []string{"t"}, FilterLevel: -1, Source: "local"}
+	require.NoError(t, Run(context.Background(), opts))
+
+	opts.Strict = true
+	assert.EqualError(t, Run(context.Background(), opts), "1 backup manifest(s) could not be read from any source")
+}
+
+func TestRunSelectsTasks(t *testing.T) {
+	base := t.TempDir()
+	for _, dataset := range []string{"db", "web"} {
+		runDir := filepath.Join(base, "run", "tank", dataset)
+		require.NoError(t, os.MkdirAll(runDir, 0o755))
+		require.NoError(t, manifest.WriteLast(filepath.Join(runDir, "last_backup_manifest.yaml"), &manifest.Last{}))
+	}
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+tasks:
+  - name: prod-db
+    pool: tank
+    dataset: db
+    enabled: true
+  - name: prod-web
+    pool: tank
+    dataset: web
+    enabled: true
+  - name: staging
+    pool: tank
+    dataset: staging
+    enabled: true
+`, base)), 0o644))
+
+	run := func(tasks ...string) (string, error) {
+		out, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+		require.NoError(t, err)
+		defer out.Close()
+		stdout := os.Stdout
+		os.Stdout = out
+		defer func() { os.Stdout = stdout }()
+		runErr := Run(context.Background(), Options{ConfigPath: configPath, Tasks: tasks, FilterLevel: -1, Source: "local"})
+		data, err := os.ReadFile(out.Name())
+		require.NoError(t, err)
+		return string(data), runErr
+	}
+
+	got, err := run("prod-*")
+	require.NoError(t, err)
+	var outputs []Output
+	require.NoError(t, json.Unmarshal([]byte(got), &outputs), "a glob lists an array")
+	require.Len(t, outputs, 2)
+	assert.Equal(t, "prod-db", outputs[0].Task)
+	assert.Equal(t, "prod-web", outputs[1].Task)
+
+	got, err = run("prod-db")
+	require.NoError(t, err)
+	var output Output
+	require.NoError(t, json.Unmarshal([]byte(got), &output), "a single task name keeps the object")
+	assert.Equal(t, "prod-db", output.Task)
+
+	got, err = run("prod-web", "prod-db")
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal([]byte(got), &outputs))
+	assert.Equal(t, []string{"prod-db", "prod-web"}, []string{outputs[0].Task, outputs[1].Task}, "tasks are listed in config order")
+
+	_, err = run("dev-*")
+	assert.EqualError(t, err, `no task matches "dev-*"`)
+
+	_, err = run("*")
+	assert.ErrorContains(t, err, "task staging: failed to read backup manifest")
+}
+
+func TestListBoth(t *testing.T) {
+	tests := []struct {
+		name    string
+		remote  func(last *manifest.Last) *manifest.Last
+		status  string
+		inSync  []bool
+		details []string
+	}{
+		{"in sync", func(last *manifest.Last) *manifest.Last { return last }, SyncInSync, []bool{true, true}, []string{"", ""}},
+		{"level missing in S3", func(last *manifest.Last) *manifest.Last {
+			return &manifest.Last{BackupLevels: last.BackupLevels[:1]}
+		}, SyncDiverged, []bool{true, false}, []string{"", "missing in S3"}},
+		{"hash differs", func(last *manifest.Last) *manifest.Last {
+			changed := *last.BackupLevels[1]
+			changed.Blake3Hash = "fedcba9876543210"
+			return &manifest.Last{BackupLevels: []*manifest.Ref{last.BackupLevels[0], &changed}}
+		}, SyncDiverged, []bool{true, false}, []string{"", "BLAKE3 differs from S3"}},
+		{"level missing locally", func(last *manifest.Last) *manifest.Last {
+			newer := &manifest.Ref{Snapshot: "tank/data@zrb_level2", S3Path: "tank/data/level2/20240102", Blake3Hash: "0123456789abcdef"}
+			return &manifest.Last{BackupLevels: append(slices.Clone(last.BackupLevels), newer)}
+		}, SyncDiverged, []bool{true, true, false}, []string{"", "", "missing locally"}},
+		{"remote unavailable", nil, SyncRemoteUnavailable, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, task, last := setup(t, true)
+			runDir := filepath.Join(cfg.BaseDir, "run", "tank", "data")
+			require.NoError(t, os.MkdirAll(runDir, 0o755))
+			require.NoError(t, manifest.WriteLast(filepath.Join(runDir, "last_backup_manifest.yaml"), last))
+			if tt.remote != nil {
+				bucket := filepath.Join(filepath.Dir(cfg.BaseDir), "bucket")
+				remotePath := filepath.Join(bucket, "manifests", "tank", "data", "last_backup_manifest.yaml")
+				require.NoError(t, os.MkdirAll(filepath.Dir(remotePath), 0o755))
+				require.NoError(t, manifest.WriteLast(remotePath, tt.remote(last)))
+			}
+
+			output, _, err := listBoth(context.Background(), cfg, task, -1)
+			require.NoError(t, err)
+			assert.Equal(t, tt.status, output.Summary.SyncStatus)
+			if tt.inSync == nil {
+				require.Len(t, output.Backups, 2, "the local manifest is listed alone")
+				for _, info := range output.Backups {
+					assert.Nil(t, info.InSync)
+				}
+				return
+			}
+			require.Len(t, output.Backups, len(tt.inSync))
+			for i, info := range output.Backups {
+				require.NotNil(t, info.InSync)
+				assert.Equal(t, tt.inSync[i], *info.InSync, "level %d", i)
+				assert.Equal(t, tt.details[i], info.SyncDetails, "level %d", i)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package list
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"zrb/internal/config"
+	"zrb/internal/manifest"
+	"zrb/internal/remote"
+)
+
+// Scanned is a backup found by listing the bucket rather than through the last backup manifest.
+type Scanned struct {
+	// S3Path is the dated directory of the backup below the pool and dataset, as in manifest.Ref.
+	S3Path   string
+	Manifest *manifest.Backup
+}
+
+// Scan lists manifests/<pool>/<dataset>/level<N>/<date>/task_manifest.yaml in the bucket and reads
+// each task manifest found, for when the last backup manifest was never uploaded. Manifests that
+// cannot be read or are incomplete are logged and skipped. The backups are sorted by level, then
+// oldest first.
+func Scan(ctx context.Context, backend remote.Backend, task *config.Task) ([]Scanned, error) {
+	prefix := remote.ManifestPath(task.S3Prefix, task.Pool, task.Dataset) + "/"
+	objects, err := backend.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []Scanned
+	for _, object := range objects {
+		// Manifests of child datasets such as <dataset>/child/level0/<date> are a level deeper.
+		elems := strings.Split(strings.TrimPrefix(object.Key, prefix), "/")
+		if len(elems) != 3 || elems[2] != "task_manifest.yaml" {
+			continue
+		}
+		level, err := strconv.ParseInt(strings.TrimPrefix(elems[0], "level"), 10, 16)
+		if !strings.HasPrefix(elems[0], "level") || err != nil {
+			continue
+		}
+
+		m, err := downloadManifest(ctx, backend, object.Key)
+		switch {
+		case err != nil:
+			slog.Warn("Skipping unreadable task manifest", "remote", object.Key, "error", err)
+			continue
+		case m.Incomplete:
+			slog.Warn("Skipping incomplete task manifest", "remote", object.Key)
+			continue
+		case m.BackupLevel != int16(level):
+			slog.Warn("Skipping task manifest stored under another level", "remote", object.Key, "level", m.BackupLevel)
+			continue
+		}
+		found = append(found, Scanned{S3Path: path.Join(task.Pool, task.Dataset, elems[0], elems[1]), Manifest: m})
+	}
+
+	slices.SortFunc(found, func(a, b Scanned) int {
+		return cmp.Or(cmp.Compare(a.Manifest.BackupLevel, b.Manifest.BackupLevel),
+			cmp.Compare(a.Manifest.Datetime, b.Manifest.Datetime), cmp.Compare(a.S3Path, b.S3Path))
+	})
+	slog.Info("Scanned the bucket for task manifests", "prefix", prefix, "objects", len(objects), "backups", len(found))
+	return found, nil
+}
+
+func downloadManifest(ctx context.Context, backend remote.Backend, remotePath string) (*manifest.Backup, error) {
+	tmp, err := os.CreateTemp("", "scan_manifest_*.yaml")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err := backend.Download(ctx, remotePath, tmp.Name()); err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", remotePath, err)
+	}
+	return manifest.Read(tmp.Name())
+}
+
+// collectScanned lists the backups Scan found, each marked as discovered by the scan.
+func collectScanned(task *config.Task, scanned []Scanned, filterLevel int16) Output {
+	output := Output{
+		Task:    task.Name,
+		Pool:    task.Pool,
+		Dataset: task.Dataset,
+		Source:  "s3",
+		Backups: []Info{},
+	}
+	for _, s := range scanned {
+		m := s.Manifest
+		if filterLevel >= 0 && m.BackupLevel != filterLevel {
+			continue
+		}
+		info := Info{
+			Level:       m.BackupLevel,
+			Type:        backupType(m.BackupLevel),
+			Datetime:    m.Datetime,
+			DatetimeStr: time.Unix(m.Datetime, 0).Format("2006-01-02 15:04:05"),
+			Snapshot:    m.TargetSnapshot,
+			Blake3Hash:  m.Blake3Hash,
+			S3Path:      s.S3Path,
+			Discovered:  true,
+			LocalOnly:   m.LocalOnly,
+		}
+		if m.Legacy {
+			info.Type = "legacy"
+		}
+		fill(&info, m)
+		output.Backups = append(output.Backups, info)
+	}
+	summarize(&output)
+	return output
+}
@@ -0,0 +1,136 @@
+package list
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"zrb/internal/config"
+	"zrb/internal/manifest"
+	"zrb/internal/remote"
+	"zrb/internal/remote/remotetest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeBucket stores the task manifests by their key below bucket.
+func writeBucket(t *testing.T, bucket string, manifests map[string]*manifest.Backup) {
+	t.Helper()
+	for key, m := range manifests {
+		path := filepath.Join(bucket, key)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, manifest.Write(path, m))
+	}
+}
+
+func backupAt(level int16, datetime int64, parts int) *manifest.Backup {
+	m := &manifest.Backup{Pool: "tank", Dataset: "data", BackupLevel: level, Datetime: datetime, Blake3Hash: "0123456789abcdef",
+		TargetSnapshot: fmt.Sprintf("tank/data@zrb_level%d_%d", level, datetime)}
+	for i := range parts {
+		m.Parts = append(m.Parts, manifest.PartInfo{Index: fmt.Sprintf("aaaaa%c", 'a'+i)})
+	}
+	return m
+}
+
+func TestScan(t *testing.T) {
+	bucket := t.TempDir()
+	incomplete := backupAt(1, 4, 1)
+	incomplete.Incomplete = true
+	writeBucket(t, bucket, map[string]*manifest.Backup{
+		"manifests/tank/data/level0/20240201/task_manifest.yaml":       backupAt(0, 3, 2),
+		"manifests/tank/data/level0/20240101/task_manifest.yaml":       backupAt(0, 1, 2),
+		"manifests/tank/data/level1/20240102/task_manifest.yaml":       backupAt(1, 2, 1),
+		"manifests/tank/data/level1/20240202/task_manifest.yaml":       incomplete,
+		"manifests/tank/data/level2/20240203/task_manifest.yaml":       backupAt(1, 5, 1),
+		"manifests/tank/data/child/level0/20240101/task_manifest.yaml": backupAt(0, 1, 1),
+	})
+	require.NoError(t, os.WriteFile(filepath.Join(bucket, "manifests/tank/data/level1/20240102/CHECKSUMS.blake3"), nil, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(bucket, "manifests/tank/data/level0/20240301"), nil, 0o644))
+
+	scanned, err := Scan(context.Background(), &remotetest.DirBackend{Dir: bucket}, &config.Task{Pool: "tank", Dataset: "data"})
+	require.NoError(t, err)
+	var paths []string
+	for _, s := range scanned {
+		paths = append(paths, s.S3Path)
+	}
+	assert.Equal(t, []string{"tank/data/level0/20240101", "tank/data/level0/20240201", "tank/data/level1/20240102"}, paths,
+		"sorted by level and time, without the incomplete, misplaced and child dataset manifests")
+	assert.Equal(t, int64(3), scanned[1].Manifest.Datetime)
+}
+
+func TestRunScan(t *testing.T) {
+	dir := t.TempDir()
+	bucket := filepath.Join(dir, "bucket")
+	writeBucket(t, bucket, map[string]*manifest.Backup{
+		"manifests/tank/data/level0/20240101/task_manifest.yaml": backupAt(0, 1, 2),
+		"manifests/tank/data/level1/20240102/task_manifest.yaml": backupAt(1, 2, 1),
+	})
+	oldCache := remote.DefaultCache
+	remote.DefaultCache = remote.NewCache(func(context.Context, remote.Options) (remote.Backend, error) {
+		return &remotetest.DirBackend{Dir: bucket}, nil
+	})
+	t.Cleanup(func() { remote.DefaultCache = oldCache })
+
+	configPath := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+s3:
+  enabled: true
+  bucket: b
+  region: us-east-1
+  storage_class:
+    manifest: STANDARD
+    backup_data: [STANDARD]
+tasks:
+  - name: t
+    pool: tank
+    dataset: data
+    enabled: true
+`, filepath.Join(dir, "base"))), 0o644))
+
+	run := func(opts Options) (Output, error) {
+		out, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+		require.NoError(t, err)
+		defer out.Close()
+		stdout := os.Stdout
+		os.Stdout = out
+		defer func() { os.Stdout = stdout }()
+		opts.ConfigPath, opts.Tasks, opts.FilterLevel = configPath, []string{"t"}, -1
+		runErr := Run(context.Background(), opts)
+		var output Output
+		if runErr == nil {
+			data, err := os.ReadFile(out.Name())
+			require.NoError(t, err)
+			require.NoError(t, json.Unmarshal(data, &output))
+		}
+		return output, runErr
+	}
+
+	// Without a last backup manifest in the bucket, the listing falls back to a scan.
+	output, err := run(Options{Source: "s3"})
+	require.NoError(t, err)
+	require.Len(t, output.Backups, 2)
+	assert.True(t, output.Backups[0].Discovered)
+	assert.Equal(t, "full", output.Backups[0].Type)
+	assert.Equal(t, "tank/data/level0/20240101", output.Backups[0].S3Path)
+	assert.Equal(t, 2, output.Backups[0].PartsCount)
+	assert.Equal(t, "incremental", output.Backups[1].Type)
+	assert.Equal(t, "tank/data@zrb_level1_2", output.Backups[1].Snapshot)
+	assert.Equal(t, 1, output.Summary.IncrementalBackups)
+	assert.Equal(t, 9, output.Summary.TotalEstimatedSizeGB)
+
+	// With one, --scan still lists the bucket.
+	require.NoError(t, manifest.WriteLast(filepath.Join(bucket, "manifests/tank/data/last_backup_manifest.yaml"), &manifest.Last{Pool: "tank", Dataset: "data"}))
+	output, err = run(Options{Source: "s3"})
+	require.NoError(t, err)
+	assert.Empty(t, output.Backups, "the last backup manifest is read")
+	output, err = run(Options{Source: "s3", Scan: true})
+	require.NoError(t, err)
+	assert.Len(t, output.Backups, 2)
+
+	_, err = run(Options{Source: "local", Scan: true})
+	assert.EqualError(t, err, "--scan lists the bucket and needs --source s3")
+}
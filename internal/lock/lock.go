@@ -5,13 +5,37 @@ import (
 	"os"
 	"syscall"
 	"time"
+	"zrb/internal/util"
+	"zrb/internal/version"
 
 	"gopkg.in/yaml.v3"
 )
 
 type Entry struct {
-	Pid       int    `yaml:"pid"`
-	StartedAt string `yaml:"started_at"`
+	Pid        int    `yaml:"pid"`
+	StartedAt  string `yaml:"started_at"`
+	TaskName   string `yaml:"task_name,omitempty"`
+	Hostname   string `yaml:"hostname,omitempty"`
+	Level      int16  `yaml:"level"`
+	ZrbVersion string `yaml:"zrb_version,omitempty"`
+	// Alive is evaluated by Query and never persisted.
+	Alive bool `yaml:"-"`
+}
+
+// ErrHeld is returned by Acquire when a live process holds the lock.
+type ErrHeld struct {
+	Entry Entry
+}
+
+func (e ErrHeld) Error() string {
+	msg := fmt.Sprintf("already locked by pid %d (started %s", e.Entry.Pid, e.Entry.StartedAt)
+	if e.Entry.TaskName != "" {
+		msg += fmt.Sprintf(", task %s level %d", e.Entry.TaskName, e.Entry.Level)
+	}
+	if e.Entry.Hostname != "" {
+		msg += ", host " + e.Entry.Hostname
+	}
+	return msg + ")"
 }
 
 func readLock(path string) (*Entry, error) {
@@ -35,7 +59,7 @@ func writeLock(path string, entry *Entry) error {
 		return err
 	}
 	tmp := path + ".tmp"
-	if err := os.WriteFile(tmp, data, 0644); err != nil {
+	if err := util.WriteFile(tmp, data); err != nil {
 		return err
 	}
 	return os.Rename(tmp, path)
@@ -55,20 +79,43 @@ func isProcessAlive(pid int) bool {
 	return true
 }
 
+// Query returns the current lock entries with liveness evaluated, without acquiring the lock.
+func Query(lockPath string) ([]Entry, error) {
+	entry, err := readLock(lockPath)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	entry.Alive = isProcessAlive(entry.Pid)
+	return []Entry{*entry}, nil
+}
+
 // Returns a release function which should be called (deferred) when work is done.
-func Acquire(lockPath string) (func() error, error) {
+func Acquire(lockPath, taskName string, level int16) (func() error, error) {
 	existing, err := readLock(lockPath)
 	if err != nil {
 		return nil, err
 	}
 
-	if existing != nil && existing.Pid > 0 && isProcessAlive(existing.Pid) {
-		return nil, fmt.Errorf("already locked by pid %d (started %s)", existing.Pid, existing.StartedAt)
+	if existing != nil && isProcessAlive(existing.Pid) {
+		existing.Alive = true
+		return nil, ErrHeld{Entry: *existing}
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = ""
 	}
 
 	entry := &Entry{
-		Pid:       os.Getpid(),
-		StartedAt: time.Now().Format(time.RFC3339),
+		Pid:        os.Getpid(),
+		StartedAt:  time.Now().Format(time.RFC3339),
+		TaskName:   taskName,
+		Hostname:   hostname,
+		Level:      level,
+		ZrbVersion: version.Version,
 	}
 	if err := writeLock(lockPath, entry); err != nil {
 		return nil, err
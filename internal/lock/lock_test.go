@@ -13,7 +13,7 @@ import (
 func TestAcquireAndRelease(t *testing.T) {
 	lockPath := filepath.Join(t.TempDir(), "zrb.lock")
 
-	release, err := Acquire(lockPath)
+	release, err := Acquire(lockPath, "t", 1)
 	require.NoError(t, err)
 
 	data, err := os.ReadFile(lockPath)
@@ -31,22 +31,62 @@ func TestAcquireAndRelease(t *testing.T) {
 func TestAcquireBlockedByLivePid(t *testing.T) {
 	lockPath := filepath.Join(t.TempDir(), "zrb.lock")
 
-	release, err := Acquire(lockPath)
+	release, err := Acquire(lockPath, "t", 1)
 	require.NoError(t, err)
 	defer release()
 
-	_, err = Acquire(lockPath)
-	assert.Error(t, err)
+	_, err = Acquire(lockPath, "other", 0)
+	var held ErrHeld
+	require.ErrorAs(t, err, &held)
+	assert.Equal(t, os.Getpid(), held.Entry.Pid)
+	assert.Equal(t, "t", held.Entry.TaskName)
+	assert.Equal(t, int16(1), held.Entry.Level)
+	assert.True(t, held.Entry.Alive)
 	assert.Contains(t, err.Error(), "already locked by pid")
 }
 
+func TestQuery(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), "zrb.lock")
+
+	entries, err := Query(lockPath)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	release, err := Acquire(lockPath, "t", 2)
+	require.NoError(t, err)
+	defer release()
+
+	entries, err = Query(lockPath)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.True(t, entries[0].Alive)
+	assert.Equal(t, "t", entries[0].TaskName)
+	assert.Equal(t, int16(2), entries[0].Level)
+	assert.NotEmpty(t, entries[0].Hostname)
+	assert.NotEmpty(t, entries[0].ZrbVersion)
+
+	data, err := os.ReadFile(lockPath)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "alive")
+}
+
+func TestQueryStale(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), "zrb.lock")
+	require.NoError(t, writeLock(lockPath, &Entry{Pid: 999999999, StartedAt: "2024-01-01T00:00:00Z"}))
+
+	entries, err := Query(lockPath)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.False(t, entries[0].Alive)
+}
+
 func TestAcquireReclaimsStaleLock(t *testing.T) {
 	lockPath := filepath.Join(t.TempDir(), "zrb.lock")
 
 	stale := &Entry{Pid: 999999999, StartedAt: "2024-01-01T00:00:00Z"}
 	require.NoError(t, writeLock(lockPath, stale))
 
-	release, err := Acquire(lockPath)
+	release, err := Acquire(lockPath, "t", 1)
 	require.NoError(t, err)
 
 	data, err := os.ReadFile(lockPath)
@@ -61,7 +101,7 @@ func TestAcquireReclaimsStaleLock(t *testing.T) {
 func TestReleaseIdempotent(t *testing.T) {
 	lockPath := filepath.Join(t.TempDir(), "zrb.lock")
 
-	release, err := Acquire(lockPath)
+	release, err := Acquire(lockPath, "t", 1)
 	require.NoError(t, err)
 
 	require.NoError(t, release())
@@ -2,7 +2,7 @@ package logging
 
 import (
 	"context"
-	"fmt"
+	"io"
 	"log/slog"
 	"os"
 )
@@ -45,17 +45,8 @@ func (m *multiHandler) WithGroup(name string) slog.Handler {
 	return &multiHandler{handlers: hs}
 }
 
-func NewLogger(filename string) (*slog.Logger, *os.File, error) {
-	file, err := os.OpenFile(
-		filename,
-		os.O_CREATE|os.O_APPEND|os.O_WRONLY,
-		0o644, // TODO: consider 0o640 to restrict log file access
-
-	)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to open log file: %w", err)
-	}
-
+// NewLogger logs JSON to file and text to stdout.
+func NewLogger(file io.Writer) *slog.Logger {
 	jsonHandler := slog.NewJSONHandler(file, &slog.HandlerOptions{
 		Level: slog.LevelDebug, // TODO: make log level configurable
 	})
@@ -71,5 +62,5 @@ func NewLogger(filename string) (*slog.Logger, *os.File, error) {
 		},
 	}
 
-	return slog.New(handler), file, nil
+	return slog.New(handler)
 }
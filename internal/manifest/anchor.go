@@ -0,0 +1,55 @@
+package manifest
+
+import (
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AnchorFile is the name of the encrypted anchor of a backup, see remote.AnchorPath.
+const AnchorFile = "anchor.yaml.age"
+
+// Anchor is the summary of a backup that zrb backup --anchor stores, encrypted to the recipients,
+// apart from the task manifest. zrb verify compares it with the manifest and the objects in the
+// bucket, which tells a replaced manifest or an overwritten part from one that was there all along.
+type Anchor struct {
+	Task           string `yaml:"task"`
+	Pool           string `yaml:"pool"`
+	Dataset        string `yaml:"dataset"`
+	BackupLevel    int16  `yaml:"backup_level"`
+	Datetime       int64  `yaml:"datetime"`
+	TargetSnapshot string `yaml:"target_snapshot"`
+	// Blake3Hash is the hash of the send stream, as in the manifest.
+	Blake3Hash string `yaml:"blake3_hash"`
+	// ManifestBlake3 is the BLAKE3 of task_manifest.yaml as it was uploaded.
+	ManifestBlake3 string       `yaml:"manifest_blake3"`
+	Parts          []AnchorPart `yaml:"parts,omitempty"`
+}
+
+// AnchorPart is an uploaded part as the bucket reported it right after the upload.
+type AnchorPart struct {
+	Index      string `yaml:"index"`
+	Blake3Hash string `yaml:"blake3_hash"`
+	Size       int64  `yaml:"size"`
+	ETag       string `yaml:"etag,omitempty"`
+}
+
+func WriteAnchor(filename string, a *Anchor) error {
+	data, err := marshal(a)
+	if err != nil {
+		return err
+	}
+	return atomicWrite(filename, data)
+}
+
+func ReadAnchor(filename string) (*Anchor, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var a Anchor
+	if err := yaml.Unmarshal(data, &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
@@ -0,0 +1,158 @@
+package manifest
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Incremental modes decide which level an incremental backup is taken relative to.
+const (
+	// ModeChain takes level N relative to level N-1, so a restore replays every level up to N.
+	ModeChain = "chain"
+	// ModeDifferential takes every level relative to level 0, so a restore needs only level 0 and N.
+	ModeDifferential = "differential"
+)
+
+// Parent policies decide which recorded backup an incremental backup is based on.
+const (
+	// PolicyPreviousLevel bases level N on the level the incremental mode names.
+	PolicyPreviousLevel = "previous_level"
+	// PolicyLatestAny bases level N on the most recent backup of levels 0 to N, so each backup
+	// holds only the changes since the one before it, whatever its level.
+	PolicyLatestAny = "latest_any"
+	// PolicySameLevel bases level N on the previous level N backup, and the first one on the level
+	// the incremental mode names.
+	PolicySameLevel = "same_level"
+)
+
+// NewGenerationID returns the generation_id of a level 0 backup taken at t, e.g. 20240115T020304Z.
+func NewGenerationID(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// ParentLevel returns the level a backup at level (> 0) is based on.
+func ParentLevel(mode string, level int16) int16 {
+	if mode == ModeDifferential {
+		return 0
+	}
+	return level - 1
+}
+
+// RestoreChain returns the levels that have to be received, in order, to restore level.
+func RestoreChain(mode string, level int16) []int16 {
+	if level <= 0 {
+		return []int16{0}
+	}
+	if mode == ModeDifferential {
+		return []int16{0, level}
+	}
+	chain := make([]int16, 0, level+1)
+	for l := int16(0); l <= level; l++ {
+		chain = append(chain, l)
+	}
+	return chain
+}
+
+// Mode returns the incremental mode the recorded history was written in: empty when nothing has been
+// recorded yet, and chain for histories written before the mode was recorded.
+func (l *Last) Mode() string {
+	if l.IncrementalMode != "" {
+		return l.IncrementalMode
+	}
+	for _, ref := range l.BackupLevels {
+		if ref != nil {
+			return ModeChain
+		}
+	}
+	return ""
+}
+
+// CheckMode fails when mode differs from the mode of the recorded history, since mixing them would
+// leave levels based on parents that a restore of the other mode does not replay.
+func (l *Last) CheckMode(mode string) error {
+	recorded := l.Mode()
+	if recorded == "" || recorded == mode {
+		return nil
+	}
+	return fmt.Errorf("backup history of %s/%s was written in %s mode but the task is configured for %s mode; "+
+		"run a level 0 backup with --reset-history to start a new history", l.Pool, l.Dataset, recorded, mode)
+}
+
+// Parent returns the recorded backup a new backup at level is based on, or nil when it is missing.
+// It is the parent under PolicyPreviousLevel; see ParentFor.
+func (l *Last) Parent(mode string, level int16) *Ref {
+	if level <= 0 {
+		return nil
+	}
+	parent := ParentLevel(mode, level)
+	if int(parent) >= len(l.BackupLevels) {
+		return nil
+	}
+	return l.BackupLevels[parent]
+}
+
+// ParentFor returns the recorded backup a new backup at level is based on under policy, or nil
+// when it is missing.
+func (l *Last) ParentFor(mode, policy string, level int16) *Ref {
+	if level <= 0 {
+		return nil
+	}
+	switch policy {
+	case PolicySameLevel:
+		if int(level) < len(l.BackupLevels) && l.BackupLevels[level] != nil {
+			return l.BackupLevels[level]
+		}
+	case PolicyLatestAny:
+		var latest *Ref
+		for i, ref := range l.BackupLevels {
+			if i > int(level) {
+				break
+			}
+			if ref != nil && (latest == nil || ref.Datetime >= latest.Datetime) {
+				latest = ref
+			}
+		}
+		return latest
+	}
+	return l.Parent(mode, level)
+}
+
+// ParentChain returns the backups to receive, in order, before b: level 0 first and b's parent
+// last. It follows the parents the manifests record rather than assuming the levels of a mode, and
+// checks that each parent is the backup of the snapshot its child is based on. load reads the task
+// manifest of an S3 path.
+func ParentChain(b *Backup, load func(s3Path string) (*Backup, error)) ([]*Backup, error) {
+	var chain []*Backup
+	seen := map[string]bool{b.TargetS3Path: true}
+	for child := b; child.BackupLevel > 0; {
+		if child.ParentS3Path == "" {
+			return nil, fmt.Errorf("level %d backup %s records no parent_s3_path", child.BackupLevel, child.TargetS3Path)
+		}
+		if seen[child.ParentS3Path] {
+			return nil, fmt.Errorf("backup chain of %s loops at %s", b.TargetS3Path, child.ParentS3Path)
+		}
+		seen[child.ParentS3Path] = true
+
+		parent, err := load(child.ParentS3Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load parent backup %s: %w", child.ParentS3Path, err)
+		}
+		if parent.TargetSnapshot != child.ParentSnapshot {
+			return nil, fmt.Errorf("backup %s is based on %s, but its parent %s backs up %s",
+				child.TargetS3Path, child.ParentSnapshot, child.ParentS3Path, parent.TargetSnapshot)
+		}
+		if child.GenerationID != "" && parent.GenerationID != "" && child.GenerationID != parent.GenerationID {
+			return nil, fmt.Errorf("backup %s belongs to generation %s, but its parent %s to generation %s",
+				child.TargetS3Path, child.GenerationID, child.ParentS3Path, parent.GenerationID)
+		}
+		if parent.BackupLevel > child.BackupLevel {
+			return nil, fmt.Errorf("level %d backup %s is based on level %d backup %s",
+				child.BackupLevel, child.TargetS3Path, parent.BackupLevel, child.ParentS3Path)
+		}
+		chain = append(chain, parent)
+		child = parent
+	}
+	slices.Reverse(chain)
+	return chain, nil
+}
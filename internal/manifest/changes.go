@@ -0,0 +1,18 @@
+package manifest
+
+// ChangesFile is the name of the zfs diff of a backup, gzip-compressed and encrypted to the
+// recipients, stored next to its parts.
+const ChangesFile = "changes.txt.age"
+
+// Changes records the zfs diff -H from the parent snapshot to the target snapshot, captured while
+// the backup ran when the task sets record_changes. File is empty when zfs diff failed, and
+// Unavailable says why.
+type Changes struct {
+	File string `yaml:"file,omitempty"`
+	// Blake3Hash is the BLAKE3 of the encrypted file.
+	Blake3Hash string `yaml:"blake3_hash,omitempty"`
+	Lines      int64  `yaml:"lines,omitempty"`
+	// Truncated marks a diff cut at record_changes_max_size; the file holds its first lines.
+	Truncated   bool   `yaml:"truncated,omitempty"`
+	Unavailable string `yaml:"unavailable,omitempty"`
+}
@@ -0,0 +1,76 @@
+package manifest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/zeebo/blake3"
+)
+
+// Checksum files list every encrypted part and the task manifest in the format of b3sum and
+// sha256sum, so the bucket contents can be verified with `b3sum --check` without reading YAML.
+const (
+	ChecksumsBlake3File = "CHECKSUMS.blake3"
+	ChecksumsSHA256File = "CHECKSUMS.sha256"
+)
+
+type Checksum struct {
+	Hash string
+	Name string
+}
+
+var checksumLine = regexp.MustCompile(`^([0-9a-f]{64}) [ *](.+)$`)
+
+// FormatChecksums renders one "<hash>  <name>" line per entry, sorted by name so the output only
+// depends on the entries. Parts sort before task_manifest.yaml.
+func FormatChecksums(entries []Checksum) []byte {
+	sorted := append([]Checksum(nil), entries...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	var buf bytes.Buffer
+	for _, e := range sorted {
+		fmt.Fprintf(&buf, "%s  %s\n", e.Hash, e.Name)
+	}
+	return buf.Bytes()
+}
+
+// ParseChecksums reads a file written by FormatChecksums, b3sum or sha256sum.
+func ParseChecksums(data []byte) ([]Checksum, error) {
+	var entries []Checksum
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		m := checksumLine.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("invalid checksum line %d: %q", n, line)
+		}
+		entries = append(entries, Checksum{Hash: m[1], Name: m[2]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// PartChecksums lists the BLAKE3 hashes of the encrypted parts under their file names.
+func PartChecksums(parts []PartInfo) []Checksum {
+	entries := make([]Checksum, 0, len(parts))
+	for _, p := range parts {
+		entries = append(entries, Checksum{Hash: p.Blake3Hash, Name: PartFileName(p.Index)})
+	}
+	return entries
+}
+
+// PartChecksumsDigest is the BLAKE3 of the part lines of CHECKSUMS.blake3, recorded in the task manifest.
+// The file's task_manifest.yaml line is left out, since the manifest cannot contain its own hash.
+func PartChecksumsDigest(parts []PartInfo) string {
+	sum := blake3.Sum256(FormatChecksums(PartChecksums(parts)))
+	return fmt.Sprintf("%x", sum[:])
+}
@@ -0,0 +1,77 @@
+package manifest
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Difference is one field or part that differs between two task manifests. Old or New is empty
+// when the field or part exists in only one of them.
+type Difference struct {
+	Field string
+	Old   string
+	New   string
+}
+
+// Diff compares the backup identity, lineage and parts of two task manifests.
+func Diff(a, b *Backup) []Difference {
+	var diffs []Difference
+	field := func(name, from, to string) {
+		if from != to {
+			diffs = append(diffs, Difference{Field: name, Old: from, New: to})
+		}
+	}
+
+	field("pool", a.Pool, b.Pool)
+	field("dataset", a.Dataset, b.Dataset)
+	field("backup_level", strconv.Itoa(int(a.BackupLevel)), strconv.Itoa(int(b.BackupLevel)))
+	field("incremental_mode", a.IncrementalMode, b.IncrementalMode)
+	field("parent_policy", a.ParentPolicy, b.ParentPolicy)
+	field("target_snapshot", a.TargetSnapshot, b.TargetSnapshot)
+	field("target_snapshot_guid", a.TargetSnapshotGUID, b.TargetSnapshotGUID)
+	field("parent_snapshot", a.ParentSnapshot, b.ParentSnapshot)
+	field("target_s3_path", a.TargetS3Path, b.TargetS3Path)
+	field("parent_s3_path", a.ParentS3Path, b.ParentS3Path)
+	field("s3_prefix", a.S3Prefix, b.S3Prefix)
+	_, aHash := a.StreamHash()
+	_, bHash := b.StreamHash()
+	field("stream_hash", aHash, bHash)
+	field("stream_bytes", strconv.FormatInt(a.StreamBytes, 10), strconv.FormatInt(b.StreamBytes, 10))
+	field("recipients", fmt.Sprint(a.Recipients()), fmt.Sprint(b.Recipients()))
+	field("format_version", strconv.Itoa(a.FormatVersion), strconv.Itoa(b.FormatVersion))
+	field("chunks", strconv.Itoa(len(a.Chunks)), strconv.Itoa(len(b.Chunks)))
+
+	aParts := make(map[string]string, len(a.Parts))
+	for _, p := range a.Parts {
+		_, aParts[p.Index] = p.Hash()
+	}
+	for _, p := range b.Parts {
+		_, hash := p.Hash()
+		old, ok := aParts[p.Index]
+		delete(aParts, p.Index)
+		if !ok || old != hash {
+			diffs = append(diffs, Difference{Field: "parts[" + p.Index + "]", Old: old, New: hash})
+		}
+	}
+	for _, p := range a.Parts {
+		if hash, ok := aParts[p.Index]; ok {
+			diffs = append(diffs, Difference{Field: "parts[" + p.Index + "]", Old: hash})
+		}
+	}
+	return diffs
+}
+
+// Lineage describes how two task manifests relate in a backup chain.
+func Lineage(a, b *Backup) string {
+	switch {
+	case a.TargetSnapshot == b.TargetSnapshot:
+		return "both back up " + a.TargetSnapshot
+	case b.ParentSnapshot != "" && b.ParentSnapshot == a.TargetSnapshot:
+		return fmt.Sprintf("B (level %d) builds on A (level %d)", b.BackupLevel, a.BackupLevel)
+	case a.ParentSnapshot != "" && a.ParentSnapshot == b.TargetSnapshot:
+		return fmt.Sprintf("A (level %d) builds on B (level %d)", a.BackupLevel, b.BackupLevel)
+	case a.ParentSnapshot != "" && a.ParentSnapshot == b.ParentSnapshot:
+		return "A and B build on the same parent " + a.ParentSnapshot
+	}
+	return "unrelated: neither builds on the other"
+}
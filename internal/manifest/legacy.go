@@ -0,0 +1,73 @@
+package manifest
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LegacyManifestName is the manifest file written by the old simple_backup tool.
+const LegacyManifestName = "backup_manifest.yaml"
+
+// Legacy is the simple_backup manifest: a single full backup with SHA256 hashes and a timestamp datetime.
+type Legacy struct {
+	Datetime     time.Time  `yaml:"datetime"`
+	System       SystemInfo `yaml:"system"`
+	Pool         string     `yaml:"pool"`
+	Dataset      string     `yaml:"dataset"`
+	Snapshot     string     `yaml:"snapshot"`
+	AgePublicKey string     `yaml:"age_public_key"`
+	SHA256Hash   string     `yaml:"sha256_hash"`
+	Parts        []struct {
+		Index      string `yaml:"index"`
+		SHA256Hash string `yaml:"sha256_hash"`
+	} `yaml:"parts"`
+	S3Path string `yaml:"s3_path"`
+}
+
+// isLegacy reports whether data uses the simple_backup schema, which has no backup levels.
+func isLegacy(data []byte) (bool, error) {
+	var raw map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return false, err
+	}
+	_, hasLevel := raw["backup_level"]
+	_, hasSHA256 := raw["sha256_hash"]
+	return !hasLevel && hasSHA256, nil
+}
+
+// Backup maps the legacy manifest to a level 0 backup whose hashes are SHA256.
+func (l *Legacy) Backup() (*Backup, error) {
+	if l.SHA256Hash == "" {
+		return nil, fmt.Errorf("legacy manifest has no sha256_hash")
+	}
+
+	m := &Backup{
+		Legacy:         true,
+		Datetime:       l.Datetime.Unix(),
+		System:         l.System,
+		Pool:           l.Pool,
+		Dataset:        l.Dataset,
+		BackupLevel:    0,
+		TargetSnapshot: l.Snapshot,
+		AgePublicKey:   l.AgePublicKey,
+		SHA256Hash:     l.SHA256Hash,
+		TargetS3Path:   l.S3Path,
+	}
+	for _, p := range l.Parts {
+		if p.SHA256Hash == "" {
+			return nil, fmt.Errorf("legacy manifest part %s has no sha256_hash", p.Index)
+		}
+		m.Parts = append(m.Parts, PartInfo{Index: p.Index, SHA256Hash: p.SHA256Hash})
+	}
+	return m, nil
+}
+
+func readLegacy(data []byte) (*Backup, error) {
+	var l Legacy
+	if err := yaml.Unmarshal(data, &l); err != nil {
+		return nil, fmt.Errorf("failed to parse legacy manifest: %w", err)
+	}
+	return l.Backup()
+}
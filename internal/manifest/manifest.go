@@ -2,9 +2,13 @@ package manifest
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"zrb/internal/util"
 
 	"gopkg.in/yaml.v3"
 )
@@ -46,37 +50,110 @@ func GetSystemInfo() (SystemInfo, error) {
 	return info, nil
 }
 
+var (
+	ErrMarshal = errors.New("failed to marshal manifest")
+	ErrWrite   = errors.New("failed to write manifest")
+	ErrRename  = errors.New("failed to rename manifest")
+)
+
+// rename is replaced in tests to simulate failures.
+var rename = os.Rename
+
+// atomicWrite writes to a temp file in the same directory, fsyncs it, renames it over filename, then fsyncs the directory.
 func atomicWrite(filename string, data []byte) error {
-	tmp := filename + ".tmp"
-	// TODO: use 0o600 to restrict access to sensitive manifest data
-	if err := os.WriteFile(tmp, data, 0o644); err != nil {
-		return err
+	dir := filepath.Dir(filename)
+	tmp, err := util.CreateTemp(dir, filepath.Base(filename)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrWrite, err)
+	}
+	tmpName := tmp.Name()
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmpName)
+		}
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		return fmt.Errorf("%w: %w", ErrWrite, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("%w: %w", ErrWrite, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("%w: %w", ErrWrite, err)
 	}
-	return os.Rename(tmp, filename)
+
+	if err := rename(tmpName, filename); err != nil {
+		return fmt.Errorf("%w: %w", ErrRename, err)
+	}
+	committed = true
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrWrite, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("%w: %w", ErrWrite, err)
+	}
+	return nil
+}
+
+func marshal(v any) ([]byte, error) {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMarshal, err)
+	}
+	return data, nil
 }
 
 func Write(filename string, m *Backup) error {
-	data, err := yaml.Marshal(m)
+	data, err := marshal(m)
 	if err != nil {
 		return err
 	}
 	return atomicWrite(filename, data)
 }
 
+// Read loads a task manifest, converting simple_backup manifests transparently.
 func Read(filename string) (*Backup, error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	var m Backup
-	if err := yaml.Unmarshal(data, &m); err != nil {
+	return Parse(data)
+}
+
+// Parse decodes a task manifest, converting simple_backup manifests transparently.
+func Parse(data []byte) (*Backup, error) {
+	legacy, err := isLegacy(data)
+	if err != nil {
+		return nil, err
+	}
+	var m *Backup
+	if legacy {
+		if m, err = readLegacy(data); err != nil {
+			return nil, err
+		}
+	} else if err := yaml.Unmarshal(data, &m); err != nil {
 		return nil, err
 	}
-	return &m, nil
+	if m == nil {
+		m = &Backup{}
+	}
+	if m.FormatVersion > ChunkedFormat {
+		return nil, fmt.Errorf("manifest format_version %d is newer than this zrb supports (%d); upgrade zrb", m.FormatVersion, ChunkedFormat)
+	}
+	if err := m.ValidatePaths(); err != nil {
+		return nil, err
+	}
+	return m, nil
 }
 
 func WriteLast(filename string, last *Last) error {
-	data, err := yaml.Marshal(last)
+	data, err := marshal(last)
 	if err != nil {
 		return err
 	}
@@ -88,15 +165,23 @@ func ReadLast(filename string) (*Last, error) {
 	if err != nil {
 		return nil, err
 	}
+	return ParseLast(data)
+}
+
+// ParseLast decodes a last backup manifest and checks the paths it records.
+func ParseLast(data []byte) (*Last, error) {
 	var last Last
 	if err := yaml.Unmarshal(data, &last); err != nil {
 		return nil, err
 	}
+	if err := last.ValidatePaths(); err != nil {
+		return nil, err
+	}
 	return &last, nil
 }
 
 func WriteState(filename string, state *State) error {
-	data, err := yaml.Marshal(state)
+	data, err := marshal(state)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,578 @@
+package manifest
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteAndRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "task_manifest.yaml")
+	m := &Backup{Pool: "p", Dataset: "d", BackupLevel: 1, Parts: []PartInfo{{Index: "aa", Blake3Hash: "h"}}}
+
+	require.NoError(t, Write(path, m))
+
+	got, err := Read(path)
+	require.NoError(t, err)
+	assert.Equal(t, m, got)
+
+	leftovers, err := filepath.Glob(path + ".tmp-*")
+	require.NoError(t, err)
+	assert.Empty(t, leftovers)
+}
+
+func TestPartTimesRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	m := &Backup{Pool: "p", Dataset: "d", Parts: []PartInfo{
+		{Index: "aa", Blake3Hash: "h1", EncryptedAt: 100, UploadedAt: 160},
+		{Index: "ab", Blake3Hash: "h2", EncryptedAt: 110},
+	}}
+	path := filepath.Join(dir, "task_manifest.yaml")
+	require.NoError(t, Write(path, m))
+	got, err := Read(path)
+	require.NoError(t, err)
+	assert.Equal(t, m, got)
+	raw, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(raw), "uploaded_at"), "zero times are omitted")
+
+	state := &State{TaskName: "t", PartsCompleted: map[string]string{"aa": "h1"},
+		PartTimes: map[string]PartTimes{"aa": {EncryptedAt: 100, UploadedAt: 160}, "ab": {EncryptedAt: 110}}}
+	statePath := filepath.Join(dir, "backup_state.yaml")
+	require.NoError(t, WriteState(statePath, state))
+	gotState, err := ReadState(statePath)
+	require.NoError(t, err)
+	assert.Equal(t, state.PartTimes, gotState.PartTimes)
+
+	// Files written before the times were recorded read as unknown times.
+	require.NoError(t, os.WriteFile(path, []byte("pool: p\ndataset: d\nparts:\n  - index: aa\n    blake3_hash: h1\n"), 0o644))
+	got, err = Read(path)
+	require.NoError(t, err)
+	assert.Equal(t, []PartInfo{{Index: "aa", Blake3Hash: "h1"}}, got.Parts)
+	require.NoError(t, os.WriteFile(statePath, []byte("task_name: t\nparts_completed:\n  aa: h1\n"), 0o644))
+	gotState, err = ReadState(statePath)
+	require.NoError(t, err)
+	assert.Nil(t, gotState.PartTimes)
+}
+
+func TestWriteUnwritableDir(t *testing.T) {
+	// A regular file as parent directory fails even when running as root.
+	parent := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(parent, nil, 0o644))
+
+	err := WriteLast(filepath.Join(parent, "last_backup_manifest.yaml"), &Last{Pool: "p"})
+	assert.ErrorIs(t, err, ErrWrite)
+}
+
+func TestWriteRenameFailure(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "backup_state.yaml")
+	require.NoError(t, WriteState(path, &State{TaskName: "old"}))
+
+	rename = func(_, _ string) error { return errors.New("injected") }
+	defer func() { rename = os.Rename }()
+
+	err := WriteState(path, &State{TaskName: "new"})
+	assert.ErrorIs(t, err, ErrRename)
+
+	got, err := ReadState(path)
+	require.NoError(t, err)
+	assert.Equal(t, "old", got.TaskName)
+
+	leftovers, err := filepath.Glob(path + ".tmp-*")
+	require.NoError(t, err)
+	assert.Empty(t, leftovers)
+}
+
+func TestConcurrentReadNeverSeesPartialWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "last_backup_manifest.yaml")
+
+	levels := make([]*Ref, 50)
+	for i := range levels {
+		levels[i] = &Ref{Snapshot: fmt.Sprintf("pool/data@zrb_level%d", i), Blake3Hash: "abcdef0123456789"}
+	}
+	require.NoError(t, WriteLast(path, &Last{Pool: "p", Dataset: "d", BackupLevels: levels}))
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := range 200 {
+			last := &Last{Pool: "p", Dataset: fmt.Sprintf("d%d", i), BackupLevels: levels}
+			assert.NoError(t, WriteLast(path, last))
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			last, err := ReadLast(path)
+			if !assert.NoError(t, err) {
+				return
+			}
+			if !assert.Len(t, last.BackupLevels, len(levels)) {
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+}
+
+// legacyManifest is a backup_manifest.yaml as written by simple_backup.
+const legacyManifest = `datetime: 2024-03-02T01:30:00+08:00
+system:
+  hostname: nas
+  os: TrueNAS-SCALE-24.04
+  zfs_version:
+    userland: zfs-2.2.3-1
+    kernel: zfs-kmod-2.2.3-1
+pool: tank
+dataset: data
+snapshot: tank/data@simple_2024-03-02
+age_public_key: age1qyqszqgpqyqszqgpqyqszqgpqyqszqgpqyqszqgpqyqszqgpqyqs3290gq
+sha256_hash: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+parts:
+  - index: aa
+    sha256_hash: 2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae
+  - index: ab
+    sha256_hash: fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9
+`
+
+func TestReadLegacy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), LegacyManifestName)
+	require.NoError(t, os.WriteFile(path, []byte(legacyManifest), 0o644))
+
+	m, err := Read(path)
+	require.NoError(t, err)
+
+	assert.True(t, m.Legacy)
+	assert.Equal(t, int16(0), m.BackupLevel)
+	assert.Equal(t, int64(1709314200), m.Datetime)
+	assert.Equal(t, "tank/data@simple_2024-03-02", m.TargetSnapshot)
+	assert.Equal(t, "nas", m.System.Hostname)
+	assert.Empty(t, m.Blake3Hash)
+
+	algorithm, hash := m.StreamHash()
+	assert.Equal(t, "sha256", algorithm)
+	assert.Equal(t, "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", hash)
+
+	require.Len(t, m.Parts, 2)
+	algorithm, hash = m.Parts[1].Hash()
+	assert.Equal(t, "sha256", algorithm)
+	assert.Equal(t, "fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9", hash)
+
+	// Converted manifests are written in the current schema and read back unchanged.
+	converted := filepath.Join(t.TempDir(), "task_manifest.yaml")
+	require.NoError(t, Write(converted, m))
+
+	got, err := Read(converted)
+	require.NoError(t, err)
+	assert.Equal(t, m, got)
+}
+
+func TestPartInfoHashPrefersBlake3(t *testing.T) {
+	algorithm, hash := PartInfo{Index: "aa", Blake3Hash: "b3", SHA256Hash: "s"}.Hash()
+	assert.Equal(t, "blake3", algorithm)
+	assert.Equal(t, "b3", hash)
+}
+
+func TestParentLevel(t *testing.T) {
+	assert.Equal(t, int16(2), ParentLevel(ModeChain, 3))
+	assert.Equal(t, int16(2), ParentLevel("", 3))
+	assert.Equal(t, int16(0), ParentLevel(ModeDifferential, 3))
+}
+
+func TestRestoreChain(t *testing.T) {
+	assert.Equal(t, []int16{0}, RestoreChain(ModeChain, 0))
+	assert.Equal(t, []int16{0, 1, 2, 3}, RestoreChain(ModeChain, 3))
+	assert.Equal(t, []int16{0, 1, 2}, RestoreChain("", 2))
+	assert.Equal(t, []int16{0}, RestoreChain(ModeDifferential, 0))
+	assert.Equal(t, []int16{0, 3}, RestoreChain(ModeDifferential, 3))
+}
+
+func TestLastMode(t *testing.T) {
+	level0 := &Ref{Snapshot: "tank/data@zrb_level0_a"}
+	level1 := &Ref{Snapshot: "tank/data@zrb_level1_b"}
+
+	t.Run("empty history accepts any mode", func(t *testing.T) {
+		last := &Last{Pool: "tank", Dataset: "data"}
+		assert.Empty(t, last.Mode())
+		assert.NoError(t, last.CheckMode(ModeDifferential))
+	})
+
+	t.Run("unrecorded mode is chain", func(t *testing.T) {
+		last := &Last{Pool: "tank", Dataset: "data", BackupLevels: []*Ref{level0}}
+		assert.Equal(t, ModeChain, last.Mode())
+		assert.NoError(t, last.CheckMode(ModeChain))
+		assert.ErrorContains(t, last.CheckMode(ModeDifferential), "--reset-history")
+	})
+
+	t.Run("recorded differential", func(t *testing.T) {
+		last := &Last{Pool: "tank", Dataset: "data", IncrementalMode: ModeDifferential, BackupLevels: []*Ref{level0, level1}}
+		assert.NoError(t, last.CheckMode(ModeDifferential))
+		assert.ErrorContains(t, last.CheckMode(ModeChain), "written in differential mode")
+	})
+
+	t.Run("parent", func(t *testing.T) {
+		last := &Last{BackupLevels: []*Ref{level0, level1}}
+		assert.Nil(t, last.Parent(ModeChain, 0))
+		assert.Same(t, level1, last.Parent(ModeChain, 2))
+		assert.Same(t, level0, last.Parent(ModeDifferential, 2))
+		assert.Nil(t, last.Parent(ModeChain, 3))
+		assert.Same(t, level0, last.Parent(ModeDifferential, 5))
+	})
+}
+
+func TestParentFor(t *testing.T) {
+	level0 := &Ref{Snapshot: "tank/data@zrb_level0_a", Datetime: 100}
+	level1 := &Ref{Snapshot: "tank/data@zrb_level1_b", Datetime: 300}
+	level2 := &Ref{Snapshot: "tank/data@zrb_level2_c", Datetime: 200}
+	last := &Last{BackupLevels: []*Ref{level0, level1, level2}}
+
+	assert.Nil(t, last.ParentFor(ModeChain, PolicyLatestAny, 0))
+	assert.Same(t, level1, last.ParentFor(ModeChain, PolicyPreviousLevel, 2))
+	assert.Same(t, level1, last.ParentFor(ModeChain, "", 2))
+
+	assert.Same(t, level1, last.ParentFor(ModeChain, PolicyLatestAny, 2))
+	assert.Same(t, level1, last.ParentFor(ModeChain, PolicyLatestAny, 1), "level 1 may be based on the previous level 1")
+	assert.Same(t, level0, (&Last{BackupLevels: []*Ref{level0}}).ParentFor(ModeChain, PolicyLatestAny, 3))
+
+	assert.Same(t, level2, last.ParentFor(ModeChain, PolicySameLevel, 2))
+	assert.Same(t, level2, last.ParentFor(ModeChain, PolicySameLevel, 3), "the first level 3 falls back to level 2")
+	assert.Nil(t, last.ParentFor(ModeChain, PolicySameLevel, 5))
+}
+
+func TestParentChain(t *testing.T) {
+	backups := map[string]*Backup{
+		"tank/data/level0/20240101": {BackupLevel: 0, TargetSnapshot: "tank/data@a", TargetS3Path: "tank/data/level0/20240101"},
+		"tank/data/level1/20240102": {BackupLevel: 1, TargetSnapshot: "tank/data@b", TargetS3Path: "tank/data/level1/20240102",
+			ParentSnapshot: "tank/data@a", ParentS3Path: "tank/data/level0/20240101"},
+		"tank/data/level1/20240103": {BackupLevel: 1, TargetSnapshot: "tank/data@c", TargetS3Path: "tank/data/level1/20240103",
+			ParentSnapshot: "tank/data@b", ParentS3Path: "tank/data/level1/20240102", ParentPolicy: PolicySameLevel},
+	}
+	load := func(s3Path string) (*Backup, error) {
+		if b, ok := backups[s3Path]; ok {
+			return b, nil
+		}
+		return nil, fmt.Errorf("no manifest at %s", s3Path)
+	}
+
+	chain, err := ParentChain(backups["tank/data/level1/20240103"], load)
+	require.NoError(t, err)
+	require.Len(t, chain, 2)
+	assert.Equal(t, "tank/data@a", chain[0].TargetSnapshot)
+	assert.Equal(t, "tank/data@b", chain[1].TargetSnapshot)
+
+	chain, err = ParentChain(backups["tank/data/level0/20240101"], load)
+	require.NoError(t, err)
+	assert.Empty(t, chain)
+
+	_, err = ParentChain(&Backup{BackupLevel: 2, TargetS3Path: "x", ParentSnapshot: "tank/data@z", ParentS3Path: "tank/data/level1/20240103"}, load)
+	assert.ErrorContains(t, err, "is based on tank/data@z, but its parent tank/data/level1/20240103 backs up tank/data@c")
+
+	_, err = ParentChain(&Backup{BackupLevel: 1, TargetS3Path: "x", ParentSnapshot: "tank/data@y", ParentS3Path: "missing"}, load)
+	assert.ErrorContains(t, err, "failed to load parent backup missing")
+
+	_, err = ParentChain(&Backup{BackupLevel: 1, TargetS3Path: "x"}, load)
+	assert.ErrorContains(t, err, "records no parent_s3_path")
+
+	backups["tank/data/level0/20240101"].GenerationID = "20240101T000000Z"
+	_, err = ParentChain(&Backup{BackupLevel: 1, TargetS3Path: "x", ParentSnapshot: "tank/data@a", ParentS3Path: "tank/data/level0/20240101", GenerationID: "20240101T000000Z"}, load)
+	assert.NoError(t, err)
+	_, err = ParentChain(&Backup{BackupLevel: 1, TargetS3Path: "x", ParentSnapshot: "tank/data@a", ParentS3Path: "tank/data/level0/20240101", GenerationID: "20231201T000000Z"}, load)
+	assert.ErrorContains(t, err, "backup x belongs to generation 20231201T000000Z, but its parent tank/data/level0/20240101 to generation 20240101T000000Z")
+	_, err = ParentChain(&Backup{BackupLevel: 1, TargetS3Path: "x", ParentSnapshot: "tank/data@a", ParentS3Path: "tank/data/level0/20240101"}, load)
+	assert.NoError(t, err, "manifests without a generation are not compared")
+}
+
+func TestNewGenerationID(t *testing.T) {
+	at := time.Date(2024, 1, 15, 10, 3, 4, 0, time.FixedZone("UTC+8", 8*3600))
+	assert.Equal(t, "20240115T020304Z", NewGenerationID(at))
+}
+
+func TestFormatChecksums(t *testing.T) {
+	h := func(c byte) string { return strings.Repeat(string(c), 64) }
+	entries := []Checksum{
+		{Hash: h('c'), Name: "task_manifest.yaml"},
+		{Hash: h('b'), Name: "snapshot.part-aaaaab.age"},
+		{Hash: h('a'), Name: "snapshot.part-aaaaaa.age"},
+	}
+
+	// b3sum and sha256sum print the hash, two spaces and the file name.
+	want := h('a') + "  snapshot.part-aaaaaa.age\n" +
+		h('b') + "  snapshot.part-aaaaab.age\n" +
+		h('c') + "  task_manifest.yaml\n"
+	assert.Equal(t, want, string(FormatChecksums(entries)))
+	assert.Equal(t, "task_manifest.yaml", entries[0].Name, "input order is left alone")
+
+	parsed, err := ParseChecksums([]byte(want))
+	require.NoError(t, err)
+	assert.Equal(t, want, string(FormatChecksums(parsed)))
+
+	// Binary mode markers from sha256sum -b are accepted.
+	parsed, err = ParseChecksums([]byte(h('a') + " *snapshot.age\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []Checksum{{Hash: h('a'), Name: "snapshot.age"}}, parsed)
+
+	_, err = ParseChecksums([]byte(h('a') + " snapshot.age\n"))
+	assert.ErrorContains(t, err, "line 1")
+}
+
+func TestPartChecksumsDigestIgnoresOrder(t *testing.T) {
+	parts := []PartInfo{{Index: "aaaaab", Blake3Hash: "h2"}, {Index: "aaaaaa", Blake3Hash: "h1"}}
+	reversed := []PartInfo{parts[1], parts[0]}
+
+	assert.Equal(t, PartChecksumsDigest(parts), PartChecksumsDigest(reversed))
+	assert.NotEqual(t, PartChecksumsDigest(parts), PartChecksumsDigest(parts[:1]))
+}
+
+func TestChecksumsMatchB3sum(t *testing.T) {
+	if _, err := exec.LookPath("b3sum"); err != nil {
+		t.Skip("b3sum not installed")
+	}
+
+	dir := t.TempDir()
+	out, err := exec.Command("sh", "-c", "cd "+dir+" && printf one > snapshot.part-aaaaaa.age && printf two > task_manifest.yaml && b3sum snapshot.part-aaaaaa.age task_manifest.yaml").Output()
+	require.NoError(t, err)
+
+	entries, err := ParseChecksums(out)
+	require.NoError(t, err)
+	assert.Equal(t, string(out), string(FormatChecksums(entries)))
+}
+
+func validBackup() *Backup {
+	parts := []PartInfo{{Index: "aaaaaa", Blake3Hash: "h0"}, {Index: "aaaaab", Blake3Hash: "h1"}}
+	return &Backup{
+		Pool:            "tank",
+		Dataset:         "data",
+		BackupLevel:     1,
+		TargetSnapshot:  "tank/data@zrb_level1_b",
+		ParentSnapshot:  "tank/data@zrb_level0_a",
+		Blake3Hash:      "stream",
+		Parts:           parts,
+		ChecksumsBlake3: PartChecksumsDigest(parts),
+		TargetS3Path:    "tank/data/level1/20240102",
+		ParentS3Path:    "tank/data/level0/20240101",
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(b *Backup)
+		want   []string
+	}{
+		{name: "valid", modify: func(*Backup) {}},
+		{
+			name: "valid level 0",
+			modify: func(b *Backup) {
+				b.BackupLevel, b.ParentSnapshot, b.ParentS3Path = 0, "", ""
+			},
+		},
+		{
+			name: "single file",
+			modify: func(b *Backup) {
+				b.Parts, b.ChecksumsBlake3 = []PartInfo{{Index: SingleFileIndex, Blake3Hash: "h"}}, ""
+			},
+		},
+		{
+			name: "numeric suffixes of a legacy backup",
+			modify: func(b *Backup) {
+				b.Parts = []PartInfo{{Index: "00", SHA256Hash: "h0"}, {Index: "01", SHA256Hash: "h1"}}
+				b.ChecksumsBlake3 = ""
+			},
+		},
+		{
+			name:   "incomplete",
+			modify: func(b *Backup) { b.Incomplete = true },
+			want:   []string{"manifest is incomplete"},
+		},
+		{
+			name:   "target of another dataset",
+			modify: func(b *Backup) { b.TargetSnapshot = "tank/other@zrb_level1_b" },
+			want:   []string{"is not a snapshot of tank/data", "parent_snapshot tank/data@zrb_level0_a is not a snapshot of tank/other"},
+		},
+		{
+			name:   "target is not a snapshot",
+			modify: func(b *Backup) { b.TargetSnapshot = "tank/data" },
+			want:   []string{"target_snapshot tank/data is not a snapshot name"},
+		},
+		{
+			name:   "level 0 with parent",
+			modify: func(b *Backup) { b.BackupLevel = 0 },
+			want:   []string{"level 0 backup has parent_snapshot", "level 0 backup has parent_s3_path"},
+		},
+		{
+			name:   "incremental without parent",
+			modify: func(b *Backup) { b.ParentSnapshot, b.ParentS3Path = "", "" },
+			want:   []string{"level 1 backup has no parent_snapshot", "level 1 backup has no parent_s3_path"},
+		},
+		{
+			name:   "parent is target",
+			modify: func(b *Backup) { b.ParentSnapshot = b.TargetSnapshot },
+			want:   []string{"parent_snapshot is the target_snapshot"},
+		},
+		{
+			name:   "empty stream hash",
+			modify: func(b *Backup) { b.Blake3Hash = "" },
+			want:   []string{"stream hash is empty"},
+		},
+		{
+			name:   "no parts",
+			modify: func(b *Backup) { b.Parts, b.ChecksumsBlake3 = nil, "" },
+			want:   []string{"manifest lists no parts"},
+		},
+		{
+			name:   "empty part hash",
+			modify: func(b *Backup) { b.Parts[1].Blake3Hash = "" },
+			want:   []string{"part aaaaab has no hash", "checksums_blake3 does not match"},
+		},
+		{
+			name: "missing part",
+			modify: func(b *Backup) {
+				b.Parts = append(b.Parts, PartInfo{Index: "aaaaad", Blake3Hash: "h3"})
+				b.ChecksumsBlake3 = PartChecksumsDigest(b.Parts)
+			},
+			want: []string{"part 2 is aaaaad, expected aaaaac"},
+		},
+		{
+			name: "out of order",
+			modify: func(b *Backup) {
+				b.Parts[0], b.Parts[1] = b.Parts[1], b.Parts[0]
+			},
+			want: []string{"part 0 is aaaaab, expected aaaaaa", "part 1 is aaaaaa, expected aaaaab"},
+		},
+		{
+			name:   "parts not matching the part size",
+			modify: func(b *Backup) { b.StreamBytes, b.PartSizeBytes = 5<<30, 1<<30 },
+			want:   []string{"manifest lists 2 parts, but a 5368709120 byte stream split at 1073741824 bytes makes 5"},
+		},
+		{
+			name:   "parts matching the part size",
+			modify: func(b *Backup) { b.StreamBytes, b.PartSizeBytes = 2<<30, 1<<30 },
+		},
+		{
+			name: "single file with other parts",
+			modify: func(b *Backup) {
+				b.Parts = append([]PartInfo{{Index: SingleFileIndex, Blake3Hash: "h"}}, b.Parts...)
+				b.ChecksumsBlake3 = ""
+			},
+			want: []string{"part single is listed together with 2 other parts"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := validBackup()
+			tt.modify(b)
+			problems := b.Validate()
+			require.Len(t, problems, len(tt.want), "%v", problems)
+			for i, want := range tt.want {
+				assert.Contains(t, problems[i].Error(), want)
+			}
+		})
+	}
+}
+
+func TestParseRejectsUnsafePaths(t *testing.T) {
+	tests := []struct {
+		name  string
+		field string
+		want  string
+	}{
+		{"pool traversal", "pool: ..", `pool ".." must not contain '..'`},
+		{"pool with slash", "pool: tank/../../etc", `pool "tank/../../etc" must not contain a slash`},
+		{"absolute dataset", "dataset: /etc", `dataset "/etc" must not be absolute`},
+		{"dataset traversal", "dataset: data/../../../root", `dataset "data/../../../root" must not contain '..'`},
+		{"absolute target path", "target_s3_path: /tank/data/level0", `target_s3_path "/tank/data/level0" must not be absolute`},
+		{"parent path traversal", "parent_s3_path: tank/../../other", `parent_s3_path "tank/../../other" must not contain '..'`},
+		{"prefix traversal", "s3_prefix: ../other-host", `s3_prefix "../other-host" must not contain '..'`},
+		{"backslash", `target_s3_path: 'tank\..\..'`, "must not contain a backslash"},
+		{"part index traversal", "parts:\n  - index: ../../../.ssh/authorized_keys", `part index "../../../.ssh/authorized_keys" is not a split suffix`},
+		{"part index with slash", "parts:\n  - index: aa/ab", `part index "aa/ab" is not a split suffix`},
+		{"empty part index", "parts:\n  - index: ''", `part index "" is not a split suffix`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte("target_snapshot: tank/data@zrb_level0_a\n" + tt.field + "\n"))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "unsafe manifest")
+			assert.Contains(t, err.Error(), tt.want)
+		})
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		m, err := Parse([]byte("pool: tank\ndataset: data/sub\ntarget_s3_path: tank/data/sub/level0/20240101\nparts:\n  - index: aaaaaa\n  - index: single\n  - index: \"00\"\n"))
+		require.NoError(t, err)
+		assert.Len(t, m.Parts, 3)
+	})
+
+	t.Run("validate reports it too", func(t *testing.T) {
+		b := validBackup()
+		b.Parts[0].Index = "../x"
+		problems := b.Validate()
+		require.NotEmpty(t, problems)
+		assert.Contains(t, problems[0].Error(), `part index "../x" is not a split suffix`)
+	})
+}
+
+func TestReadLastRejectsUnsafePaths(t *testing.T) {
+	for name, doc := range map[string]string{
+		"absolute s3 path": "pool: tank\ndataset: data\nbackup_levels:\n  - snapshot: tank/data@a\n    s3_path: /etc\n",
+		"legacy traversal": "pool: tank\ndataset: data\nlegacy:\n  - snapshot: tank/data@a\n    s3_path: ../../other\n",
+		"dataset":          "pool: tank\ndataset: ../../etc\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "last_backup_manifest.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(doc), 0o644))
+			_, err := ReadLast(path)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "unsafe last backup manifest")
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a := validBackup()
+	b := validBackup()
+	assert.Empty(t, Diff(a, b))
+	assert.Equal(t, "both back up tank/data@zrb_level1_b", Lineage(a, b))
+
+	b.BackupLevel = 2
+	b.ParentSnapshot, b.TargetSnapshot = a.TargetSnapshot, "tank/data@zrb_level2_c"
+	b.Parts = []PartInfo{{Index: "aaaaaa", Blake3Hash: "h0"}, {Index: "aaaaab", Blake3Hash: "changed"}, {Index: "aaaaac", Blake3Hash: "h2"}}
+	a.Parts = append(a.Parts, PartInfo{Index: "aaaaaz", Blake3Hash: "gone"})
+
+	assert.Equal(t, []Difference{
+		{Field: "backup_level", Old: "1", New: "2"},
+		{Field: "target_snapshot", Old: "tank/data@zrb_level1_b", New: "tank/data@zrb_level2_c"},
+		{Field: "parent_snapshot", Old: "tank/data@zrb_level0_a", New: "tank/data@zrb_level1_b"},
+		{Field: "parts[aaaaab]", Old: "h1", New: "changed"},
+		{Field: "parts[aaaaac]", New: "h2"},
+		{Field: "parts[aaaaaz]", Old: "gone"},
+	}, Diff(a, b))
+	assert.Equal(t, "B (level 2) builds on A (level 1)", Lineage(a, b))
+	assert.Equal(t, "A (level 2) builds on B (level 1)", Lineage(b, a))
+
+	b.ParentSnapshot = "tank/data@elsewhere"
+	assert.Equal(t, "unrelated: neither builds on the other", Lineage(a, b))
+}
@@ -1,8 +1,54 @@
 package manifest
 
+import (
+	"strings"
+	"zrb/internal/version"
+)
+
+// SingleFileIndex is the part index of a backup written as one unsplit file.
+const SingleFileIndex = "single"
+
+func PartFileName(index string) string {
+	if index == SingleFileIndex {
+		return "snapshot.age"
+	}
+	return "snapshot.part-" + index + ".age"
+}
+
 type PartInfo struct {
 	Index      string `yaml:"index"`
 	Blake3Hash string `yaml:"blake3_hash"`
+	// SHA256Hash is set instead of Blake3Hash for parts imported from simple_backup.
+	SHA256Hash string `yaml:"sha256_hash,omitempty"`
+	// EncryptedAt and UploadedAt are when the part was encrypted and uploaded, in Unix seconds;
+	// zero when unknown, as in manifests written before they were recorded, or not uploaded.
+	EncryptedAt int64 `yaml:"encrypted_at,omitempty"`
+	UploadedAt  int64 `yaml:"uploaded_at,omitempty"`
+	// SizeBytes is the size of the encrypted part, so a truncated copy is caught before it is
+	// hashed; zero when unknown, as in manifests written before it was recorded.
+	SizeBytes int64 `yaml:"size_bytes,omitempty"`
+}
+
+// Hash returns the algorithm and digest recorded for the encrypted part.
+func (p PartInfo) Hash() (string, string) {
+	if p.Blake3Hash == "" && p.SHA256Hash != "" {
+		return "sha256", p.SHA256Hash
+	}
+	return "blake3", p.Blake3Hash
+}
+
+// Manifest format versions. ChunkedFormat backups list the chunks of a dedup_store in Chunks
+// instead of split parts in Parts.
+const (
+	PartsFormat   = 1
+	ChunkedFormat = 2
+)
+
+// ChunkInfo is one chunk of a ChunkedFormat stream, stored encrypted by itself under its hash.
+type ChunkInfo struct {
+	// Blake3Hash is the hash of the chunk before encryption, which names its object.
+	Blake3Hash string `yaml:"blake3_hash"`
+	Size       int64  `yaml:"size"`
 }
 
 type SystemInfo struct {
@@ -15,18 +61,109 @@ type SystemInfo struct {
 }
 
 type Backup struct {
-	Datetime       int64      `yaml:"datetime"`
-	System         SystemInfo `yaml:"system"`
-	Pool           string     `yaml:"pool"`
-	Dataset        string     `yaml:"dataset"`
-	BackupLevel    int16      `yaml:"backup_level"`
-	TargetSnapshot string     `yaml:"target_snapshot"`
-	ParentSnapshot string     `yaml:"parent_snapshot"`
-	AgePublicKey   string     `yaml:"age_public_key"`
-	Blake3Hash     string     `yaml:"blake3_hash"`
-	Parts          []PartInfo `yaml:"parts"`
-	TargetS3Path   string     `yaml:"target_s3_path"`
-	ParentS3Path   string     `yaml:"parent_s3_path"`
+	// FormatVersion is PartsFormat or ChunkedFormat; empty in manifests written before it was
+	// recorded (PartsFormat).
+	FormatVersion int `yaml:"format_version,omitempty"`
+	// Incomplete marks a partial manifest written while parts are still being processed.
+	Incomplete bool `yaml:"incomplete,omitempty"`
+	// Legacy marks a manifest converted from simple_backup, hashed with SHA256.
+	Legacy bool `yaml:"legacy,omitempty"`
+	// LocalOnly marks a backup whose parts were never uploaded to S3.
+	LocalOnly bool  `yaml:"local_only,omitempty"`
+	Datetime  int64 `yaml:"datetime"`
+	// DateTimezone is the time zone of the dated directory in TargetS3Path: UTC, or empty for
+	// manifests written before directories were dated in UTC (the host's local time).
+	DateTimezone string       `yaml:"date_timezone,omitempty"`
+	ZrbVersion   version.Info `yaml:"zrb_version"`
+	System       SystemInfo   `yaml:"system"`
+	Pool         string       `yaml:"pool"`
+	Dataset      string       `yaml:"dataset"`
+	BackupLevel  int16        `yaml:"backup_level"`
+	// IncrementalMode is chain or differential; empty in manifests written before it was recorded (chain).
+	IncrementalMode string `yaml:"incremental_mode,omitempty"`
+	// ParentPolicy is how ParentSnapshot was chosen, see PolicyPreviousLevel; empty for level 0
+	// and in manifests written before it was recorded (previous_level).
+	ParentPolicy   string `yaml:"parent_policy,omitempty"`
+	TargetSnapshot string `yaml:"target_snapshot"`
+	// TargetSnapshotGUID is the guid of TargetSnapshot, which the received snapshot keeps; empty
+	// in manifests written before it was recorded.
+	TargetSnapshotGUID string `yaml:"target_snapshot_guid,omitempty"`
+	ParentSnapshot     string `yaml:"parent_snapshot"`
+	AgePublicKey       string `yaml:"age_public_key"`
+	// AgeRecipients lists the recipients configured in addition to AgePublicKey.
+	AgeRecipients []string `yaml:"age_recipients,omitempty"`
+	// KeyHistory lists the recipients of earlier levels of the chain that differ from this
+	// manifest's, recorded when a backup was taken with --accept-key-change.
+	KeyHistory []KeyRecord `yaml:"key_history,omitempty"`
+	Blake3Hash string      `yaml:"blake3_hash"`
+	SHA256Hash string      `yaml:"sha256_hash,omitempty"`
+	// StreamBytes is the size of the send stream, used to size the restore scratch space.
+	StreamBytes int64 `yaml:"stream_bytes,omitempty"`
+	// SendArgs is the zfs send command line that produced the stream; its flags tell which pool
+	// features the receiving pool may need.
+	SendArgs []string `yaml:"send_args,omitempty"`
+	// PartSizeBytes is the size the stream was split at, zero for a single-file backup.
+	PartSizeBytes int64 `yaml:"part_size_bytes,omitempty"`
+	// RecipientCount is the number of age recipients the parts were encrypted to.
+	RecipientCount int        `yaml:"recipient_count,omitempty"`
+	Parts          []PartInfo `yaml:"parts,omitempty"`
+	// ChunkStore names the chunk area of a ChunkedFormat backup, see remote.ChunkPath.
+	ChunkStore string `yaml:"chunk_store,omitempty"`
+	// ChunkSizeBytes is the average chunk size the stream was cut at.
+	ChunkSizeBytes int64 `yaml:"chunk_size_bytes,omitempty"`
+	// Chunks lists the chunks of a ChunkedFormat stream in stream order; a chunk may repeat.
+	Chunks []ChunkInfo `yaml:"chunks,omitempty"`
+	// Changes is the zfs diff of the backup from ParentSnapshot; nil for level 0 and when the task
+	// does not record changes.
+	Changes *Changes `yaml:"changes,omitempty"`
+	// ChecksumsBlake3 is PartChecksumsDigest of Parts, pinning the part lines of CHECKSUMS.blake3.
+	ChecksumsBlake3 string `yaml:"checksums_blake3,omitempty"`
+	// StagingDir is the root the task directory was staged below, base_dir or staging_dir; empty
+	// in manifests written before it was recorded (base_dir).
+	StagingDir string `yaml:"staging_dir,omitempty"`
+	// S3Prefix is the task's s3_prefix, between the global prefix and data/ or manifests/.
+	S3Prefix     string `yaml:"s3_prefix,omitempty"`
+	TargetS3Path string `yaml:"target_s3_path"`
+	ParentS3Path string `yaml:"parent_s3_path"`
+	// GenerationID names the level 0 backup the chain grows from, see NewGenerationID; every level
+	// of the chain carries the ID of its level 0. Empty in manifests written before it was recorded.
+	GenerationID string `yaml:"generation_id,omitempty"`
+}
+
+// KeyRecord is the recipients a level of the chain was encrypted to.
+type KeyRecord struct {
+	BackupLevel    int16    `yaml:"backup_level"`
+	TargetSnapshot string   `yaml:"target_snapshot"`
+	AgePublicKey   string   `yaml:"age_public_key"`
+	AgeRecipients  []string `yaml:"age_recipients,omitempty"`
+}
+
+// Recipients returns every recipient the parts were encrypted to. AgePublicKey may hold a
+// comma-separated list in manifests written by simple_backup.
+func (b *Backup) Recipients() []string {
+	return recipients(b.AgePublicKey, b.AgeRecipients)
+}
+
+// Recipients returns every recipient the level was encrypted to.
+func (k KeyRecord) Recipients() []string {
+	return recipients(k.AgePublicKey, k.AgeRecipients)
+}
+
+func recipients(publicKey string, additional []string) []string {
+	return append(strings.Fields(strings.ReplaceAll(publicKey, ",", " ")), additional...)
+}
+
+// StreamHash returns the algorithm and digest recorded for the whole send stream.
+// Chunked reports whether the stream is stored as dedup_store chunks rather than parts.
+func (b *Backup) Chunked() bool {
+	return b.FormatVersion == ChunkedFormat
+}
+
+func (b *Backup) StreamHash() (string, string) {
+	if b.Blake3Hash == "" && b.SHA256Hash != "" {
+		return "sha256", b.SHA256Hash
+	}
+	return "blake3", b.Blake3Hash
 }
 
 type Ref struct {
@@ -35,23 +172,61 @@ type Ref struct {
 	Manifest   string `yaml:"manifest"`
 	Blake3Hash string `yaml:"blake3_hash"`
 	S3Path     string `yaml:"s3_path"`
+	LocalOnly  bool   `yaml:"local_only,omitempty"`
+	// GenerationID is the generation_id of the backup's manifest.
+	GenerationID string `yaml:"generation_id,omitempty"`
 }
 
 type Last struct {
-	Pool         string `yaml:"pool"`
-	Dataset      string `yaml:"dataset"`
-	BackupLevels []*Ref `yaml:"backup_levels"`
+	Pool    string `yaml:"pool"`
+	Dataset string `yaml:"dataset"`
+	// IncrementalMode is the mode all recorded levels were taken in, see Mode.
+	IncrementalMode string `yaml:"incremental_mode,omitempty"`
+	BackupLevels    []*Ref `yaml:"backup_levels"`
+	// Legacy lists full backups imported from simple_backup; they are outside the level chain.
+	Legacy []*Ref `yaml:"legacy,omitempty"`
 }
 
+// StateVersion is the format version of State that this zrb writes. States without a version
+// predate it and are read as version 1.
+const StateVersion = 1
+
 type State struct {
+	// Version is StateVersion of the zrb that wrote the state.
+	Version          int               `yaml:"version,omitempty"`
 	TaskName         string            `yaml:"task_name"`
 	BackupLevel      int16             `yaml:"backup_level"`
 	TargetSnapshot   string            `yaml:"target_snapshot"`
 	ParentSnapshot   string            `yaml:"parent_snapshot"`
 	OutputDir        string            `yaml:"output_dir"`
 	Blake3Hash       string            `yaml:"blake3_hash"`
+	StreamBytes      int64             `yaml:"stream_bytes"`
 	PartsCompleted   map[string]string `yaml:"parts_completed"`
 	ManifestCreated  bool              `yaml:"manifest_created"`
 	ManifestUploaded bool              `yaml:"manifest_uploaded"`
 	LastUpdated      int64             `yaml:"last_updated"`
+	// PartsEncrypted maps the parts whose encrypted file was written but not yet uploaded to its
+	// BLAKE3; a part moves to PartsCompleted once uploaded. Empty in states written before it was
+	// recorded.
+	PartsEncrypted map[string]string `yaml:"parts_encrypted,omitempty"`
+	// PartTimes records when each part was encrypted and uploaded, for PartInfo.
+	PartTimes map[string]PartTimes `yaml:"part_times,omitempty"`
+	// PartSizes records the size of each encrypted part, for PartInfo.
+	PartSizes map[string]int64 `yaml:"part_sizes,omitempty"`
+	// Invalid is why the backup cannot be resumed, such as its snapshot having been destroyed;
+	// empty while it can.
+	Invalid string `yaml:"invalid,omitempty"`
+	// UploadedBytes is the size of the encrypted parts uploaded so far, so a resumed backup reports
+	// how far it got; zero in states written before it was recorded.
+	UploadedBytes int64 `yaml:"uploaded_bytes,omitempty"`
+	// PartSizeBytes is the size the stream was split at, so a resumed backup keeps it when
+	// part_size changed in between; zero for a single file, a chunked backup or a state written
+	// before part_size was configurable.
+	PartSizeBytes int64 `yaml:"part_size_bytes,omitempty"`
+}
+
+// PartTimes are the Unix seconds a part was encrypted and uploaded at, zero when unknown.
+type PartTimes struct {
+	EncryptedAt int64 `yaml:"encrypted_at,omitempty"`
+	UploadedAt  int64 `yaml:"uploaded_at,omitempty"`
 }
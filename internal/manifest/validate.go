@@ -0,0 +1,264 @@
+package manifest
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Validate checks the consistency of a task manifest and returns every problem found, nil when
+// there is none. It does not touch the parts themselves, only what the manifest records about them.
+func (b *Backup) Validate() []error {
+	var problems []error
+	add := func(format string, args ...any) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	problems = append(problems, b.pathProblems()...)
+	if b.Incomplete {
+		add("manifest is incomplete, it was written while parts were still being processed")
+	}
+	if b.BackupLevel < 0 {
+		add("backup_level %d is negative", b.BackupLevel)
+	}
+
+	targetDataset, _, ok := strings.Cut(b.TargetSnapshot, "@")
+	switch {
+	case b.TargetSnapshot == "":
+		add("target_snapshot is empty")
+	case !ok:
+		add("target_snapshot %s is not a snapshot name", b.TargetSnapshot)
+	case b.Pool != "" && targetDataset != b.Pool+"/"+b.Dataset:
+		add("target_snapshot %s is not a snapshot of %s/%s", b.TargetSnapshot, b.Pool, b.Dataset)
+	}
+
+	if b.BackupLevel == 0 {
+		if b.ParentSnapshot != "" {
+			add("level 0 backup has parent_snapshot %s", b.ParentSnapshot)
+		}
+		if b.ParentS3Path != "" {
+			add("level 0 backup has parent_s3_path %s", b.ParentS3Path)
+		}
+	} else {
+		parentDataset, _, _ := strings.Cut(b.ParentSnapshot, "@")
+		switch {
+		case b.ParentSnapshot == "":
+			add("level %d backup has no parent_snapshot", b.BackupLevel)
+		case b.ParentSnapshot == b.TargetSnapshot:
+			add("parent_snapshot is the target_snapshot %s", b.TargetSnapshot)
+		case ok && parentDataset != targetDataset:
+			add("parent_snapshot %s is not a snapshot of %s", b.ParentSnapshot, targetDataset)
+		}
+		if b.ParentS3Path == "" {
+			add("level %d backup has no parent_s3_path", b.BackupLevel)
+		} else if b.ParentS3Path == b.TargetS3Path {
+			add("parent_s3_path is the target_s3_path %s", b.TargetS3Path)
+		}
+		switch b.ParentPolicy {
+		case "", PolicyPreviousLevel, PolicyLatestAny, PolicySameLevel:
+		default:
+			add("unknown parent_policy %s", b.ParentPolicy)
+		}
+	}
+
+	if _, hash := b.StreamHash(); hash == "" {
+		add("stream hash is empty")
+	}
+
+	switch b.FormatVersion {
+	case 0, PartsFormat:
+		problems = append(problems, validateParts(b.Parts)...)
+		if err := b.partCountProblem(); err != nil {
+			problems = append(problems, err)
+		}
+	case ChunkedFormat:
+		problems = append(problems, b.chunkProblems()...)
+	default:
+		add("unknown format_version %d", b.FormatVersion)
+	}
+
+	if b.ChecksumsBlake3 != "" && b.ChecksumsBlake3 != PartChecksumsDigest(b.Parts) {
+		add("checksums_blake3 does not match the recorded part hashes")
+	}
+	return problems
+}
+
+// chunkProblems checks that a chunked manifest lists chunks adding up to the stream, and no parts.
+func (b *Backup) chunkProblems() []error {
+	var problems []error
+	if len(b.Parts) > 0 {
+		problems = append(problems, fmt.Errorf("chunked backup lists %d parts", len(b.Parts)))
+	}
+	if b.ChunkStore == "" {
+		problems = append(problems, fmt.Errorf("chunked backup has no chunk_store"))
+	}
+	if len(b.Chunks) == 0 && b.StreamBytes > 0 {
+		return append(problems, fmt.Errorf("manifest lists no chunks"))
+	}
+	var total int64
+	for i, c := range b.Chunks {
+		if c.Size <= 0 {
+			problems = append(problems, fmt.Errorf("chunk %d has size %d", i, c.Size))
+		}
+		total += c.Size
+	}
+	if total != b.StreamBytes {
+		problems = append(problems, fmt.Errorf("chunks add up to %d bytes, but the stream has %d", total, b.StreamBytes))
+	}
+	return problems
+}
+
+// partCountProblem checks that the stream split at part_size_bytes makes as many parts as are
+// listed. Manifests without a part size or stream size are not checked.
+func (b *Backup) partCountProblem() error {
+	if b.PartSizeBytes <= 0 || b.StreamBytes <= 0 || len(b.Parts) == 0 || b.Parts[0].Index == SingleFileIndex {
+		return nil
+	}
+	expected := int((b.StreamBytes + b.PartSizeBytes - 1) / b.PartSizeBytes)
+	if len(b.Parts) != expected {
+		return fmt.Errorf("manifest lists %d parts, but a %d byte stream split at %d bytes makes %d", len(b.Parts), b.StreamBytes, b.PartSizeBytes, expected)
+	}
+	return nil
+}
+
+// validateParts checks that the parts are the contiguous split suffixes in order, each with a hash.
+func validateParts(parts []PartInfo) []error {
+	if len(parts) == 0 {
+		return []error{fmt.Errorf("manifest lists no parts")}
+	}
+
+	var problems []error
+	single := false
+	for _, p := range parts {
+		if _, hash := p.Hash(); hash == "" {
+			problems = append(problems, fmt.Errorf("part %s has no hash", p.Index))
+		}
+		single = single || p.Index == SingleFileIndex
+	}
+	if single {
+		if len(parts) > 1 {
+			problems = append(problems, fmt.Errorf("part %s is listed together with %d other parts", SingleFileIndex, len(parts)-1))
+		}
+		return problems
+	}
+
+	for i, p := range parts {
+		if want := splitSuffix(i, len(parts[0].Index), parts[0].Index); p.Index != want {
+			problems = append(problems, fmt.Errorf("part %d is %s, expected %s (parts missing, duplicated or out of order)", i, p.Index, want))
+		}
+	}
+	return problems
+}
+
+// splitSuffix returns the i-th suffix of width that split generates: letters (aa, ab, ...), or
+// digits (00, 01, ...) when first is numeric as with split -d.
+func splitSuffix(i, width int, first string) string {
+	alphabet := "abcdefghijklmnopqrstuvwxyz"
+	if first != "" && first[0] >= '0' && first[0] <= '9' {
+		alphabet = "0123456789"
+	}
+	suffix := make([]byte, width)
+	for pos := width - 1; pos >= 0; pos-- {
+		suffix[pos] = alphabet[i%len(alphabet)]
+		i /= len(alphabet)
+	}
+	return string(suffix)
+}
+
+var (
+	// partIndexPattern matches the suffixes split names parts with: lowercase letters and digits.
+	partIndexPattern = regexp.MustCompile(`^[a-z0-9]+$`)
+	// chunkHashPattern and chunkStorePattern match the names chunk objects are stored under.
+	chunkHashPattern  = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	chunkStorePattern = regexp.MustCompile(`^[0-9a-f]{16}$`)
+)
+
+// ValidatePaths rejects fields that restore and list join into local paths and S3 keys when they
+// could lead out of the directory they belong in. Manifests may come from a bucket other hosts
+// write to, so Read and Parse check this for every manifest.
+func (b *Backup) ValidatePaths() error {
+	if problems := b.pathProblems(); len(problems) > 0 {
+		return fmt.Errorf("unsafe manifest: %w", errors.Join(problems...))
+	}
+	return nil
+}
+
+func (b *Backup) pathProblems() []error {
+	problems := datasetProblems(b.Pool, b.Dataset)
+	for _, field := range []struct{ name, value string }{
+		{"s3_prefix", b.S3Prefix},
+		{"target_s3_path", b.TargetS3Path},
+		{"parent_s3_path", b.ParentS3Path},
+	} {
+		if err := checkRelativePath(field.value); err != nil {
+			problems = append(problems, fmt.Errorf("%s %q %w", field.name, field.value, err))
+		}
+	}
+	for _, p := range b.Parts {
+		if p.Index != SingleFileIndex && !partIndexPattern.MatchString(p.Index) {
+			problems = append(problems, fmt.Errorf("part index %q is not a split suffix", p.Index))
+		}
+	}
+	if b.ChunkStore != "" && !chunkStorePattern.MatchString(b.ChunkStore) {
+		problems = append(problems, fmt.Errorf("chunk_store %q is not a chunk store name", b.ChunkStore))
+	}
+	for _, c := range b.Chunks {
+		if !chunkHashPattern.MatchString(c.Blake3Hash) {
+			problems = append(problems, fmt.Errorf("chunk hash %q is not a BLAKE3 hash", c.Blake3Hash))
+			break
+		}
+	}
+	return problems
+}
+
+// ValidatePaths is the Last counterpart of Backup.ValidatePaths. The manifest field of an entry is
+// a local path on the host that wrote it and is not checked here.
+func (l *Last) ValidatePaths() error {
+	problems := datasetProblems(l.Pool, l.Dataset)
+	for _, refs := range [][]*Ref{l.BackupLevels, l.Legacy} {
+		for _, ref := range refs {
+			if ref == nil {
+				continue
+			}
+			if err := checkRelativePath(ref.S3Path); err != nil {
+				problems = append(problems, fmt.Errorf("s3_path %q of %s %w", ref.S3Path, ref.Snapshot, err))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("unsafe last backup manifest: %w", errors.Join(problems...))
+	}
+	return nil
+}
+
+func datasetProblems(pool, dataset string) []error {
+	var problems []error
+	if strings.Contains(pool, "/") {
+		problems = append(problems, fmt.Errorf("pool %q must not contain a slash", pool))
+	}
+	if err := checkRelativePath(pool); err != nil {
+		problems = append(problems, fmt.Errorf("pool %q %w", pool, err))
+	}
+	if err := checkRelativePath(dataset); err != nil {
+		problems = append(problems, fmt.Errorf("dataset %q %w", dataset, err))
+	}
+	return problems
+}
+
+// checkRelativePath accepts an empty or relative slash-separated path without .. segments.
+func checkRelativePath(p string) error {
+	switch {
+	case strings.HasPrefix(p, "/") || filepath.IsAbs(p):
+		return fmt.Errorf("must not be absolute")
+	case strings.ContainsAny(p, "\\\x00"):
+		return fmt.Errorf("must not contain a backslash or NUL")
+	}
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." {
+			return fmt.Errorf("must not contain '..'")
+		}
+	}
+	return nil
+}
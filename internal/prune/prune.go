@@ -0,0 +1,294 @@
+package prune
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"time"
+	"zrb/internal/config"
+	"zrb/internal/list"
+	"zrb/internal/manifest"
+	"zrb/internal/remote"
+)
+
+// Options of zrb prune. Without TaskName it prunes every task of the config with a retention.
+type Options struct {
+	ConfigPath string
+	TaskName   string
+	// DryRun lists what would be removed without removing it.
+	DryRun bool
+	Yes    bool
+}
+
+// Backup is a backup found in the bucket, with why retention keeps it; an empty Reason prunes it.
+type Backup struct {
+	list.Scanned
+	Reason string
+}
+
+// taskPlan is what prune decided for one task.
+type taskPlan struct {
+	task    config.Task
+	backend remote.Backend
+	backups []Backup
+}
+
+// Replaced by tests.
+var (
+	promptInput     io.Reader = os.Stdin
+	output          io.Writer = os.Stdout
+	stdinIsTerminal           = func() bool {
+		info, err := os.Stdin.Stat()
+		return err == nil && info.Mode()&os.ModeCharDevice != 0
+	}
+	now = time.Now
+)
+
+func Run(ctx context.Context, opts Options) error {
+	cfg, err := config.Load(opts.ConfigPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	if !cfg.RemoteEnabled() {
+		return config.ErrNoRemote
+	}
+
+	tasks, err := selectTasks(cfg, opts.TaskName)
+	if err != nil {
+		return err
+	}
+
+	var plans []taskPlan
+	pruned := 0
+	for _, task := range tasks {
+		p, err := planTask(ctx, cfg, task)
+		if err != nil {
+			return fmt.Errorf("task %s: %w", task.Name, err)
+		}
+		fmt.Fprintf(output, "Task %s (%s/%s):\n", task.Name, task.Pool, task.Dataset)
+		for _, b := range p.backups {
+			when := time.Unix(b.Manifest.Datetime, 0).Format(time.DateTime)
+			if b.Reason == "" {
+				fmt.Fprintf(output, "  prune  %s (level %d, %s)\n", b.S3Path, b.Manifest.BackupLevel, when)
+				pruned++
+			} else {
+				fmt.Fprintf(output, "  keep   %s (level %d, %s): %s\n", b.S3Path, b.Manifest.BackupLevel, when, b.Reason)
+			}
+		}
+		plans = append(plans, p)
+	}
+
+	if pruned == 0 {
+		fmt.Fprintln(output, "Nothing to prune.")
+		return nil
+	}
+	if opts.DryRun {
+		fmt.Fprintln(output, "Dry run, nothing was removed; run again without --dry-run to remove them.")
+		return nil
+	}
+	if !opts.Yes {
+		if err := confirm(pruned); err != nil {
+			return err
+		}
+	}
+
+	removed, objects := 0, 0
+	for _, p := range plans {
+		for _, b := range p.backups {
+			if b.Reason != "" {
+				continue
+			}
+			n, err := remove(ctx, p.backend, &p.task, b.S3Path)
+			objects += n
+			if err != nil {
+				return fmt.Errorf("failed to remove backup %s: %w", b.S3Path, err)
+			}
+			removed++
+		}
+	}
+	fmt.Fprintf(output, "Removed %d backup(s), %d object(s).\n", removed, objects)
+	return nil
+}
+
+// selectTasks returns the named task, or every task with a retention that uploads.
+func selectTasks(cfg *config.Config, taskName string) ([]config.Task, error) {
+	if taskName != "" {
+		task, err := cfg.FindTask(taskName)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case task.Retention == nil:
+			return nil, fmt.Errorf("task %s has no retention", task.Name)
+		case !cfg.Uploads(task):
+			return nil, fmt.Errorf("task %s does not upload its backups", task.Name)
+		}
+		return []config.Task{*task}, nil
+	}
+
+	var tasks []config.Task
+	for _, task := range cfg.Tasks {
+		if task.Retention != nil && cfg.Uploads(&task) {
+			tasks = append(tasks, task)
+		}
+	}
+	if len(tasks) == 0 {
+		return nil, fmt.Errorf("no task that uploads has a retention; set retention on the tasks to prune")
+	}
+	return tasks, nil
+}
+
+// planTask scans the bucket for the backups of task and decides which of them to keep.
+func planTask(ctx context.Context, cfg *config.Config, task config.Task) (taskPlan, error) {
+	backend, err := remote.DefaultCache.Get(ctx, remote.OptionsFromConfig(cfg, cfg.ManifestStorageClass()))
+	if err != nil {
+		return taskPlan{}, fmt.Errorf("failed to initialize S3 backend: %w", err)
+	}
+	if err := backend.VerifyCredentials(ctx); err != nil {
+		return taskPlan{}, fmt.Errorf("credentials verification failed: %w", err)
+	}
+
+	last, err := downloadLast(ctx, backend, &task)
+	if err != nil {
+		return taskPlan{}, err
+	}
+	scanned, err := list.Scan(ctx, backend, &task)
+	if err != nil {
+		return taskPlan{}, fmt.Errorf("failed to scan the bucket: %w", err)
+	}
+	backups, err := plan(scanned, last, *task.Retention, now())
+	if err != nil {
+		return taskPlan{}, err
+	}
+	return taskPlan{task: task, backend: backend, backups: backups}, nil
+}
+
+// downloadLast reads the last backup manifest of task from the bucket. Without it prune cannot
+// tell which backups the next one builds on, so it refuses to prune the task.
+func downloadLast(ctx context.Context, backend remote.Backend, task *config.Task) (*manifest.Last, error) {
+	remotePath := remote.ManifestPath(task.S3Prefix, task.Pool, task.Dataset, "last_backup_manifest.yaml")
+	if err := remote.CheckAccessible(ctx, backend, remotePath); err != nil {
+		if remote.IsNotFound(err) {
+			return nil, fmt.Errorf("last backup manifest %s not found; refusing to prune without it", remotePath)
+		}
+		return nil, fmt.Errorf("cannot read the last backup manifest: %w", err)
+	}
+
+	tmp, err := os.CreateTemp("", "prune_last_manifest_*.yaml")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err := backend.Download(ctx, remotePath, tmp.Name()); err != nil {
+		return nil, fmt.Errorf("failed to download last backup manifest: %w", err)
+	}
+	last, err := manifest.ReadLast(tmp.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read last backup manifest: %w", err)
+	}
+	return last, nil
+}
+
+// plan decides which of the scanned backups to keep: those the last backup manifest references,
+// as the next backup builds on them, the r.KeepLast newest of any level, those taken in the last
+// r.KeepDays days, and the parents every kept incremental depends on through its ParentS3Path.
+// The rest are pruned. Backups are returned in the order of scanned.
+func plan(scanned []list.Scanned, last *manifest.Last, r config.Retention, now time.Time) ([]Backup, error) {
+	backups := make([]Backup, len(scanned))
+	byPath := make(map[string]int, len(scanned))
+	for i, s := range scanned {
+		backups[i] = Backup{Scanned: s}
+		byPath[s.S3Path] = i
+	}
+	var kept []int
+	keep := func(i int, reason string) {
+		if backups[i].Reason == "" {
+			backups[i].Reason = reason
+			kept = append(kept, i)
+		}
+	}
+
+	for _, ref := range slices.Concat(last.BackupLevels, last.Legacy) {
+		if ref == nil {
+			continue
+		}
+		if i, ok := byPath[ref.S3Path]; ok {
+			keep(i, "in the last backup manifest")
+		}
+	}
+	newest := make([]int, len(backups))
+	for i := range newest {
+		newest[i] = i
+	}
+	slices.SortStableFunc(newest, func(a, b int) int {
+		return cmp.Compare(backups[b].Manifest.Datetime, backups[a].Manifest.Datetime)
+	})
+	for n, i := range newest {
+		if n < r.KeepLast {
+			keep(i, fmt.Sprintf("one of the last %d", r.KeepLast))
+		}
+	}
+	if r.KeepDays > 0 {
+		cutoff := now.AddDate(0, 0, -r.KeepDays)
+		for i, b := range backups {
+			if !time.Unix(b.Manifest.Datetime, 0).Before(cutoff) {
+				keep(i, fmt.Sprintf("taken in the last %d days", r.KeepDays))
+			}
+		}
+	}
+
+	// A kept incremental is useless without its parent, nor that parent without its own.
+	for len(kept) > 0 {
+		b := backups[kept[0]]
+		kept = kept[1:]
+		m := b.Manifest
+		if m.BackupLevel == 0 || m.Legacy {
+			continue
+		}
+		if m.ParentS3Path == "" {
+			return nil, fmt.Errorf("backup %s records no parent_s3_path, so its parent cannot be told apart; refusing to prune", b.S3Path)
+		}
+		// A parent missing from the scan is already gone or unreadable; zrb verify reports it.
+		if i, ok := byPath[m.ParentS3Path]; ok {
+			keep(i, "parent of "+b.S3Path)
+		}
+	}
+	return backups, nil
+}
+
+// remove deletes the data of the backup at s3Path, then its manifests, so an interrupted prune
+// leaves the manifest for the next prune to find. Chunks of the dedup_store are left alone, as
+// other backups may share them.
+func remove(ctx context.Context, backend remote.Backend, task *config.Task, s3Path string) (int, error) {
+	deleted := 0
+	for _, prefix := range []string{remote.DataPath(task.S3Prefix, s3Path), remote.ManifestPath(task.S3Prefix, s3Path)} {
+		n, err := remote.DeletePrefix(ctx, backend, prefix+"/")
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+	slog.Info("Pruned backup", "task", task.Name, "s3Path", s3Path, "objects", deleted)
+	return deleted, nil
+}
+
+// confirm asks before removing count backups, and refuses without a terminal to ask on.
+func confirm(count int) error {
+	if !stdinIsTerminal() {
+		return fmt.Errorf("refusing to remove %d backup(s) without a terminal to confirm; pass --yes", count)
+	}
+	fmt.Fprintf(output, "Remove these %d backup(s) from the bucket? [y/N]: ", count)
+	answer, _ := bufio.NewReader(promptInput).ReadString('\n')
+	if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+		return fmt.Errorf("prune cancelled")
+	}
+	return nil
+}
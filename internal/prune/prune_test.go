@@ -0,0 +1,203 @@
+package prune
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"zrb/internal/config"
+	"zrb/internal/list"
+	"zrb/internal/manifest"
+	"zrb/internal/remote"
+	"zrb/internal/remote/remotetest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// backup is a backup of tank/data in the test bucket, taken at noon UTC on date.
+type backup struct {
+	level  int16
+	date   string
+	parent string
+}
+
+func (b backup) s3Path() string {
+	return fmt.Sprintf("tank/data/level%d/%s", b.level, b.date)
+}
+
+func (b backup) manifest(t *testing.T) *manifest.Backup {
+	t.Helper()
+	when, err := time.Parse("20060102", b.date)
+	require.NoError(t, err)
+	return &manifest.Backup{
+		Pool: "tank", Dataset: "data", BackupLevel: b.level, Datetime: when.Add(12 * time.Hour).Unix(),
+		TargetS3Path: b.s3Path(), ParentS3Path: b.parent,
+		Parts: []manifest.PartInfo{{Index: "aaaaaa"}},
+	}
+}
+
+// chain is the bucket of the tests: an old full backup with its incremental, and a newer full
+// backup with a recent incremental and an old one, then the two backups the last backup manifest
+// references.
+var chain = []backup{
+	{level: 0, date: "20231201"},
+	{level: 1, date: "20231205", parent: "tank/data/level0/20231201"},
+	{level: 0, date: "20240101"},
+	{level: 1, date: "20240110", parent: "tank/data/level0/20240101"},
+	{level: 1, date: "20240205", parent: "tank/data/level0/20240101"},
+	{level: 0, date: "20240215"},
+	{level: 1, date: "20240220", parent: "tank/data/level0/20240215"},
+}
+
+var chainLast = &manifest.Last{Pool: "tank", Dataset: "data", BackupLevels: []*manifest.Ref{
+	{S3Path: "tank/data/level0/20240215"},
+	{S3Path: "tank/data/level1/20240220"},
+}}
+
+func TestPlan(t *testing.T) {
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	scan := func(backups []backup) []list.Scanned {
+		var scanned []list.Scanned
+		for _, b := range backups {
+			scanned = append(scanned, list.Scanned{S3Path: b.s3Path(), Manifest: b.manifest(t)})
+		}
+		return scanned
+	}
+	reasons := func(backups []Backup) map[string]string {
+		got := make(map[string]string)
+		for _, b := range backups {
+			got[b.S3Path] = b.Reason
+		}
+		return got
+	}
+
+	t.Run("keep_days", func(t *testing.T) {
+		backups, err := plan(scan(chain), chainLast, config.Retention{KeepDays: 30}, now)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{
+			"tank/data/level0/20231201": "",
+			"tank/data/level1/20231205": "",
+			"tank/data/level0/20240101": "parent of tank/data/level1/20240205",
+			"tank/data/level1/20240110": "",
+			"tank/data/level1/20240205": "taken in the last 30 days",
+			"tank/data/level0/20240215": "in the last backup manifest",
+			"tank/data/level1/20240220": "in the last backup manifest",
+		}, reasons(backups))
+	})
+
+	t.Run("keep_last", func(t *testing.T) {
+		backups, err := plan(scan(chain), chainLast, config.Retention{KeepLast: 4}, now)
+		require.NoError(t, err)
+		got := reasons(backups)
+		assert.Equal(t, "one of the last 4", got["tank/data/level1/20240110"])
+		assert.Equal(t, "parent of tank/data/level1/20240205", got["tank/data/level0/20240101"])
+		assert.Empty(t, got["tank/data/level1/20231205"])
+	})
+
+	t.Run("parents of parents", func(t *testing.T) {
+		backups := append(chain[:2:2], backup{level: 2, date: "20240225", parent: "tank/data/level1/20231205"})
+		got, err := plan(scan(backups), &manifest.Last{}, config.Retention{KeepLast: 1}, now)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{
+			"tank/data/level0/20231201": "parent of tank/data/level1/20231205",
+			"tank/data/level1/20231205": "parent of tank/data/level2/20240225",
+			"tank/data/level2/20240225": "one of the last 1",
+		}, reasons(got))
+	})
+
+	t.Run("no parent recorded", func(t *testing.T) {
+		backups := []backup{{level: 0, date: "20240101"}, {level: 1, date: "20240225"}}
+		_, err := plan(scan(backups), &manifest.Last{}, config.Retention{KeepLast: 1}, now)
+		assert.EqualError(t, err, "backup tank/data/level1/20240225 records no parent_s3_path, so its parent cannot be told apart; refusing to prune")
+	})
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	bucket := filepath.Join(dir, "bucket")
+	configPath := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+s3:
+  enabled: true
+  bucket: b
+  region: r
+  storage_class:
+    manifest: STANDARD
+    backup_data: [STANDARD]
+tasks:
+  - name: data
+    pool: tank
+    dataset: data
+    enabled: true
+    retention:
+      keep_days: 30
+  - name: media
+    pool: tank
+    dataset: media
+    enabled: true
+`, dir)), 0o644))
+
+	for _, b := range chain {
+		require.NoError(t, os.MkdirAll(filepath.Join(bucket, "data", b.s3Path()), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(bucket, "data", b.s3Path(), "aaaaaa.age"), []byte("x"), 0o644))
+		require.NoError(t, os.MkdirAll(filepath.Join(bucket, "manifests", b.s3Path()), 0o755))
+		require.NoError(t, manifest.Write(filepath.Join(bucket, "manifests", b.s3Path(), "task_manifest.yaml"), b.manifest(t)))
+	}
+	anchor := filepath.Join(bucket, "anchors", "tank", "data", "level0", "20231201", "anchor.yaml")
+	require.NoError(t, os.MkdirAll(filepath.Dir(anchor), 0o755))
+	require.NoError(t, os.WriteFile(anchor, []byte("x"), 0o644))
+
+	oldCache, oldOutput, oldTerminal, oldNow := remote.DefaultCache, output, stdinIsTerminal, now
+	remote.DefaultCache = remote.NewCache(func(context.Context, remote.Options) (remote.Backend, error) {
+		return &remotetest.DirBackend{Dir: bucket}, nil
+	})
+	var out bytes.Buffer
+	output = &out
+	stdinIsTerminal = func() bool { return false }
+	now = func() time.Time { return time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC) }
+	t.Cleanup(func() { remote.DefaultCache, output, stdinIsTerminal, now = oldCache, oldOutput, oldTerminal, oldNow })
+	ctx := context.Background()
+
+	err := Run(ctx, Options{ConfigPath: configPath})
+	assert.EqualError(t, err, "task data: last backup manifest manifests/tank/data/last_backup_manifest.yaml not found; refusing to prune without it")
+	require.NoError(t, manifest.WriteLast(filepath.Join(bucket, "manifests", "tank", "data", "last_backup_manifest.yaml"), chainLast))
+
+	assert.EqualError(t, Run(ctx, Options{ConfigPath: configPath, TaskName: "media"}), "task media has no retention")
+
+	out.Reset()
+	require.NoError(t, Run(ctx, Options{ConfigPath: configPath, DryRun: true}))
+	assert.Contains(t, out.String(), "Task data (tank/data):\n  prune  tank/data/level0/20231201 (level 0, ")
+	assert.Contains(t, out.String(), "  keep   tank/data/level0/20240101 (level 0, ")
+	assert.Contains(t, out.String(), "): parent of tank/data/level1/20240205\n")
+	assert.Contains(t, out.String(), "Dry run, nothing was removed")
+	assert.DirExists(t, filepath.Join(bucket, "data", "tank", "data", "level0", "20231201"))
+
+	err = Run(ctx, Options{ConfigPath: configPath})
+	assert.EqualError(t, err, "refusing to remove 3 backup(s) without a terminal to confirm; pass --yes")
+
+	out.Reset()
+	require.NoError(t, Run(ctx, Options{ConfigPath: configPath, Yes: true}))
+	assert.Contains(t, out.String(), "Removed 3 backup(s), 6 object(s).\n")
+	for _, b := range chain {
+		part := filepath.Join(bucket, "data", b.s3Path(), "aaaaaa.age")
+		taskManifest := filepath.Join(bucket, "manifests", b.s3Path(), "task_manifest.yaml")
+		if strings.HasPrefix(b.date, "2023") || b.date == "20240110" {
+			assert.NoFileExists(t, part)
+			assert.NoFileExists(t, taskManifest)
+		} else {
+			assert.FileExists(t, part)
+			assert.FileExists(t, taskManifest)
+		}
+	}
+	assert.FileExists(t, anchor, "anchors are left alone")
+
+	out.Reset()
+	require.NoError(t, Run(ctx, Options{ConfigPath: configPath, Yes: true}))
+	assert.Contains(t, out.String(), "Nothing to prune.")
+}
@@ -0,0 +1,205 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"zrb/internal/config"
+)
+
+// Options select and configure a backend. Region, Endpoint, the retry settings and the multipart
+// settings only apply to S3, SFTP only to SFTP.
+type Options struct {
+	// Backend is config.BackendS3, config.BackendGCS or config.BackendSFTP; empty means S3.
+	Backend          string
+	Bucket           string
+	Region           string
+	Prefix           string
+	Endpoint         string
+	StorageClass     string
+	MaxRetryAttempts int
+	// RetryMode, InitialRetryBackoff and MaxRetryBackoff configure the retryer; zero values keep
+	// the SDK defaults.
+	RetryMode           string
+	InitialRetryBackoff time.Duration
+	MaxRetryBackoff     time.Duration
+	VerifyTTL           time.Duration
+	// UploadPartSize and UploadConcurrency configure the multipart uploader.
+	UploadPartSize    int64
+	UploadConcurrency int
+	// SSE is the server-side encryption of uploads, config.SSEAES256 or config.SSEKMS with
+	// SSEKMSKeyID; empty sends none. ObjectACL is a canned ACL set on uploads.
+	SSE         string
+	SSEKMSKeyID string
+	ObjectACL   string
+	// SFTP is the sftp section of the config, with its port and known_hosts_file defaults filled in.
+	SFTP config.SFTPConfig
+}
+
+// OptionsFromConfig returns the options of the backend cfg enables, writing with storageClass.
+func OptionsFromConfig(cfg *config.Config, storageClass string) Options {
+	if cfg.GCS.Enabled {
+		return Options{
+			Backend:      config.BackendGCS,
+			Bucket:       cfg.GCS.Bucket,
+			Prefix:       cfg.GCS.Prefix,
+			StorageClass: storageClass,
+			VerifyTTL:    cfg.S3VerifyTTL(),
+		}
+	}
+	if cfg.SFTP.Enabled {
+		sftp := cfg.SFTP
+		sftp.Port = cfg.SFTPPort()
+		sftp.KnownHostsFile = cfg.SFTPKnownHostsFile()
+		return Options{
+			Backend:   config.BackendSFTP,
+			Bucket:    fmt.Sprintf("%s@%s:%d", sftp.User, sftp.Host, sftp.Port),
+			Prefix:    sftp.BasePath,
+			VerifyTTL: cfg.S3VerifyTTL(),
+			SFTP:      sftp,
+		}
+	}
+	sse, kmsKeyID := cfg.S3SSE()
+	return Options{
+		Backend:             config.BackendS3,
+		Bucket:              cfg.S3.Bucket,
+		Region:              cfg.S3.Region,
+		Prefix:              cfg.S3.Prefix,
+		Endpoint:            cfg.S3.Endpoint,
+		StorageClass:        storageClass,
+		MaxRetryAttempts:    cfg.S3RetryAttempts(),
+		RetryMode:           cfg.S3RetryMode(),
+		InitialRetryBackoff: time.Duration(cfg.S3.Retry.InitialBackoff),
+		MaxRetryBackoff:     cfg.S3RetryMaxBackoff(),
+		VerifyTTL:           cfg.S3VerifyTTL(),
+		UploadPartSize:      cfg.S3UploadPartSize(),
+		UploadConcurrency:   cfg.S3UploadConcurrency(),
+		SSE:                 sse,
+		SSEKMSKeyID:         kmsKeyID,
+		ObjectACL:           cfg.S3.ObjectACL,
+	}
+}
+
+// Factory creates a new backend; replace it in tests to supply fakes.
+type Factory func(ctx context.Context, opts Options) (Backend, error)
+
+// NewBackend creates the backend opts.Backend names.
+func NewBackend(ctx context.Context, opts Options) (Backend, error) {
+	switch opts.Backend {
+	case config.BackendGCS:
+		return NewGCS(ctx, opts)
+	case config.BackendSFTP:
+		return NewSFTP(ctx, opts)
+	}
+	return NewS3(ctx, opts)
+}
+
+type cacheKey struct {
+	backend      string
+	bucket       string
+	region       string
+	prefix       string
+	endpoint     string
+	storageClass string
+	maxRetry     int
+	retryMode    string
+	initialRetry time.Duration
+	maxBackoff   time.Duration
+	partSize     int64
+	concurrency  int
+	sse          string
+	kmsKeyID     string
+	objectACL    string
+	sftp         config.SFTPConfig
+	identity     string
+}
+
+// Cache reuses backends within one process and remembers successful credential checks for a TTL.
+type Cache struct {
+	mu       sync.Mutex
+	factory  Factory
+	backends map[cacheKey]*cachedBackend
+	verified map[string]time.Time
+}
+
+var DefaultCache = NewCache(NewBackend)
+
+func NewCache(factory Factory) *Cache {
+	return &Cache{
+		factory:  factory,
+		backends: make(map[cacheKey]*cachedBackend),
+		verified: make(map[string]time.Time),
+	}
+}
+
+func credentialsIdentity() string {
+	return os.Getenv("AWS_PROFILE") + "|" + os.Getenv("AWS_ACCESS_KEY_ID") + "|" + os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+}
+
+func (c *Cache) Get(ctx context.Context, opts Options) (Backend, error) {
+	key := cacheKey{
+		backend:      opts.Backend,
+		bucket:       opts.Bucket,
+		region:       opts.Region,
+		prefix:       opts.Prefix,
+		endpoint:     opts.Endpoint,
+		storageClass: opts.StorageClass,
+		maxRetry:     opts.MaxRetryAttempts,
+		retryMode:    opts.RetryMode,
+		initialRetry: opts.InitialRetryBackoff,
+		maxBackoff:   opts.MaxRetryBackoff,
+		partSize:     opts.UploadPartSize,
+		concurrency:  opts.UploadConcurrency,
+		sse:          opts.SSE,
+		kmsKeyID:     opts.SSEKMSKeyID,
+		objectACL:    opts.ObjectACL,
+		sftp:         opts.SFTP,
+		identity:     credentialsIdentity(),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if b, ok := c.backends[key]; ok {
+		return b, nil
+	}
+
+	backend, err := c.factory(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Credential checks are per bucket and identity, so backends differing only by storage class share them.
+	verifyKey := opts.Backend + "|" + opts.Endpoint + "|" + opts.Region + "|" + opts.Bucket + "|" + key.identity
+	b := &cachedBackend{Backend: backend, cache: c, verifyKey: verifyKey, ttl: opts.VerifyTTL}
+	c.backends[key] = b
+	return b, nil
+}
+
+type cachedBackend struct {
+	Backend
+	cache     *Cache
+	verifyKey string
+	ttl       time.Duration
+}
+
+func (b *cachedBackend) VerifyCredentials(ctx context.Context) error {
+	b.cache.mu.Lock()
+	verifiedAt, ok := b.cache.verified[b.verifyKey]
+	b.cache.mu.Unlock()
+
+	if ok && time.Since(verifiedAt) < b.ttl {
+		return nil
+	}
+
+	if err := b.Backend.VerifyCredentials(ctx); err != nil {
+		return err
+	}
+
+	b.cache.mu.Lock()
+	b.cache.verified[b.verifyKey] = time.Now()
+	b.cache.mu.Unlock()
+	return nil
+}
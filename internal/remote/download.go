@@ -0,0 +1,219 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"zrb/internal/sdnotify"
+	"zrb/internal/throughput"
+	"zrb/internal/tracing"
+	"zrb/internal/util"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// downloadAttempts bounds how often one Download resumes after the body stream breaks.
+const downloadAttempts = 5
+
+// ProgressFunc receives the bytes downloaded so far and the object size.
+type ProgressFunc func(done, total int64)
+
+type progressKey struct{}
+
+// WithProgress attaches a download progress callback to ctx.
+func WithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+func progressFrom(ctx context.Context) ProgressFunc {
+	if fn, ok := ctx.Value(progressKey{}).(ProgressFunc); ok {
+		return fn
+	}
+	return func(int64, int64) {}
+}
+
+type meterKey struct{}
+
+// WithMeter returns a context whose downloads count the bytes they receive in m, and whose uploads
+// the bytes they send.
+func WithMeter(ctx context.Context, m *throughput.Meter) context.Context {
+	return context.WithValue(ctx, meterKey{}, m)
+}
+
+func meterFrom(ctx context.Context) *throughput.Meter {
+	m, _ := ctx.Value(meterKey{}).(*throughput.Meter)
+	return m
+}
+
+type progressWriter struct {
+	w        io.Writer
+	done     int64
+	total    int64
+	progress ProgressFunc
+	transfer *Transfer
+	meter    *throughput.Meter
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.done += int64(n)
+	sdnotify.Add(int64(n))
+	p.meter.Add(int64(n))
+	p.progress(p.done, p.total)
+	if budgetErr := p.transfer.addDownload(n); budgetErr != nil {
+		return n, budgetErr
+	}
+	return n, err
+}
+
+// Download writes the object to localPath via localPath.partial, resuming a previous partial download
+// of the same object (matched by ETag) with a ranged GET, and renames it into place once complete.
+func (s *S3) Download(ctx context.Context, remotePath, localPath string) error {
+	ctx, span := tracing.Start(ctx, "s3.download", attribute.String("s3.key", remotePath))
+	err := s.download(ctx, remotePath, localPath)
+	tracing.End(span, err)
+	return err
+}
+
+func (s *S3) download(ctx context.Context, remotePath, localPath string) error {
+	key := filepath.ToSlash(filepath.Join(s.prefix, remotePath))
+	partialPath := localPath + ".partial"
+	etagPath := partialPath + ".etag"
+
+	head, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to download from S3: %w", err)
+	}
+	total := aws.ToInt64(head.ContentLength)
+	etag := aws.ToString(head.ETag)
+
+	offset := resumeOffset(partialPath, etagPath, etag, total)
+	if offset == 0 {
+		if err := util.WriteFile(etagPath, []byte(etag)); err != nil {
+			return fmt.Errorf("failed to record download ETag: %w", err)
+		}
+	} else {
+		slog.Info("Resuming partial download", "key", key, "offset", offset, "size", total)
+	}
+
+	progress := progressFrom(ctx)
+	transfer := transferFrom(ctx)
+
+	for attempt := 1; offset < total; attempt++ {
+		offset, err = s.downloadRange(ctx, key, etag, partialPath, offset, total, progress, transfer)
+		if err == nil {
+			break
+		}
+
+		var respErr *smithyhttp.ResponseError
+		if errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusPreconditionFailed {
+			os.Remove(partialPath)
+			os.Remove(etagPath)
+			return fmt.Errorf("object %s changed during download, retry to start over: %w", key, err)
+		}
+		if errors.Is(err, ErrBudgetExceeded) {
+			return fmt.Errorf("download of %s stopped (partial download kept at %d/%d bytes): %w", key, offset, total, err)
+		}
+		if ctx.Err() != nil || attempt >= downloadAttempts {
+			return fmt.Errorf("failed to download from S3 (partial download kept at %d/%d bytes): %w", offset, total, err)
+		}
+		slog.Warn("Download interrupted, resuming", "key", key, "offset", offset, "attempt", attempt, "error", err)
+	}
+
+	if total == 0 {
+		if err := util.WritePart(partialPath, nil); err != nil {
+			return fmt.Errorf("failed to create local file: %w", err)
+		}
+	}
+
+	if err := os.Rename(partialPath, localPath); err != nil {
+		return fmt.Errorf("failed to move completed download into place: %w", err)
+	}
+	os.Remove(etagPath)
+
+	slog.Info("Downloaded from S3", "bucket", s.bucket, "key", key, "bytes", total)
+	return nil
+}
+
+// IsNotFound reports whether err is the answer of S3, GCS or SFTP for a missing object.
+func IsNotFound(err error) bool {
+	var respErr *smithyhttp.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.HTTPStatusCode() == http.StatusNotFound
+	}
+	var gcsErr *GCSError
+	if errors.As(err, &gcsErr) {
+		return gcsErr.StatusCode == http.StatusNotFound
+	}
+	var sftpErr *SFTPError
+	return errors.As(err, &sftpErr) && sftpErr.Code == sftpNoSuchFile
+}
+
+// resumeOffset returns how many bytes of an earlier partial download can be kept, discarding stale ones.
+func resumeOffset(partialPath, etagPath, etag string, total int64) int64 {
+	info, err := os.Stat(partialPath)
+	if err != nil {
+		return 0
+	}
+
+	saved, err := os.ReadFile(etagPath)
+	if err == nil && strings.TrimSpace(string(saved)) == etag && info.Size() <= total {
+		return info.Size()
+	}
+
+	slog.Info("Discarding stale partial download", "path", partialPath)
+	os.Remove(partialPath)
+	return 0
+}
+
+// downloadRange appends bytes from offset to the partial file and returns the new offset, even on error.
+func (s *S3) downloadRange(ctx context.Context, key, etag, partialPath string, offset, total int64, progress ProgressFunc, transfer *Transfer) (int64, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	if etag != "" {
+		input.IfMatch = aws.String(etag)
+	}
+	if offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	output, err := s.client.GetObject(ctx, input)
+	if err != nil {
+		return offset, err
+	}
+	defer output.Body.Close()
+
+	file, err := util.OpenPart(partialPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		return offset, fmt.Errorf("failed to create local file: %w", err)
+	}
+
+	w := &progressWriter{w: file, done: offset, total: total, progress: progress, transfer: transfer, meter: meterFrom(ctx)}
+	_, copyErr := io.Copy(w, output.Body)
+	closeErr := file.Close()
+
+	if copyErr != nil {
+		return w.done, copyErr
+	}
+	if closeErr != nil {
+		return w.done, closeErr
+	}
+	if w.done != total {
+		return w.done, fmt.Errorf("download ended at %d of %d bytes", w.done, total)
+	}
+	return w.done, nil
+}
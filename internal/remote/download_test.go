@@ -0,0 +1,161 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"zrb/internal/throughput"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rangeServer serves one object with range support and can cut the first n responses short.
+type rangeServer struct {
+	mu          sync.Mutex
+	content     []byte
+	etag        string
+	disconnects int
+	ranges      []string
+}
+
+func (s *rangeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.Header().Set("ETag", s.etag)
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Length", strconv.Itoa(len(s.content)))
+		return
+	}
+
+	if m := r.Header.Get("If-Match"); m != "" && m != s.etag {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	start := 0
+	if rng := r.Header.Get("Range"); rng != "" {
+		s.ranges = append(s.ranges, rng)
+		start, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+	}
+	body := s.content[start:]
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if start > 0 {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(s.content)-1, len(s.content)))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+
+	if s.disconnects > 0 {
+		s.disconnects--
+		w.Write(body[:len(body)/2])
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+		return
+	}
+	w.Write(body)
+}
+
+func newTestS3(t *testing.T, handler http.Handler) *S3 {
+	t.Helper()
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	s, err := NewS3(context.Background(), Options{Bucket: "bucket", Region: "us-east-1", Endpoint: server.URL, StorageClass: "STANDARD", MaxRetryAttempts: 1})
+	require.NoError(t, err)
+	return s
+}
+
+func randomContent(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	require.NoError(t, err)
+	return b
+}
+
+func TestDownloadResumesAfterDisconnect(t *testing.T) {
+	srv := &rangeServer{content: randomContent(t, 1<<20), etag: `"v1"`, disconnects: 2}
+	s := newTestS3(t, srv)
+
+	var last, total int64
+	ctx := WithProgress(context.Background(), func(done, size int64) { last, total = done, size })
+
+	local := filepath.Join(t.TempDir(), "part.age")
+	require.NoError(t, s.Download(ctx, "data/part.age", local))
+
+	got, err := os.ReadFile(local)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(srv.content, got))
+	assert.Len(t, srv.ranges, 2, "each disconnect resumes with a range request")
+	assert.Equal(t, int64(len(srv.content)), last)
+	assert.Equal(t, int64(len(srv.content)), total)
+
+	_, err = os.Stat(local + ".partial")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDownloadResumesExistingPartial(t *testing.T) {
+	srv := &rangeServer{content: randomContent(t, 4096), etag: `"v1"`}
+	s := newTestS3(t, srv)
+
+	local := filepath.Join(t.TempDir(), "part.age")
+	require.NoError(t, os.WriteFile(local+".partial", srv.content[:1000], 0o644))
+	require.NoError(t, os.WriteFile(local+".partial.etag", []byte(`"v1"`), 0o644))
+
+	meter := &throughput.Meter{}
+	require.NoError(t, s.Download(WithMeter(context.Background(), meter), "data/part.age", local))
+
+	got, err := os.ReadFile(local)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(srv.content, got))
+	assert.Equal(t, []string{"bytes=1000-"}, srv.ranges)
+	assert.Equal(t, int64(3096), meter.Bytes(), "the meter counts what was downloaded, not what was resumed")
+}
+
+func TestDownloadDiscardsStalePartial(t *testing.T) {
+	srv := &rangeServer{content: randomContent(t, 4096), etag: `"v2"`}
+	s := newTestS3(t, srv)
+
+	local := filepath.Join(t.TempDir(), "part.age")
+	require.NoError(t, os.WriteFile(local+".partial", []byte("old object bytes"), 0o644))
+	require.NoError(t, os.WriteFile(local+".partial.etag", []byte(`"v1"`), 0o644))
+
+	require.NoError(t, s.Download(context.Background(), "data/part.age", local))
+
+	got, err := os.ReadFile(local)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(srv.content, got))
+	assert.Empty(t, srv.ranges)
+}
+
+func TestDownloadKeepsPartialWhenAttemptsExhausted(t *testing.T) {
+	srv := &rangeServer{content: randomContent(t, 64*1024), etag: `"v1"`, disconnects: downloadAttempts}
+	s := newTestS3(t, srv)
+
+	local := filepath.Join(t.TempDir(), "part.age")
+	err := s.Download(context.Background(), "data/part.age", local)
+	require.Error(t, err)
+
+	info, statErr := os.Stat(local + ".partial")
+	require.NoError(t, statErr)
+	assert.Greater(t, info.Size(), int64(0))
+	assert.Less(t, info.Size(), int64(len(srv.content)))
+}
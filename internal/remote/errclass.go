@@ -0,0 +1,95 @@
+package remote
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// ErrorClass is whether a request that failed may succeed when tried again.
+type ErrorClass string
+
+const (
+	// Transient failures, such as throttling, server errors and timeouts, go through retry and backoff.
+	Transient ErrorClass = "transient"
+	// Permanent failures come from the configuration, such as a missing bucket or lacking permissions,
+	// and fail the same way on every attempt.
+	Permanent ErrorClass = "permanent"
+)
+
+// permanentCodes map the S3 error codes that no retry fixes to the setting that likely causes them.
+var permanentCodes = map[string]string{
+	"AccessDenied":                 "the credentials lack permission for s3.bucket and s3.prefix",
+	"AllAccessDisabled":            "all access to s3.bucket is disabled",
+	"AccountProblem":               "the account of the credentials is disabled",
+	"InvalidAccessKeyId":           "the access key of the credentials does not exist",
+	"SignatureDoesNotMatch":        "the secret key of the credentials is wrong",
+	"NoSuchBucket":                 "s3.bucket does not exist",
+	"InvalidBucketName":            "s3.bucket is not a valid bucket name",
+	"PermanentRedirect":            "s3.region is not the region of s3.bucket",
+	"AuthorizationHeaderMalformed": "s3.region is not the region of s3.bucket",
+	"InvalidStorageClass":          "the endpoint does not support a storage class in s3.storage_class",
+	"KMS.AccessDeniedException":    "the credentials lack permission for the key of s3.encryption.kms_key_id",
+	"KMS.NotFoundException":        "s3.encryption.kms_key_id does not exist",
+}
+
+// Classify returns the class of an error of S3, GCS or SFTP, and for a permanent one the setting that
+// likely causes it. Errors that did not come from a request have no class.
+func Classify(err error) (ErrorClass, string) {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		if hint, ok := permanentCodes[apiErr.ErrorCode()]; ok {
+			return Permanent, hint
+		}
+		return Transient, ""
+	}
+	var gcsErr *GCSError
+	if errors.As(err, &gcsErr) {
+		switch {
+		case gcsErr.StatusCode == http.StatusUnauthorized:
+			return Permanent, "the credentials of gcs are not accepted"
+		case gcsErr.StatusCode == http.StatusForbidden:
+			return Permanent, "the credentials lack permission for gcs.bucket and gcs.prefix"
+		case gcsErr.StatusCode == http.StatusNotFound && strings.Contains(strings.ToLower(gcsErr.Message), "bucket"):
+			return Permanent, "gcs.bucket does not exist"
+		}
+		return Transient, ""
+	}
+	var sftpErr *SFTPError
+	if errors.As(err, &sftpErr) {
+		if sftpErr.Code == sftpPermissionDenied {
+			return Permanent, "sftp.user lacks permission for sftp.base_path"
+		}
+		return Transient, ""
+	}
+	if errors.Is(err, errSFTPClosed) {
+		return Transient, ""
+	}
+	var respErr *smithyhttp.ResponseError
+	var netErr net.Error
+	if errors.As(err, &respErr) || errors.As(err, &netErr) {
+		return Transient, ""
+	}
+	return "", ""
+}
+
+// IsPermanent reports whether err is a permanent failure of S3, GCS or SFTP.
+func IsPermanent(err error) bool {
+	class, _ := Classify(err)
+	return class == Permanent
+}
+
+// noRetryPermanent keeps the SDK from retrying the errors Classify finds permanent, whatever its
+// own retryables say about them.
+var noRetryPermanent = retry.IsErrorRetryableFunc(func(err error) aws.Ternary {
+	if IsPermanent(err) {
+		return aws.FalseTernary
+	}
+	return aws.UnknownTernary
+})
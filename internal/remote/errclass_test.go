@@ -0,0 +1,69 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/stretchr/testify/assert"
+)
+
+// s3Error is an error with code as the SDK returns it for a response with status.
+func s3Error(status int, code string) error {
+	return &smithyhttp.ResponseError{
+		Response: &smithyhttp.Response{Response: &http.Response{StatusCode: status}},
+		Err:      &smithy.GenericAPIError{Code: code, Message: code},
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		class ErrorClass
+		hint  string
+	}{
+		{"access denied", s3Error(http.StatusForbidden, "AccessDenied"), Permanent, "s3.bucket and s3.prefix"},
+		{"missing bucket", s3Error(http.StatusNotFound, "NoSuchBucket"), Permanent, "s3.bucket does not exist"},
+		{"modeled missing bucket", &types.NoSuchBucket{}, Permanent, "s3.bucket does not exist"},
+		{"storage class", s3Error(http.StatusBadRequest, "InvalidStorageClass"), Permanent, "s3.storage_class"},
+		{"wrong region", s3Error(http.StatusMovedPermanently, "PermanentRedirect"), Permanent, "s3.region"},
+		{"wrapped", fmt.Errorf("failed to upload part: %w", s3Error(http.StatusForbidden, "AccessDenied")), Permanent, "s3.bucket and s3.prefix"},
+		{"slow down", s3Error(http.StatusServiceUnavailable, "SlowDown"), Transient, ""},
+		{"internal error", s3Error(http.StatusInternalServerError, "InternalError"), Transient, ""},
+		{"status only", &smithyhttp.ResponseError{Response: &smithyhttp.Response{Response: &http.Response{StatusCode: http.StatusBadGateway}},
+			Err: errors.New("bad gateway")}, Transient, ""},
+		{"gcs forbidden", &GCSError{StatusCode: http.StatusForbidden, Message: "denied"}, Permanent, "gcs.bucket and gcs.prefix"},
+		{"gcs missing bucket", &GCSError{StatusCode: http.StatusNotFound, Message: "The specified bucket does not exist."}, Permanent, "gcs.bucket does not exist"},
+		{"gcs missing object", &GCSError{StatusCode: http.StatusNotFound, Message: "No such object"}, Transient, ""},
+		{"gcs rate limit", &GCSError{StatusCode: http.StatusTooManyRequests}, Transient, ""},
+		{"not a request", errors.New("disk full"), "", ""},
+		{"cancelled", context.Canceled, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			class, hint := Classify(tt.err)
+			assert.Equal(t, tt.class, class)
+			if tt.hint == "" {
+				assert.Empty(t, hint)
+			} else {
+				assert.Contains(t, hint, tt.hint)
+			}
+			assert.Equal(t, tt.class == Permanent, IsPermanent(tt.err))
+		})
+	}
+}
+
+func TestRetryerSkipsPermanentErrors(t *testing.T) {
+	retryer := newRetryer(Options{})
+	assert.True(t, retryer.IsErrorRetryable(s3Error(http.StatusServiceUnavailable, "SlowDown")))
+	assert.True(t, retryer.IsErrorRetryable(s3Error(http.StatusServiceUnavailable, "ServiceUnavailable")))
+	// A permanent code wins over a status the SDK would retry.
+	assert.False(t, retryer.IsErrorRetryable(s3Error(http.StatusServiceUnavailable, "NoSuchBucket")))
+	assert.False(t, retryer.IsErrorRetryable(s3Error(http.StatusForbidden, "AccessDenied")))
+}
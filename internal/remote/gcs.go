@@ -0,0 +1,322 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"zrb/internal/tracing"
+	"zrb/internal/util"
+
+	"cloud.google.com/go/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// gcsChunkSize is the size of each request of a resumable upload; GCS needs a multiple of 256 KiB.
+// Lowered by tests.
+var gcsChunkSize = 16 << 20
+
+// gcsEmulatorEnv points the storage client at an emulator without authentication.
+const gcsEmulatorEnv = "STORAGE_EMULATOR_HOST"
+
+// GCSError is a failed Google Cloud Storage request.
+type GCSError struct {
+	StatusCode int
+	Message    string
+	err        error
+}
+
+func (e *GCSError) Error() string {
+	return fmt.Sprintf("GCS request failed with status %d: %s", e.StatusCode, e.Message)
+}
+
+func (e *GCSError) Unwrap() error {
+	return e.err
+}
+
+// gcsError turns the errors of the storage client into a GCSError with the HTTP status they stand
+// for, which Classify and IsNotFound read. Other errors, such as network failures, pass unchanged.
+func gcsError(err error) error {
+	var apiErr *googleapi.Error
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, storage.ErrObjectNotExist):
+		return &GCSError{StatusCode: http.StatusNotFound, Message: "No such object", err: err}
+	case errors.Is(err, storage.ErrBucketNotExist):
+		return &GCSError{StatusCode: http.StatusNotFound, Message: "The specified bucket does not exist.", err: err}
+	case errors.As(err, &apiErr):
+		return &GCSError{StatusCode: apiErr.Code, Message: apiErr.Message, err: err}
+	}
+	return err
+}
+
+// GCS stores objects in a Google Cloud Storage bucket with the official storage client.
+type GCS struct {
+	client       *storage.Client
+	bucket       string
+	prefix       string
+	storageClass string
+}
+
+// NewGCS creates a client with the application default credentials golang.org/x/oauth2/google finds:
+// GOOGLE_APPLICATION_CREDENTIALS, the gcloud application default credentials or the metadata server
+// of a Compute Engine instance. With STORAGE_EMULATOR_HOST set it talks to the emulator instead,
+// without credentials.
+func NewGCS(ctx context.Context, opts Options) (*GCS, error) {
+	if opts.StorageClass == "" {
+		return nil, fmt.Errorf("storage class must be specified")
+	}
+
+	clientOpts := []option.ClientOption{storage.WithJSONReads()}
+	if host := os.Getenv(gcsEmulatorEnv); host != "" {
+		slog.Info("GCS client initialized with emulator", "endpoint", host)
+	} else {
+		creds, err := google.FindDefaultCredentials(ctx, storage.ScopeReadWrite)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load Google credentials: %w", err)
+		}
+		clientOpts = append(clientOpts, option.WithCredentials(creds))
+	}
+	client, err := storage.NewClient(ctx, clientOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCS client: %w", err)
+	}
+
+	g := &GCS{
+		client:       client,
+		bucket:       opts.Bucket,
+		prefix:       opts.Prefix,
+		storageClass: string(opts.StorageClass),
+	}
+	slog.Info("Using storage class", "storageClass", g.storageClass)
+	return g, nil
+}
+
+func (g *GCS) key(remotePath string) string {
+	return filepath.ToSlash(filepath.Join(g.prefix, remotePath))
+}
+
+// object is the handle of key. Every write zrb makes replaces an object with the same content, so
+// uploads and deletes are retried like reads.
+func (g *GCS) object(key string) *storage.ObjectHandle {
+	return g.client.Bucket(g.bucket).Object(key).Retryer(storage.WithPolicy(storage.RetryAlways))
+}
+
+func (g *GCS) Upload(ctx context.Context, localPath, remotePath, checksumHash string, tags ObjectTags) error {
+	ctx, span := tracing.Start(ctx, "gcs.upload", attribute.String("gcs.object", remotePath), attribute.String("gcs.storage_class", g.storageClass))
+	err := g.upload(ctx, localPath, remotePath, checksumHash, tags)
+	tracing.End(span, err)
+	return err
+}
+
+// upload sends the file with a resumable upload of gcsChunkSize requests, which the storage client
+// resumes from the offset GCS kept when a request fails.
+func (g *GCS) upload(ctx context.Context, localPath, remotePath, checksumHash string, tags ObjectTags) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+	key := g.key(remotePath)
+
+	// Cancelling the context is how a storage.Writer is abandoned without creating the object.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := g.object(key).NewWriter(ctx)
+	w.ChunkSize = gcsChunkSize
+	w.StorageClass = g.storageClass
+	w.ContentType, w.CacheControl = objectHeaders(key)
+	w.Metadata = tags.Metadata()
+	w.Metadata["blake3"] = checksumHash
+
+	body := countingFile{File: file, transfer: transferFrom(ctx), meter: meterFrom(ctx)}
+	if _, err := io.Copy(w, body); err != nil {
+		cancel()
+		w.Close()
+		return fmt.Errorf("failed to upload to GCS: %w", gcsError(err))
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to upload to GCS: %w", gcsError(err))
+	}
+
+	slog.Info("Uploaded to GCS", "bucket", g.bucket, "object", key, "storageClass", g.storageClass)
+	return nil
+}
+
+func (g *GCS) Head(ctx context.Context, remotePath string) (*ObjectInfo, error) {
+	key := g.key(remotePath)
+	attrs, err := g.object(key).Attrs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to head object %s: %w", key, gcsError(err))
+	}
+
+	info := &ObjectInfo{Bucket: g.bucket, Key: key, Size: attrs.Size, StorageClass: attrs.StorageClass, LastModified: attrs.Updated, ETag: attrs.Etag}
+	if attrs.Metadata != nil {
+		info.Blake3 = attrs.Metadata["blake3"]
+		info.Task = attrs.Metadata["task"]
+		info.Generation = attrs.Metadata["generation"]
+	}
+	return info, nil
+}
+
+func (g *GCS) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	keyPrefix := g.key(prefix)
+	if strings.HasSuffix(prefix, "/") {
+		keyPrefix += "/"
+	}
+
+	var objects []ObjectInfo
+	it := g.client.Bucket(g.bucket).Objects(ctx, &storage.Query{Prefix: keyPrefix})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects below %s: %w", keyPrefix, gcsError(err))
+		}
+		objects = append(objects, ObjectInfo{Bucket: g.bucket, Key: relativeKey(g.prefix, attrs.Name), Size: attrs.Size,
+			StorageClass: attrs.StorageClass, LastModified: attrs.Updated, ETag: attrs.Etag})
+	}
+}
+
+// Download writes the object to localPath via localPath.partial like the S3 backend, matching a
+// partial download to the object by its GCS generation.
+func (g *GCS) Download(ctx context.Context, remotePath, localPath string) error {
+	ctx, span := tracing.Start(ctx, "gcs.download", attribute.String("gcs.object", remotePath))
+	err := g.download(ctx, remotePath, localPath)
+	tracing.End(span, err)
+	return err
+}
+
+func (g *GCS) download(ctx context.Context, remotePath, localPath string) error {
+	key := g.key(remotePath)
+	partialPath := localPath + ".partial"
+	generationPath := partialPath + ".etag"
+
+	attrs, err := g.object(key).Attrs(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to download from GCS: %w", gcsError(err))
+	}
+	total := attrs.Size
+	generation := strconv.FormatInt(attrs.Generation, 10)
+
+	offset := resumeOffset(partialPath, generationPath, generation, total)
+	if offset == 0 {
+		if err := util.WriteFile(generationPath, []byte(generation)); err != nil {
+			return fmt.Errorf("failed to record download generation: %w", err)
+		}
+	} else {
+		slog.Info("Resuming partial download", "object", key, "offset", offset, "size", total)
+	}
+
+	progress := progressFrom(ctx)
+	transfer := transferFrom(ctx)
+
+	for attempt := 1; offset < total; attempt++ {
+		offset, err = g.downloadRange(ctx, key, attrs.Generation, partialPath, offset, total, progress, transfer)
+		if err == nil {
+			break
+		}
+
+		// The generation the partial download belongs to is gone once the object was replaced.
+		if IsNotFound(err) {
+			os.Remove(partialPath)
+			os.Remove(generationPath)
+			return fmt.Errorf("object %s changed during download, retry to start over: %w", key, err)
+		}
+		if errors.Is(err, ErrBudgetExceeded) {
+			return fmt.Errorf("download of %s stopped (partial download kept at %d/%d bytes): %w", key, offset, total, err)
+		}
+		if ctx.Err() != nil || attempt >= downloadAttempts {
+			return fmt.Errorf("failed to download from GCS (partial download kept at %d/%d bytes): %w", offset, total, err)
+		}
+		slog.Warn("Download interrupted, resuming", "object", key, "offset", offset, "attempt", attempt, "error", err)
+	}
+
+	if total == 0 {
+		if err := util.WritePart(partialPath, nil); err != nil {
+			return fmt.Errorf("failed to create local file: %w", err)
+		}
+	}
+
+	if err := os.Rename(partialPath, localPath); err != nil {
+		return fmt.Errorf("failed to move completed download into place: %w", err)
+	}
+	os.Remove(generationPath)
+
+	slog.Info("Downloaded from GCS", "bucket", g.bucket, "object", key, "bytes", total)
+	return nil
+}
+
+// downloadRange appends bytes from offset of the given generation to the partial file and returns
+// the new offset, even on error.
+func (g *GCS) downloadRange(ctx context.Context, key string, generation int64, partialPath string, offset, total int64, progress ProgressFunc, transfer *Transfer) (int64, error) {
+	r, err := g.object(key).Generation(generation).NewRangeReader(ctx, offset, -1)
+	if err != nil {
+		return offset, gcsError(err)
+	}
+	defer r.Close()
+
+	file, err := util.OpenPart(partialPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		return offset, fmt.Errorf("failed to create local file: %w", err)
+	}
+
+	w := &progressWriter{w: file, done: offset, total: total, progress: progress, transfer: transfer, meter: meterFrom(ctx)}
+	_, copyErr := io.Copy(w, r)
+	closeErr := file.Close()
+
+	if copyErr != nil {
+		return w.done, gcsError(copyErr)
+	}
+	if closeErr != nil {
+		return w.done, closeErr
+	}
+	if w.done != total {
+		return w.done, fmt.Errorf("download ended at %d of %d bytes", w.done, total)
+	}
+	return w.done, nil
+}
+
+func (g *GCS) Delete(ctx context.Context, remotePath string) error {
+	key := g.key(remotePath)
+	if err := g.object(key).Delete(ctx); err != nil {
+		return fmt.Errorf("failed to delete object %s: %w", key, gcsError(err))
+	}
+
+	slog.Info("Deleted from GCS", "bucket", g.bucket, "object", key)
+	return nil
+}
+
+// VerifyCredentials reads the bucket's metadata, which needs both valid credentials and access to
+// the bucket.
+func (g *GCS) VerifyCredentials(ctx context.Context) error {
+	slog.Info("Verifying Google credentials and bucket access", "bucket", g.bucket)
+
+	if _, err := g.client.Bucket(g.bucket).Attrs(ctx); err != nil {
+		return fmt.Errorf("failed to verify Google credentials or bucket access: %w", gcsError(err))
+	}
+
+	slog.Info("Google credentials verified successfully", "bucket", g.bucket)
+	return nil
+}
+
+// AbortIncompleteUploads has nothing to do on GCS: an interrupted resumable upload is not billed
+// and expires after a week.
+func (g *GCS) AbortIncompleteUploads(context.Context, string, time.Duration) (int, error) {
+	return 0, nil
+}
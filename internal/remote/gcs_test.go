@@ -0,0 +1,302 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gcsServer implements the parts of the GCS JSON API the backend uses, for one bucket.
+type gcsServer struct {
+	mu      sync.Mutex
+	objects map[string]*gcsFake
+	// uploads maps a resumable session ID to the object it writes.
+	uploads map[string]*gcsFake
+	// failChunks makes the first n chunk requests fail with 503 after storing half of the chunk.
+	failChunks int
+	chunks     int
+}
+
+type gcsFake struct {
+	name     string
+	data     []byte
+	class    string
+	metadata map[string]string
+	gen      int
+}
+
+// UnmarshalJSON reads the object resource an upload starts with.
+func (o *gcsFake) UnmarshalJSON(data []byte) error {
+	var object struct {
+		Name         string            `json:"name"`
+		StorageClass string            `json:"storageClass"`
+		Metadata     map[string]string `json:"metadata"`
+	}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return err
+	}
+	o.name, o.class, o.metadata = object.Name, object.StorageClass, object.Metadata
+	return nil
+}
+
+func newGCSServer(t *testing.T) (*gcsServer, *GCS) {
+	t.Helper()
+	srv := &gcsServer{objects: make(map[string]*gcsFake), uploads: make(map[string]*gcsFake)}
+	server := httptest.NewServer(srv)
+	t.Cleanup(server.Close)
+	t.Setenv(gcsEmulatorEnv, server.URL)
+
+	old := gcsChunkSize
+	gcsChunkSize = 256 << 10
+	t.Cleanup(func() { gcsChunkSize = old })
+
+	g, err := NewGCS(context.Background(), Options{Bucket: "bucket", Prefix: "zrb", StorageClass: "NEARLINE"})
+	require.NoError(t, err)
+	return srv, g
+}
+
+func (s *gcsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := r.URL.EscapedPath()
+	switch {
+	case r.Method == http.MethodPost && path == "/upload/storage/v1/b/bucket/o" && r.URL.Query().Get("uploadType") == "multipart":
+		s.putMultipart(w, r)
+	case r.Method == http.MethodPost && path == "/upload/storage/v1/b/bucket/o":
+		upload := &gcsFake{}
+		if err := json.NewDecoder(r.Body).Decode(upload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		id := strconv.Itoa(len(s.uploads))
+		s.uploads[id] = upload
+		w.Header().Set("Location", "http://"+r.Host+"/session/"+id)
+	case strings.HasPrefix(path, "/session/"):
+		s.putChunk(w, r, s.uploads[strings.TrimPrefix(path, "/session/")])
+	case path == "/storage/v1/b/bucket":
+		w.Write([]byte(`{"name":"bucket"}`))
+	case r.Method == http.MethodGet && path == "/storage/v1/b/bucket/o":
+		s.list(w, r)
+	case strings.HasPrefix(path, "/storage/v1/b/bucket/o/"):
+		name, _ := url.PathUnescape(strings.TrimPrefix(path, "/storage/v1/b/bucket/o/"))
+		object, ok := s.objects[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":404,"message":"No such object"}}`))
+			return
+		}
+		switch {
+		case r.Method == http.MethodDelete:
+			delete(s.objects, name)
+			w.WriteHeader(http.StatusNoContent)
+		case r.URL.Query().Get("alt") == "media":
+			if gen := r.URL.Query().Get("generation"); gen != "" && gen != strconv.Itoa(object.gen) {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error":{"code":404,"message":"No such object"}}`))
+				return
+			}
+			w.Header().Set("X-Goog-Generation", strconv.Itoa(object.gen))
+			start, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.Header.Get("Range"), "bytes="), "-"))
+			if start > 0 {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(object.data)-1, len(object.data)))
+				w.WriteHeader(http.StatusPartialContent)
+			}
+			w.Write(object.data[start:])
+		default:
+			json.NewEncoder(w).Encode(object.attrs())
+		}
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// list answers with two objects per page, in name order like GCS.
+func (s *gcsServer) list(w http.ResponseWriter, r *http.Request) {
+	var names []string
+	for name := range s.objects {
+		if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	start, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+	end := min(start+2, len(names))
+	page := map[string]any{"items": []any{}}
+	for _, name := range names[start:end] {
+		object := s.objects[name]
+		page["items"] = append(page["items"].([]any), object.attrs())
+	}
+	if end < len(names) {
+		page["nextPageToken"] = strconv.Itoa(end)
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+// putMultipart stores an object sent in one request: the object resource, then its data.
+func (s *gcsServer) putMultipart(w http.ResponseWriter, r *http.Request) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	parts := multipart.NewReader(r.Body, params["boundary"])
+	upload := &gcsFake{}
+	resource, err := parts.NextPart()
+	if err == nil {
+		err = json.NewDecoder(resource).Decode(upload)
+	}
+	var media *multipart.Part
+	if err == nil {
+		media, err = parts.NextPart()
+	}
+	if err == nil {
+		upload.data, err = io.ReadAll(media)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.store(w, upload)
+}
+
+func (s *gcsServer) store(w http.ResponseWriter, upload *gcsFake) {
+	upload.gen = len(s.objects) + 1
+	s.objects[upload.name] = upload
+	json.NewEncoder(w).Encode(upload.attrs())
+}
+
+func (s *gcsServer) putChunk(w http.ResponseWriter, r *http.Request, upload *gcsFake) {
+	body, _ := io.ReadAll(r.Body)
+	// Content-Range is bytes start-end/total, bytes */total for a status query or an empty object, and
+	// the total is * until the last chunk.
+	span, total, _ := strings.Cut(strings.TrimPrefix(r.Header.Get("Content-Range"), "bytes "), "/")
+	start := len(upload.data)
+	if first, _, ok := strings.Cut(span, "-"); ok {
+		start, _ = strconv.Atoi(first)
+	}
+	if start != len(upload.data) && len(body) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(body) > 0 {
+		s.chunks++
+		if s.failChunks > 0 {
+			s.failChunks--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}
+	upload.data = append(upload.data, body...)
+	if size, err := strconv.Atoi(total); err != nil || len(upload.data) < size {
+		if len(upload.data) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(upload.data)-1))
+		}
+		// Clients asking for X-GUploader-No-308 get the 308 that means "continue" as a header.
+		if r.Header.Get("X-GUploader-No-308") == "yes" {
+			w.Header().Set("X-Http-Status-Code-Override", "308")
+			return
+		}
+		w.WriteHeader(http.StatusPermanentRedirect)
+		return
+	}
+	s.store(w, upload)
+}
+
+// attrs is the object resource GCS answers with.
+func (o *gcsFake) attrs() map[string]any {
+	return map[string]any{
+		"bucket":       "bucket",
+		"name":         o.name,
+		"size":         strconv.Itoa(len(o.data)),
+		"generation":   strconv.Itoa(o.gen),
+		"storageClass": o.class,
+		"metadata":     o.metadata,
+		"updated":      "2024-01-15T02:03:04.567Z",
+		"etag":         "CL" + strconv.Itoa(o.gen),
+	}
+}
+
+func TestGCSRoundTrip(t *testing.T) {
+	srv, g := newGCSServer(t)
+	ctx := context.Background()
+	content := randomContent(t, 600<<10)
+	local := filepath.Join(t.TempDir(), "part.age")
+	require.NoError(t, os.WriteFile(local, content, 0o644))
+
+	// The first chunk fails and is sent again.
+	srv.failChunks = 1
+	require.NoError(t, g.Upload(ctx, local, "data/tank/data/part", "h1", ObjectTags{Level: 0, Task: "t", Generation: "level0-20240115"}))
+	assert.Equal(t, content, srv.objects["zrb/data/tank/data/part"].data)
+	assert.Equal(t, 4, srv.chunks, "0-256K fails, then 0-256K, 256K-512K and 512K-600K")
+
+	info, err := g.Head(ctx, "data/tank/data/part")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), info.Size)
+	assert.Equal(t, "h1", info.Blake3)
+	assert.Equal(t, "t", info.Task)
+	assert.Equal(t, "level0-20240115", info.Generation)
+	assert.Equal(t, "NEARLINE", info.StorageClass)
+	assert.Equal(t, time.Date(2024, 1, 15, 2, 3, 4, 567e6, time.UTC), info.LastModified.UTC())
+	assert.Equal(t, "CL1", info.ETag)
+	assert.NoError(t, info.Accessible())
+
+	downloaded := filepath.Join(t.TempDir(), "part.age")
+	require.NoError(t, g.Download(ctx, "data/tank/data/part", downloaded))
+	got, err := os.ReadFile(downloaded)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(content, got))
+
+	require.NoError(t, g.VerifyCredentials(ctx))
+	require.NoError(t, g.Delete(ctx, "data/tank/data/part"))
+	_, err = g.Head(ctx, "data/tank/data/part")
+	assert.True(t, IsNotFound(err), "got %v", err)
+}
+
+func TestGCSList(t *testing.T) {
+	srv, g := newGCSServer(t)
+	for _, name := range []string{"zrb/manifests/tank/data/last_backup_manifest.yaml", "zrb/manifests/tank/data/level0/20240115/task_manifest.yaml",
+		"zrb/manifests/tank/data/level1/20240116/task_manifest.yaml", "zrb/manifests/tank/data2/level0/20240115/task_manifest.yaml",
+		"zrb/data/tank/data/level0/20240115/snapshot.part-aaaaaa.age"} {
+		srv.objects[name] = &gcsFake{name: name, data: []byte("x"), class: "STANDARD"}
+	}
+
+	objects, err := g.List(context.Background(), "manifests/tank/data/")
+	require.NoError(t, err)
+	var keys []string
+	for _, o := range objects {
+		keys = append(keys, o.Key)
+	}
+	assert.Equal(t, []string{"manifests/tank/data/last_backup_manifest.yaml", "manifests/tank/data/level0/20240115/task_manifest.yaml",
+		"manifests/tank/data/level1/20240116/task_manifest.yaml"}, keys, "every page, relative to the prefix, data2 excluded")
+	assert.Equal(t, int64(1), objects[0].Size)
+	assert.Equal(t, "STANDARD", objects[0].StorageClass)
+}
+
+func TestGCSUploadEmpty(t *testing.T) {
+	srv, g := newGCSServer(t)
+	local := filepath.Join(t.TempDir(), "empty")
+	require.NoError(t, os.WriteFile(local, nil, 0o644))
+
+	require.NoError(t, g.Upload(context.Background(), local, "manifests/empty", "h", ObjectTags{Level: -1}))
+	require.Contains(t, srv.objects, "zrb/manifests/empty")
+	assert.Empty(t, srv.objects["zrb/manifests/empty"].data)
+}
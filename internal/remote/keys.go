@@ -0,0 +1,29 @@
+package remote
+
+import "path"
+
+// DataPath returns the path of a backup data object below the global prefix: [taskPrefix/]data/elem...
+func DataPath(taskPrefix string, elem ...string) string {
+	return join(taskPrefix, "data", elem)
+}
+
+// ManifestPath returns the path of a manifest object below the global prefix: [taskPrefix/]manifests/elem...
+func ManifestPath(taskPrefix string, elem ...string) string {
+	return join(taskPrefix, "manifests", elem)
+}
+
+// AnchorPath returns the path of a backup anchor below the global prefix: [taskPrefix/]anchors/elem...
+// Anchors are kept apart from the manifests they vouch for.
+func AnchorPath(taskPrefix string, elem ...string) string {
+	return join(taskPrefix, "anchors", elem)
+}
+
+// ChunkPath returns the path of a dedup_store chunk below the global prefix:
+// [taskPrefix/]chunks/<store>/<first two hex digits of hash>/<hash>.
+func ChunkPath(taskPrefix, store, hash string) string {
+	return join(taskPrefix, "chunks", []string{store, hash[:2], hash})
+}
+
+func join(taskPrefix, kind string, elem []string) string {
+	return path.Join(append([]string{taskPrefix, kind}, elem...)...)
+}
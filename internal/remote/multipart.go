@@ -0,0 +1,98 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// ErrMultipartNotSupported is returned by AbortIncompleteUploads when the endpoint does not
+// implement listing multipart uploads.
+var ErrMultipartNotSupported = errors.New("endpoint does not support listing multipart uploads")
+
+// MultipartAborter is implemented by backends that can abort incomplete multipart uploads.
+type MultipartAborter interface {
+	// AbortIncompleteUploads aborts the multipart uploads below prefix that were started more than
+	// olderThan ago and returns how many it aborted.
+	AbortIncompleteUploads(ctx context.Context, prefix string, olderThan time.Duration) (int, error)
+}
+
+// AbortIncompleteUploads aborts the multipart uploads an interrupted upload left below prefix,
+// which are billed like stored objects but never show up as objects. Uploads started within
+// olderThan are left alone, as they may still be running.
+func (s *S3) AbortIncompleteUploads(ctx context.Context, prefix string, olderThan time.Duration) (int, error) {
+	keyPrefix := filepath.ToSlash(filepath.Join(s.prefix, prefix))
+	if strings.HasSuffix(prefix, "/") {
+		keyPrefix += "/"
+	}
+	cutoff := time.Now().Add(-olderThan)
+
+	aborted := 0
+	paginator := s3.NewListMultipartUploadsPaginator(s.client, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(keyPrefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			if notSupported(err) {
+				return aborted, fmt.Errorf("%w: %w", ErrMultipartNotSupported, err)
+			}
+			return aborted, fmt.Errorf("failed to list multipart uploads below %s: %w", keyPrefix, err)
+		}
+		for _, upload := range page.Uploads {
+			if upload.Initiated != nil && upload.Initiated.After(cutoff) {
+				continue
+			}
+			_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(s.bucket),
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			})
+			if err != nil {
+				if IsNotFound(err) {
+					continue
+				}
+				return aborted, fmt.Errorf("failed to abort multipart upload of %s: %w", aws.ToString(upload.Key), err)
+			}
+			aborted++
+			slog.Info("Aborted incomplete multipart upload", "bucket", s.bucket, "key", aws.ToString(upload.Key),
+				"initiated", aws.ToTime(upload.Initiated))
+		}
+	}
+	return aborted, nil
+}
+
+// notSupported reports whether an S3 compatible endpoint rejected a request it does not implement.
+func notSupported(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NotImplemented", "MethodNotAllowed", "UnsupportedOperation":
+			return true
+		}
+	}
+	var respErr *smithyhttp.ResponseError
+	return errors.As(err, &respErr) &&
+		(respErr.HTTPStatusCode() == http.StatusNotImplemented || respErr.HTTPStatusCode() == http.StatusMethodNotAllowed)
+}
+
+// AbortIncompleteUploads forwards to the backend, or fails with ErrMultipartNotSupported when it
+// cannot abort multipart uploads.
+func (b *cachedBackend) AbortIncompleteUploads(ctx context.Context, prefix string, olderThan time.Duration) (int, error) {
+	aborter, ok := b.Backend.(MultipartAborter)
+	if !ok {
+		return 0, ErrMultipartNotSupported
+	}
+	return aborter.AbortIncompleteUploads(ctx, prefix, olderThan)
+}
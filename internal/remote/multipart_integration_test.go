@@ -0,0 +1,115 @@
+//go:build integration
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// minioBackend connects to the MinIO at ZRB_TEST_S3_ENDPOINT, e.g. one started with
+//
+//	docker run -p 9000:9000 -e MINIO_ROOT_USER=admin -e MINIO_ROOT_PASSWORD=password minio/minio server /data
+//
+// and creates ZRB_TEST_S3_BUCKET (default zrb-test) when it is missing.
+func minioBackend(t *testing.T) *S3 {
+	t.Helper()
+	endpoint := os.Getenv("ZRB_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("ZRB_TEST_S3_ENDPOINT is not set")
+	}
+	bucket := os.Getenv("ZRB_TEST_S3_BUCKET")
+	if bucket == "" {
+		bucket = "zrb-test"
+	}
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+		t.Setenv("AWS_ACCESS_KEY_ID", "admin")
+		t.Setenv("AWS_SECRET_ACCESS_KEY", "password")
+	}
+
+	ctx := context.Background()
+	backend, err := NewS3(ctx, Options{
+		Bucket:       bucket,
+		Region:       "us-east-1",
+		Prefix:       fmt.Sprintf("zrb-integration-%d", time.Now().UnixNano()),
+		Endpoint:     endpoint,
+		StorageClass: "STANDARD",
+	})
+	require.NoError(t, err)
+
+	_, err = backend.client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String(bucket)})
+	var owned *types.BucketAlreadyOwnedByYou
+	if err != nil && !errors.As(err, &owned) {
+		require.NoError(t, err)
+	}
+	return backend
+}
+
+// startUpload leaves an incomplete multipart upload with one part at key, as a killed upload does.
+func startUpload(t *testing.T, backend *S3, key string) {
+	t.Helper()
+	ctx := context.Background()
+	fullKey := backend.prefix + "/" + key
+	created, err := backend.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(backend.bucket),
+		Key:    aws.String(fullKey),
+	})
+	require.NoError(t, err)
+	_, err = backend.client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:     aws.String(backend.bucket),
+		Key:        aws.String(fullKey),
+		UploadId:   created.UploadId,
+		PartNumber: aws.Int32(1),
+		Body:       bytes.NewReader(bytes.Repeat([]byte("z"), 1024)),
+	})
+	require.NoError(t, err)
+}
+
+func listUploads(t *testing.T, backend *S3) []string {
+	t.Helper()
+	out, err := backend.client.ListMultipartUploads(context.Background(), &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(backend.bucket),
+		Prefix: aws.String(backend.prefix + "/"),
+	})
+	require.NoError(t, err)
+	var keys []string
+	for _, upload := range out.Uploads {
+		keys = append(keys, aws.ToString(upload.Key))
+	}
+	return keys
+}
+
+func TestAbortIncompleteUploadsMinIO(t *testing.T) {
+	backend := minioBackend(t)
+	ctx := context.Background()
+
+	startUpload(t, backend, "data/tank/data/level0/20240101/snapshot.part-aaaaa.age")
+	startUpload(t, backend, "data/tank/other/level0/20240101/snapshot.part-aaaaa.age")
+	require.Len(t, listUploads(t, backend), 2)
+
+	aborted, err := backend.AbortIncompleteUploads(ctx, "data/tank/data/", time.Hour)
+	require.NoError(t, err)
+	assert.Zero(t, aborted, "uploads younger than olderThan are left alone")
+
+	aborted, err = backend.AbortIncompleteUploads(ctx, "data/tank/data/", 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, aborted)
+	assert.Equal(t, []string{backend.prefix + "/data/tank/other/level0/20240101/snapshot.part-aaaaa.age"}, listUploads(t, backend),
+		"uploads of other datasets are kept")
+
+	aborted, err = backend.AbortIncompleteUploads(ctx, "data/", 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, aborted)
+	assert.Empty(t, listUploads(t, backend))
+}
@@ -3,9 +3,15 @@ package remote
 import (
 	"context"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
+	"zrb/internal/sdnotify"
+	"zrb/internal/throughput"
+	"zrb/internal/tracing"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
@@ -13,16 +19,64 @@ import (
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+const (
+	// DefaultUploadPartSize is the multipart part size when Options leaves it unset.
+	DefaultUploadPartSize = 64 * 1024 * 1024
+	maxUploadParts        = 10000
+)
+
+// MaxUploadSize is the largest object the multipart uploader can send in parts of partSize.
+func MaxUploadSize(partSize int64) int64 {
+	return partSize * maxUploadParts
+}
+
 type ObjectInfo struct {
-	Size   int64
-	Blake3 string
+	Bucket       string
+	Key          string
+	Size         int64
+	Blake3       string
+	Task         string
+	Generation   string
+	StorageClass string
+	// Restore is the raw x-amz-restore header, empty when no restore was requested.
+	Restore string
+	// LastModified is when the object was last written.
+	LastModified time.Time
+	// ETag changes whenever the object is overwritten, even with the same metadata.
+	ETag string
+}
+
+// Accessible checks the object's actual storage class rather than the configured one,
+// so archived objects that have already been restored can still be downloaded.
+func (o *ObjectInfo) Accessible() error {
+	if ValidateStorageClass(o.StorageClass) == nil {
+		return nil
+	}
+	switch {
+	case strings.Contains(o.Restore, `ongoing-request="false"`):
+		return nil
+	case strings.Contains(o.Restore, `ongoing-request="true"`):
+		return fmt.Errorf("object %s is %s and its restore is still in progress, retry once it completes", o.Key, o.StorageClass)
+	}
+	return fmt.Errorf("object %s is %s (not immediately accessible)\n"+
+		"You need to:\n"+
+		"1. Initiate a restore: aws s3api restore-object --bucket %s --key %s --restore-request '{\"Days\":7}'\n"+
+		"2. Wait for the restore to complete (up to 12 hours for GLACIER, 48 hours for DEEP_ARCHIVE)\n"+
+		"3. Then retry this command", o.Key, o.StorageClass, o.Bucket, o.Key)
 }
 
 type Backend interface {
-	Upload(ctx context.Context, localPath, remotePath, checksumHash string, backupLevel int16) error
+	Download(ctx context.Context, remotePath, localPath string) error
+	Upload(ctx context.Context, localPath, remotePath, checksumHash string, tags ObjectTags) error
 	Head(ctx context.Context, remotePath string) (*ObjectInfo, error)
+	Delete(ctx context.Context, remotePath string) error
+	// List returns the objects below prefix, a path relative to the configured prefix like the
+	// ones Download takes. Their Key is relative to the configured prefix too, and of the other
+	// fields only Size, StorageClass, LastModified and ETag are set.
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
 	VerifyCredentials(ctx context.Context) error
 }
 
@@ -32,20 +86,23 @@ type S3 struct {
 	bucket         string
 	prefix         string
 	storageClass   types.StorageClass
+	sse            types.ServerSideEncryption
+	kmsKeyID       string
+	acl            types.ObjectCannedACL
 	customEndpoint bool
 }
 
-func NewS3(ctx context.Context, bucket, region, prefix, endpoint string, storageClass types.StorageClass, maxRetryAttempts int) (*S3, error) {
+func NewS3(ctx context.Context, opts Options) (*S3, error) {
+	region, endpoint := opts.Region, opts.Endpoint
+
 	var configOpts []func(*awsconfig.LoadOptions) error
 	configOpts = append(configOpts, awsconfig.WithRegion(region))
 
-	if maxRetryAttempts > 0 {
-		configOpts = append(configOpts,
-			awsconfig.WithRetryMaxAttempts(maxRetryAttempts),
-			awsconfig.WithRetryMode(aws.RetryModeStandard),
-		)
-		slog.Info("Configured S3 retry strategy", "mode", "standard", "maxAttempts", maxRetryAttempts)
-	}
+	// The retryer replaces the one awsconfig.WithRetryMode would select, so it carries the mode itself.
+	retryer := newRetryer(opts)
+	configOpts = append(configOpts, awsconfig.WithRetryer(func() aws.Retryer { return retryer }))
+	slog.Info("Configured S3 retry strategy", "mode", retryMode(opts), "maxAttempts", retryer.MaxAttempts(),
+		"initialBackoff", opts.InitialRetryBackoff, "maxBackoff", retryMaxBackoff(opts))
 
 	cfg, err := awsconfig.LoadDefaultConfig(ctx, configOpts...)
 	if err != nil {
@@ -60,91 +117,143 @@ func NewS3(ctx context.Context, bucket, region, prefix, endpoint string, storage
 		}
 	}
 
+	withRetryCount := func(o *s3.Options) {
+		o.APIOptions = append(o.APIOptions, countRetries)
+	}
+
 	var client *s3.Client
 	if endpoint != "" {
-		client = s3.NewFromConfig(cfg, func(o *s3.Options) {
+		client = s3.NewFromConfig(cfg, withRetryCount, func(o *s3.Options) {
 			o.BaseEndpoint = aws.String(endpoint)
 			o.UsePathStyle = true
 		})
 		slog.Info("S3 client initialized with custom endpoint", "endpoint", endpoint)
 	} else {
-		client = s3.NewFromConfig(cfg)
+		client = s3.NewFromConfig(cfg, withRetryCount)
 	}
 
+	// Parts are read from the file with ReadAt; the uploader only buffers part-sized slices, up to
+	// concurrency+1 of them, for bodies it cannot read at an offset.
 	uploader := manager.NewUploader(client, func(u *manager.Uploader) {
-		u.PartSize = 64 * 1024 * 1024
+		u.PartSize = opts.UploadPartSize
+		if u.PartSize == 0 {
+			u.PartSize = DefaultUploadPartSize
+		}
+		if opts.UploadConcurrency > 0 {
+			u.Concurrency = opts.UploadConcurrency
+		}
+		u.MaxUploadParts = maxUploadParts
 		u.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenSupported
 	})
 
-	if storageClass == "" {
+	if opts.StorageClass == "" {
 		return nil, fmt.Errorf("storage class must be specified")
 	}
-	slog.Info("Using storage class", "storageClass", storageClass)
+	slog.Info("Using storage class", "storageClass", opts.StorageClass)
 
 	return &S3{
 		client:         client,
 		uploader:       uploader,
-		bucket:         bucket,
-		prefix:         prefix,
-		storageClass:   storageClass,
+		bucket:         opts.Bucket,
+		prefix:         opts.Prefix,
+		storageClass:   types.StorageClass(opts.StorageClass),
+		sse:            types.ServerSideEncryption(opts.SSE),
+		kmsKeyID:       opts.SSEKMSKeyID,
+		acl:            types.ObjectCannedACL(opts.ObjectACL),
 		customEndpoint: endpoint != "",
 	}, nil
 }
 
-func (s *S3) Download(ctx context.Context, remotePath, localPath string) error {
-	key := filepath.ToSlash(filepath.Join(s.prefix, remotePath))
+func (s *S3) Upload(ctx context.Context, localPath, remotePath, checksumHash string, tags ObjectTags) error {
+	ctx, span := tracing.Start(ctx, "s3.upload", attribute.String("s3.key", remotePath), attribute.String("s3.storage_class", string(s.storageClass)))
+	err := s.upload(ctx, localPath, remotePath, checksumHash, tags)
+	tracing.End(span, err)
+	return err
+}
 
-	file, err := os.Create(localPath)
+func (s *S3) upload(ctx context.Context, localPath, remotePath, checksumHash string, tags ObjectTags) error {
+	file, err := os.Open(localPath)
 	if err != nil {
-		return fmt.Errorf("failed to create local file: %w", err)
+		return fmt.Errorf("failed to open file: %w", err)
 	}
 	defer file.Close()
 
-	downloader := manager.NewDownloader(s.client)
-	numBytes, err := downloader.Download(ctx, file, &s3.GetObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(key),
-	})
+	key := filepath.ToSlash(filepath.Join(s.prefix, remotePath))
+
+	input := s.putObjectInput(key, countingFile{File: file, transfer: transferFrom(ctx), meter: meterFrom(ctx)}, checksumHash, tags)
+	_, err = s.uploader.Upload(ctx, input)
 	if err != nil {
-		return fmt.Errorf("failed to download from S3: %w", err)
+		return fmt.Errorf("failed to upload to S3: %w", err)
 	}
 
-	slog.Info("Downloaded from S3", "bucket", s.bucket, "key", key, "bytes", numBytes)
+	slog.Info("Uploaded to S3", "bucket", s.bucket, "key", key, "storageClass", s.storageClass)
 	return nil
 }
 
-func (s *S3) Upload(ctx context.Context, localPath, remotePath, checksumHash string, backupLevel int16) error {
-	var levelTag string
-	if backupLevel < 0 {
-		levelTag = "manifest"
-	} else {
-		levelTag = fmt.Sprint(backupLevel)
-	}
-
-	file, err := os.Open(localPath)
-	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
-	}
-	defer file.Close()
-
-	key := filepath.ToSlash(filepath.Join(s.prefix, remotePath))
-
+// putObjectInput is the upload of body to key. The uploader copies its fields to
+// CreateMultipartUpload when it sends the object in parts.
+func (s *S3) putObjectInput(key string, body io.Reader, checksumHash string, tags ObjectTags) *s3.PutObjectInput {
+	contentType, cacheControl := objectHeaders(key)
 	input := &s3.PutObjectInput{
 		Bucket:       aws.String(s.bucket),
 		Key:          aws.String(key),
-		Body:         file,
+		Body:         body,
 		StorageClass: s.storageClass,
-		Tagging:      aws.String("backup-level=" + levelTag),
-		Metadata:     map[string]string{"blake3": checksumHash},
+		ContentType:  aws.String(contentType),
+		Tagging:      aws.String(tags.Tagging()),
+		Metadata:     tags.Metadata(),
+		ACL:          s.acl,
+	}
+	if cacheControl != "" {
+		input.CacheControl = aws.String(cacheControl)
 	}
+	input.Metadata["blake3"] = checksumHash
 
-	_, err = s.uploader.Upload(ctx, input)
-	if err != nil {
-		return fmt.Errorf("failed to upload to S3: %w", err)
+	if s.sse != "" {
+		input.ServerSideEncryption = s.sse
+		if s.sse == types.ServerSideEncryptionAwsKms {
+			input.SSEKMSKeyId = aws.String(s.kmsKeyID)
+		}
 	}
+	return input
+}
 
-	slog.Info("Uploaded to S3", "bucket", s.bucket, "key", key, "storageClass", s.storageClass)
-	return nil
+// objectHeaders returns the Content-Type and Cache-Control of an uploaded object. Manifests are
+// YAML, and last_backup_manifest.yaml is overwritten by every backup, so they must not be cached;
+// everything else is encrypted binary data.
+func objectHeaders(key string) (contentType, cacheControl string) {
+	if strings.HasSuffix(key, ".yaml") {
+		return "application/yaml", "no-cache"
+	}
+	return "application/octet-stream", ""
+}
+
+// countingFile reports what the uploader reads as forward progress, counts it in the meter and
+// against the transfer budget, failing the upload once the budget refuses more. It keeps the io.ReaderAt and
+// io.Seeker of the file, which let the uploader send chunks concurrently without buffering them.
+type countingFile struct {
+	*os.File
+	transfer *Transfer
+	meter    *throughput.Meter
+}
+
+func (f countingFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	return n, f.count(n, err)
+}
+
+func (f countingFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off)
+	return n, f.count(n, err)
+}
+
+func (f countingFile) count(n int, err error) error {
+	sdnotify.Add(int64(n))
+	f.meter.Add(int64(n))
+	if budgetErr := f.transfer.addUpload(n); budgetErr != nil {
+		return budgetErr
+	}
+	return err
 }
 
 func (s *S3) Head(ctx context.Context, remotePath string) (*ObjectInfo, error) {
@@ -158,16 +267,82 @@ func (s *S3) Head(ctx context.Context, remotePath string) (*ObjectInfo, error) {
 		return nil, fmt.Errorf("failed to head object %s: %w", key, err)
 	}
 
-	info := &ObjectInfo{}
+	info := &ObjectInfo{Bucket: s.bucket, Key: key}
 	if output.ContentLength != nil {
 		info.Size = *output.ContentLength
 	}
 	if output.Metadata != nil {
 		info.Blake3 = output.Metadata["blake3"]
+		info.Task = output.Metadata["task"]
+		info.Generation = output.Metadata["generation"]
+	}
+	info.StorageClass = string(output.StorageClass)
+	if output.Restore != nil {
+		info.Restore = *output.Restore
+	}
+	if output.LastModified != nil {
+		info.LastModified = *output.LastModified
+	}
+	if output.ETag != nil {
+		info.ETag = *output.ETag
 	}
 	return info, nil
 }
 
+func (s *S3) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	keyPrefix := filepath.ToSlash(filepath.Join(s.prefix, prefix))
+	if strings.HasSuffix(prefix, "/") {
+		keyPrefix += "/"
+	}
+
+	var objects []ObjectInfo
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(keyPrefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects below %s: %w", keyPrefix, err)
+		}
+		for _, object := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Bucket:       s.bucket,
+				Key:          relativeKey(s.prefix, aws.ToString(object.Key)),
+				Size:         aws.ToInt64(object.Size),
+				StorageClass: string(object.StorageClass),
+				LastModified: aws.ToTime(object.LastModified),
+				ETag:         aws.ToString(object.ETag),
+			})
+		}
+	}
+	return objects, nil
+}
+
+// relativeKey returns key relative to the configured prefix.
+func relativeKey(prefix, key string) string {
+	prefix = strings.Trim(filepath.ToSlash(prefix), "/")
+	if prefix == "" {
+		return key
+	}
+	return strings.TrimPrefix(key, prefix+"/")
+}
+
+func (s *S3) Delete(ctx context.Context, remotePath string) error {
+	key := filepath.ToSlash(filepath.Join(s.prefix, remotePath))
+
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete object %s: %w", key, err)
+	}
+
+	slog.Info("Deleted from S3", "bucket", s.bucket, "key", key)
+	return nil
+}
+
 func (s *S3) VerifyCredentials(ctx context.Context) error {
 	slog.Info("Verifying AWS credentials and bucket access", "bucket", s.bucket)
 
@@ -188,3 +363,27 @@ func ValidateStorageClass(storageClass string) error {
 	}
 	return nil
 }
+
+// CheckAccessible heads remotePath and reports whether it can be downloaded now.
+func CheckAccessible(ctx context.Context, backend Backend, remotePath string) error {
+	info, err := backend.Head(ctx, remotePath)
+	if err != nil {
+		return err
+	}
+	return info.Accessible()
+}
+
+// DeletePrefix deletes every object below prefix, a path relative to the configured prefix that
+// should end in "/", and returns how many it deleted before any error.
+func DeletePrefix(ctx context.Context, backend Backend, prefix string) (int, error) {
+	objects, err := backend.List(ctx, prefix)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list %s: %w", prefix, err)
+	}
+	for i, object := range objects {
+		if err := backend.Delete(ctx, object.Key); err != nil {
+			return i, err
+		}
+	}
+	return len(objects), nil
+}
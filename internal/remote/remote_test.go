@@ -1,9 +1,20 @@
 package remote
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
 	"testing"
+	"time"
+	"zrb/internal/config"
+	"zrb/internal/units"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestValidateStorageClass(t *testing.T) {
@@ -62,3 +73,287 @@ func TestValidateStorageClass(t *testing.T) {
 		})
 	}
 }
+
+// The config package checks S3 storage classes without the SDK, so its list must follow it.
+func TestConfigStorageClassesMatchSDK(t *testing.T) {
+	var sdk []string
+	for _, class := range types.StorageClass("").Values() {
+		sdk = append(sdk, string(class))
+	}
+	assert.Equal(t, sdk, config.StorageClasses(config.BackendS3))
+}
+
+func TestConfigSSEAndACLsMatchSDK(t *testing.T) {
+	var acls []string
+	for _, acl := range types.ObjectCannedACL("").Values() {
+		acls = append(acls, string(acl))
+	}
+	assert.ElementsMatch(t, acls, config.ObjectACLs())
+	assert.Contains(t, types.ServerSideEncryption("").Values(), types.ServerSideEncryption(config.SSEAES256))
+	assert.Contains(t, types.ServerSideEncryption("").Values(), types.ServerSideEncryption(config.SSEKMS))
+}
+
+func TestPutObjectInput(t *testing.T) {
+	tags := ObjectTags{Task: "t", Generation: "1"}
+
+	t.Run("no sse", func(t *testing.T) {
+		s := &S3{bucket: "b", storageClass: types.StorageClassDeepArchive}
+		input := s.putObjectInput("p/data/part-aaa", nil, "hash", tags)
+		assert.Equal(t, "application/octet-stream", aws.ToString(input.ContentType))
+		assert.Nil(t, input.CacheControl)
+		assert.Empty(t, input.ServerSideEncryption)
+		assert.Nil(t, input.SSEKMSKeyId)
+		assert.Empty(t, input.ACL)
+		assert.Equal(t, types.StorageClassDeepArchive, input.StorageClass)
+		assert.Equal(t, "hash", input.Metadata["blake3"])
+	})
+
+	t.Run("manifest", func(t *testing.T) {
+		s := &S3{bucket: "b"}
+		input := s.putObjectInput("p/manifests/last_backup_manifest.yaml", nil, "hash", tags)
+		assert.Equal(t, "application/yaml", aws.ToString(input.ContentType))
+		assert.Equal(t, "no-cache", aws.ToString(input.CacheControl))
+	})
+
+	t.Run("AES256", func(t *testing.T) {
+		s := &S3{bucket: "b", sse: types.ServerSideEncryptionAes256}
+		input := s.putObjectInput("k", nil, "hash", tags)
+		assert.Equal(t, types.ServerSideEncryptionAes256, input.ServerSideEncryption)
+		assert.Nil(t, input.SSEKMSKeyId)
+	})
+
+	t.Run("aws:kms", func(t *testing.T) {
+		s := &S3{bucket: "b", sse: types.ServerSideEncryptionAwsKms, kmsKeyID: "arn:aws:kms:us-east-1:111122223333:key/abc"}
+		input := s.putObjectInput("k", nil, "hash", tags)
+		assert.Equal(t, types.ServerSideEncryptionAwsKms, input.ServerSideEncryption)
+		assert.Equal(t, "arn:aws:kms:us-east-1:111122223333:key/abc", aws.ToString(input.SSEKMSKeyId))
+	})
+
+	t.Run("acl", func(t *testing.T) {
+		s := &S3{bucket: "b", acl: types.ObjectCannedACLBucketOwnerFullControl}
+		assert.Equal(t, types.ObjectCannedACLBucketOwnerFullControl, s.putObjectInput("k", nil, "hash", tags).ACL)
+	})
+}
+
+func TestOptionsFromConfigSSE(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.S3.SSE.Mode = config.SSENone
+	opts := OptionsFromConfig(cfg, "STANDARD")
+	assert.Empty(t, opts.SSE, "none sends no header")
+
+	cfg.S3.SSE.Mode, cfg.S3.SSE.KMSKeyID = config.SSEKMS, "alias/backups"
+	cfg.S3.ObjectACL = "bucket-owner-full-control"
+	opts = OptionsFromConfig(cfg, "STANDARD")
+	assert.Equal(t, config.SSEKMS, opts.SSE)
+	assert.Equal(t, "alias/backups", opts.SSEKMSKeyID)
+	assert.Equal(t, "bucket-owner-full-control", opts.ObjectACL)
+}
+
+func TestObjectInfoAccessible(t *testing.T) {
+	tests := []struct {
+		name        string
+		info        ObjectInfo
+		errContains string
+	}{
+		{name: "standard", info: ObjectInfo{StorageClass: ""}},
+		{name: "standard ia", info: ObjectInfo{StorageClass: "STANDARD_IA"}},
+		{name: "archived", info: ObjectInfo{Bucket: "b", Key: "manifests/x", StorageClass: "GLACIER"}, errContains: "restore-object --bucket b --key manifests/x"},
+		{name: "restore in progress", info: ObjectInfo{StorageClass: "DEEP_ARCHIVE", Restore: `ongoing-request="true"`}, errContains: "in progress"},
+		{name: "restored", info: ObjectInfo{StorageClass: "GLACIER", Restore: `ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.info.Accessible()
+			if tt.errContains != "" {
+				assert.ErrorContains(t, err, tt.errContains)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+type fakeBackend struct {
+	Backend
+	verifyCalls int
+}
+
+func (f *fakeBackend) VerifyCredentials(_ context.Context) error {
+	f.verifyCalls++
+	return nil
+}
+
+func TestCacheReusesBackends(t *testing.T) {
+	created := 0
+	fake := &fakeBackend{}
+	cache := NewCache(func(_ context.Context, _ Options) (Backend, error) {
+		created++
+		return fake, nil
+	})
+
+	opts := Options{Bucket: "b", Region: "r", StorageClass: "STANDARD", VerifyTTL: time.Minute}
+	b1, err := cache.Get(context.Background(), opts)
+	require.NoError(t, err)
+	b2, err := cache.Get(context.Background(), opts)
+	require.NoError(t, err)
+	assert.Same(t, b1, b2)
+
+	opts.StorageClass = "DEEP_ARCHIVE"
+	b3, err := cache.Get(context.Background(), opts)
+	require.NoError(t, err)
+	assert.NotSame(t, b1, b3)
+	assert.Equal(t, 2, created)
+
+	require.NoError(t, b1.VerifyCredentials(context.Background()))
+	require.NoError(t, b3.VerifyCredentials(context.Background()))
+	assert.Equal(t, 1, fake.verifyCalls)
+}
+
+func TestCacheVerifyTTLExpires(t *testing.T) {
+	fake := &fakeBackend{}
+	cache := NewCache(func(_ context.Context, _ Options) (Backend, error) {
+		return fake, nil
+	})
+
+	b, err := cache.Get(context.Background(), Options{Bucket: "b"})
+	require.NoError(t, err)
+
+	require.NoError(t, b.VerifyCredentials(context.Background()))
+	require.NoError(t, b.VerifyCredentials(context.Background()))
+	assert.Equal(t, 2, fake.verifyCalls)
+}
+
+func TestObjectTags(t *testing.T) {
+	tags := ObjectTags{Level: 1, Task: "photos & docs", Generation: GenerationFromTaskDir("level1/20240115")}
+	assert.Equal(t, "backup-level=1&generation=level1-20240115&task=photos%20%26%20docs", tags.Tagging())
+	assert.Equal(t, map[string]string{
+		"backup-level": "1",
+		"task":         "photos & docs",
+		"generation":   "level1-20240115",
+	}, tags.Metadata())
+
+	manifestTags := ObjectTags{Level: -1, Task: "t"}
+	assert.Equal(t, "backup-level=manifest&task=t", manifestTags.Tagging())
+}
+
+func TestObjectPaths(t *testing.T) {
+	// Without a task prefix the layout is unchanged.
+	assert.Equal(t, "data/tank/home/level0/20240115/snapshot.part-aaaaaa.age",
+		DataPath("", "tank", "home", "level0/20240115", "snapshot.part-aaaaaa.age"))
+	assert.Equal(t, "manifests/tank/home/last_backup_manifest.yaml",
+		ManifestPath("", "tank", "home", "last_backup_manifest.yaml"))
+
+	// Two hosts backing up tank/home no longer share keys.
+	hostA := DataPath("host-a", "tank", "home", "level0/20240115", "snapshot.part-aaaaaa.age")
+	hostB := DataPath("host-b", "tank", "home", "level0/20240115", "snapshot.part-aaaaaa.age")
+	assert.Equal(t, "host-a/data/tank/home/level0/20240115/snapshot.part-aaaaaa.age", hostA)
+	assert.NotEqual(t, hostA, hostB)
+
+	assert.Equal(t, "site/host-a/manifests/tank/home/last_backup_manifest.yaml",
+		ManifestPath("site/host-a/", "tank", "home", "last_backup_manifest.yaml"))
+
+	hash := "ab" + strings.Repeat("0", 62)
+	assert.Equal(t, "host-a/chunks/0123456789abcdef/ab/"+hash, ChunkPath("host-a", "0123456789abcdef", hash))
+}
+
+func TestS3List(t *testing.T) {
+	var prefixes []string
+	s := newTestS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefixes = append(prefixes, r.URL.Query().Get("prefix"))
+		// Two pages of ListObjectsV2.
+		if r.URL.Query().Get("continuation-token") == "" {
+			fmt.Fprint(w, `<ListBucketResult><IsTruncated>true</IsTruncated><NextContinuationToken>next</NextContinuationToken>`+
+				`<Contents><Key>zfs-backups/manifests/tank/data/level0/20240115/task_manifest.yaml</Key><Size>512</Size>`+
+				`<LastModified>2024-01-15T02:03:04.000Z</LastModified><StorageClass>STANDARD</StorageClass><ETag>"e1"</ETag></Contents>`+
+				`</ListBucketResult>`)
+			return
+		}
+		fmt.Fprint(w, `<ListBucketResult><IsTruncated>false</IsTruncated>`+
+			`<Contents><Key>zfs-backups/manifests/tank/data/level1/20240116/task_manifest.yaml</Key><Size>256</Size>`+
+			`<StorageClass>GLACIER</StorageClass></Contents></ListBucketResult>`)
+	}))
+	s.prefix = "zfs-backups/"
+
+	objects, err := s.List(context.Background(), "manifests/tank/data/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"zfs-backups/manifests/tank/data/", "zfs-backups/manifests/tank/data/"}, prefixes)
+	require.Len(t, objects, 2)
+	assert.Equal(t, "manifests/tank/data/level0/20240115/task_manifest.yaml", objects[0].Key, "relative to the configured prefix")
+	assert.Equal(t, int64(512), objects[0].Size)
+	assert.Equal(t, time.Date(2024, 1, 15, 2, 3, 4, 0, time.UTC), objects[0].LastModified)
+	assert.Equal(t, `"e1"`, objects[0].ETag)
+	assert.Equal(t, "manifests/tank/data/level1/20240116/task_manifest.yaml", objects[1].Key)
+	assert.Equal(t, "GLACIER", objects[1].StorageClass)
+}
+
+func TestNewS3UploaderOptions(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	cfg := &config.Config{}
+	cfg.S3.Region = "us-east-1"
+	cfg.S3.UploadPartSizeMB = 16
+	cfg.S3.UploadConcurrency = 2
+
+	s, err := NewS3(context.Background(), OptionsFromConfig(cfg, "STANDARD"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(16<<20), s.uploader.PartSize)
+	assert.Equal(t, 2, s.uploader.Concurrency)
+	assert.Equal(t, int32(maxUploadParts), s.uploader.MaxUploadParts)
+
+	s, err = NewS3(context.Background(), OptionsFromConfig(&config.Config{}, "STANDARD"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(DefaultUploadPartSize), s.uploader.PartSize)
+	assert.Equal(t, 5, s.uploader.Concurrency)
+}
+
+func TestNewRetryer(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	for _, mode := range []string{config.RetryStandard, config.RetryAdaptive} {
+		t.Run(mode, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.S3.Region = "us-east-1"
+			cfg.S3.Retry.Mode = mode
+			cfg.S3.Retry.MaxAttempts = 6
+			cfg.S3.Retry.InitialBackoff = units.Duration(100 * time.Millisecond)
+			cfg.S3.Retry.MaxBackoff = units.Duration(30 * time.Second)
+			opts := OptionsFromConfig(cfg, "STANDARD")
+
+			retryer := newRetryer(opts)
+			if mode == config.RetryAdaptive {
+				assert.IsType(t, &retry.AdaptiveMode{}, retryer)
+			} else {
+				assert.IsType(t, &retry.Standard{}, retryer)
+			}
+			assert.Equal(t, 6, retryer.MaxAttempts())
+			for range 100 {
+				delay, err := retryer.RetryDelay(1, nil)
+				require.NoError(t, err)
+				assert.Less(t, delay, 100*time.Millisecond, "the first retry waits up to initial_backoff")
+				delay, err = retryer.RetryDelay(3, nil)
+				require.NoError(t, err)
+				assert.Less(t, delay, 400*time.Millisecond, "the bound doubles per retry")
+			}
+			delay, err := retryer.RetryDelay(20, nil)
+			require.NoError(t, err)
+			assert.Equal(t, 30*time.Second, delay, "max_backoff caps the wait")
+
+			s, err := NewS3(context.Background(), opts)
+			require.NoError(t, err)
+			assert.Equal(t, 6, s.client.Options().Retryer.MaxAttempts())
+			assert.Equal(t, aws.RetryMode(mode), retryMode(opts))
+		})
+	}
+
+	// Without an initial backoff the SDK's backoff applies, capped at max_backoff.
+	retryer := newRetryer(Options{MaxRetryBackoff: 3 * time.Second})
+	assert.Equal(t, 3, retryer.MaxAttempts())
+	delay, err := retryer.RetryDelay(10, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 3*time.Second, delay)
+}
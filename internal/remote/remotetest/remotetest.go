@@ -0,0 +1,64 @@
+// Package remotetest provides fakes of remote.Backend for the tests of the packages that read the
+// bucket.
+package remotetest
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"zrb/internal/remote"
+)
+
+// DirBackend serves S3 keys from files below Dir. Methods it does not implement panic through the
+// nil embedded Backend.
+type DirBackend struct {
+	remote.Backend
+	Dir string
+}
+
+func (b *DirBackend) Download(_ context.Context, remotePath, localPath string) error {
+	data, err := os.ReadFile(filepath.Join(b.Dir, remotePath))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(localPath, data, 0o644)
+}
+
+// Head reports a missing file as the not found error of the GCS backend, which remote.IsNotFound
+// recognizes.
+func (b *DirBackend) Head(_ context.Context, remotePath string) (*remote.ObjectInfo, error) {
+	info, err := os.Stat(filepath.Join(b.Dir, remotePath))
+	if os.IsNotExist(err) {
+		return nil, &remote.GCSError{StatusCode: http.StatusNotFound, Message: "No such object"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &remote.ObjectInfo{Key: remotePath, Size: info.Size()}, nil
+}
+
+func (b *DirBackend) List(_ context.Context, prefix string) ([]remote.ObjectInfo, error) {
+	var objects []remote.ObjectInfo
+	err := filepath.WalkDir(filepath.Join(b.Dir, prefix), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(b.Dir, path)
+		objects = append(objects, remote.ObjectInfo{Key: filepath.ToSlash(rel)})
+		return err
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return objects, err
+}
+
+func (b *DirBackend) Delete(_ context.Context, remotePath string) error {
+	return os.Remove(filepath.Join(b.Dir, remotePath))
+}
+
+func (b *DirBackend) VerifyCredentials(context.Context) error {
+	return nil
+}
@@ -0,0 +1,102 @@
+package remote
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+	"zrb/internal/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go/middleware"
+)
+
+type retryCounterKey struct{}
+
+type attemptsKey struct{}
+
+// WithRetryCounter returns a context whose S3 requests add every retried attempt to the returned counter.
+func WithRetryCounter(ctx context.Context) (context.Context, *atomic.Int64) {
+	counter := new(atomic.Int64)
+	return context.WithValue(ctx, retryCounterKey{}, counter), counter
+}
+
+// countRetries registers middleware that counts attempts per request: the initialize step runs
+// once per request, the finalize step once per attempt after the SDK's retry loop.
+func countRetries(stack *middleware.Stack) error {
+	err := stack.Initialize.Add(middleware.InitializeMiddlewareFunc("zrbCountRequests",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			if ctx.Value(retryCounterKey{}) != nil {
+				ctx = context.WithValue(ctx, attemptsKey{}, new(atomic.Int64))
+			}
+			return next.HandleInitialize(ctx, in)
+		}), middleware.Before)
+	if err != nil {
+		return err
+	}
+
+	return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("zrbCountAttempts",
+		func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+			counter, _ := ctx.Value(retryCounterKey{}).(*atomic.Int64)
+			attempts, _ := ctx.Value(attemptsKey{}).(*atomic.Int64)
+			if counter != nil && attempts != nil && attempts.Add(1) > 1 {
+				counter.Add(1)
+			}
+			return next.HandleFinalize(ctx, in)
+		}), middleware.After)
+}
+
+// newRetryer builds the retryer of s3.retry. Without an initial backoff the delays are the SDK's,
+// up to 2s for the first retry; the adaptive mode wraps the same standard retryer. Permanent errors
+// are never retried.
+func newRetryer(opts Options) aws.Retryer {
+	standard := func(o *retry.StandardOptions) {
+		if opts.MaxRetryAttempts > 0 {
+			o.MaxAttempts = opts.MaxRetryAttempts
+		}
+		o.MaxBackoff = retryMaxBackoff(opts)
+		// The first retryable with an answer decides.
+		o.Retryables = append([]retry.IsErrorRetryable{noRetryPermanent}, o.Retryables...)
+		if opts.InitialRetryBackoff > 0 {
+			o.Backoff = jitterBackoff{initial: opts.InitialRetryBackoff, max: o.MaxBackoff}
+		}
+	}
+	if retryMode(opts) == aws.RetryModeAdaptive {
+		return retry.NewAdaptiveMode(func(o *retry.AdaptiveModeOptions) {
+			o.StandardOptions = append(o.StandardOptions, standard)
+		})
+	}
+	return retry.NewStandard(standard)
+}
+
+func retryMode(opts Options) aws.RetryMode {
+	if opts.RetryMode == config.RetryAdaptive {
+		return aws.RetryModeAdaptive
+	}
+	return aws.RetryModeStandard
+}
+
+func retryMaxBackoff(opts Options) time.Duration {
+	if opts.MaxRetryBackoff > 0 {
+		return opts.MaxRetryBackoff
+	}
+	return retry.DefaultMaxBackoff
+}
+
+// jitterBackoff waits a random time up to initial before the first retry, doubling the bound for
+// each further one until it reaches max, which is then waited in full like the SDK's backoff does.
+type jitterBackoff struct {
+	initial, max time.Duration
+}
+
+func (b jitterBackoff) BackoffDelay(attempt int, _ error) (time.Duration, error) {
+	bound := b.initial
+	for i := 1; i < attempt && bound < b.max; i++ {
+		bound *= 2
+	}
+	if bound >= b.max {
+		return b.max, nil
+	}
+	return time.Duration(rand.Float64() * float64(bound)), nil
+}
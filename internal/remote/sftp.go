@@ -0,0 +1,665 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"zrb/internal/tracing"
+	"zrb/internal/util"
+
+	"github.com/pkg/sftp"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	// sftpPartialMarker is in the names of the files an upload writes before renaming them into place.
+	sftpPartialMarker = ".zrb-partial-"
+	// sftpMetaSuffix names the file next to each uploaded file that holds its metadata, the blake3
+	// hash and tags that object storage keeps with the object.
+	sftpMetaSuffix = ".zrb-meta"
+	// sftpAttempts bounds the attempts of an upload whose connection broke.
+	sftpAttempts = 3
+	// sftpPosixRename is the OpenSSH extension renaming over an existing file.
+	sftpPosixRename = "posix-rename@openssh.com"
+)
+
+// sftpDialTimeout bounds connecting, the SSH handshake and starting SFTP. Lowered by tests.
+var sftpDialTimeout = 30 * time.Second
+
+// Status codes of SSH_FXP_STATUS that Classify and IsNotFound tell apart.
+const (
+	sftpNoSuchFile       = 2
+	sftpPermissionDenied = 3
+)
+
+// SFTPError is a request the SFTP server answered with a failure status.
+type SFTPError struct {
+	Code    uint32
+	Message string
+	err     error
+}
+
+func (e *SFTPError) Error() string {
+	return fmt.Sprintf("SFTP request failed with status %d: %s", e.Code, e.Message)
+}
+
+func (e *SFTPError) Unwrap() error {
+	return e.err
+}
+
+// errSFTPClosed marks the failures of requests whose connection is gone.
+var errSFTPClosed = errors.New("SFTP connection closed")
+
+// sftpConn is an SSH connection and the SFTP session on it.
+type sftpConn struct {
+	ssh    *ssh.Client
+	client *sftp.Client
+	// closed is closed once the connection is gone.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *sftpConn) close() {
+	c.closeOnce.Do(func() { close(c.closed) })
+}
+
+func (c *sftpConn) broken() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// error turns what pkg/sftp returns for a failed request into an SFTPError, and a request lost
+// with its connection into errSFTPClosed. pkg/sftp reports a missing file and a denied permission
+// as the errors of package os, which are mapped back so that they cannot be confused with the
+// errors of local files.
+func (c *sftpConn) error(err error) error {
+	var status *sftp.StatusError
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, os.ErrNotExist):
+		return &SFTPError{Code: sftpNoSuchFile, Message: "no such file", err: err}
+	case errors.Is(err, os.ErrPermission):
+		return &SFTPError{Code: sftpPermissionDenied, Message: "permission denied", err: err}
+	case errors.As(err, &status) && status.FxCode() != sftp.ErrSSHFxConnectionLost && status.FxCode() != sftp.ErrSSHFxNoConnection:
+		return &SFTPError{Code: status.Code, Message: status.Error(), err: err}
+	case errors.Is(err, sftp.ErrSSHFxConnectionLost), errors.Is(err, sftp.ErrSSHFxNoConnection), c.broken():
+		// The next request connects again rather than waiting for the SSH client to notice.
+		c.close()
+		return fmt.Errorf("%w: %w", errSFTPClosed, err)
+	}
+	return err
+}
+
+// SFTP stores objects as files below a directory of an SSH server. Files are written under a
+// temporary name and renamed into place, so a file at its final name is always complete.
+type SFTP struct {
+	addr     string
+	config   *ssh.ClientConfig
+	basePath string
+
+	mu   sync.Mutex
+	conn *sftpConn
+}
+
+func NewSFTP(ctx context.Context, opts Options) (*SFTP, error) {
+	cfg := opts.SFTP
+	key, err := os.ReadFile(cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sftp.key_file: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse sftp.key_file %s: %w", cfg.KeyFile, err)
+	}
+	hostKeys, err := knownhosts.New(cfg.KnownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known hosts: %w", err)
+	}
+
+	s := &SFTP{
+		addr: net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		config: &ssh.ClientConfig{
+			User:            cfg.User,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeys,
+		},
+		basePath: path.Clean(opts.Prefix),
+	}
+	slog.Info("SFTP backend initialized", "addr", s.addr, "user", cfg.User, "basePath", s.basePath)
+	return s, nil
+}
+
+// sftp returns the current connection, connecting again when the last one broke.
+func (s *SFTP) sftp(ctx context.Context) (*sftpConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil && !s.conn.broken() {
+		return s.conn, nil
+	}
+	if s.conn != nil {
+		s.conn.ssh.Close()
+		s.conn = nil
+	}
+
+	dialer := net.Dialer{Timeout: sftpDialTimeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", s.addr, err)
+	}
+	// ssh.ClientConfig.Timeout only applies to ssh.Dial, so a deadline keeps a server that accepts
+	// the connection and then stalls from hanging the handshake.
+	netConn.SetDeadline(time.Now().Add(sftpDialTimeout))
+	sshConn, chans, reqs, err := ssh.NewClientConn(netConn, s.addr, s.config)
+	if err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("failed to connect to %s: %w", s.addr, err)
+	}
+	conn := &sftpConn{ssh: ssh.NewClient(sshConn, chans, reqs), closed: make(chan struct{})}
+	// Writes may be sent out of order: a failed upload never renames its temporary file into place.
+	conn.client, err = sftp.NewClient(conn.ssh, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		conn.ssh.Close()
+		return nil, fmt.Errorf("failed to start SFTP on %s: %w", s.addr, err)
+	}
+	netConn.SetDeadline(time.Time{})
+	go func() {
+		conn.ssh.Wait()
+		conn.close()
+	}()
+	s.conn = conn
+	return conn, nil
+}
+
+// Close closes the connection, if any.
+func (s *SFTP) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	s.conn.client.Close()
+	err := s.conn.ssh.Close()
+	s.conn = nil
+	return err
+}
+
+func (s *SFTP) path(remotePath string) string {
+	return path.Join(s.basePath, remotePath)
+}
+
+// relative returns p relative to the base path, like the keys of object storage.
+func (s *SFTP) relative(p string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(p, s.basePath), "/")
+}
+
+func (s *SFTP) Upload(ctx context.Context, localPath, remotePath, checksumHash string, tags ObjectTags) error {
+	ctx, span := tracing.Start(ctx, "sftp.upload", attribute.String("sftp.path", remotePath))
+	err := s.upload(ctx, localPath, remotePath, checksumHash, tags)
+	tracing.End(span, err)
+	return err
+}
+
+// upload writes the file under a temporary name and renames it into place, then writes the
+// metadata next to it. The old metadata is removed first, so a file replaced by an interrupted
+// upload has none rather than that of the file it replaced, and is uploaded again.
+func (s *SFTP) upload(ctx context.Context, localPath, remotePath, checksumHash string, tags ObjectTags) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+	name := s.path(remotePath)
+
+	metadata := tags.Metadata()
+	metadata["blake3"] = checksumHash
+	meta, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to open file: %w", err)
+		}
+		err = s.put(ctx, countingFile{File: file, transfer: transferFrom(ctx), meter: meterFrom(ctx)}, name, meta)
+		if err == nil || !errors.Is(err, errSFTPClosed) || ctx.Err() != nil || attempt >= sftpAttempts {
+			break
+		}
+		slog.Warn("SFTP connection lost during upload, retrying", "path", name, "attempt", attempt, "error", err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to upload to SFTP: %w", err)
+	}
+
+	slog.Info("Uploaded to SFTP", "addr", s.addr, "path", name)
+	return nil
+}
+
+// put writes r and then meta to name.
+func (s *SFTP) put(ctx context.Context, r io.Reader, name string, meta []byte) error {
+	conn, err := s.sftp(ctx)
+	if err != nil {
+		return err
+	}
+	client := conn.client
+	tmp, err := s.writeTemp(conn, name, r)
+	if err != nil {
+		return err
+	}
+	if err := client.Remove(name + sftpMetaSuffix); err != nil && !IsNotFound(conn.error(err)) {
+		client.Remove(tmp)
+		return fmt.Errorf("failed to remove the old metadata: %w", conn.error(err))
+	}
+	if err := s.rename(conn, tmp, name); err != nil {
+		client.Remove(tmp)
+		return fmt.Errorf("failed to rename %s into place: %w", tmp, err)
+	}
+
+	tmp, err = s.writeTemp(conn, name+sftpMetaSuffix, bytes.NewReader(meta))
+	if err != nil {
+		return fmt.Errorf("failed to write the metadata: %w", err)
+	}
+	if err := s.rename(conn, tmp, name+sftpMetaSuffix); err != nil {
+		client.Remove(tmp)
+		return fmt.Errorf("failed to write the metadata: %w", err)
+	}
+	return nil
+}
+
+// rename moves oldPath to newPath, replacing newPath. Without the posix-rename extension, which
+// replaces it atomically, newPath is removed first.
+func (s *SFTP) rename(conn *sftpConn, oldPath, newPath string) error {
+	if _, ok := conn.client.HasExtension(sftpPosixRename); ok {
+		return conn.error(conn.client.PosixRename(oldPath, newPath))
+	}
+	if err := conn.client.Remove(newPath); err != nil && !IsNotFound(conn.error(err)) {
+		return conn.error(err)
+	}
+	return conn.error(conn.client.Rename(oldPath, newPath))
+}
+
+// writeTemp writes r to a new temporary file next to name, creating the directories up to it, and
+// returns the temporary name.
+func (s *SFTP) writeTemp(conn *sftpConn, name string, r io.Reader) (string, error) {
+	var suffix [8]byte
+	rand.Read(suffix[:])
+	tmp := name + sftpPartialMarker + hex.EncodeToString(suffix[:])
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	file, err := conn.client.OpenFile(tmp, flags)
+	if IsNotFound(conn.error(err)) {
+		if err := s.mkdirAll(conn, path.Dir(name)); err != nil {
+			return "", err
+		}
+		file, err = conn.client.OpenFile(tmp, flags)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", tmp, conn.error(err))
+	}
+
+	err = file.Chmod(util.PartMode)
+	if err == nil {
+		_, err = file.ReadFrom(r)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		conn.client.Remove(tmp)
+		return "", fmt.Errorf("failed to write %s: %w", tmp, conn.error(err))
+	}
+	return tmp, nil
+}
+
+// mkdirAll creates dir and its missing parents with util.DirMode.
+func (s *SFTP) mkdirAll(conn *sftpConn, dir string) error {
+	info, err := conn.client.Stat(dir)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		return nil
+	}
+	if !IsNotFound(conn.error(err)) {
+		return fmt.Errorf("failed to stat %s: %w", dir, conn.error(err))
+	}
+	if parent := path.Dir(dir); parent != dir {
+		if err := s.mkdirAll(conn, parent); err != nil {
+			return err
+		}
+	}
+	if err := conn.client.Mkdir(dir); err != nil {
+		// Another upload may have created it meanwhile.
+		if info, statErr := conn.client.Stat(dir); statErr == nil && info.IsDir() {
+			return nil
+		}
+		return fmt.Errorf("failed to create directory %s: %w", dir, conn.error(err))
+	}
+	if err := conn.client.Chmod(dir, util.DirMode()); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dir, conn.error(err))
+	}
+	return nil
+}
+
+// Head stats the file for its size and reads its metadata. A file without metadata has no
+// Blake3, like an object uploaded by something other than zrb.
+func (s *SFTP) Head(ctx context.Context, remotePath string) (*ObjectInfo, error) {
+	name := s.path(remotePath)
+	conn, err := s.sftp(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", name, err)
+	}
+	attrs, err := conn.client.Stat(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", name, conn.error(err))
+	}
+
+	info := &ObjectInfo{Bucket: s.addr, Key: name, Size: attrs.Size(), LastModified: attrs.ModTime(), ETag: sftpETag(attrs)}
+	var meta bytes.Buffer
+	if _, err := s.read(conn, name+sftpMetaSuffix, 0, &meta); err != nil && !IsNotFound(err) {
+		return nil, fmt.Errorf("failed to read the metadata of %s: %w", name, err)
+	}
+	if meta.Len() > 0 {
+		var metadata map[string]string
+		if err := json.Unmarshal(meta.Bytes(), &metadata); err != nil {
+			return nil, fmt.Errorf("failed to read the metadata of %s: %w", name, err)
+		}
+		info.Blake3 = metadata["blake3"]
+		info.Task = metadata["task"]
+		info.Generation = metadata["generation"]
+	}
+	return info, nil
+}
+
+// sftpETag identifies the content of a file by its modification time and size, which change
+// whenever an upload replaces it.
+func sftpETag(attrs os.FileInfo) string {
+	return fmt.Sprintf("%x-%x", attrs.ModTime().Unix(), attrs.Size())
+}
+
+// read copies the file at name from offset into w. An error of w is returned as it is.
+func (s *SFTP) read(conn *sftpConn, name string, offset int64, w io.Writer) (int64, error) {
+	file, err := conn.client.Open(name)
+	if err != nil {
+		return 0, conn.error(err)
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, conn.error(err)
+	}
+	sw := &sftpWriter{w: w}
+	n, err := file.WriteTo(sw)
+	if err != nil && !errors.Is(err, sw.err) {
+		err = conn.error(err)
+	}
+	return n, err
+}
+
+// sftpWriter remembers the error of the writer, to tell it from the errors of the server.
+type sftpWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *sftpWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// List walks the directories below prefix, leaving out the temporary and metadata files of
+// uploads.
+func (s *SFTP) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := s.walk(ctx, prefix, func(name string, attrs os.FileInfo) {
+		if !strings.HasSuffix(name, sftpMetaSuffix) && !strings.Contains(path.Base(name), sftpPartialMarker) {
+			objects = append(objects, ObjectInfo{Bucket: s.addr, Key: s.relative(name), Size: attrs.Size(),
+				LastModified: attrs.ModTime(), ETag: sftpETag(attrs)})
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the files below %s: %w", s.path(prefix), err)
+	}
+	return objects, nil
+}
+
+// walk calls fn for every regular file whose path starts with prefix as a string, as keys match a
+// prefix of object storage.
+func (s *SFTP) walk(ctx context.Context, prefix string, fn func(name string, attrs os.FileInfo)) error {
+	conn, err := s.sftp(ctx)
+	if err != nil {
+		return err
+	}
+	namePrefix := s.path(prefix)
+	dir := path.Dir(namePrefix)
+	if strings.HasSuffix(prefix, "/") || prefix == "" {
+		namePrefix += "/"
+		dir = s.path(prefix)
+	}
+
+	var visit func(dir string) error
+	visit = func(dir string) error {
+		entries, err := conn.client.ReadDir(dir)
+		if err != nil {
+			if err := conn.error(err); !IsNotFound(err) {
+				return err
+			}
+			return nil
+		}
+		for _, entry := range entries {
+			name := path.Join(dir, entry.Name())
+			switch {
+			case entry.IsDir() && (strings.HasPrefix(name+"/", namePrefix) || strings.HasPrefix(namePrefix, name+"/")):
+				if err := visit(name); err != nil {
+					return err
+				}
+			case entry.Mode().IsRegular() && strings.HasPrefix(name, namePrefix):
+				fn(name, entry)
+			}
+		}
+		return nil
+	}
+	return visit(dir)
+}
+
+// Download writes the file to localPath via localPath.partial like the S3 backend, matching a
+// partial download to the file by its modification time and size.
+func (s *SFTP) Download(ctx context.Context, remotePath, localPath string) error {
+	ctx, span := tracing.Start(ctx, "sftp.download", attribute.String("sftp.path", remotePath))
+	err := s.download(ctx, remotePath, localPath)
+	tracing.End(span, err)
+	return err
+}
+
+func (s *SFTP) download(ctx context.Context, remotePath, localPath string) error {
+	name := s.path(remotePath)
+	partialPath := localPath + ".partial"
+	etagPath := partialPath + ".etag"
+
+	conn, err := s.sftp(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to download from SFTP: %w", err)
+	}
+	attrs, err := conn.client.Stat(name)
+	if err != nil {
+		return fmt.Errorf("failed to download from SFTP: failed to stat %s: %w", name, conn.error(err))
+	}
+	total, etag := attrs.Size(), sftpETag(attrs)
+
+	offset := resumeOffset(partialPath, etagPath, etag, total)
+	if offset == 0 {
+		if err := util.WriteFile(etagPath, []byte(etag)); err != nil {
+			return fmt.Errorf("failed to record download etag: %w", err)
+		}
+	} else {
+		slog.Info("Resuming partial download", "path", name, "offset", offset, "size", total)
+	}
+
+	progress := progressFrom(ctx)
+	transfer := transferFrom(ctx)
+
+	for attempt := 1; offset < total; attempt++ {
+		offset, err = s.downloadRange(ctx, name, etag, partialPath, offset, total, progress, transfer)
+		if err == nil {
+			break
+		}
+		if errors.Is(err, errSFTPChanged) {
+			os.Remove(partialPath)
+			os.Remove(etagPath)
+			return fmt.Errorf("file %s changed during download, retry to start over: %w", name, err)
+		}
+		if errors.Is(err, ErrBudgetExceeded) {
+			return fmt.Errorf("download of %s stopped (partial download kept at %d/%d bytes): %w", name, offset, total, err)
+		}
+		if ctx.Err() != nil || attempt >= downloadAttempts {
+			return fmt.Errorf("failed to download from SFTP (partial download kept at %d/%d bytes): %w", offset, total, err)
+		}
+		slog.Warn("Download interrupted, resuming", "path", name, "offset", offset, "attempt", attempt, "error", err)
+	}
+
+	if total == 0 {
+		if err := util.WritePart(partialPath, nil); err != nil {
+			return fmt.Errorf("failed to create local file: %w", err)
+		}
+	}
+
+	if err := os.Rename(partialPath, localPath); err != nil {
+		return fmt.Errorf("failed to move completed download into place: %w", err)
+	}
+	os.Remove(etagPath)
+
+	slog.Info("Downloaded from SFTP", "addr", s.addr, "path", name, "bytes", total)
+	return nil
+}
+
+// errSFTPChanged is a file replaced while it was being downloaded.
+var errSFTPChanged = errors.New("file changed")
+
+// downloadRange appends bytes from offset to the partial file and returns the new offset, even on
+// error. It reconnects when the last attempt lost the connection.
+func (s *SFTP) downloadRange(ctx context.Context, name, etag, partialPath string, offset, total int64, progress ProgressFunc, transfer *Transfer) (int64, error) {
+	conn, err := s.sftp(ctx)
+	if err != nil {
+		return offset, err
+	}
+	attrs, err := conn.client.Stat(name)
+	if err != nil {
+		return offset, conn.error(err)
+	}
+	if sftpETag(attrs) != etag {
+		return offset, errSFTPChanged
+	}
+
+	file, err := util.OpenPart(partialPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		return offset, fmt.Errorf("failed to create local file: %w", err)
+	}
+
+	w := &progressWriter{w: file, done: offset, total: total, progress: progress, transfer: transfer, meter: meterFrom(ctx)}
+	_, readErr := s.read(conn, name, offset, w)
+	closeErr := file.Close()
+
+	if readErr != nil {
+		return w.done, readErr
+	}
+	if closeErr != nil {
+		return w.done, closeErr
+	}
+	if w.done != total {
+		return w.done, fmt.Errorf("download ended at %d of %d bytes", w.done, total)
+	}
+	return w.done, nil
+}
+
+// Delete removes the file and its metadata, then the directories it leaves empty up to the base
+// path. A file that does not exist is not an error, as with S3.
+func (s *SFTP) Delete(ctx context.Context, remotePath string) error {
+	name := s.path(remotePath)
+	conn, err := s.sftp(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to delete %s: %w", name, err)
+	}
+	for _, p := range []string{name + sftpMetaSuffix, name} {
+		if err := conn.error(conn.client.Remove(p)); err != nil && !IsNotFound(err) {
+			return fmt.Errorf("failed to delete %s: %w", p, err)
+		}
+	}
+	for dir := path.Dir(name); dir != s.basePath && strings.HasPrefix(dir, s.basePath+"/"); dir = path.Dir(dir) {
+		if conn.client.RemoveDirectory(dir) != nil {
+			break
+		}
+	}
+
+	slog.Info("Deleted from SFTP", "addr", s.addr, "path", name)
+	return nil
+}
+
+// VerifyCredentials connects, which checks the host key and the user's key, and stats the base
+// path.
+func (s *SFTP) VerifyCredentials(ctx context.Context) error {
+	slog.Info("Verifying SFTP access", "addr", s.addr, "basePath", s.basePath)
+
+	conn, err := s.sftp(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to verify SFTP access: %w", err)
+	}
+	attrs, err := conn.client.Stat(s.basePath)
+	if err != nil {
+		return fmt.Errorf("failed to verify SFTP access to %s: %w", s.basePath, conn.error(err))
+	}
+	if !attrs.IsDir() {
+		return fmt.Errorf("sftp.base_path %s is not a directory", s.basePath)
+	}
+
+	slog.Info("SFTP access verified successfully", "addr", s.addr)
+	return nil
+}
+
+// AbortIncompleteUploads removes the temporary files that interrupted uploads left below prefix,
+// like the multipart uploads of S3.
+func (s *SFTP) AbortIncompleteUploads(ctx context.Context, prefix string, olderThan time.Duration) (int, error) {
+	cutoff := time.Now().Add(-olderThan)
+	var stale []string
+	err := s.walk(ctx, prefix, func(name string, attrs os.FileInfo) {
+		if strings.Contains(path.Base(name), sftpPartialMarker) && attrs.ModTime().Before(cutoff) {
+			stale = append(stale, name)
+		}
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list the files below %s: %w", s.path(prefix), err)
+	}
+
+	conn, err := s.sftp(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for i, name := range stale {
+		if err := conn.error(conn.client.Remove(name)); err != nil && !IsNotFound(err) {
+			return i, fmt.Errorf("failed to remove %s: %w", name, err)
+		}
+		slog.Info("Removed incomplete SFTP upload", "path", name)
+	}
+	return len(stale), nil
+}
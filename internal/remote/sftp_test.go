@@ -0,0 +1,370 @@
+package remote
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"zrb/internal/config"
+	"zrb/internal/util"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpServer is an SSH server on localhost whose sftp subsystem serves the local file system.
+type sftpServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	mu       sync.Mutex
+	conns    []net.Conn
+}
+
+// newSFTPServer starts a server accepting the key of the returned options, whose known hosts
+// file holds the server's key.
+func newSFTPServer(t *testing.T) (*sftpServer, Options) {
+	t.Helper()
+	dir := t.TempDir()
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	require.NoError(t, err)
+	userPublic, userKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	userSSHPublic, err := ssh.NewPublicKey(userPublic)
+	require.NoError(t, err)
+
+	srv := &sftpServer{config: &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(userSSHPublic.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}}
+	srv.config.AddHostKey(hostSigner)
+	srv.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		srv.listener.Close()
+		srv.dropConnections()
+	})
+	go srv.serve()
+
+	block, err := ssh.MarshalPrivateKey(userKey, "")
+	require.NoError(t, err)
+	keyFile := filepath.Join(dir, "id_ed25519")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(block), 0o600))
+	addr := srv.listener.Addr().(*net.TCPAddr)
+	knownHosts := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr.String())}, hostSigner.PublicKey())
+	require.NoError(t, os.WriteFile(knownHosts, []byte(line+"\n"), 0o644))
+
+	base := filepath.Join(dir, "backups")
+	require.NoError(t, os.Mkdir(base, 0o755))
+	return srv, Options{Backend: config.BackendSFTP, Prefix: base, SFTP: config.SFTPConfig{
+		Enabled: true, Host: "127.0.0.1", Port: addr.Port, User: "zrb", KeyFile: keyFile, KnownHostsFile: knownHosts, BasePath: base,
+	}}
+}
+
+func (srv *sftpServer) serve() {
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			return
+		}
+		srv.mu.Lock()
+		srv.conns = append(srv.conns, conn)
+		srv.mu.Unlock()
+		go srv.handle(conn)
+	}
+}
+
+// dropConnections closes every connection, as a network failure would.
+func (srv *sftpServer) dropConnections() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, conn := range srv.conns {
+		conn.Close()
+	}
+	srv.conns = nil
+}
+
+func (srv *sftpServer) handle(conn net.Conn) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, srv.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		channel, requests, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					go func() {
+						if server, err := sftp.NewServer(channel); err == nil {
+							server.Serve()
+						}
+						channel.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+func newTestSFTP(t *testing.T, opts Options) *SFTP {
+	t.Helper()
+	s, err := NewSFTP(context.Background(), opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestSFTPUploadHeadDownload(t *testing.T) {
+	_, opts := newSFTPServer(t)
+	s := newTestSFTP(t, opts)
+	ctx := context.Background()
+	require.NoError(t, s.VerifyCredentials(ctx))
+
+	// Many requests of 32 KiB, the last one short.
+	data := make([]byte, 3<<20+1234)
+	rand.Read(data)
+	local := filepath.Join(t.TempDir(), "part.age")
+	require.NoError(t, os.WriteFile(local, data, 0o600))
+
+	key := "data/tank/data/level0/20240101/aaaaaa.age"
+	require.NoError(t, s.Upload(ctx, local, key, "hash", ObjectTags{Level: 0, Task: "data", Generation: "level0-20240101"}))
+
+	name := filepath.Join(opts.Prefix, key)
+	stored, err := os.ReadFile(name)
+	require.NoError(t, err)
+	assert.Equal(t, data, stored)
+	info, err := os.Stat(name)
+	require.NoError(t, err)
+	assert.Equal(t, util.PartMode, info.Mode().Perm())
+	entries, err := os.ReadDir(filepath.Dir(name))
+	require.NoError(t, err)
+	assert.Len(t, entries, 2, "only the file and its metadata are left")
+
+	head, err := s.Head(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), head.Size)
+	assert.Equal(t, "hash", head.Blake3)
+	assert.Equal(t, "data", head.Task)
+	assert.Equal(t, "level0-20240101", head.Generation)
+	assert.NotEmpty(t, head.ETag)
+	assert.NoError(t, head.Accessible())
+
+	downloaded := filepath.Join(t.TempDir(), "downloaded.age")
+	require.NoError(t, s.Download(ctx, key, downloaded))
+	got, err := os.ReadFile(downloaded)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	assert.NoFileExists(t, downloaded+".partial.etag")
+
+	_, err = s.Head(ctx, "data/missing.age")
+	assert.True(t, IsNotFound(err), "%v", err)
+	assert.Error(t, s.Download(ctx, "data/missing.age", filepath.Join(t.TempDir(), "missing")))
+}
+
+func TestSFTPDownloadResumes(t *testing.T) {
+	_, opts := newSFTPServer(t)
+	s := newTestSFTP(t, opts)
+	ctx := context.Background()
+
+	data := []byte(strings.Repeat("0123456789", 10000))
+	local := filepath.Join(t.TempDir(), "part.age")
+	require.NoError(t, os.WriteFile(local, data, 0o600))
+	require.NoError(t, s.Upload(ctx, local, "part.age", "hash", ObjectTags{}))
+	head, err := s.Head(ctx, "part.age")
+	require.NoError(t, err)
+
+	downloaded := filepath.Join(t.TempDir(), "downloaded.age")
+	require.NoError(t, os.WriteFile(downloaded+".partial", data[:4321], 0o600))
+	require.NoError(t, os.WriteFile(downloaded+".partial.etag", []byte(head.ETag), 0o600))
+	require.NoError(t, s.Download(ctx, "part.age", downloaded))
+	got, err := os.ReadFile(downloaded)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestSFTPUploadReplaces(t *testing.T) {
+	for _, posixRename := range []bool{true, false} {
+		_, opts := newSFTPServer(t)
+		// Servers other than OpenSSH lack the posix-rename extension.
+		if !posixRename {
+			require.NoError(t, sftp.SetSFTPExtensions("statvfs@openssh.com"))
+			t.Cleanup(func() { sftp.SetSFTPExtensions("hardlink@openssh.com", sftpPosixRename, "statvfs@openssh.com") })
+		}
+		s := newTestSFTP(t, opts)
+		ctx := context.Background()
+		local := filepath.Join(t.TempDir(), "last_backup_manifest.yaml")
+
+		require.NoError(t, os.WriteFile(local, []byte("old"), 0o600))
+		require.NoError(t, s.Upload(ctx, local, "manifests/last_backup_manifest.yaml", "old-hash", ObjectTags{Level: -1}))
+		require.NoError(t, os.WriteFile(local, []byte("newer"), 0o600))
+		require.NoError(t, s.Upload(ctx, local, "manifests/last_backup_manifest.yaml", "new-hash", ObjectTags{Level: -1}))
+
+		stored, err := os.ReadFile(filepath.Join(opts.Prefix, "manifests", "last_backup_manifest.yaml"))
+		require.NoError(t, err)
+		assert.Equal(t, "newer", string(stored), "posix-rename %v", posixRename)
+		head, err := s.Head(ctx, "manifests/last_backup_manifest.yaml")
+		require.NoError(t, err)
+		assert.Equal(t, "new-hash", head.Blake3)
+	}
+}
+
+func TestSFTPUploadFailureLeavesNothing(t *testing.T) {
+	_, opts := newSFTPServer(t)
+	s := newTestSFTP(t, opts)
+	local := filepath.Join(t.TempDir(), "part.age")
+	require.NoError(t, os.WriteFile(local, make([]byte, 1<<20), 0o600))
+
+	// The budget stops the upload halfway through the file.
+	ctx := WithTransfer(context.Background(), NewTransfer(Budget{MaxUploadBytes: 512 << 10}))
+	err := s.Upload(ctx, local, "data/part.age", "hash", ObjectTags{})
+	assert.ErrorIs(t, err, ErrBudgetExceeded)
+	entries, err := os.ReadDir(filepath.Join(opts.Prefix, "data"))
+	require.NoError(t, err)
+	assert.Empty(t, entries, "the temporary file is removed")
+	_, err = s.Head(ctx, "data/part.age")
+	assert.True(t, IsNotFound(err))
+}
+
+func TestSFTPListAndDelete(t *testing.T) {
+	_, opts := newSFTPServer(t)
+	s := newTestSFTP(t, opts)
+	ctx := context.Background()
+	local := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(local, []byte("data"), 0o600))
+	for _, key := range []string{
+		"manifests/tank/data/level0/20240101/task_manifest.yaml",
+		"manifests/tank/data/level1/20240102/task_manifest.yaml",
+		"manifests/tank/database/level0/20240101/task_manifest.yaml",
+		"data/tank/data/level0/20240101/aaaaaa.age",
+	} {
+		require.NoError(t, s.Upload(ctx, local, key, "hash", ObjectTags{}))
+	}
+	stale := filepath.Join(opts.Prefix, "data/tank/data/level0/20240101/aaaaab.age"+sftpPartialMarker+"1234")
+	require.NoError(t, os.WriteFile(stale, []byte("da"), 0o600))
+
+	keys := func(prefix string) []string {
+		objects, err := s.List(ctx, prefix)
+		require.NoError(t, err)
+		var keys []string
+		for _, object := range objects {
+			keys = append(keys, object.Key)
+		}
+		return keys
+	}
+	assert.ElementsMatch(t, []string{
+		"manifests/tank/data/level0/20240101/task_manifest.yaml",
+		"manifests/tank/data/level1/20240102/task_manifest.yaml",
+	}, keys("manifests/tank/data/"))
+	assert.Len(t, keys("manifests/tank/data"), 3, "a prefix matches like a string")
+	assert.Equal(t, []string{"data/tank/data/level0/20240101/aaaaaa.age"}, keys("data/"))
+	assert.Empty(t, keys("anchors/"))
+
+	aborted, err := s.AbortIncompleteUploads(ctx, "data/", time.Hour)
+	require.NoError(t, err)
+	assert.Zero(t, aborted, "recent uploads may still be running")
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(stale, old, old))
+	aborted, err = s.AbortIncompleteUploads(ctx, "data/", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 1, aborted)
+	assert.NoFileExists(t, stale)
+
+	deleted, err := DeletePrefix(ctx, s, "manifests/tank/data/")
+	require.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+	assert.NoDirExists(t, filepath.Join(opts.Prefix, "manifests/tank/data"), "empty directories are removed")
+	assert.FileExists(t, filepath.Join(opts.Prefix, "manifests/tank/database/level0/20240101/task_manifest.yaml"))
+	assert.NoError(t, s.Delete(ctx, "manifests/tank/data/level0/20240101/task_manifest.yaml"), "a missing file is deleted already")
+	assert.DirExists(t, opts.Prefix)
+}
+
+func TestSFTPReconnects(t *testing.T) {
+	srv, opts := newSFTPServer(t)
+	s := newTestSFTP(t, opts)
+	ctx := context.Background()
+	require.NoError(t, s.VerifyCredentials(ctx))
+
+	srv.dropConnections()
+	// The first request after the drop may find the connection gone; the next one reconnects.
+	s.VerifyCredentials(ctx)
+	require.NoError(t, s.VerifyCredentials(ctx))
+
+	local := filepath.Join(t.TempDir(), "part.age")
+	require.NoError(t, os.WriteFile(local, []byte("data"), 0o600))
+	srv.dropConnections()
+	require.NoError(t, s.Upload(ctx, local, "part.age", "hash", ObjectTags{}))
+}
+
+func TestSFTPRejectsUnknownHostKey(t *testing.T) {
+	_, opts := newSFTPServer(t)
+	_, other := newSFTPServer(t)
+	opts.SFTP.KnownHostsFile = other.SFTP.KnownHostsFile
+	s := newTestSFTP(t, opts)
+	err := s.VerifyCredentials(context.Background())
+	assert.ErrorContains(t, err, "knownhosts")
+}
+
+func TestSFTPHandshakeTimesOut(t *testing.T) {
+	_, opts := newSFTPServer(t)
+	// A server that accepts connections and never replies.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	opts.SFTP.Port = listener.Addr().(*net.TCPAddr).Port
+
+	oldTimeout := sftpDialTimeout
+	sftpDialTimeout = 100 * time.Millisecond
+	defer func() { sftpDialTimeout = oldTimeout }()
+
+	s := newTestSFTP(t, opts)
+	start := time.Now()
+	err = s.VerifyCredentials(context.Background())
+	assert.ErrorContains(t, err, "i/o timeout")
+	assert.Less(t, time.Since(start), 5*time.Second)
+	(<-accepted).Close()
+}
+
+func TestOptionsFromConfigSFTP(t *testing.T) {
+	cfg := &config.Config{SFTP: config.SFTPConfig{Enabled: true, Host: "backup.example.com", User: "zrb", KeyFile: "/etc/zrb/id_ed25519", BasePath: "/srv/zrb"}}
+	opts := OptionsFromConfig(cfg, cfg.ManifestStorageClass())
+	assert.Equal(t, config.BackendSFTP, opts.Backend)
+	assert.Equal(t, "zrb@backup.example.com:22", opts.Bucket)
+	assert.Equal(t, "/srv/zrb", opts.Prefix)
+	assert.Equal(t, 22, opts.SFTP.Port)
+	assert.Equal(t, cfg.SFTPKnownHostsFile(), opts.SFTP.KnownHostsFile)
+}
@@ -0,0 +1,51 @@
+package remote
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// ObjectTags identify the task and backup generation an uploaded object belongs to.
+type ObjectTags struct {
+	// Level is the backup level, negative for manifests.
+	Level int16
+	Task  string
+	// Generation is stable across resumed runs, e.g. level0-20240115.
+	Generation string
+}
+
+// GenerationFromTaskDir derives the generation from a task directory name such as level0/20240115.
+func GenerationFromTaskDir(taskDirName string) string {
+	return strings.ReplaceAll(filepath.ToSlash(taskDirName), "/", "-")
+}
+
+func (t ObjectTags) values() map[string]string {
+	v := map[string]string{"backup-level": "manifest"}
+	if t.Level >= 0 {
+		v["backup-level"] = fmt.Sprint(t.Level)
+	}
+	if t.Task != "" {
+		v["task"] = t.Task
+	}
+	if t.Generation != "" {
+		v["generation"] = t.Generation
+	}
+	return v
+}
+
+// Tagging encodes the tags as an S3 Tagging header value.
+func (t ObjectTags) Tagging() string {
+	q := url.Values{}
+	for k, v := range t.values() {
+		q.Set(k, v)
+	}
+	// S3 does not decode '+' as a space in tag values.
+	return strings.ReplaceAll(q.Encode(), "+", "%20")
+}
+
+// Metadata returns the tags as object metadata, for backends that ignore tagging.
+func (t ObjectTags) Metadata() map[string]string {
+	return t.values()
+}
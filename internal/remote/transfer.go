@@ -0,0 +1,166 @@
+package remote
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"zrb/internal/config"
+)
+
+// ErrBudgetExceeded stops the transfers of a run that moved more bytes than its budget allows.
+var ErrBudgetExceeded = errors.New("S3 transfer budget exceeded")
+
+// Directions of a transfer, as passed to an ExceededFunc.
+const (
+	DirectionUpload   = "upload"
+	DirectionDownload = "download"
+)
+
+// ExceededFunc decides whether a run may go on after transferring more than limit bytes in
+// direction. It is called once per direction, with the other transfers of the run waiting for it.
+type ExceededFunc func(direction string, limit, transferred int64) error
+
+// Budget bounds the bytes of one run; a zero limit means none.
+type Budget struct {
+	MaxUploadBytes   int64
+	MaxDownloadBytes int64
+	Exceeded         ExceededFunc
+}
+
+// Transfer counts the bytes a run uploads to and downloads from S3 and enforces its budget. It is
+// safe for concurrent use; a nil Transfer counts nothing.
+type Transfer struct {
+	upload, download counter
+	exceeded         ExceededFunc
+}
+
+type counter struct {
+	direction string
+	limit     int64
+	bytes     atomic.Int64
+	once      sync.Once
+	err       error
+}
+
+func NewTransfer(b Budget) *Transfer {
+	t := &Transfer{exceeded: b.Exceeded}
+	t.upload.direction, t.upload.limit = DirectionUpload, b.MaxUploadBytes
+	t.download.direction, t.download.limit = DirectionDownload, b.MaxDownloadBytes
+	if t.exceeded == nil {
+		t.exceeded = FailBudget
+	}
+	return t
+}
+
+// Uploaded returns the bytes the uploader has read from local files, retries included.
+func (t *Transfer) Uploaded() int64 {
+	if t == nil {
+		return 0
+	}
+	return t.upload.bytes.Load()
+}
+
+// Downloaded returns the bytes received from S3, retries included.
+func (t *Transfer) Downloaded() int64 {
+	if t == nil {
+		return 0
+	}
+	return t.download.bytes.Load()
+}
+
+func (t *Transfer) addUpload(n int) error {
+	if t == nil {
+		return nil
+	}
+	return t.upload.add(int64(n), t.exceeded)
+}
+
+func (t *Transfer) addDownload(n int) error {
+	if t == nil {
+		return nil
+	}
+	return t.download.add(int64(n), t.exceeded)
+}
+
+// add counts n bytes and returns the decision of exceeded once the limit is crossed. Concurrent
+// transfers block in once.Do until the first one crossing the limit has its answer.
+func (c *counter) add(n int64, exceeded ExceededFunc) error {
+	total := c.bytes.Add(n)
+	if c.limit <= 0 || total <= c.limit {
+		return nil
+	}
+	c.once.Do(func() { c.err = exceeded(c.direction, c.limit, total) })
+	return c.err
+}
+
+type transferKey struct{}
+
+// WithTransfer returns a context whose uploads and downloads are counted by t.
+func WithTransfer(ctx context.Context, t *Transfer) context.Context {
+	return context.WithValue(ctx, transferKey{}, t)
+}
+
+func transferFrom(ctx context.Context) *Transfer {
+	t, _ := ctx.Value(transferKey{}).(*Transfer)
+	return t
+}
+
+// FailBudget stops the run, which resumes where it stopped when run again with --acknowledge-cost.
+func FailBudget(direction string, limit, transferred int64) error {
+	return fmt.Errorf("%w: %sed %d bytes, over the limit of %d; run again with --acknowledge-cost to continue",
+		ErrBudgetExceeded, direction, transferred, limit)
+}
+
+// Replaced by tests.
+var (
+	promptInput     io.Reader = os.Stdin
+	promptOutput    io.Writer = os.Stdout
+	stdinIsTerminal           = func() bool {
+		info, err := os.Stdin.Stat()
+		return err == nil && info.Mode()&os.ModeCharDevice != 0
+	}
+)
+
+// BudgetPolicy returns the ExceededFunc for s3.on_budget_exceeded. An acknowledged cost only
+// logs; pause asks on the terminal and fails without one, as unattended runs have nobody to ask.
+func BudgetPolicy(action string, acknowledged bool) ExceededFunc {
+	return func(direction string, limit, transferred int64) error {
+		if acknowledged {
+			slog.Warn("S3 transfer budget exceeded, continuing as acknowledged", "direction", direction, "limit", limit, "bytes", transferred)
+			return nil
+		}
+		if action == config.BudgetFail || !stdinIsTerminal() {
+			return FailBudget(direction, limit, transferred)
+		}
+
+		fmt.Fprintf(promptOutput, "\nThis run has %sed %d bytes, over the S3 budget of %d.\nContinue anyway? [y/N]: ", direction, transferred, limit)
+		answer, err := bufio.NewReader(promptInput).ReadString('\n')
+		if err != nil && answer == "" {
+			return FailBudget(direction, limit, transferred)
+		}
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			return FailBudget(direction, limit, transferred)
+		}
+		slog.Warn("S3 transfer budget exceeded, continuing as confirmed", "direction", direction, "limit", limit, "bytes", transferred)
+		return nil
+	}
+}
+
+// BudgetFromConfig is the budget of a backup (uploads) or restore (downloads).
+func BudgetFromConfig(cfg *config.Config, direction string, acknowledged bool) Budget {
+	b := Budget{Exceeded: BudgetPolicy(cfg.S3.OnBudgetExceeded, acknowledged)}
+	switch direction {
+	case DirectionUpload:
+		b.MaxUploadBytes = int64(cfg.S3.MaxUploadBytesPerBackup)
+	case DirectionDownload:
+		b.MaxDownloadBytes = int64(cfg.S3.MaxDownloadBytesPerRestore)
+	}
+	return b
+}
@@ -0,0 +1,132 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"zrb/internal/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransferCountsConcurrently(t *testing.T) {
+	transfer := NewTransfer(Budget{})
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				assert.NoError(t, transfer.addUpload(3))
+				assert.NoError(t, transfer.addDownload(7))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(50*100*3), transfer.Uploaded())
+	assert.Equal(t, int64(50*100*7), transfer.Downloaded())
+
+	var none *Transfer
+	assert.NoError(t, none.addUpload(1))
+	assert.Zero(t, none.Uploaded())
+}
+
+func TestTransferBudgetDecidesOnce(t *testing.T) {
+	var calls atomic.Int32
+	transfer := NewTransfer(Budget{MaxDownloadBytes: 1000, Exceeded: func(direction string, limit, transferred int64) error {
+		calls.Add(1)
+		assert.Equal(t, DirectionDownload, direction)
+		assert.Equal(t, int64(1000), limit)
+		assert.Greater(t, transferred, limit)
+		return FailBudget(direction, limit, transferred)
+	}})
+
+	var wg sync.WaitGroup
+	var refused atomic.Int32
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := transfer.addDownload(100); errors.Is(err, ErrBudgetExceeded) {
+				refused.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), calls.Load())
+	assert.Equal(t, int32(10), refused.Load(), "every transfer past the limit is refused")
+	assert.NoError(t, transfer.addUpload(1<<30), "uploads have no limit")
+}
+
+func TestDownloadStopsAtBudget(t *testing.T) {
+	srv := &rangeServer{content: randomContent(t, 256*1024), etag: `"v1"`}
+	s := newTestS3(t, srv)
+	transfer := NewTransfer(Budget{MaxDownloadBytes: 1000})
+
+	local := filepath.Join(t.TempDir(), "part.age")
+	err := s.Download(WithTransfer(context.Background(), transfer), "data/part.age", local)
+	require.ErrorIs(t, err, ErrBudgetExceeded)
+	assert.Contains(t, err.Error(), "--acknowledge-cost")
+	assert.Empty(t, srv.ranges, "a refused download is not resumed")
+	assert.Greater(t, transfer.Downloaded(), int64(1000))
+
+	info, statErr := os.Stat(local + ".partial")
+	require.NoError(t, statErr, "the partial download is kept for the acknowledged run")
+	assert.Equal(t, transfer.Downloaded(), info.Size())
+
+	transfer = NewTransfer(Budget{MaxDownloadBytes: 1000, Exceeded: BudgetPolicy(config.BudgetFail, true)})
+	require.NoError(t, s.Download(WithTransfer(context.Background(), transfer), "data/part.age", local))
+	assert.Equal(t, int64(len(srv.content))-info.Size(), transfer.Downloaded())
+}
+
+func TestUploadCountsAndStopsAtBudget(t *testing.T) {
+	s := newTestS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("ETag", `"v1"`)
+	}))
+
+	local := filepath.Join(t.TempDir(), "part.age")
+	require.NoError(t, os.WriteFile(local, randomContent(t, 64*1024), 0o644))
+
+	transfer := NewTransfer(Budget{MaxUploadBytes: 1 << 20})
+	require.NoError(t, s.Upload(WithTransfer(context.Background(), transfer), local, "data/part.age", "hash", ObjectTags{}))
+	assert.GreaterOrEqual(t, transfer.Uploaded(), int64(64*1024))
+
+	transfer = NewTransfer(Budget{MaxUploadBytes: 1000})
+	err := s.Upload(WithTransfer(context.Background(), transfer), local, "data/part.age", "hash", ObjectTags{})
+	require.ErrorIs(t, err, ErrBudgetExceeded)
+}
+
+func TestBudgetPolicy(t *testing.T) {
+	terminal := true
+	var output bytes.Buffer
+	oldInput, oldOutput, oldTerminal := promptInput, promptOutput, stdinIsTerminal
+	promptOutput = &output
+	stdinIsTerminal = func() bool { return terminal }
+	t.Cleanup(func() { promptInput, promptOutput, stdinIsTerminal = oldInput, oldOutput, oldTerminal })
+
+	assert.NoError(t, BudgetPolicy(config.BudgetFail, true)(DirectionUpload, 10, 20), "acknowledged")
+	assert.ErrorIs(t, BudgetPolicy(config.BudgetFail, false)(DirectionUpload, 10, 20), ErrBudgetExceeded)
+
+	promptInput = strings.NewReader("y\n")
+	assert.NoError(t, BudgetPolicy(config.BudgetPause, false)(DirectionDownload, 10, 20))
+	assert.Contains(t, output.String(), "This run has downloaded 20 bytes, over the S3 budget of 10.")
+
+	promptInput = strings.NewReader("\n")
+	assert.ErrorIs(t, BudgetPolicy(config.BudgetPause, false)(DirectionDownload, 10, 20), ErrBudgetExceeded)
+
+	terminal = false
+	promptInput = strings.NewReader("y\n")
+	err := BudgetPolicy(config.BudgetPause, false)(DirectionDownload, 10, 20)
+	assert.ErrorIs(t, err, ErrBudgetExceeded, "nobody to ask without a terminal")
+	assert.EqualError(t, err, "S3 transfer budget exceeded: downloaded 20 bytes, over the limit of 10; run again with --acknowledge-cost to continue")
+}
@@ -0,0 +1,154 @@
+// Package repair rebuilds the last backup manifest of a task in the bucket from the task manifests
+// stored there, for when its upload failed or an older zrb never uploaded it.
+package repair
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"zrb/internal/config"
+	"zrb/internal/crypto"
+	"zrb/internal/list"
+	"zrb/internal/manifest"
+	"zrb/internal/remote"
+)
+
+// Options of zrb repair-index.
+type Options struct {
+	ConfigPath string
+	TaskName   string
+	// DryRun prints the rebuilt last backup manifest without uploading it.
+	DryRun bool
+	// Force replaces a last backup manifest that exists in the bucket.
+	Force bool
+}
+
+// Replaced by tests.
+var output io.Writer = os.Stdout
+
+// Run scans the bucket for the task manifests of the task, prints the last backup manifest they
+// make up and uploads it in place of the missing one.
+func Run(ctx context.Context, opts Options) error {
+	cfg, err := config.Load(opts.ConfigPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	task, err := cfg.FindTask(opts.TaskName)
+	if err != nil {
+		return err
+	}
+	if !cfg.RemoteEnabled() {
+		return config.ErrNoRemote
+	}
+	if !cfg.Uploads(task) {
+		return fmt.Errorf("task %s does not upload, so the bucket holds no backups of it", task.Name)
+	}
+
+	backend, err := remote.DefaultCache.Get(ctx, remote.OptionsFromConfig(cfg, cfg.ManifestStorageClass()))
+	if err != nil {
+		return fmt.Errorf("failed to initialize S3 backend: %w", err)
+	}
+	if err := backend.VerifyCredentials(ctx); err != nil {
+		return fmt.Errorf("credentials verification failed: %w", err)
+	}
+
+	remotePath := remote.ManifestPath(task.S3Prefix, task.Pool, task.Dataset, "last_backup_manifest.yaml")
+	_, err = backend.Head(ctx, remotePath)
+	switch {
+	case err == nil && !opts.Force && !opts.DryRun:
+		return fmt.Errorf("last backup manifest %s exists; pass --force to replace it with the rebuilt one", remotePath)
+	case err != nil && !remote.IsNotFound(err):
+		return fmt.Errorf("failed to check for the last backup manifest: %w", err)
+	}
+
+	scanned, err := list.Scan(ctx, backend, task)
+	if err != nil {
+		return fmt.Errorf("failed to scan the bucket: %w", err)
+	}
+	last, err := Rebuild(task, scanned)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp("", "last_backup_manifest_*.yaml")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := manifest.WriteLast(tmp.Name(), last); err != nil {
+		return fmt.Errorf("failed to write last backup manifest: %w", err)
+	}
+	data, err := os.ReadFile(tmp.Name())
+	if err != nil {
+		return err
+	}
+	if _, err := output.Write(data); err != nil {
+		return err
+	}
+	if opts.DryRun {
+		return nil
+	}
+
+	hash, err := crypto.BLAKE3File(tmp.Name())
+	if err != nil {
+		return fmt.Errorf("failed to calculate BLAKE3 for last backup manifest: %w", err)
+	}
+	if err := backend.Upload(ctx, tmp.Name(), remotePath, hash, remote.ObjectTags{Level: -1, Task: task.Name}); err != nil {
+		return fmt.Errorf("failed to upload last backup manifest: %w", err)
+	}
+	slog.Info("Uploaded rebuilt last backup manifest", "remote", remotePath, "levels", len(last.BackupLevels))
+	return nil
+}
+
+// Rebuild returns the last backup manifest that a run of backups leaves behind: the newest level 0,
+// and for each level above it the newest backup of the same generation. A level 0 drops the levels
+// above it, so backups older than the level 0 belong to an earlier generation even when their
+// manifests predate generation IDs.
+func Rebuild(task *config.Task, scanned []list.Scanned) (*manifest.Last, error) {
+	last := &manifest.Last{Pool: task.Pool, Dataset: task.Dataset}
+	var base *manifest.Backup
+	for _, s := range scanned {
+		m := s.Manifest
+		if m.Legacy {
+			continue
+		}
+		if m.BackupLevel > 0 {
+			if base == nil || !sameGeneration(base, m) {
+				continue
+			}
+		} else {
+			// A new level 0 starts over.
+			base = m
+			last.IncrementalMode = m.IncrementalMode
+			last.BackupLevels = nil
+		}
+		for len(last.BackupLevels) <= int(m.BackupLevel) {
+			last.BackupLevels = append(last.BackupLevels, nil)
+		}
+		last.BackupLevels[m.BackupLevel] = &manifest.Ref{
+			Datetime:     m.Datetime,
+			Snapshot:     m.TargetSnapshot,
+			Blake3Hash:   m.Blake3Hash,
+			S3Path:       s.S3Path,
+			GenerationID: m.GenerationID,
+		}
+	}
+	if base == nil {
+		return nil, errors.New("no complete level 0 backup found in the bucket")
+	}
+	if err := last.ValidatePaths(); err != nil {
+		return nil, err
+	}
+	return last, nil
+}
+
+func sameGeneration(base, m *manifest.Backup) bool {
+	if base.GenerationID != "" && m.GenerationID != "" {
+		return base.GenerationID == m.GenerationID
+	}
+	return m.Datetime >= base.Datetime
+}
@@ -0,0 +1,126 @@
+package repair
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"zrb/internal/config"
+	"zrb/internal/list"
+	"zrb/internal/manifest"
+	"zrb/internal/remote"
+	"zrb/internal/remote/remotetest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bucketBackend is a bucket of files below Dir that records the hashes of its uploads.
+type bucketBackend struct {
+	*remotetest.DirBackend
+	uploaded map[string]string
+}
+
+func (b *bucketBackend) Upload(_ context.Context, localPath, remotePath, checksumHash string, _ remote.ObjectTags) error {
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		return err
+	}
+	b.uploaded[remotePath] = checksumHash
+	return os.WriteFile(filepath.Join(b.Dir, remotePath), data, 0o644)
+}
+
+func scanned(level int16, date string, datetime int64, generation string) list.Scanned {
+	return list.Scanned{
+		S3Path: fmt.Sprintf("tank/data/level%d/%s", level, date),
+		Manifest: &manifest.Backup{Pool: "tank", Dataset: "data", BackupLevel: level, Datetime: datetime, GenerationID: generation,
+			TargetSnapshot: fmt.Sprintf("tank/data@zrb_level%d_%s", level, date), Blake3Hash: "hash-" + date, IncrementalMode: "chain"},
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	task := &config.Task{Pool: "tank", Dataset: "data"}
+
+	_, err := Rebuild(task, []list.Scanned{scanned(1, "20240102", 2, "g1")})
+	assert.EqualError(t, err, "no complete level 0 backup found in the bucket")
+
+	// Scan sorts by level, then time.
+	last, err := Rebuild(task, []list.Scanned{
+		scanned(0, "20240101", 1, "g1"),
+		scanned(0, "20240201", 10, "g2"),
+		scanned(1, "20240102", 2, "g1"),
+		scanned(1, "20240202", 11, "g2"),
+		scanned(1, "20240203", 12, "g2"),
+		scanned(2, "20240103", 3, "g1"),
+		scanned(3, "20240204", 13, ""),
+		scanned(3, "20240104", 4, ""),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "chain", last.IncrementalMode)
+	require.Len(t, last.BackupLevels, 4)
+	assert.Equal(t, &manifest.Ref{Datetime: 10, Snapshot: "tank/data@zrb_level0_20240201", Blake3Hash: "hash-20240201",
+		S3Path: "tank/data/level0/20240201", GenerationID: "g2"}, last.BackupLevels[0], "the newest level 0")
+	assert.Equal(t, "tank/data/level1/20240203", last.BackupLevels[1].S3Path, "the newest level 1 of its generation")
+	assert.Nil(t, last.BackupLevels[2], "level 2 belongs to the previous generation")
+	assert.Equal(t, "tank/data/level3/20240204", last.BackupLevels[3].S3Path, "without a generation ID, only backups after the level 0 count")
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	bucket := filepath.Join(dir, "bucket")
+	for _, s := range []list.Scanned{scanned(0, "20240101", 1, "g1"), scanned(1, "20240102", 2, "g1")} {
+		path := filepath.Join(bucket, "manifests", s.S3Path, "task_manifest.yaml")
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, manifest.Write(path, s.Manifest))
+	}
+	backend := &bucketBackend{DirBackend: &remotetest.DirBackend{Dir: bucket}, uploaded: make(map[string]string)}
+	oldCache := remote.DefaultCache
+	remote.DefaultCache = remote.NewCache(func(context.Context, remote.Options) (remote.Backend, error) {
+		return backend, nil
+	})
+	t.Cleanup(func() { remote.DefaultCache = oldCache })
+	var out bytes.Buffer
+	defer func(w io.Writer) { output = w }(output)
+	output = &out
+
+	configPath := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+s3:
+  enabled: true
+  bucket: b
+  region: us-east-1
+  storage_class:
+    manifest: STANDARD
+    backup_data: [STANDARD]
+tasks:
+  - name: t
+    pool: tank
+    dataset: data
+    enabled: true
+`, filepath.Join(dir, "base"))), 0o644))
+
+	opts := Options{ConfigPath: configPath, TaskName: "t", DryRun: true}
+	require.NoError(t, Run(context.Background(), opts))
+	assert.Contains(t, out.String(), "s3_path: tank/data/level1/20240102")
+	assert.Empty(t, backend.uploaded, "a dry run uploads nothing")
+
+	opts.DryRun = false
+	require.NoError(t, Run(context.Background(), opts))
+	lastKey := "manifests/tank/data/last_backup_manifest.yaml"
+	require.Contains(t, backend.uploaded, lastKey)
+	last, err := manifest.ReadLast(filepath.Join(bucket, lastKey))
+	require.NoError(t, err)
+	require.Len(t, last.BackupLevels, 2)
+	assert.Equal(t, "tank/data@zrb_level1_20240102", last.BackupLevels[1].Snapshot)
+
+	err = Run(context.Background(), opts)
+	assert.ErrorContains(t, err, "last backup manifest "+lastKey+" exists; pass --force")
+	opts.Force = true
+	assert.NoError(t, Run(context.Background(), opts))
+	assert.Equal(t, 3, strings.Count(out.String(), "backup_levels:"), "each run but the refused one prints the manifest")
+}
@@ -0,0 +1,81 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"zrb/internal/config"
+	"zrb/internal/crypto"
+	"zrb/internal/manifest"
+	"zrb/internal/remote"
+)
+
+// loadChecksums reads CHECKSUMS.blake3 from where the parts come from: S3 next to the parts, or
+// the local directory of the manifest.
+func loadChecksums(ctx context.Context, cfg *config.Config, m *manifest.Backup, source, manifestPath string) ([]byte, error) {
+	if source != "s3" {
+		return os.ReadFile(filepath.Join(filepath.Dir(manifestPath), manifest.ChecksumsBlake3File))
+	}
+
+	backend, err := remote.DefaultCache.Get(ctx, remote.OptionsFromConfig(cfg, cfg.ManifestStorageClass()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize S3 backend: %w", err)
+	}
+
+	tmp, err := os.CreateTemp("", "restore_checksums_*")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	remotePath := remote.DataPath(m.S3Prefix, m.TargetS3Path, manifest.ChecksumsBlake3File)
+	if err := backend.Download(ctx, remotePath, tmp.Name()); err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", remotePath, err)
+	}
+	return os.ReadFile(tmp.Name())
+}
+
+// checkChecksums cross-checks CHECKSUMS.blake3 against the task manifest: the part lines must match
+// the manifest's parts and its recorded digest, and the manifest line must match the manifest file.
+func checkChecksums(m *manifest.Backup, data []byte, manifestPath string) error {
+	if m.ChecksumsBlake3 == "" {
+		return fmt.Errorf("the manifest records no %s, it was written before checksum files existed", manifest.ChecksumsBlake3File)
+	}
+
+	entries, err := manifest.ParseChecksums(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %w", manifest.ChecksumsBlake3File, err)
+	}
+
+	manifestName := filepath.Base(manifestPath)
+	var parts []manifest.Checksum
+	var manifestHash string
+	for _, e := range entries {
+		if e.Name == "task_manifest.yaml" {
+			manifestHash = e.Hash
+			continue
+		}
+		parts = append(parts, e)
+	}
+
+	if digest := manifest.PartChecksumsDigest(m.Parts); digest != m.ChecksumsBlake3 {
+		return fmt.Errorf("manifest parts do not match its checksums_blake3 (%s, expected %s)", digest, m.ChecksumsBlake3)
+	}
+	if string(manifest.FormatChecksums(parts)) != string(manifest.FormatChecksums(manifest.PartChecksums(m.Parts))) {
+		return fmt.Errorf("part lines of %s do not match the manifest", manifest.ChecksumsBlake3File)
+	}
+
+	if manifestHash == "" {
+		return fmt.Errorf("%s has no line for the task manifest", manifest.ChecksumsBlake3File)
+	}
+	actual, err := crypto.BLAKE3File(manifestPath)
+	if err != nil {
+		return fmt.Errorf("failed to hash %s: %w", manifestName, err)
+	}
+	if actual != manifestHash {
+		return fmt.Errorf("%s does not match the task manifest: expected %s, got %s", manifest.ChecksumsBlake3File, manifestHash, actual)
+	}
+	return nil
+}
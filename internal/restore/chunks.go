@@ -0,0 +1,105 @@
+package restore
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"zrb/internal/config"
+	"zrb/internal/events"
+	"zrb/internal/manifest"
+	"zrb/internal/remote"
+	"zrb/internal/sdnotify"
+	"zrb/internal/throughput"
+
+	"filippo.io/age"
+	"github.com/zeebo/blake3"
+)
+
+// fetchChunks downloads the chunks of a dedup_store backup in stream order, decrypts and verifies
+// each against its hash, and writes it to out. A chunk that repeats is downloaded once and
+// kept until its last use.
+func fetchChunks(ctx context.Context, cfg *config.Config, m *manifest.Backup, dataStorageClass string, identities []age.Identity, tempDir string, out io.Writer) error {
+	backend, err := remote.DefaultCache.Get(ctx, remote.OptionsFromConfig(cfg, dataStorageClass))
+	if err != nil {
+		return fmt.Errorf("failed to initialize S3 backend: %w", err)
+	}
+
+	lastUse := make(map[string]int, len(m.Chunks))
+	for i, c := range m.Chunks {
+		lastUse[c.Blake3Hash] = i
+	}
+	slog.Info("Processing chunks", "count", len(m.Chunks), "unique", len(lastUse))
+
+	meters := metersFrom(ctx)
+	notifier := sdnotify.FromContext(ctx)
+	notifier.Phase("fetching chunks", len(m.Chunks))
+	for i, c := range m.Chunks {
+		if ctx.Err() != nil {
+			return fmt.Errorf("restore cancelled: %w", ctx.Err())
+		}
+
+		// Named .age like parts, so a failed restore keeps what it downloaded for the next attempt.
+		encryptedFile := filepath.Join(tempDir, "chunk-"+c.Blake3Hash+".age")
+		if _, err := os.Stat(encryptedFile); err != nil {
+			remotePath := remote.ChunkPath(m.S3Prefix, m.ChunkStore, c.Blake3Hash)
+			if err := meters.download.Time(func() error { return backend.Download(ctx, remotePath, encryptedFile) }); err != nil {
+				return fmt.Errorf("failed to download chunk %d (%s): %w", i, c.Blake3Hash, err)
+			}
+			events.Emit(ctx, events.Event{Stage: events.PartDownloaded, Part: c.Blake3Hash, Object: remotePath})
+		}
+
+		data, err := decryptChunk(encryptedFile, c, identities, meters.decrypt)
+		if err != nil {
+			os.Remove(encryptedFile)
+			return fmt.Errorf("failed to decrypt/verify chunk %d: %w", i, err)
+		}
+		if _, err := out.Write(data); err != nil {
+			return fmt.Errorf("failed to merge chunk %d: %w", i, err)
+		}
+		if lastUse[c.Blake3Hash] == i {
+			if err := os.Remove(encryptedFile); err != nil {
+				slog.Warn("Failed to remove consumed chunk", "path", encryptedFile, "error", err)
+			}
+		}
+		notifier.Step()
+	}
+	events.Emit(ctx, events.Event{Stage: events.PartVerified, Part: "chunks"})
+	return nil
+}
+
+// decryptChunk decrypts a chunk and checks its size and hash against the manifest. The decryption
+// is counted in meter.
+func decryptChunk(path string, c manifest.ChunkInfo, identities []age.Identity, meter *throughput.Meter) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	buf.Grow(int(c.Size))
+	err = meter.Time(func() error {
+		r, err := age.Decrypt(f, identities...)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(meter.Writer(&buf), r)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed: %w", err)
+	}
+	if int64(buf.Len()) != c.Size {
+		return nil, fmt.Errorf("chunk %s has %d bytes, expected %d", c.Blake3Hash, buf.Len(), c.Size)
+	}
+	sum := blake3.Sum256(buf.Bytes())
+	if hash := hex.EncodeToString(sum[:]); hash != c.Blake3Hash {
+		return nil, fmt.Errorf("BLAKE3 mismatch: expected %s, got %s", c.Blake3Hash, hash)
+	}
+	return buf.Bytes(), nil
+}
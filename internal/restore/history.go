@@ -0,0 +1,160 @@
+package restore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+	"zrb/internal/config"
+	"zrb/internal/util"
+	"zrb/internal/zfs"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	historyFileName   = "restore_history.yaml"
+	historyMaxSize    = 1 << 20
+	historyMaxBackups = 3
+)
+
+type HistoryEntry struct {
+	Timestamp       int64   `yaml:"timestamp" json:"timestamp"`
+	Task            string  `yaml:"task" json:"task"`
+	Source          string  `yaml:"source" json:"source"`
+	Level           int16   `yaml:"level" json:"level"`
+	BackupDatetime  int64   `yaml:"backup_datetime,omitempty" json:"backup_datetime,omitempty"`
+	Snapshot        string  `yaml:"snapshot,omitempty" json:"snapshot,omitempty"`
+	Target          string  `yaml:"target" json:"target"`
+	DryRun          bool    `yaml:"dry_run" json:"dry_run"`
+	Outcome         string  `yaml:"outcome" json:"outcome"`
+	Error           string  `yaml:"error,omitempty" json:"error,omitempty"`
+	Blake3Hash      string  `yaml:"blake3_hash,omitempty" json:"blake3_hash,omitempty"`
+	PartsVerified   int     `yaml:"parts_verified" json:"parts_verified"`
+	DurationSeconds float64 `yaml:"duration_seconds" json:"duration_seconds"`
+	// ReceiveArgs is the zfs receive command line the restore ran.
+	ReceiveArgs []string `yaml:"receive_args,omitempty" json:"receive_args,omitempty"`
+	// ReceivedLevels are the levels received, in order; a chained restore receives several.
+	ReceivedLevels []int16 `yaml:"received_levels,omitempty" json:"received_levels,omitempty"`
+	// DownloadedBytes is what the restore downloaded from S3, retries included.
+	DownloadedBytes int64 `yaml:"downloaded_bytes,omitempty" json:"downloaded_bytes,omitempty"`
+	// StaleHolds are the holds the restore failed to release.
+	StaleHolds []zfs.UserHold `yaml:"stale_holds,omitempty" json:"stale_holds,omitempty"`
+	// Throughput breaks the restore down into its download, decryption and receive.
+	Throughput *Throughput `yaml:"throughput,omitempty" json:"throughput,omitempty"`
+}
+
+func historyPath(baseDir, pool, dataset string) string {
+	return filepath.Join(util.RunDir(baseDir, pool, dataset), historyFileName)
+}
+
+// appendHistory appends one entry as a YAML sequence item, so the file stays a valid list without rewriting it.
+func appendHistory(path string, entry *HistoryEntry) error {
+	if err := util.MkdirAll(filepath.Dir(path)); err != nil {
+		return err
+	}
+	if err := rotateHistory(path); err != nil {
+		return fmt.Errorf("failed to rotate restore history: %w", err)
+	}
+
+	data, err := yaml.Marshal([]*HistoryEntry{entry})
+	if err != nil {
+		return err
+	}
+
+	f, err := util.AppendFile(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func rotateHistory(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size() < historyMaxSize {
+		return nil
+	}
+
+	for i := historyMaxBackups - 1; i >= 1; i-- {
+		src := fmt.Sprintf("%s.%d", path, i)
+		if _, err := os.Stat(src); err == nil {
+			if err := os.Rename(src, fmt.Sprintf("%s.%d", path, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Rename(path, path+".1")
+}
+
+func readHistory(path string) ([]HistoryEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var entries []HistoryEntry
+	if err := yaml.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// History prints the restore history of a task as JSON or as a table.
+func History(_ context.Context, configPath, taskName, format string) error {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	task, err := cfg.FindTask(taskName)
+	if err != nil {
+		return err
+	}
+
+	entries, err := readHistory(historyPath(cfg.BaseDir, task.Pool, task.Dataset))
+	if err != nil {
+		return fmt.Errorf("failed to read restore history: %w", err)
+	}
+	if entries == nil {
+		entries = []HistoryEntry{}
+	}
+
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(entries); err != nil {
+			return fmt.Errorf("failed to encode JSON: %w", err)
+		}
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TIME\tSOURCE\tLEVEL\tSNAPSHOT\tTARGET\tDRY-RUN\tOUTCOME\tDOWNLOADED\tDURATION")
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%t\t%s\t%d\t%.1fs\n",
+				time.Unix(e.Timestamp, 0).Format("2006-01-02 15:04:05"),
+				e.Source, e.Level, e.Snapshot, e.Target, e.DryRun, e.Outcome, e.DownloadedBytes, e.DurationSeconds)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported format: %s (expected json or table)", format)
+	}
+
+	return nil
+}
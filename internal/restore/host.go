@@ -0,0 +1,122 @@
+package restore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"zrb/internal/zfs"
+)
+
+// targetHost runs the zfs commands of a restore on the machine that receives the stream: this one,
+// or the host given with --receive-via-ssh.
+type targetHost interface {
+	// preflight checks that the pool of target exists and that the restore may create target.
+	preflight(target string) error
+	hostname() (string, error)
+	datasetExists(dataset string) (bool, error)
+	snapshotExists(snapshot string) (bool, error)
+	snapshotGUID(snapshot string) (string, error)
+	written(snapshot string) (int64, error)
+	poolFeature(pool, feature string) (string, error)
+	receiveResumeToken(dataset string) (string, error)
+	abortReceive(dataset string) error
+	destroyRecursive(dataset string) error
+	hold(ctx context.Context, tag, snapshot string) error
+	release(ctx context.Context, tag, snapshot string) error
+	// receiveCommand is the command line that receives into target, recorded in the restore history.
+	receiveCommand(target string, force bool) []string
+	// receive runs receiveCommand with stream as its stdin.
+	receive(ctx context.Context, stream io.Reader, target string, force bool) error
+	// explain adds the zfs allow or the installation a permission or availability failure of a
+	// zfs command on dataset calls for.
+	explain(err error, dataset string) error
+	close()
+}
+
+// localHost receives on this machine.
+type localHost struct{}
+
+func (localHost) preflight(target string) error {
+	pool, _, _ := strings.Cut(target, "/")
+	if err := zfs.CheckPoolExists(pool); err != nil {
+		return zfs.ExplainLocal(err, pool, zfs.RestorePermissions)
+	}
+	permDataset, err := zfs.NearestExistingDataset(target)
+	if err != nil {
+		return zfs.ExplainLocal(err, pool, zfs.RestorePermissions)
+	}
+	return zfs.CheckPermissions(permDataset, zfs.RestorePermissions)
+}
+
+func (localHost) hostname() (string, error) { return os.Hostname() }
+
+func (localHost) datasetExists(dataset string) (bool, error) { return zfs.DatasetExists(dataset) }
+
+func (localHost) snapshotExists(snapshot string) (bool, error) { return zfs.SnapshotExists(snapshot) }
+
+func (localHost) snapshotGUID(snapshot string) (string, error) { return zfs.SnapshotGUID(snapshot) }
+
+func (localHost) written(snapshot string) (int64, error) { return zfs.Written(snapshot) }
+
+func (localHost) poolFeature(pool, feature string) (string, error) {
+	return zfs.PoolFeature(pool, feature)
+}
+
+func (localHost) receiveResumeToken(dataset string) (string, error) {
+	return zfs.ReceiveResumeToken(dataset)
+}
+
+func (localHost) abortReceive(dataset string) error { return zfs.AbortReceive(dataset) }
+
+func (localHost) destroyRecursive(dataset string) error { return zfs.DestroyRecursive(dataset) }
+
+func (localHost) hold(ctx context.Context, tag, snapshot string) error {
+	return zfs.Hold(ctx, tag, snapshot)
+}
+
+func (localHost) release(ctx context.Context, tag, snapshot string) error {
+	return zfs.Release(ctx, tag, snapshot)
+}
+
+func (localHost) receiveCommand(target string, force bool) []string {
+	return receiveCommand(target, force)
+}
+
+func (localHost) receive(_ context.Context, stream io.Reader, target string, force bool) error {
+	args := receiveCommand(target, force)
+	return runReceive(exec.Command(args[0], args[1:]...), stream)
+}
+
+func (localHost) explain(err error, dataset string) error {
+	return zfs.ExplainLocal(err, dataset, zfs.RestorePermissions)
+}
+
+func (localHost) close() {}
+
+// runReceive runs a receive command with stream as its stdin, keeping what it printed to stderr
+// in the returned *receiveError.
+func runReceive(cmd *exec.Cmd, stream io.Reader) error {
+	var stderr bytes.Buffer
+	cmd.Stdin = stream
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+	if err := cmd.Run(); err != nil {
+		return &receiveError{err: err, stderr: strings.TrimSpace(stderr.String())}
+	}
+	return nil
+}
+
+// newTargetHost returns the host opts receive on.
+func newTargetHost(opts Options) (targetHost, error) {
+	if opts.ReceiveViaSSH == "" {
+		if len(opts.SSHOptions) > 0 {
+			return nil, fmt.Errorf("--ssh-option needs --receive-via-ssh")
+		}
+		return localHost{}, nil
+	}
+	return newSSHHost(opts.ReceiveViaSSH, opts.SSHOptions)
+}
@@ -0,0 +1,248 @@
+package restore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"zrb/internal/crypto"
+	"zrb/internal/manifest"
+	"zrb/internal/sdnotify"
+	"zrb/internal/tracing"
+	"zrb/internal/zfs"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// receiveError keeps what zfs receive printed to stderr, which tells why it failed.
+type receiveError struct {
+	err    error
+	stderr string
+}
+
+func (e *receiveError) Error() string {
+	if e.stderr == "" {
+		return fmt.Sprintf("zfs receive command failed: %v", e.err)
+	}
+	return fmt.Sprintf("zfs receive command failed: %v: %s", e.err, e.stderr)
+}
+
+func (e *receiveError) Unwrap() error {
+	return e.err
+}
+
+// receive runs zfs receive of mergedFile into target on host and cleans up what a failed receive leaves behind.
+func receive(ctx context.Context, host targetHost, mergedFile, target string, force bool) (err error) {
+	_, span := tracing.Start(ctx, "restore.receive", attribute.String("zfs.dataset", target))
+	defer func() { tracing.End(span, err) }()
+
+	// Whether the target existed decides if a failed receive may destroy what it leaves behind.
+	targetExisted, err := host.datasetExists(target)
+	if err != nil {
+		return host.explain(fmt.Errorf("failed to check target dataset: %w", err), target)
+	}
+	file, err := os.Open(mergedFile)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot file: %w", err)
+	}
+	defer file.Close()
+	if err := executeZfsReceive(ctx, host, file, target, force); err != nil {
+		return cleanupFailedReceive(host, target, targetExisted, false, err)
+	}
+	return nil
+}
+
+// errReceiveEnded stops feeding a stream zfs receive no longer reads.
+var errReceiveEnded = errors.New("zfs receive ended")
+
+// receiveStreamed runs zfs receive into target on host with the stream feed writes, without a
+// merged copy on disk, and returns the stream's hash with algorithm and its size. A feed that fails
+// stops the receive, which is cleaned up as a failed one. The stream is hashed as zfs receive reads
+// it; when the hash does not match want, the received snapshot is destroyed, or the whole target
+// when this restore created it.
+func receiveStreamed(ctx context.Context, host targetHost, target, snapshot string, force bool, algorithm, want string, feed func(io.Writer) error) (_ string, _ int64, err error) {
+	_, span := tracing.Start(ctx, "restore.receive", attribute.String("zfs.dataset", target))
+	defer func() { tracing.End(span, err) }()
+
+	targetExisted, err := host.datasetExists(target)
+	if err != nil {
+		return "", 0, host.explain(fmt.Errorf("failed to check target dataset: %w", err), target)
+	}
+	hasher, err := crypto.NewHasher(algorithm)
+	if err != nil {
+		return "", 0, err
+	}
+
+	pr, pw := io.Pipe()
+	fed := make(chan error, 1)
+	go func() {
+		err := feed(pw)
+		pw.CloseWithError(err)
+		fed <- err
+	}()
+	stream := &countingReader{r: io.TeeReader(pr, hasher)}
+	recvErr := executeZfsReceive(ctx, host, stream, target, force)
+	pr.CloseWithError(errReceiveEnded)
+	if err := <-fed; err != nil && !errors.Is(err, errReceiveEnded) {
+		notes := append(cleanupReceived(host, target, targetExisted), "Rerun the restore to continue. It fetches again the parts zfs receive already read, which were deleted; fetched parts it had not read yet are kept.")
+		return "", 0, fmt.Errorf("%w\n%s", err, strings.Join(notes, "\n"))
+	}
+	if recvErr != nil {
+		return "", 0, cleanupFailedReceive(host, target, targetExisted, true, recvErr)
+	}
+
+	got := fmt.Sprintf("%x", hasher.Sum(nil))
+	if got != want {
+		err := fmt.Errorf("%s mismatch: expected %s, got %s; the received stream is corrupt", strings.ToUpper(algorithm), want, got)
+		return "", 0, discardReceived(host, target, snapshot, targetExisted, err)
+	}
+	slog.Info("Stream hash verified", "algorithm", algorithm, "hash", got)
+	return got, stream.n, nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// discardReceived removes what a receive whose stream failed verification brought: the target when
+// this restore created it, else only the received snapshot, leaving the target as it was.
+func discardReceived(host targetHost, target, snapshot string, targetExisted bool, verifyErr error) error {
+	remove := snapshot
+	if !targetExisted {
+		remove = target
+	}
+	slog.Warn("Destroying what the corrupt stream was received into", "target", target, "destroy", remove)
+	// zfs destroy -r also takes a snapshot, destroying it alone.
+	if err := host.destroyRecursive(remove); err != nil {
+		return fmt.Errorf("%w\nFailed to remove the received data (%v); run: zfs destroy -r %s", verifyErr, err, remove)
+	}
+	return fmt.Errorf("%w\nRemoved %s. The backup itself may be damaged; rerun with --safe to verify it before receiving, or restore another backup.", verifyErr, remove)
+}
+
+func executeZfsReceive(ctx context.Context, host targetHost, stream io.Reader, target string, force bool) error {
+	slog.Info("Running zfs receive", "target", target, "force", force, "command", strings.Join(host.receiveCommand(target, force), " "))
+	meter := metersFrom(ctx).receive
+	return meter.Time(func() error { return host.receive(ctx, meter.Reader(sdnotify.Reader(stream)), target, force) })
+}
+
+// receiveCommand is the command line of the zfs receive into target, recorded in the restore history.
+func receiveCommand(target string, force bool) []string {
+	args := []string{"zfs", "receive"}
+	if force {
+		args = append(args, "-F")
+	}
+	return append(args, target)
+}
+
+// poolFeatureWarnings lists the pool features the send flags recorded in m may require that pool
+// on host lacks, as zfs receive would then fail only after the whole stream was downloaded.
+func poolFeatureWarnings(host targetHost, m *manifest.Backup, pool string) []string {
+	var warnings []string
+	for _, feature := range zfs.StreamFeatures(m.SendArgs) {
+		state, err := host.poolFeature(pool, feature)
+		switch {
+		case err != nil:
+			warnings = append(warnings, fmt.Sprintf("could not check feature@%s on pool %s, which the stream may need: %v", feature, pool, err))
+		case state == "disabled":
+			warnings = append(warnings, fmt.Sprintf("the stream may need feature@%s, which is disabled on pool %s; enable it with: zpool set feature@%s=enabled %s", feature, pool, feature, pool))
+		}
+	}
+	return warnings
+}
+
+// receiveHints map zfs receive error messages to what the user can do about them. The first match wins.
+var receiveHints = []struct {
+	pattern string
+	hint    string
+}{
+	{"out of space", "Free up space on the target pool, or restore to a pool with more room, then rerun the restore."},
+	{"permission denied", "Grant the restore permissions with zfs allow (receive, create, mount) or run as root, then rerun the restore."},
+	{"destination has been modified", "The target changed since its latest snapshot; rerun with --force to roll it back."},
+	{"match incremental source", "The target does not hold the parent snapshot; restore the lower levels first, or rerun with --from-scratch."},
+	{"must specify -F", "The target already exists; rerun with --force to overwrite it, or with --from-scratch to start over."},
+	{"invalid backup stream", "The stream is corrupt or truncated although its hash matched; the backup itself may be damaged, try restoring another backup."},
+	{"checksum mismatch", "The stream is corrupt or truncated although its hash matched; the backup itself may be damaged, try restoring another backup."},
+}
+
+// streamedReceiveHints replace the receiveHints of the same pattern for a streamed receive, whose
+// stream hash is only known once zfs receive finished.
+var streamedReceiveHints = map[string]string{
+	"invalid backup stream": "The stream is corrupt or truncated; a streamed restore checks its hash only after zfs receive. Rerun with --safe to verify the whole stream before it is received.",
+	"checksum mismatch":     "The stream is corrupt or truncated; a streamed restore checks its hash only after zfs receive. Rerun with --safe to verify the whole stream before it is received.",
+}
+
+func receiveHint(stderr string, streamed bool) string {
+	for _, h := range receiveHints {
+		if strings.Contains(stderr, h.pattern) {
+			if hint, ok := streamedReceiveHints[h.pattern]; ok && streamed {
+				return hint
+			}
+			return h.hint
+		}
+	}
+	return "Fix the cause reported by zfs above and rerun the restore. It fetches again every part fed to zfs receive or merged with --safe, as those were deleted."
+}
+
+// cleanupFailedReceive removes what a failed receive left on target, so a retry does not fail with
+// "destination exists": it aborts a saved resumable receive, or destroys the dataset when this restore
+// created it. A target that existed before is never destroyed. The returned error says what to do next,
+// which for a streamed receive may differ.
+func cleanupFailedReceive(host targetHost, target string, targetExisted, streamed bool, recvErr error) error {
+	var stderr string
+	var re *receiveError
+	if errors.As(recvErr, &re) {
+		stderr = re.stderr
+	}
+
+	notes := cleanupReceived(host, target, targetExisted)
+	notes = append(notes, receiveHint(stderr, streamed))
+	return fmt.Errorf("ZFS receive failed: %w\n%s", recvErr, strings.Join(notes, "\n"))
+}
+
+// cleanupReceived aborts a saved resumable receive into target, or destroys target when this
+// restore created it, and returns notes on what it did.
+func cleanupReceived(host targetHost, target string, targetExisted bool) []string {
+	var notes []string
+
+	exists, err := host.datasetExists(target)
+	if err != nil {
+		slog.Warn("Failed to check target after failed receive", "target", target, "error", err)
+	}
+
+	var token string
+	if exists {
+		if token, err = host.receiveResumeToken(target); err != nil {
+			slog.Warn("Failed to read receive resume token", "target", target, "error", err)
+		}
+	}
+
+	switch {
+	case token != "":
+		slog.Warn("Aborting interrupted receive", "target", target)
+		if err := host.abortReceive(target); err != nil {
+			notes = append(notes, fmt.Sprintf("Failed to abort the interrupted receive (%v); run: zfs receive -A %s", err, target))
+		} else {
+			notes = append(notes, fmt.Sprintf("Aborted the interrupted receive into %s.", target))
+		}
+	case exists && !targetExisted:
+		slog.Warn("Destroying partially received dataset created by this restore", "target", target)
+		if err := host.destroyRecursive(target); err != nil {
+			notes = append(notes, fmt.Sprintf("Failed to remove the partially received dataset (%v); run: zfs destroy -r %s", err, target))
+		} else {
+			notes = append(notes, fmt.Sprintf("Removed the partially received dataset %s.", target))
+		}
+	}
+
+	return notes
+}
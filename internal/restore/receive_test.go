@@ -0,0 +1,263 @@
+package restore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"zrb/internal/manifest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zeebo/blake3"
+)
+
+// scriptedZFS is a fake zfs whose receive fails with stderr after optionally creating the target
+// or leaving a resume token, or succeeds when the succeed flag is set. Flag files in dir hold the state; every call is appended to dir/calls.
+type scriptedZFS struct {
+	dir string
+}
+
+func newScriptedZFS(t *testing.T) *scriptedZFS {
+	t.Helper()
+	dir := t.TempDir()
+	script := fmt.Sprintf(`#!/bin/sh
+d=%q
+echo "$*" >> "$d/calls"
+case "$1" in
+list)
+	[ -f "$d/exists" ] && { echo "$4"; exit 0; }
+	echo "cannot open '$4': dataset does not exist" >&2; exit 1 ;;
+get)
+	if [ -f "$d/token" ]; then echo "1-abc-def"; else echo "-"; fi ;;
+destroy)
+	rm -f "$d/exists" ;;
+receive)
+	if [ "$2" = "-A" ]; then rm -f "$d/token"; exit 0; fi
+	cat > /dev/null
+	[ -f "$d/create" ] && touch "$d/exists"
+	[ -f "$d/leave_token" ] && touch "$d/token"
+	[ -f "$d/succeed" ] && exit 0
+	cat "$d/stderr" >&2
+	exit 1 ;;
+esac
+`, dir)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "zfs"), []byte(script), 0o755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return &scriptedZFS{dir: dir}
+}
+
+func (z *scriptedZFS) set(t *testing.T, flag, content string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(filepath.Join(z.dir, flag), []byte(content), 0o644))
+}
+
+func (z *scriptedZFS) calls(t *testing.T) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(z.dir, "calls"))
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestReceiveHint(t *testing.T) {
+	assert.Contains(t, receiveHint("cannot receive new filesystem stream: out of space", false), "Free up space")
+	assert.Contains(t, receiveHint("cannot receive new filesystem stream: destination 'tank/x' exists\nmust specify -F to overwrite it", false), "--force")
+	assert.Contains(t, receiveHint("cannot receive incremental stream: most recent snapshot of tank/x does not\nmatch incremental source", false), "lower levels")
+	assert.Contains(t, receiveHint("cannot receive: invalid backup stream", false), "although its hash matched")
+	assert.Contains(t, receiveHint("something new", false), "rerun the restore")
+
+	// A streamed receive fails before the stream hash is known.
+	assert.Contains(t, receiveHint("cannot receive: invalid backup stream", true), "--safe")
+	assert.NotContains(t, receiveHint("cannot receive incremental stream: checksum mismatch", true), "hash matched")
+	assert.Contains(t, receiveHint("cannot receive new filesystem stream: out of space", true), "Free up space")
+}
+
+func TestFailedReceiveCleanup(t *testing.T) {
+	tests := []struct {
+		name          string
+		existedBefore bool
+		creates       bool
+		leavesToken   bool
+		streamed      bool
+		stderr        string
+		wantCall      string
+		noCall        []string
+		wantErr       []string
+	}{
+		{
+			name:     "partial dataset created by this run is destroyed",
+			creates:  true,
+			stderr:   "cannot receive new filesystem stream: out of space",
+			wantCall: "destroy -r tank/restored",
+			wantErr:  []string{"out of space", "Removed the partially received dataset tank/restored", "Free up space"},
+		},
+		{
+			name:          "resumable receive is aborted instead of destroying",
+			existedBefore: true,
+			leavesToken:   true,
+			stderr:        "cannot receive incremental stream: checksum mismatch",
+			wantCall:      "receive -A tank/restored",
+			noCall:        []string{"destroy"},
+			wantErr:       []string{"Aborted the interrupted receive", "although its hash matched"},
+		},
+		{
+			name:          "streamed corrupt stream",
+			existedBefore: true,
+			streamed:      true,
+			stderr:        "cannot receive incremental stream: checksum mismatch",
+			noCall:        []string{"destroy"},
+			wantErr:       []string{"corrupt", "Rerun with --safe"},
+		},
+		{
+			name:          "existing target is never destroyed",
+			existedBefore: true,
+			stderr:        "cannot receive new filesystem stream: destination 'tank/restored' exists\nmust specify -F to overwrite it",
+			noCall:        []string{"destroy", "receive -A"},
+			wantErr:       []string{"--from-scratch"},
+		},
+		{
+			name:    "nothing left behind",
+			stderr:  "cannot receive: permission denied",
+			noCall:  []string{"destroy", "receive -A"},
+			wantErr: []string{"zfs allow"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			z := newScriptedZFS(t)
+			z.set(t, "stderr", tt.stderr)
+			if tt.existedBefore {
+				z.set(t, "exists", "")
+			}
+			if tt.creates {
+				z.set(t, "create", "")
+			}
+			if tt.leavesToken {
+				z.set(t, "leave_token", "")
+			}
+
+			recvErr := executeZfsReceive(context.Background(), localHost{}, strings.NewReader("stream"), "tank/restored", false)
+			require.Error(t, recvErr)
+			err := cleanupFailedReceive(localHost{}, "tank/restored", tt.existedBefore, tt.streamed, recvErr)
+			require.Error(t, err)
+
+			for _, want := range tt.wantErr {
+				assert.ErrorContains(t, err, want)
+			}
+			calls := z.calls(t)
+			if tt.wantCall != "" {
+				assert.Contains(t, calls, tt.wantCall)
+			}
+			for _, call := range tt.noCall {
+				for _, line := range strings.Split(calls, "\n") {
+					assert.False(t, strings.HasPrefix(line, call), "unexpected call %q", line)
+				}
+			}
+		})
+	}
+}
+
+func TestReceiveStreamed(t *testing.T) {
+	const stream = "zfs send stream"
+	hasher := blake3.New()
+	hasher.Write([]byte(stream))
+	streamHash := fmt.Sprintf("%x", hasher.Sum(nil))
+	feedStream := func(w io.Writer) error {
+		_, err := io.WriteString(w, stream)
+		return err
+	}
+
+	tests := []struct {
+		name          string
+		existedBefore bool
+		want          string
+		feed          func(io.Writer) error
+		wantCall      string
+		wantErr       []string
+	}{
+		{name: "verified", want: streamHash, feed: feedStream},
+		{
+			name:     "corrupt stream into a new target",
+			want:     strings.Repeat("0", 64),
+			feed:     feedStream,
+			wantCall: "destroy -r tank/restored\n",
+			wantErr:  []string{"BLAKE3 mismatch", "the received stream is corrupt", "Removed tank/restored.", "--safe"},
+		},
+		{
+			name:          "corrupt stream into an existing target",
+			existedBefore: true,
+			want:          strings.Repeat("0", 64),
+			feed:          feedStream,
+			wantCall:      "destroy -r tank/restored@zrb_level1",
+			wantErr:       []string{"BLAKE3 mismatch", "Removed tank/restored@zrb_level1."},
+		},
+		{
+			name: "failed feed",
+			want: streamHash,
+			feed: func(w io.Writer) error {
+				io.WriteString(w, "zfs send")
+				return errors.New("failed to download part aaaaab")
+			},
+			wantCall: "destroy -r tank/restored\n",
+			wantErr:  []string{"failed to download part aaaaab", "Removed the partially received dataset tank/restored", "fetches again the parts zfs receive already read"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			z := newScriptedZFS(t)
+			z.set(t, "create", "")
+			z.set(t, "succeed", "")
+			if tt.existedBefore {
+				z.set(t, "exists", "")
+			}
+
+			hash, size, err := receiveStreamed(context.Background(), localHost{}, "tank/restored", "tank/restored@zrb_level1", false, "blake3", tt.want, tt.feed)
+			if tt.wantErr == nil {
+				require.NoError(t, err)
+				assert.Equal(t, streamHash, hash)
+				assert.Equal(t, int64(len(stream)), size)
+				assert.NotContains(t, z.calls(t), "destroy")
+				return
+			}
+			for _, want := range tt.wantErr {
+				assert.ErrorContains(t, err, want)
+			}
+			assert.Contains(t, z.calls(t), tt.wantCall)
+		})
+	}
+}
+
+func TestPoolFeatureWarnings(t *testing.T) {
+	bin := t.TempDir()
+	script := `#!/bin/sh
+case "$6" in
+tank) echo disabled ;;
+big) echo active ;;
+*) echo "cannot open '$6': no such pool" >&2; exit 1 ;;
+esac
+`
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "zpool"), []byte(script), 0o755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	m := &manifest.Backup{SendArgs: []string{"zfs", "send", "-L", "-i", "tank/data@a", "tank/data@b"}}
+	assert.Equal(t, []string{"the stream may need feature@large_blocks, which is disabled on pool tank; enable it with: zpool set feature@large_blocks=enabled tank"},
+		poolFeatureWarnings(localHost{}, m, "tank"))
+	assert.Empty(t, poolFeatureWarnings(localHost{}, m, "big"))
+
+	warnings := poolFeatureWarnings(localHost{}, m, "gone")
+	require.Len(t, warnings, 1)
+	assert.Contains(t, warnings[0], "could not check feature@large_blocks on pool gone")
+
+	assert.Empty(t, poolFeatureWarnings(localHost{}, &manifest.Backup{}, "tank"), "nothing recorded, nothing checked")
+}
+
+func TestReceiveCommand(t *testing.T) {
+	assert.Equal(t, []string{"zfs", "receive", "tank/restored"}, receiveCommand("tank/restored", false))
+	assert.Equal(t, []string{"zfs", "receive", "-F", "tank/restored"}, receiveCommand("tank/restored", true))
+}
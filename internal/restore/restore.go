@@ -1,55 +1,222 @@
 package restore
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"zrb/internal/config"
 	"zrb/internal/crypto"
+	"zrb/internal/events"
 	"zrb/internal/manifest"
 	"zrb/internal/remote"
+	"zrb/internal/sdnotify"
+	"zrb/internal/throughput"
+	"zrb/internal/tracing"
+	"zrb/internal/units"
+	"zrb/internal/util"
 	"zrb/internal/zfs"
 
 	"filippo.io/age"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func Run(ctx context.Context, configPath, taskName string, level int16, target, privateKeyPath, source string, dryRun, force bool) error {
-	slog.Info("Restore started", "task", taskName, "level", level, "target", target, "source", source, "dryRun", dryRun)
+type Options struct {
+	ConfigPath string
+	// Standalone replaces the config file when restoring on a bare machine.
+	Standalone     config.Standalone
+	TaskName       string
+	Level          int16
+	Target         string
+	PrivateKeyPath string
+	Source         string
+	// ManifestPath points directly at a local task_manifest.yaml, bypassing the last backup lookup.
+	ManifestPath string
+	DryRun       bool
+	Force        bool
+	// AllowCrossHost permits restoring over the original dataset from a different host.
+	AllowCrossHost bool
+	// FromScratch destroys the target dataset first instead of skipping already received levels.
+	FromScratch bool
+	// SkipKeyCheck skips matching the private key against the manifest's recorded public key.
+	SkipKeyCheck bool
+	// VerifyChecksums cross-checks CHECKSUMS.blake3 against the manifest before restoring.
+	VerifyChecksums bool
+	// WorkDir is the parent of the scratch directory, overriding restore.work_dir.
+	WorkDir string
+	// AcknowledgeCost lets the restore download more than s3.max_download_bytes_per_restore.
+	AcknowledgeCost bool
+	// ReceiveViaSSH is the user@host whose zfs receive the stream is piped into over ssh, instead of
+	// receiving on this machine.
+	ReceiveViaSSH string
+	// SSHOptions are ssh_config options such as Port=2222 passed to ssh with -o.
+	SSHOptions []string
+	// Progress redraws the rolling throughput of each phase on stderr while it is a terminal.
+	Progress bool
+	// Chain receives the backups an incremental builds on first, level 0 first, skipping those
+	// already received.
+	Chain bool
+	// Safe merges the parts into a file and verifies the stream hash before zfs receive reads it,
+	// instead of streaming the parts into zfs receive and verifying the hash as it reads.
+	Safe bool
+}
+
+// step is one backup a restore receives into the target.
+type step struct {
+	m *manifest.Backup
+	// manifestPath is where the manifest was read locally, to find the parts next to it.
+	manifestPath string
+	storageClass string
+	// snapshot is the name of the backup's snapshot on the target, and received whether it is
+	// there already.
+	snapshot string
+	received bool
+}
 
-	cfg, err := config.Load(configPath)
+func Run(ctx context.Context, opts Options) error {
+	slog.Info("Restore started", "task", opts.TaskName, "level", opts.Level, "target", opts.Target, "source", opts.Source, "dryRun", opts.DryRun)
+
+	cfg, task, err := config.Resolve(opts.ConfigPath, opts.TaskName, opts.Standalone)
 	if err != nil {
-		return fmt.Errorf("failed to load config: %w", err)
+		return err
 	}
 
-	task, err := cfg.FindTask(taskName)
+	start := time.Now()
+	entry := &HistoryEntry{
+		Timestamp: start.Unix(),
+		Task:      opts.TaskName,
+		Source:    opts.Source,
+		Level:     opts.Level,
+		Target:    opts.Target,
+		DryRun:    opts.DryRun,
+	}
+
+	// Dry runs change nothing, so they stay out of the audit trail.
+	eventsFile := cfg.Events.File
+	if opts.DryRun {
+		eventsFile = ""
+	}
+	sink, err := events.Open(eventsFile)
 	if err != nil {
 		return err
 	}
+	defer sink.Close()
+	emitter := events.NewEmitter(sink, events.Event{Task: task.Name, Pool: task.Pool, Dataset: task.Dataset, Level: opts.Level, Target: opts.Target})
+	emitter.Emit(events.Event{Stage: events.RestoreStarted})
+
+	notifier, err := sdnotify.New()
+	if err != nil {
+		slog.Warn("systemd notification disabled", "error", err)
+	}
+	defer notifier.Close()
+	ctx = sdnotify.NewContext(ctx, notifier)
+	notifier.Ready()
+	stopWatch := notifier.Watch()
+
+	// Holds retry while the pool is busy; the ones that never get released go into the history
+	holds := zfs.NewHolds(cfg.HoldRetry())
+	ctx = zfs.NewHoldsContext(ctx, holds)
+
+	// Downloads are counted for the history and bounded by the download budget
+	transfer := remote.NewTransfer(remote.BudgetFromConfig(cfg, remote.DirectionDownload, opts.AcknowledgeCost))
+	ctx = remote.WithTransfer(ctx, transfer)
+
+	// The download, decryption and receive are measured to tell which one holds up the restore
+	meters := newPhaseMeters()
+	ctx = withMeters(ctx, meters)
+	var progress io.Writer
+	if opts.Progress && stderrIsTerminal() {
+		progress = os.Stderr
+	}
+	stopReport := meters.report(progress)
+
+	ctx, span := tracing.Start(ctx, "restore", attribute.String("task", task.Name), attribute.String("restore.source", opts.Source),
+		attribute.String("restore.target", opts.Target), attribute.Int("backup.level", int(opts.Level)), attribute.Bool("restore.dry_run", opts.DryRun))
+	runErr := run(events.NewContext(ctx, emitter), cfg, task, opts, entry)
+	tracing.End(span, runErr)
+	stopReport()
+	notifier.Stopping()
+	stopWatch()
+
+	if runErr != nil {
+		emitter.Emit(events.Event{Stage: events.RestoreFailed, Error: runErr.Error()})
+	} else {
+		emitter.Emit(events.Event{Stage: events.RestoreCompleted, Snapshot: entry.Snapshot})
+	}
+
+	entry.DurationSeconds = time.Since(start).Seconds()
+	entry.StaleHolds = holds.Stale()
+	entry.DownloadedBytes = transfer.Downloaded()
+	entry.Outcome = "success"
+	if runErr != nil {
+		entry.Outcome = "failed"
+		entry.Error = runErr.Error()
+	}
+	if entry.DownloadedBytes > 0 {
+		slog.Info("Downloaded from S3", "bytes", entry.DownloadedBytes)
+	}
+	if meters.download.Bytes() > 0 {
+		entry.Throughput = meters.summary()
+		logSummary(entry.Throughput)
+	}
+	if err := appendHistory(historyPath(cfg.BaseDir, task.Pool, task.Dataset), entry); err != nil {
+		slog.Warn("Failed to record restore history", "error", err)
+	}
+
+	return runErr
+}
+
+func run(ctx context.Context, cfg *config.Config, task *config.Task, opts Options, entry *HistoryEntry) error {
+	taskName := task.Name
+	level := opts.Level
+	target := opts.Target
+	source := opts.Source
 
 	targetParts := strings.Split(target, "/")
 	if len(targetParts) < 2 {
 		return fmt.Errorf("target must be in format pool/dataset, got: %s", target)
 	}
 
-	// Pre-flight: verify the target pool exists before downloading anything
-	if err := zfs.CheckPoolExists(targetParts[0]); err != nil {
-		return fmt.Errorf("pre-flight check: %w", err)
+	// The storage class of the level is looked up before any pre-flight check or download
+	var dataStorageClass string
+	if source == "s3" {
+		if !cfg.RemoteEnabled() {
+			return config.ErrNoRemote
+		}
+		if opts.ManifestPath == "" && !opts.Standalone.Enabled() {
+			if err := checkUploaded(cfg, task, level); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		if dataStorageClass, err = storageClass(cfg, opts, level); err != nil {
+			return err
+		}
 	}
 
-	privateKeyData, err := os.ReadFile(privateKeyPath)
+	host, err := newTargetHost(opts)
 	if err != nil {
-		return fmt.Errorf("failed to read private key: %w", err)
+		return err
 	}
+	defer host.close()
 
-	identity, err := age.ParseX25519Identity(strings.TrimSpace(string(privateKeyData)))
+	// Pre-flight: verify the target pool exists before downloading anything
+	if err := host.preflight(target); err != nil {
+		return fmt.Errorf("pre-flight check: %w", err)
+	}
+
+	identities, err := crypto.LoadIdentities(opts.PrivateKeyPath)
 	if err != nil {
-		return fmt.Errorf("failed to parse private key: %w", err)
+		return err
 	}
 
 	slog.Info("Private key loaded successfully")
@@ -57,48 +224,39 @@ func Run(ctx context.Context, configPath, taskName string, level int16, target,
 	var m *manifest.Backup
 	var manifestPath string
 
-	if source == "s3" {
-		if !cfg.S3.Enabled {
-			return fmt.Errorf("S3 is not enabled in config")
-		}
-
-		var storageClass string
-		if level >= 0 && int(level) < len(cfg.S3.StorageClass.BackupData) {
-			storageClass = string(cfg.S3.StorageClass.BackupData[level])
-		} else {
-			return fmt.Errorf("invalid backup level %d for configured storage classes", level)
-		}
-
-		if err := remote.ValidateStorageClass(storageClass); err != nil {
-			return fmt.Errorf("cannot restore from S3: backup data storage class is %s (not immediately accessible)\n"+
-				"You need to:\n"+
-				"1. Initiate a restore request in AWS S3 console or via AWS CLI\n"+
-				"2. Wait for the restore to complete (12-48 hours for DEEP_ARCHIVE)\n"+
-				"3. Then retry this restore command", storageClass)
-		}
-
-		manifestStorageClass := string(cfg.S3.StorageClass.Manifest)
-		if err := remote.ValidateStorageClass(manifestStorageClass); err != nil {
-			return fmt.Errorf("cannot restore from S3: manifest %w", err)
+	if opts.ManifestPath != "" {
+		slog.Info("Using manifest from path", "path", opts.ManifestPath)
+		manifestPath = opts.ManifestPath
+		// An s3:// manifest picks a backup the last backup manifest no longer references, such as
+		// an earlier backup of a same_level chain.
+		if key, ok := strings.CutPrefix(opts.ManifestPath, "s3://"); ok {
+			if source != "s3" {
+				return fmt.Errorf("--manifest %s needs --source s3", opts.ManifestPath)
+			}
+			manifestPath = filepath.Join(os.TempDir(), fmt.Sprintf("restore_manifest_%s_level%d.yaml", taskName, level))
+			defer os.Remove(manifestPath)
+			if err := downloadManifest(ctx, cfg, strings.TrimPrefix(key, "/"), manifestPath); err != nil {
+				return err
+			}
 		}
-
-		maxRetryAttempts := cfg.S3RetryAttempts()
-
-		backend, err := remote.NewS3(ctx, cfg.S3.Bucket, cfg.S3.Region,
-			cfg.S3.Prefix, cfg.S3.Endpoint,
-			cfg.S3.StorageClass.Manifest, maxRetryAttempts)
+	} else if source == "s3" {
+		backend, err := remote.DefaultCache.Get(ctx, remote.OptionsFromConfig(cfg, cfg.ManifestStorageClass()))
 		if err != nil {
 			return fmt.Errorf("failed to initialize S3 backend: %w", err)
 		}
 
 		if err := backend.VerifyCredentials(ctx); err != nil {
-			return fmt.Errorf("AWS credentials verification failed: %w", err)
+			return fmt.Errorf("credentials verification failed: %w", err)
 		}
 
 		lastManifestPath := filepath.Join(os.TempDir(), fmt.Sprintf("restore_last_manifest_%s.yaml", taskName))
 		defer os.Remove(lastManifestPath)
 
-		remoteLastPath := filepath.Join("manifests", task.Pool, task.Dataset, "last_backup_manifest.yaml")
+		remoteLastPath := remote.ManifestPath(task.S3Prefix, task.Pool, task.Dataset, "last_backup_manifest.yaml")
+		if err := remote.CheckAccessible(ctx, backend, remoteLastPath); err != nil {
+			return fmt.Errorf("cannot restore from S3: %w\nAlternatively, pass --manifest with a local copy of the task manifest", err)
+		}
+
 		slog.Info("Downloading last backup manifest from S3", "remote", remoteLastPath)
 
 		if err := backend.Download(ctx, remoteLastPath, lastManifestPath); err != nil {
@@ -120,7 +278,11 @@ func Run(ctx context.Context, configPath, taskName string, level int16, target,
 		manifestPath = filepath.Join(os.TempDir(), fmt.Sprintf("restore_manifest_%s_level%d.yaml", taskName, level))
 		defer os.Remove(manifestPath)
 
-		remoteManifestPath := filepath.Join("manifests", s3Path, "task_manifest.yaml")
+		remoteManifestPath := remote.ManifestPath(task.S3Prefix, s3Path, "task_manifest.yaml")
+		if err := remote.CheckAccessible(ctx, backend, remoteManifestPath); err != nil {
+			return fmt.Errorf("cannot restore from S3: %w", err)
+		}
+
 		slog.Info("Downloading task manifest from S3", "remote", remoteManifestPath)
 
 		if err := backend.Download(ctx, remoteManifestPath, manifestPath); err != nil {
@@ -146,10 +308,69 @@ func Run(ctx context.Context, configPath, taskName string, level int16, target,
 	if err != nil {
 		return fmt.Errorf("failed to read manifest: %w", err)
 	}
+	if m.Incomplete {
+		return fmt.Errorf("manifest %s is a partial manifest of an unfinished backup and cannot be restored", manifestPath)
+	}
+	if source == "s3" && m.LocalOnly {
+		return fmt.Errorf("this backup was never uploaded, it is local-only; restore it with --source local")
+	}
+	if source != "s3" && m.Chunked() {
+		return fmt.Errorf("this backup is stored as dedup_store chunks, which are only kept in S3; restore it with --source s3")
+	}
+	if m.BackupLevel != level {
+		return fmt.Errorf("manifest is for backup level %d, not %d", m.BackupLevel, level)
+	}
 
 	slog.Info("Manifest loaded", "snapshot", m.TargetSnapshot, "parts", len(m.Parts), "blake3", m.Blake3Hash)
 
-	if dryRun {
+	if opts.SkipKeyCheck {
+		slog.Warn("Skipping private key check against manifest")
+	} else if err := checkKey(m, identities); err != nil {
+		return err
+	}
+	if opts.VerifyChecksums {
+		data, err := loadChecksums(ctx, cfg, m, source, manifestPath)
+		if err != nil {
+			return fmt.Errorf("failed to load checksums file: %w", err)
+		}
+		if err := checkChecksums(m, data, manifestPath); err != nil {
+			return fmt.Errorf("checksums cross-check failed: %w", err)
+		}
+		slog.Info("Checksums file matches manifest")
+	}
+	entry.BackupDatetime = m.Datetime
+	entry.Snapshot = m.TargetSnapshot
+
+	currentHost, err := host.hostname()
+	if err != nil {
+		return fmt.Errorf("failed to get hostname: %w", err)
+	}
+	origin := checkOrigin(m, target, currentHost, opts.AllowCrossHost, opts.Force)
+
+	steps := []*step{{m: m, manifestPath: opts.ManifestPath, storageClass: dataStorageClass}}
+	if opts.Chain && m.BackupLevel > 0 {
+		parents, err := parentSteps(ctx, cfg, task, opts, m, identities)
+		if err != nil {
+			return err
+		}
+		steps = append(parents, steps...)
+	}
+	for _, s := range steps {
+		if s.snapshot, err = restoredSnapshotName(target, s.m.TargetSnapshot); err != nil {
+			return err
+		}
+		if !opts.FromScratch {
+			if s.received, err = host.snapshotExists(s.snapshot); err != nil {
+				return host.explain(fmt.Errorf("failed to check for existing snapshot: %w", err), target)
+			}
+		}
+	}
+	requested := steps[len(steps)-1]
+
+	// Features are checked before downloading, while nothing is lost by fixing the pool first
+	featureWarnings := poolFeatureWarnings(host, m, targetParts[0])
+
+	if opts.DryRun {
 		fmt.Printf("\n=== DRY RUN MODE ===\n")
 		fmt.Printf("Would restore backup:\n")
 		fmt.Printf("  Task:            %s\n", taskName)
@@ -159,20 +380,216 @@ func Run(ctx context.Context, configPath, taskName string, level int16, target,
 		fmt.Printf("  Snapshot:        %s\n", m.TargetSnapshot)
 		if m.ParentSnapshot != "" {
 			fmt.Printf("  Parent Snapshot: %s\n", m.ParentSnapshot)
+			if m.ParentPolicy != "" {
+				fmt.Printf("  Parent Policy:   %s\n", m.ParentPolicy)
+			}
+			if opts.Chain {
+				fmt.Printf("  Chain:           receiving these levels, in order:\n")
+				for _, s := range steps {
+					action := "receive"
+					if s.received {
+						action = "skip (already received)"
+					}
+					fmt.Printf("    level %d %s: %s\n", s.m.BackupLevel, s.m.TargetSnapshot, action)
+				}
+			} else if chain, err := manifest.ParentChain(m, chainLoader(ctx, cfg, task, source, m)); err != nil {
+				fmt.Printf("  Requires levels: %s (recorded parents not readable: %v)\n", formatLevels(manifest.RestoreChain(m.IncrementalMode, m.BackupLevel)), err)
+			} else {
+				fmt.Printf("  Requires:        restoring these first, in order:\n")
+				for _, b := range chain {
+					fmt.Printf("    level %d %s: --level %d --manifest %s\n", b.BackupLevel, b.TargetSnapshot, b.BackupLevel, manifestLocation(cfg, task, source, b.StagingDir, b.TargetS3Path))
+				}
+			}
+		}
+		if m.Chunked() {
+			fmt.Printf("  Chunks:          %d\n", len(m.Chunks))
+		} else {
+			fmt.Printf("  Parts:           %d\n", len(m.Parts))
+		}
+		if m.PartSizeBytes > 0 {
+			fmt.Printf("  Part Size:       %d bytes\n", m.PartSizeBytes)
+		}
+		if len(m.SendArgs) > 0 {
+			fmt.Printf("  Send Command:    %s\n", strings.Join(m.SendArgs, " "))
+		}
+		fmt.Printf("  Receive Command: %s\n", strings.Join(host.receiveCommand(target, opts.Force), " "))
+		if m.RecipientCount > 0 {
+			fmt.Printf("  Recipients:      %d\n", m.RecipientCount)
+		}
+		for _, w := range featureWarnings {
+			fmt.Printf("  Pool Features:   WARNING (%s)\n", w)
+		}
+		if algorithm, hash := m.StreamHash(); algorithm == "sha256" {
+			fmt.Printf("  SHA256 Hash:     %s (legacy)\n", hash)
+		} else {
+			fmt.Printf("  BLAKE3 Hash:     %s\n", hash)
 		}
-		fmt.Printf("  Parts:           %d\n", len(m.Parts))
-		fmt.Printf("  BLAKE3 Hash:     %s\n", m.Blake3Hash)
 		fmt.Printf("  Source:          %s\n", source)
+		if source == "s3" {
+			var estimate int64
+			for _, s := range steps {
+				if !s.received {
+					estimate += estimatedDownload(s.m)
+				}
+			}
+			printDownloadEstimate(os.Stdout, estimate, int64(cfg.S3.MaxDownloadBytesPerRestore), opts.AcknowledgeCost)
+		}
+		fmt.Printf("  Original Host:   %s\n", origin.OriginalHost)
+		fmt.Printf("  Current Host:    %s\n", origin.CurrentHost)
+		switch {
+		case origin.Err != nil:
+			fmt.Printf("  Origin Check:    BLOCKED (%v)\n", origin.Err)
+		case origin.Warning != "":
+			fmt.Printf("  Origin Check:    WARNING (%s)\n", origin.Warning)
+		default:
+			fmt.Printf("  Origin Check:    OK\n")
+		}
+		switch {
+		case opts.FromScratch:
+			fmt.Printf("  Action:          destroy %s, then receive\n", target)
+		case requested.received:
+			fmt.Printf("  Action:          skip (%s already received)\n", requested.snapshot)
+		default:
+			fmt.Printf("  Action:          receive\n")
+		}
 		fmt.Printf("\nNo changes made.\n")
 		return nil
 	}
 
-	tempDir := filepath.Join(cfg.BaseDir, "tmp", fmt.Sprintf("restore_%s_%d_%d", taskName, level, time.Now().Unix()))
-	if err := os.MkdirAll(tempDir, 0o755); err != nil {
-		return fmt.Errorf("failed to create temp directory: %w", err)
+	if !slices.ContainsFunc(steps, func(s *step) bool { return !s.received }) {
+		slog.Info("Snapshot already received on target, skipping", "snapshot", requested.snapshot)
+		return nil
+	}
+
+	if origin.Err != nil {
+		return origin.Err
+	}
+	if origin.Warning != "" {
+		slog.Warn(origin.Warning, "target", target, "host", currentHost)
+	}
+	for _, w := range featureWarnings {
+		slog.Warn("Target pool may not accept the stream: "+w, "target", target)
+	}
+
+	if opts.FromScratch {
+		if err := destroyTarget(host, target); err != nil {
+			return err
+		}
+	}
+
+	restored, restoredBytes := 0, int64(0)
+	for _, st := range steps {
+		if st.received {
+			slog.Info("Snapshot already received on target, skipping", "snapshot", st.snapshot)
+			continue
+		}
+		n, err := receiveStep(ctx, cfg, task, host, opts, st, identities, entry)
+		if err != nil {
+			if len(steps) > 1 {
+				return fmt.Errorf("failed to restore level %d %s: %w", st.m.BackupLevel, st.m.TargetSnapshot, err)
+			}
+			return err
+		}
+		restored++
+		restoredBytes += n
+		entry.ReceivedLevels = append(entry.ReceivedLevels, st.m.BackupLevel)
+	}
+
+	slog.Info("Restore completed successfully!", "levels", restored, "bytes", restoredBytes)
+	fmt.Printf("Restored %d level(s), %s, into %s\n", restored, units.FormatSize(restoredBytes), target)
+	return nil
+}
+
+// parentSteps returns the backups m builds on, level 0 first, following the parents the manifests
+// record. It fails before anything is received when one of them is missing or cannot be restored.
+func parentSteps(ctx context.Context, cfg *config.Config, task *config.Task, opts Options, m *manifest.Backup, identities []age.Identity) ([]*step, error) {
+	chain, err := manifest.ParentChain(m, chainLoader(ctx, cfg, task, opts.Source, m))
+	if err != nil {
+		return nil, fmt.Errorf("cannot restore the chain of level %d: %w", m.BackupLevel, err)
+	}
+
+	steps := make([]*step, 0, len(chain))
+	for _, p := range chain {
+		switch {
+		case p.Incomplete:
+			return nil, fmt.Errorf("parent backup %s is a partial manifest of an unfinished backup and cannot be restored", p.TargetS3Path)
+		case opts.Source == "s3" && p.LocalOnly:
+			return nil, fmt.Errorf("parent backup %s was never uploaded, it is local-only; restore the chain with --source local", p.TargetS3Path)
+		case opts.Source != "s3" && p.Chunked():
+			return nil, fmt.Errorf("parent backup %s is stored as dedup_store chunks, which are only kept in S3; restore the chain with --source s3", p.TargetS3Path)
+		}
+		if !opts.SkipKeyCheck {
+			if err := checkKey(p, identities); err != nil {
+				return nil, fmt.Errorf("parent backup %s: %w", p.TargetS3Path, err)
+			}
+		}
+		st := &step{m: p}
+		if opts.Source == "s3" {
+			if st.storageClass, err = storageClass(cfg, opts, p.BackupLevel); err != nil {
+				return nil, err
+			}
+		} else {
+			st.manifestPath = manifestLocation(cfg, task, opts.Source, p.StagingDir, p.TargetS3Path)
+		}
+		steps = append(steps, st)
 	}
+	return steps, nil
+}
 
+// storageClass returns the storage class the data of level is read from S3 with, and fails when
+// that class cannot be read at once.
+func storageClass(cfg *config.Config, opts Options, level int16) (string, error) {
+	if opts.Standalone.Enabled() {
+		// Without a config the data storage class is unknown; archived objects fail at download time.
+		return "STANDARD", nil
+	}
+	class, err := cfg.DataStorageClass(level)
+	if err != nil {
+		return "", err
+	}
+	if err := remote.ValidateStorageClass(class); err != nil {
+		return "", fmt.Errorf("cannot restore from S3: backup data storage class is %s (not immediately accessible)\n"+
+			"You need to:\n"+
+			"1. Initiate a restore request in AWS S3 console or via AWS CLI\n"+
+			"2. Wait for the restore to complete (12-48 hours for DEEP_ARCHIVE)\n"+
+			"3. Then retry this restore command", class)
+	}
+	return class, nil
+}
+
+// receiveStep fetches, verifies and receives the backup of st into opts.Target, and returns the
+// size of its stream.
+func receiveStep(ctx context.Context, cfg *config.Config, task *config.Task, host targetHost, opts Options, st *step, identities []age.Identity, entry *HistoryEntry) (int64, error) {
+	m, level, target := st.m, st.m.BackupLevel, opts.Target
+	// The parts of each backup are looked up next to its own manifest.
+	opts.ManifestPath = st.manifestPath
+
+	// Named after the backup rather than the run, so a failed restore can resume its downloads.
+	workDir := opts.WorkDir
+	if workDir == "" {
+		workDir = cfg.Restore.WorkDir
+	}
+	// Chunks are fetched one at a time.
+	workers := cfg.WorkerCount()
+	if m.Chunked() {
+		workers = 1
+	}
+	tempDir, err := ChooseWorkDir(workDir, []string{os.TempDir(), filepath.Join(cfg.BaseDir, "tmp")},
+		fmt.Sprintf("restore_%s_%d_%d", task.Name, level, m.Datetime), requiredSpace(m, workers, opts.Safe))
+	if err != nil {
+		return 0, err
+	}
+	// The directory holds decrypted parts, so only the owner may enter it.
+	if err := util.MkdirPrivate(tempDir); err != nil {
+		return 0, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+
+	completed := false
 	defer func() {
+		if !completed {
+			keepDownloads(tempDir)
+			return
+		}
 		slog.Info("Cleaning up temp directory", "path", tempDir)
 		if err := os.RemoveAll(tempDir); err != nil {
 			slog.Warn("Failed to remove temp directory", "error", err)
@@ -181,166 +598,581 @@ func Run(ctx context.Context, configPath, taskName string, level int16, target,
 
 	slog.Info("Created temp directory", "path", tempDir)
 
-	slog.Info("Processing parts", "count", len(m.Parts))
-	decryptedParts := make([]string, len(m.Parts))
+	// A merged stream left by a killed run would be appended to; start it over.
+	mergedFile := filepath.Join(tempDir, "snapshot.merged")
+	if err := os.Remove(mergedFile); err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("failed to remove stale merged stream: %w", err)
+	}
 
-	for i, partInfo := range m.Parts {
-		encryptedFile := filepath.Join(tempDir, fmt.Sprintf("snapshot.part-%s.age", partInfo.Index))
-		decryptedFile := filepath.Join(tempDir, fmt.Sprintf("snapshot.part-%s", partInfo.Index))
+	notifier := sdnotify.FromContext(ctx)
+	// feed writes the verified parts or chunks of the stream to out in order.
+	feed := func(out io.Writer) error {
+		if m.Chunked() {
+			return fetchChunks(ctx, cfg, m, st.storageClass, identities, tempDir, out)
+		}
+		slog.Info("Processing parts", "count", len(m.Parts), "workers", workers)
+		notifier.Phase("fetching parts", len(m.Parts))
+		return fetchParts(ctx, cfg, m, opts, st.storageClass, identities, tempDir, out, workers)
+	}
 
-		if source == "s3" {
-			maxRetryAttempts := cfg.S3RetryAttempts()
-			storageClass := cfg.S3.StorageClass.BackupData[level]
+	algorithm, actualHash, streamBytes := "", "", int64(0)
+	if opts.Safe {
+		if err := feedFile(mergedFile, feed); err != nil {
+			return 0, err
+		}
+		notifier.Phase("verifying stream", 0)
+		if algorithm, actualHash, err = verifyStream(ctx, m, mergedFile); err != nil {
+			return 0, err
+		}
+		info, err := os.Stat(mergedFile)
+		if err != nil {
+			return 0, err
+		}
+		streamBytes = info.Size()
+	}
+
+	slog.Info("Executing ZFS receive", "target", target, "streaming", !opts.Safe)
+	events.Emit(ctx, events.Event{Stage: events.ReceiveStarted, Snapshot: m.TargetSnapshot})
 
-			backend, err := remote.NewS3(ctx, cfg.S3.Bucket, cfg.S3.Region,
-				cfg.S3.Prefix, cfg.S3.Endpoint, storageClass, maxRetryAttempts)
-			if err != nil {
-				return fmt.Errorf("failed to initialize S3 backend: %w", err)
+	entry.ReceiveArgs = host.receiveCommand(target, opts.Force)
+	if opts.Safe {
+		notifier.Phase("receiving "+m.TargetSnapshot, 0)
+		if err := receive(ctx, host, mergedFile, target, opts.Force); err != nil {
+			return 0, err
+		}
+	} else {
+		var want string
+		algorithm, want = m.StreamHash()
+		if actualHash, streamBytes, err = receiveStreamed(ctx, host, target, st.snapshot, opts.Force, algorithm, want, feed); err != nil {
+			return 0, err
+		}
+	}
+	if algorithm == "blake3" {
+		entry.Blake3Hash = actualHash
+	}
+	entry.PartsVerified += len(m.Parts)
+
+	// Hold the received snapshot while verifying it, so a retention script on the target cannot
+	// destroy it in between; without the hold permission the check just runs unprotected.
+	if err := host.hold(ctx, restoreHoldTag, st.snapshot); err != nil {
+		slog.Warn("Failed to hold received snapshot, verifying without a hold", "snapshot", st.snapshot, "error", err)
+	} else {
+		defer func() {
+			if err := host.release(ctx, restoreHoldTag, st.snapshot); err != nil {
+				slog.Error("Failed to release hold on received snapshot", "snapshot", st.snapshot, "tag", restoreHoldTag, "error", err)
 			}
+		}()
+	}
+	if err := verifyRestoredSnapshot(host, target, m); err != nil {
+		return 0, fmt.Errorf("restore verification failed: %w", err)
+	}
+	events.Emit(ctx, events.Event{Stage: events.ReceiveCompleted, Snapshot: st.snapshot})
 
-			remotePath := filepath.Join("data", m.TargetS3Path, fmt.Sprintf("snapshot.part-%s.age", partInfo.Index))
-			slog.Info("Downloading part from S3", "part", partInfo.Index, "remote", remotePath)
+	completed = true
+	return streamBytes, nil
+}
+
+// fetchParts fetches the parts of m with up to workers in parallel and writes them to out in index
+// order. A part holds its worker until it is merged, so no more than workers parts are in
+// tempDir at a time. The first failure cancels the parts in flight.
+func fetchParts(ctx context.Context, cfg *config.Config, m *manifest.Backup, opts Options, dataStorageClass string, identities []age.Identity, tempDir string, out io.Writer, workers int) error {
+	var backend remote.Backend
+	if opts.Source == "s3" {
+		var err error
+		backend, err = remote.DefaultCache.Get(ctx, remote.OptionsFromConfig(cfg, dataStorageClass))
+		if err != nil {
+			return fmt.Errorf("failed to initialize S3 backend: %w", err)
+		}
+	}
 
-			if err := backend.Download(ctx, remotePath, encryptedFile); err != nil {
-				return fmt.Errorf("failed to download part %s: %w", partInfo.Index, err)
+	fetchCtx, cancel := context.WithCancelCause(ctx)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel(nil)
+		wg.Wait()
+	}()
+
+	type result struct {
+		file string
+		err  error
+	}
+	results := make([]chan result, len(m.Parts))
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+	slots := make(chan struct{}, workers)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range m.Parts {
+			select {
+			case slots <- struct{}{}:
+			case <-fetchCtx.Done():
+				return
 			}
-		} else {
-			localEncrypted := filepath.Join(cfg.BaseDir, "task", m.Pool, m.Dataset,
-				fmt.Sprintf("level%d", m.BackupLevel), time.Unix(m.Datetime, 0).Format("20060102"),
-				fmt.Sprintf("snapshot.part-%s.age", partInfo.Index))
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				file, err := fetchPart(fetchCtx, backend, cfg, m, opts, identities, tempDir, i)
+				if err != nil {
+					cancel(err)
+				}
+				results[i] <- result{file, err}
+			}()
+		}
+	}()
 
-			slog.Info("Copying part from local", "part", partInfo.Index, "path", localEncrypted)
+	notifier := sdnotify.FromContext(ctx)
+	for i := range m.Parts {
+		var r result
+		select {
+		case r = <-results[i]:
+		case <-fetchCtx.Done():
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("restore cancelled: %w", ctx.Err())
+		}
+		if fetchCtx.Err() != nil {
+			// The part that failed first, which may come after this one.
+			return context.Cause(fetchCtx)
+		}
+		if err := mergePart(out, r.file); err != nil {
+			return fmt.Errorf("failed to merge part %s: %w", m.Parts[i].Index, err)
+		}
+		<-slots
+		notifier.Step()
+	}
+	return nil
+}
+
+// fetchPart downloads part i of m with backend, or copies it without one, into tempDir, decrypts
+// and verifies it, and returns the decrypted file. The encrypted file is kept until the part is
+// merged, for a failed restore to resume from.
+func fetchPart(ctx context.Context, backend remote.Backend, cfg *config.Config, m *manifest.Backup, opts Options, identities []age.Identity, tempDir string, i int) (_ string, err error) {
+	partInfo := m.Parts[i]
+	ctx, span := tracing.Start(ctx, "restore.part", attribute.String("part.index", partInfo.Index))
+	defer func() { tracing.End(span, err) }()
+
+	encryptedFile := filepath.Join(tempDir, manifest.PartFileName(partInfo.Index))
+	decryptedFile := strings.TrimSuffix(encryptedFile, ".age")
+	meters := metersFrom(ctx)
+
+	if backend != nil {
+		remotePath := remote.DataPath(m.S3Prefix, m.TargetS3Path, manifest.PartFileName(partInfo.Index))
+		if partDownloaded(encryptedFile, partInfo) {
+			slog.Info("Part already downloaded", "part", partInfo.Index)
+		} else {
+			slog.Info("Downloading part from S3", "part", partInfo.Index, "remote", remotePath)
 
-			if err := copyFile(localEncrypted, encryptedFile); err != nil {
-				return fmt.Errorf("failed to copy part %s: %w", partInfo.Index, err)
+			partCtx := remote.WithProgress(ctx, downloadProgress(partInfo.Index, i+1, len(m.Parts)))
+			if err := meters.download.Time(func() error { return backend.Download(partCtx, remotePath, encryptedFile) }); err != nil {
+				return "", fmt.Errorf("failed to download part %s: %w", partInfo.Index, err)
 			}
+			events.Emit(ctx, events.Event{Stage: events.PartDownloaded, Part: partInfo.Index, Object: remotePath})
 		}
+	} else {
+		localEncrypted := localPartPath(cfg, m, opts.ManifestPath, partInfo.Index)
 
-		slog.Info("Decrypting and verifying part", "part", partInfo.Index)
+		slog.Info("Copying part from local", "part", partInfo.Index, "path", localEncrypted)
 
-		if err := crypto.DecryptAndVerify(encryptedFile, decryptedFile, partInfo.Blake3Hash, identity); err != nil {
-			return fmt.Errorf("failed to decrypt/verify part %s: %w", partInfo.Index, err)
+		if err := meters.download.Time(func() error { return copyFile(localEncrypted, encryptedFile, meters.download) }); err != nil {
+			return "", fmt.Errorf("failed to copy part %s: %w", partInfo.Index, err)
 		}
+		events.Emit(ctx, events.Event{Stage: events.PartDownloaded, Part: partInfo.Index, Object: localEncrypted})
+	}
 
-		decryptedParts[i] = decryptedFile
+	if err := checkPartSize(encryptedFile, partInfo); err != nil {
+		os.Remove(encryptedFile)
+		return "", err
 	}
 
-	mergedFile := filepath.Join(tempDir, "snapshot.merged")
-	slog.Info("Merging parts", "output", mergedFile)
+	slog.Info("Decrypting and verifying part", "part", partInfo.Index)
 
-	if err := mergeParts(decryptedParts, mergedFile); err != nil {
-		return fmt.Errorf("failed to merge parts: %w", err)
+	_, decryptSpan := tracing.Start(ctx, "restore.part.decrypt")
+	algorithm, expectedHash := partInfo.Hash()
+	err = crypto.DecryptAndVerify(encryptedFile, decryptedFile, algorithm, expectedHash, meters.decrypt, identities...)
+	tracing.End(decryptSpan, err)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt/verify part %s: %w", partInfo.Index, err)
 	}
+	events.Emit(ctx, events.Event{Stage: events.PartVerified, Part: partInfo.Index, Blake3: partInfo.Blake3Hash})
+	return decryptedFile, nil
+}
+
+// verifyStream checks the merged stream against the manifest's stream hash and returns the
+// algorithm and the hash.
+func verifyStream(ctx context.Context, m *manifest.Backup, mergedFile string) (_, _ string, err error) {
+	_, span := tracing.Start(ctx, "restore.verify_stream")
+	defer func() { tracing.End(span, err) }()
 
-	slog.Info("Verifying BLAKE3 hash")
+	algorithm, expectedHash := m.StreamHash()
+	slog.Info("Verifying stream hash", "algorithm", algorithm)
 
-	actualBlake3, err := crypto.BLAKE3File(mergedFile)
+	actualHash, err := crypto.HashFile(algorithm, mergedFile)
 	if err != nil {
-		return fmt.Errorf("failed to calculate BLAKE3: %w", err)
+		return "", "", fmt.Errorf("failed to calculate %s: %w", strings.ToUpper(algorithm), err)
 	}
 
-	if actualBlake3 != m.Blake3Hash {
-		return fmt.Errorf("BLAKE3 mismatch: expected %s, got %s", m.Blake3Hash, actualBlake3)
+	if actualHash != expectedHash {
+		return "", "", fmt.Errorf("%s mismatch: expected %s, got %s", strings.ToUpper(algorithm), expectedHash, actualHash)
 	}
 
-	slog.Info("BLAKE3 verified", "hash", actualBlake3)
+	slog.Info("Stream hash verified", "algorithm", algorithm, "hash", actualHash)
+	return algorithm, actualHash, nil
+}
 
-	slog.Info("Executing ZFS receive", "target", target)
+// partDownloaded reports whether a previous attempt left a complete, matching copy of the encrypted part.
+func partDownloaded(path string, part manifest.PartInfo) bool {
+	if _, err := os.Stat(path); err != nil {
+		return false
+	}
+	if err := checkPartSize(path, part); err != nil {
+		slog.Info("Downloading part again", "part", part.Index, "reason", err)
+		os.Remove(path)
+		return false
+	}
+	algorithm, expected := part.Hash()
+	actual, err := crypto.HashFile(algorithm, path)
+	if err == nil && actual == expected {
+		return true
+	}
+	os.Remove(path)
+	return false
+}
 
-	if err := executeZfsReceive(mergedFile, target, force); err != nil {
-		return fmt.Errorf("ZFS receive failed: %w", err)
+// checkPartSize compares the size of the encrypted part at path with the manifest, so a truncated
+// download fails before it is hashed. Parts of manifests that recorded no size pass.
+func checkPartSize(path string, part manifest.PartInfo) error {
+	if part.SizeBytes == 0 {
+		return nil
 	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat part %s: %w", part.Index, err)
+	}
+	if info.Size() != part.SizeBytes {
+		return fmt.Errorf("part %s has %d bytes, the manifest records %d: truncated or wrong download", part.Index, info.Size(), part.SizeBytes)
+	}
+	return nil
+}
 
-	if err := verifyRestoredSnapshot(target, m.TargetSnapshot); err != nil {
-		return fmt.Errorf("restore verification failed: %w", err)
+// downloadProgress logs a part's download progress in 10% steps.
+func downloadProgress(index string, n, total int) remote.ProgressFunc {
+	lastStep := int64(-1)
+	return func(done, size int64) {
+		if size <= 0 {
+			return
+		}
+		step := done * 10 / size
+		if step == lastStep {
+			return
+		}
+		lastStep = step
+		slog.Info("Download progress", "part", index, "partNumber", n, "parts", total, "bytes", done, "size", size, "percent", step*10)
 	}
+}
 
-	slog.Info("Restore completed successfully!")
+// keepDownloads removes decrypted and merged data after a failed restore but keeps encrypted
+// and partially downloaded parts so the next attempt can resume.
+func keepDownloads(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasSuffix(name, ".age") || strings.HasSuffix(name, ".partial") || strings.HasSuffix(name, ".partial.etag") {
+			continue
+		}
+		os.RemoveAll(filepath.Join(dir, name))
+	}
+	slog.Info("Kept downloaded parts for the next restore attempt", "path", dir)
+}
 
-	return nil
+type originResult struct {
+	OriginalHost string
+	CurrentHost  string
+	Err          error
+	Warning      string
+}
+
+// checkKey fails fast when the identities cannot decrypt the backup, before any part is downloaded.
+func checkKey(m *manifest.Backup, identities []age.Identity) error {
+	var expected []string
+	for _, r := range m.Recipients() {
+		expected = append(expected, crypto.NormalizeRecipient(r))
+	}
+	if len(expected) == 0 {
+		return fmt.Errorf("manifest has no age_public_key to check the private key against (use --skip-key-check to restore anyway)")
+	}
+
+	var got []string
+	for _, identity := range identities {
+		r, ok := crypto.IdentityRecipient(identity)
+		if !ok {
+			// Plugin identities do not reveal their recipient; decryption will tell.
+			slog.Warn("Cannot check plugin identity against the manifest recipients")
+			return nil
+		}
+		r = crypto.NormalizeRecipient(r)
+		if slices.Contains(expected, r) {
+			return nil
+		}
+		got = append(got, r)
+	}
+	return fmt.Errorf("the provided private key does not correspond to any recipient that encrypted this backup (expected %s, got %s)",
+		strings.Join(expected, ", "), strings.Join(got, ", "))
 }
 
-func copyFile(src, dst string) error {
+// checkOrigin guards against restoring over the original dataset by mistake.
+func checkOrigin(m *manifest.Backup, target, currentHost string, allowCrossHost, force bool) originResult {
+	result := originResult{OriginalHost: m.System.Hostname, CurrentHost: currentHost}
+	if target != m.Pool+"/"+m.Dataset {
+		return result
+	}
+
+	if m.System.Hostname != "" && m.System.Hostname != currentHost {
+		if !allowCrossHost {
+			result.Err = fmt.Errorf("target %s matches the original dataset of host %s, but this host is %s; pass --allow-cross-host to proceed",
+				target, m.System.Hostname, currentHost)
+		}
+		return result
+	}
+
+	if !force {
+		result.Warning = "Restoring over the original dataset on its original host"
+	}
+	return result
+}
+
+// localPartPath prefers parts sitting next to an explicitly given manifest over the dated task directory,
+// which is below the staging root the manifest records.
+func localPartPath(cfg *config.Config, m *manifest.Backup, manifestPath, index string) string {
+	if manifestPath != "" {
+		candidate := filepath.Join(filepath.Dir(manifestPath), manifest.PartFileName(index))
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate
+		}
+	}
+	stagingRoot := m.StagingDir
+	if stagingRoot == "" {
+		stagingRoot = cfg.BaseDir
+	}
+	return filepath.Join(stagingRoot, "task", m.Pool, m.Dataset,
+		fmt.Sprintf("level%d", m.BackupLevel), time.Unix(m.Datetime, 0).Format("20060102"),
+		manifest.PartFileName(index))
+}
+
+// copyFile copies src to dst, counting the bytes in meter.
+func copyFile(src, dst string, meter *throughput.Meter) error {
 	srcFile, err := os.Open(src)
 	if err != nil {
 		return err
 	}
 	defer srcFile.Close()
 
-	dstFile, err := os.Create(dst)
+	dstFile, err := util.CreatePart(dst)
 	if err != nil {
 		return err
 	}
 	defer dstFile.Close()
 
-	if _, err := io.Copy(dstFile, srcFile); err != nil {
+	if _, err := io.Copy(dstFile, meter.Reader(srcFile)); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func mergeParts(parts []string, outputFile string) error {
-	out, err := os.Create(outputFile)
+// mergePart writes a decrypted part to the end of the stream out and deletes it, with its
+// encrypted file, so consumed parts leave the scratch space right away.
+func mergePart(out io.Writer, partFile string) error {
+	part, err := os.Open(partFile)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to open part %s: %w", partFile, err)
 	}
-	defer out.Close()
+	defer part.Close()
 
-	for _, partFile := range parts {
-		part, err := os.Open(partFile)
-		if err != nil {
-			return fmt.Errorf("failed to open part %s: %w", partFile, err)
+	if _, err := io.Copy(out, part); err != nil {
+		return fmt.Errorf("failed to copy part %s: %w", partFile, err)
+	}
+	for _, path := range []string{partFile, partFile + ".age"} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			slog.Warn("Failed to remove consumed part", "path", path, "error", err)
 		}
+	}
+	return nil
+}
+
+// feedFile writes the stream feed produces to mergedFile, for a receive that reads it once it was
+// verified.
+func feedFile(mergedFile string, feed func(io.Writer) error) error {
+	out, err := util.OpenPart(mergedFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		return fmt.Errorf("failed to create merged stream: %w", err)
+	}
+	defer out.Close()
+	if err := feed(out); err != nil {
+		return err
+	}
+	return out.Close()
+}
 
-		if _, err := io.Copy(out, part); err != nil {
-			part.Close()
-			return fmt.Errorf("failed to copy part %s: %w", partFile, err)
+// chainManifest reads the task manifest of the backup at s3Path from source, to follow the
+// recorded parents of a backup.
+// chainLoader returns the loader manifest.ParentChain reads the parents of m with. A local parent
+// is looked up below the staging root its child recorded, which holds the whole chain unless
+// staging_dir changed between its levels.
+func chainLoader(ctx context.Context, cfg *config.Config, task *config.Task, source string, m *manifest.Backup) func(string) (*manifest.Backup, error) {
+	stagingDir := m.StagingDir
+	return func(s3Path string) (*manifest.Backup, error) {
+		parent, err := chainManifest(ctx, cfg, task, source, stagingDir, s3Path)
+		if err == nil {
+			stagingDir = parent.StagingDir
 		}
+		return parent, err
+	}
+}
+
+func chainManifest(ctx context.Context, cfg *config.Config, task *config.Task, source, stagingDir, s3Path string) (*manifest.Backup, error) {
+	if source != "s3" {
+		return manifest.Read(manifestLocation(cfg, task, source, stagingDir, s3Path))
+	}
+	tmp, err := os.CreateTemp("", "restore_parent_manifest_*.yaml")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
 
-		part.Close()
+	if err := downloadManifest(ctx, cfg, remote.ManifestPath(task.S3Prefix, s3Path, "task_manifest.yaml"), tmp.Name()); err != nil {
+		return nil, err
 	}
+	return manifest.Read(tmp.Name())
+}
 
-	return nil
+// manifestLocation is the --manifest that restores the backup at s3Path from source. A local
+// manifest is below stagingDir, the staging root a manifest recorded, or below the task root of
+// the current config for manifests that recorded none.
+func manifestLocation(cfg *config.Config, task *config.Task, source, stagingDir, s3Path string) string {
+	if source == "s3" {
+		return "s3://" + remote.ManifestPath(task.S3Prefix, s3Path, "task_manifest.yaml")
+	}
+	taskRoot := cfg.TaskRoot(task)
+	if stagingDir != "" {
+		taskRoot = filepath.Join(stagingDir, "task")
+	}
+	return filepath.Join(taskRoot, s3Path, "task_manifest.yaml")
 }
 
-func verifyRestoredSnapshot(target, originalSnapshot string) error {
-	parts := strings.SplitN(originalSnapshot, "@", 2)
-	if len(parts) != 2 {
-		return fmt.Errorf("cannot parse snapshot name from: %s", originalSnapshot)
+func downloadManifest(ctx context.Context, cfg *config.Config, remotePath, localPath string) error {
+	backend, err := remote.DefaultCache.Get(ctx, remote.OptionsFromConfig(cfg, cfg.ManifestStorageClass()))
+	if err != nil {
+		return fmt.Errorf("failed to initialize S3 backend: %w", err)
 	}
-	expected := target + "@" + parts[1]
-	cmd := exec.Command("zfs", "list", "-H", "-o", "name", "-t", "snapshot", expected)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("snapshot %s not found after restore: %w", expected, err)
+	slog.Info("Downloading task manifest from S3", "remote", remotePath)
+	if err := backend.Download(ctx, remotePath, localPath); err != nil {
+		return fmt.Errorf("failed to download task manifest %s: %w", remotePath, err)
 	}
-	slog.Info("Restored snapshot verified", "snapshot", expected)
 	return nil
 }
 
-func executeZfsReceive(snapshotFile, target string, force bool) error {
-	file, err := os.Open(snapshotFile)
+// formatLevels renders a restore chain as "0, 1, 2" for the dry run.
+func formatLevels(levels []int16) string {
+	parts := make([]string, len(levels))
+	for i, l := range levels {
+		parts[i] = strconv.Itoa(int(l))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// restoredSnapshotName is the name originalSnapshot gets when received into target.
+func restoredSnapshotName(target, originalSnapshot string) (string, error) {
+	name, err := zfs.ParseSnapshotName(originalSnapshot)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse snapshot name: %w", err)
+	}
+	return name.On(target).String(), nil
+}
+
+// destroyTarget removes a partially restored target after interactive confirmation.
+func destroyTarget(host targetHost, target string) error {
+	exists, err := host.datasetExists(target)
 	if err != nil {
-		return fmt.Errorf("failed to open snapshot file: %w", err)
+		return fmt.Errorf("failed to check target dataset: %w", err)
+	}
+	if !exists {
+		return nil
 	}
-	defer file.Close()
 
-	args := []string{"receive"}
-	if force {
-		args = append(args, "-F")
+	fmt.Printf("This will destroy %s and all of its snapshots.\nType the dataset name to confirm: ", target)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read confirmation: %w", err)
+	}
+	if strings.TrimSpace(answer) != target {
+		return fmt.Errorf("confirmation did not match, not destroying %s", target)
 	}
-	args = append(args, target)
 
-	cmd := exec.Command("zfs", args...)
-	cmd.Stdin = file
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	slog.Info("Destroying target dataset", "target", target)
+	return host.destroyRecursive(target)
+}
 
-	slog.Info("Running zfs receive", "target", target, "force", force)
+// restoreHoldTag is the hold on a received snapshot while restore verifies it.
+const restoreHoldTag = "zrb:restore"
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("zfs receive command failed: %w", err)
+// verifyRestoredSnapshot checks that the received snapshot is the one m backed up: it must exist,
+// carry the guid the manifest recorded and report a plausible written. A mismatch leaves the
+// target as it is, for inspection.
+func verifyRestoredSnapshot(host targetHost, target string, m *manifest.Backup) error {
+	expected, err := restoredSnapshotName(target, m.TargetSnapshot)
+	if err != nil {
+		return err
+	}
+	found, err := host.snapshotExists(expected)
+	if err != nil {
+		return host.explain(fmt.Errorf("failed to check snapshot %s after restore: %w", expected, err), target)
+	}
+	if !found {
+		return fmt.Errorf("snapshot %s not found after restore", expected)
 	}
 
+	if m.TargetSnapshotGUID == "" {
+		slog.Warn("Manifest records no snapshot guid, only the snapshot name was verified", "snapshot", expected)
+	} else {
+		guid, err := host.snapshotGUID(expected)
+		if err != nil {
+			return host.explain(err, target)
+		}
+		if guid != m.TargetSnapshotGUID {
+			return fmt.Errorf("snapshot %s has guid %s, but the backed up %s had guid %s: it is not the received backup, "+
+				"e.g. a snapshot of that name already existed on %s; the dataset was left in place for inspection",
+				expected, guid, m.TargetSnapshot, m.TargetSnapshotGUID, target)
+		}
+	}
+
+	written, err := host.written(expected)
+	if err != nil {
+		return host.explain(err, target)
+	}
+	if written < 0 {
+		return fmt.Errorf("snapshot %s reports written %d; the dataset was left in place for inspection", expected, written)
+	}
+	slog.Info("Restored snapshot verified", "snapshot", expected, "guid", m.TargetSnapshotGUID, "written", written)
+	return nil
+}
+
+// checkUploaded fails when the local last backup manifest says the backup at level was never
+// uploaded, before any S3 request. Hosts without the local manifest fall through to S3.
+func checkUploaded(cfg *config.Config, task *config.Task, level int16) error {
+	lastPath := filepath.Join(cfg.BaseDir, "run", task.Pool, task.Dataset, "last_backup_manifest.yaml")
+	last, err := manifest.ReadLast(lastPath)
+	if err != nil || last == nil || int(level) >= len(last.BackupLevels) || last.BackupLevels[level] == nil {
+		return nil
+	}
+	if last.BackupLevels[level].LocalOnly {
+		return fmt.Errorf("this backup was never uploaded, level %d of task %s is local-only; restore it with --source local", level, task.Name)
+	}
 	return nil
 }
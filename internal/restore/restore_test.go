@@ -0,0 +1,684 @@
+package restore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"zrb/internal/config"
+	"zrb/internal/crypto"
+	"zrb/internal/events"
+	"zrb/internal/manifest"
+	"zrb/internal/throughput"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppendAndReadHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run", historyFileName)
+
+	require.NoError(t, appendHistory(path, &HistoryEntry{Timestamp: 1, Task: "t", Level: 0, Outcome: "success"}))
+	require.NoError(t, appendHistory(path, &HistoryEntry{Timestamp: 2, Task: "t", Level: 1, Outcome: "failed", Error: "boom"}))
+
+	entries, err := readHistory(path)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, int64(1), entries[0].Timestamp)
+	assert.Equal(t, "failed", entries[1].Outcome)
+	assert.Equal(t, "boom", entries[1].Error)
+}
+
+func TestReadHistoryMissing(t *testing.T) {
+	entries, err := readHistory(filepath.Join(t.TempDir(), historyFileName))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestRotateHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), historyFileName)
+	require.NoError(t, os.WriteFile(path, make([]byte, historyMaxSize), 0o644))
+
+	require.NoError(t, appendHistory(path, &HistoryEntry{Timestamp: 3, Outcome: "success"}))
+
+	_, err := os.Stat(path + ".1")
+	require.NoError(t, err)
+
+	entries, err := readHistory(path)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, int64(3), entries[0].Timestamp)
+}
+
+func TestLocalPartPath(t *testing.T) {
+	cfg := &config.Config{BaseDir: "/base"}
+	m := &manifest.Backup{Pool: "p", Dataset: "d", BackupLevel: 1, Datetime: time.Date(2024, 1, 15, 12, 0, 0, 0, time.Local).Unix()}
+
+	t.Run("dated task directory", func(t *testing.T) {
+		got := localPartPath(cfg, m, "", "aaaaab")
+		assert.Equal(t, "/base/task/p/d/level1/20240115/snapshot.part-aaaaab.age", got)
+	})
+
+	t.Run("recorded staging_dir", func(t *testing.T) {
+		staged := *m
+		staged.StagingDir = "/scratch"
+		got := localPartPath(cfg, &staged, "", "aaaaab")
+		assert.Equal(t, "/scratch/task/p/d/level1/20240115/snapshot.part-aaaaab.age", got)
+	})
+
+	t.Run("next to manifest", func(t *testing.T) {
+		dir := t.TempDir()
+		part := filepath.Join(dir, "snapshot.part-aaaaab.age")
+		require.NoError(t, os.WriteFile(part, nil, 0o644))
+
+		got := localPartPath(cfg, m, filepath.Join(dir, "task_manifest.yaml"), "aaaaab")
+		assert.Equal(t, part, got)
+	})
+}
+
+func TestCheckOrigin(t *testing.T) {
+	m := &manifest.Backup{Pool: "tank", Dataset: "data"}
+	m.System.Hostname = "prod"
+
+	tests := []struct {
+		name           string
+		target         string
+		host           string
+		allowCrossHost bool
+		force          bool
+		wantErr        bool
+		wantWarning    bool
+	}{
+		{name: "different target", target: "backup/data", host: "dr"},
+		{name: "different target with force", target: "backup/data", host: "prod", force: true},
+		{name: "cross host blocked", target: "tank/data", host: "dr", wantErr: true},
+		{name: "cross host blocked even with force", target: "tank/data", host: "dr", force: true, wantErr: true},
+		{name: "cross host allowed", target: "tank/data", host: "dr", allowCrossHost: true},
+		{name: "same host warns", target: "tank/data", host: "prod", wantWarning: true},
+		{name: "same host allow-cross-host still warns", target: "tank/data", host: "prod", allowCrossHost: true, wantWarning: true},
+		{name: "same host with force", target: "tank/data", host: "prod", force: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := checkOrigin(m, tt.target, tt.host, tt.allowCrossHost, tt.force)
+			assert.Equal(t, "prod", got.OriginalHost)
+			assert.Equal(t, tt.host, got.CurrentHost)
+			if tt.wantErr {
+				assert.ErrorContains(t, got.Err, "--allow-cross-host")
+			} else {
+				assert.NoError(t, got.Err)
+			}
+			assert.Equal(t, tt.wantWarning, got.Warning != "")
+		})
+	}
+
+	t.Run("unknown original host", func(t *testing.T) {
+		unknown := &manifest.Backup{Pool: "tank", Dataset: "data"}
+		got := checkOrigin(unknown, "tank/data", "dr", false, false)
+		assert.NoError(t, got.Err)
+		assert.NotEmpty(t, got.Warning)
+	})
+}
+
+func TestRestoredSnapshotName(t *testing.T) {
+	got, err := restoredSnapshotName("backup/restored", "tank/data@zrb_level1_2024-01-01_00-00")
+	require.NoError(t, err)
+	assert.Equal(t, "backup/restored@zrb_level1_2024-01-01_00-00", got)
+
+	got, err = restoredSnapshotName("backup/my restore", "tank/a/b@weekly 1")
+	require.NoError(t, err)
+	assert.Equal(t, "backup/my restore@weekly 1", got)
+
+	_, err = restoredSnapshotName("backup/restored", "tank/data")
+	assert.ErrorContains(t, err, "no '@'")
+}
+
+func TestCheckKey(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	own := identity.Recipient().String()
+
+	assert.NoError(t, checkKey(&manifest.Backup{AgePublicKey: own}, []age.Identity{identity}))
+	assert.NoError(t, checkKey(&manifest.Backup{AgePublicKey: other.Recipient().String() + ", " + own}, []age.Identity{identity}))
+
+	err = checkKey(&manifest.Backup{AgePublicKey: other.Recipient().String()}, []age.Identity{identity})
+	assert.ErrorContains(t, err, "does not correspond")
+	assert.ErrorContains(t, err, own)
+
+	assert.ErrorContains(t, checkKey(&manifest.Backup{}, []age.Identity{identity}), "--skip-key-check")
+}
+
+func TestCheckUploaded(t *testing.T) {
+	cfg := &config.Config{BaseDir: t.TempDir()}
+	task := &config.Task{Name: "t", Pool: "tank", Dataset: "data"}
+
+	assert.NoError(t, checkUploaded(cfg, task, 0), "no local manifest falls through to S3")
+
+	lastPath := filepath.Join(cfg.BaseDir, "run", "tank", "data", "last_backup_manifest.yaml")
+	require.NoError(t, os.MkdirAll(filepath.Dir(lastPath), 0o755))
+	require.NoError(t, manifest.WriteLast(lastPath, &manifest.Last{BackupLevels: []*manifest.Ref{
+		{Snapshot: "tank/data@zrb_level0_a"},
+		{Snapshot: "tank/data@zrb_level1_a", LocalOnly: true},
+	}}))
+
+	assert.NoError(t, checkUploaded(cfg, task, 0))
+	assert.ErrorContains(t, checkUploaded(cfg, task, 1), "this backup was never uploaded")
+	assert.NoError(t, checkUploaded(cfg, task, 2))
+}
+
+func TestPartDownloadedChecksSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.part-aaaaaa.age")
+	require.NoError(t, os.WriteFile(path, []byte("encrypted"), 0o644))
+	hash, err := crypto.BLAKE3File(path)
+	require.NoError(t, err)
+
+	assert.NoError(t, checkPartSize(path, manifest.PartInfo{Index: "aaaaaa"}), "an unknown size passes")
+	assert.NoError(t, checkPartSize(path, manifest.PartInfo{Index: "aaaaaa", SizeBytes: 9}))
+	assert.ErrorContains(t, checkPartSize(path, manifest.PartInfo{Index: "aaaaaa", SizeBytes: 20}), "part aaaaaa has 9 bytes, the manifest records 20")
+
+	assert.True(t, partDownloaded(path, manifest.PartInfo{Index: "aaaaaa", Blake3Hash: hash, SizeBytes: 9}))
+	assert.False(t, partDownloaded(path, manifest.PartInfo{Index: "aaaaaa", Blake3Hash: hash, SizeBytes: 20}))
+	assert.NoFileExists(t, path, "a copy of the wrong size is downloaded again")
+}
+
+func TestDecryptChunk(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "chunk")
+	require.NoError(t, os.WriteFile(plain, []byte("zfs send stream"), 0o644))
+	require.NoError(t, crypto.Encrypt(plain, plain+".age", identity.Recipient()))
+	hash, err := crypto.BLAKE3File(plain)
+	require.NoError(t, err)
+
+	meter := &throughput.Meter{}
+	data, err := decryptChunk(plain+".age", manifest.ChunkInfo{Blake3Hash: hash, Size: 15}, []age.Identity{identity}, meter)
+	require.NoError(t, err)
+	assert.Equal(t, "zfs send stream", string(data))
+	assert.Equal(t, int64(15), meter.Bytes())
+
+	_, err = decryptChunk(plain+".age", manifest.ChunkInfo{Blake3Hash: hash, Size: 16}, []age.Identity{identity}, nil)
+	assert.ErrorContains(t, err, "has 15 bytes, expected 16")
+
+	_, err = decryptChunk(plain+".age", manifest.ChunkInfo{Blake3Hash: strings.Repeat("0", 64), Size: 15}, []age.Identity{identity}, nil)
+	assert.ErrorContains(t, err, "BLAKE3 mismatch")
+}
+
+func TestRunRejectsLevelWithoutStorageClass(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base")
+	configPath := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+s3:
+  enabled: true
+  bucket: b
+  region: us-east-1
+  prefix: p
+  storage_class:
+    manifest: STANDARD
+    backup_data: [STANDARD]
+tasks:
+  - name: t
+    pool: tank
+    dataset: data
+    enabled: true
+`, base)), 0o644))
+
+	for level, want := range map[int16]string{
+		1:  "s3.storage_class.backup_data defines storage classes for levels 0 to 0, not for backup level 1",
+		-1: "invalid backup level -1",
+	} {
+		err := Run(context.Background(), Options{ConfigPath: configPath, TaskName: "t", Level: level, Target: "tank/restored", Source: "s3"})
+		require.EqualError(t, err, want)
+		assert.NoDirExists(t, filepath.Join(base, "tmp"), "no scratch space is created")
+	}
+}
+
+// fakeZFS puts a zfs script first in PATH that receives into a marker file and reports the
+// restored snapshot only once it was received.
+// fakeZFS puts a zfs script first in PATH that stores what it receives in the returned file and
+// lists a snapshot once it exists. Snapshots have the guid FAKE_ZFS_GUID (default 1234567890) and
+// written FAKE_ZFS_WRITTEN (default 1024).
+func fakeZFS(t *testing.T) string {
+	t.Helper()
+	bin := t.TempDir()
+	received := filepath.Join(bin, "received")
+	script := fmt.Sprintf(`#!/bin/sh
+case "$1" in
+list)
+	case "$*" in
+	*snapshot*) [ -f %[1]q ] || { echo "dataset does not exist" >&2; exit 1; } ;;
+	esac ;;
+get)
+	case "$*" in
+	*guid*) echo "${FAKE_ZFS_GUID:-1234567890}" ;;
+	*written*) echo "${FAKE_ZFS_WRITTEN:-1024}" ;;
+	esac ;;
+receive) cat > %[1]q ;;
+esac
+`, received)
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "zfs"), []byte(script), 0o755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return received
+}
+
+func TestVerifyRestoredSnapshot(t *testing.T) {
+	received := fakeZFS(t)
+	m := &manifest.Backup{TargetSnapshot: "tank/data@zrb_level0_2024-01-15_00-00", TargetSnapshotGUID: "1234567890"}
+
+	assert.ErrorContains(t, verifyRestoredSnapshot(localHost{}, "tank/restored", m), "snapshot tank/restored@zrb_level0_2024-01-15_00-00 not found after restore")
+
+	require.NoError(t, os.WriteFile(received, []byte("stream"), 0o644))
+	assert.NoError(t, verifyRestoredSnapshot(localHost{}, "tank/restored", m))
+
+	t.Setenv("FAKE_ZFS_GUID", "987654321")
+	err := verifyRestoredSnapshot(localHost{}, "tank/restored", m)
+	assert.ErrorContains(t, err, "snapshot tank/restored@zrb_level0_2024-01-15_00-00 has guid 987654321, but the backed up tank/data@zrb_level0_2024-01-15_00-00 had guid 1234567890")
+	assert.ErrorContains(t, err, "left in place for inspection")
+	assert.FileExists(t, received)
+
+	assert.NoError(t, verifyRestoredSnapshot(localHost{}, "tank/restored", &manifest.Backup{TargetSnapshot: m.TargetSnapshot}),
+		"manifests without a guid only verify the name")
+
+	t.Setenv("FAKE_ZFS_GUID", "1234567890")
+	t.Setenv("FAKE_ZFS_WRITTEN", "-1")
+	assert.ErrorContains(t, verifyRestoredSnapshot(localHost{}, "tank/restored", m), "reports written -1")
+	t.Setenv("FAKE_ZFS_WRITTEN", "-")
+	assert.ErrorContains(t, verifyRestoredSnapshot(localHost{}, "tank/restored", m), `unexpected written of tank/restored@zrb_level0_2024-01-15_00-00: "-"`)
+}
+
+func TestRunEmitsEvents(t *testing.T) {
+	tests := []struct {
+		name   string
+		safe   bool
+		stages []events.Stage
+	}{
+		{
+			name: "streamed",
+			stages: []events.Stage{
+				events.RestoreStarted,
+				events.ReceiveStarted,
+				events.PartDownloaded,
+				events.PartVerified,
+				events.ReceiveCompleted,
+				events.RestoreCompleted,
+			},
+		},
+		{
+			name: "safe",
+			safe: true,
+			stages: []events.Stage{
+				events.RestoreStarted,
+				events.PartDownloaded,
+				events.PartVerified,
+				events.ReceiveStarted,
+				events.ReceiveCompleted,
+				events.RestoreCompleted,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeZFS(t)
+
+			identity, err := age.GenerateX25519Identity()
+			require.NoError(t, err)
+			dir := t.TempDir()
+			keyPath := filepath.Join(dir, "key")
+			require.NoError(t, os.WriteFile(keyPath, []byte(identity.String()+"\n"), 0o600))
+
+			// A one-part level 0 backup next to its manifest
+			backupDir := filepath.Join(dir, "backup")
+			require.NoError(t, os.MkdirAll(backupDir, 0o755))
+			rawPart := filepath.Join(backupDir, "snapshot.part-aaaaaa")
+			require.NoError(t, os.WriteFile(rawPart, []byte("zfs send stream"), 0o644))
+			streamHash, err := crypto.BLAKE3File(rawPart)
+			require.NoError(t, err)
+			partHash, _, err := crypto.ProcessPart(context.Background(), rawPart, identity.Recipient())
+			require.NoError(t, err)
+
+			manifestPath := filepath.Join(backupDir, "task_manifest.yaml")
+			require.NoError(t, manifest.Write(manifestPath, &manifest.Backup{
+				Datetime:           time.Now().Unix(),
+				Pool:               "tank",
+				Dataset:            "data",
+				TargetSnapshot:     "tank/data@zrb_level0_2024-01-15_00-00",
+				TargetSnapshotGUID: "1234567890",
+				AgePublicKey:       identity.Recipient().String(),
+				Blake3Hash:         streamHash,
+				Parts:              []manifest.PartInfo{{Index: "aaaaaa", Blake3Hash: partHash}},
+			}))
+
+			eventsPath := filepath.Join(dir, "events.jsonl")
+			configPath := filepath.Join(dir, "config.yaml")
+			require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: %s
+s3:
+  enabled: false
+  bucket: ""
+  region: ""
+  prefix: ""
+  storage_class:
+    manifest: STANDARD
+    backup_data: [STANDARD]
+events:
+  file: %s
+tasks:
+  - name: t
+    pool: tank
+    dataset: data
+    enabled: true
+`, filepath.Join(dir, "base"), identity.Recipient(), eventsPath)), 0o644))
+
+			require.NoError(t, Run(context.Background(), Options{
+				ConfigPath:     configPath,
+				TaskName:       "t",
+				Target:         "tank/restored",
+				PrivateKeyPath: keyPath,
+				Source:         "local",
+				ManifestPath:   manifestPath,
+				Safe:           tt.safe,
+			}))
+
+			data, err := os.ReadFile(eventsPath)
+			require.NoError(t, err)
+
+			var stages []events.Stage
+			for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+				var e events.Event
+				require.NoError(t, json.Unmarshal([]byte(line), &e))
+				assert.Equal(t, "tank/restored", e.Target)
+				stages = append(stages, e.Stage)
+			}
+			assert.Equal(t, tt.stages, stages)
+
+			history, err := readHistory(historyPath(filepath.Join(dir, "base"), "tank", "data"))
+			require.NoError(t, err)
+			require.Len(t, history, 1)
+			assert.Equal(t, []string{"zfs", "receive", "tank/restored"}, history[0].ReceiveArgs)
+
+			encrypted, err := os.Stat(filepath.Join(backupDir, "snapshot.part-aaaaaa.age"))
+			require.NoError(t, err)
+			require.NotNil(t, history[0].Throughput)
+			assert.Equal(t, encrypted.Size(), history[0].Throughput.Download.Bytes, "the local part copy counts as the download")
+			assert.Equal(t, int64(15), history[0].Throughput.Decrypt.Bytes)
+			assert.Equal(t, int64(15), history[0].Throughput.Receive.Bytes, "the stream written to zfs receive")
+			assert.Positive(t, history[0].Throughput.Decrypt.Seconds)
+		})
+	}
+}
+
+func TestRunFailedFeedFetchesReadPartsAgain(t *testing.T) {
+	received := fakeZFS(t)
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "key")
+	require.NoError(t, os.WriteFile(keyPath, []byte(identity.String()+"\n"), 0o600))
+
+	// A two-part level 0 backup whose second part went missing
+	backupDir := filepath.Join(dir, "backup")
+	require.NoError(t, os.MkdirAll(backupDir, 0o755))
+	streamFile := filepath.Join(dir, "stream")
+	require.NoError(t, os.WriteFile(streamFile, []byte("zfs send stream"), 0o644))
+	streamHash, err := crypto.BLAKE3File(streamFile)
+	require.NoError(t, err)
+	var parts []manifest.PartInfo
+	for _, p := range []struct{ index, data string }{{"aaaaaa", "zfs send"}, {"aaaaab", " stream"}} {
+		rawPart := filepath.Join(backupDir, "snapshot.part-"+p.index)
+		require.NoError(t, os.WriteFile(rawPart, []byte(p.data), 0o644))
+		partHash, _, err := crypto.ProcessPart(context.Background(), rawPart, identity.Recipient())
+		require.NoError(t, err)
+		parts = append(parts, manifest.PartInfo{Index: p.index, Blake3Hash: partHash})
+	}
+	missing := filepath.Join(backupDir, "snapshot.part-aaaaab.age")
+	require.NoError(t, os.Rename(missing, missing+".moved"))
+
+	datetime := time.Now().Unix()
+	manifestPath := filepath.Join(backupDir, "task_manifest.yaml")
+	require.NoError(t, manifest.Write(manifestPath, &manifest.Backup{
+		Datetime:           datetime,
+		Pool:               "tank",
+		Dataset:            "data",
+		TargetSnapshot:     "tank/data@zrb_level0_2024-01-15_00-00",
+		TargetSnapshotGUID: "1234567890",
+		AgePublicKey:       identity.Recipient().String(),
+		Blake3Hash:         streamHash,
+		Parts:              parts,
+	}))
+
+	// One worker, so the first part is fed to zfs receive before the second is copied.
+	configPath := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: %s
+workers: 1
+s3:
+  enabled: false
+  bucket: ""
+  region: ""
+  prefix: ""
+  storage_class:
+    manifest: STANDARD
+    backup_data: [STANDARD]
+tasks:
+  - name: t
+    pool: tank
+    dataset: data
+    enabled: true
+`, filepath.Join(dir, "base"), identity.Recipient())), 0o644))
+
+	opts := Options{
+		ConfigPath:     configPath,
+		TaskName:       "t",
+		Target:         "tank/restored",
+		PrivateKeyPath: keyPath,
+		Source:         "local",
+		ManifestPath:   manifestPath,
+		WorkDir:        filepath.Join(dir, "scratch"),
+	}
+	err = Run(context.Background(), opts)
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "failed to copy part aaaaab")
+	assert.ErrorContains(t, err, "It fetches again the parts zfs receive already read, which were deleted")
+
+	// The part zfs receive read is gone from the scratch directory, as the message says.
+	scratch := filepath.Join(dir, "scratch", fmt.Sprintf("restore_t_0_%d", datetime))
+	entries, err := os.ReadDir(scratch)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// The fake zfs does not destroy what the failed receive left, so drop it by hand.
+	require.NoError(t, os.Remove(received))
+	require.NoError(t, os.Rename(missing+".moved", missing))
+	require.NoError(t, Run(context.Background(), opts))
+	data, err := os.ReadFile(received)
+	require.NoError(t, err)
+	assert.Equal(t, "zfs send stream", string(data), "the rerun fetches the first part again")
+	assert.NoDirExists(t, scratch)
+}
+
+func TestFetchParts(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	backupDir := t.TempDir()
+	m := &manifest.Backup{}
+	var stream string
+	for i := range 6 {
+		index := fmt.Sprintf("aaaaa%c", 'a'+i)
+		raw := filepath.Join(backupDir, "snapshot.part-"+index)
+		data := strings.Repeat(index, 100*(6-i))
+		stream += data
+		require.NoError(t, os.WriteFile(raw, []byte(data), 0o644))
+		hash, _, err := crypto.ProcessPart(context.Background(), raw, identity.Recipient())
+		require.NoError(t, err)
+		m.Parts = append(m.Parts, manifest.PartInfo{Index: index, Blake3Hash: hash})
+	}
+	opts := Options{Source: "local", ManifestPath: filepath.Join(backupDir, "task_manifest.yaml")}
+	identities := []age.Identity{identity}
+
+	tempDir := t.TempDir()
+	var merged bytes.Buffer
+	require.NoError(t, fetchParts(context.Background(), &config.Config{}, m, opts, "", identities, tempDir, &merged, 3))
+	assert.Equal(t, stream, merged.String(), "parts fetched in parallel are merged in index order")
+	entries, err := os.ReadDir(tempDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "consumed parts are deleted")
+
+	m.Parts[4].Blake3Hash = strings.Repeat("0", 64)
+	err = fetchParts(context.Background(), &config.Config{}, m, opts, "", identities, t.TempDir(), io.Discard, 3)
+	assert.ErrorContains(t, err, "failed to decrypt/verify part aaaaae")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = fetchParts(ctx, &config.Config{}, m, opts, "", identities, t.TempDir(), io.Discard, 3)
+	assert.ErrorContains(t, err, "restore cancelled")
+}
+
+func TestRunChain(t *testing.T) {
+	// The fake zfs lists a snapshot once a received stream named it.
+	bin := t.TempDir()
+	received := filepath.Join(bin, "received")
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "zfs"), []byte(fmt.Sprintf(`#!/bin/sh
+case "$1" in
+list)
+	case "$*" in
+	*snapshot*) for a; do last=$a; done; grep -qF "@${last#*@}" %[1]q 2>/dev/null || { echo "dataset does not exist" >&2; exit 1; } ;;
+	esac ;;
+get) echo 1024 ;;
+receive) cat >> %[1]q ;;
+esac
+`, received)), 0o755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base")
+	keyPath := filepath.Join(dir, "key")
+	require.NoError(t, os.WriteFile(keyPath, []byte(identity.String()+"\n"), 0o600))
+
+	// writeBackup stores a one-part backup of level in the task directory, based on the backup of
+	// the level below taken on parentDate.
+	writeBackup := func(level int16, date, parentDate string) string {
+		s3Path := fmt.Sprintf("tank/data/level%d/%s", level, date)
+		backupDir := filepath.Join(base, "task", s3Path)
+		require.NoError(t, os.MkdirAll(backupDir, 0o755))
+		snapshot := fmt.Sprintf("tank/data@zrb_level%d_%s", level, date)
+		rawPart := filepath.Join(backupDir, "snapshot.part-aaaaaa")
+		require.NoError(t, os.WriteFile(rawPart, []byte("stream of "+snapshot+"\n"), 0o644))
+		streamHash, err := crypto.BLAKE3File(rawPart)
+		require.NoError(t, err)
+		partHash, _, err := crypto.ProcessPart(context.Background(), rawPart, identity.Recipient())
+		require.NoError(t, err)
+		m := &manifest.Backup{
+			Datetime: time.Now().Unix(), Pool: "tank", Dataset: "data", BackupLevel: level,
+			TargetSnapshot: snapshot, TargetS3Path: s3Path, StagingDir: base,
+			AgePublicKey: identity.Recipient().String(), Blake3Hash: streamHash,
+			Parts: []manifest.PartInfo{{Index: "aaaaaa", Blake3Hash: partHash}},
+		}
+		if parentDate != "" {
+			m.ParentS3Path = fmt.Sprintf("tank/data/level%d/%s", level-1, parentDate)
+			m.ParentSnapshot = fmt.Sprintf("tank/data@zrb_level%d_%s", level-1, parentDate)
+		}
+		manifestPath := filepath.Join(backupDir, "task_manifest.yaml")
+		require.NoError(t, manifest.Write(manifestPath, m))
+		return manifestPath
+	}
+
+	configPath := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: %s
+tasks:
+  - name: t
+    pool: tank
+    dataset: data
+    enabled: true
+`, base, identity.Recipient())), 0o644))
+
+	writeBackup(0, "20240115", "")
+	level2 := writeBackup(2, "20240117", "20240116")
+	opts := Options{ConfigPath: configPath, TaskName: "t", Level: 2, Target: "tank/restored", PrivateKeyPath: keyPath, Source: "local", ManifestPath: level2, Chain: true}
+
+	err = Run(context.Background(), opts)
+	assert.ErrorContains(t, err, "cannot restore the chain of level 2: failed to load parent backup tank/data/level1/20240116")
+	assert.NoFileExists(t, received, "nothing is received while a level is missing")
+
+	writeBackup(1, "20240116", "20240115")
+	require.NoError(t, os.WriteFile(received, []byte("stream of tank/data@zrb_level0_20240115\n"), 0o644))
+	require.NoError(t, Run(context.Background(), opts))
+
+	data, err := os.ReadFile(received)
+	require.NoError(t, err)
+	assert.Equal(t, "stream of tank/data@zrb_level0_20240115\nstream of tank/data@zrb_level1_20240116\nstream of tank/data@zrb_level2_20240117\n",
+		string(data), "level 0 was already received, levels 1 and 2 follow in order")
+
+	history, err := readHistory(historyPath(base, "tank", "data"))
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, []int16{1, 2}, history[1].ReceivedLevels)
+	assert.Equal(t, 2, history[1].PartsVerified)
+
+	// After staging_dir moves, the parents are still found below the root the manifests recorded.
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+staging_dir: %s
+age_public_key: %s
+tasks:
+  - name: t
+    pool: tank
+    dataset: data
+    enabled: true
+`, base, t.TempDir(), identity.Recipient())), 0o644))
+	require.NoError(t, os.Remove(received))
+	require.NoError(t, Run(context.Background(), opts))
+	data, err = os.ReadFile(received)
+	require.NoError(t, err)
+	assert.Equal(t, "stream of tank/data@zrb_level0_20240115\nstream of tank/data@zrb_level1_20240116\nstream of tank/data@zrb_level2_20240117\n", string(data))
+
+	cfg, err := config.Load(configPath)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(base, "task", "tank/data/level1/20240116", "task_manifest.yaml"),
+		manifestLocation(cfg, &cfg.Tasks[0], "local", base, "tank/data/level1/20240116"))
+}
+
+func TestCheckChecksums(t *testing.T) {
+	h := func(c byte) string { return strings.Repeat(string(c), 64) }
+	parts := []manifest.PartInfo{{Index: "aaaaaa", Blake3Hash: h('a')}, {Index: "aaaaab", Blake3Hash: h('b')}}
+	m := &manifest.Backup{Parts: parts, ChecksumsBlake3: manifest.PartChecksumsDigest(parts)}
+
+	manifestPath := filepath.Join(t.TempDir(), "restore_manifest_t_level0.yaml")
+	require.NoError(t, manifest.Write(manifestPath, m))
+	manifestHash, err := crypto.BLAKE3File(manifestPath)
+	require.NoError(t, err)
+
+	file := func(entries ...manifest.Checksum) []byte { return manifest.FormatChecksums(entries) }
+	manifestLine := manifest.Checksum{Hash: manifestHash, Name: "task_manifest.yaml"}
+	partA := manifest.Checksum{Hash: h('a'), Name: "snapshot.part-aaaaaa.age"}
+	partB := manifest.Checksum{Hash: h('b'), Name: "snapshot.part-aaaaab.age"}
+
+	assert.NoError(t, checkChecksums(m, file(partA, partB, manifestLine), manifestPath))
+
+	assert.ErrorContains(t, checkChecksums(m, file(partA, manifestLine), manifestPath), "do not match the manifest")
+	assert.ErrorContains(t, checkChecksums(m, file(partA, manifest.Checksum{Hash: h('c'), Name: partB.Name}, manifestLine), manifestPath), "do not match the manifest")
+	assert.ErrorContains(t, checkChecksums(m, file(partA, partB), manifestPath), "no line for the task manifest")
+	assert.ErrorContains(t, checkChecksums(m, file(partA, partB, manifest.Checksum{Hash: h('d'), Name: "task_manifest.yaml"}), manifestPath), "does not match the task manifest")
+
+	tampered := *m
+	tampered.ChecksumsBlake3 = h('e')
+	assert.ErrorContains(t, checkChecksums(&tampered, file(partA, partB, manifestLine), manifestPath), "checksums_blake3")
+
+	assert.ErrorContains(t, checkChecksums(&manifest.Backup{Parts: parts}, nil, manifestPath), "written before checksum files existed")
+}
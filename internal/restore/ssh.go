@@ -0,0 +1,257 @@
+package restore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"zrb/internal/zfs"
+)
+
+// sshHost receives on the host given with --receive-via-ssh. Its commands run as `ssh destination
+// command` with an explicit argv and share one connection: connect starts an ssh control master
+// in controlDir, which close shuts down.
+type sshHost struct {
+	destination string
+	// options are passed to ssh as -o options, e.g. Port=2222 or IdentityFile=~/.ssh/restore.
+	options    []string
+	controlDir string
+	connected  bool
+}
+
+func newSSHHost(destination string, options []string) (*sshHost, error) {
+	if destination == "" || strings.HasPrefix(destination, "-") || strings.ContainsFunc(destination, isSpace) {
+		return nil, fmt.Errorf("invalid --receive-via-ssh destination %q, expected user@host", destination)
+	}
+	for _, o := range options {
+		if strings.HasPrefix(o, "-") || !strings.Contains(o, "=") {
+			return nil, fmt.Errorf("invalid --ssh-option %q, expected an ssh_config option such as Port=2222", o)
+		}
+	}
+	controlDir, err := os.MkdirTemp("", "zrb-ssh-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ssh control directory: %w", err)
+	}
+	return &sshHost{destination: destination, options: options, controlDir: controlDir}, nil
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+}
+
+// sshArgs is the ssh command line that runs argv on the host. ssh hands the command to the login
+// shell of the host as one string, so every argument is quoted for it. The control path is left
+// out of what is shown to the user.
+func (h *sshHost) sshArgs(control bool, argv ...string) []string {
+	args := []string{"ssh"}
+	if control {
+		args = append(args, "-o", "ControlPath="+h.controlPath())
+	}
+	for _, o := range h.options {
+		args = append(args, "-o", o)
+	}
+	args = append(args, h.destination)
+	for _, a := range argv {
+		args = append(args, shellQuote(a))
+	}
+	return args
+}
+
+func (h *sshHost) controlPath() string {
+	return filepath.Join(h.controlDir, "%C")
+}
+
+// connect starts the control master the commands share, once. It authenticates in the foreground,
+// so a password or host key prompt appears before any download, and writes to our stderr directly:
+// the master outlives the command, and a pipe it kept open would block waiting for the command.
+func (h *sshHost) connect() error {
+	if h.connected {
+		return nil
+	}
+	args := []string{"-o", "ControlMaster=yes", "-o", "ControlPersist=yes", "-o", "ControlPath=" + h.controlPath(), "-N", "-f"}
+	for _, o := range h.options {
+		args = append(args, "-o", o)
+	}
+	cmd := exec.Command("ssh", append(args, h.destination)...)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to connect to %s over ssh: %w", h.destination, err)
+	}
+	h.connected = true
+	return nil
+}
+
+// output runs argv on the host and returns its stdout. The error carries the exit status, which
+// ssh passes on from the command or sets to 255 for its own failures, and what was printed to stderr.
+func (h *sshHost) output(argv ...string) (string, error) {
+	if err := h.connect(); err != nil {
+		return "", err
+	}
+	args := h.sshArgs(true, argv...)
+	cmd := exec.Command(args[0], args[1:]...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		cmdErr := zfs.NewCommandError(argv, err, stderr.String())
+		cmdErr.Host = h.destination
+		// ssh exits with 255 on its own failures, such as a rejected key, which say nothing about
+		// the command.
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 255 {
+			cmdErr.Kind = nil
+		}
+		return "", cmdErr
+	}
+	return string(out), nil
+}
+
+// exists mirrors zfs.exists on the host: only zfs.ErrNotFound counts as absent.
+func (h *sshHost) exists(name string, extraArgs ...string) (bool, error) {
+	args := append([]string{"zfs", "list", "-H", "-o", "name"}, extraArgs...)
+	_, err := h.output(append(args, name)...)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, zfs.ErrNotFound) {
+		return false, nil
+	}
+	return false, err
+}
+
+// explain names the ssh user in the zfs allow, as the commands run as that user on the host.
+func (h *sshHost) explain(err error, dataset string) error {
+	user, _, ok := strings.Cut(h.destination, "@")
+	if !ok {
+		user = "<ssh user>"
+	}
+	return zfs.Explain(err, user, dataset, zfs.RestorePermissions)
+}
+
+func (h *sshHost) property(name, prop string) (string, error) {
+	out, err := h.output("zfs", "get", "-H", "-p", "-o", "value", prop, name)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// preflight checks that the pool exists on the host. Missing zfs allow permissions of the ssh user
+// are reported by zfs receive itself.
+func (h *sshHost) preflight(target string) error {
+	pool, _, _ := strings.Cut(target, "/")
+	if _, err := h.output("zfs", "list", "-H", "-o", "name", pool); err != nil {
+		if errors.Is(err, zfs.ErrNotFound) {
+			return fmt.Errorf("ZFS pool %s not found on %s: %w", pool, h.destination, err)
+		}
+		return h.explain(fmt.Errorf("failed to check ZFS pool %s on %s: %w", pool, h.destination, err), pool)
+	}
+	return nil
+}
+
+func (h *sshHost) hostname() (string, error) {
+	out, err := h.output("hostname")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+func (h *sshHost) datasetExists(dataset string) (bool, error) { return h.exists(dataset) }
+
+func (h *sshHost) snapshotExists(snapshot string) (bool, error) {
+	return h.exists(snapshot, "-t", "snapshot")
+}
+
+func (h *sshHost) snapshotGUID(snapshot string) (string, error) { return h.property(snapshot, "guid") }
+
+func (h *sshHost) written(snapshot string) (int64, error) {
+	value, err := h.property(snapshot, "written")
+	if err != nil {
+		return 0, err
+	}
+	written, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected written of %s: %q", snapshot, value)
+	}
+	return written, nil
+}
+
+func (h *sshHost) poolFeature(pool, feature string) (string, error) {
+	out, err := h.output("zpool", "get", "-H", "-o", "value", "feature@"+feature, pool)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+func (h *sshHost) receiveResumeToken(dataset string) (string, error) {
+	token, err := h.property(dataset, "receive_resume_token")
+	if err != nil || token == "-" {
+		return "", err
+	}
+	return token, nil
+}
+
+func (h *sshHost) abortReceive(dataset string) error {
+	_, err := h.output("zfs", "receive", "-A", dataset)
+	return err
+}
+
+func (h *sshHost) destroyRecursive(dataset string) error {
+	_, err := h.output("zfs", "destroy", "-r", dataset)
+	return err
+}
+
+func (h *sshHost) hold(_ context.Context, tag, snapshot string) error {
+	_, err := h.output("zfs", "hold", tag, snapshot)
+	return err
+}
+
+func (h *sshHost) release(_ context.Context, tag, snapshot string) error {
+	_, err := h.output("zfs", "release", tag, snapshot)
+	return err
+}
+
+func (h *sshHost) receiveCommand(target string, force bool) []string {
+	return h.sshArgs(false, receiveCommand(target, force)...)
+}
+
+// receive pipes stream into zfs receive on the host. Cancelling ctx kills ssh, which ends the
+// receive on the host as its stdin closes.
+func (h *sshHost) receive(ctx context.Context, stream io.Reader, target string, force bool) error {
+	if err := h.connect(); err != nil {
+		return err
+	}
+	args := h.sshArgs(true, receiveCommand(target, force)...)
+	return runReceive(exec.CommandContext(ctx, args[0], args[1:]...), stream)
+}
+
+func (h *sshHost) close() {
+	if h.connected {
+		args := []string{"-o", "ControlPath=" + h.controlPath(), "-O", "exit", h.destination}
+		if out, err := exec.Command("ssh", args...).CombinedOutput(); err != nil {
+			slog.Warn("Failed to stop ssh control master", "destination", h.destination, "error", err, "output", strings.TrimSpace(string(out)))
+		}
+	}
+	if err := os.RemoveAll(h.controlDir); err != nil {
+		slog.Warn("Failed to remove ssh control directory", "path", h.controlDir, "error", err)
+	}
+}
+
+// shellQuote quotes s for a POSIX shell unless it only has characters the shell leaves alone.
+func shellQuote(s string) string {
+	safe := s != "" && !strings.ContainsFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("@%+=:,./_-", r))
+	})
+	if safe {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,164 @@
+package restore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"zrb/internal/manifest"
+	"zrb/internal/zfs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSSH puts an ssh script first in PATH that logs its arguments to the returned file and runs
+// the remote command with sh, which undoes the quoting like the login shell of the host would.
+// With FAKE_SSH_HANG set, the remote command hangs instead.
+func fakeSSH(t *testing.T) string {
+	t.Helper()
+	bin := t.TempDir()
+	calls := filepath.Join(bin, "calls")
+	script := `#!/bin/sh
+echo "$*" >> "` + calls + `"
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-o) shift 2 ;;
+	-N|-f) master=1; shift ;;
+	-O) exit 0 ;;
+	*) break ;;
+	esac
+done
+[ -n "$master" ] && exit 0
+shift
+[ -n "$FAKE_SSH_HANG" ] && exec sleep 30
+exec sh -c "$*"
+`
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "ssh"), []byte(script), 0o755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return calls
+}
+
+func TestShellQuote(t *testing.T) {
+	assert.Equal(t, "tank/data@zrb_level0_2024-01-15_00-00", shellQuote("tank/data@zrb_level0_2024-01-15_00-00"))
+	assert.Equal(t, "'tank/my data'", shellQuote("tank/my data"))
+	assert.Equal(t, `'a'\''b;rm -rf /'`, shellQuote("a'b;rm -rf /"))
+	assert.Equal(t, "''", shellQuote(""))
+}
+
+func TestNewSSHHost(t *testing.T) {
+	for _, destination := range []string{"", "-oProxyCommand=x", "user@host extra"} {
+		_, err := newSSHHost(destination, nil)
+		assert.ErrorContains(t, err, "invalid --receive-via-ssh destination", destination)
+	}
+	_, err := newSSHHost("root@backup", []string{"-p"})
+	assert.ErrorContains(t, err, `invalid --ssh-option "-p"`)
+
+	_, err = newTargetHost(Options{SSHOptions: []string{"Port=2222"}})
+	assert.ErrorContains(t, err, "--ssh-option needs --receive-via-ssh")
+
+	h, err := newSSHHost("root@backup", []string{"Port=2222", "IdentityFile=/keys/restore"})
+	require.NoError(t, err)
+	defer h.close()
+	assert.Equal(t, "ssh -o Port=2222 -o IdentityFile=/keys/restore root@backup zfs receive -F 'tank/my data'",
+		strings.Join(h.receiveCommand("tank/my data", true), " "), "the dry run shows the invocation without the control path")
+}
+
+func TestSSHHostReceiveAndVerify(t *testing.T) {
+	received := fakeZFS(t)
+	calls := fakeSSH(t)
+
+	h, err := newSSHHost("root@backup", []string{"Port=2222"})
+	require.NoError(t, err)
+	stream := filepath.Join(t.TempDir(), "snapshot.merged")
+	require.NoError(t, os.WriteFile(stream, []byte("zfs send stream"), 0o644))
+
+	require.NoError(t, receive(context.Background(), h, stream, "tank/restored", false))
+	data, err := os.ReadFile(received)
+	require.NoError(t, err)
+	assert.Equal(t, "zfs send stream", string(data))
+
+	m := &manifest.Backup{TargetSnapshot: "tank/data@zrb_level0_2024-01-15_00-00", TargetSnapshotGUID: "1234567890"}
+	require.NoError(t, verifyRestoredSnapshot(h, "tank/restored", m))
+	t.Setenv("FAKE_ZFS_GUID", "987654321")
+	assert.ErrorContains(t, verifyRestoredSnapshot(h, "tank/restored", m), "has guid 987654321")
+
+	controlDir := h.controlDir
+	h.close()
+	assert.NoDirExists(t, controlDir)
+
+	log, err := os.ReadFile(calls)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(log)), "\n")
+	assert.Equal(t, 1, strings.Count(string(log), "ControlMaster=yes"), "one connection is opened")
+	assert.Contains(t, lines[0], "-N -f -o Port=2222 root@backup")
+	for _, line := range lines[1:] {
+		assert.Contains(t, line, "ControlPath="+filepath.Join(controlDir, "%C"), "every command reuses the connection")
+	}
+	assert.Contains(t, string(log), "root@backup zfs receive tank/restored")
+	assert.Contains(t, string(log), "root@backup zfs list -H -o name -t snapshot tank/restored@zrb_level0_2024-01-15_00-00")
+	assert.Contains(t, lines[len(lines)-1], "-O exit root@backup")
+}
+
+func TestSSHHostFailedReceive(t *testing.T) {
+	z := newScriptedZFS(t)
+	z.set(t, "stderr", "cannot receive new filesystem stream: out of space")
+	z.set(t, "create", "")
+	fakeSSH(t)
+
+	h, err := newSSHHost("root@backup", nil)
+	require.NoError(t, err)
+	defer h.close()
+	stream := filepath.Join(t.TempDir(), "snapshot.merged")
+	require.NoError(t, os.WriteFile(stream, []byte("stream"), 0o644))
+
+	err = receive(context.Background(), h, stream, "tank/restored", false)
+	assert.ErrorContains(t, err, "exit status 1: cannot receive new filesystem stream: out of space")
+	assert.ErrorContains(t, err, "Removed the partially received dataset tank/restored")
+	assert.Contains(t, z.calls(t), "destroy -r tank/restored", "the cleanup runs on the host")
+}
+
+func TestSSHHostReceiveCancel(t *testing.T) {
+	fakeSSH(t)
+	t.Setenv("FAKE_SSH_HANG", "1")
+
+	h, err := newSSHHost("root@backup", nil)
+	require.NoError(t, err)
+	defer h.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = h.receive(ctx, strings.NewReader("stream"), "tank/restored", false)
+	assert.ErrorContains(t, err, "signal: killed")
+	assert.Less(t, time.Since(start), 10*time.Second, "cancelling kills ssh")
+}
+
+func TestSSHHostErrorKinds(t *testing.T) {
+	z := newScriptedZFS(t)
+	fakeSSH(t)
+	h, err := newSSHHost("zrb@backup", nil)
+	require.NoError(t, err)
+	defer h.close()
+
+	exists, err := h.datasetExists("tank/restored")
+	require.NoError(t, err, "only a missing dataset counts as absent")
+	assert.False(t, exists)
+
+	z.set(t, "exists", "")
+	require.NoError(t, os.WriteFile(filepath.Join(z.dir, "zfs"), []byte("#!/bin/sh\necho \"cannot open '$4': permission denied\" >&2\nexit 1\n"), 0o755))
+	_, err = h.snapshotGUID("tank/restored@snap")
+	assert.ErrorIs(t, err, zfs.ErrPermission)
+	assert.ErrorContains(t, h.explain(err, "tank/restored"), "zfs allow -u zrb receive,create,mount tank/restored")
+
+	// ssh itself failing exits with 255, whatever its stderr says.
+	bin := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "ssh"), []byte("#!/bin/sh\necho 'zrb@backup: Permission denied (publickey).' >&2\nexit 255\n"), 0o755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	_, err = h.datasetExists("tank/restored")
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, zfs.ErrPermission)
+	assert.ErrorContains(t, err, "zfs list -H -o name tank/restored on zrb@backup failed: exit status 255")
+}
@@ -0,0 +1,115 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+	"zrb/internal/remote"
+	"zrb/internal/throughput"
+)
+
+// Replaced by tests.
+var (
+	// throughputLogInterval is how often a restore logs the rolling rate of its phases.
+	throughputLogInterval = 30 * time.Second
+	// progressInterval is how often --progress redraws its line.
+	progressInterval = time.Second
+	stderrIsTerminal = func() bool {
+		info, err := os.Stderr.Stat()
+		return err == nil && info.Mode()&os.ModeCharDevice != 0
+	}
+)
+
+// Throughput is the bytes, time and rate of each phase of a restore, recorded in its history.
+type Throughput struct {
+	Download throughput.Phase `yaml:"download" json:"download"`
+	Decrypt  throughput.Phase `yaml:"decrypt" json:"decrypt"`
+	Receive  throughput.Phase `yaml:"receive" json:"receive"`
+}
+
+// phaseMeters count what the download, the decryption and the zfs receive of a restore move.
+// Downloads are counted from S3 or GCS, or from the local parts copied with --source local; the
+// receive counts the bytes written to the stdin of zfs receive.
+type phaseMeters struct {
+	download, decrypt, receive *throughput.Meter
+}
+
+func newPhaseMeters() *phaseMeters {
+	return &phaseMeters{download: &throughput.Meter{}, decrypt: &throughput.Meter{}, receive: &throughput.Meter{}}
+}
+
+type metersKey struct{}
+
+// withMeters returns a context whose restore phases, downloads included, are counted by m.
+func withMeters(ctx context.Context, m *phaseMeters) context.Context {
+	return remote.WithMeter(context.WithValue(ctx, metersKey{}, m), m.download)
+}
+
+// metersFrom returns the meters of ctx; without them nothing is counted.
+func metersFrom(ctx context.Context) *phaseMeters {
+	if m, ok := ctx.Value(metersKey{}).(*phaseMeters); ok {
+		return m
+	}
+	return &phaseMeters{}
+}
+
+func (m *phaseMeters) summary() *Throughput {
+	return &Throughput{Download: m.download.Summary(), Decrypt: m.decrypt.Summary(), Receive: m.receive.Summary()}
+}
+
+// report logs the rolling rate of each phase every throughputLogInterval and, if progress is not
+// nil, redraws it on one line of progress every progressInterval, until stop is called.
+func (m *phaseMeters) report(progress io.Writer) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		logTicker := time.NewTicker(throughputLogInterval)
+		defer logTicker.Stop()
+		var redraw <-chan time.Time
+		if progress != nil {
+			t := time.NewTicker(progressInterval)
+			defer t.Stop()
+			redraw = t.C
+		}
+		for {
+			select {
+			case <-done:
+				if progress != nil {
+					fmt.Fprint(progress, "\r\033[K")
+				}
+				return
+			case at := <-logTicker.C:
+				if m.download.Bytes()+m.decrypt.Bytes()+m.receive.Bytes() == 0 {
+					continue
+				}
+				slog.Info("Restore throughput",
+					"downloaded", m.download.Bytes(), "download", throughput.FormatRate(m.download.Rolling(at)),
+					"decrypted", m.decrypt.Bytes(), "decrypt", throughput.FormatRate(m.decrypt.Rolling(at)),
+					"received", m.receive.Bytes(), "receive", throughput.FormatRate(m.receive.Rolling(at)))
+			case at := <-redraw:
+				fmt.Fprintf(progress, "\r\033[Kdownload %s (%s)  decrypt %s (%s)  receive %s (%s)",
+					throughput.FormatRate(m.download.Rolling(at)), throughput.FormatBytes(m.download.Bytes()),
+					throughput.FormatRate(m.decrypt.Rolling(at)), throughput.FormatBytes(m.decrypt.Bytes()),
+					throughput.FormatRate(m.receive.Rolling(at)), throughput.FormatBytes(m.receive.Bytes()))
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// logSummary logs the final rate of each phase over the time spent in it, with the CPU time
+// decryption took, to tell a slow network from a slow CPU or pool.
+func logSummary(t *Throughput) {
+	slog.Info("Restore throughput summary",
+		"downloaded", t.Download.Bytes, "download", throughput.FormatRate(t.Download.BytesPerSecond), "downloadSeconds", t.Download.Seconds,
+		"decrypted", t.Decrypt.Bytes, "decrypt", throughput.FormatRate(t.Decrypt.BytesPerSecond), "decryptSeconds", t.Decrypt.Seconds,
+		"decryptCPUSeconds", t.Decrypt.CPUSeconds,
+		"received", t.Receive.Bytes, "receive", throughput.FormatRate(t.Receive.BytesPerSecond), "receiveSeconds", t.Receive.Seconds)
+}
@@ -0,0 +1,54 @@
+package restore
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// syncBuffer is a bytes.Buffer safe for the reporting goroutine and the test.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestReportProgress(t *testing.T) {
+	defer func(d time.Duration) { progressInterval = d }(progressInterval)
+	progressInterval = 5 * time.Millisecond
+
+	m := newPhaseMeters()
+	m.download.Add(3 << 20)
+	m.decrypt.Add(1 << 20)
+	var out syncBuffer
+	stop := m.report(&out)
+	assert.Eventually(t, func() bool { return strings.Contains(out.String(), "download") }, time.Second, time.Millisecond)
+	stop()
+
+	line := out.String()
+	assert.Contains(t, line, "(3.0 MiB)")
+	assert.Contains(t, line, "decrypt ")
+	assert.Contains(t, line, "receive 0 B/s (0 B)")
+	assert.True(t, strings.HasSuffix(line, "\r\033[K"), "stop clears the line")
+}
+
+func TestMetersFromWithout(t *testing.T) {
+	m := metersFrom(t.Context())
+	m.download.Add(1)
+	assert.Equal(t, &Throughput{}, m.summary(), "without meters nothing is counted")
+}
@@ -0,0 +1,107 @@
+package restore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"zrb/internal/manifest"
+	"zrb/internal/util"
+	"zrb/internal/zfs"
+)
+
+// workDirSafetyFactor pads the space estimate for filesystem overhead and age framing.
+const workDirSafetyFactor = 1.1
+
+// diskFree is util.DiskFree; replaced in tests.
+var diskFree = util.DiskFree
+
+// requiredSpace estimates the peak scratch space of a restore: an encrypted and a decrypted copy of
+// each of the parts the workers have in flight, plus the merged stream when merged. Manifests
+// without a stream size count every part as full.
+func requiredSpace(m *manifest.Backup, workers int, merged bool) uint64 {
+	stream := m.StreamBytes
+	if stream <= 0 {
+		stream = int64(len(m.Parts)) * partSize(m)
+	}
+	need := 2 * min(stream, int64(workers)*partSize(m))
+	if merged {
+		need += stream
+	}
+	return uint64(float64(need) * workDirSafetyFactor)
+}
+
+// estimatedDownload is the size of the encrypted parts of m: the stream plus the 16 bytes age adds
+// to every 64 KiB chunk. Manifests without a stream size count every part as full.
+func estimatedDownload(m *manifest.Backup) int64 {
+	stream := m.StreamBytes
+	if stream <= 0 {
+		stream = int64(len(m.Parts)) * partSize(m)
+	}
+	return stream + (stream/(64<<10)+int64(len(m.Parts)+len(m.Chunks)))*16
+}
+
+// partSize is the size the stream of m was split at; manifests without one split at zfs.PartSize.
+func partSize(m *manifest.Backup) int64 {
+	if m.PartSizeBytes > 0 {
+		return m.PartSizeBytes
+	}
+	return zfs.PartSize
+}
+
+// printDownloadEstimate adds the download of a dry run and how it compares to the budget.
+func printDownloadEstimate(w io.Writer, estimate, limit int64, acknowledged bool) {
+	fmt.Fprintf(w, "  Download:        ~%s\n", formatGiB(uint64(estimate)))
+	switch {
+	case limit <= 0:
+	case estimate <= limit:
+		fmt.Fprintf(w, "  Download Budget: %s, OK\n", formatGiB(uint64(limit)))
+	case acknowledged:
+		fmt.Fprintf(w, "  Download Budget: %s, EXCEEDED (acknowledged)\n", formatGiB(uint64(limit)))
+	default:
+		fmt.Fprintf(w, "  Download Budget: %s, EXCEEDED (needs --acknowledge-cost)\n", formatGiB(uint64(limit)))
+	}
+}
+
+// ChooseWorkDir returns the scratch directory named name for a restore, or a deep verify, needing
+// required bytes. A directory left by an interrupted attempt is reused so its downloads resume. An
+// explicit parent (--work-dir or restore.work_dir) must have room; otherwise the first default
+// parent with room wins.
+func ChooseWorkDir(explicit string, defaults []string, name string, required uint64) (string, error) {
+	candidates := defaults
+	if explicit != "" {
+		candidates = []string{explicit}
+	}
+
+	for _, parent := range candidates {
+		dir := filepath.Join(parent, name)
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir, nil
+		}
+	}
+
+	var report []string
+	for _, parent := range candidates {
+		free, err := diskFree(parent)
+		if err != nil {
+			report = append(report, fmt.Sprintf("%s: %v", parent, err))
+			continue
+		}
+		if free >= required {
+			return filepath.Join(parent, name), nil
+		}
+		report = append(report, fmt.Sprintf("%s has %s free", parent, formatGiB(free)))
+	}
+
+	hint := "pass --work-dir or set restore.work_dir to a larger filesystem"
+	if explicit != "" {
+		hint = "choose a larger filesystem for --work-dir or restore.work_dir"
+	}
+	return "", fmt.Errorf("not enough scratch space, about %s needed (%s); %s",
+		formatGiB(required), strings.Join(report, ", "), hint)
+}
+
+func formatGiB(b uint64) string {
+	return fmt.Sprintf("%.1f GiB", float64(b)/(1<<30))
+}
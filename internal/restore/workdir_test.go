@@ -0,0 +1,154 @@
+package restore
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"zrb/internal/manifest"
+	"zrb/internal/zfs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const gib = 1 << 30
+
+func TestRequiredSpace(t *testing.T) {
+	padded := func(n int64) uint64 { return uint64(float64(n) * workDirSafetyFactor) }
+
+	assert.Equal(t, padded(16*gib), requiredSpace(&manifest.Backup{StreamBytes: 10 * gib}, 1, true),
+		"merged stream plus one encrypted and one decrypted part")
+	assert.Equal(t, padded(3*gib), requiredSpace(&manifest.Backup{StreamBytes: gib}, 1, true),
+		"a small stream is its own largest part")
+	assert.Equal(t, padded(22*gib), requiredSpace(&manifest.Backup{StreamBytes: 10 * gib}, 2, true),
+		"every worker holds a part")
+	assert.Equal(t, padded(30*gib), requiredSpace(&manifest.Backup{StreamBytes: 10 * gib}, 8, true),
+		"no more parts are in flight than the stream has")
+
+	parts := make([]manifest.PartInfo, 4)
+	assert.Equal(t, padded(6*zfs.PartSize), requiredSpace(&manifest.Backup{Parts: parts}, 1, true),
+		"without a stream size every part counts as full")
+	assert.Equal(t, padded(12*gib), requiredSpace(&manifest.Backup{StreamBytes: 10 * gib}, 2, false),
+		"a streamed restore keeps no merged stream")
+}
+
+func TestDownloadEstimate(t *testing.T) {
+	assert.Equal(t, int64(gib+gib/4096+16), estimatedDownload(&manifest.Backup{StreamBytes: gib, Parts: make([]manifest.PartInfo, 1)}))
+
+	var out bytes.Buffer
+	printDownloadEstimate(&out, 2*gib, 0, false)
+	assert.Equal(t, "  Download:        ~2.0 GiB\n", out.String())
+
+	for want, limit := range map[string]int64{"OK": 4 * gib, "EXCEEDED (needs --acknowledge-cost)": gib} {
+		out.Reset()
+		printDownloadEstimate(&out, 2*gib, limit, false)
+		assert.Contains(t, out.String(), "  Download Budget: "+formatGiB(uint64(limit))+", "+want+"\n")
+	}
+	out.Reset()
+	printDownloadEstimate(&out, 2*gib, gib, true)
+	assert.Contains(t, out.String(), "EXCEEDED (acknowledged)")
+}
+
+// fakeDiskFree reports fixed free space per directory, failing for unknown ones.
+func fakeDiskFree(t *testing.T, free map[string]uint64) {
+	t.Helper()
+	old := diskFree
+	diskFree = func(path string) (uint64, error) {
+		if f, ok := free[path]; ok {
+			return f, nil
+		}
+		return 0, fmt.Errorf("statfs %s: no such file or directory", path)
+	}
+	t.Cleanup(func() { diskFree = old })
+}
+
+func TestChooseWorkDir(t *testing.T) {
+	const name = "restore_t_0_1700000000"
+
+	tests := []struct {
+		name        string
+		explicit    string
+		free        map[string]uint64
+		want        string
+		errContains []string
+	}{
+		{
+			name: "system temp when it fits",
+			free: map[string]uint64{"/tmp": 20 * gib, "/base/tmp": 500 * gib},
+			want: "/tmp/" + name,
+		},
+		{
+			name: "base dir when the system temp is too small",
+			free: map[string]uint64{"/tmp": 2 * gib, "/base/tmp": 500 * gib},
+			want: "/base/tmp/" + name,
+		},
+		{
+			name: "unreadable candidate is skipped",
+			free: map[string]uint64{"/base/tmp": 500 * gib},
+			want: "/base/tmp/" + name,
+		},
+		{
+			name:        "nothing fits",
+			free:        map[string]uint64{"/tmp": 2 * gib, "/base/tmp": 5 * gib},
+			errContains: []string{"/tmp has 2.0 GiB free", "/base/tmp has 5.0 GiB free", "pass --work-dir"},
+		},
+		{
+			name:     "explicit work dir with room",
+			explicit: "/scratch",
+			free:     map[string]uint64{"/tmp": 500 * gib, "/scratch": 20 * gib},
+			want:     "/scratch/" + name,
+		},
+		{
+			name:        "explicit work dir without room is not second-guessed",
+			explicit:    "/scratch",
+			free:        map[string]uint64{"/tmp": 500 * gib, "/scratch": 2 * gib},
+			errContains: []string{"/scratch has 2.0 GiB free", "larger filesystem for --work-dir"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeDiskFree(t, tt.free)
+
+			got, err := ChooseWorkDir(tt.explicit, []string{"/tmp", "/base/tmp"}, name, 10*gib)
+			if len(tt.errContains) > 0 {
+				for _, want := range tt.errContains {
+					assert.ErrorContains(t, err, want)
+				}
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestChooseWorkDirResumesExisting(t *testing.T) {
+	fakeDiskFree(t, map[string]uint64{})
+
+	base := t.TempDir()
+	existing := filepath.Join(base, "restore_t_0_1")
+	require.NoError(t, os.Mkdir(existing, 0o755))
+
+	got, err := ChooseWorkDir("", []string{"/nonexistent", base}, "restore_t_0_1", 10*gib)
+	require.NoError(t, err)
+	assert.Equal(t, existing, got, "kept downloads of an interrupted restore are reused regardless of free space")
+}
+
+func TestMergePart(t *testing.T) {
+	dir := t.TempDir()
+	var merged bytes.Buffer
+
+	for _, content := range []string{"one", "two", "three"} {
+		part := filepath.Join(dir, "snapshot.part-"+content)
+		require.NoError(t, os.WriteFile(part, []byte(content), 0o644))
+		require.NoError(t, os.WriteFile(part+".age", []byte("encrypted"), 0o644))
+		require.NoError(t, mergePart(&merged, part))
+
+		assert.NoFileExists(t, part, "consumed part is deleted")
+		assert.NoFileExists(t, part+".age", "with its encrypted file")
+	}
+	assert.Equal(t, "onetwothree", merged.String())
+}
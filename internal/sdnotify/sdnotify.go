@@ -0,0 +1,286 @@
+// Package sdnotify implements the sd_notify protocol so zrb can run as a Type=notify systemd unit.
+// The watchdog is only fed while bytes keep moving, so a stalled upload lets systemd restart or alert
+// instead of being mistaken for a long but healthy run.
+package sdnotify
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// statusInterval is how often STATUS= is refreshed when systemd set no watchdog.
+const statusInterval = 30 * time.Second
+
+// moved counts the bytes of forward progress of this process: hashed, encrypted, decrypted, sent,
+// received, uploaded or downloaded. It is process-wide like the notify socket itself.
+var moved atomic.Int64
+
+// Add records n bytes of forward progress.
+func Add(n int64) {
+	moved.Add(n)
+}
+
+type countingReader struct {
+	r io.Reader
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	moved.Add(int64(n))
+	return n, err
+}
+
+// Reader counts everything read from r as forward progress.
+func Reader(r io.Reader) io.Reader {
+	return countingReader{r: r}
+}
+
+type countingWriter struct{}
+
+func (countingWriter) Write(p []byte) (int, error) {
+	moved.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// Writer counts everything written to it as forward progress, for use in an io.MultiWriter.
+func Writer() io.Writer {
+	return countingWriter{}
+}
+
+// Notifier sends state changes to the socket systemd passes in NOTIFY_SOCKET. A nil Notifier, as
+// returned outside a Type=notify unit, ignores every call.
+type Notifier struct {
+	conn     net.Conn
+	watchdog time.Duration
+
+	mu    sync.Mutex
+	phase string
+	done  int
+	total int
+	// stepped is set by Phase and Step so the next tick counts them as progress.
+	stepped bool
+	// paused is set while the run waits on purpose, which is not a stall, and so is waiting, the
+	// reason shown while it waits on its own, such as for the upload window.
+	paused  bool
+	waiting string
+}
+
+// New connects to NOTIFY_SOCKET, returning nil when it is unset. The watchdog interval comes from
+// WATCHDOG_USEC, unless WATCHDOG_PID names another process.
+func New() (*Notifier, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil, nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NOTIFY_SOCKET %s: %w", socket, err)
+	}
+
+	n := &Notifier{conn: conn}
+	if usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil && usec > 0 {
+		pid := os.Getenv("WATCHDOG_PID")
+		if pid == "" || pid == strconv.Itoa(os.Getpid()) {
+			n.watchdog = time.Duration(usec) * time.Microsecond
+		}
+	}
+	return n, nil
+}
+
+// Close closes the socket.
+func (n *Notifier) Close() error {
+	if n == nil {
+		return nil
+	}
+	return n.conn.Close()
+}
+
+func (n *Notifier) send(lines ...string) {
+	if n == nil {
+		return
+	}
+	if _, err := n.conn.Write([]byte(strings.Join(lines, "\n"))); err != nil {
+		slog.Warn("Failed to notify systemd", "error", err)
+	}
+}
+
+// Ready tells systemd that initialization finished.
+func (n *Notifier) Ready() {
+	n.send("READY=1", "STATUS="+n.status())
+}
+
+// Stopping tells systemd the run is finishing.
+func (n *Notifier) Stopping() {
+	n.send("STOPPING=1")
+}
+
+// Phase starts a new phase shown in STATUS=, made of total steps (0 when it has no natural count).
+func (n *Notifier) Phase(name string, total int) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	n.phase, n.done, n.total, n.stepped = name, 0, total, true
+	status := n.statusLocked()
+	n.mu.Unlock()
+	n.send("STATUS=" + status)
+}
+
+// Step marks one step of the current phase, such as a part, as done.
+func (n *Notifier) Step() {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	n.done++
+	n.stepped = true
+	n.mu.Unlock()
+}
+
+// Paused marks the run as paused on request or running again. A paused run keeps petting the
+// watchdog, as nothing is expected to move.
+func (n *Notifier) Paused(paused bool) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	n.paused = paused
+	n.stepped = true
+	status := n.statusLocked()
+	n.mu.Unlock()
+	n.send("STATUS=" + status)
+}
+
+// Waiting shows reason in STATUS= while the run waits on its own, or nothing when reason is
+// empty. Like a paused run, a waiting one keeps petting the watchdog.
+func (n *Notifier) Waiting(reason string) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	n.waiting = reason
+	n.stepped = true
+	status := n.statusLocked()
+	n.mu.Unlock()
+	n.send("STATUS=" + status)
+}
+
+func (n *Notifier) status() string {
+	if n == nil {
+		return ""
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.statusLocked()
+}
+
+func (n *Notifier) statusLocked() string {
+	if n.paused {
+		return n.runningStatusLocked() + " (paused)"
+	}
+	if n.waiting != "" {
+		return n.runningStatusLocked() + " (" + n.waiting + ")"
+	}
+	return n.runningStatusLocked()
+}
+
+func (n *Notifier) runningStatusLocked() string {
+	switch {
+	case n.phase == "":
+		return "starting"
+	case n.total > 0:
+		return fmt.Sprintf("%s: %d/%d (%d%%)", n.phase, n.done, n.total, n.done*100/n.total)
+	}
+	return n.phase
+}
+
+// Watch refreshes STATUS= and pets the watchdog at half its interval until the returned stop is
+// called. A tick only sends WATCHDOG=1 when bytes moved or a step finished since the previous tick,
+// so a stalled run stops petting the watchdog and systemd can act on it.
+func (n *Notifier) Watch() (stop func()) {
+	if n == nil {
+		return func() {}
+	}
+	interval := statusInterval
+	if n.watchdog > 0 {
+		interval = n.watchdog / 2
+	}
+
+	w := &watchState{last: moved.Load(), lastProgress: time.Now()}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				n.tick(w)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// watchState is what Watch remembers between ticks.
+type watchState struct {
+	last         int64
+	lastProgress time.Time
+}
+
+func (n *Notifier) tick(w *watchState) {
+	current := moved.Load()
+	n.mu.Lock()
+	progressed := current != w.last || n.stepped || n.paused || n.waiting != ""
+	n.stepped = false
+	status := n.statusLocked()
+	n.mu.Unlock()
+	w.last = current
+
+	if progressed {
+		w.lastProgress = time.Now()
+		if n.watchdog > 0 {
+			n.send("WATCHDOG=1", "STATUS="+status)
+		} else {
+			n.send("STATUS=" + status)
+		}
+		return
+	}
+	stalled := time.Since(w.lastProgress).Round(time.Second)
+	if n.watchdog > 0 {
+		slog.Warn("No progress, not petting the systemd watchdog", "phase", status, "stalledFor", stalled)
+	}
+	n.send(fmt.Sprintf("STATUS=%s, no progress for %s", status, stalled))
+}
+
+type notifierKey struct{}
+
+// NewContext returns a context carrying n, for reporting phases and steps deep in a run.
+func NewContext(ctx context.Context, n *Notifier) context.Context {
+	return context.WithValue(ctx, notifierKey{}, n)
+}
+
+// FromContext returns the Notifier carried by ctx, or nil.
+func FromContext(ctx context.Context) *Notifier {
+	n, _ := ctx.Value(notifierKey{}).(*Notifier)
+	return n
+}
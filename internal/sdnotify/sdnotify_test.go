@@ -0,0 +1,173 @@
+package sdnotify
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSystemd listens on a unix datagram socket like systemd's notify socket and returns the
+// connection so tests can read the messages sent to it.
+func fakeSystemd(t *testing.T, watchdog time.Duration) *net.UnixConn {
+	t.Helper()
+	// Socket paths are limited to ~108 bytes, too short for some t.TempDir paths.
+	dir, err := os.MkdirTemp("", "sdnotify")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	socket := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	t.Setenv("NOTIFY_SOCKET", socket)
+	t.Setenv("WATCHDOG_PID", "")
+	t.Setenv("WATCHDOG_USEC", "")
+	if watchdog > 0 {
+		t.Setenv("WATCHDOG_USEC", strconv.FormatInt(watchdog.Microseconds(), 10))
+	}
+	return conn
+}
+
+// receive returns the messages that arrive within wait.
+func receive(t *testing.T, conn *net.UnixConn, wait time.Duration) []string {
+	t.Helper()
+	var messages []string
+	buf := make([]byte, 4096)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(wait)))
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return messages
+		}
+		messages = append(messages, string(buf[:n]))
+	}
+}
+
+func TestNewWithoutSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+
+	n, err := New()
+	require.NoError(t, err)
+	assert.Nil(t, n)
+
+	// Every call is a no-op outside a Type=notify unit.
+	n.Ready()
+	n.Phase("processing parts", 3)
+	n.Step()
+	n.Paused(true)
+	n.Waiting("waiting for upload window until 00:00")
+	n.Watch()()
+	n.Stopping()
+	assert.NoError(t, n.Close())
+}
+
+func TestReadyAndStatus(t *testing.T) {
+	conn := fakeSystemd(t, 0)
+
+	n, err := New()
+	require.NoError(t, err)
+	defer n.Close()
+
+	n.Ready()
+	n.Phase("processing parts", 4)
+	n.Step()
+	n.Phase("uploading manifest", 0)
+	n.Stopping()
+
+	assert.Equal(t, []string{
+		"READY=1\nSTATUS=starting",
+		"STATUS=processing parts: 0/4 (0%)",
+		"STATUS=uploading manifest",
+		"STOPPING=1",
+	}, receive(t, conn, 100*time.Millisecond))
+}
+
+func TestWatchdogFollowsProgress(t *testing.T) {
+	conn := fakeSystemd(t, 200*time.Millisecond)
+
+	n, err := New()
+	require.NoError(t, err)
+	defer n.Close()
+	assert.Equal(t, 200*time.Millisecond, n.watchdog)
+
+	n.Phase("processing parts", 2)
+	receive(t, conn, 10*time.Millisecond)
+	w := &watchState{last: moved.Load(), lastProgress: time.Now()}
+
+	// Bytes moving through a counted reader pet the watchdog.
+	_, err = io.Copy(io.Discard, Reader(bytes.NewReader(make([]byte, 1024))))
+	require.NoError(t, err)
+	n.tick(w)
+	assert.Equal(t, []string{"WATCHDOG=1\nSTATUS=processing parts: 0/2 (0%)"}, receive(t, conn, 10*time.Millisecond))
+
+	// So does a finished step.
+	n.Step()
+	n.tick(w)
+	assert.Equal(t, []string{"WATCHDOG=1\nSTATUS=processing parts: 1/2 (50%)"}, receive(t, conn, 10*time.Millisecond))
+
+	// A stalled run only refreshes its status.
+	n.tick(w)
+	assert.Equal(t, []string{"STATUS=processing parts: 1/2 (50%), no progress for 0s"}, receive(t, conn, 10*time.Millisecond))
+
+	// Progress resumes the pings.
+	_, err = Writer().Write([]byte("part"))
+	require.NoError(t, err)
+	n.tick(w)
+	assert.Equal(t, []string{"WATCHDOG=1\nSTATUS=processing parts: 1/2 (50%)"}, receive(t, conn, 10*time.Millisecond))
+
+	// A paused run is not stalled.
+	n.Paused(true)
+	assert.Equal(t, []string{"STATUS=processing parts: 1/2 (50%) (paused)"}, receive(t, conn, 10*time.Millisecond))
+	n.tick(w)
+	n.tick(w)
+	assert.Equal(t, []string{
+		"WATCHDOG=1\nSTATUS=processing parts: 1/2 (50%) (paused)",
+		"WATCHDOG=1\nSTATUS=processing parts: 1/2 (50%) (paused)",
+	}, receive(t, conn, 10*time.Millisecond))
+	n.Paused(false)
+	assert.Equal(t, []string{"STATUS=processing parts: 1/2 (50%)"}, receive(t, conn, 10*time.Millisecond))
+
+	// Neither is a run waiting for its upload window.
+	n.Waiting("waiting for upload window until 00:00")
+	assert.Equal(t, []string{"STATUS=processing parts: 1/2 (50%) (waiting for upload window until 00:00)"}, receive(t, conn, 10*time.Millisecond))
+	n.tick(w)
+	n.tick(w)
+	assert.Len(t, receive(t, conn, 10*time.Millisecond), 2)
+	n.Waiting("")
+	assert.Equal(t, []string{"STATUS=processing parts: 1/2 (50%)"}, receive(t, conn, 10*time.Millisecond))
+}
+
+func TestWatch(t *testing.T) {
+	conn := fakeSystemd(t, 100*time.Millisecond)
+
+	n, err := New()
+	require.NoError(t, err)
+	defer n.Close()
+
+	stop := n.Watch()
+	Add(1)
+	messages := receive(t, conn, 200*time.Millisecond)
+	stop()
+
+	require.NotEmpty(t, messages)
+	assert.Equal(t, "WATCHDOG=1\nSTATUS=starting", messages[0])
+}
+
+func TestWatchdogForAnotherProcess(t *testing.T) {
+	fakeSystemd(t, 200*time.Millisecond)
+	t.Setenv("WATCHDOG_PID", "1")
+
+	n, err := New()
+	require.NoError(t, err)
+	defer n.Close()
+	assert.Zero(t, n.watchdog)
+}
@@ -0,0 +1,126 @@
+// Package shutdown turns SIGTERM and SIGINT into a two-stage stop: work that asked for a grace
+// period with Grace is told to stop with Stopping and may finish what it started, while everything
+// else, and everything once the grace period is over or at a second signal, is cancelled.
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+// ErrStopped is returned by work that stopped early because Stopping was closed.
+var ErrStopped = errors.New("stopped by signal")
+
+type contextKey struct{}
+
+type stopper struct {
+	cancel   context.CancelFunc
+	stopping chan struct{}
+
+	mu    sync.Mutex
+	grace time.Duration
+	// graced counts the Grace calls not yet released.
+	graced int
+	timer  *time.Timer
+}
+
+// NotifyContext returns a context that the signals cancel, and a function that stops listening
+// for them. Unless Grace is in effect, the first signal cancels the context as
+// signal.NotifyContext does.
+func NotifyContext(parent context.Context, signals ...os.Signal) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	s := &stopper{cancel: cancel, stopping: make(chan struct{})}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+
+	go func() {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return
+		}
+		s.stop()
+		select {
+		case <-ch:
+			slog.Warn("Signalled again, stopping at once")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return context.WithValue(ctx, contextKey{}, s), func() {
+		signal.Stop(ch)
+		cancel()
+	}
+}
+
+// stop closes stopping, and cancels the context at once or when the grace period is over.
+func (s *stopper) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	close(s.stopping)
+	if s.graced == 0 || s.grace <= 0 {
+		s.cancel()
+		return
+	}
+	slog.Warn("Stopping, letting the work in flight finish; signal again to stop at once", "grace", s.grace)
+	s.timer = time.AfterFunc(s.grace, func() {
+		slog.Warn("Grace period is over, stopping at once", "grace", s.grace)
+		s.cancel()
+	})
+}
+
+func (s *stopper) stopped() bool {
+	select {
+	case <-s.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// Grace lets a signal that arrives before release is called leave the context of NotifyContext
+// uncancelled for grace, so that the caller can finish its work in flight after Stopping. release
+// cancels the context if a stop was requested meanwhile, as the work it covered is done. Without
+// NotifyContext, Grace does nothing.
+func Grace(ctx context.Context, grace time.Duration) (release func()) {
+	s, _ := ctx.Value(contextKey{}).(*stopper)
+	if s == nil {
+		return func() {}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.graced++
+	s.grace = grace
+	return sync.OnceFunc(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.graced--
+		if s.stopped() && s.graced == 0 {
+			if s.timer != nil {
+				s.timer.Stop()
+			}
+			s.cancel()
+		}
+	})
+}
+
+// Stopping returns a channel that is closed once a signal asked to stop, or nil, which never is,
+// without NotifyContext.
+func Stopping(ctx context.Context) <-chan struct{} {
+	if s, _ := ctx.Value(contextKey{}).(*stopper); s != nil {
+		return s.stopping
+	}
+	return nil
+}
+
+// Stopped reports whether a signal asked to stop.
+func Stopped(ctx context.Context) bool {
+	s, _ := ctx.Value(contextKey{}).(*stopper)
+	return s != nil && s.stopped()
+}
@@ -0,0 +1,87 @@
+package shutdown
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signalSelf(t *testing.T) {
+	t.Helper()
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGUSR2))
+}
+
+func waitDone(t *testing.T, ctx context.Context) {
+	t.Helper()
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context was not cancelled")
+	}
+}
+
+func TestWithoutGrace(t *testing.T) {
+	ctx, stop := NotifyContext(context.Background(), syscall.SIGUSR2)
+	defer stop()
+
+	signalSelf(t)
+	waitDone(t, ctx)
+	assert.True(t, Stopped(ctx))
+}
+
+func TestGraceReleased(t *testing.T) {
+	ctx, stop := NotifyContext(context.Background(), syscall.SIGUSR2)
+	defer stop()
+	release := Grace(ctx, time.Hour)
+
+	signalSelf(t)
+	<-Stopping(ctx)
+	assert.NoError(t, ctx.Err(), "the work in flight goes on")
+
+	release()
+	waitDone(t, ctx)
+	release()
+}
+
+func TestGraceOver(t *testing.T) {
+	ctx, stop := NotifyContext(context.Background(), syscall.SIGUSR2)
+	defer stop()
+	defer Grace(ctx, 20*time.Millisecond)()
+
+	signalSelf(t)
+	waitDone(t, ctx)
+}
+
+func TestSecondSignal(t *testing.T) {
+	ctx, stop := NotifyContext(context.Background(), syscall.SIGUSR2)
+	defer stop()
+	defer Grace(ctx, time.Hour)()
+
+	signalSelf(t)
+	<-Stopping(ctx)
+	assert.NoError(t, ctx.Err())
+	signalSelf(t)
+	waitDone(t, ctx)
+}
+
+func TestGraceReleasedBeforeSignal(t *testing.T) {
+	ctx, stop := NotifyContext(context.Background(), syscall.SIGUSR2)
+	defer stop()
+	Grace(ctx, time.Hour)()
+
+	signalSelf(t)
+	waitDone(t, ctx)
+}
+
+func TestWithoutNotifyContext(t *testing.T) {
+	ctx := context.Background()
+	assert.Nil(t, Stopping(ctx))
+	assert.False(t, Stopped(ctx))
+	Grace(ctx, time.Minute)()
+	assert.NoError(t, ctx.Err())
+}
@@ -0,0 +1,274 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"text/tabwriter"
+	"time"
+	"zrb/internal/config"
+	"zrb/internal/manifest"
+	"zrb/internal/util"
+	"zrb/internal/zfs"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Record struct {
+	ZrbVersion      string  `yaml:"zrb_version,omitempty" json:"zrb_version,omitempty"`
+	Level           int16   `yaml:"level" json:"level"`
+	Datetime        int64   `yaml:"datetime" json:"datetime"`
+	StreamBytes     int64   `yaml:"stream_bytes" json:"stream_bytes"`
+	EncryptedBytes  int64   `yaml:"encrypted_bytes" json:"encrypted_bytes"`
+	DurationSeconds float64 `yaml:"duration_seconds" json:"duration_seconds"`
+	Parts           int     `yaml:"parts" json:"parts"`
+	TargetSnapshot  string  `yaml:"target_snapshot" json:"target_snapshot"`
+	ParentSnapshot  string  `yaml:"parent_snapshot,omitempty" json:"parent_snapshot,omitempty"`
+	// UploadedBytes and DownloadedBytes are what the run moved to and from S3, retries included.
+	UploadedBytes   int64 `yaml:"uploaded_bytes,omitempty" json:"uploaded_bytes,omitempty"`
+	DownloadedBytes int64 `yaml:"downloaded_bytes,omitempty" json:"downloaded_bytes,omitempty"`
+	// StaleHolds are the holds the run failed to release.
+	StaleHolds []zfs.UserHold `yaml:"stale_holds,omitempty" json:"stale_holds,omitempty"`
+	// FreshStart is why the run did not resume the backup state, e.g. level-mismatch; empty when it resumed.
+	FreshStart string `yaml:"fresh_start,omitempty" json:"fresh_start,omitempty"`
+	// PartUploadSeconds is how long the parts took from encryption to the end of their upload; nil
+	// when the run uploaded nothing or predates per-part times.
+	PartUploadSeconds *Distribution `yaml:"part_upload_seconds,omitempty" json:"part_upload_seconds,omitempty"`
+}
+
+// Distribution summarizes per-part durations in seconds.
+type Distribution struct {
+	P50 int64 `yaml:"p50" json:"p50"`
+	P90 int64 `yaml:"p90" json:"p90"`
+	Max int64 `yaml:"max" json:"max"`
+}
+
+func (d *Distribution) String() string {
+	if d == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%ds/%ds/%ds", d.P50, d.P90, d.Max)
+}
+
+// PartUploadSeconds returns the distribution of the seconds between encrypting and uploading each
+// part, over the parts that recorded both, or nil when none did.
+func PartUploadSeconds(parts []manifest.PartInfo) *Distribution {
+	var seconds []int64
+	for _, p := range parts {
+		if p.EncryptedAt > 0 && p.UploadedAt >= p.EncryptedAt {
+			seconds = append(seconds, p.UploadedAt-p.EncryptedAt)
+		}
+	}
+	if len(seconds) == 0 {
+		return nil
+	}
+	slices.Sort(seconds)
+	// Nearest rank, so every value is one a part took.
+	rank := func(p int) int64 {
+		return seconds[(p*len(seconds)+99)/100-1]
+	}
+	return &Distribution{P50: rank(50), P90: rank(90), Max: seconds[len(seconds)-1]}
+}
+
+type LevelSummary struct {
+	Level              int16   `json:"level"`
+	Count              int     `json:"count"`
+	MinStreamBytes     int64   `json:"min_stream_bytes"`
+	MaxStreamBytes     int64   `json:"max_stream_bytes"`
+	AvgStreamBytes     int64   `json:"avg_stream_bytes"`
+	MinEncryptedBytes  int64   `json:"min_encrypted_bytes"`
+	MaxEncryptedBytes  int64   `json:"max_encrypted_bytes"`
+	AvgEncryptedBytes  int64   `json:"avg_encrypted_bytes"`
+	AvgDurationSeconds float64 `json:"avg_duration_seconds"`
+}
+
+type Output struct {
+	Task    string         `json:"task"`
+	Pool    string         `json:"pool"`
+	Dataset string         `json:"dataset"`
+	Levels  []LevelSummary `json:"levels"`
+	Records []Record       `json:"records"`
+}
+
+func Path(baseDir, pool, dataset string) string {
+	return filepath.Join(util.RunDir(baseDir, pool, dataset), "stats.yaml")
+}
+
+// Append adds one record as a YAML sequence item, keeping the file a valid list without rewriting it.
+func Append(path string, rec *Record) error {
+	if err := util.MkdirAll(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	data, err := yaml.Marshal([]*Record{rec})
+	if err != nil {
+		return err
+	}
+
+	f, err := util.AppendFile(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func Read(path string) ([]Record, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var records []Record
+	if err := yaml.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Filter keeps records of the given level (all if negative), limited to the last n by datetime (all if n <= 0).
+func Filter(records []Record, level int16, last int) []Record {
+	var out []Record
+	for _, r := range records {
+		if level >= 0 && r.Level != level {
+			continue
+		}
+		out = append(out, r)
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Datetime < out[j].Datetime
+	})
+
+	if last > 0 && len(out) > last {
+		out = out[len(out)-last:]
+	}
+	return out
+}
+
+func Summarize(records []Record) []LevelSummary {
+	byLevel := make(map[int16]*LevelSummary)
+	totalDuration := make(map[int16]float64)
+	totalStream := make(map[int16]int64)
+	totalEncrypted := make(map[int16]int64)
+
+	for _, r := range records {
+		s, ok := byLevel[r.Level]
+		if !ok {
+			s = &LevelSummary{
+				Level:             r.Level,
+				MinStreamBytes:    r.StreamBytes,
+				MaxStreamBytes:    r.StreamBytes,
+				MinEncryptedBytes: r.EncryptedBytes,
+				MaxEncryptedBytes: r.EncryptedBytes,
+			}
+			byLevel[r.Level] = s
+		}
+
+		s.Count++
+		s.MinStreamBytes = min(s.MinStreamBytes, r.StreamBytes)
+		s.MaxStreamBytes = max(s.MaxStreamBytes, r.StreamBytes)
+		s.MinEncryptedBytes = min(s.MinEncryptedBytes, r.EncryptedBytes)
+		s.MaxEncryptedBytes = max(s.MaxEncryptedBytes, r.EncryptedBytes)
+		totalStream[r.Level] += r.StreamBytes
+		totalEncrypted[r.Level] += r.EncryptedBytes
+		totalDuration[r.Level] += r.DurationSeconds
+	}
+
+	summaries := make([]LevelSummary, 0, len(byLevel))
+	for level, s := range byLevel {
+		s.AvgStreamBytes = totalStream[level] / int64(s.Count)
+		s.AvgEncryptedBytes = totalEncrypted[level] / int64(s.Count)
+		s.AvgDurationSeconds = totalDuration[level] / float64(s.Count)
+		summaries = append(summaries, *s)
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Level < summaries[j].Level
+	})
+	return summaries
+}
+
+func Run(_ context.Context, configPath, taskName string, level int16, last int, format string) error {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	task, err := cfg.FindTask(taskName)
+	if err != nil {
+		return err
+	}
+
+	records, err := Read(Path(cfg.BaseDir, task.Pool, task.Dataset))
+	if err != nil {
+		return fmt.Errorf("failed to read backup statistics: %w", err)
+	}
+
+	records = Filter(records, level, last)
+	output := Output{
+		Task:    taskName,
+		Pool:    task.Pool,
+		Dataset: task.Dataset,
+		Levels:  Summarize(records),
+		Records: records,
+	}
+	if output.Records == nil {
+		output.Records = []Record{}
+	}
+
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(output); err != nil {
+			return fmt.Errorf("failed to encode JSON: %w", err)
+		}
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "LEVEL\tCOUNT\tMIN STREAM\tMAX STREAM\tAVG STREAM\tAVG ENCRYPTED\tAVG DURATION")
+		for _, s := range output.Levels {
+			fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d\t%d\t%.1fs\n",
+				s.Level, s.Count, s.MinStreamBytes, s.MaxStreamBytes, s.AvgStreamBytes, s.AvgEncryptedBytes, s.AvgDurationSeconds)
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "DATETIME\tLEVEL\tSTREAM\tENCRYPTED\tUPLOADED\tPARTS\tPART P50/P90/MAX\tDURATION\tSNAPSHOT")
+		for _, r := range output.Records {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%s\t%.1fs\t%s\n",
+				time.Unix(r.Datetime, 0).Format("2006-01-02 15:04:05"),
+				r.Level, r.StreamBytes, r.EncryptedBytes, r.UploadedBytes, r.Parts, r.PartUploadSeconds, r.DurationSeconds, r.TargetSnapshot)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		printStaleHolds(os.Stdout, output.Records)
+	default:
+		return fmt.Errorf("unsupported format: %s (expected json or table)", format)
+	}
+
+	return nil
+}
+
+// printStaleHolds lists the holds backups failed to release, as the commands that release them.
+func printStaleHolds(w io.Writer, records []Record) {
+	header := false
+	for _, r := range records {
+		for _, h := range r.StaleHolds {
+			if !header {
+				fmt.Fprintln(w, "\nHolds the backups failed to release:")
+				header = true
+			}
+			fmt.Fprintf(w, "  zfs release %s  # backup of %s\n", h, time.Unix(r.Datetime, 0).Format("2006-01-02 15:04:05"))
+		}
+	}
+}
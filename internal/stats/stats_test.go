@@ -0,0 +1,149 @@
+package stats
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"zrb/internal/manifest"
+	"zrb/internal/zfs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const history = `- level: 0
+  datetime: 100
+  stream_bytes: 1000
+  encrypted_bytes: 1100
+  duration_seconds: 10
+  parts: 1
+  target_snapshot: pool/data@zrb_level0_a
+- level: 1
+  datetime: 200
+  stream_bytes: 100
+  encrypted_bytes: 120
+  duration_seconds: 2
+  parts: 1
+  target_snapshot: pool/data@zrb_level1_a
+- level: 1
+  datetime: 300
+  stream_bytes: 300
+  encrypted_bytes: 320
+  duration_seconds: 4
+  parts: 1
+  target_snapshot: pool/data@zrb_level1_b
+- level: 1
+  datetime: 250
+  stream_bytes: 200
+  encrypted_bytes: 220
+  duration_seconds: 3
+  parts: 1
+  target_snapshot: pool/data@zrb_level1_c
+`
+
+func writeHistory(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "stats.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(history), 0o644))
+	return path
+}
+
+func TestAppendAndRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run", "stats.yaml")
+
+	require.NoError(t, Append(path, &Record{Level: 0, Datetime: 1, StreamBytes: 10}))
+	require.NoError(t, Append(path, &Record{Level: 1, Datetime: 2, StreamBytes: 5}))
+
+	records, err := Read(path)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, int64(10), records[0].StreamBytes)
+	assert.Equal(t, int16(1), records[1].Level)
+}
+
+func TestPrintStaleHolds(t *testing.T) {
+	var out bytes.Buffer
+	printStaleHolds(&out, []Record{{Datetime: 1}})
+	assert.Empty(t, out.String())
+
+	path := filepath.Join(t.TempDir(), "stats.yaml")
+	require.NoError(t, Append(path, &Record{Datetime: 1705276800, StaleHolds: []zfs.UserHold{{Tag: "zrb:last", Snapshot: "tank/data@zrb_level0_a"}}}))
+	records, err := Read(path)
+	require.NoError(t, err)
+
+	printStaleHolds(&out, records)
+	assert.Contains(t, out.String(), "Holds the backups failed to release:\n  zfs release zrb:last tank/data@zrb_level0_a  # backup of ")
+}
+
+func TestReadMissing(t *testing.T) {
+	records, err := Read(filepath.Join(t.TempDir(), "stats.yaml"))
+	require.NoError(t, err)
+	assert.Empty(t, records)
+}
+
+func TestFilter(t *testing.T) {
+	records, err := Read(writeHistory(t))
+	require.NoError(t, err)
+
+	t.Run("all levels sorted by datetime", func(t *testing.T) {
+		got := Filter(records, -1, 0)
+		require.Len(t, got, 4)
+		assert.Equal(t, []int64{100, 200, 250, 300}, []int64{got[0].Datetime, got[1].Datetime, got[2].Datetime, got[3].Datetime})
+	})
+
+	t.Run("single level", func(t *testing.T) {
+		got := Filter(records, 1, 0)
+		assert.Len(t, got, 3)
+	})
+
+	t.Run("last n", func(t *testing.T) {
+		got := Filter(records, 1, 2)
+		require.Len(t, got, 2)
+		assert.Equal(t, int64(250), got[0].Datetime)
+		assert.Equal(t, int64(300), got[1].Datetime)
+	})
+}
+
+func TestSummarize(t *testing.T) {
+	records, err := Read(writeHistory(t))
+	require.NoError(t, err)
+
+	summaries := Summarize(records)
+	require.Len(t, summaries, 2)
+
+	assert.Equal(t, int16(0), summaries[0].Level)
+	assert.Equal(t, 1, summaries[0].Count)
+	assert.Equal(t, int64(1000), summaries[0].AvgStreamBytes)
+
+	level1 := summaries[1]
+	assert.Equal(t, int16(1), level1.Level)
+	assert.Equal(t, 3, level1.Count)
+	assert.Equal(t, int64(100), level1.MinStreamBytes)
+	assert.Equal(t, int64(300), level1.MaxStreamBytes)
+	assert.Equal(t, int64(200), level1.AvgStreamBytes)
+	assert.Equal(t, int64(120), level1.MinEncryptedBytes)
+	assert.Equal(t, int64(320), level1.MaxEncryptedBytes)
+	assert.Equal(t, int64(220), level1.AvgEncryptedBytes)
+	assert.InDelta(t, 3.0, level1.AvgDurationSeconds, 0.001)
+}
+
+func TestSummarizeEmpty(t *testing.T) {
+	assert.Empty(t, Summarize(nil))
+}
+
+func TestPartUploadSeconds(t *testing.T) {
+	assert.Nil(t, PartUploadSeconds([]manifest.PartInfo{{Index: "aa", EncryptedAt: 100}}), "nothing uploaded")
+
+	var parts []manifest.PartInfo
+	for i := range 10 {
+		parts = append(parts, manifest.PartInfo{EncryptedAt: 1000, UploadedAt: 1000 + int64(i+1)*10})
+	}
+	parts = append(parts, manifest.PartInfo{UploadedAt: 5000}, manifest.PartInfo{EncryptedAt: 2000, UploadedAt: 1000})
+	d := PartUploadSeconds(parts)
+	assert.Equal(t, &Distribution{P50: 50, P90: 90, Max: 100}, d, "parts without both times are left out")
+	assert.Equal(t, "50s/90s/100s", d.String())
+
+	var none *Distribution
+	assert.Equal(t, "-", none.String())
+}
@@ -0,0 +1,193 @@
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+	"zrb/internal/config"
+	"zrb/internal/lock"
+	"zrb/internal/manifest"
+	"zrb/internal/util"
+)
+
+// Options of zrb status. Without Tasks it reports every task of the config.
+type Options struct {
+	ConfigPath string
+	// Tasks are task names or globs, see config.Config.SelectTasks.
+	Tasks []string
+}
+
+// Task is the local state of one task's dataset, as read from its run directory.
+type Task struct {
+	Task    string `json:"task"`
+	Pool    string `json:"pool"`
+	Dataset string `json:"dataset"`
+	// Lock is the holder recorded in zrb.lock, nil when there is none.
+	Lock *Lock `json:"lock"`
+	// State is the backup left in backup_state.yaml, nil when there is none.
+	State *State `json:"state"`
+	// LastBackups are the backups of last_backup_manifest.yaml, one per level.
+	LastBackups []Backup `json:"last_backups"`
+	// Errors are the files of the run directory that could not be read.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Lock is the process recorded in a lock file. Held is false for a stale lock whose process is
+// gone, which the next backup takes over.
+type Lock struct {
+	Held       bool   `json:"held"`
+	Pid        int    `json:"pid"`
+	StartedAt  string `json:"started_at"`
+	TaskName   string `json:"task_name,omitempty"`
+	Level      int16  `json:"level"`
+	Hostname   string `json:"hostname,omitempty"`
+	ZrbVersion string `json:"zrb_version,omitempty"`
+}
+
+// State is a backup that was started and not finished: in flight while the lock is held,
+// otherwise resumed by the next backup of its level unless Invalid says why it cannot be.
+type State struct {
+	TaskName       string `json:"task_name"`
+	Level          int16  `json:"level"`
+	TargetSnapshot string `json:"target_snapshot"`
+	ParentSnapshot string `json:"parent_snapshot,omitempty"`
+	// PartsUploaded are done; PartsEncrypted are encrypted and wait for their upload.
+	PartsUploaded  int   `json:"parts_uploaded"`
+	PartsEncrypted int   `json:"parts_encrypted"`
+	StreamBytes    int64 `json:"stream_bytes,omitempty"`
+	UploadedBytes  int64 `json:"uploaded_bytes,omitempty"`
+	// ManifestCreated and ManifestUploaded tell whether the run got past its parts.
+	ManifestCreated  bool   `json:"manifest_created"`
+	ManifestUploaded bool   `json:"manifest_uploaded"`
+	LastUpdated      int64  `json:"last_updated"`
+	LastUpdatedStr   string `json:"last_updated_str"`
+	Resumable        bool   `json:"resumable"`
+	Invalid          string `json:"invalid,omitempty"`
+}
+
+// Backup is the last successful backup of a level.
+type Backup struct {
+	Level       int16  `json:"level"`
+	Snapshot    string `json:"snapshot"`
+	Datetime    int64  `json:"datetime"`
+	DatetimeStr string `json:"datetime_str"`
+	S3Path      string `json:"s3_path,omitempty"`
+	LocalOnly   bool   `json:"local_only,omitempty"`
+}
+
+// Replaced by tests.
+var output io.Writer = os.Stdout
+
+// Run prints the status of the selected tasks as a JSON array. It only reads the run directories,
+// so it is safe while a backup runs: the state and the last backup manifest are replaced
+// atomically, never written in place.
+func Run(opts Options) error {
+	cfg, err := config.Load(opts.ConfigPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	names := make([]string, 0, len(cfg.Tasks))
+	if len(opts.Tasks) == 0 {
+		for _, t := range cfg.Tasks {
+			names = append(names, t.Name)
+		}
+	} else if names, err = cfg.SelectTasks(opts.Tasks); err != nil {
+		return err
+	}
+
+	statuses := make([]*Task, 0, len(names))
+	for _, name := range names {
+		task, err := cfg.FindTask(name)
+		if err != nil {
+			return err
+		}
+		statuses = append(statuses, read(util.RunDir(cfg.BaseDir, task.Pool, task.Dataset), task))
+	}
+
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(statuses)
+}
+
+// read collects the status of task from its run directory. A file that cannot be read is
+// reported in Errors rather than failing the other tasks.
+func read(runDir string, task *config.Task) *Task {
+	status := &Task{Task: task.Name, Pool: task.Pool, Dataset: task.Dataset, LastBackups: []Backup{}}
+
+	entries, err := lock.Query(filepath.Join(runDir, "zrb.lock"))
+	if err != nil {
+		status.Errors = append(status.Errors, fmt.Sprintf("failed to read lock: %v", err))
+	}
+	for _, e := range entries {
+		status.Lock = &Lock{
+			Held:       e.Alive,
+			Pid:        e.Pid,
+			StartedAt:  e.StartedAt,
+			TaskName:   e.TaskName,
+			Level:      e.Level,
+			Hostname:   e.Hostname,
+			ZrbVersion: e.ZrbVersion,
+		}
+	}
+
+	state, err := manifest.ReadState(filepath.Join(runDir, "backup_state.yaml"))
+	switch {
+	case err == nil:
+		status.State = stateStatus(state)
+	case !os.IsNotExist(err):
+		status.Errors = append(status.Errors, fmt.Sprintf("failed to read backup state: %v", err))
+	}
+
+	last, err := manifest.ReadLast(filepath.Join(runDir, "last_backup_manifest.yaml"))
+	switch {
+	case err == nil:
+		for level, ref := range last.BackupLevels {
+			if ref == nil {
+				continue
+			}
+			status.LastBackups = append(status.LastBackups, Backup{
+				Level:       int16(level),
+				Snapshot:    ref.Snapshot,
+				Datetime:    ref.Datetime,
+				DatetimeStr: formatTime(ref.Datetime),
+				S3Path:      ref.S3Path,
+				LocalOnly:   ref.LocalOnly,
+			})
+		}
+	case !os.IsNotExist(err):
+		status.Errors = append(status.Errors, fmt.Sprintf("failed to read last backup manifest: %v", err))
+	}
+
+	return status
+}
+
+func stateStatus(state *manifest.State) *State {
+	return &State{
+		TaskName:         state.TaskName,
+		Level:            state.BackupLevel,
+		TargetSnapshot:   state.TargetSnapshot,
+		ParentSnapshot:   state.ParentSnapshot,
+		PartsUploaded:    len(state.PartsCompleted),
+		PartsEncrypted:   len(state.PartsEncrypted),
+		StreamBytes:      state.StreamBytes,
+		UploadedBytes:    state.UploadedBytes,
+		ManifestCreated:  state.ManifestCreated,
+		ManifestUploaded: state.ManifestUploaded,
+		LastUpdated:      state.LastUpdated,
+		LastUpdatedStr:   formatTime(state.LastUpdated),
+		Resumable:        state.Invalid == "",
+		Invalid:          state.Invalid,
+	}
+}
+
+// formatTime formats Unix seconds in local time, or returns an empty string when unknown.
+func formatTime(unix int64) string {
+	if unix == 0 {
+		return ""
+	}
+	return time.Unix(unix, 0).Format("2006-01-02 15:04:05")
+}
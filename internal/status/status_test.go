@@ -0,0 +1,146 @@
+package status
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"zrb/internal/lock"
+	"zrb/internal/manifest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setup writes a config with the tasks data (tank/data), sub (tank/data/sub) and other
+// (tank/other) and returns it with its base_dir. The output of Run is captured in the returned
+// buffer.
+func setup(t *testing.T) (string, string, *bytes.Buffer) {
+	t.Helper()
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base")
+	configPath := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+tasks:
+  - name: data
+    pool: tank
+    dataset: data
+    enabled: true
+  - name: sub
+    pool: tank
+    dataset: data/sub
+    enabled: true
+  - name: other
+    pool: tank
+    dataset: other
+    enabled: true
+`, base)), 0o644))
+
+	var out bytes.Buffer
+	old := output
+	output = &out
+	t.Cleanup(func() { output = old })
+	return configPath, base, &out
+}
+
+func writeLock(t *testing.T, path string, entry lock.Entry) {
+	t.Helper()
+	data := fmt.Sprintf("pid: %d\nstarted_at: %q\ntask_name: %s\nlevel: %d\n", entry.Pid, entry.StartedAt, entry.TaskName, entry.Level)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(t, os.WriteFile(path, []byte(data), 0o644))
+}
+
+func TestRun(t *testing.T) {
+	configPath, base, out := setup(t)
+
+	runDir := filepath.Join(base, "run", "tank", "data")
+	writeLock(t, filepath.Join(runDir, "zrb.lock"), lock.Entry{Pid: os.Getpid(), StartedAt: "2024-01-02T00:00:00Z", TaskName: "data", Level: 1})
+	require.NoError(t, manifest.WriteState(filepath.Join(runDir, "backup_state.yaml"), &manifest.State{
+		TaskName:       "data",
+		BackupLevel:    1,
+		TargetSnapshot: "tank/data@zrb_level1",
+		PartsCompleted: map[string]string{"a00000": "h0", "a00001": "h1"},
+		PartsEncrypted: map[string]string{"a00002": "h2"},
+		StreamBytes:    300,
+		UploadedBytes:  200,
+		LastUpdated:    1700000000,
+	}))
+	require.NoError(t, manifest.WriteLast(filepath.Join(runDir, "last_backup_manifest.yaml"), &manifest.Last{
+		Pool: "tank", Dataset: "data",
+		BackupLevels: []*manifest.Ref{{Snapshot: "tank/data@zrb_level0", Datetime: 1600000000, S3Path: "tank/data/level0/20200913"}},
+	}))
+
+	subDir := filepath.Join(base, "run", "tank", "data", "sub")
+	writeLock(t, filepath.Join(subDir, "zrb.lock"), lock.Entry{Pid: 999999999, StartedAt: "2024-01-01T00:00:00Z", TaskName: "sub"})
+	require.NoError(t, manifest.WriteState(filepath.Join(subDir, "backup_state.yaml"), &manifest.State{TaskName: "sub", Invalid: "snapshot destroyed"}))
+
+	require.NoError(t, Run(Options{ConfigPath: configPath}))
+
+	var statuses []Task
+	require.NoError(t, json.Unmarshal(out.Bytes(), &statuses))
+	require.Len(t, statuses, 3)
+
+	data := statuses[0]
+	assert.Equal(t, "data", data.Task)
+	require.NotNil(t, data.Lock)
+	assert.True(t, data.Lock.Held, "the lock of a running process is held")
+	assert.Equal(t, os.Getpid(), data.Lock.Pid)
+	require.NotNil(t, data.State)
+	assert.Equal(t, int16(1), data.State.Level)
+	assert.Equal(t, 2, data.State.PartsUploaded)
+	assert.Equal(t, 1, data.State.PartsEncrypted)
+	assert.Equal(t, int64(200), data.State.UploadedBytes)
+	assert.Equal(t, int64(1700000000), data.State.LastUpdated)
+	assert.True(t, data.State.Resumable)
+	require.Len(t, data.LastBackups, 1)
+	assert.Equal(t, "tank/data@zrb_level0", data.LastBackups[0].Snapshot)
+	assert.Equal(t, int64(1600000000), data.LastBackups[0].Datetime)
+
+	sub := statuses[1]
+	require.NotNil(t, sub.Lock)
+	assert.False(t, sub.Lock.Held, "a lock left by a dead process is stale")
+	require.NotNil(t, sub.State)
+	assert.False(t, sub.State.Resumable)
+	assert.Equal(t, "snapshot destroyed", sub.State.Invalid)
+	assert.Empty(t, sub.LastBackups)
+
+	other := statuses[2]
+	assert.Nil(t, other.Lock)
+	assert.Nil(t, other.State)
+	assert.Empty(t, other.Errors, "a task that never ran has nothing to read")
+
+	// Nothing was written to the run directories
+	_, err := os.Stat(filepath.Join(base, "run", "tank", "other"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRunSelectsTasks(t *testing.T) {
+	configPath, _, out := setup(t)
+
+	require.NoError(t, Run(Options{ConfigPath: configPath, Tasks: []string{"o*"}}))
+	var statuses []Task
+	require.NoError(t, json.Unmarshal(out.Bytes(), &statuses))
+	require.Len(t, statuses, 1)
+	assert.Equal(t, "other", statuses[0].Task)
+
+	assert.Error(t, Run(Options{ConfigPath: configPath, Tasks: []string{"missing"}}))
+}
+
+func TestRunReportsUnreadableState(t *testing.T) {
+	configPath, base, out := setup(t)
+
+	runDir := filepath.Join(base, "run", "tank", "other")
+	require.NoError(t, os.MkdirAll(runDir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(runDir, "backup_state.yaml"), []byte("parts_completed: ["), 0o644))
+
+	require.NoError(t, Run(Options{ConfigPath: configPath, Tasks: []string{"other"}}))
+	var statuses []Task
+	require.NoError(t, json.Unmarshal(out.Bytes(), &statuses))
+	require.Len(t, statuses, 1)
+	assert.Nil(t, statuses[0].State)
+	require.Len(t, statuses[0].Errors, 1)
+	assert.Contains(t, statuses[0].Errors[0], "failed to read backup state")
+}
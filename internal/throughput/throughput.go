@@ -0,0 +1,182 @@
+// Package throughput measures how fast the phases of a run move bytes, such as the download,
+// decryption and zfs receive of a restore, so a slow run shows which phase holds it up. The bytes
+// are counted by readers and writers placed in the pipeline of each phase.
+package throughput
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// rollingWindow is how far back Rolling looks.
+const rollingWindow = 30 * time.Second
+
+// Replaced by tests.
+var (
+	now        = time.Now
+	processCPU = func() time.Duration {
+		var ru syscall.Rusage
+		if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+			return 0
+		}
+		return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+	}
+)
+
+// Meter counts the bytes of one phase and the wall and CPU time spent in it. It is safe for
+// concurrent use; a nil Meter counts nothing.
+type Meter struct {
+	bytes  atomic.Int64
+	active atomic.Int64
+	cpu    atomic.Int64
+
+	mu      sync.Mutex
+	samples []sample
+}
+
+type sample struct {
+	at    time.Time
+	bytes int64
+}
+
+// Add counts n bytes.
+func (m *Meter) Add(n int64) {
+	if m == nil {
+		return
+	}
+	m.bytes.Add(n)
+}
+
+// Bytes returns the bytes counted so far.
+func (m *Meter) Bytes() int64 {
+	if m == nil {
+		return 0
+	}
+	return m.bytes.Load()
+}
+
+type countingReader struct {
+	r io.Reader
+	m *Meter
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.m.Add(int64(n))
+	return n, err
+}
+
+// Reader counts everything read from r.
+func (m *Meter) Reader(r io.Reader) io.Reader {
+	if m == nil {
+		return r
+	}
+	return countingReader{r: r, m: m}
+}
+
+type countingWriter struct {
+	w io.Writer
+	m *Meter
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.m.Add(int64(n))
+	return n, err
+}
+
+// Writer counts everything written to w.
+func (m *Meter) Writer(w io.Writer) io.Writer {
+	if m == nil {
+		return w
+	}
+	return countingWriter{w: w, m: m}
+}
+
+// Time runs fn and adds the wall time it took and the CPU time the process used meanwhile. Phases
+// of a restore run one after another, so the CPU time is that of the phase.
+func (m *Meter) Time(fn func() error) error {
+	if m == nil {
+		return fn()
+	}
+	start, startCPU := now(), processCPU()
+	err := fn()
+	m.active.Add(int64(now().Sub(start)))
+	m.cpu.Add(int64(processCPU() - startCPU))
+	return err
+}
+
+// Rolling returns the bytes per second over the last rollingWindow up to at, measured from the
+// earlier calls. The first call has nothing to compare with and returns 0.
+func (m *Meter) Rolling(at time.Time) float64 {
+	if m == nil {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	bytes := m.Bytes()
+	m.samples = append(m.samples, sample{at: at, bytes: bytes})
+	// Keep the newest sample at or before the start of the window.
+	for len(m.samples) > 2 && at.Sub(m.samples[1].at) >= rollingWindow {
+		m.samples = m.samples[1:]
+	}
+	first := m.samples[0]
+	elapsed := at.Sub(first.at)
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(bytes-first.bytes) / elapsed.Seconds()
+}
+
+// Phase is the final throughput of one phase, as recorded in the restore history.
+type Phase struct {
+	Bytes      int64   `yaml:"bytes" json:"bytes"`
+	Seconds    float64 `yaml:"seconds" json:"seconds"`
+	CPUSeconds float64 `yaml:"cpu_seconds" json:"cpu_seconds"`
+	// BytesPerSecond is Bytes over Seconds, the time spent in the phase rather than the whole run.
+	BytesPerSecond float64 `yaml:"bytes_per_second" json:"bytes_per_second"`
+}
+
+// Summary returns the bytes and time of the phase so far.
+func (m *Meter) Summary() Phase {
+	if m == nil {
+		return Phase{}
+	}
+	p := Phase{
+		Bytes:      m.Bytes(),
+		Seconds:    time.Duration(m.active.Load()).Seconds(),
+		CPUSeconds: time.Duration(m.cpu.Load()).Seconds(),
+	}
+	if p.Seconds > 0 {
+		p.BytesPerSecond = float64(p.Bytes) / p.Seconds
+	}
+	return p
+}
+
+// FormatRate returns bytes per second in powers of 1024, e.g. 112.4 MiB/s.
+func FormatRate(bytesPerSecond float64) string {
+	return formatBytes(bytesPerSecond) + "/s"
+}
+
+// FormatBytes returns bytes in powers of 1024, e.g. 1.2 GiB.
+func FormatBytes(bytes int64) string {
+	return formatBytes(float64(bytes))
+}
+
+func formatBytes(v float64) string {
+	const units = "KMGTP"
+	if v < 1024 {
+		return fmt.Sprintf("%.0f B", v)
+	}
+	i := -1
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", v, units[i])
+}
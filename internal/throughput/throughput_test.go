@@ -0,0 +1,92 @@
+package throughput
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReaderWriter(t *testing.T) {
+	m := &Meter{}
+	var out bytes.Buffer
+	n, err := io.Copy(m.Writer(&out), m.Reader(strings.NewReader("hello")))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+	assert.Equal(t, "hello", out.String())
+	assert.Equal(t, int64(10), m.Bytes(), "read and written bytes both count")
+
+	var nilMeter *Meter
+	r := strings.NewReader("x")
+	assert.Same(t, r, nilMeter.Reader(r), "a nil meter does not wrap")
+	nilMeter.Add(1)
+	assert.Equal(t, int64(0), nilMeter.Bytes())
+	assert.Equal(t, Phase{}, nilMeter.Summary())
+	assert.Equal(t, 0.0, nilMeter.Rolling(time.Now()))
+}
+
+func TestTime(t *testing.T) {
+	clock := time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)
+	cpu := time.Duration(0)
+	defer func(n func() time.Time, c func() time.Duration) { now, processCPU = n, c }(now, processCPU)
+	now = func() time.Time { return clock }
+	processCPU = func() time.Duration { return cpu }
+
+	m := &Meter{}
+	err := m.Time(func() error {
+		m.Add(4 << 20)
+		clock = clock.Add(2 * time.Second)
+		cpu += 1500 * time.Millisecond
+		return io.ErrUnexpectedEOF
+	})
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF, "the error of fn is returned")
+
+	// Time outside of Time does not count.
+	clock = clock.Add(time.Hour)
+	require.NoError(t, m.Time(func() error {
+		clock = clock.Add(2 * time.Second)
+		return nil
+	}))
+
+	assert.Equal(t, Phase{Bytes: 4 << 20, Seconds: 4, CPUSeconds: 1.5, BytesPerSecond: 1 << 20}, m.Summary())
+}
+
+func TestRolling(t *testing.T) {
+	m := &Meter{}
+	start := time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, 0.0, m.Rolling(start), "nothing to compare the first sample with")
+
+	m.Add(1000)
+	assert.Equal(t, 100.0, m.Rolling(start.Add(10*time.Second)))
+	m.Add(2000)
+	assert.Equal(t, 150.0, m.Rolling(start.Add(20*time.Second)))
+
+	// After a stall the rate drops once the fast samples leave the window.
+	assert.Equal(t, 100.0, m.Rolling(start.Add(30*time.Second)))
+	assert.InDelta(t, 66.7, m.Rolling(start.Add(40*time.Second)), 0.1, "30s back is the sample at 10s")
+	assert.Equal(t, 0.0, m.Rolling(start.Add(50*time.Second)))
+	assert.Equal(t, 0.0, m.Rolling(start.Add(80*time.Second)))
+	assert.LessOrEqual(t, len(m.samples), 5, "old samples are dropped")
+}
+
+func TestFormatRate(t *testing.T) {
+	for in, want := range map[float64]string{
+		0:                 "0 B/s",
+		1000:              "1000 B/s",
+		1536:              "1.5 KiB/s",
+		112.4 * (1 << 20): "112.4 MiB/s",
+		3 << 30:           "3.0 GiB/s",
+		1 << 60:           "1024.0 PiB/s",
+	} {
+		assert.Equal(t, want, FormatRate(in))
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "512 B", FormatBytes(512))
+	assert.Equal(t, "1.2 GiB", FormatBytes(1288490189))
+}
@@ -0,0 +1,81 @@
+package units
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LimitFormats describes the accepted input of a Limit in error messages and help texts.
+const LimitFormats = "a size (" + SizeFormats + ") or a multiple of the expected size such as 3x or 1.5x"
+
+// Limit caps a size either absolutely or as a multiple of the size expected beforehand, e.g.
+// 500G or 3x. The zero Limit is no limit. A plain number in YAML is bytes.
+type Limit struct {
+	Bytes  int64
+	Factor float64
+}
+
+// ParseLimit returns the limit of a size such as 500G or a multiple such as 3x.
+func ParseLimit(s string) (Limit, error) {
+	in := strings.TrimSpace(s)
+	if factor, ok := strings.CutSuffix(strings.ToLower(in), "x"); ok {
+		number, rest := splitNumber(factor)
+		if number == "" || rest != "" {
+			return Limit{}, limitError(s, "no number before x")
+		}
+		f, err := strconv.ParseFloat(number, 64)
+		if err != nil || f == 0 {
+			return Limit{}, limitError(s, "the multiple must be above 0")
+		}
+		return Limit{Factor: f}, nil
+	}
+	n, reason := parseSize(in)
+	if reason != "" {
+		return Limit{}, limitError(s, reason)
+	}
+	return Limit{Bytes: n}, nil
+}
+
+// IsZero reports whether l is no limit.
+func (l Limit) IsZero() bool {
+	return l.Bytes == 0 && l.Factor == 0
+}
+
+// Of returns the limit in bytes for a size of expected bytes, 0 when there is none: the factor
+// of a multiple needs an expected size above 0.
+func (l Limit) Of(expected int64) int64 {
+	if l.Bytes > 0 || l.Factor == 0 || expected <= 0 {
+		return l.Bytes
+	}
+	return int64(l.Factor * float64(expected))
+}
+
+func (l Limit) String() string {
+	if l.Factor > 0 {
+		return strconv.FormatFloat(l.Factor, 'f', -1, 64) + "x"
+	}
+	return FormatSize(l.Bytes)
+}
+
+func (l *Limit) UnmarshalYAML(node *yaml.Node) error {
+	if err := scalar(node); err != nil {
+		return err
+	}
+	if n, err := strconv.ParseInt(node.Value, 10, 64); err == nil {
+		*l = Limit{Bytes: n}
+		return nil
+	}
+	v, err := ParseLimit(node.Value)
+	if err != nil {
+		return &YAMLError{Line: node.Line, Column: node.Column, Err: err}
+	}
+	*l = v
+	return nil
+}
+
+func limitError(s, reason string) error {
+	return fmt.Errorf("invalid limit %q: %s; want %s", s, reason, LimitFormats)
+}
@@ -0,0 +1,204 @@
+// Package units parses the sizes and durations of config fields and command-line flags, such as
+// 512M, 1.5GiB, 36h or 7d, so every knob accepts the same formats and reports the same errors.
+package units
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SizeFormats and DurationFormats describe the accepted input in error messages and help texts.
+const (
+	SizeFormats     = "a byte count or a number with a K, M, G, T or P suffix in powers of 1024, optionally followed by B or iB (e.g. 512M, 3G, 1.5GiB)"
+	DurationFormats = "a number with a unit of ns, us, ms, s, m, h, d (24h) or w (7d), which may be combined (e.g. 90s, 36h, 7d, 1d12h)"
+)
+
+// sizeUnits are the byte multipliers of the size suffixes, lower-cased. Like zfs, K, M and G
+// mean powers of 1024 with or without B or iB.
+var sizeUnits = map[string]int64{
+	"": 1, "b": 1,
+	"k": 1 << 10, "kb": 1 << 10, "kib": 1 << 10,
+	"m": 1 << 20, "mb": 1 << 20, "mib": 1 << 20,
+	"g": 1 << 30, "gb": 1 << 30, "gib": 1 << 30,
+	"t": 1 << 40, "tb": 1 << 40, "tib": 1 << 40,
+	"p": 1 << 50, "pb": 1 << 50, "pib": 1 << 50,
+}
+
+// durationUnits extends the units of time.ParseDuration with days and weeks.
+var durationUnits = map[string]int64{
+	"ns": int64(time.Nanosecond),
+	"us": int64(time.Microsecond),
+	"µs": int64(time.Microsecond),
+	"ms": int64(time.Millisecond),
+	"s":  int64(time.Second),
+	"m":  int64(time.Minute),
+	"h":  int64(time.Hour),
+	"d":  int64(24 * time.Hour),
+	"w":  int64(7 * 24 * time.Hour),
+}
+
+// ParseSize returns the bytes of a size such as 4096, 512M or 1.5GiB.
+func ParseSize(s string) (int64, error) {
+	n, reason := parseSize(s)
+	if reason != "" {
+		return 0, sizeError(s, reason)
+	}
+	return n, nil
+}
+
+// parseSize is ParseSize with the reason s is invalid instead of an error.
+func parseSize(s string) (int64, string) {
+	in := strings.TrimSpace(s)
+	if in == "" {
+		return 0, "empty"
+	}
+	if in[0] == '-' {
+		return 0, "negative"
+	}
+
+	number, unit := splitNumber(in)
+	if number == "" {
+		return 0, "no number"
+	}
+	multiplier, ok := sizeUnits[strings.ToLower(strings.TrimSpace(unit))]
+	if !ok {
+		return 0, fmt.Sprintf("unknown unit %q", strings.TrimSpace(unit))
+	}
+	n, exact, err := scale(number, multiplier)
+	switch {
+	case err != nil:
+		return 0, err.Error()
+	case !exact:
+		return 0, "not a whole number of bytes"
+	}
+	return n, ""
+}
+
+// FormatSize returns bytes with the largest suffix that keeps it whole, e.g. 512M, the way
+// ParseSize reads it back.
+func FormatSize(bytes int64) string {
+	for _, u := range []struct {
+		suffix string
+		size   int64
+	}{{"P", 1 << 50}, {"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if bytes != 0 && bytes%u.size == 0 {
+			return strconv.FormatInt(bytes/u.size, 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(bytes, 10)
+}
+
+// ParseDuration returns a duration such as 90s, 36h, 7d or 1d12h. Unlike time.ParseDuration it
+// knows days and weeks, rejects negative durations, and rejects M, which could mean minutes or
+// months.
+func ParseDuration(s string) (time.Duration, error) {
+	in := strings.TrimSpace(s)
+	switch {
+	case in == "":
+		return 0, durationError(s, "empty")
+	case in[0] == '-':
+		return 0, durationError(s, "negative")
+	case in == "0":
+		return 0, nil
+	}
+
+	var total int64
+	for rest := in; rest != ""; {
+		number, after := splitNumber(rest)
+		if number == "" {
+			return 0, durationError(s, "no number before "+strconv.Quote(after))
+		}
+		end := strings.IndexAny(after, "0123456789.")
+		if end < 0 {
+			end = len(after)
+		}
+		unit := after[:end]
+		rest = after[end:]
+
+		multiplier, ok := durationUnits[unit]
+		switch {
+		case unit == "":
+			return 0, durationError(s, "missing unit after "+number)
+		case unit == "M":
+			return 0, durationError(s, "M is ambiguous, use m for minutes or d for days")
+		case unit == "mo" || unit == "y" || unit == "Y":
+			return 0, durationError(s, "months and years have no fixed length, use d or w")
+		case !ok:
+			return 0, durationError(s, fmt.Sprintf("unknown unit %q", unit))
+		}
+		n, _, err := scale(number, multiplier)
+		if err != nil || total > math.MaxInt64-n {
+			return 0, durationError(s, "too large")
+		}
+		total += n
+	}
+	return time.Duration(total), nil
+}
+
+// splitNumber splits s after its leading decimal number, with at most one decimal point.
+func splitNumber(s string) (number, rest string) {
+	dot := false
+	i := 0
+	for ; i < len(s); i++ {
+		c := s[i]
+		if c == '.' && !dot {
+			dot = true
+			continue
+		}
+		if c < '0' || c > '9' {
+			break
+		}
+	}
+	number = s[:i]
+	if strings.Trim(number, ".") == "" {
+		return "", s
+	}
+	return number, s[i:]
+}
+
+// scale returns the decimal number times multiplier, truncated, and whether nothing was truncated.
+func scale(number string, multiplier int64) (n int64, exact bool, err error) {
+	whole, frac, _ := strings.Cut(number, ".")
+	if whole != "" {
+		w, err := strconv.ParseInt(whole, 10, 64)
+		if err != nil || w > math.MaxInt64/multiplier {
+			return 0, false, fmt.Errorf("too large")
+		}
+		n = w * multiplier
+	}
+
+	// Scale the fraction digit by digit so that 1.5G stays exact.
+	exact = true
+	remainder := int64(0)
+	divisor := int64(1)
+	for _, c := range frac {
+		if divisor > math.MaxInt64/10/multiplier {
+			// Digits this far down cannot add a whole unit.
+			if c != '0' {
+				exact = false
+			}
+			continue
+		}
+		remainder = remainder*10 + int64(c-'0')
+		divisor *= 10
+	}
+	part := remainder * multiplier
+	if part%divisor != 0 {
+		exact = false
+	}
+	if n > math.MaxInt64-part/divisor {
+		return 0, false, fmt.Errorf("too large")
+	}
+	return n + part/divisor, exact, nil
+}
+
+func sizeError(s, reason string) error {
+	return fmt.Errorf("invalid size %q: %s; want %s", s, reason, SizeFormats)
+}
+
+func durationError(s, reason string) error {
+	return fmt.Errorf("invalid duration %q: %s; want %s", s, reason, DurationFormats)
+}
@@ -0,0 +1,280 @@
+package units
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr string
+	}{
+		{in: "0", want: 0},
+		{in: "4096", want: 4096},
+		{in: "1B", want: 1},
+		{in: "512K", want: 512 << 10},
+		{in: "512k", want: 512 << 10},
+		{in: "512KB", want: 512 << 10},
+		{in: "512KiB", want: 512 << 10},
+		{in: "512kib", want: 512 << 10},
+		{in: "512M", want: 512 << 20},
+		{in: "64MiB", want: 64 << 20},
+		{in: "3G", want: 3 << 30},
+		{in: "3GB", want: 3 << 30},
+		{in: "1.5GiB", want: 3 << 29},
+		{in: "1.5G", want: 3 << 29},
+		{in: "0.5M", want: 512 << 10},
+		{in: ".5M", want: 512 << 10},
+		{in: "5.M", want: 5 << 20},
+		{in: "2T", want: 2 << 40},
+		{in: "1P", want: 1 << 50},
+		{in: "8191P", want: 8191 << 50},
+		{in: " 10 MB ", want: 10 << 20},
+		{in: "1.000000000000000000000000G", want: 1 << 30},
+		{in: "9223372036854775807", want: math.MaxInt64},
+
+		{in: "", wantErr: "empty"},
+		{in: "   ", wantErr: "empty"},
+		{in: "-1", wantErr: "negative"},
+		{in: "-1G", wantErr: "negative"},
+		{in: "+1G", wantErr: "no number"},
+		{in: "G", wantErr: "no number"},
+		{in: ".G", wantErr: "no number"},
+		{in: "1.5", wantErr: "not a whole number of bytes"},
+		{in: "0.1K", wantErr: "not a whole number of bytes"},
+		{in: "1.0000000000000000001P", wantErr: "not a whole number of bytes"},
+		{in: "1X", wantErr: `unknown unit "X"`},
+		{in: "1Gb/s", wantErr: `unknown unit "Gb/s"`},
+		{in: "1E", wantErr: `unknown unit "E"`},
+		{in: "1e9", wantErr: `unknown unit "e9"`},
+		{in: "0x10", wantErr: `unknown unit "x10"`},
+		{in: "1,024", wantErr: `unknown unit ",024"`},
+		{in: "1.2.3G", wantErr: `unknown unit ".3G"`},
+		{in: "1 G B", wantErr: `unknown unit "G B"`},
+		{in: "8192P", wantErr: "too large"},
+		{in: "9223372036854775808", wantErr: "too large"},
+		{in: "8192.0P", wantErr: "too large"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseSize(tt.in)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				assert.Contains(t, err.Error(), "want "+SizeFormats, "errors list the accepted formats")
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	for in, want := range map[int64]string{0: "0", 1: "1", 1000: "1000", 1024: "1K", 1536: "1536", 3 << 29: "1536M", 64 << 20: "64M", 5 << 40: "5T", 1 << 50: "1P"} {
+		assert.Equal(t, want, FormatSize(in))
+		back, err := ParseSize(want)
+		require.NoError(t, err)
+		assert.Equal(t, in, back)
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	const day = 24 * time.Hour
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr string
+	}{
+		{in: "0", want: 0},
+		{in: "0s", want: 0},
+		{in: "500ms", want: 500 * time.Millisecond},
+		{in: "10us", want: 10 * time.Microsecond},
+		{in: "10µs", want: 10 * time.Microsecond},
+		{in: "7ns", want: 7},
+		{in: "90s", want: 90 * time.Second},
+		{in: "5m", want: 5 * time.Minute},
+		{in: "36h", want: 36 * time.Hour},
+		{in: "7d", want: 7 * day},
+		{in: "2w", want: 14 * day},
+		{in: "1d12h", want: 36 * time.Hour},
+		{in: "1w2d3h4m5s", want: 9*day + 3*time.Hour + 4*time.Minute + 5*time.Second},
+		{in: "1.5h", want: 90 * time.Minute},
+		{in: "1.5d", want: 36 * time.Hour},
+		{in: ".5m", want: 30 * time.Second},
+		{in: " 30s ", want: 30 * time.Second},
+		{in: "1.5ns", want: 1},
+		{in: "2562047h", want: 2562047 * time.Hour},
+
+		{in: "", wantErr: "empty"},
+		{in: "-5m", wantErr: "negative"},
+		{in: "300", wantErr: "missing unit after 300"},
+		{in: "1h30", wantErr: "missing unit after 30"},
+		{in: "1.5", wantErr: "missing unit"},
+		{in: "1M", wantErr: "M is ambiguous"},
+		{in: "1mo", wantErr: "months and years have no fixed length"},
+		{in: "1y", wantErr: "months and years have no fixed length"},
+		{in: "1Y", wantErr: "months and years have no fixed length"},
+		{in: "1H", wantErr: `unknown unit "H"`},
+		{in: "1D", wantErr: `unknown unit "D"`},
+		{in: "1min", wantErr: `unknown unit "min"`},
+		{in: "1 h", wantErr: `unknown unit " h"`},
+		{in: "1e3s", wantErr: `unknown unit "e"`},
+		{in: "h", wantErr: `no number before "h"`},
+		{in: "1h-5m", wantErr: `unknown unit "h-"`},
+		{in: "2562048h", wantErr: "too large"},
+		{in: "15251w", wantErr: "too large"},
+		{in: "15000w2000w", wantErr: "too large"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseDuration(tt.in)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				assert.Contains(t, err.Error(), "want "+DurationFormats, "errors list the accepted formats")
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseDurationMatchesTime(t *testing.T) {
+	for _, in := range []string{"1h2m3s", "1.25s", "100ms", "3h0m0.5s"} {
+		want, err := time.ParseDuration(in)
+		require.NoError(t, err)
+		got, err := ParseDuration(in)
+		require.NoError(t, err)
+		assert.Equal(t, want, got, in)
+	}
+}
+
+func TestUnmarshalYAML(t *testing.T) {
+	type fields struct {
+		Bytes    Bytes    `yaml:"bytes"`
+		MiB      MiB      `yaml:"mib"`
+		GiB      GiB      `yaml:"gib"`
+		Duration Duration `yaml:"duration"`
+	}
+	tests := []struct {
+		name    string
+		in      string
+		want    fields
+		wantErr string
+	}{
+		{name: "plain numbers in the unit of the field", in: "bytes: 1000\nmib: 64\ngib: 3\nduration: 0", want: fields{Bytes: 1000, MiB: 64, GiB: 3}},
+		{name: "quoted plain numbers", in: "bytes: '1000'\nmib: \"64\"", want: fields{Bytes: 1000, MiB: 64}},
+		{name: "negative numbers are left to validation", in: "mib: -1", want: fields{MiB: -1}},
+		{
+			name: "units",
+			in:   "bytes: 1.5K\nmib: 1G\ngib: 2048M\nduration: 7d",
+			want: fields{Bytes: 1536, MiB: 1024, GiB: 2, Duration: Duration(7 * 24 * time.Hour)},
+		},
+		{name: "not a whole number of the unit", in: "gib: 1.5G", wantErr: `line 1: invalid size "1.5G": not a whole number of GiB`},
+		{name: "fraction without unit", in: "mib: 1.5", wantErr: `invalid size "1.5": not a whole number of bytes`},
+		{name: "bad size", in: "\nbytes: lots", wantErr: `line 2: invalid size "lots"`},
+		{name: "duration needs a unit", in: "duration: 30", wantErr: `line 1: invalid duration "30": missing unit after 30`},
+		{name: "list", in: "mib: [1, 2]", wantErr: "line 1: want a single value, got a list"},
+		{name: "mapping", in: "duration:\n  h: 1", wantErr: "line 2: want a single value, got a mapping"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got fields
+			err := yaml.Unmarshal([]byte(tt.in), &got)
+			if tt.wantErr != "" {
+				var yamlErr *YAMLError
+				require.ErrorAs(t, err, &yamlErr)
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestDurationMarshalYAML(t *testing.T) {
+	data, err := yaml.Marshal(struct {
+		Timeout Duration `yaml:"timeout"`
+	}{Duration(90 * time.Minute)})
+	require.NoError(t, err)
+	assert.Equal(t, "timeout: 1h30m0s\n", string(data))
+
+	var back struct {
+		Timeout Duration `yaml:"timeout"`
+	}
+	require.NoError(t, yaml.Unmarshal(data, &back))
+	assert.Equal(t, Duration(90*time.Minute), back.Timeout)
+}
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Limit
+		wantErr string
+	}{
+		{in: "500G", want: Limit{Bytes: 500 << 30}},
+		{in: "4096", want: Limit{Bytes: 4096}},
+		{in: "3x", want: Limit{Factor: 3}},
+		{in: "1.5X", want: Limit{Factor: 1.5}},
+		{in: " 2x ", want: Limit{Factor: 2}},
+
+		{in: "x", wantErr: "no number before x"},
+		{in: "-2x", wantErr: "no number before x"},
+		{in: "1e3x", wantErr: "no number before x"},
+		{in: "infx", wantErr: "no number before x"},
+		{in: "3 x", wantErr: "no number before x"},
+		{in: "0x", wantErr: "the multiple must be above 0"},
+		{in: "0x10", wantErr: `unknown unit "x10"`},
+		{in: "3y", wantErr: `unknown unit "y"`},
+		{in: "", wantErr: "empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseLimit(tt.in)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				assert.Contains(t, err.Error(), "want "+LimitFormats)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestLimitOf(t *testing.T) {
+	assert.Equal(t, int64(0), Limit{}.Of(1000))
+	assert.Equal(t, int64(500), Limit{Bytes: 500}.Of(1000), "an absolute limit ignores the estimate")
+	assert.Equal(t, int64(3000), Limit{Factor: 3}.Of(1000))
+	assert.Equal(t, int64(1500), Limit{Factor: 1.5}.Of(1000))
+	assert.Equal(t, int64(0), Limit{Factor: 3}.Of(0), "a multiple of no estimate is no limit")
+	assert.Equal(t, "3x", Limit{Factor: 3}.String())
+	assert.Equal(t, "4K", Limit{Bytes: 4096}.String())
+	assert.Equal(t, "1000", Limit{Bytes: 1000}.String())
+
+	var v struct {
+		A Limit `yaml:"a"`
+		B Limit `yaml:"b"`
+		C Limit `yaml:"c"`
+	}
+	require.NoError(t, yaml.Unmarshal([]byte("a: 1000\nb: 2x\nc: 1G"), &v))
+	assert.Equal(t, Limit{Bytes: 1000}, v.A)
+	assert.Equal(t, Limit{Factor: 2}, v.B)
+	assert.Equal(t, Limit{Bytes: 1 << 30}, v.C)
+
+	err := yaml.Unmarshal([]byte("a: twice"), &v)
+	var yamlErr *YAMLError
+	require.ErrorAs(t, err, &yamlErr)
+	assert.Equal(t, 1, yamlErr.Line)
+}
@@ -0,0 +1,110 @@
+package units
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Bytes, MiB and GiB are sizes of config fields whose names carry their unit, e.g.
+// upload_part_size_mb. A plain number, as configs were written before units were accepted, is in
+// that unit; a size with a suffix is converted and must come out whole.
+type (
+	Bytes int64
+	MiB   int
+	GiB   int
+)
+
+// Duration is a config field holding a duration such as 30s or 7d.
+type Duration time.Duration
+
+// YAMLError is a size or duration that did not parse at Line and Column of a YAML document.
+// config.Load adds the name of the field.
+type YAMLError struct {
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *YAMLError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *YAMLError) Unwrap() error {
+	return e.Err
+}
+
+func (b *Bytes) UnmarshalYAML(node *yaml.Node) error {
+	n, err := unmarshalSize(node, 1, "bytes")
+	*b = Bytes(n)
+	return err
+}
+
+func (m *MiB) UnmarshalYAML(node *yaml.Node) error {
+	n, err := unmarshalSize(node, 1<<20, "MiB")
+	*m = MiB(n)
+	return err
+}
+
+func (g *GiB) UnmarshalYAML(node *yaml.Node) error {
+	n, err := unmarshalSize(node, 1<<30, "GiB")
+	*g = GiB(n)
+	return err
+}
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	if err := scalar(node); err != nil {
+		return err
+	}
+	v, err := ParseDuration(node.Value)
+	if err != nil {
+		return &YAMLError{Line: node.Line, Column: node.Column, Err: err}
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalYAML() (any, error) {
+	return d.String(), nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// unmarshalSize returns the size in node in units of unit bytes, named name in errors.
+func unmarshalSize(node *yaml.Node, unit int64, name string) (int64, error) {
+	if err := scalar(node); err != nil {
+		return 0, err
+	}
+	if n, err := strconv.ParseInt(node.Value, 10, 64); err == nil {
+		return n, nil
+	}
+	bytes, err := ParseSize(node.Value)
+	if err == nil && bytes%unit != 0 {
+		err = sizeError(node.Value, "not a whole number of "+name)
+	}
+	if err != nil {
+		return 0, &YAMLError{Line: node.Line, Column: node.Column, Err: err}
+	}
+	return bytes / unit, nil
+}
+
+func scalar(node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode {
+		return &YAMLError{Line: node.Line, Column: node.Column, Err: fmt.Errorf("want a single value, got a %s", kindName(node.Kind))}
+	}
+	return nil
+}
+
+func kindName(k yaml.Kind) string {
+	switch k {
+	case yaml.MappingNode:
+		return "mapping"
+	case yaml.SequenceNode:
+		return "list"
+	}
+	return "value"
+}
@@ -0,0 +1,107 @@
+package util
+
+import (
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Modes of what zrb creates below base_dir and staging_dir. Directories and the run state,
+// manifests and logs are open to the group at most; the parts, raw or encrypted, and the other
+// files holding stream data only to the owner. The umask of the process narrows them further,
+// except for directories holding decrypted data, which MkdirPrivate sets to PrivateDirMode.
+const (
+	DefaultDirMode  os.FileMode = 0o750
+	DefaultFileMode os.FileMode = 0o640
+	PartMode        os.FileMode = 0o600
+	PrivateDirMode  os.FileMode = 0o700
+)
+
+// dirMode and fileMode are the modes of new directories and metadata files, see SetModes.
+var (
+	dirMode  = DefaultDirMode
+	fileMode = DefaultFileMode
+)
+
+// SetModes sets the modes of the metadata files and directories created from now on, the
+// file_mode and dir_mode of the config; zero restores the default. Parts keep PartMode.
+func SetModes(file, dir os.FileMode) {
+	fileMode, dirMode = DefaultFileMode, DefaultDirMode
+	if file != 0 {
+		fileMode = file
+	}
+	if dir != 0 {
+		dirMode = dir
+	}
+}
+
+// FileMode returns the mode of new metadata files, before the umask.
+func FileMode() os.FileMode {
+	return fileMode
+}
+
+// DirMode returns the mode of new directories, before the umask.
+func DirMode() os.FileMode {
+	return dirMode
+}
+
+// MkdirAll creates path and its missing parents with DirMode.
+func MkdirAll(path string) error {
+	return os.MkdirAll(path, dirMode)
+}
+
+// MkdirPrivate creates path with PrivateDirMode, and narrows it to that when it already exists,
+// for directories holding decrypted data.
+func MkdirPrivate(path string) error {
+	if err := os.MkdirAll(path, PrivateDirMode); err != nil {
+		return err
+	}
+	return os.Chmod(path, PrivateDirMode)
+}
+
+// WriteFile writes a metadata file, created with FileMode.
+func WriteFile(path string, data []byte) error {
+	return os.WriteFile(path, data, fileMode)
+}
+
+// AppendFile opens a metadata file for appending, created with FileMode.
+func AppendFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, fileMode)
+}
+
+// CreateTemp creates a new file in dir, named by pattern as os.CreateTemp does, with FileMode
+// rather than the 0600 of os.CreateTemp, such as a temporary file about to replace a metadata file.
+func CreateTemp(dir, pattern string) (*os.File, error) {
+	prefix, suffix := pattern, ""
+	if i := strings.LastIndex(pattern, "*"); i >= 0 {
+		prefix, suffix = pattern[:i], pattern[i+1:]
+	}
+	for {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10)+suffix)
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, fileMode)
+		if !os.IsExist(err) {
+			return f, err
+		}
+	}
+}
+
+// OpenPart opens a file holding stream data, raw or encrypted, created with PartMode.
+func OpenPart(path string, flag int) (*os.File, error) {
+	return os.OpenFile(path, flag, PartMode)
+}
+
+// CreatePart creates or truncates a file holding stream data with PartMode.
+func CreatePart(path string) (*os.File, error) {
+	return OpenPart(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+}
+
+// WritePart writes a file holding stream data, created with PartMode.
+func WritePart(path string, data []byte) error {
+	return os.WriteFile(path, data, PartMode)
+}
+
+// PartUmask is the umask under which a child process, such as split, creates files with no more
+// than PartMode.
+const PartUmask = 0o777 &^ PartMode
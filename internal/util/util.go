@@ -5,19 +5,22 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"syscall"
 	"time"
 	"zrb/internal/logging"
 )
 
+// TaskDirName is levelN/YYYYMMDD, dated in UTC so the directory does not depend on the host's time zone.
 func TaskDirName(level int16, timestamp time.Time) string {
 	return filepath.Join(
 		fmt.Sprintf("level%d", level),
-		timestamp.Format("20060102"),
+		timestamp.UTC().Format("20060102"),
 	)
 }
 
-func OutputDir(baseDir, pool, dataset string, level int16, timestamp time.Time) string {
-	return filepath.Join(baseDir, "task", pool, dataset, TaskDirName(level, timestamp))
+// OutputDir is the task directory of a backup below stagingRoot, see config.Config.StagingRoot.
+func OutputDir(stagingRoot, pool, dataset string, level int16, timestamp time.Time) string {
+	return filepath.Join(stagingRoot, "task", pool, dataset, TaskDirName(level, timestamp))
 }
 
 func RunDir(baseDir, pool, dataset string) string {
@@ -28,9 +31,26 @@ func LogDir(baseDir, pool, dataset string) string {
 	return filepath.Join(baseDir, "logs", pool, dataset)
 }
 
+// DiskFree returns the bytes available to unprivileged users on the filesystem holding path, or
+// its nearest existing ancestor.
+func DiskFree(path string) (uint64, error) {
+	for {
+		var st syscall.Statfs_t
+		err := syscall.Statfs(path, &st)
+		if err == nil {
+			return uint64(st.Bavail) * uint64(st.Bsize), nil
+		}
+		parent := filepath.Dir(path)
+		if !os.IsNotExist(err) || parent == path {
+			return 0, fmt.Errorf("failed to check free space of %s: %w", path, err)
+		}
+		path = parent
+	}
+}
+
 func SetupDirectories(dirs ...string) error {
 	for _, dir := range dirs {
-		if err := os.MkdirAll(dir, 0o755); err != nil {
+		if err := MkdirAll(dir); err != nil {
 			return fmt.Errorf("failed to create directory %s: %w", dir, err)
 		}
 	}
@@ -39,14 +59,14 @@ func SetupDirectories(dirs ...string) error {
 
 func SetupLogging(logPath string) (*slog.Logger, *os.File, error) {
 	logDir := filepath.Dir(logPath)
-	if err := os.MkdirAll(logDir, 0o755); err != nil {
+	if err := MkdirAll(logDir); err != nil {
 		return nil, nil, fmt.Errorf("failed to create log directory: %w", err)
 	}
 
-	logger, logFile, err := logging.NewLogger(logPath)
+	logFile, err := AppendFile(logPath)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, fmt.Errorf("failed to open log file: %w", err)
 	}
 
-	return logger, logFile, nil
+	return logging.NewLogger(logFile), logFile, nil
 }
@@ -1,10 +1,14 @@
 package util
 
 import (
+	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestTaskDirName(t *testing.T) {
@@ -32,6 +36,12 @@ func TestTaskDirName(t *testing.T) {
 			timestamp: time.Date(2024, 12, 31, 23, 59, 59, 0, time.UTC),
 			want:      "level4/20241231",
 		},
+		{
+			name:      "dated in UTC",
+			level:     0,
+			timestamp: time.Date(2024, 1, 16, 7, 0, 0, 0, time.FixedZone("UTC+8", 8*60*60)),
+			want:      "level0/20240115",
+		},
 	}
 
 	for _, tt := range tests {
@@ -98,3 +108,68 @@ func TestLogDir(t *testing.T) {
 		})
 	}
 }
+
+// setUmask sets the umask of the process for the rest of the test.
+func setUmask(t *testing.T, mask int) {
+	t.Helper()
+	old := syscall.Umask(mask)
+	t.Cleanup(func() { syscall.Umask(old) })
+}
+
+func TestModes(t *testing.T) {
+	setUmask(t, 0)
+	defer SetModes(0, 0)
+	dir := t.TempDir()
+
+	require.NoError(t, MkdirAll(filepath.Join(dir, "a", "b")))
+	require.NoError(t, WriteFile(filepath.Join(dir, "a", "meta.yaml"), nil))
+	require.NoError(t, WritePart(filepath.Join(dir, "a", "part"), nil))
+	assertMode(t, DefaultDirMode, filepath.Join(dir, "a", "b"))
+	assertMode(t, DefaultFileMode, filepath.Join(dir, "a", "meta.yaml"))
+	assertMode(t, PartMode, filepath.Join(dir, "a", "part"))
+
+	SetModes(0o660, 0o770)
+	require.NoError(t, MkdirAll(filepath.Join(dir, "shared")))
+	f, err := AppendFile(filepath.Join(dir, "shared", "log"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	assertMode(t, 0o770, filepath.Join(dir, "shared"))
+	assertMode(t, 0o660, filepath.Join(dir, "shared", "log"))
+	f, err = CreatePart(filepath.Join(dir, "shared", "part"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	assertMode(t, PartMode, filepath.Join(dir, "shared", "part"))
+
+	f, err = CreateTemp(filepath.Join(dir, "shared"), "manifest.yaml.tmp-*")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	assert.Regexp(t, `/manifest\.yaml\.tmp-\d+$`, f.Name())
+	assertMode(t, 0o660, f.Name())
+
+	SetModes(0, 0)
+	assert.Equal(t, DefaultFileMode, FileMode())
+	assert.Equal(t, DefaultDirMode, DirMode())
+
+	// The umask narrows the modes
+	setUmask(t, 0o027)
+	require.NoError(t, WriteFile(filepath.Join(dir, "narrowed"), nil))
+	assertMode(t, 0o640, filepath.Join(dir, "narrowed"))
+	SetModes(0o666, 0)
+	require.NoError(t, WriteFile(filepath.Join(dir, "narrowed-shared"), nil))
+	assertMode(t, 0o640, filepath.Join(dir, "narrowed-shared"))
+}
+
+func TestMkdirPrivate(t *testing.T) {
+	setUmask(t, 0)
+	dir := filepath.Join(t.TempDir(), "restore")
+	require.NoError(t, os.Mkdir(dir, 0o755))
+	require.NoError(t, MkdirPrivate(dir))
+	assertMode(t, PrivateDirMode, dir)
+}
+
+func assertMode(t *testing.T, mode os.FileMode, path string) {
+	t.Helper()
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, mode, info.Mode().Perm(), path)
+}
@@ -0,0 +1,219 @@
+package verify
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+	"zrb/internal/crypto"
+	"zrb/internal/manifest"
+	"zrb/internal/remote"
+)
+
+// Kind is what is wrong with an object of a backup.
+type Kind string
+
+const (
+	// Missing objects are gone from the bucket.
+	Missing Kind = "missing"
+	// Overwritten objects are not what the backup uploaded: their blake3 metadata or size differs
+	// from the manifest, or their size or ETag changed since the anchor recorded them.
+	Overwritten Kind = "overwritten"
+	// OutsideWindow objects were last written before the backup started or after it completed.
+	OutsideWindow Kind = "outside_window"
+	// ManifestReplaced means the manifest no longer matches the anchor written with it.
+	ManifestReplaced Kind = "manifest_replaced"
+	// Corrupt parts are not valid age files, or were read in full and do not hash to what the
+	// manifest records.
+	Corrupt Kind = "corrupt"
+)
+
+// Finding is one problem with a backup level. Part is empty when it concerns the manifest.
+type Finding struct {
+	Level  int16  `json:"level"`
+	Part   string `json:"part,omitempty"`
+	Kind   Kind   `json:"kind"`
+	Detail string `json:"detail"`
+}
+
+func (f Finding) String() string {
+	if f.Part == "" {
+		return fmt.Sprintf("level %d manifest: %s: %s", f.Level, f.Kind, f.Detail)
+	}
+	return fmt.Sprintf("level %d part %s: %s: %s", f.Level, f.Part, f.Kind, f.Detail)
+}
+
+// Window is when the parts of a backup were written; a zero bound is open.
+type Window struct {
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// clockSlack allows for the clocks of the backup host and the bucket disagreeing.
+const clockSlack = time.Hour
+
+// BackupWindow is when the parts of m were uploaded: not before the UTC day its task directory is
+// dated, and not after the manifest was created, which happens once every part is uploaded. Task
+// directories dated in local time only bound the window from above.
+func BackupWindow(m *manifest.Backup) Window {
+	w := Window{NotAfter: time.Unix(m.Datetime, 0).Add(clockSlack)}
+	if m.DateTimezone == "UTC" {
+		if day, err := time.Parse("20060102", path.Base(m.TargetS3Path)); err == nil {
+			w.NotBefore = day.Add(-clockSlack)
+		}
+	}
+	return w
+}
+
+// CheckPart compares the object of part, nil when it is missing, with the manifest and window. The
+// times the manifest recorded for the part, if any, narrow the window to that part.
+func CheckPart(level int16, part manifest.PartInfo, info *remote.ObjectInfo, window Window) []Finding {
+	if info == nil {
+		return []Finding{{Level: level, Part: part.Index, Kind: Missing, Detail: "the object is not in the bucket"}}
+	}
+
+	var findings []Finding
+	// Parts imported from simple_backup carry no blake3 metadata to compare.
+	if algorithm, hash := part.Hash(); algorithm == "blake3" {
+		switch info.Blake3 {
+		case hash:
+		case "":
+			findings = append(findings, Finding{Level: level, Part: part.Index, Kind: Overwritten,
+				Detail: fmt.Sprintf("the object carries no blake3 metadata, the manifest records %s", hash)})
+		default:
+			findings = append(findings, Finding{Level: level, Part: part.Index, Kind: Overwritten,
+				Detail: fmt.Sprintf("the object's blake3 metadata is %s, the manifest records %s", info.Blake3, hash)})
+		}
+	}
+
+	if finding := checkSize(level, part, info.Size); finding != nil {
+		findings = append(findings, *finding)
+	}
+
+	if !info.LastModified.IsZero() {
+		before, after := "before the backup started", "after the backup completed"
+		if part.EncryptedAt > 0 {
+			window.NotBefore = time.Unix(part.EncryptedAt, 0).Add(-clockSlack)
+			before = "before the part was encrypted at " + time.Unix(part.EncryptedAt, 0).UTC().Format(time.RFC3339)
+		}
+		if part.UploadedAt > 0 {
+			window.NotAfter = time.Unix(part.UploadedAt, 0).Add(clockSlack)
+			after = "after the part was uploaded at " + time.Unix(part.UploadedAt, 0).UTC().Format(time.RFC3339)
+		}
+		switch {
+		case !window.NotBefore.IsZero() && info.LastModified.Before(window.NotBefore):
+			findings = append(findings, Finding{Level: level, Part: part.Index, Kind: OutsideWindow,
+				Detail: fmt.Sprintf("last modified %s, %s", info.LastModified.UTC().Format(time.RFC3339), before)})
+		case !window.NotAfter.IsZero() && info.LastModified.After(window.NotAfter):
+			findings = append(findings, Finding{Level: level, Part: part.Index, Kind: OutsideWindow,
+				Detail: fmt.Sprintf("last modified %s, %s", info.LastModified.UTC().Format(time.RFC3339), after)})
+		}
+	}
+	return findings
+}
+
+// checkSize returns an Overwritten finding when the part's object has another size than the
+// manifest records. Manifests written before part sizes were recorded have none to compare.
+func checkSize(level int16, part manifest.PartInfo, size int64) *Finding {
+	if part.SizeBytes == 0 || size == part.SizeBytes {
+		return nil
+	}
+	return &Finding{Level: level, Part: part.Index, Kind: Overwritten,
+		Detail: fmt.Sprintf("the object has %d bytes, the manifest records %d", size, part.SizeBytes)}
+}
+
+// HashPart hashes the encrypted part at path, and returns a Corrupt finding when it does not match
+// the manifest.
+func HashPart(level int16, part manifest.PartInfo, path string) (*Finding, error) {
+	algorithm, want := part.Hash()
+	got, err := crypto.HashFile(algorithm, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash part %s: %w", part.Index, err)
+	}
+	if got == want {
+		return nil, nil
+	}
+	return &Finding{Level: level, Part: part.Index, Kind: Corrupt,
+		Detail: fmt.Sprintf("the data has %s %s, the manifest records %s", strings.ToUpper(algorithm), got, want)}, nil
+}
+
+// QuickCheckPart checks the age header and chunk framing of the encrypted part at path without
+// decrypting it, and returns a Corrupt finding when they are invalid.
+func QuickCheckPart(level int16, part manifest.PartInfo, path string) (*Finding, error) {
+	err := crypto.QuickCheck(path)
+	var pathErr *fs.PathError
+	switch {
+	case err == nil:
+		return nil, nil
+	case errors.As(err, &pathErr):
+		return nil, fmt.Errorf("failed to check part %s: %w", part.Index, err)
+	}
+	return &Finding{Level: level, Part: part.Index, Kind: Corrupt, Detail: err.Error()}, nil
+}
+
+// UploadSpan returns when the first and the last part of m were uploaded, zero when the manifest
+// recorded no upload times.
+func UploadSpan(m *manifest.Backup) (first, last time.Time) {
+	for _, p := range m.Parts {
+		if p.UploadedAt == 0 {
+			continue
+		}
+		at := time.Unix(p.UploadedAt, 0)
+		if first.IsZero() || at.Before(first) {
+			first = at
+		}
+		if at.After(last) {
+			last = at
+		}
+	}
+	return first, last
+}
+
+// CheckAnchor compares the anchor of a backup with its manifest m, whose file hashes to
+// manifestBlake3, and with the part objects by index. Missing parts are left to CheckPart.
+func CheckAnchor(level int16, a *manifest.Anchor, m *manifest.Backup, manifestBlake3 string, objects map[string]*remote.ObjectInfo) []Finding {
+	var findings []Finding
+	replaced := func(part, format string, args ...any) {
+		findings = append(findings, Finding{Level: level, Part: part, Kind: ManifestReplaced, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	if manifestBlake3 != a.ManifestBlake3 {
+		replaced("", "task_manifest.yaml has BLAKE3 %s, the anchor recorded %s", manifestBlake3, a.ManifestBlake3)
+	}
+	if m.TargetSnapshot != a.TargetSnapshot || m.Blake3Hash != a.Blake3Hash {
+		replaced("", "the manifest describes %s with stream hash %s, the anchor %s with %s", m.TargetSnapshot, m.Blake3Hash, a.TargetSnapshot, a.Blake3Hash)
+	}
+
+	parts := make(map[string]manifest.PartInfo, len(m.Parts))
+	for _, p := range m.Parts {
+		parts[p.Index] = p
+	}
+	anchored := make(map[string]bool, len(a.Parts))
+	for _, ap := range a.Parts {
+		anchored[ap.Index] = true
+		if p, ok := parts[ap.Index]; !ok {
+			replaced(ap.Index, "the anchor lists the part, the manifest does not")
+		} else if p.Blake3Hash != ap.Blake3Hash {
+			replaced(ap.Index, "the manifest records %s, the anchor %s", p.Blake3Hash, ap.Blake3Hash)
+		}
+
+		info := objects[ap.Index]
+		switch {
+		case info == nil:
+		case info.Size != ap.Size:
+			findings = append(findings, Finding{Level: level, Part: ap.Index, Kind: Overwritten,
+				Detail: fmt.Sprintf("the object has %d bytes, %d when the backup uploaded it", info.Size, ap.Size)})
+		case ap.ETag != "" && info.ETag != ap.ETag:
+			findings = append(findings, Finding{Level: level, Part: ap.Index, Kind: Overwritten,
+				Detail: fmt.Sprintf("the object's ETag is %s, %s when the backup uploaded it", info.ETag, ap.ETag)})
+		}
+	}
+	for _, p := range m.Parts {
+		if !anchored[p.Index] {
+			replaced(p.Index, "the manifest lists the part, the anchor does not")
+		}
+	}
+	return findings
+}
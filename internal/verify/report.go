@@ -0,0 +1,114 @@
+package verify
+
+import (
+	"fmt"
+	"io"
+	"zrb/internal/remote"
+)
+
+// Level and part statuses of a Report; a part with a problem has the Kind of its first finding.
+const (
+	StatusOK       = "ok"
+	StatusProblems = "problems"
+	StatusSkipped  = "skipped"
+)
+
+// Report is what zrb verify --json prints.
+type Report struct {
+	Task    string        `json:"task"`
+	Pool    string        `json:"pool"`
+	Dataset string        `json:"dataset"`
+	Source  string        `json:"source"`
+	Deep    bool          `json:"deep"`
+	Levels  []LevelReport `json:"levels"`
+	Summary struct {
+		// Levels counts the levels checked, not those skipped.
+		Levels int `json:"levels"`
+		Parts  int `json:"parts"`
+		// Missing counts the findings of missing objects, Mismatched those of overwritten and
+		// corrupt ones.
+		Missing    int  `json:"missing"`
+		Mismatched int  `json:"mismatched"`
+		Problems   int  `json:"problems"`
+		Passed     bool `json:"passed"`
+	} `json:"summary"`
+}
+
+// LevelReport is the result of one backup level.
+type LevelReport struct {
+	Level    int16  `json:"level"`
+	Snapshot string `json:"snapshot"`
+	S3Path   string `json:"s3_path,omitempty"`
+	Status   string `json:"status"`
+	// Details tells what was checked, or why the level was skipped.
+	Details  string       `json:"details"`
+	Parts    []PartReport `json:"parts"`
+	Findings []Finding    `json:"findings,omitempty"`
+}
+
+// PartReport is the result of one part; Size is zero when it is missing.
+type PartReport struct {
+	Index  string `json:"index"`
+	Status string `json:"status"`
+	Size   int64  `json:"size,omitempty"`
+}
+
+func (lr *LevelReport) skip(reason string) *LevelReport {
+	lr.Status, lr.Details = StatusSkipped, reason
+	return lr
+}
+
+// addPart records the part at index, whose object or file is info, nil when missing.
+func (lr *LevelReport) addPart(index string, info *remote.ObjectInfo, findings []Finding) {
+	p := PartReport{Index: index, Status: StatusOK}
+	if info != nil {
+		p.Size = info.Size
+	}
+	if len(findings) > 0 {
+		p.Status = string(findings[0].Kind)
+	}
+	lr.Parts = append(lr.Parts, p)
+	lr.Findings = append(lr.Findings, findings...)
+}
+
+func (lr *LevelReport) finish(details string) *LevelReport {
+	lr.Status, lr.Details = StatusOK, details
+	if len(lr.Findings) > 0 {
+		lr.Status = StatusProblems
+	}
+	return lr
+}
+
+// print writes the level as zrb verify prints it without --json.
+func (lr *LevelReport) print(w io.Writer) {
+	switch lr.Status {
+	case StatusSkipped:
+		fmt.Fprintf(w, "level %d %s: skipped (%s)\n", lr.Level, lr.Snapshot, lr.Details)
+	case StatusOK:
+		fmt.Fprintf(w, "level %d %s: OK (%s)\n", lr.Level, lr.Snapshot, lr.Details)
+	default:
+		fmt.Fprintf(w, "level %d %s: %d problem(s) (%s)\n", lr.Level, lr.Snapshot, len(lr.Findings), lr.Details)
+		for _, f := range lr.Findings {
+			fmt.Fprintf(w, "  %s\n", f)
+		}
+	}
+}
+
+// add counts lr into the summary.
+func (r *Report) add(lr *LevelReport) {
+	r.Levels = append(r.Levels, *lr)
+	if lr.Status != StatusSkipped {
+		r.Summary.Levels++
+	}
+	r.Summary.Parts += len(lr.Parts)
+	for _, f := range lr.Findings {
+		switch f.Kind {
+		case Missing:
+			r.Summary.Missing++
+		case Overwritten, Corrupt:
+			r.Summary.Mismatched++
+		}
+	}
+	r.Summary.Problems += len(lr.Findings)
+	r.Summary.Passed = r.Summary.Problems == 0
+}
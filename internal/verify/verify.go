@@ -0,0 +1,366 @@
+// Package verify implements zrb verify: checking the objects of the backups in the bucket, or the
+// parts in the local task directories, against their manifests and anchors, without reading the
+// data unless asked to hash it.
+package verify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+	"zrb/internal/config"
+	"zrb/internal/crypto"
+	"zrb/internal/manifest"
+	"zrb/internal/remote"
+	"zrb/internal/restore"
+	"zrb/internal/util"
+
+	"filippo.io/age"
+)
+
+type Options struct {
+	ConfigPath string
+	TaskName   string
+	// Level restricts verify to one backup level; -1 verifies every level.
+	Level int16
+	// Source is where the parts are checked: s3, the bucket, which is GCS when gcs is enabled, or
+	// local, the task directories of base_dir or staging_dir. Empty means s3.
+	Source string
+	// Deep downloads, or reads, every part and hashes it instead of trusting its metadata.
+	Deep bool
+	// JSON prints the report as JSON rather than as text.
+	JSON bool
+	// PrivateKeyPath decrypts the anchors; without it anchors are only looked up.
+	PrivateKeyPath string
+	// WorkDir is the parent of the scratch directory for downloads, overriding restore.work_dir.
+	WorkDir string
+	// Out receives the report, os.Stdout when nil.
+	Out io.Writer
+}
+
+func Run(ctx context.Context, opts Options) error {
+	out := opts.Out
+	if out == nil {
+		out = os.Stdout
+	}
+	source := opts.Source
+	switch source {
+	case "":
+		source = "s3"
+	case "s3", "local":
+	default:
+		return fmt.Errorf("--source must be s3 or local, got %q", source)
+	}
+
+	cfg, err := config.Load(opts.ConfigPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	task, err := cfg.FindTask(opts.TaskName)
+	if err != nil {
+		return err
+	}
+
+	var identities []age.Identity
+	if opts.PrivateKeyPath != "" {
+		if identities, err = crypto.LoadIdentities(opts.PrivateKeyPath); err != nil {
+			return err
+		}
+	}
+
+	var backend remote.Backend
+	var workDir string
+	lastPath := filepath.Join(cfg.BaseDir, "run", task.Pool, task.Dataset, "last_backup_manifest.yaml")
+	if source == "s3" {
+		if !cfg.RemoteEnabled() {
+			return config.ErrNoRemote
+		}
+		backend, err = remote.DefaultCache.Get(ctx, remote.OptionsFromConfig(cfg, cfg.ManifestStorageClass()))
+		if err != nil {
+			return fmt.Errorf("failed to initialize remote backend: %w", err)
+		}
+		if err := backend.VerifyCredentials(ctx); err != nil {
+			return fmt.Errorf("credentials verification failed: %w", err)
+		}
+		remoteLastPath := remote.ManifestPath(task.S3Prefix, task.Pool, task.Dataset, "last_backup_manifest.yaml")
+		if err := remote.CheckAccessible(ctx, backend, remoteLastPath); err != nil {
+			return fmt.Errorf("cannot verify from S3: %w", err)
+		}
+
+		if workDir, err = chooseWorkDir(cfg, task, opts); err != nil {
+			return err
+		}
+		// The directory holds decrypted anchors, so only the owner may enter it.
+		if err := util.MkdirPrivate(workDir); err != nil {
+			return fmt.Errorf("failed to create temp directory: %w", err)
+		}
+		defer os.RemoveAll(workDir)
+
+		lastPath = filepath.Join(workDir, "last_backup_manifest.yaml")
+		if err := backend.Download(ctx, remoteLastPath, lastPath); err != nil {
+			return fmt.Errorf("failed to download last backup manifest: %w", err)
+		}
+	}
+	last, err := manifest.ReadLast(lastPath)
+	if err != nil {
+		return fmt.Errorf("failed to read last backup manifest: %w", err)
+	}
+
+	report := &Report{Task: task.Name, Pool: task.Pool, Dataset: task.Dataset, Source: source, Deep: opts.Deep, Levels: []LevelReport{}}
+	report.Summary.Passed = true
+	for i, ref := range last.BackupLevels {
+		level := int16(i)
+		if ref == nil || (opts.Level >= 0 && level != opts.Level) {
+			continue
+		}
+		v := levelVerifier{backend: backend, task: task, level: level, ref: ref, identities: identities, deep: opts.Deep, workDir: workDir}
+		lr, err := v.run(ctx)
+		if err != nil {
+			return fmt.Errorf("level %d: %w", level, err)
+		}
+		report.add(lr)
+		if !opts.JSON {
+			lr.print(out)
+		}
+	}
+	if opts.Level >= 0 && len(report.Levels) == 0 {
+		return fmt.Errorf("backup level %d not found", opts.Level)
+	}
+
+	if opts.JSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return fmt.Errorf("failed to encode JSON: %w", err)
+		}
+	}
+	if !report.Summary.Passed {
+		return fmt.Errorf("%d problem(s) found in %d level(s)", report.Summary.Problems, report.Summary.Levels)
+	}
+	if !opts.JSON {
+		fmt.Fprintf(out, "all %d level(s) verified\n", report.Summary.Levels)
+	}
+	return nil
+}
+
+// chooseWorkDir picks the scratch directory for the downloads like restore does, from --work-dir,
+// restore.work_dir, the system temp directory or base_dir/tmp. --deep downloads one part at a time.
+func chooseWorkDir(cfg *config.Config, task *config.Task, opts Options) (string, error) {
+	parent := opts.WorkDir
+	if parent == "" {
+		parent = cfg.Restore.WorkDir
+	}
+	var required uint64
+	if opts.Deep {
+		required = uint64(float64(cfg.PartSizeBytes(task)) * workDirSafetyFactor)
+	}
+	return restore.ChooseWorkDir(parent, []string{os.TempDir(), filepath.Join(cfg.BaseDir, "tmp")}, "verify_"+task.Name, required)
+}
+
+// workDirSafetyFactor pads the size of a part for age framing and filesystem overhead.
+const workDirSafetyFactor = 1.1
+
+// levelVerifier checks the objects of one backup level, in the bucket or, without a backend, in
+// the local task directory.
+type levelVerifier struct {
+	backend    remote.Backend
+	task       *config.Task
+	level      int16
+	ref        *manifest.Ref
+	identities []age.Identity
+	deep       bool
+	workDir    string
+}
+
+func (v *levelVerifier) run(ctx context.Context) (*LevelReport, error) {
+	lr := &LevelReport{Level: v.level, Snapshot: v.ref.Snapshot, S3Path: v.ref.S3Path, Parts: []PartReport{}}
+	if v.backend == nil {
+		return v.runLocal(lr)
+	}
+	if v.ref.LocalOnly {
+		return lr.skip("local-only"), nil
+	}
+
+	manifestPath := filepath.Join(v.workDir, fmt.Sprintf("level%d_task_manifest.yaml", v.level))
+	if err := v.backend.Download(ctx, remote.ManifestPath(v.task.S3Prefix, v.ref.S3Path, "task_manifest.yaml"), manifestPath); err != nil {
+		return nil, fmt.Errorf("failed to download task manifest: %w", err)
+	}
+	manifestBlake3, err := crypto.BLAKE3File(manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash task manifest: %w", err)
+	}
+	m, err := manifest.Read(manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read task manifest: %w", err)
+	}
+	lr.Snapshot = m.TargetSnapshot
+
+	objects := make(map[string]*remote.ObjectInfo, len(m.Parts))
+	window := BackupWindow(m)
+	for _, part := range m.Parts {
+		remotePath := remote.DataPath(v.task.S3Prefix, v.ref.S3Path, manifest.PartFileName(part.Index))
+		info, err := v.head(ctx, remotePath)
+		if err != nil {
+			return nil, fmt.Errorf("part %s: %w", part.Index, err)
+		}
+		objects[part.Index] = info
+		findings := CheckPart(v.level, part, info, window)
+		if v.deep && info != nil {
+			local := filepath.Join(v.workDir, manifest.PartFileName(part.Index))
+			if err := v.backend.Download(ctx, remotePath, local); err != nil {
+				return nil, fmt.Errorf("failed to download part %s: %w", part.Index, err)
+			}
+			finding, err := v.checkFile(part, local)
+			os.Remove(local)
+			if err != nil {
+				return nil, err
+			}
+			if finding != nil {
+				findings = append(findings, *finding)
+			}
+		}
+		lr.addPart(part.Index, info, findings)
+	}
+
+	// Chunks are shared between backups and named after their hash, so only their presence tells anything.
+	seen := make(map[string]bool)
+	for _, c := range m.Chunks {
+		if seen[c.Blake3Hash] {
+			continue
+		}
+		seen[c.Blake3Hash] = true
+		info, err := v.head(ctx, remote.ChunkPath(m.S3Prefix, m.ChunkStore, c.Blake3Hash))
+		if err != nil {
+			return nil, fmt.Errorf("chunk %s: %w", c.Blake3Hash, err)
+		}
+		if info == nil {
+			lr.Findings = append(lr.Findings, Finding{Level: v.level, Part: "chunk " + c.Blake3Hash, Kind: Missing, Detail: "the object is not in the bucket"})
+		}
+	}
+
+	anchorFindings, anchorStatus, err := v.checkAnchor(ctx, m, manifestBlake3, objects)
+	if err != nil {
+		return nil, fmt.Errorf("anchor: %w", err)
+	}
+	lr.Findings = append(lr.Findings, anchorFindings...)
+
+	checked := fmt.Sprintf("%d parts", len(m.Parts))
+	if m.Chunked() {
+		checked = fmt.Sprintf("%d chunks", len(seen))
+	}
+	if first, last := UploadSpan(m); !first.IsZero() {
+		checked += fmt.Sprintf(", uploaded %s to %s", first.UTC().Format(time.RFC3339), last.UTC().Format(time.RFC3339))
+	}
+	if v.deep && !m.Chunked() {
+		checked += ", hashed"
+	}
+	return lr.finish(checked + ", " + anchorStatus), nil
+}
+
+// runLocal checks the parts of the level in the task directory holding its local manifest. Without
+// object metadata to compare, their presence, size and age framing are checked unless they are
+// hashed.
+func (v *levelVerifier) runLocal(lr *LevelReport) (*LevelReport, error) {
+	if v.ref.Manifest == "" {
+		return lr.skip("no local manifest; use --source s3"), nil
+	}
+	m, err := manifest.Read(v.ref.Manifest)
+	switch {
+	case os.IsNotExist(err) && v.ref.LocalOnly:
+		lr.Findings = append(lr.Findings, Finding{Level: v.level, Kind: Missing, Detail: fmt.Sprintf("the local manifest %s of the local-only backup is gone", v.ref.Manifest)})
+		return lr.finish("no manifest"), nil
+	case os.IsNotExist(err):
+		return lr.skip("no local manifest; use --source s3"), nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to read task manifest: %w", err)
+	case m.Chunked():
+		return lr.skip("dedup_store chunks are only in the bucket; use --source s3"), nil
+	}
+	lr.Snapshot = m.TargetSnapshot
+
+	dir := filepath.Dir(v.ref.Manifest)
+	for _, part := range m.Parts {
+		path := filepath.Join(dir, manifest.PartFileName(part.Index))
+		var info *remote.ObjectInfo
+		var findings []Finding
+		if fi, err := os.Stat(path); os.IsNotExist(err) {
+			findings = append(findings, Finding{Level: v.level, Part: part.Index, Kind: Missing, Detail: "the file is not in " + dir})
+		} else if err != nil {
+			return nil, fmt.Errorf("part %s: %w", part.Index, err)
+		} else {
+			info = &remote.ObjectInfo{Size: fi.Size(), LastModified: fi.ModTime()}
+			if finding := checkSize(v.level, part, fi.Size()); finding != nil {
+				findings = append(findings, *finding)
+			}
+		}
+		if info != nil {
+			finding, err := v.checkFile(part, path)
+			if err != nil {
+				return nil, err
+			}
+			if finding != nil {
+				findings = append(findings, *finding)
+			}
+		}
+		lr.addPart(part.Index, info, findings)
+	}
+
+	checked := fmt.Sprintf("%d parts in %s", len(m.Parts), dir)
+	if v.deep {
+		checked += ", hashed"
+	} else {
+		checked += ", headers checked"
+	}
+	return lr.finish(checked), nil
+}
+
+// checkFile checks the age header and framing of the part at path, and hashes it with --deep unless
+// the header already shows it corrupt.
+func (v *levelVerifier) checkFile(part manifest.PartInfo, path string) (*Finding, error) {
+	finding, err := QuickCheckPart(v.level, part, path)
+	if err != nil || finding != nil || !v.deep {
+		return finding, err
+	}
+	return HashPart(v.level, part, path)
+}
+
+// checkAnchor compares the anchor of the level, if one was written and can be decrypted, with m
+// and the part objects. The returned status tells whether it was checked.
+func (v *levelVerifier) checkAnchor(ctx context.Context, m *manifest.Backup, manifestBlake3 string, objects map[string]*remote.ObjectInfo) ([]Finding, string, error) {
+	remotePath := remote.AnchorPath(v.task.S3Prefix, v.ref.S3Path, manifest.AnchorFile)
+	info, err := v.head(ctx, remotePath)
+	switch {
+	case err != nil:
+		return nil, "", err
+	case info == nil:
+		return nil, "no anchor", nil
+	case v.identities == nil:
+		return nil, "anchor not checked without --private-key", nil
+	}
+
+	encrypted := filepath.Join(v.workDir, fmt.Sprintf("level%d_%s", v.level, manifest.AnchorFile))
+	plain := filepath.Join(v.workDir, fmt.Sprintf("level%d_anchor.yaml", v.level))
+	if err := v.backend.Download(ctx, remotePath, encrypted); err != nil {
+		return nil, "", fmt.Errorf("failed to download: %w", err)
+	}
+	if err := crypto.Decrypt(encrypted, plain, v.identities...); err != nil {
+		return nil, "", fmt.Errorf("failed to decrypt: %w", err)
+	}
+	a, err := manifest.ReadAnchor(plain)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read: %w", err)
+	}
+	return CheckAnchor(v.level, a, m, manifestBlake3, objects), "anchor checked", nil
+}
+
+// head returns the object at remotePath, nil when it does not exist.
+func (v *levelVerifier) head(ctx context.Context, remotePath string) (*remote.ObjectInfo, error) {
+	info, err := v.backend.Head(ctx, remotePath)
+	if remote.IsNotFound(err) {
+		return nil, nil
+	}
+	return info, err
+}
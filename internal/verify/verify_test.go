@@ -0,0 +1,280 @@
+package verify
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"zrb/internal/crypto"
+	"zrb/internal/manifest"
+	"zrb/internal/remote"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupWindow(t *testing.T) {
+	completed := time.Date(2024, 1, 15, 3, 0, 0, 0, time.UTC)
+	m := &manifest.Backup{Datetime: completed.Unix(), DateTimezone: "UTC", TargetS3Path: "tank/data/level0/20240115"}
+	assert.Equal(t, Window{
+		NotBefore: time.Date(2024, 1, 14, 23, 0, 0, 0, time.UTC),
+		NotAfter:  completed.Add(time.Hour),
+	}, toUTC(BackupWindow(m)))
+
+	m.DateTimezone = ""
+	assert.True(t, BackupWindow(m).NotBefore.IsZero(), "a directory dated in local time does not bound the start")
+}
+
+func toUTC(w Window) Window {
+	return Window{NotBefore: w.NotBefore.UTC(), NotAfter: w.NotAfter.UTC()}
+}
+
+func TestCheckPart(t *testing.T) {
+	part := manifest.PartInfo{Index: "aa", Blake3Hash: "h1"}
+	window := Window{
+		NotBefore: time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC),
+		NotAfter:  time.Date(2024, 1, 15, 4, 0, 0, 0, time.UTC),
+	}
+	during := time.Date(2024, 1, 15, 2, 0, 0, 0, time.UTC)
+	// The part times narrow the window to the part.
+	timed := part
+	timed.EncryptedAt = time.Date(2024, 1, 15, 1, 30, 0, 0, time.UTC).Unix()
+	timed.UploadedAt = timed.EncryptedAt
+	sized := part
+	sized.SizeBytes = 1024
+
+	tests := []struct {
+		name  string
+		part  manifest.PartInfo
+		info  *remote.ObjectInfo
+		kinds []Kind
+		want  string
+	}{
+		{name: "intact", part: part, info: &remote.ObjectInfo{Blake3: "h1", LastModified: during}},
+		{name: "missing", part: part, kinds: []Kind{Missing}, want: "not in the bucket"},
+		{
+			name:  "overwritten with other metadata",
+			part:  part,
+			info:  &remote.ObjectInfo{Blake3: "h2", LastModified: during},
+			kinds: []Kind{Overwritten},
+			want:  "blake3 metadata is h2, the manifest records h1",
+		},
+		{
+			name:  "overwritten without metadata",
+			part:  part,
+			info:  &remote.ObjectInfo{LastModified: during},
+			kinds: []Kind{Overwritten},
+			want:  "no blake3 metadata",
+		},
+		{
+			name:  "rewritten later with the same metadata",
+			part:  part,
+			info:  &remote.ObjectInfo{Blake3: "h1", LastModified: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+			kinds: []Kind{OutsideWindow},
+			want:  "last modified 2024-03-01T00:00:00Z, after the backup completed",
+		},
+		{
+			name:  "older than the backup",
+			part:  part,
+			info:  &remote.ObjectInfo{Blake3: "h1", LastModified: time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC)},
+			kinds: []Kind{OutsideWindow},
+			want:  "before the backup started",
+		},
+		{
+			name:  "overwritten later",
+			part:  part,
+			info:  &remote.ObjectInfo{Blake3: "h2", LastModified: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+			kinds: []Kind{Overwritten, OutsideWindow},
+		},
+		{
+			name: "legacy parts have no blake3 to compare",
+			part: manifest.PartInfo{Index: "aa", SHA256Hash: "s1"},
+			info: &remote.ObjectInfo{LastModified: during},
+		},
+		{name: "backends without a modification time", part: part, info: &remote.ObjectInfo{Blake3: "h1"}},
+		{
+			name:  "rewritten within the backup, after the part was uploaded",
+			part:  timed,
+			info:  &remote.ObjectInfo{Blake3: "h1", LastModified: during.Add(time.Hour)},
+			kinds: []Kind{OutsideWindow},
+			want:  "after the part was uploaded at 2024-01-15T01:30:00Z",
+		},
+		{
+			name:  "older than the part's encryption",
+			part:  timed,
+			info:  &remote.ObjectInfo{Blake3: "h1", LastModified: window.NotBefore.Add(15 * time.Minute)},
+			kinds: []Kind{OutsideWindow},
+			want:  "before the part was encrypted at 2024-01-15T01:30:00Z",
+		},
+		{name: "uploaded when recorded", part: timed, info: &remote.ObjectInfo{Blake3: "h1", LastModified: during.Add(-30 * time.Minute)}},
+		{name: "recorded size", part: sized, info: &remote.ObjectInfo{Blake3: "h1", Size: 1024, LastModified: during}},
+		{
+			name:  "truncated",
+			part:  sized,
+			info:  &remote.ObjectInfo{Blake3: "h1", Size: 512, LastModified: during},
+			kinds: []Kind{Overwritten},
+			want:  "the object has 512 bytes, the manifest records 1024",
+		},
+		{name: "manifests without sizes", part: part, info: &remote.ObjectInfo{Blake3: "h1", Size: 512, LastModified: during}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			findings := CheckPart(2, tt.part, tt.info, window)
+			var kinds []Kind
+			for _, f := range findings {
+				kinds = append(kinds, f.Kind)
+				assert.Equal(t, int16(2), f.Level)
+				assert.Equal(t, "aa", f.Part)
+			}
+			assert.Equal(t, tt.kinds, kinds)
+			if tt.want != "" {
+				require.NotEmpty(t, findings)
+				assert.Contains(t, findings[0].Detail, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunLocalChecksHeaders(t *testing.T) {
+	dir := t.TempDir()
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	plain := filepath.Join(dir, "plain")
+	require.NoError(t, os.WriteFile(plain, []byte(strings.Repeat("data", 1000)), 0o600))
+
+	m := &manifest.Backup{TargetSnapshot: "tank/data@l0"}
+	for _, index := range []string{"aa", "ab"} {
+		path := filepath.Join(dir, manifest.PartFileName(index))
+		require.NoError(t, crypto.Encrypt(plain, path, identity.Recipient()))
+		hash, err := crypto.BLAKE3File(path)
+		require.NoError(t, err)
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		m.Parts = append(m.Parts, manifest.PartInfo{Index: index, Blake3Hash: hash, SizeBytes: info.Size()})
+	}
+	manifestPath := filepath.Join(dir, "task_manifest.yaml")
+	require.NoError(t, manifest.Write(manifestPath, m))
+
+	// A damaged header keeps the size, so only the header check finds it.
+	path := filepath.Join(dir, manifest.PartFileName("ab"))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[0] = 'x'
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+
+	for _, deep := range []bool{false, true} {
+		v := levelVerifier{level: 0, ref: &manifest.Ref{Manifest: manifestPath}, deep: deep}
+		lr, err := v.runLocal(&LevelReport{Level: 0, Parts: []PartReport{}})
+		require.NoError(t, err)
+		require.Len(t, lr.Findings, 1, "deep %v", deep)
+		assert.Equal(t, "ab", lr.Findings[0].Part)
+		assert.Equal(t, Corrupt, lr.Findings[0].Kind)
+		assert.Contains(t, lr.Findings[0].Detail, "invalid age header")
+		assert.Equal(t, []PartReport{{Index: "aa", Status: StatusOK, Size: int64(len(data))}, {Index: "ab", Status: "corrupt", Size: int64(len(data))}}, lr.Parts)
+	}
+}
+
+func TestUploadSpan(t *testing.T) {
+	first, last := UploadSpan(&manifest.Backup{Parts: []manifest.PartInfo{{Index: "aa"}}})
+	assert.True(t, first.IsZero(), "manifests without upload times")
+	assert.True(t, last.IsZero())
+
+	first, last = UploadSpan(&manifest.Backup{Parts: []manifest.PartInfo{{Index: "aa", UploadedAt: 300}, {Index: "ab"}, {Index: "ac", UploadedAt: 100}}})
+	assert.Equal(t, time.Unix(100, 0), first)
+	assert.Equal(t, time.Unix(300, 0), last)
+}
+
+func TestCheckAnchor(t *testing.T) {
+	m := &manifest.Backup{
+		TargetSnapshot: "tank/data@zrb_level0_2024-01-15_00-00",
+		Blake3Hash:     "stream",
+		Parts:          []manifest.PartInfo{{Index: "aa", Blake3Hash: "h1"}, {Index: "ab", Blake3Hash: "h2"}},
+	}
+	anchor := func() *manifest.Anchor {
+		return &manifest.Anchor{
+			TargetSnapshot: m.TargetSnapshot,
+			Blake3Hash:     "stream",
+			ManifestBlake3: "manifest",
+			Parts: []manifest.AnchorPart{
+				{Index: "aa", Blake3Hash: "h1", Size: 100, ETag: `"e1"`},
+				{Index: "ab", Blake3Hash: "h2", Size: 50, ETag: `"e2"`},
+			},
+		}
+	}
+	objects := map[string]*remote.ObjectInfo{
+		"aa": {Blake3: "h1", Size: 100, ETag: `"e1"`},
+		"ab": {Blake3: "h2", Size: 50, ETag: `"e2"`},
+	}
+
+	assert.Empty(t, CheckAnchor(0, anchor(), m, "manifest", objects))
+
+	findings := CheckAnchor(0, anchor(), m, "other", objects)
+	require.Len(t, findings, 1)
+	assert.Equal(t, Finding{Level: 0, Kind: ManifestReplaced, Detail: "task_manifest.yaml has BLAKE3 other, the anchor recorded manifest"}, findings[0])
+	assert.Equal(t, "level 0 manifest: manifest_replaced: task_manifest.yaml has BLAKE3 other, the anchor recorded manifest", findings[0].String())
+
+	// A replaced manifest that names other parts, e.g. to point a restore at planted objects.
+	replaced := *m
+	replaced.Parts = []manifest.PartInfo{{Index: "aa", Blake3Hash: "evil"}, {Index: "ac", Blake3Hash: "h3"}}
+	var details []string
+	for _, f := range CheckAnchor(0, anchor(), &replaced, "other", objects) {
+		assert.Equal(t, ManifestReplaced, f.Kind)
+		details = append(details, f.Part+": "+f.Detail)
+	}
+	assert.Equal(t, []string{
+		": task_manifest.yaml has BLAKE3 other, the anchor recorded manifest",
+		"aa: the manifest records evil, the anchor h1",
+		"ab: the anchor lists the part, the manifest does not",
+		"ac: the manifest lists the part, the anchor does not",
+	}, details)
+
+	// Overwriting a part with the original metadata still changes its ETag or size.
+	a := anchor()
+	findings = CheckAnchor(0, a, m, "manifest", map[string]*remote.ObjectInfo{
+		"aa": {Blake3: "h1", Size: 100, ETag: `"e9"`},
+		"ab": {Blake3: "h2", Size: 49, ETag: `"e2"`},
+	})
+	require.Len(t, findings, 2)
+	assert.Equal(t, Finding{Level: 0, Part: "aa", Kind: Overwritten, Detail: `the object's ETag is "e9", "e1" when the backup uploaded it`}, findings[0])
+	assert.Equal(t, Finding{Level: 0, Part: "ab", Kind: Overwritten, Detail: "the object has 49 bytes, 50 when the backup uploaded it"}, findings[1])
+
+	assert.Empty(t, CheckAnchor(0, a, m, "manifest", map[string]*remote.ObjectInfo{"aa": objects["aa"]}),
+		"missing parts are reported by CheckPart")
+}
+
+func TestReport(t *testing.T) {
+	r := &Report{}
+	r.Summary.Passed = true
+	r.add((&LevelReport{Level: 0, Snapshot: "tank/data@l0"}).skip("local-only"))
+	assert.True(t, r.Summary.Passed, "skipped levels pass")
+	assert.Zero(t, r.Summary.Levels)
+
+	lr := &LevelReport{Level: 1, Snapshot: "tank/data@l1"}
+	lr.addPart("aa", &remote.ObjectInfo{Size: 10}, nil)
+	lr.addPart("ab", nil, []Finding{{Level: 1, Part: "ab", Kind: Missing, Detail: "gone"}})
+	lr.addPart("ac", &remote.ObjectInfo{Size: 10}, []Finding{
+		{Level: 1, Part: "ac", Kind: Corrupt, Detail: "bad"},
+		{Level: 1, Part: "ac", Kind: OutsideWindow, Detail: "late"},
+	})
+	r.add(lr.finish("3 parts"))
+
+	assert.Equal(t, []PartReport{{Index: "aa", Status: StatusOK, Size: 10}, {Index: "ab", Status: "missing"}, {Index: "ac", Status: "corrupt", Size: 10}}, r.Levels[1].Parts)
+	assert.Equal(t, StatusProblems, r.Levels[1].Status)
+	assert.Equal(t, 1, r.Summary.Levels)
+	assert.Equal(t, 3, r.Summary.Parts)
+	assert.Equal(t, 1, r.Summary.Missing)
+	assert.Equal(t, 1, r.Summary.Mismatched)
+	assert.Equal(t, 3, r.Summary.Problems)
+	assert.False(t, r.Summary.Passed)
+
+	var out strings.Builder
+	r.Levels[0].print(&out)
+	lr.print(&out)
+	assert.Equal(t, "level 0 tank/data@l0: skipped (local-only)\n"+
+		"level 1 tank/data@l1: 3 problem(s) (3 parts)\n"+
+		"  level 1 part ab: missing: gone\n"+
+		"  level 1 part ac: corrupt: bad\n"+
+		"  level 1 part ac: outside_window: late\n", out.String())
+}
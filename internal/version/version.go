@@ -0,0 +1,29 @@
+package version
+
+import "fmt"
+
+// Set at build time via -ldflags "-X zrb/internal/version.Version=...".
+var (
+	Version = "dev"
+	Commit  = "unknown"
+	Date    = "unknown"
+)
+
+type Info struct {
+	Version string `yaml:"version" json:"version"`
+	Commit  string `yaml:"commit" json:"commit"`
+	Date    string `yaml:"date" json:"date"`
+}
+
+func Get() Info {
+	return Info{Version: Version, Commit: Commit, Date: Date}
+}
+
+func String() string {
+	return fmt.Sprintf("%s (commit %s, built %s)", Version, Commit, Date)
+}
+
+// LogAttrs returns key-value pairs for slog.
+func LogAttrs() []any {
+	return []any{"version", Version, "commit", Commit, "buildDate", Date}
+}
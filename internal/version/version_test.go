@@ -0,0 +1,13 @@
+package version
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFallbackValues(t *testing.T) {
+	assert.Equal(t, Info{Version: "dev", Commit: "unknown", Date: "unknown"}, Get())
+	assert.Equal(t, "dev (commit unknown, built unknown)", String())
+	assert.Equal(t, []any{"version", "dev", "commit", "unknown", "buildDate", "unknown"}, LogAttrs())
+}
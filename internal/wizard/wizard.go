@@ -0,0 +1,164 @@
+package wizard
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"zrb/internal/config"
+	"zrb/internal/keys"
+)
+
+type Options struct {
+	Output   string
+	BaseDir  string
+	Bucket   string
+	Region   string
+	Prefix   string
+	Endpoint string
+	TaskName string
+	Pool     string
+	Dataset  string
+	// NonInteractive fails on missing values instead of prompting for them.
+	NonInteractive bool
+}
+
+const configTemplate = `# yaml-language-server: $schema=https://raw.githubusercontent.com/ziteh/zfs-remote-backup/refs/heads/main/docs/config-schema.json
+
+base_dir: {{q .BaseDir}}
+age_public_key: {{q .PublicKey}} # private key: {{.PrivateKeyPath}}
+s3:
+  enabled: true
+  bucket: {{q .Bucket}}
+  region: {{q .Region}}
+  prefix: {{q .Prefix}}
+  endpoint: {{q .Endpoint}} # Leave empty for AWS S3, or specify custom endpoint for S3-compatible services
+  storage_class:
+    manifest: STANDARD
+    backup_data:
+      - DEEP_ARCHIVE # Level 0 (full backup)
+      - DEEP_ARCHIVE
+      - GLACIER
+  retry:
+    max_attempts: 8
+tasks:
+  - name: {{q .TaskName}}
+    pool: {{q .Pool}}
+    dataset: {{q .Dataset}}
+    enabled: true
+`
+
+var tmpl = template.Must(template.New("config").Funcs(template.FuncMap{"q": strconv.Quote}).Parse(configTemplate))
+
+type prompter struct {
+	in             *bufio.Reader
+	out            io.Writer
+	nonInteractive bool
+}
+
+// ask fills *value from input when it is empty, falling back to def; required values must end up non-empty.
+func (p *prompter) ask(value *string, label, def string, required bool) error {
+	if *value != "" {
+		return nil
+	}
+
+	if !p.nonInteractive {
+		if def != "" {
+			fmt.Fprintf(p.out, "%s [%s]: ", label, def)
+		} else {
+			fmt.Fprintf(p.out, "%s: ", label)
+		}
+		line, err := p.in.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read %s: %w", label, err)
+		}
+		*value = strings.TrimSpace(line)
+	}
+
+	if *value == "" {
+		*value = def
+	}
+	if *value == "" && required {
+		return fmt.Errorf("%s is required", label)
+	}
+	return nil
+}
+
+func (p *prompter) fill(opts *Options) error {
+	steps := []struct {
+		value    *string
+		label    string
+		def      string
+		required bool
+	}{
+		{&opts.BaseDir, "Base directory", "/var/lib/zrb", true},
+		{&opts.Bucket, "S3 bucket", "", true},
+		{&opts.Region, "S3 region", "us-east-1", true},
+		{&opts.Prefix, "S3 prefix", "zfs-backups/", false},
+		{&opts.Endpoint, "S3 endpoint (empty for AWS)", "", false},
+		{&opts.Pool, "ZFS pool", "", true},
+		{&opts.Dataset, "ZFS dataset", "", true},
+	}
+	for _, s := range steps {
+		if err := p.ask(s.value, s.label, s.def, s.required); err != nil {
+			return err
+		}
+	}
+	return p.ask(&opts.TaskName, "Task name", strings.ReplaceAll(opts.Pool+"/"+opts.Dataset, "/", "_"), true)
+}
+
+// Init writes a starter config with a freshly generated key pair next to it, prompting on stdin for missing values.
+func Init(_ context.Context, opts Options) error {
+	return run(opts, os.Stdin, os.Stdout)
+}
+
+func run(opts Options, in io.Reader, out io.Writer) error {
+	if _, err := os.Stat(opts.Output); err == nil {
+		return fmt.Errorf("%s already exists, remove it first", opts.Output)
+	}
+
+	p := &prompter{in: bufio.NewReader(in), out: out, nonInteractive: opts.NonInteractive}
+	if err := p.fill(&opts); err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(opts.Output)
+	privateKeyPath := filepath.Join(dir, "zrb_private.key")
+	publicKeyPath := filepath.Join(dir, "zrb_public.key")
+	publicKey, err := keys.WriteKeyPair(privateKeyPath, publicKeyPath, "")
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, struct {
+		Options
+		PublicKey      string
+		PrivateKeyPath string
+	}{opts, publicKey, privateKeyPath}); err != nil {
+		return fmt.Errorf("failed to render config: %w", err)
+	}
+
+	if err := os.WriteFile(opts.Output, buf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+
+	if _, err := config.Load(opts.Output); err != nil {
+		for _, f := range []string{opts.Output, privateKeyPath, publicKeyPath} {
+			os.Remove(f)
+		}
+		return fmt.Errorf("generated config is invalid: %w", err)
+	}
+
+	fmt.Fprintf(out, "Config written to:      %s\n", opts.Output)
+	fmt.Fprintf(out, "Private key saved to:   %s\n", privateKeyPath)
+	fmt.Fprintf(out, "\nIMPORTANT: Move the private key off this machine and keep it secure.\n")
+	fmt.Fprintf(out, "If you lose the private key, your backups cannot be restored.\n")
+	return nil
+}
@@ -0,0 +1,74 @@
+package wizard
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"zrb/internal/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunWithFlags(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{
+		Output:         filepath.Join(dir, "zrb_config.yaml"),
+		Bucket:         "my-bucket",
+		Region:         "eu-west-1",
+		Pool:           "tank",
+		Dataset:        "data/photos",
+		NonInteractive: true,
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, run(opts, strings.NewReader(""), &out))
+
+	cfg, err := config.Load(opts.Output)
+	require.NoError(t, err)
+	assert.Equal(t, "/var/lib/zrb", cfg.BaseDir)
+	assert.Equal(t, "my-bucket", cfg.S3.Bucket)
+	assert.Equal(t, "zfs-backups/", cfg.S3.Prefix)
+	require.Len(t, cfg.Tasks, 1)
+	assert.Equal(t, "tank_data_photos", cfg.Tasks[0].Name)
+
+	public, err := os.ReadFile(filepath.Join(dir, "zrb_public.key"))
+	require.NoError(t, err)
+	assert.Equal(t, strings.TrimSpace(string(public)), cfg.AgePublicKey)
+
+	info, err := os.Stat(filepath.Join(dir, "zrb_private.key"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	assert.ErrorContains(t, run(opts, strings.NewReader(""), &out), "already exists")
+}
+
+func TestRunPrompts(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{Output: filepath.Join(dir, "zrb_config.yaml"), Pool: "tank"}
+
+	// base dir, bucket, region, prefix, endpoint, dataset, task name
+	input := "/srv/zrb\nb\n\n\n\ndata\nnightly\n"
+	var out bytes.Buffer
+	require.NoError(t, run(opts, strings.NewReader(input), &out))
+	assert.Contains(t, out.String(), "S3 region [us-east-1]: ")
+	assert.NotContains(t, out.String(), "ZFS pool")
+
+	cfg, err := config.Load(opts.Output)
+	require.NoError(t, err)
+	assert.Equal(t, "/srv/zrb", cfg.BaseDir)
+	assert.Equal(t, "us-east-1", cfg.S3.Region)
+	assert.Equal(t, "nightly", cfg.Tasks[0].Name)
+	assert.Equal(t, "data", cfg.Tasks[0].Dataset)
+}
+
+func TestRunMissingRequired(t *testing.T) {
+	opts := Options{Output: filepath.Join(t.TempDir(), "zrb_config.yaml"), NonInteractive: true}
+
+	err := run(opts, strings.NewReader(""), &bytes.Buffer{})
+	assert.ErrorContains(t, err, "S3 bucket is required")
+	_, statErr := os.Stat(opts.Output)
+	assert.True(t, os.IsNotExist(statErr))
+}
@@ -0,0 +1,192 @@
+package zfs
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"slices"
+	"strings"
+)
+
+var (
+	// BackupPermissions are the delegated permissions backup needs on the source dataset.
+	BackupPermissions = []string{"send", "snapshot", "hold"}
+	// SnapshotPermissions are the delegated permissions the snapshot command needs.
+	SnapshotPermissions = []string{"snapshot"}
+	// RestorePermissions are the delegated permissions restore needs on the target dataset.
+	RestorePermissions = []string{"receive", "create", "mount"}
+)
+
+// Principal is the user and groups delegated permissions are evaluated for.
+type Principal struct {
+	User   string
+	UID    string
+	Groups []string
+}
+
+func CurrentPrincipal() (Principal, error) {
+	u, err := user.Current()
+	if err != nil {
+		return Principal{}, fmt.Errorf("failed to look up current user: %w", err)
+	}
+
+	p := Principal{User: u.Username, UID: u.Uid}
+	gids, err := u.GroupIds()
+	if err != nil {
+		return Principal{}, fmt.Errorf("failed to look up groups of %s: %w", u.Username, err)
+	}
+	for _, gid := range gids {
+		p.Groups = append(p.Groups, gid)
+		if g, err := user.LookupGroupId(gid); err == nil {
+			p.Groups = append(p.Groups, g.Name)
+		}
+	}
+	return p, nil
+}
+
+func (p Principal) matches(kind, name string) bool {
+	switch kind {
+	case "everyone":
+		return true
+	case "user":
+		return name == p.User || name == p.UID
+	case "group":
+		return slices.Contains(p.Groups, name)
+	}
+	return false
+}
+
+// EffectivePermissions evaluates `zfs allow <dataset>` output for p. Local permissions count only on the
+// dataset itself, descendent permissions only when inherited from an ancestor, and permission sets are expanded.
+func EffectivePermissions(output, dataset string, p Principal) map[string]bool {
+	sets := make(map[string][]string)
+	var granted []string
+
+	var onSelf bool
+	var section string
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if rest, ok := strings.CutPrefix(line, "---- Permissions on "); ok {
+			onSelf = strings.Fields(rest)[0] == dataset
+			section = ""
+			continue
+		}
+		if !strings.HasPrefix(line, "\t") && strings.HasSuffix(line, ":") {
+			section = strings.TrimSuffix(line, ":")
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if section == "Permission sets" {
+			if len(fields) == 2 {
+				sets[fields[0]] = strings.Split(fields[1], ",")
+			}
+			continue
+		}
+
+		var applies bool
+		switch section {
+		case "Local permissions":
+			applies = onSelf
+		case "Descendent permissions":
+			applies = !onSelf
+		case "Local+Descendent permissions":
+			applies = true
+		}
+		if !applies {
+			continue
+		}
+
+		var kind, name, perms string
+		switch {
+		case fields[0] == "everyone" && len(fields) == 2:
+			kind, perms = fields[0], fields[1]
+		case len(fields) == 3:
+			kind, name, perms = fields[0], fields[1], fields[2]
+		default:
+			continue
+		}
+		if p.matches(kind, name) {
+			granted = append(granted, strings.Split(perms, ",")...)
+		}
+	}
+
+	effective := make(map[string]bool)
+	for _, perm := range granted {
+		if expanded, ok := sets[perm]; ok {
+			for _, e := range expanded {
+				effective[e] = true
+			}
+			continue
+		}
+		effective[perm] = true
+	}
+	return effective
+}
+
+// MissingPermissions returns the entries of required that are not in effective, in order.
+func MissingPermissions(effective map[string]bool, required []string) []string {
+	var missing []string
+	for _, perm := range required {
+		if !effective[perm] {
+			missing = append(missing, perm)
+		}
+	}
+	return missing
+}
+
+// CheckPermissions verifies that a non-root user has been delegated the required permissions on dataset,
+// so a missing `zfs allow` fails before any work instead of with "permission denied" halfway through.
+func CheckPermissions(dataset string, required []string) error {
+	if os.Geteuid() == 0 {
+		return nil
+	}
+
+	p, err := CurrentPrincipal()
+	if err != nil {
+		return err
+	}
+
+	output, err := exec.Command("zfs", "allow", dataset).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to read ZFS permissions on %s: %w: %s", dataset, err, strings.TrimSpace(string(output)))
+	}
+
+	missing := MissingPermissions(EffectivePermissions(string(output), dataset, p), required)
+	if len(missing) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("user %s is missing ZFS permissions on %s: %s\n"+
+		"Ask an administrator to run: zfs allow -u %s %s %s",
+		p.User, dataset, strings.Join(missing, ", "), p.User, strings.Join(required, ","), dataset)
+}
+
+// NearestExistingDataset returns dataset or its closest existing ancestor, where permissions for creating it apply.
+func NearestExistingDataset(dataset string) (string, error) {
+	for name := dataset; name != ""; {
+		ok, err := DatasetExists(name)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return name, nil
+		}
+
+		i := strings.LastIndex(name, "/")
+		if i < 0 {
+			break
+		}
+		name = name[:i]
+	}
+	return "", fmt.Errorf("no existing dataset found for %s", dataset)
+}
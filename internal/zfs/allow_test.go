@@ -0,0 +1,57 @@
+package zfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const allowOutput = `---- Permissions on tank/data ----------------------------------------
+Permission sets:
+	@restore create,mount,receive
+Local permissions:
+	user backup send
+	user other destroy
+Descendent permissions:
+	user backup rollback
+Local+Descendent permissions:
+	group operators hold
+---- Permissions on tank ---------------------------------------------
+Create time permissions:
+	destroy
+Local permissions:
+	user backup snapshot
+Descendent permissions:
+	everyone mount
+Local+Descendent permissions:
+	user 1001 @restore
+`
+
+func TestEffectivePermissions(t *testing.T) {
+	backup := Principal{User: "backup", UID: "1001", Groups: []string{"1001", "backup", "50", "operators"}}
+
+	got := EffectivePermissions(allowOutput, "tank/data", backup)
+	assert.Equal(t, map[string]bool{
+		"send":    true,
+		"hold":    true,
+		"mount":   true,
+		"create":  true,
+		"receive": true,
+	}, got, "local on self, descendent from ancestors, sets expanded by uid")
+
+	assert.Empty(t, MissingPermissions(got, []string{"send", "hold"}))
+	assert.Equal(t, []string{"snapshot"}, MissingPermissions(got, BackupPermissions))
+	assert.Empty(t, MissingPermissions(got, RestorePermissions))
+}
+
+func TestEffectivePermissionsOtherUser(t *testing.T) {
+	nobody := Principal{User: "nobody", UID: "65534", Groups: []string{"65534", "nogroup"}}
+
+	got := EffectivePermissions(allowOutput, "tank/data", nobody)
+	assert.Equal(t, map[string]bool{"mount": true}, got)
+}
+
+func TestEffectivePermissionsNoDelegation(t *testing.T) {
+	got := EffectivePermissions("", "tank/data", Principal{User: "backup"})
+	assert.Equal(t, []string{"send", "snapshot", "hold"}, MissingPermissions(got, BackupPermissions))
+}
@@ -0,0 +1,96 @@
+package zfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// Change types of zfs diff.
+const (
+	ChangeAdded    = "+"
+	ChangeRemoved  = "-"
+	ChangeModified = "M"
+	ChangeRenamed  = "R"
+)
+
+// Change is one line of zfs diff -H: a file added, removed, modified or renamed to NewPath.
+// Paths keep the octal escapes zfs diff writes for spaces and unprintable characters.
+type Change struct {
+	Type    string
+	Path    string
+	NewPath string
+}
+
+// ParseChange parses a line of zfs diff -H.
+func ParseChange(line string) (Change, error) {
+	fields := strings.Split(strings.TrimSuffix(line, "\n"), "\t")
+	switch {
+	case len(fields) == 2 && fields[0] != ChangeRenamed:
+		return Change{Type: fields[0], Path: fields[1]}, nil
+	case len(fields) == 3 && fields[0] == ChangeRenamed:
+		return Change{Type: fields[0], Path: fields[1], NewPath: fields[2]}, nil
+	}
+	return Change{}, fmt.Errorf("unexpected zfs diff line %q", line)
+}
+
+// Diff writes the changes from the snapshot parent to target, as zfs diff -H prints them, into w.
+// It writes whole lines of at most maxBytes in total and reports whether it stopped zfs diff there,
+// along with the lines written.
+func Diff(ctx context.Context, parent, target string, w io.Writer, maxBytes int64) (lines int64, truncated bool, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	args := []string{"diff", "-H", parent, target}
+	cmd := exec.CommandContext(ctx, "zfs", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, false, err
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, false, NewCommandError(append([]string{"zfs"}, args...), err, "")
+	}
+
+	r := bufio.NewReader(stdout)
+	var written int64
+	var writeErr error
+	for {
+		line, readErr := r.ReadBytes('\n')
+		if len(line) > 0 {
+			if line[len(line)-1] != '\n' {
+				line = append(line, '\n')
+			}
+			if written+int64(len(line)) > maxBytes {
+				truncated = true
+				break
+			}
+			if _, writeErr = w.Write(line); writeErr != nil {
+				break
+			}
+			written += int64(len(line))
+			lines++
+		}
+		if readErr != nil {
+			break
+		}
+	}
+
+	if truncated || writeErr != nil {
+		// zfs diff may have much more to say; stop it rather than read it all.
+		cancel()
+		_ = cmd.Wait()
+		if writeErr != nil {
+			return lines, false, fmt.Errorf("failed to write zfs diff output: %w", writeErr)
+		}
+		return lines, true, nil
+	}
+	if err := cmd.Wait(); err != nil {
+		return lines, false, NewCommandError(append([]string{"zfs"}, args...), err, stderr.String())
+	}
+	return lines, false, nil
+}
@@ -0,0 +1,71 @@
+package zfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseChange(t *testing.T) {
+	c, err := ParseChange("M\t/tank/data/etc\n")
+	require.NoError(t, err)
+	assert.Equal(t, Change{Type: ChangeModified, Path: "/tank/data/etc"}, c)
+
+	c, err = ParseChange("R\t/tank/data/a\t/tank/data/b")
+	require.NoError(t, err)
+	assert.Equal(t, Change{Type: ChangeRenamed, Path: "/tank/data/a", NewPath: "/tank/data/b"}, c)
+
+	for _, line := range []string{"", "/tank/data/a", "R\t/tank/data/a", "+\t/a\t/b"} {
+		_, err := ParseChange(line)
+		assert.Error(t, err, line)
+	}
+}
+
+// fakeDiffZFS puts a zfs first in PATH that prints out and exits with code.
+func fakeDiffZFS(t *testing.T, out string, code int) {
+	t.Helper()
+	bin := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "out"), []byte(out), 0o644))
+	script := fmt.Sprintf("#!/bin/sh\ncat %q\necho 'Cannot stat /tank/data: unable to generate diffs' >&2\nexit %d\n", filepath.Join(bin, "out"), code)
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "zfs"), []byte(script), 0o755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestDiff(t *testing.T) {
+	out := "+\t/tank/data/new\nM\t/tank/data\nR\t/tank/data/a\t/tank/data/b\n"
+
+	t.Run("complete", func(t *testing.T) {
+		fakeDiffZFS(t, out, 0)
+		var w bytes.Buffer
+		lines, truncated, err := Diff(context.Background(), "tank/data@a", "tank/data@b", &w, 1<<20)
+		require.NoError(t, err)
+		assert.Equal(t, int64(3), lines)
+		assert.False(t, truncated)
+		assert.Equal(t, out, w.String())
+	})
+
+	t.Run("truncated at whole lines", func(t *testing.T) {
+		fakeDiffZFS(t, out, 0)
+		var w bytes.Buffer
+		lines, truncated, err := Diff(context.Background(), "tank/data@a", "tank/data@b", &w, 30)
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), lines)
+		assert.True(t, truncated)
+		assert.Equal(t, "+\t/tank/data/new\nM\t/tank/data\n", w.String())
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		fakeDiffZFS(t, "", 1)
+		_, _, err := Diff(context.Background(), "tank/data@a", "tank/data@b", &bytes.Buffer{}, 1<<20)
+		var cmdErr *CommandError
+		require.True(t, errors.As(err, &cmdErr))
+		assert.Equal(t, "zfs diff -H tank/data@a tank/data@b failed: exit status 1: Cannot stat /tank/data: unable to generate diffs", err.Error())
+	})
+}
@@ -0,0 +1,133 @@
+package zfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Kinds of failed zfs commands, matched with errors.Is. Each calls for a different fix: correcting
+// a name or creating the dataset, a zfs allow, or installing ZFS and loading its kernel module.
+var (
+	ErrNotFound       = errors.New("not found")
+	ErrPermission     = errors.New("permission denied")
+	ErrZfsUnavailable = errors.New("zfs is not available")
+)
+
+// CommandError is a failed zfs command with what it printed to stderr. Kind is the ErrNotFound,
+// ErrPermission or ErrZfsUnavailable the failure shows, or nil for any other failure.
+type CommandError struct {
+	Args []string
+	// Host is where the command ran over ssh, empty for this machine.
+	Host   string
+	Err    error
+	Stderr string
+	Kind   error
+}
+
+// NewCommandError returns the failure err of the command args, classified by its exit code and
+// stderr.
+func NewCommandError(args []string, err error, stderr string) *CommandError {
+	stderr = strings.TrimSpace(stderr)
+	return &CommandError{Args: args, Err: err, Stderr: stderr, Kind: classify(err, stderr)}
+}
+
+func (e *CommandError) Error() string {
+	msg := strings.Join(e.Args, " ")
+	if e.Host != "" {
+		msg += " on " + e.Host
+	}
+	msg = fmt.Sprintf("%s failed: %v", msg, e.Err)
+	if e.Stderr != "" {
+		msg += ": " + e.Stderr
+	}
+	return msg
+}
+
+func (e *CommandError) Unwrap() []error {
+	if e.Kind == nil {
+		return []error{e.Err}
+	}
+	return []error{e.Err, e.Kind}
+}
+
+// stderrKinds map what zfs prints to stderr to the kind of failure, checked in order. The messages
+// are those of OpenZFS 2.1 and 2.2, the ones of libzfs failing to start included.
+var stderrKinds = []struct {
+	pattern string
+	kind    error
+}{
+	{"the zfs modules are not loaded", ErrZfsUnavailable},
+	{"failed to initialize the libzfs library", ErrZfsUnavailable},
+	{"/dev/zfs", ErrZfsUnavailable},
+	{"zfs: command not found", ErrZfsUnavailable},
+	{"zfs: not found", ErrZfsUnavailable},
+	{"permission denied", ErrPermission},
+	{"must be run as root", ErrPermission},
+	{"insufficient privileges", ErrPermission},
+	{"operation not permitted", ErrPermission},
+	{"dataset does not exist", ErrNotFound},
+	{"no such pool", ErrNotFound},
+	{"does not exist", ErrNotFound},
+}
+
+// classify returns the kind of failure of a zfs command that exited with err after printing stderr.
+func classify(err error, stderr string) error {
+	var exitErr *exec.ExitError
+	switch {
+	case errors.Is(err, exec.ErrNotFound):
+		return ErrZfsUnavailable
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 127:
+		// The shell of an ssh host found no zfs to run.
+		return ErrZfsUnavailable
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 2:
+		// Usage errors say nothing about the dataset.
+		return nil
+	}
+	lower := strings.ToLower(stderr)
+	for _, k := range stderrKinds {
+		if strings.Contains(lower, k.pattern) {
+			return k.kind
+		}
+	}
+	return nil
+}
+
+// output runs zfs with args and returns what it printed to stdout, or a *CommandError.
+func output(args ...string) ([]byte, error) {
+	cmd := exec.Command("zfs", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, NewCommandError(append([]string{"zfs"}, args...), err, stderr.String())
+	}
+	return out, nil
+}
+
+// Explain adds what to do about err to it when it is a permission or availability failure of a
+// zfs command on dataset: the zfs allow that grants required to user, or getting zfs to run.
+func Explain(err error, user, dataset string, required []string) error {
+	switch {
+	case errors.Is(err, ErrPermission):
+		return fmt.Errorf("%w\nAsk an administrator to run: zfs allow -u %s %s %s, or run as root",
+			err, user, strings.Join(required, ","), dataset)
+	case errors.Is(err, ErrZfsUnavailable):
+		return fmt.Errorf("%w\nInstall ZFS and load its kernel module (modprobe zfs), then run again", err)
+	}
+	return err
+}
+
+// ExplainLocal is Explain for the current user.
+func ExplainLocal(err error, dataset string, required []string) error {
+	if !errors.Is(err, ErrPermission) && !errors.Is(err, ErrZfsUnavailable) {
+		return err
+	}
+	name := "<user>"
+	if p, perr := CurrentPrincipal(); perr == nil {
+		name = p.User
+	}
+	return Explain(err, name, dataset, required)
+}
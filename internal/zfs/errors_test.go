@@ -0,0 +1,142 @@
+package zfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeFailingZFS puts a zfs first in PATH that prints stderr and exits with code.
+func fakeFailingZFS(t *testing.T, stderr string, code int) {
+	t.Helper()
+	bin := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "stderr"), []byte(stderr), 0o644))
+	script := fmt.Sprintf("#!/bin/sh\ncat %q >&2\nexit %d\n", filepath.Join(bin, "stderr"), code)
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "zfs"), []byte(script), 0o755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestCheckDatasetExistsKinds(t *testing.T) {
+	tests := []struct {
+		name    string
+		stderr  string
+		code    int
+		kind    error
+		wantErr string
+	}{
+		{
+			name:    "missing dataset",
+			stderr:  "cannot open 'tank/data': dataset does not exist\n",
+			code:    1,
+			kind:    ErrNotFound,
+			wantErr: "ZFS dataset tank/data not found: zfs list -H -o name tank/data failed: exit status 1: cannot open 'tank/data': dataset does not exist",
+		},
+		{
+			name:   "missing pool",
+			stderr: "cannot open 'tank': no such pool\n",
+			code:   1,
+			kind:   ErrNotFound,
+		},
+		{
+			name:    "permission denied",
+			stderr:  "cannot open 'tank/data': permission denied\n",
+			code:    1,
+			kind:    ErrPermission,
+			wantErr: "no permission to access ZFS dataset tank/data",
+		},
+		{
+			name:   "no access to /dev/zfs (2.1)",
+			stderr: "Permission denied the ZFS utilities must be run as root.\n",
+			code:   1,
+			kind:   ErrPermission,
+		},
+		{
+			name:    "modules not loaded (2.1)",
+			stderr:  "The ZFS modules are not loaded.\nTry running '/sbin/modprobe zfs' as root to load them.\n",
+			code:    1,
+			kind:    ErrZfsUnavailable,
+			wantErr: "cannot check ZFS dataset tank/data, zfs is not available",
+		},
+		{
+			name:   "libzfs cannot start (2.2)",
+			stderr: "Failed to initialize the libzfs library.\n\n/dev/zfs and /proc/self/mounts are required.\nTry running 'udevadm trigger' and 'mount -t proc proc /proc' as root.\n",
+			code:   1,
+			kind:   ErrZfsUnavailable,
+		},
+		{
+			name:    "other failure",
+			stderr:  "internal error: Invalid argument\n",
+			code:    1,
+			wantErr: "failed to check ZFS dataset tank/data: zfs list -H -o name tank/data failed: exit status 1: internal error: Invalid argument",
+		},
+		{
+			name:   "usage error",
+			stderr: "invalid option 'q'\nusage:\n\tlist [-Hp] [-r|-d max] ... does not exist\n",
+			code:   2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeFailingZFS(t, tt.stderr, tt.code)
+			err := CheckDatasetExists("tank", "data")
+			require.Error(t, err)
+			for _, kind := range []error{ErrNotFound, ErrPermission, ErrZfsUnavailable} {
+				assert.Equal(t, kind == tt.kind, errors.Is(err, kind), "errors.Is(%v)", kind)
+			}
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestZfsMissing(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	err := CheckPoolExists("tank")
+	assert.ErrorIs(t, err, ErrZfsUnavailable)
+	assert.ErrorIs(t, err, exec.ErrNotFound, "the exec error stays in the chain")
+
+	_, err = DatasetExists("tank/data")
+	assert.ErrorIs(t, err, ErrZfsUnavailable, "only a missing dataset counts as absent")
+}
+
+func TestExistsNotFound(t *testing.T) {
+	fakeFailingZFS(t, "cannot open 'tank/data@snap': dataset does not exist\n", 1)
+	ok, err := SnapshotExists("tank/data@snap")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	fakeFailingZFS(t, "cannot open 'tank/data@snap': permission denied\n", 1)
+	_, err = SnapshotExists("tank/data@snap")
+	assert.ErrorIs(t, err, ErrPermission)
+}
+
+func TestClassifyExitCodes(t *testing.T) {
+	notFound := exec.Command("sh", "-c", "exit 127").Run()
+	assert.Equal(t, ErrZfsUnavailable, classify(notFound, "bash: line 1: zfs: command not found"))
+	assert.Equal(t, ErrZfsUnavailable, classify(notFound, ""), "a shell without zfs exits with 127")
+	assert.Equal(t, ErrZfsUnavailable, classify(exec.Command("sh", "-c", "exit 1").Run(), "sh: 1: zfs: not found"))
+}
+
+func TestExplain(t *testing.T) {
+	err := NewCommandError([]string{"zfs", "list", "tank/restored"}, errors.New("exit status 1"), "cannot open 'tank/restored': permission denied\n")
+	err.Host = "zrb@nas"
+	assert.Equal(t, "zfs list tank/restored on zrb@nas failed: exit status 1: cannot open 'tank/restored': permission denied", err.Error())
+
+	explained := Explain(err, "zrb", "tank/restored", RestorePermissions)
+	assert.ErrorIs(t, explained, ErrPermission)
+	assert.Contains(t, explained.Error(), "Ask an administrator to run: zfs allow -u zrb receive,create,mount tank/restored")
+
+	unavailable := Explain(&CommandError{Args: []string{"zfs"}, Err: exec.ErrNotFound, Kind: ErrZfsUnavailable}, "zrb", "tank", nil)
+	assert.Contains(t, unavailable.Error(), "Install ZFS")
+
+	other := errors.New("exit status 1")
+	assert.Same(t, other, Explain(other, "zrb", "tank", nil))
+	assert.Same(t, other, ExplainLocal(other, "tank", nil))
+}
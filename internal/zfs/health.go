@@ -0,0 +1,120 @@
+package zfs
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// DatasetHealth holds the dataset properties the pre-backup health check looks at.
+type DatasetHealth struct {
+	Type       string
+	Mounted    string
+	CanMount   string
+	Mountpoint string
+	Used       int64
+}
+
+// PoolHealth is the state reported by `zpool status -x`; Errors is its errors line, if any.
+type PoolHealth struct {
+	Healthy bool
+	State   string
+	Errors  string
+}
+
+// parseDatasetHealth parses `zfs get -Hp -o property,value type,mounted,canmount,mountpoint,used` output.
+func parseDatasetHealth(output string) (DatasetHealth, error) {
+	var h DatasetHealth
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		property, value, ok := strings.Cut(line, "\t")
+		if !ok {
+			continue
+		}
+		switch property {
+		case "type":
+			h.Type = value
+		case "mounted":
+			h.Mounted = value
+		case "canmount":
+			h.CanMount = value
+		case "mountpoint":
+			h.Mountpoint = value
+		case "used":
+			used, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return h, fmt.Errorf("invalid used value %q: %w", value, err)
+			}
+			h.Used = used
+		}
+	}
+	if h.Type == "" {
+		return h, fmt.Errorf("type not found in zfs get output")
+	}
+	return h, nil
+}
+
+// parsePoolStatus parses `zpool status -x <pool>` output, which is a single "is healthy" line for a healthy pool
+// and the full status otherwise.
+func parsePoolStatus(output string) PoolHealth {
+	if strings.Contains(output, "is healthy") || strings.Contains(output, "all pools are healthy") {
+		return PoolHealth{Healthy: true, State: "ONLINE"}
+	}
+
+	var h PoolHealth
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if state, ok := strings.CutPrefix(line, "state:"); ok {
+			h.State = strings.TrimSpace(state)
+		} else if errs, ok := strings.CutPrefix(line, "errors:"); ok {
+			h.Errors = strings.TrimSpace(errs)
+		}
+	}
+	h.Healthy = h.State == "ONLINE" && (h.Errors == "" || h.Errors == "No known data errors")
+	return h
+}
+
+// healthViolations lists why a dataset should not be backed up; minUsed of 0 disables the size check.
+func healthViolations(dataset string, d DatasetHealth, pool string, p PoolHealth, minUsed int64) []string {
+	var violations []string
+	if !p.Healthy {
+		v := fmt.Sprintf("pool %s is %s", pool, p.State)
+		if p.Errors != "" {
+			v += " (errors: " + p.Errors + ")"
+		}
+		violations = append(violations, v)
+	}
+	if d.Type == "filesystem" && d.CanMount != "off" && d.Mountpoint != "none" && d.Mounted != "yes" {
+		violations = append(violations, fmt.Sprintf("dataset %s is not mounted (canmount=%s, mountpoint=%s)", dataset, d.CanMount, d.Mountpoint))
+	}
+	if minUsed > 0 && d.Used < minUsed {
+		violations = append(violations, fmt.Sprintf("dataset %s uses %d bytes, below the configured minimum of %d", dataset, d.Used, minUsed))
+	}
+	return violations
+}
+
+// CheckHealth refuses datasets that failed to mount, live on a degraded or faulted pool, or are smaller
+// than minUsed bytes, any of which would ship an empty or damaged filesystem as a valid backup.
+func CheckHealth(pool, dataset string, minUsed int64) error {
+	name := DatasetPath(pool, dataset)
+
+	output, err := exec.Command("zfs", "get", "-Hp", "-o", "property,value", "type,mounted,canmount,mountpoint,used", name).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to read properties of %s: %w: %s", name, err, strings.TrimSpace(string(output)))
+	}
+	d, err := parseDatasetHealth(string(output))
+	if err != nil {
+		return fmt.Errorf("failed to parse properties of %s: %w", name, err)
+	}
+
+	output, err = exec.Command("zpool", "status", "-x", pool).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to read status of pool %s: %w: %s", pool, err, strings.TrimSpace(string(output)))
+	}
+
+	violations := healthViolations(name, d, pool, parsePoolStatus(string(output)), minUsed)
+	if len(violations) == 0 {
+		return nil
+	}
+	return fmt.Errorf("health check failed: %s\nFix the dataset or pass --ignore-health-check to back it up anyway", strings.Join(violations, "; "))
+}
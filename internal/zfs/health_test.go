@@ -0,0 +1,90 @@
+package zfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const degradedStatus = `  pool: tank
+ state: DEGRADED
+status: One or more devices could not be used because the label is missing or
+	invalid.  Sufficient replicas exist for the pool to continue
+	functioning in a degraded state.
+action: Replace the device using 'zpool replace'.
+   see: https://openzfs.github.io/openzfs-docs/msg/ZFS-8000-4J
+  scan: scrub repaired 0B in 00:01:02 with 0 errors on Sun Jan 11 00:25:03 2026
+config:
+
+	NAME        STATE     READ WRITE CKSUM
+	tank        DEGRADED     0     0     0
+	  mirror-0  DEGRADED     0     0     0
+	    sda     ONLINE       0     0     0
+	    sdb     UNAVAIL      0     0     0
+
+errors: No known data errors
+`
+
+const corruptedStatus = `  pool: tank
+ state: ONLINE
+status: One or more devices has experienced an error resulting in data
+	corruption.  Applications may be affected.
+config:
+
+	NAME        STATE     READ WRITE CKSUM
+	tank        ONLINE       0     0     0
+	  sda       ONLINE       0     0     4
+
+errors: 2 data errors, use '-v' for a list
+`
+
+func TestParseDatasetHealth(t *testing.T) {
+	h, err := parseDatasetHealth("type\tfilesystem\nmounted\tno\ncanmount\ton\nmountpoint\t/mnt/tank/data\nused\t98304\n")
+	require.NoError(t, err)
+	assert.Equal(t, DatasetHealth{Type: "filesystem", Mounted: "no", CanMount: "on", Mountpoint: "/mnt/tank/data", Used: 98304}, h)
+
+	_, err = parseDatasetHealth("used\tlots\n")
+	assert.Error(t, err)
+}
+
+func TestParsePoolStatus(t *testing.T) {
+	assert.Equal(t, PoolHealth{Healthy: true, State: "ONLINE"}, parsePoolStatus("pool 'tank' is healthy\n"))
+	assert.Equal(t, PoolHealth{State: "DEGRADED", Errors: "No known data errors"}, parsePoolStatus(degradedStatus))
+
+	h := parsePoolStatus(corruptedStatus)
+	assert.False(t, h.Healthy)
+	assert.Equal(t, "2 data errors, use '-v' for a list", h.Errors)
+}
+
+func TestHealthViolations(t *testing.T) {
+	healthy := PoolHealth{Healthy: true, State: "ONLINE"}
+	mounted := DatasetHealth{Type: "filesystem", Mounted: "yes", CanMount: "on", Mountpoint: "/mnt/data", Used: 1 << 30}
+
+	assert.Empty(t, healthViolations("tank/data", mounted, "tank", healthy, 1<<20))
+
+	unmounted := mounted
+	unmounted.Mounted = "no"
+	v := healthViolations("tank/data", unmounted, "tank", healthy, 0)
+	require.Len(t, v, 1)
+	assert.Contains(t, v[0], "not mounted")
+
+	// Datasets that are not meant to be mounted pass.
+	for _, d := range []DatasetHealth{
+		{Type: "filesystem", Mounted: "no", CanMount: "off", Mountpoint: "/mnt/data"},
+		{Type: "filesystem", Mounted: "no", CanMount: "on", Mountpoint: "none"},
+		{Type: "volume", Mounted: "-", CanMount: "-", Mountpoint: "-"},
+	} {
+		assert.Empty(t, healthViolations("tank/data", d, "tank", healthy, 0))
+	}
+
+	small := mounted
+	small.Used = 98304
+	v = healthViolations("tank/data", small, "tank", healthy, 1<<20)
+	require.Len(t, v, 1)
+	assert.Contains(t, v[0], "below the configured minimum")
+
+	v = healthViolations("tank/data", mounted, "tank", parsePoolStatus(degradedStatus), 0)
+	require.Len(t, v, 1)
+	assert.Equal(t, "pool tank is DEGRADED (errors: No known data errors)", v[0])
+}
@@ -0,0 +1,170 @@
+package zfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+	"zrb/internal/events"
+)
+
+// HoldRetry is how Hold and Release retry a failing zfs command, e.g. while a scrub is starting.
+type HoldRetry struct {
+	// Attempts is the number of tries, at least one.
+	Attempts int
+	// Backoff is the wait before the first retry, doubled for each further one.
+	Backoff time.Duration
+	// Timeout bounds each try.
+	Timeout time.Duration
+}
+
+// DefaultHoldRetry rides out a pool that is busy for half a minute.
+var DefaultHoldRetry = HoldRetry{Attempts: 4, Backoff: 5 * time.Second, Timeout: 30 * time.Second}
+
+// UserHold is a user hold on a snapshot.
+type UserHold struct {
+	Tag      string `yaml:"tag" json:"tag"`
+	Snapshot string `yaml:"snapshot" json:"snapshot"`
+}
+
+func (h UserHold) String() string {
+	return h.Tag + " " + h.Snapshot
+}
+
+// Holds carries the retry policy of a run and collects the holds it failed to release, which
+// otherwise accumulate unnoticed and keep snapshots from being destroyed.
+type Holds struct {
+	retry HoldRetry
+	mu    sync.Mutex
+	stale []UserHold
+}
+
+func NewHolds(retry HoldRetry) *Holds {
+	return &Holds{retry: retry}
+}
+
+// Stale returns the holds that could not be released, to be released by hand with zfs release.
+func (h *Holds) Stale() []UserHold {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]UserHold(nil), h.stale...)
+}
+
+type holdsKey struct{}
+
+// NewHoldsContext returns a context whose holds and releases use h.
+func NewHoldsContext(ctx context.Context, h *Holds) context.Context {
+	return context.WithValue(ctx, holdsKey{}, h)
+}
+
+func holdsFromContext(ctx context.Context) *Holds {
+	if h, ok := ctx.Value(holdsKey{}).(*Holds); ok {
+		return h
+	}
+	return NewHolds(DefaultHoldRetry)
+}
+
+// runZFS runs a zfs command and returns a *CommandError with its output; tests replace it.
+var runZFS = func(ctx context.Context, args ...string) error {
+	out, err := exec.CommandContext(ctx, "zfs", args...).CombinedOutput()
+	if err != nil {
+		return NewCommandError(append([]string{"zfs"}, args...), err, string(out))
+	}
+	return nil
+}
+
+// errDone marks a failure that retrying cannot fix because the goal is already reached.
+var errDone = errors.New("already done")
+
+// retryZFS runs a zfs command under the retry policy of ctx. done recognizes errors that mean
+// the command has nothing left to do.
+func retryZFS(ctx context.Context, done func(error) bool, args ...string) error {
+	retry := holdsFromContext(ctx).retry
+	attempts := max(retry.Attempts, 1)
+	backoff := retry.Backoff
+
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, retry.Timeout)
+		err := runZFS(attemptCtx, args...)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if done(err) {
+			return errDone
+		}
+		// A missing snapshot does not come back by waiting.
+		if attempt == attempts || ctx.Err() != nil || strings.Contains(err.Error(), "does not exist") {
+			return fmt.Errorf("zfs %s failed after %d attempt(s): %w", args[0], attempt, err)
+		}
+
+		slog.Warn("zfs command failed, retrying", "command", "zfs "+strings.Join(args, " "),
+			"attempt", attempt, "retryIn", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("zfs %s interrupted: %w", args[0], ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// Hold places a user hold on snapshot, retrying while the pool is busy. A hold with the same tag
+// already in place counts as success.
+func Hold(ctx context.Context, tag, snapshot string) error {
+	err := retryZFS(ctx, func(err error) bool {
+		return strings.Contains(err.Error(), "tag already exists")
+	}, "hold", tag, snapshot)
+	if errors.Is(err, errDone) {
+		slog.Debug("Snapshot already held", "tag", tag, "snapshot", snapshot)
+		return nil
+	}
+	return err
+}
+
+// Release removes a user hold, retrying while the pool is busy; a hold that is already gone counts
+// as released, as does one on a snapshot that no longer exists. A hold that cannot be released is
+// recorded as stale and reported as an audit event.
+func Release(ctx context.Context, tag, snapshot string) error {
+	err := retryZFS(ctx, func(err error) bool {
+		return strings.Contains(err.Error(), "no such tag")
+	}, "release", tag, snapshot)
+	if errors.Is(err, errDone) {
+		slog.Debug("Snapshot hold already released", "tag", tag, "snapshot", snapshot)
+		return nil
+	}
+	if errors.Is(err, ErrNotFound) {
+		// A destroyed snapshot took the hold with it; a renamed one keeps it under its new name.
+		slog.Warn("Snapshot of the hold no longer exists; if it was renamed, release the hold under its new name",
+			"tag", tag, "snapshot", snapshot, "error", err)
+		return nil
+	}
+	if err != nil {
+		h := holdsFromContext(ctx)
+		h.mu.Lock()
+		h.stale = append(h.stale, UserHold{Tag: tag, Snapshot: snapshot})
+		h.mu.Unlock()
+		events.Emit(ctx, events.Event{Stage: events.HoldReleaseFailed, Snapshot: snapshot, Object: tag, Error: err.Error()})
+	}
+	return err
+}
+
+// holdForSend places a temporary hold on the snapshot for the duration of a send.
+func holdForSend(ctx context.Context, snapshot string) (func(), error) {
+	holdTag := fmt.Sprintf("zrb:%d", time.Now().Unix())
+	if err := Hold(ctx, holdTag, snapshot); err != nil {
+		slog.Error("Failed to hold snapshot", "snapshot", snapshot, "error", err)
+		return nil, fmt.Errorf("failed to hold snapshot: %w", err)
+	}
+
+	return func() {
+		// Release even when the send was cancelled, keeping the retry policy of ctx.
+		if err := Release(context.WithoutCancel(ctx), holdTag, snapshot); err != nil {
+			slog.Error("Failed to release snapshot hold", "holdTag", holdTag, "snapshot", snapshot, "error", err)
+		}
+	}, nil
+}
@@ -0,0 +1,128 @@
+package zfs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRunner replaces runZFS with one that fails the first failures calls with failure.
+func fakeRunner(t *testing.T, failures int, failure string) *[]string {
+	t.Helper()
+	var calls []string
+	old := runZFS
+	runZFS = func(_ context.Context, args ...string) error {
+		calls = append(calls, strings.Join(args, " "))
+		if len(calls) <= failures {
+			return errors.New(failure)
+		}
+		return nil
+	}
+	t.Cleanup(func() { runZFS = old })
+	return &calls
+}
+
+func testContext(attempts int) (context.Context, *Holds) {
+	holds := NewHolds(HoldRetry{Attempts: attempts, Backoff: time.Millisecond, Timeout: time.Second})
+	return NewHoldsContext(context.Background(), holds), holds
+}
+
+func TestHoldRetries(t *testing.T) {
+	calls := fakeRunner(t, 2, "exit status 1: pool I/O is currently suspended")
+	ctx, _ := testContext(4)
+
+	require.NoError(t, Hold(ctx, "zrb:last", "tank/data@zrb_level0_a"))
+	assert.Equal(t, []string{
+		"hold zrb:last tank/data@zrb_level0_a",
+		"hold zrb:last tank/data@zrb_level0_a",
+		"hold zrb:last tank/data@zrb_level0_a",
+	}, *calls)
+}
+
+func TestHoldGivesUp(t *testing.T) {
+	calls := fakeRunner(t, 10, "exit status 1: pool is busy")
+	ctx, holds := testContext(3)
+
+	err := Hold(ctx, "zrb:last", "tank/data@zrb_level0_a")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "zfs hold failed after 3 attempt(s): exit status 1: pool is busy")
+	assert.Len(t, *calls, 3)
+	assert.Empty(t, holds.Stale(), "a failed hold leaves nothing to release")
+}
+
+func TestHoldAlreadyHeld(t *testing.T) {
+	calls := fakeRunner(t, 1, "exit status 1: cannot hold snapshot 'tank/data@a': tag already exists on this dataset")
+	ctx, _ := testContext(4)
+
+	require.NoError(t, Hold(ctx, "zrb:last", "tank/data@a"))
+	assert.Len(t, *calls, 1)
+}
+
+func TestHoldMissingSnapshot(t *testing.T) {
+	calls := fakeRunner(t, 10, "exit status 1: cannot open 'tank/data@a': dataset does not exist")
+	ctx, _ := testContext(4)
+
+	require.Error(t, Hold(ctx, "zrb:restore", "tank/data@a"))
+	assert.Len(t, *calls, 1, "waiting does not bring a snapshot back")
+}
+
+func TestReleaseRetries(t *testing.T) {
+	calls := fakeRunner(t, 3, "exit status 1: pool is busy")
+	ctx, holds := testContext(4)
+
+	require.NoError(t, Release(ctx, "zrb:last", "tank/data@a"))
+	assert.Len(t, *calls, 4)
+	assert.Empty(t, holds.Stale())
+}
+
+func TestReleaseRecordsStaleHold(t *testing.T) {
+	fakeRunner(t, 10, "exit status 1: pool is busy")
+	ctx, holds := testContext(2)
+
+	require.Error(t, Release(ctx, "zrb:last", "tank/data@a"))
+	require.Error(t, Release(ctx, "zrb:1705276800", "tank/data@b"))
+	assert.Equal(t, []UserHold{
+		{Tag: "zrb:last", Snapshot: "tank/data@a"},
+		{Tag: "zrb:1705276800", Snapshot: "tank/data@b"},
+	}, holds.Stale())
+}
+
+func TestReleaseAlreadyReleased(t *testing.T) {
+	fakeRunner(t, 1, "exit status 1: cannot release hold from snapshot 'tank/data@a': no such tag on this dataset")
+	ctx, holds := testContext(4)
+
+	require.NoError(t, Release(ctx, "zrb:last", "tank/data@a"))
+	assert.Empty(t, holds.Stale())
+}
+
+func TestReleaseMissingSnapshot(t *testing.T) {
+	var calls int
+	old := runZFS
+	runZFS = func(_ context.Context, args ...string) error {
+		calls++
+		return NewCommandError(append([]string{"zfs"}, args...), errors.New("exit status 1"),
+			"cannot open 'tank/data@a': dataset does not exist\n")
+	}
+	t.Cleanup(func() { runZFS = old })
+	ctx, holds := testContext(4)
+
+	require.NoError(t, Release(ctx, "zrb:last", "tank/data@a"))
+	assert.Equal(t, 1, calls, "waiting does not bring a snapshot back")
+	assert.Empty(t, holds.Stale(), "a destroyed snapshot leaves no hold behind")
+}
+
+func TestRetryStopsWhenCancelled(t *testing.T) {
+	calls := fakeRunner(t, 10, "exit status 1: pool is busy")
+	holds := NewHolds(HoldRetry{Attempts: 4, Backoff: time.Hour, Timeout: time.Second})
+	ctx, cancel := context.WithCancel(NewHoldsContext(context.Background(), holds))
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	err := Hold(ctx, "zrb:last", "tank/data@a")
+	require.ErrorIs(t, err, context.Canceled)
+	assert.Len(t, *calls, 1)
+}
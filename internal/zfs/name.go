@@ -0,0 +1,65 @@
+package zfs
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SnapshotName is a snapshot name split into the pool, the dataset path below it, which may be
+// nested (a/b) or empty for the root dataset of the pool, and the part after the '@'.
+type SnapshotName struct {
+	Pool    string
+	Dataset string
+	Snap    string
+}
+
+// ParseSnapshotName splits pool/dataset@snap. Names are passed to zfs as single arguments, so
+// anything but '/' and '@' is left for zfs to judge, spaces included.
+func ParseSnapshotName(name string) (SnapshotName, error) {
+	datasetPath, snap, ok := strings.Cut(name, "@")
+	switch {
+	case !ok:
+		return SnapshotName{}, fmt.Errorf("%q is not a snapshot name: no '@'", name)
+	case snap == "":
+		return SnapshotName{}, fmt.Errorf("%q is not a snapshot name: nothing after '@'", name)
+	case strings.ContainsAny(snap, "@/"):
+		return SnapshotName{}, fmt.Errorf("%q is not a snapshot name: '@' or '/' after the '@'", name)
+	}
+	pool, dataset, _ := strings.Cut(datasetPath, "/")
+	if pool == "" || strings.HasSuffix(datasetPath, "/") || strings.Contains(datasetPath, "//") {
+		return SnapshotName{}, fmt.Errorf("%q is not a snapshot name: invalid dataset %q", name, datasetPath)
+	}
+	return SnapshotName{Pool: pool, Dataset: dataset, Snap: snap}, nil
+}
+
+// DatasetPath returns the full name of the snapshotted dataset, pool/dataset.
+func (n SnapshotName) DatasetPath() string {
+	return DatasetPath(n.Pool, n.Dataset)
+}
+
+// String returns pool/dataset@snap.
+func (n SnapshotName) String() string {
+	return n.DatasetPath() + "@" + n.Snap
+}
+
+// On returns the snapshot of the same name on dataset, a full pool/dataset name.
+func (n SnapshotName) On(dataset string) SnapshotName {
+	pool, rest, _ := strings.Cut(dataset, "/")
+	return SnapshotName{Pool: pool, Dataset: rest, Snap: n.Snap}
+}
+
+// DatasetPath joins a pool and the dataset path below it; an empty dataset is the pool's root dataset.
+func DatasetPath(pool, dataset string) string {
+	if dataset == "" {
+		return pool
+	}
+	return pool + "/" + dataset
+}
+
+// TimestampedSnapshot returns the snapshot CreateSnapshot takes at t: pool/dataset@prefix_date.
+func TimestampedSnapshot(pool, dataset, prefix string, t time.Time) SnapshotName {
+	// UTC keeps names ordered across DST changes and hosts in different time zones.
+	date := t.UTC().Format("2006-01-02_15-04")
+	return SnapshotName{Pool: pool, Dataset: dataset, Snap: prefix + "_" + date}
+}
@@ -0,0 +1,59 @@
+package zfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSnapshotName(t *testing.T) {
+	valid := map[string]SnapshotName{
+		"tank/data@zrb_level0_2024-01-15_00-00":    {Pool: "tank", Dataset: "data", Snap: "zrb_level0_2024-01-15_00-00"},
+		"tank/a/b/c@snap":                          {Pool: "tank", Dataset: "a/b/c", Snap: "snap"},
+		"tank@root":                                {Pool: "tank", Snap: "root"},
+		"tank/my data/photos 2024@weekly snapshot": {Pool: "tank", Dataset: "my data/photos 2024", Snap: "weekly snapshot"},
+		"tank/data.v2:x-y@a:b.c-d":                 {Pool: "tank", Dataset: "data.v2:x-y", Snap: "a:b.c-d"},
+	}
+	for input, want := range valid {
+		t.Run(input, func(t *testing.T) {
+			got, err := ParseSnapshotName(input)
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+			assert.Equal(t, input, got.String(), "parsing and formatting round-trips")
+		})
+	}
+
+	invalid := map[string]string{
+		"":                "no '@'",
+		"tank/data":       "no '@'",
+		"tank/data@":      "nothing after '@'",
+		"tank/data@a@b":   "'@' or '/' after the '@'",
+		"tank/data@a/b":   "'@' or '/' after the '@'",
+		"@snap":           "invalid dataset",
+		"/tank/data@snap": "invalid dataset",
+		"tank/@snap":      "invalid dataset",
+		"tank//data@snap": "invalid dataset",
+		"tank/data/@snap": "invalid dataset",
+	}
+	for input, want := range invalid {
+		t.Run("invalid "+input, func(t *testing.T) {
+			_, err := ParseSnapshotName(input)
+			assert.ErrorContains(t, err, want)
+		})
+	}
+}
+
+func TestSnapshotNameOn(t *testing.T) {
+	name := SnapshotName{Pool: "tank", Dataset: "data", Snap: "zrb_level1"}
+	assert.Equal(t, "backup/restored/nested@zrb_level1", name.On("backup/restored/nested").String())
+	assert.Equal(t, "backup@zrb_level1", name.On("backup").String())
+	assert.Equal(t, "tank/data", name.DatasetPath())
+}
+
+func TestTimestampedSnapshot(t *testing.T) {
+	at := time.Date(2024, 1, 15, 9, 30, 0, 0, time.FixedZone("UTC+8", 8*3600))
+	name := TimestampedSnapshot("tank", "a/b", "zrb_level0", at)
+	assert.Equal(t, "tank/a/b@zrb_level0_2024-01-15_01-30", name.String(), "the date is in UTC")
+}
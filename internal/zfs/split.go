@@ -0,0 +1,85 @@
+package zfs
+
+import (
+	"fmt"
+	"io"
+)
+
+// PartSuffix returns the suffix split gives the part at i, counting from 0: aaaaaa, aaaaab and so on.
+func PartSuffix(i int) string {
+	suffix := make([]byte, PartSuffixLength)
+	for pos := PartSuffixLength - 1; pos >= 0; pos-- {
+		suffix[pos] = byte('a' + i%26)
+		i /= 26
+	}
+	return string(suffix)
+}
+
+// PartWriter cuts a stream into parts of a fixed size, as split does, without an external process
+// or an unencrypted file: each part goes to the writer open returns for its suffix, which is closed
+// once the part is full. An empty stream opens no part.
+type PartWriter struct {
+	size  int64
+	open  func(suffix string) (io.WriteCloser, error)
+	part  io.WriteCloser
+	n     int64
+	count int
+}
+
+// NewPartWriter returns a PartWriter cutting parts of size bytes, PartSize outside tests.
+func NewPartWriter(size int64, open func(suffix string) (io.WriteCloser, error)) *PartWriter {
+	return &PartWriter{size: size, open: open}
+}
+
+func (w *PartWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if w.part == nil {
+			if w.count >= pow26(PartSuffixLength) {
+				return written, fmt.Errorf("stream needs more than %d parts", w.count)
+			}
+			part, err := w.open(PartSuffix(w.count))
+			if err != nil {
+				return written, err
+			}
+			w.part, w.n = part, 0
+			w.count++
+		}
+		chunk := p[:min(int64(len(p)), w.size-w.n)]
+		n, err := w.part.Write(chunk)
+		written += n
+		w.n += int64(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+		if w.n == w.size {
+			if err := w.closePart(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close closes the last part, if the stream did not end at a part boundary.
+func (w *PartWriter) Close() error {
+	if w.part == nil {
+		return nil
+	}
+	return w.closePart()
+}
+
+func (w *PartWriter) closePart() error {
+	part := w.part
+	w.part = nil
+	return part.Close()
+}
+
+func pow26(n int) int {
+	p := 1
+	for range n {
+		p *= 26
+	}
+	return p
+}
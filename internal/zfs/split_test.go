@@ -0,0 +1,61 @@
+package zfs
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartSuffix(t *testing.T) {
+	assert.Equal(t, "aaaaaa", PartSuffix(0))
+	assert.Equal(t, "aaaaab", PartSuffix(1))
+	assert.Equal(t, "aaaaaz", PartSuffix(25))
+	assert.Equal(t, "aaaaba", PartSuffix(26))
+	assert.Equal(t, "zzzzzz", PartSuffix(pow26(PartSuffixLength)-1))
+}
+
+// bufferPart is a part kept in memory that records being closed.
+type bufferPart struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *bufferPart) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestPartWriter(t *testing.T) {
+	parts := map[string]*bufferPart{}
+	var order []string
+	w := NewPartWriter(4, func(suffix string) (io.WriteCloser, error) {
+		order = append(order, suffix)
+		parts[suffix] = &bufferPart{}
+		return parts[suffix], nil
+	})
+
+	n, err := w.Write([]byte("abcdefghij"))
+	require.NoError(t, err)
+	assert.Equal(t, 10, n)
+	_, err = w.Write([]byte("kl"))
+	require.NoError(t, err)
+	assert.True(t, parts["aaaaab"].closed, "a full part is closed without waiting for the next write")
+	require.NoError(t, w.Close())
+
+	assert.Equal(t, []string{"aaaaaa", "aaaaab", "aaaaac"}, order, "a stream ending at a part boundary opens no empty part")
+	assert.Equal(t, "abcd", parts["aaaaaa"].String())
+	assert.Equal(t, "efgh", parts["aaaaab"].String())
+	assert.Equal(t, "ijkl", parts["aaaaac"].String())
+	for suffix, part := range parts {
+		assert.True(t, part.closed, suffix)
+	}
+
+	empty := NewPartWriter(4, func(string) (io.WriteCloser, error) {
+		t.Error("an empty stream has no parts")
+		return nil, nil
+	})
+	require.NoError(t, empty.Close())
+}
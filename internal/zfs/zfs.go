@@ -1,7 +1,9 @@
 package zfs
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -9,15 +11,89 @@ import (
 	"os/exec"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"zrb/internal/fsync"
+	"zrb/internal/sdnotify"
+	"zrb/internal/throughput"
+	"zrb/internal/tracing"
+	"zrb/internal/util"
 
 	"github.com/zeebo/blake3"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-// SendAndSplit executes zfs send and splits the output into parts while computing BLAKE3 hash
-func SendAndSplit(ctx context.Context, targetSnapshot, parentSnapshot, exportDir string) (string, error) {
+const (
+	// PartSize is the default size of each split part, 3 GiB.
+	PartSize = 3 << 30
+	// MinPartSize and MaxPartSize bound the configurable part size.
+	MinPartSize = 64 << 20
+	MaxPartSize = 64 << 30
+	// PartSuffixLength is the number of letters split uses for part suffixes.
+	PartSuffixLength = 6
+)
+
+// StreamLimitError is returned by SendAndSplit and Send when zfs send produced more than the
+// limit they were given, e.g. because a runaway file grew the snapshot far beyond its estimate.
+type StreamLimitError struct {
+	Limit int64
+	// Produced is how many bytes zfs send had produced when it was stopped.
+	Produced int64
+}
+
+func (e *StreamLimitError) Error() string {
+	return fmt.Sprintf("zfs send produced more than the limit of %d bytes and was stopped after %d bytes", e.Limit, e.Produced)
+}
+
+type countingWriter struct {
+	n int64
+	// limit, when above 0, fails the write that goes past it with a *StreamLimitError in err,
+	// after calling stop.
+	limit int64
+	stop  func()
+	err   error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	if c.limit > 0 && c.n > c.limit {
+		if c.err == nil {
+			c.err = &StreamLimitError{Limit: c.limit, Produced: c.n}
+			c.stop()
+		}
+		return 0, c.err
+	}
+	return len(p), nil
+}
+
+type sendMeterKey struct{}
+
+// WithSendMeter returns a context whose sends count the bytes of the stream in m.
+func WithSendMeter(ctx context.Context, m *throughput.Meter) context.Context {
+	return context.WithValue(ctx, sendMeterKey{}, m)
+}
+
+// sendMeterFrom returns the meter of ctx; a nil meter counts nothing.
+func sendMeterFrom(ctx context.Context) *throughput.Meter {
+	m, _ := ctx.Value(sendMeterKey{}).(*throughput.Meter)
+	return m
+}
+
+// SendAndSplit executes zfs send and splits the output into parts of partSize bytes while computing
+// BLAKE3 hash and stream size. When the stream grows past maxBytes, if above 0, the send is stopped and the
+// partial parts removed.
+func SendAndSplit(ctx context.Context, targetSnapshot, parentSnapshot, exportDir string, partSize, maxBytes int64) (string, int64, error) {
+	ctx, span := tracing.Start(ctx, "zfs.send_and_split",
+		attribute.String("zfs.snapshot", targetSnapshot), attribute.String("zfs.parent_snapshot", parentSnapshot))
+	hash, streamBytes, err := sendAndSplit(ctx, targetSnapshot, parentSnapshot, exportDir, partSize, maxBytes)
+	span.SetAttributes(attribute.Int64("zfs.stream_bytes", streamBytes))
+	tracing.End(span, err)
+	return hash, streamBytes, err
+}
+
+func sendAndSplit(ctx context.Context, targetSnapshot, parentSnapshot, exportDir string, partSize, maxBytes int64) (string, int64, error) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
@@ -36,50 +112,44 @@ func SendAndSplit(ctx context.Context, targetSnapshot, parentSnapshot, exportDir
 		}
 	}()
 
-	args := []string{"send", "-L"}
 	if parentSnapshot != "" {
-		args = append(args, "-i", parentSnapshot)
 		slog.Info("Running incremental send", "parentSnapshot", parentSnapshot, "snapshot", targetSnapshot)
 	} else {
 		slog.Info("Running full send", "snapshot", targetSnapshot)
 	}
-	args = append(args, targetSnapshot)
-	zfsCmd := exec.CommandContext(ctx, "zfs", args...)
-	zfsCmd.Stderr = os.Stderr
-
-	splitCmd := exec.CommandContext(ctx, "split", "-b", "3G", "-a", "6", "--additional-suffix=.tmp", "-", outputPatternTmp)
+	zfsArgs := sendArgs(targetSnapshot, parentSnapshot)
+	zfsCmd := exec.CommandContext(ctx, "zfs", zfsArgs...)
+	// Kept to tell a snapshot destroyed or renamed during the send from other failures
+	var zfsStderr bytes.Buffer
+	zfsCmd.Stderr = io.MultiWriter(os.Stderr, &zfsStderr)
+
+	// split creates the raw parts under the umask of its process, which only a shell can set.
+	splitCmd := exec.CommandContext(ctx, "sh", "-c", fmt.Sprintf(`umask %03o && exec split "$@"`, util.PartUmask), "split",
+		"-b", strconv.FormatInt(partSize, 10), "-a", strconv.Itoa(PartSuffixLength), "--additional-suffix=.tmp", "-", outputPatternTmp)
 	splitCmd.Stderr = os.Stderr
 
-	holdTag := fmt.Sprintf("zrb:%d", time.Now().Unix())
-	holdCtx, cancelHold := context.WithTimeout(ctx, 10*time.Second)
-	if err := exec.CommandContext(holdCtx, "zfs", "hold", holdTag, targetSnapshot).Run(); err != nil {
-		cancelHold()
-		slog.Error("Failed to hold snapshot", "snapshot", targetSnapshot, "error", err)
-		return "", fmt.Errorf("failed to hold snapshot: %w", err)
+	releaseHold, err := holdForSend(ctx, targetSnapshot)
+	if err != nil {
+		return "", 0, err
 	}
-	cancelHold()
-	defer func() {
-		releaseCtx, cancelRelease := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancelRelease()
-		if err := exec.CommandContext(releaseCtx, "zfs", "release", holdTag, targetSnapshot).Run(); err != nil {
-			slog.Warn("Failed to release snapshot hold", "holdTag", holdTag, "error", err)
-		}
-	}()
+	defer releaseHold()
 
 	pr, pw, err := os.Pipe()
 	if err != nil {
-		return "", fmt.Errorf("failed to create pipe: %w", err)
+		return "", 0, fmt.Errorf("failed to create pipe: %w", err)
 	}
 	zfsCmd.Stdout = pw
 
 	hasher := blake3.New()
-	splitCmd.Stdin = io.TeeReader(pr, hasher)
+	// The counter comes first so that split never sees the bytes past the limit.
+	counter := &countingWriter{limit: maxBytes, stop: cancel}
+	splitCmd.Stdin = io.TeeReader(pr, io.MultiWriter(counter, hasher, sdnotify.Writer(), sendMeterFrom(ctx).Writer(io.Discard)))
 
 	if err := splitCmd.Start(); err != nil {
 		pw.Close()
 		pr.Close()
 		slog.Error("Failed to start split command", "error", err)
-		return "", fmt.Errorf("failed to start split: %w", err)
+		return "", 0, fmt.Errorf("failed to start split: %w", err)
 	}
 
 	if err := zfsCmd.Start(); err != nil {
@@ -88,7 +158,7 @@ func SendAndSplit(ctx context.Context, targetSnapshot, parentSnapshot, exportDir
 		_ = splitCmd.Process.Kill()
 		_ = splitCmd.Wait()
 		slog.Error("Failed to start zfs command", "error", err)
-		return "", fmt.Errorf("failed to start zfs: %w", err)
+		return "", 0, fmt.Errorf("failed to start zfs: %w", err)
 	}
 
 	// Close our copy of the write end so split gets EOF when zfs exits.
@@ -102,8 +172,9 @@ func SendAndSplit(ctx context.Context, targetSnapshot, parentSnapshot, exportDir
 		defer wg.Done()
 		if err := zfsCmd.Wait(); err != nil {
 			if ctx.Err() == nil {
+				err := NewCommandError(append([]string{"zfs"}, zfsArgs...), err, zfsStderr.String())
 				slog.Error("ZFS send failed", "error", err)
-				errChan <- fmt.Errorf("zfs send failed: %w", err)
+				errChan <- err
 			}
 			cancel()
 		}
@@ -125,6 +196,10 @@ func SendAndSplit(ctx context.Context, targetSnapshot, parentSnapshot, exportDir
 	pr.Close()
 	close(errChan)
 
+	if counter.err != nil {
+		slog.Error("ZFS send stopped at the stream limit", "limitBytes", maxBytes, "producedBytes", counter.n)
+		return "", 0, counter.err
+	}
 	var errs []error
 	for err := range errChan {
 		errs = append(errs, err)
@@ -132,103 +207,386 @@ func SendAndSplit(ctx context.Context, targetSnapshot, parentSnapshot, exportDir
 
 	if len(errs) > 0 {
 		slog.Error("Pipeline failed", "errors", errs)
-		return "", fmt.Errorf("pipeline failed: %v", errs)
+		return "", 0, fmt.Errorf("pipeline failed: %w", errors.Join(errs...))
 	}
 
 	matches, err := filepath.Glob(outputPatternTmp + "*.tmp")
 	if err != nil {
 		slog.Error("Failed to glob tmp files", "error", err)
-		return "", fmt.Errorf("failed to glob tmp files: %w", err)
+		return "", 0, fmt.Errorf("failed to glob tmp files: %w", err)
 	}
+	// The parts must be on disk before the caller records the send as done in its state.
+	syncer := fsync.FromContext(ctx)
 	for _, tmpFile := range matches {
+		if err := syncer.File(tmpFile); err != nil {
+			return "", 0, err
+		}
 		finalFile := strings.TrimSuffix(tmpFile, ".tmp")
 		if err := os.Rename(tmpFile, finalFile); err != nil {
 			slog.Error("Failed to rename tmp file", "tmpFile", tmpFile, "finalFile", finalFile, "error", err)
-			return "", fmt.Errorf("failed to rename tmp file: %w", err)
+			return "", 0, fmt.Errorf("failed to rename tmp file: %w", err)
 		}
 		slog.Debug("Renamed tmp file", "tmpFile", tmpFile, "finalFile", finalFile)
 	}
+	if err := syncer.Dir(exportDir); err != nil {
+		return "", 0, err
+	}
 
 	success = true
 	blake3Hash := fmt.Sprintf("%x", hasher.Sum(nil))
-	slog.Info("ZFS send and split completed successfully", "outputPattern", outputPattern, "blake3", blake3Hash)
+	slog.Info("ZFS send and split completed successfully", "outputPattern", outputPattern, "blake3", blake3Hash, "bytes", counter.n)
 
-	return blake3Hash, nil
+	return blake3Hash, counter.n, nil
 }
 
-func ListSnapshots(pool, dataset, prefix string) ([]string, error) {
+func sendArgs(targetSnapshot, parentSnapshot string, extra ...string) []string {
+	args := append([]string{"send", "-L"}, extra...)
+	if parentSnapshot != "" {
+		args = append(args, "-i", parentSnapshot)
+	}
+	return append(args, targetSnapshot)
+}
+
+// SendCommand is the command line of the zfs send that SendAndSplit and Send run, recorded in the
+// manifest so the stream can be reproduced and its requirements on the receiving pool known.
+func SendCommand(targetSnapshot, parentSnapshot string) []string {
+	return append([]string{"zfs"}, sendArgs(targetSnapshot, parentSnapshot)...)
+}
+
+// streamFeatures maps zfs send flags to the pool feature a stream sent with them may need on the
+// receiving side.
+var streamFeatures = map[byte]string{
+	'L': "large_blocks",
+	'e': "embedded_data",
+	'w': "encryption",
+}
+
+// StreamFeatures returns the pool features a stream sent with the command line args may require
+// on the receiving pool, in the order the flags appear.
+func StreamFeatures(args []string) []string {
+	var features []string
+	seen := make(map[string]bool)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") || strings.HasPrefix(arg, "--") {
+			continue
+		}
+		for _, flag := range []byte(arg[1:]) {
+			if feature, ok := streamFeatures[flag]; ok && !seen[feature] {
+				seen[feature] = true
+				features = append(features, feature)
+			}
+		}
+		// -i and -I take the incremental source as the next argument.
+		if strings.ContainsAny(arg, "iI") {
+			i++
+		}
+	}
+	return features
+}
+
+// PoolFeature returns the state of feature@<feature> on pool: disabled, enabled or active.
+func PoolFeature(pool, feature string) (string, error) {
+	output, err := exec.Command("zpool", "get", "-H", "-o", "value", "feature@"+feature, pool).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("zpool get feature@%s %s failed: %w: %s", feature, pool, err, strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// Send streams zfs send output into w and returns the BLAKE3 hash and size of the stream. When the
+// stream grows past maxBytes, if above 0, the send is stopped before w sees the excess.
+func Send(ctx context.Context, targetSnapshot, parentSnapshot string, w io.Writer, maxBytes int64) (string, int64, error) {
+	releaseHold, err := holdForSend(ctx, targetSnapshot)
+	if err != nil {
+		return "", 0, err
+	}
+	defer releaseHold()
+
+	slog.Info("Running zfs send", "snapshot", targetSnapshot, "parentSnapshot", parentSnapshot)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	hasher := blake3.New()
+	counter := &countingWriter{limit: maxBytes, stop: cancel}
+	args := sendArgs(targetSnapshot, parentSnapshot)
+	cmd := exec.CommandContext(ctx, "zfs", args...)
+	cmd.Stdout = io.MultiWriter(counter, w, hasher, sdnotify.Writer(), sendMeterFrom(ctx).Writer(io.Discard))
+	var stderr bytes.Buffer
+	cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+	err = cmd.Run()
+	if counter.err != nil {
+		slog.Error("ZFS send stopped at the stream limit", "limitBytes", maxBytes, "producedBytes", counter.n)
+		return "", 0, counter.err
+	}
+	if err != nil {
+		return "", 0, NewCommandError(append([]string{"zfs"}, args...), err, stderr.String())
+	}
+
+	return fmt.Sprintf("%x", hasher.Sum(nil)), counter.n, nil
+}
+
+// EstimateSendSize returns the estimated stream size in bytes using a dry-run zfs send
+func EstimateSendSize(ctx context.Context, targetSnapshot, parentSnapshot string) (int64, error) {
+	output, err := exec.CommandContext(ctx, "zfs", sendArgs(targetSnapshot, parentSnapshot, "-nP")...).Output()
+	if err != nil {
+		return 0, fmt.Errorf("zfs send dry-run failed: %w", err)
+	}
+	return parseSendSize(string(output))
+}
+
+func parseSendSize(output string) (int64, error) {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "size" {
+			size, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid size in zfs send dry-run output: %w", err)
+			}
+			return size, nil
+		}
+	}
+	return 0, fmt.Errorf("size not found in zfs send dry-run output")
+}
+
+// Snapshot is a snapshot name with the creation time ZFS recorded for it.
+type Snapshot struct {
+	Name    string
+	Created time.Time
+}
+
+func listSnapshots(pool, dataset string) ([]Snapshot, error) {
 	cmd := exec.Command(
 		"zfs",
 		"list",
 		"-H",
+		"-p",
 		"-o",
-		"name",
+		"name,creation",
 		"-t",
 		"snapshot",
-		fmt.Sprintf("%s/%s", pool, dataset),
+		DatasetPath(pool, dataset),
 	)
 	output, err := cmd.Output()
 	if err != nil {
 		return nil, err
 	}
+	return parseSnapshots(string(output))
+}
 
-	var snapshots []string
-	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
-	for _, line := range lines {
-		parts := strings.SplitN(line, "@", 2)
-		if len(parts) != 2 {
+// parseSnapshots parses `zfs list -H -p -o name,creation` and orders the snapshots newest first.
+// Creation time rather than the name decides, since names embed a clock that may have been wrong.
+func parseSnapshots(output string) ([]Snapshot, error) {
+	var snapshots []Snapshot
+	for line := range strings.SplitSeq(strings.TrimSpace(output), "\n") {
+		if line == "" {
 			continue
 		}
-
-		snapName := parts[1]
-		if prefix != "" && !strings.HasPrefix(snapName, prefix) {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 2 {
 			continue
 		}
-
-		snapshots = append(snapshots, line)
+		if _, err := ParseSnapshotName(fields[0]); err != nil {
+			continue
+		}
+		created, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid creation time of snapshot %s: %w", fields[0], err)
+		}
+		snapshots = append(snapshots, Snapshot{Name: fields[0], Created: time.Unix(created, 0)})
 	}
 
+	// Snapshots taken within the same second fall back to the name.
 	sort.SliceStable(snapshots, func(i, j int) bool {
-		return snapshots[i] > snapshots[j]
+		if !snapshots[i].Created.Equal(snapshots[j].Created) {
+			return snapshots[i].Created.After(snapshots[j].Created)
+		}
+		return snapshots[i].Name > snapshots[j].Name
 	})
+	return snapshots, nil
+}
 
+// ListSnapshots returns the snapshots of pool/dataset whose name starts with prefix, newest first by creation time.
+func ListSnapshots(pool, dataset, prefix string) ([]string, error) {
+	all, err := listSnapshots(pool, dataset)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []string
+	for _, snapshot := range all {
+		name, err := ParseSnapshotName(snapshot.Name)
+		if err != nil {
+			return nil, err
+		}
+		if prefix != "" && !strings.HasPrefix(name.Snap, prefix) {
+			continue
+		}
+		snapshots = append(snapshots, snapshot.Name)
+	}
 	return snapshots, nil
 }
 
+// LatestSnapshotCreation returns the creation time of the newest snapshot of pool/dataset, zero when it has none.
+func LatestSnapshotCreation(pool, dataset string) (time.Time, error) {
+	snapshots, err := listSnapshots(pool, dataset)
+	if err != nil || len(snapshots) == 0 {
+		return time.Time{}, err
+	}
+	return snapshots[0].Created, nil
+}
+
+// CheckDatasetExists returns nil when pool/dataset exists, else an error matching ErrNotFound,
+// ErrPermission or ErrZfsUnavailable when the failure shows which.
 func CheckDatasetExists(pool, dataset string) error {
-	cmd := exec.Command("zfs", "list", "-H", "-o", "name", fmt.Sprintf("%s/%s", pool, dataset))
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("ZFS dataset %s/%s not found or not accessible", pool, dataset)
+	return checkExists("dataset", DatasetPath(pool, dataset))
+}
+
+// CheckPoolExists is CheckDatasetExists for the root dataset of pool.
+func CheckPoolExists(pool string) error {
+	return checkExists("pool", pool)
+}
+
+func checkExists(what, name string) error {
+	_, err := output("list", "-H", "-o", "name", name)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrNotFound):
+		return fmt.Errorf("ZFS %s %s not found: %w", what, name, err)
+	case errors.Is(err, ErrPermission):
+		return fmt.Errorf("no permission to access ZFS %s %s: %w", what, name, err)
+	case errors.Is(err, ErrZfsUnavailable):
+		return fmt.Errorf("cannot check ZFS %s %s, zfs is not available: %w", what, name, err)
+	}
+	return fmt.Errorf("failed to check ZFS %s %s: %w", what, name, err)
+}
+
+// exists reports whether a dataset or snapshot exists, treating only ErrNotFound as absent.
+func exists(name string, extraArgs ...string) (bool, error) {
+	args := append([]string{"list", "-H", "-o", "name"}, extraArgs...)
+	_, err := output(append(args, name)...)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return false, err
+}
+
+func SnapshotExists(snapshot string) (bool, error) {
+	return exists(snapshot, "-t", "snapshot")
+}
+
+func DatasetExists(dataset string) (bool, error) {
+	return exists(dataset)
+}
+
+// DestroyRecursive destroys a dataset together with its snapshots and children.
+func DestroyRecursive(dataset string) error {
+	output, err := exec.Command("zfs", "destroy", "-r", dataset).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("zfs destroy %s failed: %w: %s", dataset, err, strings.TrimSpace(string(output)))
 	}
 	return nil
 }
 
-func CheckPoolExists(pool string) error {
-	cmd := exec.Command("zfs", "list", "-H", "-o", "name", pool)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("ZFS pool %s not found or not accessible", pool)
+// DestroySnapshot destroys a single snapshot, refusing names that are not a snapshot.
+func DestroySnapshot(snapshot string) error {
+	if !strings.Contains(snapshot, "@") {
+		return fmt.Errorf("refusing to destroy %s, which is not a snapshot", snapshot)
+	}
+	output, err := exec.Command("zfs", "destroy", snapshot).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("zfs destroy %s failed: %w: %s", snapshot, err, strings.TrimSpace(string(output)))
 	}
 	return nil
 }
 
-func Hold(tag, snapshot string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	return exec.CommandContext(ctx, "zfs", "hold", tag, snapshot).Run()
+// ReceiveResumeToken returns the receive_resume_token of dataset, empty when no interrupted receive is pending.
+func ReceiveResumeToken(dataset string) (string, error) {
+	output, err := exec.Command("zfs", "get", "-H", "-o", "value", "receive_resume_token", dataset).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to read receive_resume_token of %s: %w: %s", dataset, err, strings.TrimSpace(string(output)))
+	}
+	token := strings.TrimSpace(string(output))
+	if token == "-" {
+		return "", nil
+	}
+	return token, nil
 }
 
-func Release(tag, snapshot string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-	return exec.CommandContext(ctx, "zfs", "release", tag, snapshot).Run()
+// SnapshotGUID returns the guid of snapshot. zfs receive keeps the guid of the sent snapshot, so it
+// tells a received copy from an unrelated snapshot of the same name.
+func SnapshotGUID(snapshot string) (string, error) {
+	return property(snapshot, "guid")
+}
+
+// Written returns the bytes written to the dataset between the previous snapshot and snapshot.
+func Written(snapshot string) (int64, error) {
+	value, err := property(snapshot, "written")
+	if err != nil {
+		return 0, err
+	}
+	written, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected written of %s: %q", snapshot, value)
+	}
+	return written, nil
+}
+
+// property returns the exact (-p) value of a property of a dataset or snapshot.
+func property(name, prop string) (string, error) {
+	out, err := output("get", "-H", "-p", "-o", "value", prop, name)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s of %s: %w", prop, name, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// AbortReceive discards the saved state of an interrupted resumable receive into dataset.
+func AbortReceive(dataset string) error {
+	output, err := exec.Command("zfs", "receive", "-A", dataset).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("zfs receive -A %s failed: %w: %s", dataset, err, strings.TrimSpace(string(output)))
+	}
+	return nil
 }
 
 func CreateSnapshot(pool, dataset, prefix string) error {
-	date := time.Now().Format("2006-01-02_15-04")
-	fullSnapshotName := fmt.Sprintf("%s/%s@%s_%s", pool, dataset, prefix, date)
+	return TakeSnapshot(TimestampedSnapshot(pool, dataset, prefix, time.Now()).String())
+}
 
+// TakeSnapshot creates the snapshot named fullSnapshotName.
+func TakeSnapshot(fullSnapshotName string) error {
 	cmd := exec.Command("zfs", "snapshot", fullSnapshotName)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
 }
+
+// SetProperty sets a property of a dataset.
+func SetProperty(dataset, prop, value string) error {
+	output, err := exec.Command("zfs", "set", prop+"="+value, dataset).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("zfs set %s=%s %s failed: %w: %s", prop, value, dataset, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Mount mounts dataset at its mountpoint unless it is mounted already.
+func Mount(dataset string) error {
+	mounted, err := property(dataset, "mounted")
+	if err != nil {
+		return err
+	}
+	if mounted == "yes" {
+		return nil
+	}
+	output, err := exec.Command("zfs", "mount", dataset).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("zfs mount %s failed: %w: %s", dataset, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
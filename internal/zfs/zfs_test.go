@@ -0,0 +1,103 @@
+package zfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSendSize(t *testing.T) {
+	t.Run("full send", func(t *testing.T) {
+		size, err := parseSendSize("full\tpool/data@snap\t12345\nsize\t12345\n")
+		require.NoError(t, err)
+		assert.Equal(t, int64(12345), size)
+	})
+
+	t.Run("incremental send", func(t *testing.T) {
+		size, err := parseSendSize("incremental\tsnap1\tpool/data@snap2\t4096\nsize\t4096\n")
+		require.NoError(t, err)
+		assert.Equal(t, int64(4096), size)
+	})
+
+	t.Run("missing size", func(t *testing.T) {
+		_, err := parseSendSize("full\tpool/data@snap\t12345\n")
+		assert.Error(t, err)
+	})
+}
+
+func TestParseSnapshots(t *testing.T) {
+	// The clock was behind when level0_2024-06-01 was taken, so its name sorts after the newest snapshot.
+	output := "tank/data@zrb_level0_2024-06-01_00-00\t1700000000\n" +
+		"tank/data@zrb_level0_2024-01-02_00-00\t1704153600\n" +
+		"tank/data@zrb_level0_2024-01-01_00-00\t1704067200\n" +
+		"tank/data@manual\t1704067200\n"
+
+	snapshots, err := parseSnapshots(output)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 4)
+	assert.Equal(t, "tank/data@zrb_level0_2024-01-02_00-00", snapshots[0].Name)
+	assert.Equal(t, time.Unix(1704153600, 0), snapshots[0].Created)
+	assert.Equal(t, "tank/data@zrb_level0_2024-01-01_00-00", snapshots[1].Name, "same second falls back to the name")
+	assert.Equal(t, "tank/data@manual", snapshots[2].Name)
+	assert.Equal(t, "tank/data@zrb_level0_2024-06-01_00-00", snapshots[3].Name)
+
+	_, err = parseSnapshots("tank/data@snap\tyesterday\n")
+	assert.Error(t, err)
+
+	snapshots, err = parseSnapshots("")
+	require.NoError(t, err)
+	assert.Empty(t, snapshots)
+}
+
+func TestSendCommand(t *testing.T) {
+	assert.Equal(t, []string{"zfs", "send", "-L", "tank/data@zrb_level0"}, SendCommand("tank/data@zrb_level0", ""))
+	assert.Equal(t, []string{"zfs", "send", "-L", "-i", "tank/data@zrb_level0", "tank/data@zrb_level1"},
+		SendCommand("tank/data@zrb_level1", "tank/data@zrb_level0"))
+}
+
+func TestStreamFeatures(t *testing.T) {
+	assert.Equal(t, []string{"large_blocks"}, StreamFeatures(SendCommand("tank/data@b", "tank/data@a")))
+	assert.Equal(t, []string{"large_blocks", "embedded_data", "encryption"}, StreamFeatures([]string{"zfs", "send", "-Lec", "-w", "-L", "tank/data@a"}))
+	assert.Empty(t, StreamFeatures([]string{"zfs", "send", "-i", "tank/data@-L", "tank/data@b"}), "the incremental source is not a flag")
+	assert.Empty(t, StreamFeatures(nil), "manifests written before send_args was recorded")
+}
+
+func TestSendAndSplitPartMode(t *testing.T) {
+	bin := t.TempDir()
+	script := "#!/bin/sh\ncase \"$1\" in\nsend) printf 'zfs send stream' ;;\nesac\n"
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "zfs"), []byte(script), 0o755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	dir := t.TempDir()
+	_, n, err := SendAndSplit(context.Background(), "tank/data@a", "", dir, PartSize, 0)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len("zfs send stream")), n)
+	parts, err := filepath.Glob(filepath.Join(dir, "snapshot.part-*"))
+	require.NoError(t, err)
+	require.Len(t, parts, 1)
+	info, err := os.Stat(parts[0])
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm(), "raw parts hold the plaintext stream")
+}
+
+func TestSendAndSplitPartSize(t *testing.T) {
+	bin := t.TempDir()
+	script := "#!/bin/sh\ncase \"$1\" in\nsend) printf 'zfs send stream' ;;\nesac\n"
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "zfs"), []byte(script), 0o755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	dir := t.TempDir()
+	_, _, err := SendAndSplit(context.Background(), "tank/data@a", "", dir, 4, 0)
+	require.NoError(t, err)
+	parts, err := filepath.Glob(filepath.Join(dir, "snapshot.part-*"))
+	require.NoError(t, err)
+	require.Len(t, parts, 4, "15 bytes split at 4")
+	last, err := os.ReadFile(filepath.Join(dir, "snapshot.part-"+PartSuffix(3)))
+	require.NoError(t, err)
+	assert.Equal(t, "eam", string(last))
+}
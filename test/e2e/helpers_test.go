@@ -23,6 +23,8 @@ const (
 	minioAccessKey = "admin"
 	minioSecretKey = "password"
 	minioBucket    = "zrb-test"
+
+	e2eVersion = "e2e-test"
 )
 
 type vm struct {
@@ -103,7 +105,12 @@ func buildBinary(t *testing.T) string {
 	buildDir := "../../build"
 	binary := buildDir + "/zrb_dev"
 
-	cmd := exec.Command("go", "build", "-ldflags=-s -w", "-o", binary, "./../../cmd/zrb")
+	commit, err := exec.Command("git", "rev-parse", "--short", "HEAD").Output()
+	require.NoError(t, err, "failed to read git commit")
+	ldflags := fmt.Sprintf("-s -w -X zrb/internal/version.Version=%s -X zrb/internal/version.Commit=%s -X zrb/internal/version.Date=%s",
+		e2eVersion, strings.TrimSpace(string(commit)), time.Now().UTC().Format(time.RFC3339))
+
+	cmd := exec.Command("go", "build", "-ldflags="+ldflags, "-o", binary, "./../../cmd/zrb")
 	cmd.Env = append(os.Environ(), "GOOS=linux")
 	out, err := cmd.CombinedOutput()
 	require.NoError(t, err, "build failed: %s", string(out))
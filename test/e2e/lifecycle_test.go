@@ -37,6 +37,12 @@ func TestBackupRestoreLifecycle(t *testing.T) {
 		v.mustExec(t, "mc mb --ignore-existing myminio/"+minioBucket)
 	})
 
+	t.Run("Version", func(t *testing.T) {
+		out := v.mustExec(t, remoteBin+" --version")
+		assert.Contains(t, out, e2eVersion)
+		assert.NotContains(t, out, "commit unknown")
+	})
+
 	t.Run("GenerateKeys", func(t *testing.T) {
 		out := v.mustExec(t, remoteBin+" genkey")
 
@@ -0,0 +1,243 @@
+//go:build integration_zfs
+
+// Package integration runs backups and restores against a real ZFS pool backed by a file. It needs
+// root and the zfs kernel module, and skips when either is missing:
+//
+//	sudo -E go test -tags integration_zfs ./test/integration/
+package integration
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"zrb/internal/backup"
+	"zrb/internal/restore"
+	"zrb/internal/util"
+	"zrb/internal/zfs"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pool is the file-backed pool TestMain creates, empty when the tests are skipped.
+var pool string
+
+// skipReason says why there is no pool.
+var skipReason string
+
+func TestMain(m *testing.M) {
+	os.Exit(run(m))
+}
+
+func run(m *testing.M) int {
+	if reason := unavailable(); reason != "" {
+		skipReason = reason
+		return m.Run()
+	}
+
+	dir, err := os.MkdirTemp("", "zrb-integration-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to create pool directory:", err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	vdev := filepath.Join(dir, "vdev")
+	if err := exec.Command("truncate", "-s", "1G", vdev).Run(); err != nil {
+		fmt.Fprintln(os.Stderr, "failed to create pool file:", err)
+		return 1
+	}
+	pool = fmt.Sprintf("zrbtest%d", os.Getpid())
+	out, err := exec.Command("zpool", "create", "-m", filepath.Join(dir, "mnt"), pool, vdev).CombinedOutput()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create pool: %v: %s\n", err, out)
+		return 1
+	}
+	defer func() {
+		if out, err := exec.Command("zpool", "destroy", "-f", pool).CombinedOutput(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to destroy pool %s: %v: %s\n", pool, err, out)
+		}
+	}()
+	return m.Run()
+}
+
+// unavailable returns why a pool cannot be created here, empty when it can.
+func unavailable() string {
+	if os.Geteuid() != 0 {
+		return "needs root to create a pool"
+	}
+	if _, err := exec.LookPath("zpool"); err != nil {
+		return "zpool is not installed"
+	}
+	if _, err := os.Stat("/dev/zfs"); err != nil {
+		return "the zfs kernel module is not loaded"
+	}
+	return ""
+}
+
+func requirePool(t *testing.T) {
+	t.Helper()
+	if pool == "" {
+		t.Skip(skipReason)
+	}
+}
+
+func mustRun(t *testing.T, name string, args ...string) string {
+	t.Helper()
+	out, err := exec.Command(name, args...).CombinedOutput()
+	require.NoError(t, err, "%s %s: %s", name, strings.Join(args, " "), out)
+	return strings.TrimSpace(string(out))
+}
+
+func mountpoint(t *testing.T, dataset string) string {
+	t.Helper()
+	return mustRun(t, "zfs", "get", "-H", "-o", "value", "mountpoint", dataset)
+}
+
+func writeRandom(t *testing.T, path string, size int) {
+	t.Helper()
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+}
+
+// checksums returns the SHA256 of every regular file below root by relative path.
+func checksums(t *testing.T, root string) map[string]string {
+	t.Helper()
+	sums := make(map[string]string)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		sums[rel] = hex.EncodeToString(h.Sum(nil))
+		return nil
+	})
+	require.NoError(t, err)
+	return sums
+}
+
+func TestBackupRestoreChain(t *testing.T) {
+	requirePool(t)
+
+	dataset := "data"
+	source := pool + "/" + dataset
+	target := pool + "/restored"
+	mustRun(t, "zfs", "create", source)
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "key")
+	require.NoError(t, os.WriteFile(keyPath, []byte(identity.String()+"\n"), 0o600))
+
+	baseDir := filepath.Join(dir, "base")
+	configPath := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`base_dir: %s
+age_public_key: %s
+s3:
+  enabled: false
+  bucket: ""
+  region: ""
+  prefix: ""
+  storage_class:
+    manifest: STANDARD
+    backup_data: [STANDARD, STANDARD, STANDARD]
+tasks:
+  - name: t
+    pool: %s
+    dataset: %s
+    enabled: true
+`, baseDir, identity.Recipient(), pool, dataset)), 0o644))
+
+	data := mountpoint(t, source)
+	backupLevel := func(ctx context.Context, level int16) error {
+		return backup.Run(ctx, backup.Options{ConfigPath: configPath, TaskName: "t", Level: level})
+	}
+
+	// Level 0: the initial files
+	writeRandom(t, filepath.Join(data, "a.bin"), 4<<20)
+	writeRandom(t, filepath.Join(data, "dir/b.bin"), 1<<20)
+	require.NoError(t, zfs.CreateSnapshot(pool, dataset, "zrb_level0"))
+	require.NoError(t, backupLevel(context.Background(), 0))
+
+	// Level 1: a changed and a new file; the first run is cancelled while its parts wait on the
+	// pause file, the second resumes from its state
+	writeRandom(t, filepath.Join(data, "a.bin"), 2<<20)
+	writeRandom(t, filepath.Join(data, "dir/c.bin"), 512<<10)
+	require.NoError(t, zfs.CreateSnapshot(pool, dataset, "zrb_level1"))
+
+	runDir := util.RunDir(baseDir, pool, dataset)
+	require.NoError(t, os.MkdirAll(runDir, 0o755))
+	pauseFile := filepath.Join(runDir, "pause")
+	require.NoError(t, os.WriteFile(pauseFile, nil, 0o644))
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() { result <- backupLevel(ctx, 1) }()
+	statePath := filepath.Join(runDir, "backup_state.yaml")
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(statePath)
+		return err == nil
+	}, time.Minute, 10*time.Millisecond, "the send finishes and the state is written")
+	cancel()
+	select {
+	case err := <-result:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Minute):
+		t.Fatal("the cancelled backup did not return")
+	}
+	assert.FileExists(t, statePath, "the interrupted backup is left to resume")
+
+	require.NoError(t, os.Remove(pauseFile))
+	require.NoError(t, backupLevel(context.Background(), 1))
+	assert.NoFileExists(t, statePath, "the resumed backup completed")
+
+	// Level 2: a removed file
+	require.NoError(t, os.Remove(filepath.Join(data, "dir/b.bin")))
+	require.NoError(t, zfs.CreateSnapshot(pool, dataset, "zrb_level2"))
+	require.NoError(t, backupLevel(context.Background(), 2))
+
+	// Restore the chain into another dataset, in order
+	for level := int16(0); level <= 2; level++ {
+		require.NoError(t, restore.Run(context.Background(), restore.Options{
+			ConfigPath:     configPath,
+			TaskName:       "t",
+			Level:          level,
+			Target:         target,
+			PrivateKeyPath: keyPath,
+			Source:         "local",
+			Force:          level > 0,
+		}), "level %d", level)
+	}
+
+	want := checksums(t, data)
+	require.Len(t, want, 2)
+	assert.Equal(t, want, checksums(t, mountpoint(t, target)))
+	snapshots := mustRun(t, "zfs", "list", "-H", "-o", "name", "-t", "snapshot", target)
+	assert.Equal(t, 3, len(strings.Split(snapshots, "\n")), "every level was received")
+}